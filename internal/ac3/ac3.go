@@ -0,0 +1,277 @@
+// Package ac3 contains utilities to work with AC-3 and E-AC-3.
+package ac3
+
+import (
+	"fmt"
+
+	"github.com/aler9/gortsplib/v2/pkg/bits"
+)
+
+// SamplesPerFrame is the number of samples contained in a AC-3 frame.
+const SamplesPerFrame = 1536
+
+var sampleRates = []int{
+	48000,
+	44100,
+	32000,
+}
+
+// E-AC-3 reduced sample rates, used when fscod is 3.
+var reducedSampleRates = []int{
+	24000,
+	22050,
+	16000,
+}
+
+// bitrates of AC-3 frames in kbit/s, indexed by frmsizecod / 2.
+var bitrates = []int{
+	32, 40, 48, 56, 64, 80, 96, 112, 128, 160,
+	192, 224, 256, 320, 384, 448, 512, 576, 640,
+}
+
+var channelCounts = []int{
+	2, // 1+1
+	1, // 1/0
+	2, // 2/0
+	3, // 3/0
+	3, // 2/1
+	4, // 3/1
+	4, // 2/2
+	5, // 3/2
+}
+
+var blockCounts = []int{
+	1,
+	2,
+	3,
+	6,
+}
+
+// Config is the configuration of a AC-3 or E-AC-3 stream,
+// extracted from the header of a syncframe.
+type Config struct {
+	// whether the stream is E-AC-3.
+	Enhanced bool
+
+	SampleRate   int
+	ChannelCount int
+
+	// E-AC-3 only: number of audio blocks per frame.
+	BlockCount int
+
+	// E-AC-3 only: whether the syncframe belongs to a dependent substream,
+	// that carries additional channels of the preceding independent one (i.e. 7.1).
+	Dependent bool
+
+	// raw fields, needed to generate decoder configurations.
+	Fscod       uint8
+	Bsid        uint8
+	Bsmod       uint8
+	Acmod       uint8
+	LFEOn       bool
+	BitRateCode uint8
+	FrameSize   int
+}
+
+func ac3FrameSize(fscod uint8, frmsizecod uint8) (int, error) {
+	if frmsizecod >= 38 {
+		return 0, fmt.Errorf("invalid frmsizecod (%d)", frmsizecod)
+	}
+
+	bitrate := bitrates[frmsizecod>>1]
+
+	// frame size in 16-bit words
+	var words int
+	switch fscod {
+	case 0:
+		words = bitrate * 2
+
+	case 1:
+		words = bitrate*1000*SamplesPerFrame/44100/16 + int(frmsizecod&0x01)
+
+	default:
+		words = bitrate * 3
+	}
+
+	return words * 2, nil
+}
+
+// Unmarshal decodes a Config from the header of a syncframe.
+func (c *Config) Unmarshal(frame []byte) error {
+	if len(frame) < 7 {
+		return fmt.Errorf("invalid size")
+	}
+
+	if frame[0] != 0x0B || frame[1] != 0x77 {
+		return fmt.Errorf("invalid syncword")
+	}
+
+	c.Bsid = frame[5] >> 3
+
+	switch {
+	case c.Bsid <= 8:
+		return c.unmarshalAC3(frame)
+
+	case c.Bsid >= 11 && c.Bsid <= 16:
+		return c.unmarshalEAC3(frame)
+	}
+
+	return fmt.Errorf("unsupported bsid (%d)", c.Bsid)
+}
+
+func (c *Config) unmarshalAC3(frame []byte) error {
+	c.Enhanced = false
+	c.Dependent = false
+	c.BlockCount = 6
+
+	c.Fscod = frame[4] >> 6
+	if int(c.Fscod) >= len(sampleRates) {
+		return fmt.Errorf("invalid fscod (%d)", c.Fscod)
+	}
+	c.SampleRate = sampleRates[c.Fscod]
+
+	frmsizecod := frame[4] & 0x3F
+	var err error
+	c.FrameSize, err = ac3FrameSize(c.Fscod, frmsizecod)
+	if err != nil {
+		return err
+	}
+	c.BitRateCode = frmsizecod >> 1
+
+	c.Bsmod = frame[5] & 0x07
+
+	pos := 6 * 8
+
+	tmp, err := bits.ReadBits(frame, &pos, 3)
+	if err != nil {
+		return err
+	}
+	c.Acmod = uint8(tmp)
+
+	if (c.Acmod&0x01) != 0 && c.Acmod != 1 {
+		pos += 2 // cmixlev
+	}
+	if (c.Acmod & 0x04) != 0 {
+		pos += 2 // surmixlev
+	}
+	if c.Acmod == 2 {
+		pos += 2 // dsurmod
+	}
+
+	c.LFEOn, err = bits.ReadFlag(frame, &pos)
+	if err != nil {
+		return err
+	}
+
+	c.ChannelCount = channelCounts[c.Acmod]
+	if c.LFEOn {
+		c.ChannelCount++
+	}
+
+	return nil
+}
+
+func (c *Config) unmarshalEAC3(frame []byte) error {
+	c.Enhanced = true
+	c.Bsmod = 0
+	c.BitRateCode = 0
+
+	pos := 2 * 8
+
+	strmtyp, err := bits.ReadBits(frame, &pos, 2)
+	if err != nil {
+		return err
+	}
+	c.Dependent = (strmtyp == 1)
+
+	pos += 3 // substreamid
+
+	frmsiz, err := bits.ReadBits(frame, &pos, 11)
+	if err != nil {
+		return err
+	}
+	c.FrameSize = (int(frmsiz) + 1) * 2
+
+	tmp, err := bits.ReadBits(frame, &pos, 2)
+	if err != nil {
+		return err
+	}
+	c.Fscod = uint8(tmp)
+
+	tmp, err = bits.ReadBits(frame, &pos, 2)
+	if err != nil {
+		return err
+	}
+
+	if c.Fscod == 3 {
+		if int(tmp) >= len(reducedSampleRates) {
+			return fmt.Errorf("invalid fscod2 (%d)", tmp)
+		}
+		c.SampleRate = reducedSampleRates[tmp]
+		c.BlockCount = 6
+	} else {
+		c.SampleRate = sampleRates[c.Fscod]
+		c.BlockCount = blockCounts[tmp]
+	}
+
+	tmp, err = bits.ReadBits(frame, &pos, 3)
+	if err != nil {
+		return err
+	}
+	c.Acmod = uint8(tmp)
+
+	c.LFEOn, err = bits.ReadFlag(frame, &pos)
+	if err != nil {
+		return err
+	}
+
+	c.ChannelCount = channelCounts[c.Acmod]
+	if c.LFEOn {
+		c.ChannelCount++
+	}
+
+	return nil
+}
+
+// SamplesPerFrame returns the number of samples contained in a frame.
+func (c Config) SamplesPerFrame() int {
+	if c.Enhanced {
+		return c.BlockCount * 256
+	}
+	return SamplesPerFrame
+}
+
+// SplitFrames splits a buffer into syncframes.
+// E-AC-3 dependent substreams are returned together with the preceding independent syncframe,
+// since they belong to the same access unit.
+func SplitFrames(buf []byte) ([][]byte, error) {
+	var ret [][]byte
+
+	for len(buf) > 0 {
+		var conf Config
+		err := conf.Unmarshal(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if conf.FrameSize > len(buf) {
+			return nil, fmt.Errorf("frame is truncated")
+		}
+
+		if conf.Dependent {
+			if len(ret) == 0 {
+				return nil, fmt.Errorf("dependent substream without a preceding independent substream")
+			}
+
+			// frames are contiguous in buf, therefore the previous frame can be extended.
+			prev := ret[len(ret)-1]
+			ret[len(ret)-1] = prev[:len(prev)+conf.FrameSize]
+		} else {
+			ret = append(ret, buf[:conf.FrameSize])
+		}
+
+		buf = buf[conf.FrameSize:]
+	}
+
+	return ret, nil
+}
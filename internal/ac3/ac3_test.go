@@ -0,0 +1,162 @@
+package ac3
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ac3Frame() []byte {
+	frame := make([]byte, 768)
+	copy(frame, []byte{0x0b, 0x77, 0x00, 0x00, 0x14, 0x40, 0xe1})
+	return frame
+}
+
+func eac3Frame() []byte {
+	frame := make([]byte, 1536)
+	copy(frame, []byte{0x0b, 0x77, 0x02, 0xff, 0x3f, 0x80, 0x00})
+	return frame
+}
+
+func eac3DependentFrame() []byte {
+	frame := eac3Frame()
+	frame[2] |= 0x40
+	return frame
+}
+
+func TestConfigUnmarshal(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		frame []byte
+		conf  Config
+	}{
+		{
+			"ac-3",
+			ac3Frame(),
+			Config{
+				SampleRate:   48000,
+				ChannelCount: 6,
+				BlockCount:   6,
+				Bsid:         8,
+				Acmod:        7,
+				LFEOn:        true,
+				BitRateCode:  10,
+				FrameSize:    768,
+			},
+		},
+		{
+			"e-ac-3",
+			eac3Frame(),
+			Config{
+				Enhanced:     true,
+				SampleRate:   48000,
+				ChannelCount: 6,
+				BlockCount:   6,
+				Bsid:         16,
+				Acmod:        7,
+				LFEOn:        true,
+				FrameSize:    1536,
+			},
+		},
+		{
+			"e-ac-3 dependent",
+			eac3DependentFrame(),
+			Config{
+				Enhanced:     true,
+				SampleRate:   48000,
+				ChannelCount: 6,
+				BlockCount:   6,
+				Dependent:    true,
+				Bsid:         16,
+				Acmod:        7,
+				LFEOn:        true,
+				FrameSize:    1536,
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var conf Config
+			err := conf.Unmarshal(ca.frame)
+			require.NoError(t, err)
+			require.Equal(t, ca.conf, conf)
+			require.Equal(t, 1536, conf.SamplesPerFrame())
+		})
+	}
+}
+
+func TestConfigUnmarshalErrors(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		frame []byte
+		err   string
+	}{
+		{
+			"invalid size",
+			[]byte{0x0b, 0x77},
+			"invalid size",
+		},
+		{
+			"invalid syncword",
+			[]byte{0x0b, 0x78, 0x00, 0x00, 0x14, 0x40, 0xe1},
+			"invalid syncword",
+		},
+		{
+			"unsupported bsid",
+			[]byte{0x0b, 0x77, 0x00, 0x00, 0x14, 0x48, 0xe1},
+			"unsupported bsid (9)",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var conf Config
+			err := conf.Unmarshal(ca.frame)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestSplitFrames(t *testing.T) {
+	frames, err := SplitFrames(append(ac3Frame(), ac3Frame()...))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{ac3Frame(), ac3Frame()}, frames)
+
+	_, err = SplitFrames(ac3Frame()[:500])
+	require.EqualError(t, err, "frame is truncated")
+}
+
+func TestSplitFramesDependent(t *testing.T) {
+	// 7.1 audio: each access unit contains an independent and a dependent substream
+	au := append(eac3Frame(), eac3DependentFrame()...)
+
+	frames, err := SplitFrames(append(append([]byte(nil), au...), au...))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{au, au}, frames)
+
+	_, err = SplitFrames(append(eac3DependentFrame(), eac3Frame()...))
+	require.EqualError(t, err, "dependent substream without a preceding independent substream")
+}
+
+func TestEncoderFragmentation(t *testing.T) {
+	e := &Encoder{
+		PayloadType:           97,
+		SSRC:                  func() *uint32 { v := uint32(0x9dbb7812); return &v }(),
+		InitialSequenceNumber: func() *uint16 { v := uint16(0x44ed); return &v }(),
+		InitialTimestamp:      func() *uint32 { v := uint32(0x88776655); return &v }(),
+		PayloadMaxSize:        500,
+		SampleRate:            48000,
+		SamplesPerFrame:       1536,
+	}
+	e.Init()
+
+	pkts, err := e.Encode([][]byte{ac3Frame()}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(pkts))
+
+	require.Equal(t, []byte{0x01, 0x02}, pkts[0].Payload[:2])
+	require.Equal(t, 500, len(pkts[0].Payload))
+	require.Equal(t, false, pkts[0].Marker)
+
+	require.Equal(t, []byte{0x03, 0x02}, pkts[1].Payload[:2])
+	require.Equal(t, 2+768-498, len(pkts[1].Payload))
+	require.Equal(t, true, pkts[1].Marker)
+	require.Equal(t, uint16(0x44ee), pkts[1].SequenceNumber)
+}
@@ -0,0 +1,54 @@
+package ac3
+
+import (
+	"strconv"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+)
+
+// Format is a AC-3 or E-AC-3 format.
+// RTP encoding follows RFC4184 (AC-3) and RFC4598 (E-AC-3).
+type Format struct {
+	format.Generic
+	Config *Config
+}
+
+// NewFormat allocates a Format.
+func NewFormat(payloadType uint8, conf *Config) *Format {
+	codec := "AC3"
+	if conf.Enhanced {
+		codec = "eac3"
+	}
+
+	f := &Format{
+		Generic: format.Generic{
+			PayloadTyp: payloadType,
+			RTPMap: codec + "/" + strconv.FormatInt(int64(conf.SampleRate), 10) +
+				"/" + strconv.FormatInt(int64(conf.ChannelCount), 10),
+		},
+		Config: conf,
+	}
+	f.Init()
+
+	return f
+}
+
+// String implements format.Format.
+func (t *Format) String() string {
+	if t.Config.Enhanced {
+		return "E-AC-3"
+	}
+	return "AC-3"
+}
+
+// CreateEncoder creates an encoder able to encode the content of the format.
+func (t *Format) CreateEncoder() *Encoder {
+	e := &Encoder{
+		PayloadType:     t.PayloadTyp,
+		Enhanced:        t.Config.Enhanced,
+		SampleRate:      t.Config.SampleRate,
+		SamplesPerFrame: t.Config.SamplesPerFrame(),
+	}
+	e.Init()
+	return e
+}
@@ -0,0 +1,148 @@
+package ac3
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	rtpVersion = 2
+)
+
+func randUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// Encoder is a RTP/AC-3 and RTP/E-AC-3 encoder.
+type Encoder struct {
+	// payload type of packets.
+	PayloadType uint8
+
+	// SSRC of packets (optional).
+	// It defaults to a random value.
+	SSRC *uint32
+
+	// initial sequence number of packets (optional).
+	// It defaults to a random value.
+	InitialSequenceNumber *uint16
+
+	// initial timestamp of packets (optional).
+	// It defaults to a random value.
+	InitialTimestamp *uint32
+
+	// maximum size of packet payloads (optional).
+	// It defaults to 1460.
+	PayloadMaxSize int
+
+	// whether frames are E-AC-3.
+	Enhanced bool
+
+	SampleRate      int
+	SamplesPerFrame int
+
+	sequenceNumber uint16
+}
+
+// Init initializes the encoder.
+func (e *Encoder) Init() {
+	if e.SSRC == nil {
+		v := randUint32()
+		e.SSRC = &v
+	}
+	if e.InitialSequenceNumber == nil {
+		v := uint16(randUint32())
+		e.InitialSequenceNumber = &v
+	}
+	if e.InitialTimestamp == nil {
+		v := randUint32()
+		e.InitialTimestamp = &v
+	}
+	if e.PayloadMaxSize == 0 {
+		e.PayloadMaxSize = 1460 // 1500 (UDP MTU) - 20 (IP header) - 8 (UDP header) - 12 (RTP header)
+	}
+
+	e.sequenceNumber = *e.InitialSequenceNumber
+}
+
+func (e *Encoder) encodeTimestamp(ts time.Duration) uint32 {
+	return *e.InitialTimestamp + uint32(ts.Seconds()*float64(e.SampleRate))
+}
+
+// Encode encodes frames into RTP packets.
+// Each frame is put into a single packet, or fragmented when it is too big.
+func (e *Encoder) Encode(frames [][]byte, pts time.Duration) ([]*rtp.Packet, error) {
+	var rets []*rtp.Packet
+
+	for i, frame := range frames {
+		framePTS := pts + time.Duration(i*e.SamplesPerFrame)*time.Second/time.Duration(e.SampleRate)
+		rets = append(rets, e.encodeFrame(frame, e.encodeTimestamp(framePTS))...)
+	}
+
+	return rets, nil
+}
+
+func (e *Encoder) encodeFrame(frame []byte, ts uint32) []*rtp.Packet {
+	maxFragmentSize := e.PayloadMaxSize - 2
+
+	fragmentCount := len(frame) / maxFragmentSize
+	if (len(frame) % maxFragmentSize) != 0 {
+		fragmentCount++
+	}
+
+	rets := make([]*rtp.Packet, fragmentCount)
+
+	for i := range rets {
+		le := maxFragmentSize
+		if i == (fragmentCount - 1) {
+			le = len(frame)
+		}
+
+		payload := make([]byte, 2+le)
+		payload[0] = e.frameType(i, fragmentCount, le, len(frame))
+		payload[1] = byte(fragmentCount)
+		copy(payload[2:], frame[:le])
+		frame = frame[le:]
+
+		rets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        rtpVersion,
+				PayloadType:    e.PayloadType,
+				SequenceNumber: e.sequenceNumber,
+				Timestamp:      ts,
+				SSRC:           *e.SSRC,
+				Marker:         i == (fragmentCount - 1),
+			},
+			Payload: payload,
+		}
+
+		e.sequenceNumber++
+	}
+
+	return rets
+}
+
+func (e *Encoder) frameType(i int, fragmentCount int, le int, frameLen int) byte {
+	switch {
+	case fragmentCount == 1:
+		return 0 // one or more complete frames
+
+	case i != 0:
+		if e.Enhanced {
+			return 2 // fragment which is not initial
+		}
+		return 3 // fragment which is not initial
+
+	case e.Enhanced:
+		return 1 // initial fragment
+
+	case le*8 >= frameLen*5:
+		return 1 // initial fragment, containing at least 5/8 of the frame
+
+	default:
+		return 2 // initial fragment, containing less than 5/8 of the frame
+	}
+}
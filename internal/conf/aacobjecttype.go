@@ -0,0 +1,66 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+)
+
+// AACObjectTypes is the rtmpAACObjectTypes parameter.
+type AACObjectTypes []mpeg4audio.ObjectType
+
+// MarshalJSON implements json.Marshaler.
+func (d AACObjectTypes) MarshalJSON() ([]byte, error) {
+	out := make([]string, len(d))
+
+	for i, v := range d {
+		switch v {
+		case mpeg4audio.ObjectTypeSBR:
+			out[i] = "he"
+
+		case mpeg4audio.ObjectTypePS:
+			out[i] = "hev2"
+
+		default:
+			out[i] = "lc"
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *AACObjectTypes) UnmarshalJSON(b []byte) error {
+	var in []string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	*d = nil
+
+	for _, v := range in {
+		switch v {
+		case "lc":
+			*d = append(*d, mpeg4audio.ObjectTypeAACLC)
+
+		case "he":
+			*d = append(*d, mpeg4audio.ObjectTypeSBR)
+
+		case "hev2":
+			*d = append(*d, mpeg4audio.ObjectTypePS)
+
+		default:
+			return fmt.Errorf("invalid AAC object type: %s", v)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalEnv implements envUnmarshaler.
+func (d *AACObjectTypes) unmarshalEnv(s string) error {
+	byts, _ := json.Marshal(strings.Split(s, ","))
+	return d.UnmarshalJSON(byts)
+}
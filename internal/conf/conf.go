@@ -12,10 +12,12 @@ import (
 	"time"
 
 	"github.com/aler9/gortsplib/v2"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/headers"
 	"golang.org/x/crypto/nacl/secretbox"
 	"gopkg.in/yaml.v2"
 
+	"github.com/aler9/rtsp-simple-server/internal/hls"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
@@ -201,27 +203,53 @@ type Conf struct {
 	AuthMethods       AuthMethods `json:"authMethods"`
 
 	// RTMP
-	RTMPDisable    bool       `json:"rtmpDisable"`
-	RTMPAddress    string     `json:"rtmpAddress"`
-	RTMPEncryption Encryption `json:"rtmpEncryption"`
-	RTMPSAddress   string     `json:"rtmpsAddress"`
-	RTMPServerKey  string     `json:"rtmpServerKey"`
-	RTMPServerCert string     `json:"rtmpServerCert"`
+	RTMPDisable                          bool           `json:"rtmpDisable"`
+	RTMPAddress                          string         `json:"rtmpAddress"`
+	RTMPEncryption                       Encryption     `json:"rtmpEncryption"`
+	RTMPSAddress                         string         `json:"rtmpsAddress"`
+	RTMPServerKey                        string         `json:"rtmpServerKey"`
+	RTMPServerCert                       string         `json:"rtmpServerCert"`
+	RTMPMaxReaders                       int            `json:"rtmpMaxReaders"`
+	RTMPPacing                           bool           `json:"rtmpPacing"`
+	RTMPAACObjectTypes                   AACObjectTypes `json:"rtmpAACObjectTypes"`
+	RTMPSetupTimeout                     StringDuration `json:"rtmpSetupTimeout"`
+	RTMPMaxPublishBitrate                uint64         `json:"rtmpMaxPublishBitrate"`
+	RTMPMaxPublishBitrateWindow          StringDuration `json:"rtmpMaxPublishBitrateWindow"`
+	RTMPTimestampCorrection              bool           `json:"rtmpTimestampCorrection"`
+	RTMPTimestampCorrectionWarnThreshold StringDuration `json:"rtmpTimestampCorrectionWarnThreshold"`
 
 	// HLS
-	HLSDisable         bool           `json:"hlsDisable"`
-	HLSAddress         string         `json:"hlsAddress"`
-	HLSEncryption      bool           `json:"hlsEncryption"`
-	HLSServerKey       string         `json:"hlsServerKey"`
-	HLSServerCert      string         `json:"hlsServerCert"`
-	HLSAlwaysRemux     bool           `json:"hlsAlwaysRemux"`
-	HLSVariant         HLSVariant     `json:"hlsVariant"`
-	HLSSegmentCount    int            `json:"hlsSegmentCount"`
-	HLSSegmentDuration StringDuration `json:"hlsSegmentDuration"`
-	HLSPartDuration    StringDuration `json:"hlsPartDuration"`
-	HLSSegmentMaxSize  StringSize     `json:"hlsSegmentMaxSize"`
-	HLSAllowOrigin     string         `json:"hlsAllowOrigin"`
-	HLSTrustedProxies  IPsOrCIDRs     `json:"hlsTrustedProxies"`
+	HLSDisable                bool           `json:"hlsDisable"`
+	HLSAddress                string         `json:"hlsAddress"`
+	HLSEncryption             bool           `json:"hlsEncryption"`
+	HLSServerKey              string         `json:"hlsServerKey"`
+	HLSServerCert             string         `json:"hlsServerCert"`
+	HLSAlwaysRemux            bool           `json:"hlsAlwaysRemux"`
+	HLSVariant                HLSVariant     `json:"hlsVariant"`
+	HLSSegmentCount           int            `json:"hlsSegmentCount"`
+	HLSLowLatencySegmentCount int            `json:"hlsLowLatencySegmentCount"`
+	HLSSegmentDuration        StringDuration `json:"hlsSegmentDuration"`
+	HLSSegmentMaxDeviation    StringDuration `json:"hlsSegmentMaxDeviation"`
+	HLSTargetDuration         StringDuration `json:"hlsTargetDuration"`
+	HLSPartDuration           StringDuration `json:"hlsPartDuration"`
+	HLSFragmentDuration       StringDuration `json:"hlsFragmentDuration"`
+	HLSInterleaveFragments    bool           `json:"hlsInterleaveFragments"`
+	HLSInitPerDiscontinuity   bool           `json:"hlsInitPerDiscontinuity"`
+	HLSStallTimeout           StringDuration `json:"hlsStallTimeout"`
+	HLSSegmentMaxSize         StringSize     `json:"hlsSegmentMaxSize"`
+	HLSSegmentRetention       StringDuration `json:"hlsSegmentRetention"`
+	HLSDirectory              string         `json:"hlsDirectory"`
+	HLSSegmentNameTemplate    string         `json:"hlsSegmentNameTemplate"`
+	HLSPartNameTemplate       string         `json:"hlsPartNameTemplate"`
+	HLSProducerReferenceTime  bool           `json:"hlsProducerReferenceTime"`
+	HLSCMAF                   bool           `json:"hlsCMAF"`
+	HLSTranscodeG711          bool           `json:"hlsTranscodeG711"`
+	HLSTranscodeG711FFmpeg    string         `json:"hlsTranscodeG711FFmpeg"`
+	HLSAVSyncThreshold        StringDuration `json:"hlsAVSyncThreshold"`
+	HLSAVSyncCorrection       bool           `json:"hlsAVSyncCorrection"`
+	HLSCompressPlaylists      bool           `json:"hlsCompressPlaylists"`
+	HLSAllowOrigin            string         `json:"hlsAllowOrigin"`
+	HLSTrustedProxies         IPsOrCIDRs     `json:"hlsTrustedProxies"`
 
 	// WebRTC
 	WebRTCDisable           bool       `json:"webrtcDisable"`
@@ -356,6 +384,22 @@ func (conf *Conf) CheckAndFillMissing() error {
 	if conf.RTMPSAddress == "" {
 		conf.RTMPSAddress = ":1936"
 	}
+	if len(conf.RTMPAACObjectTypes) == 0 {
+		conf.RTMPAACObjectTypes = AACObjectTypes{
+			mpeg4audio.ObjectTypeAACLC,
+			mpeg4audio.ObjectTypeSBR,
+			mpeg4audio.ObjectTypePS,
+		}
+	}
+	if conf.RTMPSetupTimeout == 0 {
+		conf.RTMPSetupTimeout = 10 * StringDuration(time.Second)
+	}
+	if conf.RTMPMaxPublishBitrateWindow == 0 {
+		conf.RTMPMaxPublishBitrateWindow = 5 * StringDuration(time.Second)
+	}
+	if conf.RTMPTimestampCorrectionWarnThreshold == 0 {
+		conf.RTMPTimestampCorrectionWarnThreshold = 100 * StringDuration(time.Millisecond)
+	}
 
 	// HLS
 	if conf.HLSAddress == "" {
@@ -376,18 +420,43 @@ func (conf *Conf) CheckAndFillMissing() error {
 	if conf.HLSPartDuration == 0 {
 		conf.HLSPartDuration = 200 * StringDuration(time.Millisecond)
 	}
+	if conf.HLSTranscodeG711FFmpeg == "" {
+		conf.HLSTranscodeG711FFmpeg = "ffmpeg"
+	}
+	if conf.HLSTargetDuration != 0 {
+		if (conf.HLSTargetDuration % StringDuration(time.Second)) != 0 {
+			return fmt.Errorf("HLS target duration must be an integer number of seconds")
+		}
+		if conf.HLSTargetDuration < conf.HLSSegmentDuration {
+			return fmt.Errorf("HLS target duration can't be less than segment duration")
+		}
+	}
 	if conf.HLSSegmentMaxSize == 0 {
 		conf.HLSSegmentMaxSize = 50 * 1024 * 1024
 	}
+	if conf.HLSSegmentNameTemplate == "" {
+		conf.HLSSegmentNameTemplate = hls.MuxerDefaultSegmentNameTemplate
+	}
+	if conf.HLSPartNameTemplate == "" {
+		conf.HLSPartNameTemplate = hls.MuxerDefaultPartNameTemplate
+	}
+	err := hls.ValidateFileNameTemplates(conf.HLSSegmentNameTemplate, conf.HLSPartNameTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid HLS name templates: %v", err)
+	}
 	if conf.HLSAllowOrigin == "" {
 		conf.HLSAllowOrigin = "*"
 	}
 	switch conf.HLSVariant {
 	case HLSVariantLowLatency:
-		if conf.HLSSegmentCount < 7 {
+		if conf.HLSLowLatencySegmentCount != 0 && conf.HLSLowLatencySegmentCount < 7 {
 			return fmt.Errorf("Low-Latency HLS requires at least 7 segments")
 		}
 
+		if (conf.HLSPartDuration * 5 / 4) > conf.HLSSegmentDuration {
+			return fmt.Errorf("Low-Latency HLS requires a part duration that is at most 4/5 of segment duration")
+		}
+
 		if !conf.HLSEncryption {
 			return fmt.Errorf("Low-Latency HLS requires encryption")
 		}
@@ -397,6 +466,14 @@ func (conf *Conf) CheckAndFillMissing() error {
 			return fmt.Errorf("The minimum number of HLS segments is 3")
 		}
 	}
+	if conf.HLSCMAF && conf.HLSVariant == HLSVariantMPEGTS {
+		return fmt.Errorf("CMAF requires the HLS variant to be 'fmp4' or 'lowLatency'")
+	}
+	if conf.HLSCMAF && (conf.HLSSegmentMaxDeviation != 0 || conf.HLSTargetDuration != 0 ||
+		(conf.HLSVariant == HLSVariantLowLatency && conf.HLSStallTimeout != 0)) {
+		return fmt.Errorf("CMAF requires segments to start with a keyframe, therefore it can't be used " +
+			"with 'hlsSegmentMaxDeviation', 'hlsTargetDuration' or 'hlsStallTimeout'")
+	}
 
 	// WebRTC
 	if conf.WebRTCAddress == "" {
@@ -204,6 +204,13 @@ func TestConfErrors(t *testing.T) {
 				"    source: rpiCamera\n",
 			"'rpiCamera' is used as source in two paths ('cam1' and 'cam2')",
 		},
+		{
+			"colliding hls name templates",
+			"hlsSegmentNameTemplate: seg$Number$\n" +
+				"hlsPartNameTemplate: seg$Token$$Number$\n",
+			"invalid HLS name templates: file name templates 'seg$Number$' and " +
+				"'seg$Token$$Number$' can generate the same file name",
+		},
 	} {
 		t.Run(ca.name, func(t *testing.T) {
 			tmpf, err := writeTempFile([]byte(ca.conf))
@@ -39,40 +39,43 @@ type PathConf struct {
 	Regexp *regexp.Regexp `json:"-"`
 
 	// source
-	Source                     string         `json:"source"`
-	SourceProtocol             SourceProtocol `json:"sourceProtocol"`
-	SourceAnyPortEnable        bool           `json:"sourceAnyPortEnable"`
-	SourceFingerprint          string         `json:"sourceFingerprint"`
-	SourceOnDemand             bool           `json:"sourceOnDemand"`
-	SourceOnDemandStartTimeout StringDuration `json:"sourceOnDemandStartTimeout"`
-	SourceOnDemandCloseAfter   StringDuration `json:"sourceOnDemandCloseAfter"`
-	SourceRedirect             string         `json:"sourceRedirect"`
-	DisablePublisherOverride   bool           `json:"disablePublisherOverride"`
-	Fallback                   string         `json:"fallback"`
-	RPICameraCamID             int            `json:"rpiCameraCamID"`
-	RPICameraWidth             int            `json:"rpiCameraWidth"`
-	RPICameraHeight            int            `json:"rpiCameraHeight"`
-	RPICameraHFlip             bool           `json:"rpiCameraHFlip"`
-	RPICameraVFlip             bool           `json:"rpiCameraVFlip"`
-	RPICameraBrightness        float64        `json:"rpiCameraBrightness"`
-	RPICameraContrast          float64        `json:"rpiCameraContrast"`
-	RPICameraSaturation        float64        `json:"rpiCameraSaturation"`
-	RPICameraSharpness         float64        `json:"rpiCameraSharpness"`
-	RPICameraExposure          string         `json:"rpiCameraExposure"`
-	RPICameraAWB               string         `json:"rpiCameraAWB"`
-	RPICameraDenoise           string         `json:"rpiCameraDenoise"`
-	RPICameraShutter           int            `json:"rpiCameraShutter"`
-	RPICameraMetering          string         `json:"rpiCameraMetering"`
-	RPICameraGain              float64        `json:"rpiCameraGain"`
-	RPICameraEV                float64        `json:"rpiCameraEV"`
-	RPICameraROI               string         `json:"rpiCameraROI"`
-	RPICameraTuningFile        string         `json:"rpiCameraTuningFile"`
-	RPICameraMode              string         `json:"rpiCameraMode"`
-	RPICameraFPS               int            `json:"rpiCameraFPS"`
-	RPICameraIDRPeriod         int            `json:"rpiCameraIDRPeriod"`
-	RPICameraBitrate           int            `json:"rpiCameraBitrate"`
-	RPICameraProfile           string         `json:"rpiCameraProfile"`
-	RPICameraLevel             string         `json:"rpiCameraLevel"`
+	Source                      string         `json:"source"`
+	SourceProtocol              SourceProtocol `json:"sourceProtocol"`
+	SourceAnyPortEnable         bool           `json:"sourceAnyPortEnable"`
+	SourceFingerprint           string         `json:"sourceFingerprint"`
+	SourceOnDemand              bool           `json:"sourceOnDemand"`
+	SourceOnDemandStartTimeout  StringDuration `json:"sourceOnDemandStartTimeout"`
+	SourceOnDemandCloseAfter    StringDuration `json:"sourceOnDemandCloseAfter"`
+	SourceRedirect              string         `json:"sourceRedirect"`
+	DisablePublisherOverride    bool           `json:"disablePublisherOverride"`
+	Fallback                    string         `json:"fallback"`
+	SkipDecodeErrors            bool           `json:"skipDecodeErrors"`
+	H265MaxPacketsWithoutMarker int            `json:"h265MaxPacketsWithoutMarker"`
+	H265EncodeTimeout           StringDuration `json:"h265EncodeTimeout"`
+	RPICameraCamID              int            `json:"rpiCameraCamID"`
+	RPICameraWidth              int            `json:"rpiCameraWidth"`
+	RPICameraHeight             int            `json:"rpiCameraHeight"`
+	RPICameraHFlip              bool           `json:"rpiCameraHFlip"`
+	RPICameraVFlip              bool           `json:"rpiCameraVFlip"`
+	RPICameraBrightness         float64        `json:"rpiCameraBrightness"`
+	RPICameraContrast           float64        `json:"rpiCameraContrast"`
+	RPICameraSaturation         float64        `json:"rpiCameraSaturation"`
+	RPICameraSharpness          float64        `json:"rpiCameraSharpness"`
+	RPICameraExposure           string         `json:"rpiCameraExposure"`
+	RPICameraAWB                string         `json:"rpiCameraAWB"`
+	RPICameraDenoise            string         `json:"rpiCameraDenoise"`
+	RPICameraShutter            int            `json:"rpiCameraShutter"`
+	RPICameraMetering           string         `json:"rpiCameraMetering"`
+	RPICameraGain               float64        `json:"rpiCameraGain"`
+	RPICameraEV                 float64        `json:"rpiCameraEV"`
+	RPICameraROI                string         `json:"rpiCameraROI"`
+	RPICameraTuningFile         string         `json:"rpiCameraTuningFile"`
+	RPICameraMode               string         `json:"rpiCameraMode"`
+	RPICameraFPS                int            `json:"rpiCameraFPS"`
+	RPICameraIDRPeriod          int            `json:"rpiCameraIDRPeriod"`
+	RPICameraBitrate            int            `json:"rpiCameraBitrate"`
+	RPICameraProfile            string         `json:"rpiCameraProfile"`
+	RPICameraLevel              string         `json:"rpiCameraLevel"`
 
 	// authentication
 	PublishUser Credential `json:"publishUser"`
@@ -244,6 +247,14 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		pconf.SourceOnDemandCloseAfter = 10 * StringDuration(time.Second)
 	}
 
+	if pconf.H265MaxPacketsWithoutMarker < 0 {
+		return fmt.Errorf("'h265MaxPacketsWithoutMarker' can't be negative")
+	}
+
+	if pconf.H265EncodeTimeout < 0 {
+		return fmt.Errorf("'h265EncodeTimeout' can't be negative")
+	}
+
 	if pconf.Fallback != "" {
 		if strings.HasPrefix(pconf.Fallback, "/") {
 			err := IsValidPathName(pconf.Fallback[1:])
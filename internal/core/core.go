@@ -17,6 +17,7 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rlimit"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp"
 )
 
 var version = "v0.0.0"
@@ -35,6 +36,7 @@ type Core struct {
 	pathManager     *pathManager
 	rtspServer      *rtspServer
 	rtspsServer     *rtspServer
+	rtmpPlayLimiter *rtmp.PlayLimiter
 	rtmpServer      *rtmpServer
 	rtmpsServer     *rtmpServer
 	hlsServer       *hlsServer
@@ -313,6 +315,13 @@ func (p *Core) createResources(initial bool) error {
 		}
 	}
 
+	// the limit of readers is shared by the RTMP and RTMPS servers
+	if !p.conf.RTMPDisable && p.conf.RTMPMaxReaders > 0 {
+		if p.rtmpPlayLimiter == nil {
+			p.rtmpPlayLimiter = rtmp.NewPlayLimiter(p.conf.RTMPMaxReaders)
+		}
+	}
+
 	if !p.conf.RTMPDisable &&
 		(p.conf.RTMPEncryption == conf.EncryptionNo ||
 			p.conf.RTMPEncryption == conf.EncryptionOptional) {
@@ -328,6 +337,14 @@ func (p *Core) createResources(initial bool) error {
 				"",
 				"",
 				p.conf.RTSPAddress,
+				p.rtmpPlayLimiter,
+				p.conf.RTMPPacing,
+				p.conf.RTMPAACObjectTypes,
+				p.conf.RTMPSetupTimeout,
+				p.conf.RTMPMaxPublishBitrate,
+				p.conf.RTMPMaxPublishBitrateWindow,
+				p.conf.RTMPTimestampCorrection,
+				p.conf.RTMPTimestampCorrectionWarnThreshold,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
 				p.externalCmdPool,
@@ -356,6 +373,14 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.RTMPServerCert,
 				p.conf.RTMPServerKey,
 				p.conf.RTSPAddress,
+				p.rtmpPlayLimiter,
+				p.conf.RTMPPacing,
+				p.conf.RTMPAACObjectTypes,
+				p.conf.RTMPSetupTimeout,
+				p.conf.RTMPMaxPublishBitrate,
+				p.conf.RTMPMaxPublishBitrateWindow,
+				p.conf.RTMPTimestampCorrection,
+				p.conf.RTMPTimestampCorrectionWarnThreshold,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
 				p.externalCmdPool,
@@ -381,9 +406,27 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.HLSAlwaysRemux,
 				p.conf.HLSVariant,
 				p.conf.HLSSegmentCount,
+				p.conf.HLSLowLatencySegmentCount,
 				p.conf.HLSSegmentDuration,
+				p.conf.HLSSegmentMaxDeviation,
+				p.conf.HLSTargetDuration,
 				p.conf.HLSPartDuration,
+				p.conf.HLSFragmentDuration,
+				p.conf.HLSInterleaveFragments,
+				p.conf.HLSInitPerDiscontinuity,
+				p.conf.HLSStallTimeout,
 				p.conf.HLSSegmentMaxSize,
+				p.conf.HLSSegmentRetention,
+				p.conf.HLSDirectory,
+				p.conf.HLSSegmentNameTemplate,
+				p.conf.HLSPartNameTemplate,
+				p.conf.HLSProducerReferenceTime,
+				p.conf.HLSCMAF,
+				p.conf.HLSTranscodeG711,
+				p.conf.HLSTranscodeG711FFmpeg,
+				p.conf.HLSAVSyncThreshold,
+				p.conf.HLSAVSyncCorrection,
+				p.conf.HLSCompressPlaylists,
 				p.conf.HLSAllowOrigin,
 				p.conf.HLSTrustedProxies,
 				p.conf.ReadBufferCount,
@@ -515,6 +558,10 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		closeMetrics ||
 		closePathManager
 
+	closeRTMPPlayLimiter := newConf == nil ||
+		newConf.RTMPDisable != p.conf.RTMPDisable ||
+		newConf.RTMPMaxReaders != p.conf.RTMPMaxReaders
+
 	closeRTMPServer := newConf == nil ||
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPEncryption != p.conf.RTMPEncryption ||
@@ -523,6 +570,14 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.ReadTimeout != p.conf.ReadTimeout ||
 		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
+		closeRTMPPlayLimiter ||
+		newConf.RTMPPacing != p.conf.RTMPPacing ||
+		!reflect.DeepEqual(newConf.RTMPAACObjectTypes, p.conf.RTMPAACObjectTypes) ||
+		newConf.RTMPSetupTimeout != p.conf.RTMPSetupTimeout ||
+		newConf.RTMPMaxPublishBitrate != p.conf.RTMPMaxPublishBitrate ||
+		newConf.RTMPMaxPublishBitrateWindow != p.conf.RTMPMaxPublishBitrateWindow ||
+		newConf.RTMPTimestampCorrection != p.conf.RTMPTimestampCorrection ||
+		newConf.RTMPTimestampCorrectionWarnThreshold != p.conf.RTMPTimestampCorrectionWarnThreshold ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		newConf.RunOnConnect != p.conf.RunOnConnect ||
 		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
@@ -539,6 +594,14 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.RTMPServerCert != p.conf.RTMPServerCert ||
 		newConf.RTMPServerKey != p.conf.RTMPServerKey ||
+		closeRTMPPlayLimiter ||
+		newConf.RTMPPacing != p.conf.RTMPPacing ||
+		!reflect.DeepEqual(newConf.RTMPAACObjectTypes, p.conf.RTMPAACObjectTypes) ||
+		newConf.RTMPSetupTimeout != p.conf.RTMPSetupTimeout ||
+		newConf.RTMPMaxPublishBitrate != p.conf.RTMPMaxPublishBitrate ||
+		newConf.RTMPMaxPublishBitrateWindow != p.conf.RTMPMaxPublishBitrateWindow ||
+		newConf.RTMPTimestampCorrection != p.conf.RTMPTimestampCorrection ||
+		newConf.RTMPTimestampCorrectionWarnThreshold != p.conf.RTMPTimestampCorrectionWarnThreshold ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		newConf.RunOnConnect != p.conf.RunOnConnect ||
 		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
@@ -555,9 +618,27 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.HLSAlwaysRemux != p.conf.HLSAlwaysRemux ||
 		newConf.HLSVariant != p.conf.HLSVariant ||
 		newConf.HLSSegmentCount != p.conf.HLSSegmentCount ||
+		newConf.HLSLowLatencySegmentCount != p.conf.HLSLowLatencySegmentCount ||
 		newConf.HLSSegmentDuration != p.conf.HLSSegmentDuration ||
+		newConf.HLSSegmentMaxDeviation != p.conf.HLSSegmentMaxDeviation ||
+		newConf.HLSTargetDuration != p.conf.HLSTargetDuration ||
 		newConf.HLSPartDuration != p.conf.HLSPartDuration ||
+		newConf.HLSFragmentDuration != p.conf.HLSFragmentDuration ||
+		newConf.HLSInterleaveFragments != p.conf.HLSInterleaveFragments ||
+		newConf.HLSInitPerDiscontinuity != p.conf.HLSInitPerDiscontinuity ||
+		newConf.HLSStallTimeout != p.conf.HLSStallTimeout ||
 		newConf.HLSSegmentMaxSize != p.conf.HLSSegmentMaxSize ||
+		newConf.HLSSegmentRetention != p.conf.HLSSegmentRetention ||
+		newConf.HLSDirectory != p.conf.HLSDirectory ||
+		newConf.HLSSegmentNameTemplate != p.conf.HLSSegmentNameTemplate ||
+		newConf.HLSPartNameTemplate != p.conf.HLSPartNameTemplate ||
+		newConf.HLSProducerReferenceTime != p.conf.HLSProducerReferenceTime ||
+		newConf.HLSCMAF != p.conf.HLSCMAF ||
+		newConf.HLSTranscodeG711 != p.conf.HLSTranscodeG711 ||
+		newConf.HLSTranscodeG711FFmpeg != p.conf.HLSTranscodeG711FFmpeg ||
+		newConf.HLSAVSyncThreshold != p.conf.HLSAVSyncThreshold ||
+		newConf.HLSAVSyncCorrection != p.conf.HLSAVSyncCorrection ||
+		newConf.HLSCompressPlaylists != p.conf.HLSCompressPlaylists ||
 		newConf.HLSAllowOrigin != p.conf.HLSAllowOrigin ||
 		!reflect.DeepEqual(newConf.HLSTrustedProxies, p.conf.HLSTrustedProxies) ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
@@ -639,6 +720,10 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		p.rtmpServer = nil
 	}
 
+	if closeRTMPPlayLimiter {
+		p.rtmpPlayLimiter = nil
+	}
+
 	if closePPROF && p.pprof != nil {
 		p.pprof.close()
 		p.pprof = nil
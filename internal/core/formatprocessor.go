@@ -1,20 +1,80 @@
 package core
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+type formatProcessorParent interface {
+	log(logger.Level, string, ...interface{})
+}
+
 type formatProcessor interface {
 	process(data, bool) error
 }
 
-func newFormatProcessor(forma format.Format, generateRTPPackets bool) (formatProcessor, error) {
+// formatProcessorReencoder is implemented by format processors that
+// re-encode RTP packets when they exceed the maximum size.
+type formatProcessorReencoder interface {
+	reencodeStats() (bool, uint64)
+}
+
+// formatProcessorCloser is implemented by format processors that
+// allocate resources that must be released when the stream is closed.
+type formatProcessorCloser interface {
+	close()
+}
+
+// formatProcessorReencodeStats keeps track of the re-encoding of RTP packets.
+// It is read by the API while packets are being processed.
+type formatProcessorReencodeStats struct {
+	reencoding       int32
+	reencodedPackets uint64
+}
+
+func (s *formatProcessorReencodeStats) startReencoding() {
+	atomic.StoreInt32(&s.reencoding, 1)
+}
+
+// onPacketsEncoded counts packets generated by the encoder.
+// Packets generated for sources that don't use RTP are not re-encoded, therefore they are not counted.
+func (s *formatProcessorReencodeStats) onPacketsEncoded(n int) {
+	if atomic.LoadInt32(&s.reencoding) == 1 {
+		atomic.AddUint64(&s.reencodedPackets, uint64(n))
+	}
+}
+
+// reencodeStats returns whether RTP packets are being re-encoded,
+// and the number of packets that have been generated by re-encoding.
+func (s *formatProcessorReencodeStats) reencodeStats() (bool, uint64) {
+	return atomic.LoadInt32(&s.reencoding) == 1, atomic.LoadUint64(&s.reencodedPackets)
+}
+
+func newFormatProcessor(
+	forma format.Format,
+	generateRTPPackets bool,
+	skipDecodeErrors bool,
+	h265MaxPacketsWithoutMarker int,
+	h265EncodeTimeout time.Duration,
+	parent formatProcessorParent,
+) (formatProcessor, error) {
 	switch forma := forma.(type) {
 	case *format.H264:
-		return newFormatProcessorH264(forma, generateRTPPackets)
+		return newFormatProcessorH264(forma, generateRTPPackets, skipDecodeErrors, parent)
 
 	case *format.H265:
-		return newFormatProcessorH265(forma, generateRTPPackets)
+		return newFormatProcessorH265(
+			forma,
+			generateRTPPackets,
+			skipDecodeErrors,
+			h265MaxPacketsWithoutMarker,
+			h265EncodeTimeout,
+			parent)
 
 	case *format.VP8:
 		return newFormatProcessorVP8(forma, generateRTPPackets)
@@ -25,7 +85,13 @@ func newFormatProcessor(forma format.Format, generateRTPPackets bool) (formatPro
 	case *format.MPEG4Audio:
 		return newFormatProcessorMPEG4Audio(forma, generateRTPPackets)
 
+	case *ac3.Format:
+		return newFormatProcessorAC3(forma, generateRTPPackets)
+
 	default:
+		if codec := findFormatProcessorCodec(forma); codec != nil {
+			return newFormatProcessorCustom(forma, codec, generateRTPPackets)
+		}
 		return newFormatProcessorGeneric(forma, generateRTPPackets)
 	}
 }
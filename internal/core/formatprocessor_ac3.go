@@ -0,0 +1,61 @@
+package core
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+)
+
+type dataAC3 struct {
+	rtpPackets []*rtp.Packet
+	ntp        time.Time
+	pts        time.Duration
+	frames     [][]byte
+}
+
+func (d *dataAC3) getRTPPackets() []*rtp.Packet {
+	return d.rtpPackets
+}
+
+func (d *dataAC3) getNTP() time.Time {
+	return d.ntp
+}
+
+type formatProcessorAC3 struct {
+	format  *ac3.Format
+	encoder *ac3.Encoder
+}
+
+func newFormatProcessorAC3(
+	forma *ac3.Format,
+	allocateEncoder bool,
+) (*formatProcessorAC3, error) {
+	t := &formatProcessorAC3{
+		format: forma,
+	}
+
+	if allocateEncoder {
+		t.encoder = forma.CreateEncoder()
+	}
+
+	return t, nil
+}
+
+func (t *formatProcessorAC3) process(dat data, hasNonRTSPReaders bool) error {
+	tdata := dat.(*dataAC3)
+
+	// AC-3 formats are only produced by sources that provide frames
+	if tdata.rtpPackets != nil {
+		return nil
+	}
+
+	pkts, err := t.encoder.Encode(tdata.frames, tdata.pts)
+	if err != nil {
+		return err
+	}
+
+	tdata.rtpPackets = pkts
+	return nil
+}
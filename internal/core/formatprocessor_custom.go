@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/pion/rtp"
+)
+
+// rtpPacketizer encodes units of a custom codec into RTP packets.
+type rtpPacketizer interface {
+	Encode(unit interface{}, pts time.Duration) ([]*rtp.Packet, error)
+}
+
+// formatProcessorCodec adds support for a codec to the format processors,
+// by providing a RTP packetizer for the formats it matches,
+// without modifying the built-in processors.
+// RTP packets of these formats are routed as is, since readers can't consume decoded units.
+type formatProcessorCodec struct {
+	// checks whether the codec handles a format,
+	// i.e. a *format.Generic with a given RTPMap.
+	match func(format.Format) bool
+
+	// can be nil when the codec doesn't support the generation of RTP packets.
+	newPacketizer func(format.Format) rtpPacketizer
+}
+
+var formatProcessorCodecs []formatProcessorCodec
+
+// registerFormatProcessorCodec registers a codec. Registered codecs are used for formats
+// that are not handled by the built-in processors, and are checked in order of registration.
+// It must be called before any format processor is created, i.e. in init().
+func registerFormatProcessorCodec(c formatProcessorCodec) {
+	formatProcessorCodecs = append(formatProcessorCodecs, c)
+}
+
+func findFormatProcessorCodec(forma format.Format) *formatProcessorCodec {
+	for i, c := range formatProcessorCodecs {
+		if c.match(forma) {
+			return &formatProcessorCodecs[i]
+		}
+	}
+	return nil
+}
+
+type dataCustom struct {
+	rtpPackets []*rtp.Packet
+	ntp        time.Time
+	pts        time.Duration
+	unit       interface{}
+}
+
+func (d *dataCustom) getRTPPackets() []*rtp.Packet {
+	return d.rtpPackets
+}
+
+func (d *dataCustom) getNTP() time.Time {
+	return d.ntp
+}
+
+type formatProcessorCustom struct {
+	packetizer rtpPacketizer
+}
+
+func newFormatProcessorCustom(
+	forma format.Format,
+	codec *formatProcessorCodec,
+	generateRTPPackets bool,
+) (*formatProcessorCustom, error) {
+	t := &formatProcessorCustom{}
+
+	if generateRTPPackets {
+		if codec.newPacketizer == nil {
+			return nil, fmt.Errorf("we don't know how to generate RTP packets of format %+v", forma)
+		}
+		t.packetizer = codec.newPacketizer(forma)
+	}
+
+	return t, nil
+}
+
+func (t *formatProcessorCustom) process(dat data, hasNonRTSPReaders bool) error {
+	tdata := dat.(*dataCustom)
+
+	if tdata.rtpPackets != nil {
+		pkt := tdata.rtpPackets[0]
+
+		// remove padding
+		pkt.Header.Padding = false
+		pkt.PaddingSize = 0
+
+		if pkt.MarshalSize() > maxPacketSize {
+			return fmt.Errorf("payload size (%d) is greater than maximum allowed (%d)",
+				pkt.MarshalSize(), maxPacketSize)
+		}
+
+		// route packet as is
+		return nil
+	}
+
+	pkts, err := t.packetizer.Encode(tdata.unit, tdata.pts)
+	if err != nil {
+		return err
+	}
+
+	tdata.rtpPackets = pkts
+	return nil
+}
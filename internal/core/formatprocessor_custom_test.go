@@ -0,0 +1,107 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+type testRTPPacketizer struct{}
+
+func (testRTPPacketizer) Encode(unit interface{}, pts time.Duration) ([]*rtp.Packet, error) {
+	return []*rtp.Packet{{
+		Header: rtp.Header{
+			Version:   2,
+			Marker:    true,
+			Timestamp: uint32(pts * 90000 / time.Second),
+		},
+		Payload: unit.([]byte),
+	}}, nil
+}
+
+func TestFormatProcessorCustom(t *testing.T) {
+	prev := formatProcessorCodecs
+	defer func() {
+		formatProcessorCodecs = prev
+	}()
+
+	registerFormatProcessorCodec(formatProcessorCodec{
+		match: func(forma format.Format) bool {
+			tforma, ok := forma.(*format.Generic)
+			return ok && tforma.RTPMap == "x-custom/90000"
+		},
+		newPacketizer: func(format.Format) rtpPacketizer {
+			return testRTPPacketizer{}
+		},
+	})
+
+	forma := &format.Generic{
+		PayloadTyp: 96,
+		RTPMap:     "x-custom/90000",
+	}
+	err := forma.Init()
+	require.NoError(t, err)
+
+	p, err := newFormatProcessor(forma, false, false, 0, 0, testFormatProcessorParent{})
+	require.NoError(t, err)
+	require.IsType(t, &formatProcessorCustom{}, p)
+
+	// RTP packets are routed as is
+	data := &dataCustom{
+		rtpPackets: []*rtp.Packet{{
+			Header: rtp.Header{
+				Version: 2,
+				Marker:  true,
+			},
+			Payload: []byte{0x01, 0x02},
+		}},
+	}
+	err = p.process(data, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(data.rtpPackets))
+	require.Equal(t, []byte{0x01, 0x02}, data.rtpPackets[0].Payload)
+
+	// RTP packets are generated by the packetizer
+	p, err = newFormatProcessor(forma, true, false, 0, 0, testFormatProcessorParent{})
+	require.NoError(t, err)
+
+	data = &dataCustom{
+		unit: []byte{0x05, 0x06},
+		pts:  2 * time.Second,
+	}
+	err = p.process(data, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(data.rtpPackets))
+	require.Equal(t, uint32(180000), data.rtpPackets[0].Timestamp)
+
+	// formats that are not matched are handled by the generic processor
+	p, err = newFormatProcessor(&format.Generic{
+		PayloadTyp: 97,
+		RTPMap:     "x-other/90000",
+	}, false, false, 0, 0, testFormatProcessorParent{})
+	require.NoError(t, err)
+	require.IsType(t, &formatProcessorGeneric{}, p)
+}
+
+func TestFormatProcessorCustomWithoutPacketizer(t *testing.T) {
+	prev := formatProcessorCodecs
+	defer func() {
+		formatProcessorCodecs = prev
+	}()
+
+	registerFormatProcessorCodec(formatProcessorCodec{
+		match: func(forma format.Format) bool {
+			_, ok := forma.(*format.Generic)
+			return ok
+		},
+	})
+
+	_, err := newFormatProcessor(&format.Generic{
+		PayloadTyp: 96,
+		RTPMap:     "x-custom/90000",
+	}, true, false, 0, 0, testFormatProcessorParent{})
+	require.Error(t, err)
+}
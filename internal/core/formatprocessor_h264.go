@@ -2,12 +2,15 @@ package core
 
 import (
 	"bytes"
+	"fmt"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
 	"github.com/pion/rtp"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 // extract SPS and PPS without decoding RTP packets
@@ -72,6 +75,16 @@ type dataH264 struct {
 	ntp        time.Time
 	pts        time.Duration
 	nalus      [][]byte
+
+	// filled by sources that already know whether nalus contain an IDR,
+	// in order to allow readers to skip scanning them.
+	idrKnown   bool
+	idrPresent bool
+
+	// filled by sources that already know the DTS of nalus,
+	// in order to preserve the decoding order of B-frames.
+	dtsKnown bool
+	dts      time.Duration
 }
 
 func (d *dataH264) getRTPPackets() []*rtp.Packet {
@@ -83,18 +96,27 @@ func (d *dataH264) getNTP() time.Time {
 }
 
 type formatProcessorH264 struct {
-	format *format.H264
+	format           *format.H264
+	skipDecodeErrors bool
+	parent           formatProcessorParent
 
-	encoder *rtph264.Encoder
-	decoder *rtph264.Decoder
+	formatProcessorReencodeStats
+
+	encoder             *rtph264.Encoder
+	decoder             *rtph264.Decoder
+	waitingRandomAccess bool
 }
 
 func newFormatProcessorH264(
 	forma *format.H264,
 	allocateEncoder bool,
+	skipDecodeErrors bool,
+	parent formatProcessorParent,
 ) (*formatProcessorH264, error) {
 	t := &formatProcessorH264{
-		format: forma,
+		format:           forma,
+		skipDecodeErrors: skipDecodeErrors,
+		parent:           parent,
 	}
 
 	if allocateEncoder {
@@ -138,11 +160,13 @@ func (t *formatProcessorH264) updateTrackParametersFromNALUs(nalus [][]byte) {
 // compatible with all protocols.
 func (t *formatProcessorH264) remuxNALUs(nalus [][]byte) [][]byte {
 	addSPSPPS := false
+	paramsPresent := false
 	n := 0
 	for _, nalu := range nalus {
 		typ := h264.NALUType(nalu[0] & 0x1F)
 		switch typ {
 		case h264.NALUTypeSPS, h264.NALUTypePPS:
+			paramsPresent = true
 			continue
 		case h264.NALUTypeAccessUnitDelimiter:
 			continue
@@ -157,6 +181,15 @@ func (t *formatProcessorH264) remuxNALUs(nalus [][]byte) [][]byte {
 	}
 
 	if n == 0 {
+		// keep groups that contain parameters only, since they are used
+		// to signal parameter changes in-band.
+		if paramsPresent {
+			sps := t.format.SafeSPS()
+			pps := t.format.SafePPS()
+			if sps != nil && pps != nil {
+				return [][]byte{sps, pps}
+			}
+		}
 		return nil
 	}
 
@@ -188,6 +221,18 @@ func (t *formatProcessorH264) remuxNALUs(nalus [][]byte) [][]byte {
 	return filteredNALUs
 }
 
+// skipDecodeError drops the access unit that couldn't be decoded and
+// waits for the next random access point.
+// The error is returned only once, in order to be logged.
+func (t *formatProcessorH264) skipDecodeError(err error) error {
+	if t.waitingRandomAccess {
+		return nil
+	}
+
+	t.waitingRandomAccess = true
+	return fmt.Errorf("unable to decode access unit, waiting for next random access point: %v", err)
+}
+
 func (t *formatProcessorH264) process(dat data, hasNonRTSPReaders bool) error { //nolint:dupl
 	tdata := dat.(*dataH264)
 
@@ -202,6 +247,10 @@ func (t *formatProcessorH264) process(dat data, hasNonRTSPReaders bool) error {
 
 			// RTP packets exceed maximum size: start re-encoding them
 			if pkt.MarshalSize() > maxPacketSize {
+				t.parent.log(logger.Info, "RTP packets of the H264 track exceed maximum size (%d > %d), re-encoding them",
+					pkt.MarshalSize(), maxPacketSize)
+				t.startReencoding()
+
 				v1 := pkt.SSRC
 				v2 := pkt.SequenceNumber
 				v3 := pkt.Timestamp
@@ -232,9 +281,23 @@ func (t *formatProcessorH264) process(dat data, hasNonRTSPReaders bool) error {
 				if err == rtph264.ErrNonStartingPacketAndNoPrevious || err == rtph264.ErrMorePacketsNeeded {
 					return nil
 				}
+
+				if t.skipDecodeErrors {
+					return t.skipDecodeError(err)
+				}
+
 				return err
 			}
 
+			// the access unit following a decode error may reference the
+			// dropped one: skip access units until a random access point.
+			if t.waitingRandomAccess {
+				if !h264.IDRPresent(nalus) {
+					return nil
+				}
+				t.waitingRandomAccess = false
+			}
+
 			tdata.nalus = nalus
 			tdata.pts = pts
 
@@ -255,6 +318,8 @@ func (t *formatProcessorH264) process(dat data, hasNonRTSPReaders bool) error {
 		return err
 	}
 
+	t.onPacketsEncoded(len(pkts))
+
 	tdata.rtpPackets = pkts
 	return nil
 }
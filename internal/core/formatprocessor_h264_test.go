@@ -0,0 +1,59 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatProcessorH264Reencode(t *testing.T) {
+	forma := &format.H264{
+		PayloadTyp:        96,
+		PacketizationMode: 1,
+	}
+
+	p, err := newFormatProcessorH264(forma, false, false, testFormatProcessorParent{})
+	require.NoError(t, err)
+
+	data := &dataH264{
+		rtpPackets: []*rtp.Packet{{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         true,
+				PayloadType:    96,
+				SequenceNumber: 0,
+			},
+			Payload: []byte{0x01, 0x02, 0x03, 0x04},
+		}},
+	}
+	err = p.process(data, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(data.rtpPackets))
+
+	reencoding, packets := p.reencodeStats()
+	require.Equal(t, false, reencoding)
+	require.Equal(t, uint64(0), packets)
+
+	// packets that exceed the maximum size are re-encoded
+	data = &dataH264{
+		rtpPackets: []*rtp.Packet{{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         true,
+				PayloadType:    96,
+				SequenceNumber: 1,
+			},
+			Payload: append([]byte{0x01}, bytes.Repeat([]byte{0x02}, 2000)...),
+		}},
+	}
+	err = p.process(data, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(data.rtpPackets))
+
+	reencoding, packets = p.reencodeStats()
+	require.Equal(t, true, reencoding)
+	require.Equal(t, uint64(2), packets)
+}
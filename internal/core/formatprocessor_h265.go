@@ -2,12 +2,15 @@ package core
 
 import (
 	"bytes"
+	"fmt"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h265"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph265"
 	"github.com/pion/rtp"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 // extract VPS, SPS and PPS without decoding RTP packets
@@ -51,9 +54,12 @@ func rtpH265ExtractVPSSPSPPS(pkt *rtp.Packet) ([]byte, []byte, []byte) {
 			}
 
 			nalu := payload[:size]
+			if len(nalu) < 2 {
+				continue
+			}
 			payload = payload[size:]
 
-			typ = h265.NALUType((pkt.Payload[0] >> 1) & 0b111111)
+			typ = h265.NALUType((nalu[0] >> 1) & 0b111111)
 
 			switch typ {
 			case h265.NALUType_VPS_NUT:
@@ -74,6 +80,21 @@ func rtpH265ExtractVPSSPSPPS(pkt *rtp.Packet) ([]byte, []byte, []byte) {
 	}
 }
 
+// check whether a group of NALUs contains an IRAP picture (BLA, IDR or CRA).
+func h265RandomAccessPresent(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+
+		typ := h265.NALUType((nalu[0] >> 1) & 0b111111)
+		if typ >= 16 && typ <= 21 {
+			return true
+		}
+	}
+	return false
+}
+
 type dataH265 struct {
 	rtpPackets []*rtp.Packet
 	ntp        time.Time
@@ -89,30 +110,114 @@ func (d *dataH265) getNTP() time.Time {
 	return d.ntp
 }
 
-type formatProcessorH265 struct {
-	format *format.H265
+type formatProcessorH265EncodeReq struct {
+	nalus [][]byte
+	pts   time.Duration
+}
 
-	encoder *rtph265.Encoder
-	decoder *rtph265.Decoder
+type formatProcessorH265EncodeRes struct {
+	pkts []*rtp.Packet
+	err  error
+}
+
+type formatProcessorH265 struct {
+	format                  *format.H265
+	skipDecodeErrors        bool
+	maxPacketsWithoutMarker int
+	encodeTimeout           time.Duration
+	parent                  formatProcessorParent
+
+	formatProcessorReencodeStats
+
+	encoder              *rtph265.Encoder
+	decoder              *rtph265.Decoder
+	waitingRandomAccess  bool
+	packetsWithoutMarker int
+	markerMissing        bool
+	auNALUs              [][]byte
+	auPTS                time.Duration
+	auTimestamp          uint32
+	encodeRequests       chan formatProcessorH265EncodeReq
+	encodeResults        chan formatProcessorH265EncodeRes
+	encodeTerminate      chan struct{}
+	encodeTimer          *time.Timer
+	encodeBusy           bool
+	encodeWaitingRAP     bool
+	pendingVPS           []byte
+	pendingSPS           []byte
+	pendingPPS           []byte
 }
 
 func newFormatProcessorH265(
 	forma *format.H265,
 	allocateEncoder bool,
+	skipDecodeErrors bool,
+	maxPacketsWithoutMarker int,
+	encodeTimeout time.Duration,
+	parent formatProcessorParent,
 ) (*formatProcessorH265, error) {
 	t := &formatProcessorH265{
-		format: forma,
+		format:                  forma,
+		skipDecodeErrors:        skipDecodeErrors,
+		maxPacketsWithoutMarker: maxPacketsWithoutMarker,
+		encodeTimeout:           encodeTimeout,
+		parent:                  parent,
 	}
 
 	if allocateEncoder {
 		t.encoder = forma.CreateEncoder()
 	}
 
+	if encodeTimeout > 0 {
+		t.encodeRequests = make(chan formatProcessorH265EncodeReq, 1)
+		t.encodeResults = make(chan formatProcessorH265EncodeRes, 1)
+		t.encodeTerminate = make(chan struct{})
+
+		t.encodeTimer = time.NewTimer(encodeTimeout)
+		if !t.encodeTimer.Stop() {
+			<-t.encodeTimer.C
+		}
+
+		go t.runEncoder()
+	}
+
+	if !t.ready() {
+		t.pendingVPS = forma.SafeVPS()
+		t.pendingSPS = forma.SafeSPS()
+		t.pendingPPS = forma.SafePPS()
+	}
+
 	return t, nil
 }
 
-func (t *formatProcessorH265) updateTrackParametersFromRTPPacket(pkt *rtp.Packet) {
-	vps, sps, pps := rtpH265ExtractVPSSPSPPS(pkt)
+// ready checks whether the track contains all parameter sets (VPS, SPS and PPS).
+func (t *formatProcessorH265) ready() bool {
+	return t.format.SafeVPS() != nil && t.format.SafeSPS() != nil && t.format.SafePPS() != nil
+}
+
+// updateTrackParameters sets parameter sets into the track.
+// Cameras can send VPS, SPS and PPS in separate packets: until all of them
+// have been received, they are buffered, in order to never expose
+// an incomplete set of parameters to readers.
+func (t *formatProcessorH265) updateTrackParameters(vps []byte, sps []byte, pps []byte) {
+	if !t.ready() {
+		if vps != nil {
+			t.pendingVPS = vps
+		}
+		if sps != nil {
+			t.pendingSPS = sps
+		}
+		if pps != nil {
+			t.pendingPPS = pps
+		}
+
+		if t.pendingVPS == nil || t.pendingSPS == nil || t.pendingPPS == nil {
+			return
+		}
+
+		vps, sps, pps = t.pendingVPS, t.pendingSPS, t.pendingPPS
+		t.pendingVPS, t.pendingSPS, t.pendingPPS = nil, nil, nil
+	}
 
 	if vps != nil && !bytes.Equal(vps, t.format.SafeVPS()) {
 		t.format.SafeSetVPS(vps)
@@ -127,8 +232,38 @@ func (t *formatProcessorH265) updateTrackParametersFromRTPPacket(pkt *rtp.Packet
 	}
 }
 
+func (t *formatProcessorH265) updateTrackParametersFromRTPPacket(pkt *rtp.Packet) {
+	vps, sps, pps := rtpH265ExtractVPSSPSPPS(pkt)
+	if vps != nil || sps != nil || pps != nil {
+		t.updateTrackParameters(vps, sps, pps)
+	}
+}
+
 func (t *formatProcessorH265) updateTrackParametersFromNALUs(nalus [][]byte) {
-	// TODO: extract VPS, SPS, PPS and set them into the track
+	var vps []byte
+	var sps []byte
+	var pps []byte
+
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+
+		switch h265.NALUType((nalu[0] >> 1) & 0b111111) {
+		case h265.NALUType_VPS_NUT:
+			vps = nalu
+
+		case h265.NALUType_SPS_NUT:
+			sps = nalu
+
+		case h265.NALUType_PPS_NUT:
+			pps = nalu
+		}
+	}
+
+	if vps != nil || sps != nil || pps != nil {
+		t.updateTrackParameters(vps, sps, pps)
+	}
 }
 
 func (t *formatProcessorH265) remuxNALUs(nalus [][]byte) [][]byte {
@@ -136,6 +271,153 @@ func (t *formatProcessorH265) remuxNALUs(nalus [][]byte) [][]byte {
 	return nalus
 }
 
+// skipDecodeError drops the access unit that couldn't be decoded and
+// waits for the next random access point.
+// The error is returned only once, in order to be logged.
+func (t *formatProcessorH265) skipDecodeError(err error) error {
+	if t.waitingRandomAccess {
+		return nil
+	}
+
+	t.waitingRandomAccess = true
+	return fmt.Errorf("unable to decode access unit, waiting for next random access point: %v", err)
+}
+
+// decodeUntilTimestampChange decodes an access unit from RTP packets of sources
+// that don't set the RTP marker. Since all packets of an access unit share
+// the same RTP timestamp, a different timestamp implies that the previous access unit is complete.
+func (t *formatProcessorH265) decodeUntilTimestampChange(pkt *rtp.Packet) ([][]byte, time.Duration, error) {
+	var ret [][]byte
+	var retPTS time.Duration
+
+	if len(t.auNALUs) != 0 && pkt.Timestamp != t.auTimestamp {
+		ret = t.auNALUs
+		retPTS = t.auPTS
+		t.auNALUs = nil
+	}
+	t.auTimestamp = pkt.Timestamp
+
+	nalus, pts, err := t.decoder.Decode(pkt)
+	if err != nil {
+		if err != rtph265.ErrMorePacketsNeeded && err != rtph265.ErrNonStartingPacketAndNoPrevious {
+			t.auNALUs = nil
+			return nil, 0, err
+		}
+	} else {
+		if (len(t.auNALUs) + len(nalus)) > h265.MaxNALUsPerGroup {
+			n := len(t.auNALUs) + len(nalus)
+			t.auNALUs = nil
+			return nil, 0, fmt.Errorf("number of NALUs contained inside a single group (%d) is too big (maximum is %d)",
+				n, h265.MaxNALUsPerGroup)
+		}
+
+		t.auNALUs = append(t.auNALUs, nalus...)
+		t.auPTS = pts
+	}
+
+	if ret == nil {
+		return nil, 0, rtph265.ErrMorePacketsNeeded
+	}
+
+	return ret, retPTS, nil
+}
+
+func (t *formatProcessorH265) decode(pkt *rtp.Packet) ([][]byte, time.Duration, error) {
+	if !t.markerMissing {
+		if pkt.Marker {
+			t.packetsWithoutMarker = 0
+		} else {
+			t.packetsWithoutMarker++
+
+			if t.maxPacketsWithoutMarker > 0 && t.packetsWithoutMarker >= t.maxPacketsWithoutMarker {
+				t.parent.log(logger.Warn, "RTP marker of the H265 track not received in %d packets, "+
+					"detecting frames through timestamps", t.packetsWithoutMarker)
+				t.markerMissing = true
+
+				// discard NALUs buffered by DecodeUntilMarker()
+				t.decoder = t.format.CreateDecoder()
+			}
+		}
+	}
+
+	if t.markerMissing {
+		return t.decodeUntilTimestampChange(pkt)
+	}
+
+	// DecodeUntilMarker() is necessary, otherwise Encode() generates partial groups
+	return t.decoder.DecodeUntilMarker(pkt)
+}
+
+func (t *formatProcessorH265) close() {
+	if t.encodeTerminate != nil {
+		close(t.encodeTerminate)
+	}
+}
+
+// runEncoder encodes access units in a separate routine, in order to allow encode()
+// to stop waiting when encoding takes more than encodeTimeout.
+// Since encode() sends a request only when the previous result has been received,
+// channels never contain more than one element.
+func (t *formatProcessorH265) runEncoder() {
+	for {
+		select {
+		case req := <-t.encodeRequests:
+			pkts, err := t.encoder.Encode(req.nalus, req.pts)
+			t.encodeResults <- formatProcessorH265EncodeRes{pkts, err}
+
+		case <-t.encodeTerminate:
+			return
+		}
+	}
+}
+
+// encode encodes an access unit into RTP packets.
+// If encodeTimeout is set and encoding doesn't complete in time, RTP packets of the access unit
+// are dropped instead of blocking the stream. Since the encoder can't be used concurrently,
+// RTP packets of following access units are dropped too until the late encoding completes,
+// then until the next random access point, since they may reference dropped access units.
+// Only RTP packets are dropped: NALUs are still routed to readers that don't use RTP.
+func (t *formatProcessorH265) encode(nalus [][]byte, pts time.Duration) ([]*rtp.Packet, error) {
+	if t.encodeTimeout == 0 {
+		return t.encoder.Encode(nalus, pts)
+	}
+
+	if t.encodeBusy {
+		select {
+		case <-t.encodeResults:
+			t.encodeBusy = false
+
+		default:
+			return nil, nil
+		}
+	}
+
+	if t.encodeWaitingRAP {
+		if !h265RandomAccessPresent(nalus) {
+			return nil, nil
+		}
+		t.encodeWaitingRAP = false
+	}
+
+	t.encodeRequests <- formatProcessorH265EncodeReq{nalus, pts}
+	t.encodeTimer.Reset(t.encodeTimeout)
+
+	select {
+	case res := <-t.encodeResults:
+		if !t.encodeTimer.Stop() {
+			<-t.encodeTimer.C
+		}
+		return res.pkts, res.err
+
+	case <-t.encodeTimer.C:
+		t.parent.log(logger.Warn, "re-encoding of a H265 access unit took more than %v, "+
+			"dropping RTP packets until the next random access point", t.encodeTimeout)
+		t.encodeBusy = true
+		t.encodeWaitingRAP = true
+		return nil, nil
+	}
+}
+
 func (t *formatProcessorH265) process(dat data, hasNonRTSPReaders bool) error { //nolint:dupl
 	tdata := dat.(*dataH265)
 
@@ -150,6 +432,10 @@ func (t *formatProcessorH265) process(dat data, hasNonRTSPReaders bool) error {
 
 			// RTP packets exceed maximum size: start re-encoding them
 			if pkt.MarshalSize() > maxPacketSize {
+				t.parent.log(logger.Info, "RTP packets of the H265 track exceed maximum size (%d > %d), re-encoding them",
+					pkt.MarshalSize(), maxPacketSize)
+				t.startReencoding()
+
 				v1 := pkt.SSRC
 				v2 := pkt.SequenceNumber
 				v3 := pkt.Timestamp
@@ -174,15 +460,28 @@ func (t *formatProcessorH265) process(dat data, hasNonRTSPReaders bool) error {
 				tdata.rtpPackets = nil
 			}
 
-			// DecodeUntilMarker() is necessary, otherwise Encode() generates partial groups
-			nalus, pts, err := t.decoder.DecodeUntilMarker(pkt)
+			nalus, pts, err := t.decode(pkt)
 			if err != nil {
 				if err == rtph265.ErrNonStartingPacketAndNoPrevious || err == rtph265.ErrMorePacketsNeeded {
 					return nil
 				}
+
+				if t.skipDecodeErrors {
+					return t.skipDecodeError(err)
+				}
+
 				return err
 			}
 
+			// the access unit following a decode error may reference the
+			// dropped one: skip access units until a random access point.
+			if t.waitingRandomAccess {
+				if !h265RandomAccessPresent(nalus) {
+					return nil
+				}
+				t.waitingRandomAccess = false
+			}
+
 			tdata.nalus = nalus
 			tdata.pts = pts
 
@@ -198,11 +497,13 @@ func (t *formatProcessorH265) process(dat data, hasNonRTSPReaders bool) error {
 		tdata.nalus = t.remuxNALUs(tdata.nalus)
 	}
 
-	pkts, err := t.encoder.Encode(tdata.nalus, tdata.pts)
+	pkts, err := t.encode(tdata.nalus, tdata.pts)
 	if err != nil {
 		return err
 	}
 
+	t.onPacketsEncoded(len(pkts))
+
 	tdata.rtpPackets = pkts
 	return nil
 }
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h265"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+type testFormatProcessorParent struct{}
+
+func (testFormatProcessorParent) log(logger.Level, string, ...interface{}) {}
+
+func TestFormatProcessorH265SeparateParameters(t *testing.T) {
+	forma := &format.H265{
+		PayloadTyp: 96,
+	}
+
+	p, err := newFormatProcessorH265(forma, false, false, 0, 0, testFormatProcessorParent{})
+	require.NoError(t, err)
+
+	vps := []byte{byte(h265.NALUType_VPS_NUT) << 1, 1, 2, 3}
+	sps := []byte{byte(h265.NALUType_SPS_NUT) << 1, 4, 5, 6}
+	pps := []byte{byte(h265.NALUType_PPS_NUT) << 1, 7, 8, 9}
+
+	for i, nalu := range [][]byte{vps, sps, pps} {
+		err := p.process(&dataH265{
+			rtpPackets: []*rtp.Packet{{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         true,
+					PayloadType:    96,
+					SequenceNumber: uint16(i),
+				},
+				Payload: nalu,
+			}},
+		}, false)
+		require.NoError(t, err)
+
+		if i < 2 {
+			require.False(t, p.ready())
+			require.Nil(t, forma.SafeVPS())
+			require.Nil(t, forma.SafeSPS())
+			require.Nil(t, forma.SafePPS())
+		}
+	}
+
+	require.True(t, p.ready())
+	require.Equal(t, vps, forma.SafeVPS())
+	require.Equal(t, sps, forma.SafeSPS())
+	require.Equal(t, pps, forma.SafePPS())
+}
+
+func TestFormatProcessorH265EncodeTimeout(t *testing.T) {
+	forma := &format.H265{
+		PayloadTyp: 96,
+	}
+
+	p, err := newFormatProcessorH265(forma, true, false, 0, time.Second, testFormatProcessorParent{})
+	require.NoError(t, err)
+	defer p.close()
+
+	irap := []byte{byte(h265.NALUType_IDR_W_RADL) << 1, 1, 2, 3}
+	nonIRAP := []byte{byte(h265.NALUType_TRAIL_R) << 1, 1, 2, 3}
+
+	data := &dataH265{nalus: [][]byte{irap}}
+	err = p.process(data, true)
+	require.NoError(t, err)
+	require.NotEqual(t, 0, len(data.rtpPackets))
+
+	// simulate an encoding that completed after the timeout
+	p.encodeBusy = true
+	p.encodeWaitingRAP = true
+	p.encodeResults <- formatProcessorH265EncodeRes{}
+
+	// RTP packets are dropped until the next random access point, NALUs are not
+	data = &dataH265{nalus: [][]byte{nonIRAP}}
+	err = p.process(data, true)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(data.rtpPackets))
+	require.Equal(t, [][]byte{nonIRAP}, data.nalus)
+	require.False(t, p.encodeBusy)
+
+	data = &dataH265{nalus: [][]byte{irap}}
+	err = p.process(data, true)
+	require.NoError(t, err)
+	require.NotEqual(t, 0, len(data.rtpPackets))
+}
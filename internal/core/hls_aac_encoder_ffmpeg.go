@@ -0,0 +1,146 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+)
+
+// hlsAACEncoderFFmpeg is a hls.AACEncoder that runs an external FFmpeg process.
+type hlsAACEncoderFFmpeg struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{}
+
+	mutex sync.Mutex
+	aus   [][]byte
+	err   error
+}
+
+// newHLSAACEncoderFFmpeg allocates a hlsAACEncoderFFmpeg, that encodes mono audio
+// with the given sample rate into AAC-LC with the given bitrate, by using the FFmpeg executable at ffmpegPath.
+func newHLSAACEncoderFFmpeg(ffmpegPath string, sampleRate int, bitrate int) (*hlsAACEncoderFFmpeg, error) {
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "s16le",
+		"-ar", strconv.FormatInt(int64(sampleRate), 10),
+		"-ac", "1",
+		"-i", "pipe:0",
+		"-c:a", "aac",
+		"-b:a", strconv.FormatInt(int64(bitrate), 10),
+		"-flush_packets", "1",
+		"-f", "adts",
+		"pipe:1")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start FFmpeg: %v", err)
+	}
+
+	e := &hlsAACEncoderFFmpeg{
+		cmd:   cmd,
+		stdin: stdin,
+		done:  make(chan struct{}),
+	}
+
+	go e.runReader(stdout)
+
+	return e, nil
+}
+
+func (e *hlsAACEncoderFFmpeg) runReader(r io.Reader) {
+	defer close(e.done)
+
+	err := e.readADTS(bufio.NewReader(r))
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.err = fmt.Errorf("the FFmpeg process exited: %v", err)
+}
+
+func (e *hlsAACEncoderFFmpeg) readADTS(r io.Reader) error {
+	header := make([]byte, 7)
+
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return err
+		}
+
+		// frame length includes the header
+		frameLen := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+		if frameLen < len(header) {
+			return fmt.Errorf("invalid ADTS frame length: %d", frameLen)
+		}
+
+		frame := make([]byte, frameLen)
+		copy(frame, header)
+
+		_, err = io.ReadFull(r, frame[len(header):])
+		if err != nil {
+			return err
+		}
+
+		var pkts mpeg4audio.ADTSPackets
+		err = pkts.Unmarshal(frame)
+		if err != nil {
+			return err
+		}
+
+		e.mutex.Lock()
+		for _, pkt := range pkts {
+			e.aus = append(e.aus, pkt.AU)
+		}
+		e.mutex.Unlock()
+	}
+}
+
+// Encode implements hls.AACEncoder.
+func (e *hlsAACEncoderFFmpeg) Encode(samples []int16) ([][]byte, error) {
+	buf := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(sample))
+	}
+
+	_, writeErr := e.stdin.Write(buf)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	aus := e.aus
+	e.aus = nil
+	return aus, nil
+}
+
+// Close implements hls.AACEncoder.
+func (e *hlsAACEncoderFFmpeg) Close() {
+	e.stdin.Close()
+	e.cmd.Process.Kill()
+	<-e.done
+	e.cmd.Wait()
+}
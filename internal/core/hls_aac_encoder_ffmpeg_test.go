@@ -0,0 +1,45 @@
+package core
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/hls"
+)
+
+func TestHLSAACEncoderFFmpeg(t *testing.T) {
+	_, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("FFmpeg is not available")
+	}
+
+	enc, err := newHLSAACEncoderFFmpeg("ffmpeg", hls.G711SampleRate, 32000)
+	require.NoError(t, err)
+	defer enc.Close()
+
+	// the encoder returns access units with a delay
+	var aus [][]byte
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(aus) == 0 {
+		require.True(t, time.Now().Before(deadline), "no access units were returned")
+
+		ret, err := enc.Encode(make([]int16, hls.G711SampleRate/10))
+		require.NoError(t, err)
+		aus = append(aus, ret...)
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, au := range aus {
+		require.NotEqual(t, 0, len(au))
+	}
+}
+
+func TestHLSAACEncoderFFmpegInvalidPath(t *testing.T) {
+	_, err := newHLSAACEncoderFFmpeg("/nonexisting/ffmpeg", hls.G711SampleRate, 32000)
+	require.Error(t, err)
+}
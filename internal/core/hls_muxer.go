@@ -8,16 +8,21 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtpmjpeg"
 	"github.com/aler9/gortsplib/v2/pkg/media"
 	"github.com/aler9/gortsplib/v2/pkg/ringbuffer"
 	"github.com/gin-gonic/gin"
 
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/hls"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
@@ -59,8 +64,25 @@ type hlsMuxer struct {
 	hlsVariant                conf.HLSVariant
 	hlsSegmentCount           int
 	hlsSegmentDuration        conf.StringDuration
+	hlsSegmentMaxDeviation    conf.StringDuration
+	hlsTargetDuration         conf.StringDuration
 	hlsPartDuration           conf.StringDuration
+	hlsFragmentDuration       conf.StringDuration
+	hlsInterleaveFragments    bool
+	hlsInitPerDiscontinuity   bool
+	hlsStallTimeout           conf.StringDuration
 	hlsSegmentMaxSize         conf.StringSize
+	hlsSegmentRetention       conf.StringDuration
+	hlsDirectory              string
+	hlsSegmentNameTemplate    string
+	hlsPartNameTemplate       string
+	hlsProducerReferenceTime  bool
+	hlsCMAF                   bool
+	hlsTranscodeG711          bool
+	hlsTranscodeG711FFmpeg    string
+	hlsAVSyncThreshold        conf.StringDuration
+	hlsAVSyncCorrection       bool
+	hlsCompressPlaylists      bool
 	readBufferCount           int
 	wg                        *sync.WaitGroup
 	pathName                  string
@@ -90,8 +112,25 @@ func newHLSMuxer(
 	hlsVariant conf.HLSVariant,
 	hlsSegmentCount int,
 	hlsSegmentDuration conf.StringDuration,
+	hlsSegmentMaxDeviation conf.StringDuration,
+	hlsTargetDuration conf.StringDuration,
 	hlsPartDuration conf.StringDuration,
+	hlsFragmentDuration conf.StringDuration,
+	hlsInterleaveFragments bool,
+	hlsInitPerDiscontinuity bool,
+	hlsStallTimeout conf.StringDuration,
 	hlsSegmentMaxSize conf.StringSize,
+	hlsSegmentRetention conf.StringDuration,
+	hlsDirectory string,
+	hlsSegmentNameTemplate string,
+	hlsPartNameTemplate string,
+	hlsProducerReferenceTime bool,
+	hlsCMAF bool,
+	hlsTranscodeG711 bool,
+	hlsTranscodeG711FFmpeg string,
+	hlsAVSyncThreshold conf.StringDuration,
+	hlsAVSyncCorrection bool,
+	hlsCompressPlaylists bool,
 	readBufferCount int,
 	req *hlsMuxerRequest,
 	wg *sync.WaitGroup,
@@ -108,8 +147,25 @@ func newHLSMuxer(
 		hlsVariant:                hlsVariant,
 		hlsSegmentCount:           hlsSegmentCount,
 		hlsSegmentDuration:        hlsSegmentDuration,
+		hlsSegmentMaxDeviation:    hlsSegmentMaxDeviation,
+		hlsTargetDuration:         hlsTargetDuration,
 		hlsPartDuration:           hlsPartDuration,
+		hlsFragmentDuration:       hlsFragmentDuration,
+		hlsInterleaveFragments:    hlsInterleaveFragments,
+		hlsInitPerDiscontinuity:   hlsInitPerDiscontinuity,
+		hlsStallTimeout:           hlsStallTimeout,
 		hlsSegmentMaxSize:         hlsSegmentMaxSize,
+		hlsSegmentRetention:       hlsSegmentRetention,
+		hlsDirectory:              hlsDirectory,
+		hlsSegmentNameTemplate:    hlsSegmentNameTemplate,
+		hlsPartNameTemplate:       hlsPartNameTemplate,
+		hlsProducerReferenceTime:  hlsProducerReferenceTime,
+		hlsCMAF:                   hlsCMAF,
+		hlsTranscodeG711:          hlsTranscodeG711,
+		hlsTranscodeG711FFmpeg:    hlsTranscodeG711FFmpeg,
+		hlsAVSyncThreshold:        hlsAVSyncThreshold,
+		hlsAVSyncCorrection:       hlsAVSyncCorrection,
+		hlsCompressPlaylists:      hlsCompressPlaylists,
 		readBufferCount:           readBufferCount,
 		wg:                        wg,
 		pathName:                  pathName,
@@ -152,6 +208,11 @@ func (m *hlsMuxer) log(level logger.Level, format string, args ...interface{}) {
 	m.parent.log(level, "[muxer %s] "+format, append([]interface{}{m.pathName}, args...)...)
 }
 
+// Log implements hls.MuxerLogger.
+func (m *hlsMuxer) Log(level logger.Level, format string, args ...interface{}) {
+	m.log(level, format, args...)
+}
+
 // PathName returns the path name.
 func (m *hlsMuxer) PathName() string {
 	return m.pathName
@@ -218,7 +279,7 @@ func (m *hlsMuxer) run() {
 		req.res <- hlsMuxerResponse{
 			muxer: m,
 			cb: func() *hls.MuxerFileResponse {
-				return &hls.MuxerFileResponse{Status: http.StatusNotFound}
+				return hls.NewMuxerFileResponseError(http.StatusNotFound)
 			},
 		}
 	}
@@ -243,14 +304,59 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 		m.path.readerRemove(pathReaderRemoveReq{author: m})
 	}()
 
-	var videoFormat *format.H264
-	videoMedia := res.stream.medias().FindFormat(&videoFormat)
+	var videoFormat format.Format
+
+	var h264Format *format.H264
+	videoMedia := res.stream.medias().FindFormat(&h264Format)
+	if videoMedia != nil {
+		videoFormat = h264Format
+	}
+
+	// M-JPEG can be stored into fMP4 segments only
+	var mjpegFormat *format.MJPEG
+	if videoMedia == nil && m.hlsVariant != conf.HLSVariantMPEGTS {
+		videoMedia = res.stream.medias().FindFormat(&mjpegFormat)
+		if videoMedia != nil {
+			videoFormat = mjpegFormat
+		}
+	}
+
+	var audioFormat format.Format
 
-	var audioFormat *format.MPEG4Audio
-	audioMedia := res.stream.medias().FindFormat(&audioFormat)
+	var aacFormat *format.MPEG4Audio
+	audioMedia := res.stream.medias().FindFormat(&aacFormat)
+	if audioMedia != nil {
+		audioFormat = aacFormat
+	} else {
+		var ac3Format *ac3.Format
+		audioMedia = res.stream.medias().FindFormat(&ac3Format)
+		if audioMedia != nil {
+			audioFormat = ac3Format
+		}
+	}
+
+	// G711 is transcoded into AAC
+	var g711Format *format.G711
+	if audioMedia == nil && m.hlsTranscodeG711 {
+		audioMedia = res.stream.medias().FindFormat(&g711Format)
+		if audioMedia != nil {
+			audioFormat = hls.G711AACTrack()
+		}
+	}
 
 	if videoFormat == nil && audioFormat == nil {
-		return fmt.Errorf("the stream doesn't contain an H264 track or an AAC track")
+		return fmt.Errorf("the stream doesn't contain an H264 or M-JPEG track or an AAC or AC-3 track")
+	}
+
+	var storage hls.SegmentStorage
+	if m.hlsDirectory != "" {
+		dir, err := os.MkdirTemp(m.hlsDirectory, "muxer")
+		if err != nil {
+			return fmt.Errorf("unable to create the segment directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		storage = hls.NewSegmentStorageDisk(dir)
 	}
 
 	var err error
@@ -268,13 +374,145 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 	}
 	defer m.muxer.Close()
 
+	m.muxer.SetLogger(m)
+
+	if storage != nil {
+		m.muxer.SetSegmentStorage(storage)
+	}
+
+	err = m.muxer.SetSegmentRetention(time.Duration(m.hlsSegmentRetention))
+	if err != nil {
+		return fmt.Errorf("muxer error: %v", err)
+	}
+
+	err = m.muxer.SetFileNameTemplates(m.hlsSegmentNameTemplate, m.hlsPartNameTemplate)
+	if err != nil {
+		return fmt.Errorf("muxer error: %v", err)
+	}
+
+	// the producer reference time is ignored by the MPEG-TS variant
+	if m.hlsProducerReferenceTime && m.hlsVariant != conf.HLSVariantMPEGTS {
+		err := m.muxer.EnableProducerReferenceTime()
+		if err != nil {
+			return fmt.Errorf("muxer error: %v", err)
+		}
+	}
+
+	if m.hlsCMAF {
+		err := m.muxer.EnableCMAF()
+		if err != nil {
+			return fmt.Errorf("muxer error: %v", err)
+		}
+	}
+
+	if m.hlsTargetDuration != 0 {
+		err := m.muxer.SetTargetDuration(time.Duration(m.hlsTargetDuration))
+		if err != nil {
+			return fmt.Errorf("muxer error: %v", err)
+		}
+	}
+
+	if m.hlsVariant != conf.HLSVariantMPEGTS {
+		err := m.muxer.SetSegmentMaxDeviation(time.Duration(m.hlsSegmentMaxDeviation))
+		if err != nil {
+			return fmt.Errorf("muxer error: %v", err)
+		}
+
+		err = m.muxer.SetFragmentDuration(time.Duration(m.hlsFragmentDuration))
+		if err != nil {
+			return fmt.Errorf("muxer error: %v", err)
+		}
+	}
+
+	if m.hlsVariant == conf.HLSVariantLowLatency {
+		err := m.muxer.SetStallTimeout(time.Duration(m.hlsStallTimeout))
+		if err != nil {
+			return fmt.Errorf("muxer error: %v", err)
+		}
+	}
+
+	if g711Format != nil {
+		enc, err := newHLSAACEncoderFFmpeg(m.hlsTranscodeG711FFmpeg, hls.G711SampleRate, 32000)
+		if err != nil {
+			return err
+		}
+
+		err = m.muxer.EnableG711Transcoding(g711Format.MULaw, enc)
+		if err != nil {
+			enc.Close()
+			return err
+		}
+	}
+
+	if m.hlsInterleaveFragments && m.hlsVariant != conf.HLSVariantMPEGTS &&
+		videoFormat != nil && audioFormat != nil {
+		err := m.muxer.EnableFragmentInterleaving()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.hlsInitPerDiscontinuity && m.hlsVariant != conf.HLSVariantMPEGTS {
+		err := m.muxer.EnableInitPerDiscontinuity()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.hlsAVSyncThreshold > 0 && videoFormat != nil && audioFormat != nil {
+		err := m.muxer.EnableAVSync(time.Duration(m.hlsAVSyncThreshold), m.hlsAVSyncCorrection)
+		if err != nil {
+			return err
+		}
+	}
+
+	// segments stored on disk can be truncated by external factors
+	if storage != nil {
+		m.muxer.EnableSegmentValidation()
+	}
+
 	innerReady <- struct{}{}
 
 	m.ringBuffer, _ = ringbuffer.New(uint64(m.readBufferCount))
 
 	var medias media.Medias
 
-	if videoMedia != nil {
+	if mjpegFormat != nil {
+		medias = append(medias, videoMedia)
+
+		decoder := mjpegFormat.CreateDecoder()
+		videoStartPTSFilled := false
+		var videoStartPTS time.Duration
+
+		res.stream.readerAdd(m, videoMedia, videoFormat, func(dat data) {
+			m.ringBuffer.Push(func() error {
+				tdata := dat.(*dataGeneric)
+
+				for _, pkt := range tdata.rtpPackets {
+					frame, pts, err := decoder.Decode(pkt)
+					if err != nil {
+						if err == rtpmjpeg.ErrMorePacketsNeeded || err == rtpmjpeg.ErrNonStartingPacketAndNoPrevious {
+							continue
+						}
+						m.log(logger.Warn, "unable to decode M-JPEG frame: %v", err)
+						continue
+					}
+
+					if !videoStartPTSFilled {
+						videoStartPTSFilled = true
+						videoStartPTS = pts
+					}
+
+					err = m.muxer.WriteMJPEG(tdata.ntp, pts-videoStartPTS, frame)
+					if err != nil {
+						return fmt.Errorf("muxer error: %v", err)
+					}
+				}
+
+				return nil
+			})
+		})
+	} else if videoMedia != nil {
 		medias = append(medias, videoMedia)
 
 		videoStartPTSFilled := false
@@ -294,7 +532,18 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 				}
 				pts := tdata.pts - videoStartPTS
 
-				err := m.muxer.WriteH264(tdata.ntp, pts, tdata.nalus)
+				var err error
+				switch {
+				case tdata.dtsKnown && tdata.idrKnown:
+					dts := tdata.dts - videoStartPTS
+					err = m.muxer.WriteH264WithDTS(tdata.ntp, dts, pts, tdata.nalus, tdata.idrPresent)
+
+				case tdata.idrKnown:
+					err = m.muxer.WriteH264WithIDRPresent(tdata.ntp, pts, tdata.nalus, tdata.idrPresent)
+
+				default:
+					err = m.muxer.WriteH264(tdata.ntp, pts, tdata.nalus)
+				}
 				if err != nil {
 					return fmt.Errorf("muxer error: %v", err)
 				}
@@ -304,7 +553,38 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 		})
 	}
 
-	if audioMedia != nil {
+	if g711Format != nil {
+		medias = append(medias, audioMedia)
+
+		timestampFilled := false
+		var lastTimestamp uint32
+		var timestamp int64
+
+		res.stream.readerAdd(m, audioMedia, g711Format, func(dat data) {
+			m.ringBuffer.Push(func() error {
+				tdata := dat.(*dataGeneric)
+				pkt := tdata.rtpPackets[0]
+
+				// G711 packets contain raw samples, whose timestamp is the RTP one
+				if !timestampFilled {
+					timestampFilled = true
+					lastTimestamp = pkt.Timestamp
+				}
+				timestamp += int64(int32(pkt.Timestamp - lastTimestamp))
+				lastTimestamp = pkt.Timestamp
+
+				err := m.muxer.WriteG711(
+					tdata.ntp,
+					time.Duration(timestamp)*time.Second/hls.G711SampleRate,
+					pkt.Payload)
+				if err != nil {
+					return fmt.Errorf("muxer error: %v", err)
+				}
+
+				return nil
+			})
+		})
+	} else if audioMedia != nil {
 		medias = append(medias, audioMedia)
 
 		audioStartPTSFilled := false
@@ -312,6 +592,29 @@ func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{})
 
 		res.stream.readerAdd(m, audioMedia, audioFormat, func(dat data) {
 			m.ringBuffer.Push(func() error {
+				if tdata, ok := dat.(*dataAC3); ok {
+					if !audioStartPTSFilled {
+						audioStartPTSFilled = true
+						audioStartPTS = tdata.pts
+					}
+					pts := tdata.pts - audioStartPTS
+
+					samplesPerFrame := audioFormat.(*ac3.Format).Config.SamplesPerFrame()
+
+					for i, frame := range tdata.frames {
+						err := m.muxer.WriteAC3(
+							tdata.ntp,
+							pts+time.Duration(i*samplesPerFrame)*
+								time.Second/time.Duration(audioFormat.ClockRate()),
+							frame)
+						if err != nil {
+							return fmt.Errorf("muxer error: %v", err)
+						}
+					}
+
+					return nil
+				}
+
 				tdata := dat.(*dataMPEG4Audio)
 
 				if tdata.aus == nil {
@@ -432,8 +735,47 @@ func (m *hlsMuxer) handleRequest(req *hlsMuxerRequest) func() *hls.MuxerFileResp
 			req.file,
 			req.ctx.Query("_HLS_msn"),
 			req.ctx.Query("_HLS_part"),
-			req.ctx.Query("_HLS_skip"))
+			req.ctx.Query("_HLS_skip"),
+			m.hlsCompressPlaylists && gzipAccepted(req.ctx.GetHeader("Accept-Encoding")))
+	}
+}
+
+// gzipAccepted checks whether the gzip content coding is acceptable, according to
+// the Accept-Encoding header of a request (RFC 9110, section 12.5.3).
+func gzipAccepted(acceptEncoding string) bool {
+	gzipQ := -1.0
+	anyQ := -1.0
+
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == "q" {
+				v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+
+		switch coding {
+		case "gzip", "x-gzip":
+			gzipQ = q
+
+		case "*":
+			anyQ = q
+		}
+	}
+
+	// an explicit entry takes precedence over the wildcard
+	if gzipQ >= 0 {
+		return gzipQ > 0
 	}
+	return anyQ > 0
 }
 
 func (m *hlsMuxer) authenticate(ctx *gin.Context) error {
@@ -503,7 +845,7 @@ func (m *hlsMuxer) request(req *hlsMuxerRequest) {
 		req.res <- hlsMuxerResponse{
 			muxer: m,
 			cb: func() *hls.MuxerFileResponse {
-				return &hls.MuxerFileResponse{Status: http.StatusInternalServerError}
+				return hls.NewMuxerFileResponseError(http.StatusInternalServerError)
 			},
 		}
 	}
@@ -0,0 +1,33 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipAccepted(t *testing.T) {
+	for _, ca := range []struct {
+		header   string
+		accepted bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;q=0.5, deflate", true},
+		{"deflate, br", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+		{"br, *;q=0.1", true},
+		{"gzip;q=invalid", false},
+	} {
+		t.Run(ca.header, func(t *testing.T) {
+			require.Equal(t, ca.accepted, gzipAccepted(ca.header))
+		})
+	}
+}
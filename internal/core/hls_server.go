@@ -16,6 +16,7 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/hls"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
@@ -60,8 +61,25 @@ type hlsServer struct {
 	variant                   conf.HLSVariant
 	segmentCount              int
 	segmentDuration           conf.StringDuration
+	segmentMaxDeviation       conf.StringDuration
+	targetDuration            conf.StringDuration
 	partDuration              conf.StringDuration
+	fragmentDuration          conf.StringDuration
+	interleaveFragments       bool
+	initPerDiscontinuity      bool
+	stallTimeout              conf.StringDuration
 	segmentMaxSize            conf.StringSize
+	segmentRetention          conf.StringDuration
+	directory                 string
+	segmentNameTemplate       string
+	partNameTemplate          string
+	producerReferenceTime     bool
+	cmaf                      bool
+	transcodeG711             bool
+	transcodeG711FFmpeg       string
+	avSyncThreshold           conf.StringDuration
+	avSyncCorrection          bool
+	compressPlaylists         bool
 	allowOrigin               string
 	trustedProxies            conf.IPsOrCIDRs
 	readBufferCount           int
@@ -94,9 +112,27 @@ func newHLSServer(
 	alwaysRemux bool,
 	variant conf.HLSVariant,
 	segmentCount int,
+	lowLatencySegmentCount int,
 	segmentDuration conf.StringDuration,
+	segmentMaxDeviation conf.StringDuration,
+	targetDuration conf.StringDuration,
 	partDuration conf.StringDuration,
+	fragmentDuration conf.StringDuration,
+	interleaveFragments bool,
+	initPerDiscontinuity bool,
+	stallTimeout conf.StringDuration,
 	segmentMaxSize conf.StringSize,
+	segmentRetention conf.StringDuration,
+	directory string,
+	segmentNameTemplate string,
+	partNameTemplate string,
+	producerReferenceTime bool,
+	cmaf bool,
+	transcodeG711 bool,
+	transcodeG711FFmpeg string,
+	avSyncThreshold conf.StringDuration,
+	avSyncCorrection bool,
+	compressPlaylists bool,
 	allowOrigin string,
 	trustedProxies conf.IPsOrCIDRs,
 	readBufferCount int,
@@ -122,6 +158,17 @@ func newHLSServer(
 		}
 	}
 
+	// the Low-Latency variant needs a longer playlist than the other variants
+	if variant == conf.HLSVariantLowLatency {
+		switch {
+		case lowLatencySegmentCount != 0:
+			segmentCount = lowLatencySegmentCount
+
+		case segmentCount < hls.MuxerLowLatencyMinSegmentCount:
+			segmentCount = hls.MuxerLowLatencyMinSegmentCount
+		}
+	}
+
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &hlsServer{
@@ -130,8 +177,25 @@ func newHLSServer(
 		variant:                   variant,
 		segmentCount:              segmentCount,
 		segmentDuration:           segmentDuration,
+		segmentMaxDeviation:       segmentMaxDeviation,
+		targetDuration:            targetDuration,
 		partDuration:              partDuration,
+		fragmentDuration:          fragmentDuration,
+		interleaveFragments:       interleaveFragments,
+		initPerDiscontinuity:      initPerDiscontinuity,
+		stallTimeout:              stallTimeout,
 		segmentMaxSize:            segmentMaxSize,
+		segmentRetention:          segmentRetention,
+		directory:                 directory,
+		segmentNameTemplate:       segmentNameTemplate,
+		partNameTemplate:          partNameTemplate,
+		producerReferenceTime:     producerReferenceTime,
+		cmaf:                      cmaf,
+		transcodeG711:             transcodeG711,
+		transcodeG711FFmpeg:       transcodeG711FFmpeg,
+		avSyncThreshold:           avSyncThreshold,
+		avSyncCorrection:          avSyncCorrection,
+		compressPlaylists:         compressPlaylists,
 		allowOrigin:               allowOrigin,
 		trustedProxies:            trustedProxies,
 		readBufferCount:           readBufferCount,
@@ -320,6 +384,11 @@ func (s *hlsServer) onRequest(ctx *gin.Context) {
 		if res.Body != nil {
 			n, _ := io.Copy(ctx.Writer, res.Body)
 			res1.muxer.addSentBytes(uint64(n))
+
+			// release segments stored on disk
+			if c, ok := res.Body.(io.Closer); ok {
+				c.Close()
+			}
 		}
 
 	case <-s.ctx.Done():
@@ -337,8 +406,25 @@ func (s *hlsServer) findOrCreateMuxer(pathName string, remoteAddr string, req *h
 			s.variant,
 			s.segmentCount,
 			s.segmentDuration,
+			s.segmentMaxDeviation,
+			s.targetDuration,
 			s.partDuration,
+			s.fragmentDuration,
+			s.interleaveFragments,
+			s.initPerDiscontinuity,
+			s.stallTimeout,
 			s.segmentMaxSize,
+			s.segmentRetention,
+			s.directory,
+			s.segmentNameTemplate,
+			s.partNameTemplate,
+			s.producerReferenceTime,
+			s.cmaf,
+			s.transcodeG711,
+			s.transcodeG711FFmpeg,
+			s.avSyncThreshold,
+			s.avSyncCorrection,
+			s.compressPlaylists,
 			s.readBufferCount,
 			req,
 			&s.wg,
@@ -157,14 +157,21 @@ type pathPublisherStopReq struct {
 	res    chan struct{}
 }
 
+type pathAPIPathsListTrackStats struct {
+	// "passthrough" or "reencode"
+	Mode             string `json:"mode"`
+	ReencodedPackets uint64 `json:"reencodedPackets"`
+}
+
 type pathAPIPathsListItem struct {
-	ConfName      string         `json:"confName"`
-	Conf          *conf.PathConf `json:"conf"`
-	Source        interface{}    `json:"source"`
-	SourceReady   bool           `json:"sourceReady"`
-	Tracks        []string       `json:"tracks"`
-	BytesReceived uint64         `json:"bytesReceived"`
-	Readers       []interface{}  `json:"readers"`
+	ConfName      string                       `json:"confName"`
+	Conf          *conf.PathConf               `json:"conf"`
+	Source        interface{}                  `json:"source"`
+	SourceReady   bool                         `json:"sourceReady"`
+	Tracks        []string                     `json:"tracks"`
+	TrackStats    []pathAPIPathsListTrackStats `json:"trackStats"`
+	BytesReceived uint64                       `json:"bytesReceived"`
+	Readers       []interface{}                `json:"readers"`
 }
 
 type pathAPIPathsListData struct {
@@ -637,7 +644,15 @@ func (pa *path) onDemandPublisherStop() {
 }
 
 func (pa *path) sourceSetReady(medias media.Medias, allocateEncoder bool) error {
-	stream, err := newStream(medias, allocateEncoder, pa.bytesReceived)
+	stream, err := newStream(
+		medias,
+		allocateEncoder,
+		pa.conf.SkipDecodeErrors,
+		pa.conf.H265MaxPacketsWithoutMarker,
+		time.Duration(pa.conf.H265EncodeTimeout),
+		pa.bytesReceived,
+		pa,
+	)
 	if err != nil {
 		return err
 	}
@@ -908,6 +923,25 @@ func (pa *path) handleAPIPathsList(req pathAPIPathsListSubReq) {
 			}
 			return mediasDescription(pa.stream.medias())
 		}(),
+		TrackStats: func() []pathAPIPathsListTrackStats {
+			if pa.stream == nil {
+				return []pathAPIPathsListTrackStats{}
+			}
+
+			stats := pa.stream.reencodeStats()
+			ret := make([]pathAPIPathsListTrackStats, len(stats))
+
+			for i, s := range stats {
+				if s.reencoding {
+					ret[i].Mode = "reencode"
+				} else {
+					ret[i].Mode = "passthrough"
+				}
+				ret[i].ReencodedPackets = s.reencodedPackets
+			}
+
+			return ret
+		}(),
 		BytesReceived: atomic.LoadUint64(pa.bytesReceived),
 		Readers: func() []interface{} {
 			ret := []interface{}{}
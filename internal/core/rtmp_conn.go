@@ -11,18 +11,17 @@ import (
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
-	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/media"
 	"github.com/aler9/gortsplib/v2/pkg/ringbuffer"
 	"github.com/google/uuid"
 	"github.com/notedit/rtmp/format/flv/flvio"
 
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
-	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
 )
 
@@ -30,6 +29,15 @@ const (
 	rtmpConnPauseAfterAuthError = 2 * time.Second
 )
 
+// rtmpMetadataDescription returns a description of the parameters of a metadata update.
+func rtmpMetadataDescription(md flvio.AMFMap) string {
+	parts := make([]string, len(md))
+	for i, kv := range md {
+		parts[i] = fmt.Sprintf("%s=%v", kv.K, kv.V)
+	}
+	return strings.Join(parts, ", ")
+}
+
 func pathNameAndQuery(inURL *url.URL) (string, url.Values, string) {
 	// remove leading and trailing slashes inserted by OBS and some other clients
 	tmp := strings.TrimRight(inURL.String(), "/")
@@ -86,6 +94,14 @@ func newRTMPConn(
 	isTLS bool,
 	externalAuthenticationURL string,
 	rtspAddress string,
+	playLimiter *rtmp.PlayLimiter,
+	pacing bool,
+	aacObjectTypes conf.AACObjectTypes,
+	setupTimeout conf.StringDuration,
+	maxPublishBitrate uint64,
+	maxPublishBitrateWindow conf.StringDuration,
+	tsCorrection bool,
+	tsCorrectionWarnThreshold conf.StringDuration,
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
 	readBufferCount int,
@@ -99,6 +115,8 @@ func newRTMPConn(
 ) *rtmpConn {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
+	rtmp.ConfigureTCP(nconn)
+
 	c := &rtmpConn{
 		isTLS:                     isTLS,
 		externalAuthenticationURL: externalAuthenticationURL,
@@ -120,6 +138,17 @@ func newRTMPConn(
 		created:                   time.Now(),
 	}
 
+	if playLimiter != nil {
+		c.conn.SetPlayLimiter(playLimiter)
+	}
+
+	c.conn.SetPacing(pacing)
+	c.conn.SetAACObjectTypes(aacObjectTypes)
+	c.conn.SetSetupTimeout(time.Duration(setupTimeout))
+	c.conn.SetMaxBitrate(maxPublishBitrate, time.Duration(maxPublishBitrateWindow))
+	c.conn.SetTimestampCorrection(tsCorrection, time.Duration(tsCorrectionWarnThreshold))
+	c.conn.SetLogger(c)
+
 	c.log(logger.Info, "opened")
 
 	c.wg.Add(1)
@@ -140,6 +169,11 @@ func (c *rtmpConn) log(level logger.Level, format string, args ...interface{}) {
 	c.parent.log(level, "[conn %v] "+format, append([]interface{}{c.nconn.RemoteAddr()}, args...)...)
 }
 
+// Log implements rtmp.ConnLogger.
+func (c *rtmpConn) Log(level logger.Level, format string, args ...interface{}) {
+	c.log(level, format, args...)
+}
+
 func (c *rtmpConn) ip() net.IP {
 	return c.nconn.RemoteAddr().(*net.TCPAddr).IP
 }
@@ -204,9 +238,11 @@ func (c *rtmpConn) runInner(ctx context.Context) error {
 		c.nconn.Close()
 	}()
 
+	defer c.conn.ReleasePlay()
+
 	c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
 	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-	u, isPublishing, err := c.conn.InitializeServer()
+	u, isPublishing, err := c.conn.InitializeServerContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -254,7 +290,6 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 	var videoFormat *format.H264
 	videoMedia := res.stream.medias().FindFormat(&videoFormat)
 	videoFirstIDRFound := false
-	var videoStartDTS time.Duration
 
 	var audioFormat *format.MPEG4Audio
 	audioMedia := res.stream.medias().FindFormat(&audioFormat)
@@ -269,97 +304,35 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		ringBuffer.Close()
 	}()
 
+	// messages are generated and encoded once for all the RTMP readers of the stream
+	fanout := res.stream.rtmpFanoutAdd(videoFormat, audioFormat)
+	defer res.stream.rtmpFanoutRemove()
+
 	var medias media.Medias
 	if videoMedia != nil {
 		medias = append(medias, videoMedia)
 
-		videoStartPTSFilled := false
-		var videoStartPTS time.Duration
-		var videoDTSExtractor *h264.DTSExtractor
-
 		res.stream.readerAdd(c, videoMedia, videoFormat, func(dat data) {
-			ringBuffer.Push(func() error {
-				tdata := dat.(*dataH264)
-
-				if tdata.nalus == nil {
-					return nil
-				}
-
-				if !videoStartPTSFilled {
-					videoStartPTSFilled = true
-					videoStartPTS = tdata.pts
-				}
-				pts := tdata.pts - videoStartPTS
-
-				idrPresent := false
-				nonIDRPresent := false
-
-				for _, nalu := range tdata.nalus {
-					typ := h264.NALUType(nalu[0] & 0x1F)
-					switch typ {
-					case h264.NALUTypeIDR:
-						idrPresent = true
+			u := fanout.video(dat)
+			if u == nil {
+				return
+			}
 
-					case h264.NALUTypeNonIDR:
-						nonIDRPresent = true
-					}
+			ringBuffer.Push(func() error {
+				if u.err != nil {
+					return u.err
 				}
 
-				var dts time.Duration
-
 				// wait until we receive an IDR
 				if !videoFirstIDRFound {
-					if !idrPresent {
+					if !u.isKeyFrame {
 						return nil
 					}
 
 					videoFirstIDRFound = true
-					videoDTSExtractor = h264.NewDTSExtractor()
-
-					var err error
-					dts, err = videoDTSExtractor.Extract(tdata.nalus, pts)
-					if err != nil {
-						return err
-					}
-
-					videoStartDTS = dts
-					dts = 0
-					pts -= videoStartDTS
-				} else {
-					if !idrPresent && !nonIDRPresent {
-						return nil
-					}
-
-					var err error
-					dts, err = videoDTSExtractor.Extract(tdata.nalus, pts)
-					if err != nil {
-						return err
-					}
-
-					dts -= videoStartDTS
-					pts -= videoStartDTS
 				}
 
-				avcc, err := h264.AVCCMarshal(tdata.nalus)
-				if err != nil {
-					return err
-				}
-
-				c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-				err = c.conn.WriteMessage(&message.MsgVideo{
-					ChunkStreamID:   message.MsgVideoChunkStreamID,
-					MessageStreamID: 0x1000000,
-					IsKeyFrame:      idrPresent,
-					H264Type:        flvio.AVC_NALU,
-					Payload:         avcc,
-					DTS:             dts,
-					PTSDelta:        pts - dts,
-				})
-				if err != nil {
-					return err
-				}
-
-				return nil
+				return c.writeFanoutUnit(u)
 			})
 		})
 	}
@@ -367,53 +340,18 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 	if audioMedia != nil {
 		medias = append(medias, audioMedia)
 
-		audioStartPTSFilled := false
-		var audioStartPTS time.Duration
-
 		res.stream.readerAdd(c, audioMedia, audioFormat, func(dat data) {
-			ringBuffer.Push(func() error {
-				tdata := dat.(*dataMPEG4Audio)
+			u := fanout.audio(dat)
+			if u == nil {
+				return
+			}
 
-				if tdata.aus == nil {
+			ringBuffer.Push(func() error {
+				if videoFormat != nil && !videoFirstIDRFound {
 					return nil
 				}
 
-				if !audioStartPTSFilled {
-					audioStartPTSFilled = true
-					audioStartPTS = tdata.pts
-				}
-				pts := tdata.pts - audioStartPTS
-
-				if videoFormat != nil {
-					if !videoFirstIDRFound {
-						return nil
-					}
-
-					pts -= videoStartDTS
-					if pts < 0 {
-						return nil
-					}
-				}
-
-				for i, au := range tdata.aus {
-					c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-					err := c.conn.WriteMessage(&message.MsgAudio{
-						ChunkStreamID:   message.MsgAudioChunkStreamID,
-						MessageStreamID: 0x1000000,
-						Rate:            flvio.SOUND_44Khz,
-						Depth:           flvio.SOUND_16BIT,
-						Channels:        flvio.SOUND_STEREO,
-						AACType:         flvio.AAC_RAW,
-						Payload:         au,
-						DTS: pts + time.Duration(i)*mpeg4audio.SamplesPerAccessUnit*
-							time.Second/time.Duration(audioFormat.ClockRate()),
-					})
-					if err != nil {
-						return err
-					}
-				}
-
-				return nil
+				return c.writeFanoutUnit(u)
 			})
 		})
 	}
@@ -460,6 +398,23 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 	}
 }
 
+func (c *rtmpConn) writeFanoutUnit(u *rtmpFanoutUnit) error {
+	ems, err := u.encode(c.conn)
+	if err != nil {
+		return err
+	}
+
+	for _, em := range ems {
+		c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+		err := c.conn.WriteEncodedMessage(em)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 	pathName, query, rawQuery := pathNameAndQuery(u)
 
@@ -494,7 +449,11 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 	c.state = rtmpConnStatePublish
 	c.stateMutex.Unlock()
 
-	videoFormat, audioFormat, err := c.conn.ReadTracks()
+	c.conn.SetOnMetadata(func(md flvio.AMFMap) {
+		c.log(logger.Info, "metadata updated: %s", rtmpMetadataDescription(md))
+	})
+
+	videoFormat, audioFormat, err := c.conn.ReadTracksContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -535,21 +494,25 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 	// disable write deadline to allow outgoing acknowledges
 	c.nconn.SetWriteDeadline(time.Time{})
 
-	var onVideoData func(time.Duration, [][]byte)
+	var onVideoData func(time.Duration, time.Duration, [][]byte, bool)
 
 	if _, ok := videoFormat.(*format.H264); ok {
-		onVideoData = func(pts time.Duration, nalus [][]byte) {
+		onVideoData = func(dts time.Duration, pts time.Duration, nalus [][]byte, isKeyFrame bool) {
 			err = rres.stream.writeData(videoMedia, videoFormat, &dataH264{
-				pts:   pts,
-				nalus: nalus,
-				ntp:   time.Now(),
+				pts:        pts,
+				nalus:      nalus,
+				ntp:        time.Now(),
+				idrKnown:   true,
+				idrPresent: isKeyFrame,
+				dtsKnown:   true,
+				dts:        dts,
 			})
 			if err != nil {
 				c.log(logger.Warn, "%v", err)
 			}
 		}
 	} else {
-		onVideoData = func(pts time.Duration, nalus [][]byte) {
+		onVideoData = func(dts time.Duration, pts time.Duration, nalus [][]byte, isKeyFrame bool) {
 			err = rres.stream.writeData(videoMedia, videoFormat, &dataH265{
 				pts:   pts,
 				nalus: nalus,
@@ -571,24 +534,26 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 		switch tmsg := msg.(type) {
 		case *message.MsgVideo:
 			if tmsg.H264Type == flvio.AVC_SEQHDR {
-				var conf h264conf.Conf
-				err = conf.Unmarshal(tmsg.Payload)
-				if err != nil {
-					return fmt.Errorf("unable to parse H264 config: %v", err)
-				}
-
-				nalus := [][]byte{
-					conf.SPS,
-					conf.PPS,
-				}
+				// a new decoder configuration is sent in case of a resolution change
+				if h264Format, ok := videoFormat.(*format.H264); ok {
+					changed, err := rtmp.UpdateH264TrackFromDecoderConfig(h264Format, tmsg.Payload)
+					if err != nil {
+						return err
+					}
 
-				err := rres.stream.writeData(videoMedia, videoFormat, &dataH264{
-					pts:   tmsg.DTS + tmsg.PTSDelta,
-					nalus: nalus,
-					ntp:   time.Now(),
-				})
-				if err != nil {
-					c.log(logger.Warn, "%v", err)
+					if changed {
+						c.log(logger.Info, "H264 parameters changed")
+
+						// send parameters in-band too, in order to allow readers to reconfigure their decoders
+						err := rres.stream.writeData(videoMedia, videoFormat, &dataH264{
+							pts:   tmsg.DTS + tmsg.PTSDelta,
+							nalus: [][]byte{h264Format.SafeSPS(), h264Format.SafePPS()},
+							ntp:   time.Now(),
+						})
+						if err != nil {
+							c.log(logger.Warn, "%v", err)
+						}
+					}
 				}
 			} else if tmsg.H264Type == flvio.AVC_NALU {
 				if videoFormat == nil {
@@ -600,40 +565,41 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 					return fmt.Errorf("unable to decode AVCC: %v", err)
 				}
 
-				// skip invalid NALUs sent by DJI
-				n := 0
-				for _, nalu := range nalus {
-					if len(nalu) != 0 {
-						n++
-					}
-				}
-				if n == 0 {
+				nalus = rtmp.RemoveEmptyNALUs(nalus)
+				if len(nalus) == 0 {
 					continue
 				}
 
-				validNALUs := make([][]byte, n)
-				pos := 0
-				for _, nalu := range nalus {
-					if len(nalu) != 0 {
-						validNALUs[pos] = nalu
-						pos++
-					}
-				}
-
-				onVideoData(tmsg.DTS+tmsg.PTSDelta, validNALUs)
+				onVideoData(tmsg.DTS, tmsg.DTS+tmsg.PTSDelta, nalus, tmsg.IsKeyFrame)
 			}
 
 		case *message.MsgAudio:
-			if tmsg.AACType == flvio.AAC_RAW {
+			// additional audio tracks of multitrack streams are skipped
+			if tmsg.TrackID == 0 && tmsg.AACType == flvio.AAC_RAW {
 				if audioFormat == nil {
 					return fmt.Errorf("received an audio packet, but track is not set up")
 				}
 
-				err := rres.stream.writeData(audioMedia, audioFormat, &dataMPEG4Audio{
-					pts: tmsg.DTS,
-					aus: [][]byte{tmsg.Payload},
-					ntp: time.Now(),
-				})
+				var err error
+				if _, ok := audioFormat.(*ac3.Format); ok {
+					var frames [][]byte
+					frames, err = ac3.SplitFrames(tmsg.Payload)
+					if err != nil {
+						return fmt.Errorf("unable to decode AC-3 frames: %v", err)
+					}
+
+					err = rres.stream.writeData(audioMedia, audioFormat, &dataAC3{
+						pts:    tmsg.DTS,
+						frames: frames,
+						ntp:    time.Now(),
+					})
+				} else {
+					err = rres.stream.writeData(audioMedia, audioFormat, &dataMPEG4Audio{
+						pts: tmsg.DTS,
+						aus: [][]byte{tmsg.Payload},
+						ntp: time.Now(),
+					})
+				}
 				if err != nil {
 					c.log(logger.Warn, "%v", err)
 				}
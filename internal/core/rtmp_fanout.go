@@ -0,0 +1,245 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+// rtmpFanoutUnit contains the RTMP messages generated from a data unit.
+// Messages are encoded once for each message stream ID, then the encoded
+// messages are shared by all the readers with that message stream ID.
+type rtmpFanoutUnit struct {
+	err        error
+	isKeyFrame bool
+	video      *message.MsgVideo
+	audio      []*message.MsgAudio
+
+	mutex   sync.Mutex
+	encoded map[uint32][]*message.EncodedMessage
+}
+
+// encode returns the unit encoded for the given connection.
+func (u *rtmpFanoutUnit) encode(conn *rtmp.Conn) ([]*message.EncodedMessage, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	msid := conn.MessageStreamID()
+
+	if ems, ok := u.encoded[msid]; ok {
+		return ems, nil
+	}
+
+	var ems []*message.EncodedMessage
+
+	if u.video != nil {
+		msg := *u.video
+		msg.ChunkStreamID = conn.VideoChunkStreamID()
+		msg.MessageStreamID = msid
+
+		em, err := conn.EncodeMessage(&msg)
+		if err != nil {
+			return nil, err
+		}
+		ems = append(ems, em)
+	}
+
+	for _, au := range u.audio {
+		msg := *au
+		msg.ChunkStreamID = conn.AudioChunkStreamID()
+		msg.MessageStreamID = msid
+
+		em, err := conn.EncodeMessage(&msg)
+		if err != nil {
+			return nil, err
+		}
+		ems = append(ems, em)
+	}
+
+	u.encoded[msid] = ems
+	return ems, nil
+}
+
+// rtmpFanout converts the data of a stream into RTMP messages once for all
+// the RTMP readers of the stream. Since messages are shared, readers share
+// the same timeline, that starts with the first IDR received by the fanout.
+type rtmpFanout struct {
+	videoFormat *format.H264
+	audioFormat *format.MPEG4Audio
+
+	mutex               sync.Mutex
+	videoStartPTSFilled bool
+	videoStartPTS       time.Duration
+	videoFirstIDRFound  bool
+	videoStartDTS       time.Duration
+	videoDTSExtractor   *h264.DTSExtractor
+	lastVideoData       data
+	lastVideoUnit       *rtmpFanoutUnit
+	audioStartPTSFilled bool
+	audioStartPTS       time.Duration
+	lastAudioData       data
+	lastAudioUnit       *rtmpFanoutUnit
+}
+
+func newRTMPFanout(videoFormat *format.H264, audioFormat *format.MPEG4Audio) *rtmpFanout {
+	return &rtmpFanout{
+		videoFormat: videoFormat,
+		audioFormat: audioFormat,
+	}
+}
+
+// video returns the unit generated from a H264 data unit, or nil if the data unit must be skipped.
+// Since the stream passes the same data unit to every reader, the unit is generated
+// by the first reader that receives the data unit, and is reused by the others.
+func (f *rtmpFanout) video(dat data) *rtmpFanoutUnit {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if dat != f.lastVideoData {
+		f.lastVideoData = dat
+		f.lastVideoUnit = f.generateVideo(dat.(*dataH264))
+	}
+
+	return f.lastVideoUnit
+}
+
+func (f *rtmpFanout) generateVideo(tdata *dataH264) *rtmpFanoutUnit {
+	if tdata.nalus == nil {
+		return nil
+	}
+
+	if !f.videoStartPTSFilled {
+		f.videoStartPTSFilled = true
+		f.videoStartPTS = tdata.pts
+	}
+	pts := tdata.pts - f.videoStartPTS
+
+	idrPresent := false
+	nonIDRPresent := false
+
+	for _, nalu := range tdata.nalus {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		switch typ {
+		case h264.NALUTypeIDR:
+			idrPresent = true
+
+		case h264.NALUTypeNonIDR:
+			nonIDRPresent = true
+		}
+	}
+
+	var dts time.Duration
+
+	// wait until we receive an IDR
+	if !f.videoFirstIDRFound {
+		if !idrPresent {
+			return nil
+		}
+
+		f.videoFirstIDRFound = true
+		f.videoDTSExtractor = h264.NewDTSExtractor()
+
+		var err error
+		dts, err = f.videoDTSExtractor.Extract(tdata.nalus, pts)
+		if err != nil {
+			return &rtmpFanoutUnit{err: err}
+		}
+
+		f.videoStartDTS = dts
+		dts = 0
+		pts -= f.videoStartDTS
+	} else {
+		if !idrPresent && !nonIDRPresent {
+			return nil
+		}
+
+		var err error
+		dts, err = f.videoDTSExtractor.Extract(tdata.nalus, pts)
+		if err != nil {
+			return &rtmpFanoutUnit{err: err}
+		}
+
+		dts -= f.videoStartDTS
+		pts -= f.videoStartDTS
+	}
+
+	avcc, err := h264.AVCCMarshal(tdata.nalus)
+	if err != nil {
+		return &rtmpFanoutUnit{err: err}
+	}
+
+	return &rtmpFanoutUnit{
+		isKeyFrame: idrPresent,
+		video: &message.MsgVideo{
+			IsKeyFrame: idrPresent,
+			H264Type:   flvio.AVC_NALU,
+			Payload:    avcc,
+			DTS:        dts,
+			PTSDelta:   pts - dts,
+		},
+		encoded: make(map[uint32][]*message.EncodedMessage),
+	}
+}
+
+// audio returns the unit generated from a MPEG-4 Audio data unit, or nil if the data unit must be skipped.
+func (f *rtmpFanout) audio(dat data) *rtmpFanoutUnit {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if dat != f.lastAudioData {
+		f.lastAudioData = dat
+		f.lastAudioUnit = f.generateAudio(dat.(*dataMPEG4Audio))
+	}
+
+	return f.lastAudioUnit
+}
+
+func (f *rtmpFanout) generateAudio(tdata *dataMPEG4Audio) *rtmpFanoutUnit {
+	if tdata.aus == nil {
+		return nil
+	}
+
+	if !f.audioStartPTSFilled {
+		f.audioStartPTSFilled = true
+		f.audioStartPTS = tdata.pts
+	}
+	pts := tdata.pts - f.audioStartPTS
+
+	if f.videoFormat != nil {
+		if !f.videoFirstIDRFound {
+			return nil
+		}
+
+		pts -= f.videoStartDTS
+		if pts < 0 {
+			return nil
+		}
+	}
+
+	audioRate, audioDepth, audioChannels := rtmp.AudioFlags(f.audioFormat.Config)
+
+	u := &rtmpFanoutUnit{
+		encoded: make(map[uint32][]*message.EncodedMessage),
+	}
+
+	for i, au := range tdata.aus {
+		u.audio = append(u.audio, &message.MsgAudio{
+			Rate:     audioRate,
+			Depth:    audioDepth,
+			Channels: audioChannels,
+			AACType:  flvio.AAC_RAW,
+			Payload:  au,
+			DTS: pts + time.Duration(i)*mpeg4audio.SamplesPerAccessUnit*
+				time.Second/time.Duration(f.audioFormat.ClockRate()),
+		})
+	}
+
+	return u
+}
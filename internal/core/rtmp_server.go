@@ -11,6 +11,7 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp"
 )
 
 type rtmpServerAPIConnsListItem struct {
@@ -54,6 +55,14 @@ type rtmpServer struct {
 	readBufferCount           int
 	isTLS                     bool
 	rtspAddress               string
+	playLimiter               *rtmp.PlayLimiter
+	pacing                    bool
+	aacObjectTypes            conf.AACObjectTypes
+	setupTimeout              conf.StringDuration
+	maxPublishBitrate         uint64
+	maxPublishBitrateWindow   conf.StringDuration
+	tsCorrection              bool
+	tsCorrectionWarnThreshold conf.StringDuration
 	runOnConnect              string
 	runOnConnectRestart       bool
 	externalCmdPool           *externalcmd.Pool
@@ -84,6 +93,14 @@ func newRTMPServer(
 	serverCert string,
 	serverKey string,
 	rtspAddress string,
+	playLimiter *rtmp.PlayLimiter,
+	pacing bool,
+	aacObjectTypes conf.AACObjectTypes,
+	setupTimeout conf.StringDuration,
+	maxPublishBitrate uint64,
+	maxPublishBitrateWindow conf.StringDuration,
+	tsCorrection bool,
+	tsCorrectionWarnThreshold conf.StringDuration,
 	runOnConnect string,
 	runOnConnectRestart bool,
 	externalCmdPool *externalcmd.Pool,
@@ -115,6 +132,14 @@ func newRTMPServer(
 		writeTimeout:              writeTimeout,
 		readBufferCount:           readBufferCount,
 		rtspAddress:               rtspAddress,
+		playLimiter:               playLimiter,
+		pacing:                    pacing,
+		aacObjectTypes:            aacObjectTypes,
+		setupTimeout:              setupTimeout,
+		maxPublishBitrate:         maxPublishBitrate,
+		maxPublishBitrateWindow:   maxPublishBitrateWindow,
+		tsCorrection:              tsCorrection,
+		tsCorrectionWarnThreshold: tsCorrectionWarnThreshold,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
 		isTLS:                     isTLS,
@@ -201,6 +226,14 @@ outer:
 				s.isTLS,
 				s.externalAuthenticationURL,
 				s.rtspAddress,
+				s.playLimiter,
+				s.pacing,
+				s.aacObjectTypes,
+				s.setupTimeout,
+				s.maxPublishBitrate,
+				s.maxPublishBitrateWindow,
+				s.tsCorrection,
+				s.tsCorrectionWarnThreshold,
 				s.readTimeout,
 				s.writeTimeout,
 				s.readBufferCount,
@@ -147,6 +147,96 @@ func TestRTMPServerPublishRead(t *testing.T) {
 	}
 }
 
+func TestRTMPServerReadMultiple(t *testing.T) {
+	p, ok := newInstance("rtspDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.Close()
+
+	u, err := url.Parse("rtmp://127.0.0.1:1935/mystream")
+	require.NoError(t, err)
+
+	nconn1, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn1.Close()
+	conn1 := rtmp.NewConn(nconn1)
+
+	err = conn1.InitializeClient(u, true)
+	require.NoError(t, err)
+
+	videoTrack := &format.H264{
+		PayloadTyp: 96,
+		SPS: []byte{ // 1920x1080 baseline
+			0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+			0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+			0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9, 0x20,
+		},
+		PPS:               []byte{0x08, 0x06, 0x07, 0x08},
+		PacketizationMode: 1,
+	}
+
+	err = conn1.WriteTracks(videoTrack, nil)
+	require.NoError(t, err)
+
+	var readers []*rtmp.Conn
+
+	for i := 0; i < 2; i++ {
+		nconn, err := net.Dial("tcp", u.Host)
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := rtmp.NewConn(nconn)
+
+		err = conn.InitializeClient(u, false)
+		require.NoError(t, err)
+
+		videoTrack1, _, err := conn.ReadTracks()
+		require.NoError(t, err)
+		require.Equal(t, videoTrack, videoTrack1)
+
+		readers = append(readers, conn)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = conn1.WriteMessage(&message.MsgVideo{
+			ChunkStreamID:   message.MsgVideoChunkStreamID,
+			MessageStreamID: 0x1000000,
+			IsKeyFrame:      true,
+			H264Type:        flvio.AVC_NALU,
+			Payload: []byte{
+				0x00, 0x00, 0x00, 0x04, 0x05, 0x02, 0x03, 0x04, // IDR
+			},
+			DTS: time.Duration(i) * time.Second,
+		})
+		require.NoError(t, err)
+	}
+
+	// readers receive the same messages, with the same timestamps
+	for _, conn := range readers {
+		for i := 0; i < 2; i++ {
+			msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			require.Equal(t, &message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_NALU,
+				Payload: []byte{
+					0x00, 0x00, 0x00, 0x19, // SPS
+					0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+					0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+					0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9,
+					0x20,
+					0x00, 0x00, 0x00, 0x04, 0x08, 0x06, 0x07, 0x08, // PPS
+					0x00, 0x00, 0x00, 0x04, 0x05, 0x02, 0x03, 0x04, // IDR
+				},
+				DTS: time.Duration(i) * time.Second,
+			}, msg)
+		}
+	}
+}
+
 func TestRTMPServerAuth(t *testing.T) {
 	for _, ca := range []string{
 		"internal",
@@ -6,8 +6,8 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
-	"net/url"
 	"strings"
 	"time"
 
@@ -16,6 +16,7 @@ import (
 	"github.com/aler9/gortsplib/v2/pkg/media"
 	"github.com/notedit/rtmp/format/flv/flvio"
 
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
@@ -60,17 +61,11 @@ func (s *rtmpSource) Log(level logger.Level, format string, args ...interface{})
 func (s *rtmpSource) run(ctx context.Context) error {
 	s.Log(logger.Debug, "connecting")
 
-	u, err := url.Parse(s.ur)
+	u, err := rtmp.ParseURL(s.ur)
 	if err != nil {
 		return err
 	}
 
-	// add default port
-	_, _, err = net.SplitHostPort(u.Host)
-	if err != nil {
-		u.Host = net.JoinHostPort(u.Host, "1935")
-	}
-
 	ctx2, cancel2 := context.WithTimeout(ctx, time.Duration(s.readTimeout))
 	defer cancel2()
 
@@ -102,7 +97,13 @@ func (s *rtmpSource) run(ctx context.Context) error {
 		return err
 	}
 
+	rtmp.ConfigureTCP(nconn)
+
 	conn := rtmp.NewConn(nconn)
+	conn.SetLogger(s)
+	conn.SetOnMetadata(func(md flvio.AMFMap) {
+		s.Log(logger.Info, "metadata updated: %s", rtmpMetadataDescription(md))
+	})
 
 	readDone := make(chan error)
 	go func() {
@@ -155,6 +156,10 @@ func (s *rtmpSource) run(ctx context.Context) error {
 
 			s.Log(logger.Info, "ready: %s", sourceMediaInfo(medias))
 
+			if conn.IsFinite() {
+				s.Log(logger.Info, "source is a file with duration %v", conn.Duration())
+			}
+
 			defer func() {
 				s.parent.sourceStaticImplSetNotReady(pathSourceStaticSetNotReadyReq{})
 			}()
@@ -166,12 +171,38 @@ func (s *rtmpSource) run(ctx context.Context) error {
 				nconn.SetReadDeadline(time.Now().Add(time.Duration(s.readTimeout)))
 				msg, err := conn.ReadMessage()
 				if err != nil {
+					// files end normally with EOF
+					if err == io.EOF && conn.IsFinite() {
+						return fmt.Errorf("end of file reached")
+					}
 					return err
 				}
 
 				switch tmsg := msg.(type) {
 				case *message.MsgVideo:
-					if tmsg.H264Type == flvio.AVC_NALU {
+					if tmsg.H264Type == flvio.AVC_SEQHDR {
+						// a new decoder configuration is sent in case of a resolution change
+						if h264Format, ok := videoFormat.(*format.H264); ok {
+							changed, err := rtmp.UpdateH264TrackFromDecoderConfig(h264Format, tmsg.Payload)
+							if err != nil {
+								return err
+							}
+
+							if changed {
+								s.Log(logger.Info, "H264 parameters changed")
+
+								// send parameters in-band too, in order to allow readers to reconfigure their decoders
+								err := res.stream.writeData(videoMedia, videoFormat, &dataH264{
+									pts:   tmsg.DTS + tmsg.PTSDelta,
+									nalus: [][]byte{h264Format.SafeSPS(), h264Format.SafePPS()},
+									ntp:   time.Now(),
+								})
+								if err != nil {
+									s.Log(logger.Warn, "%v", err)
+								}
+							}
+						}
+					} else if tmsg.H264Type == flvio.AVC_NALU {
 						if videoFormat == nil {
 							return fmt.Errorf("received an H264 packet, but track is not set up")
 						}
@@ -181,10 +212,19 @@ func (s *rtmpSource) run(ctx context.Context) error {
 							return fmt.Errorf("unable to decode AVCC: %v", err)
 						}
 
+						nalus = rtmp.RemoveEmptyNALUs(nalus)
+						if len(nalus) == 0 {
+							continue
+						}
+
 						err = res.stream.writeData(videoMedia, videoFormat, &dataH264{
-							pts:   tmsg.DTS + tmsg.PTSDelta,
-							nalus: nalus,
-							ntp:   time.Now(),
+							pts:        tmsg.DTS + tmsg.PTSDelta,
+							nalus:      nalus,
+							ntp:        time.Now(),
+							idrKnown:   true,
+							idrPresent: tmsg.IsKeyFrame,
+							dtsKnown:   true,
+							dts:        tmsg.DTS,
 						})
 						if err != nil {
 							s.Log(logger.Warn, "%v", err)
@@ -192,16 +232,32 @@ func (s *rtmpSource) run(ctx context.Context) error {
 					}
 
 				case *message.MsgAudio:
-					if tmsg.AACType == flvio.AAC_RAW {
+					// additional audio tracks of multitrack streams are skipped
+					if tmsg.TrackID == 0 && tmsg.AACType == flvio.AAC_RAW {
 						if audioFormat == nil {
 							return fmt.Errorf("received an AAC packet, but track is not set up")
 						}
 
-						err := res.stream.writeData(audioMedia, audioFormat, &dataMPEG4Audio{
-							pts: tmsg.DTS,
-							aus: [][]byte{tmsg.Payload},
-							ntp: time.Now(),
-						})
+						var err error
+						if _, ok := audioFormat.(*ac3.Format); ok {
+							var frames [][]byte
+							frames, err = ac3.SplitFrames(tmsg.Payload)
+							if err != nil {
+								return fmt.Errorf("unable to decode AC-3 frames: %v", err)
+							}
+
+							err = res.stream.writeData(audioMedia, audioFormat, &dataAC3{
+								pts:    tmsg.DTS,
+								frames: frames,
+								ntp:    time.Now(),
+							})
+						} else {
+							err = res.stream.writeData(audioMedia, audioFormat, &dataMPEG4Audio{
+								pts: tmsg.DTS,
+								aus: [][]byte{tmsg.Payload},
+								ntp: time.Now(),
+							})
+						}
 						if err != nil {
 							s.Log(logger.Warn, "%v", err)
 						}
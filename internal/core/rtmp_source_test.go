@@ -15,6 +15,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
 )
 
@@ -151,3 +152,113 @@ func TestRTMPSource(t *testing.T) {
 		})
 	}
 }
+
+func TestRTMPSourceParamsChange(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:1937")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	connected := make(chan struct{})
+	received := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+		conn := rtmp.NewConn(nconn)
+
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		videoTrack := &format.H264{
+			PayloadTyp: 96,
+			SPS: []byte{ // 1920x1080 baseline
+				0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+				0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+				0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9, 0x20,
+			},
+			PPS:               []byte{0x08, 0x06, 0x07, 0x08},
+			PacketizationMode: 1,
+		}
+
+		audioTrack := &format.MPEG4Audio{
+			PayloadTyp: 96,
+			Config: &mpeg4audio.Config{
+				Type:         2,
+				SampleRate:   44100,
+				ChannelCount: 2,
+			},
+			SizeLength:       13,
+			IndexLength:      3,
+			IndexDeltaLength: 3,
+		}
+
+		err = conn.WriteTracks(videoTrack, audioTrack)
+		require.NoError(t, err)
+
+		<-connected
+
+		conf := h264conf.Conf{
+			SPS: []byte{
+				0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+				0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+				0x00, 0x03, 0x00, 0x3d, 0x08,
+			},
+			PPS: []byte{0x08, 0x06, 0x07, 0x09},
+		}
+		buf, err := conf.Marshal()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgVideo{
+			ChunkStreamID:   message.MsgVideoChunkStreamID,
+			MessageStreamID: 0x1000000,
+			IsKeyFrame:      true,
+			H264Type:        flvio.AVC_SEQHDR,
+			Payload:         buf,
+		})
+		require.NoError(t, err)
+
+		<-done
+	}()
+
+	p, ok := newInstance("paths:\n" +
+		"  proxied:\n" +
+		"    source: rtmp://localhost:1937/teststream\n" +
+		"    sourceOnDemand: yes\n")
+	require.Equal(t, true, ok)
+	defer p.Close()
+
+	c := gortsplib.Client{}
+
+	u, err := url.Parse("rtsp://127.0.0.1:8554/proxied")
+	require.NoError(t, err)
+
+	err = c.Start(u.Scheme, u.Host)
+	require.NoError(t, err)
+	defer c.Close()
+
+	medias, baseURL, _, err := c.Describe(u)
+	require.NoError(t, err)
+
+	err = c.SetupAll(medias, baseURL)
+	require.NoError(t, err)
+
+	// new parameters are sent in-band
+	c.OnPacketRTP(medias[0], medias[0].Formats[0], func(pkt *rtp.Packet) {
+		require.Equal(t, []byte{
+			0x18, 0x00, 0x15, 0x67, 0x64, 0x00, 0x0c, 0xac,
+			0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03,
+			0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08,
+			0x00, 0x04, 0x08, 0x06, 0x07, 0x09,
+		}, pkt.Payload)
+		close(received)
+	})
+
+	_, err = c.Play(nil)
+	require.NoError(t, err)
+
+	close(connected)
+	<-received
+	close(done)
+}
@@ -364,11 +364,23 @@ func (s *rtspSession) onRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.R
 				})
 
 			default:
+				custom := findFormatProcessorCodec(forma) != nil
+
 				ctx.Session.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
-					err := s.stream.writeData(cmedia, cformat, &dataGeneric{
-						rtpPackets: []*rtp.Packet{pkt},
-						ntp:        time.Now(),
-					})
+					var dat data
+					if custom {
+						dat = &dataCustom{
+							rtpPackets: []*rtp.Packet{pkt},
+							ntp:        time.Now(),
+						}
+					} else {
+						dat = &dataGeneric{
+							rtpPackets: []*rtp.Packet{pkt},
+							ntp:        time.Now(),
+						}
+					}
+
+					err := s.stream.writeData(cmedia, cformat, dat)
 					if err != nil {
 						s.log(logger.Warn, "%v", err)
 					}
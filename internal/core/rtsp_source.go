@@ -204,11 +204,23 @@ func (s *rtspSource) run(ctx context.Context) error {
 						})
 
 					default:
+						custom := findFormatProcessorCodec(forma) != nil
+
 						c.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
-							err := res.stream.writeData(cmedia, cformat, &dataGeneric{
-								rtpPackets: []*rtp.Packet{pkt},
-								ntp:        time.Now(),
-							})
+							var dat data
+							if custom {
+								dat = &dataCustom{
+									rtpPackets: []*rtp.Packet{pkt},
+									ntp:        time.Now(),
+								}
+							} else {
+								dat = &dataGeneric{
+									rtpPackets: []*rtp.Packet{pkt},
+									ntp:        time.Now(),
+								}
+							}
+
+							err := res.stream.writeData(cmedia, cformat, dat)
 							if err != nil {
 								s.Log(logger.Warn, "%v", err)
 							}
@@ -1,21 +1,38 @@
 package core
 
 import (
+	"sync"
+	"time"
+
 	"github.com/aler9/gortsplib/v2"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/media"
 )
 
+// streamReencodeStats contains the re-encoding statistics of a media.
+type streamReencodeStats struct {
+	reencoding       bool
+	reencodedPackets uint64
+}
+
 type stream struct {
 	bytesReceived *uint64
 	rtspStream    *gortsplib.ServerStream
 	smedias       map[*media.Media]*streamMedia
+
+	rtmpFanoutMutex   sync.Mutex
+	rtmpFanout        *rtmpFanout
+	rtmpFanoutReaders int
 }
 
 func newStream(
 	medias media.Medias,
 	generateRTPPackets bool,
+	skipDecodeErrors bool,
+	h265MaxPacketsWithoutMarker int,
+	h265EncodeTimeout time.Duration,
 	bytesReceived *uint64,
+	parent formatProcessorParent,
 ) (*stream, error) {
 	s := &stream{
 		bytesReceived: bytesReceived,
@@ -26,7 +43,14 @@ func newStream(
 
 	for _, media := range s.rtspStream.Medias() {
 		var err error
-		s.smedias[media], err = newStreamMedia(media, generateRTPPackets)
+		s.smedias[media], err = newStreamMedia(
+			media,
+			generateRTPPackets,
+			skipDecodeErrors,
+			h265MaxPacketsWithoutMarker,
+			h265EncodeTimeout,
+			parent,
+		)
 		if err != nil {
 			return nil, err
 		}
@@ -37,12 +61,32 @@ func newStream(
 
 func (s *stream) close() {
 	s.rtspStream.Close()
+
+	for _, sm := range s.smedias {
+		sm.close()
+	}
 }
 
 func (s *stream) medias() media.Medias {
 	return s.rtspStream.Medias()
 }
 
+// reencodeStats returns the re-encoding statistics of each media, in the same order of medias().
+func (s *stream) reencodeStats() []streamReencodeStats {
+	medias := s.medias()
+	ret := make([]streamReencodeStats, len(medias))
+
+	for i, medi := range medias {
+		for _, sf := range s.smedias[medi].formats {
+			reencoding, packets := sf.reencodeStats()
+			ret[i].reencoding = ret[i].reencoding || reencoding
+			ret[i].reencodedPackets += packets
+		}
+	}
+
+	return ret
+}
+
 func (s *stream) readerAdd(r reader, medi *media.Media, forma format.Format, cb func(data)) {
 	sm := s.smedias[medi]
 	sf := sm.formats[forma]
@@ -57,6 +101,31 @@ func (s *stream) readerRemove(r reader) {
 	}
 }
 
+// rtmpFanoutAdd returns the fanout shared by the RTMP readers of the stream.
+func (s *stream) rtmpFanoutAdd(videoFormat *format.H264, audioFormat *format.MPEG4Audio) *rtmpFanout {
+	s.rtmpFanoutMutex.Lock()
+	defer s.rtmpFanoutMutex.Unlock()
+
+	if s.rtmpFanout == nil {
+		s.rtmpFanout = newRTMPFanout(videoFormat, audioFormat)
+	}
+	s.rtmpFanoutReaders++
+
+	return s.rtmpFanout
+}
+
+// rtmpFanoutRemove releases the fanout. When there are no RTMP readers left,
+// the fanout is discarded, in order to restart the timeline with the next reader.
+func (s *stream) rtmpFanoutRemove() {
+	s.rtmpFanoutMutex.Lock()
+	defer s.rtmpFanoutMutex.Unlock()
+
+	s.rtmpFanoutReaders--
+	if s.rtmpFanoutReaders == 0 {
+		s.rtmpFanout = nil
+	}
+}
+
 func (s *stream) writeData(medi *media.Media, forma format.Format, data data) error {
 	sm := s.smedias[medi]
 	sf := sm.formats[forma]
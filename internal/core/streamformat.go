@@ -3,6 +3,7 @@ package core
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/media"
@@ -14,8 +15,21 @@ type streamFormat struct {
 	nonRTSPReaders map[reader]func(data)
 }
 
-func newStreamFormat(forma format.Format, generateRTPPackets bool) (*streamFormat, error) {
-	proc, err := newFormatProcessor(forma, generateRTPPackets)
+func newStreamFormat(
+	forma format.Format,
+	generateRTPPackets bool,
+	skipDecodeErrors bool,
+	h265MaxPacketsWithoutMarker int,
+	h265EncodeTimeout time.Duration,
+	parent formatProcessorParent,
+) (*streamFormat, error) {
+	proc, err := newFormatProcessor(
+		forma,
+		generateRTPPackets,
+		skipDecodeErrors,
+		h265MaxPacketsWithoutMarker,
+		h265EncodeTimeout,
+		parent)
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +42,21 @@ func newStreamFormat(forma format.Format, generateRTPPackets bool) (*streamForma
 	return sf, nil
 }
 
+func (sf *streamFormat) close() {
+	if c, ok := sf.proc.(formatProcessorCloser); ok {
+		c.close()
+	}
+}
+
+// reencodeStats returns whether RTP packets are being re-encoded,
+// and the number of packets that have been generated by re-encoding.
+func (sf *streamFormat) reencodeStats() (bool, uint64) {
+	if r, ok := sf.proc.(formatProcessorReencoder); ok {
+		return r.reencodeStats()
+	}
+	return false, 0
+}
+
 func (sf *streamFormat) readerAdd(r reader, cb func(data)) {
 	sf.mutex.Lock()
 	defer sf.mutex.Unlock()
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"time"
+
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/media"
 )
@@ -9,14 +11,28 @@ type streamMedia struct {
 	formats map[format.Format]*streamFormat
 }
 
-func newStreamMedia(medi *media.Media, generateRTPPackets bool) (*streamMedia, error) {
+func newStreamMedia(
+	medi *media.Media,
+	generateRTPPackets bool,
+	skipDecodeErrors bool,
+	h265MaxPacketsWithoutMarker int,
+	h265EncodeTimeout time.Duration,
+	parent formatProcessorParent,
+) (*streamMedia, error) {
 	sm := &streamMedia{
 		formats: make(map[format.Format]*streamFormat),
 	}
 
 	for _, forma := range medi.Formats {
 		var err error
-		sm.formats[forma], err = newStreamFormat(forma, generateRTPPackets)
+		sm.formats[forma], err = newStreamFormat(
+			forma,
+			generateRTPPackets,
+			skipDecodeErrors,
+			h265MaxPacketsWithoutMarker,
+			h265EncodeTimeout,
+			parent,
+		)
 		if err != nil {
 			return nil, err
 		}
@@ -24,3 +40,9 @@ func newStreamMedia(medi *media.Media, generateRTPPackets bool) (*streamMedia, e
 
 	return sm, nil
 }
+
+func (sm *streamMedia) close() {
+	for _, sf := range sm.formats {
+		sf.close()
+	}
+}
@@ -0,0 +1,423 @@
+package fmp4
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+)
+
+// EncryptionScheme is a protection scheme of Common Encryption (ISO/IEC 23001-7).
+type EncryptionScheme int
+
+// supported schemes.
+const (
+	// AES-CTR with random per-sample IVs.
+	EncryptionSchemeCENC EncryptionScheme = iota
+
+	// AES-CBC with a constant IV and, for video, a 1:9 pattern.
+	EncryptionSchemeCBCS
+)
+
+// size of the per-sample IVs of the cenc scheme.
+const encryptionCENCIVSize = 8
+
+// bytes at the beginning of video NALUs that are left in clear,
+// in order to leave the slice header readable, as required by both schemes.
+const encryptionClearNALUPrefix = 32
+
+// encryptionSubsample is an entry of the subsample encryption information,
+// that describes a range of clear bytes followed by a range of protected bytes.
+type encryptionSubsample struct {
+	clear     uint16
+	protected uint32
+}
+
+// encryptionSampleInfo is the auxiliary information of an encrypted sample,
+// that is written into the senc box.
+type encryptionSampleInfo struct {
+	iv         []byte
+	subsamples []encryptionSubsample
+}
+
+func (i encryptionSampleInfo) size(useSubsamples bool) int {
+	n := len(i.iv)
+	if useSubsamples {
+		n += 2 + len(i.subsamples)*6
+	}
+	return n
+}
+
+// Encryption contains the parameters of Common Encryption.
+// Video samples are encrypted with subsample encryption, that leaves NALU headers
+// and slice headers in clear, therefore the video track must be H264.
+type Encryption struct {
+	Scheme EncryptionScheme
+	KeyID  [16]byte
+	Key    [16]byte
+
+	// IV that is used by all samples of the cbcs scheme.
+	// It is ignored by the cenc scheme, that generates random per-sample IVs.
+	ConstantIV [16]byte
+
+	// pssh boxes that are inserted into the initialization file, as provided by DRM systems.
+	PSSH [][]byte
+}
+
+// Validate checks whether tracks with the given formats can be encrypted with the selected scheme.
+// Subsample encryption of video is implemented for H264 only.
+func (e *Encryption) Validate(formats ...format.Format) error {
+	switch e.Scheme {
+	case EncryptionSchemeCENC, EncryptionSchemeCBCS:
+	default:
+		return fmt.Errorf("unsupported encryption scheme: %d", e.Scheme)
+	}
+
+	for _, forma := range formats {
+		switch forma.(type) {
+		case *format.H264, *format.MPEG4Audio, *ac3.Format:
+		default:
+			return fmt.Errorf("encryption of tracks with format %T is not supported", forma)
+		}
+	}
+
+	return nil
+}
+
+func (e *Encryption) schemeType() string {
+	if e.Scheme == EncryptionSchemeCBCS {
+		return "cbcs"
+	}
+	return "cenc"
+}
+
+func (e *Encryption) validatePSSH() error {
+	for _, pssh := range e.PSSH {
+		if len(pssh) < 8 ||
+			int(binary.BigEndian.Uint32(pssh)) != len(pssh) ||
+			string(pssh[4:8]) != "pssh" {
+			return fmt.Errorf("invalid pssh box")
+		}
+	}
+	return nil
+}
+
+// marshalSinf encodes a sinf box, that is placed into encrypted sample entries
+// and contains the original format of the sample entry and the default encryption parameters.
+// go-mp4 doesn't support writing all the boxes, therefore they are written manually.
+func (e *Encryption) marshalSinf(originalFormat string, isVideo bool) []byte {
+	/*
+		sinf
+		- frma
+		- schm
+		- schi
+		  - tenc
+	*/
+
+	var tenc []byte
+
+	if e.Scheme == EncryptionSchemeCBCS {
+		tenc = make([]byte, 12+20+17)
+		tenc[8] = 1 // version
+		if isVideo {
+			tenc[13] = 1<<4 | 9 // crypt_byte_block, skip_byte_block
+		}
+		tenc[14] = 1 // isProtected
+		tenc[15] = 0 // Per_Sample_IV_Size
+		copy(tenc[16:], e.KeyID[:])
+		tenc[32] = 16 // constant_IV_size
+		copy(tenc[33:], e.ConstantIV[:])
+	} else {
+		tenc = make([]byte, 12+20)
+		tenc[14] = 1 // isProtected
+		tenc[15] = encryptionCENCIVSize
+		copy(tenc[16:], e.KeyID[:])
+	}
+
+	binary.BigEndian.PutUint32(tenc, uint32(len(tenc)))
+	copy(tenc[4:], "tenc")
+
+	frma := make([]byte, 12)
+	binary.BigEndian.PutUint32(frma, 12)
+	copy(frma[4:], "frma")
+	copy(frma[8:], originalFormat)
+
+	schm := make([]byte, 20)
+	binary.BigEndian.PutUint32(schm, 20)
+	copy(schm[4:], "schm")
+	copy(schm[12:], e.schemeType())
+	binary.BigEndian.PutUint32(schm[16:], 0x00010000) // scheme_version
+
+	schi := make([]byte, 8, 8+len(tenc))
+	binary.BigEndian.PutUint32(schi, uint32(8+len(tenc)))
+	copy(schi[4:], "schi")
+	schi = append(schi, tenc...)
+
+	sinfSize := 8 + len(frma) + len(schm) + len(schi)
+	sinf := make([]byte, 8, sinfSize)
+	binary.BigEndian.PutUint32(sinf, uint32(sinfSize))
+	copy(sinf[4:], "sinf")
+	sinf = append(sinf, frma...)
+	sinf = append(sinf, schm...)
+	sinf = append(sinf, schi...)
+
+	return sinf
+}
+
+// encryptSampleEntry converts a sample entry, that is encoded manually,
+// into an encrypted sample entry, by changing its type and appending a sinf box.
+func (e *Encryption) encryptSampleEntry(entry []byte, typ string, isVideo bool) []byte {
+	sinf := e.marshalSinf(string(entry[4:8]), isVideo)
+
+	ret := make([]byte, len(entry)+len(sinf))
+	copy(ret, entry)
+	copy(ret[len(entry):], sinf)
+	binary.BigEndian.PutUint32(ret, uint32(len(ret)))
+	copy(ret[4:], typ)
+
+	return ret
+}
+
+// videoSubsamples computes the subsamples of a H264 sample in AVCC format.
+// The protected part of slices starts after encryptionClearNALUPrefix bytes and is
+// a multiple of the AES block size, while other NALUs are left in clear.
+func videoSubsamples(payload []byte) ([]encryptionSubsample, error) {
+	var ret []encryptionSubsample
+	clear := 0
+
+	addClear := func(n int) {
+		clear += n
+		for clear > 0xFFFF {
+			ret = append(ret, encryptionSubsample{clear: 0xFFFF})
+			clear -= 0xFFFF
+		}
+	}
+
+	buf := payload
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("invalid AVCC")
+		}
+
+		size := int(binary.BigEndian.Uint32(buf))
+		if size == 0 || len(buf) < (4+size) {
+			return nil, fmt.Errorf("invalid AVCC")
+		}
+
+		protected := 0
+		typ := h264.NALUType(buf[4] & 0x1F)
+		if (typ == h264.NALUTypeNonIDR || typ == h264.NALUTypeIDR) && size > encryptionClearNALUPrefix {
+			protected = ((size - encryptionClearNALUPrefix) / aes.BlockSize) * aes.BlockSize
+		}
+
+		addClear(4 + size - protected)
+
+		if protected > 0 {
+			ret = append(ret, encryptionSubsample{
+				clear:     uint16(clear),
+				protected: uint32(protected),
+			})
+			clear = 0
+		}
+
+		buf = buf[4+size:]
+	}
+
+	if clear > 0 {
+		ret = append(ret, encryptionSubsample{clear: uint16(clear)})
+	}
+
+	return ret, nil
+}
+
+// encryptCBCS encrypts a range of a sample with AES-CBC,
+// applying the pattern of the cbcs scheme to video samples.
+// Partial blocks at the end of the range are left in clear.
+func (e *Encryption) encryptCBCS(block cipher.Block, buf []byte, isVideo bool) {
+	enc := cipher.NewCBCEncrypter(block, e.ConstantIV[:])
+	n := (len(buf) / aes.BlockSize) * aes.BlockSize
+
+	if !isVideo {
+		enc.CryptBlocks(buf[:n], buf[:n])
+		return
+	}
+
+	// encrypt 1 block, skip 9 blocks.
+	// CBC chaining continues across encrypted blocks.
+	for pos := 0; pos < n; pos += 10 * aes.BlockSize {
+		enc.CryptBlocks(buf[pos:pos+aes.BlockSize], buf[pos:pos+aes.BlockSize])
+	}
+}
+
+// encryptSample returns an encrypted copy of a sample and its auxiliary information.
+func (e *Encryption) encryptSample(
+	block cipher.Block,
+	payload []byte,
+	isVideo bool,
+) ([]byte, encryptionSampleInfo, error) {
+	var info encryptionSampleInfo
+
+	ret := make([]byte, len(payload))
+	copy(ret, payload)
+
+	if isVideo {
+		var err error
+		info.subsamples, err = videoSubsamples(payload)
+		if err != nil {
+			return nil, info, err
+		}
+	}
+
+	if e.Scheme == EncryptionSchemeCBCS {
+		if !isVideo {
+			e.encryptCBCS(block, ret, false)
+			return ret, info, nil
+		}
+
+		// the IV is reset at the beginning of each subsample
+		pos := 0
+		for _, s := range info.subsamples {
+			pos += int(s.clear)
+			e.encryptCBCS(block, ret[pos:pos+int(s.protected)], true)
+			pos += int(s.protected)
+		}
+
+		return ret, info, nil
+	}
+
+	info.iv = make([]byte, encryptionCENCIVSize)
+	_, err := rand.Read(info.iv)
+	if err != nil {
+		return nil, info, err
+	}
+
+	var iv [aes.BlockSize]byte
+	copy(iv[:], info.iv)
+	stream := cipher.NewCTR(block, iv[:])
+
+	if !isVideo {
+		stream.XORKeyStream(ret, ret)
+		return ret, info, nil
+	}
+
+	// the counter continues across the protected ranges of subsamples
+	pos := 0
+	for _, s := range info.subsamples {
+		pos += int(s.clear)
+		stream.XORKeyStream(ret[pos:pos+int(s.protected)], ret[pos:pos+int(s.protected)])
+		pos += int(s.protected)
+	}
+
+	return ret, info, nil
+}
+
+// encryptTrack encrypts the samples of a track and returns their payloads and auxiliary information.
+func (e *Encryption) encryptTrack(track *PartTrack) ([][]byte, []encryptionSampleInfo, error) {
+	block, err := aes.NewCipher(e.Key[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payloads := make([][]byte, len(track.Samples))
+	infos := make([]encryptionSampleInfo, len(track.Samples))
+
+	for i, sample := range track.Samples {
+		payloads[i], infos[i], err = e.encryptSample(block, sample.Payload, track.IsVideo)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return payloads, infos, nil
+}
+
+// marshalSenc encodes a senc box, that contains the auxiliary information of samples.
+// It is written manually since it's not supported by go-mp4.
+func marshalSenc(infos []encryptionSampleInfo, useSubsamples bool) []byte {
+	size := 16
+	for _, info := range infos {
+		size += info.size(useSubsamples)
+	}
+
+	byts := make([]byte, size)
+	binary.BigEndian.PutUint32(byts, uint32(size))
+	copy(byts[4:], "senc")
+	if useSubsamples {
+		byts[11] = 0x02 // flags: UseSubSampleEncryption
+	}
+	binary.BigEndian.PutUint32(byts[12:], uint32(len(infos)))
+	pos := 16
+
+	for _, info := range infos {
+		pos += copy(byts[pos:], info.iv)
+
+		if useSubsamples {
+			binary.BigEndian.PutUint16(byts[pos:], uint16(len(info.subsamples)))
+			pos += 2
+
+			for _, s := range info.subsamples {
+				binary.BigEndian.PutUint16(byts[pos:], s.clear)
+				binary.BigEndian.PutUint32(byts[pos+2:], s.protected)
+				pos += 6
+			}
+		}
+	}
+
+	return byts
+}
+
+// marshalSaiz encodes a saiz box, that contains the sizes of the auxiliary information of samples.
+// Sizes are encoded with a single byte, therefore samples with too many subsamples
+// (more than 40 with the cenc scheme) can't be encrypted.
+func marshalSaiz(infos []encryptionSampleInfo, useSubsamples bool) ([]byte, error) {
+	for _, info := range infos {
+		if info.size(useSubsamples) > 255 {
+			return nil, fmt.Errorf("auxiliary information of sample is too big (%d subsamples)",
+				len(info.subsamples))
+		}
+	}
+
+	defaultSize := infos[0].size(useSubsamples)
+	for _, info := range infos[1:] {
+		if info.size(useSubsamples) != defaultSize {
+			defaultSize = 0
+			break
+		}
+	}
+
+	size := 17
+	if defaultSize == 0 {
+		size += len(infos)
+	}
+
+	byts := make([]byte, size)
+	binary.BigEndian.PutUint32(byts, uint32(size))
+	copy(byts[4:], "saiz")
+	byts[12] = uint8(defaultSize)
+	binary.BigEndian.PutUint32(byts[13:], uint32(len(infos)))
+
+	if defaultSize == 0 {
+		for i, info := range infos {
+			byts[17+i] = uint8(info.size(useSubsamples))
+		}
+	}
+
+	return byts, nil
+}
+
+// marshalSaio encodes a saio box, that contains the offset of the auxiliary information
+// of samples with respect to the beginning of the moof box.
+func marshalSaio(offset int) []byte {
+	byts := make([]byte, 20)
+	binary.BigEndian.PutUint32(byts, 20)
+	copy(byts[4:], "saio")
+	binary.BigEndian.PutUint32(byts[12:], 1) // entry_count
+	binary.BigEndian.PutUint32(byts[16:], uint32(offset))
+	return byts
+}
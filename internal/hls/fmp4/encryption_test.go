@@ -0,0 +1,404 @@
+package fmp4
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/stretchr/testify/require"
+)
+
+var testEncryptionKey = [16]byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+}
+
+var testEncryptionKeyID = [16]byte{
+	0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+	0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20,
+}
+
+// testFindBoxes returns the payloads of the boxes with the given type,
+// searching inside container boxes.
+func testFindBoxes(byts []byte, typ string) [][]byte {
+	var ret [][]byte
+
+	for len(byts) >= 8 {
+		size := int(binary.BigEndian.Uint32(byts))
+		if size < 8 || size > len(byts) {
+			break
+		}
+
+		switch string(byts[4:8]) {
+		case typ:
+			ret = append(ret, byts[8:size])
+
+		case "moof", "traf", "moov", "sinf", "schi":
+			ret = append(ret, testFindBoxes(byts[8:size], typ)...)
+		}
+
+		byts = byts[size:]
+	}
+
+	return ret
+}
+
+func testEncryptionPart() (*Part, [][]byte) {
+	idr := make([]byte, 100)
+	idr[0] = 0x05
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i)
+	}
+
+	videoSample1 := append([]byte{
+		0x00, 0x00, 0x00, 0x04,
+		0x07, 0x01, 0x02, 0x03, // SPS
+		0x00, 0x00, 0x00, 0x64,
+	}, idr...)
+
+	videoSample2 := []byte{
+		0x00, 0x00, 0x00, 0x14,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // non-IDR
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x11, 0x12, 0x13, 0x14,
+	}
+
+	audioSample := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x11, 0x12, 0x13, 0x14,
+	}
+
+	part := &Part{
+		Tracks: []*PartTrack{
+			{
+				ID: 1,
+				Samples: []*PartSample{
+					{
+						Duration: 90000,
+						Payload:  videoSample1,
+					},
+					{
+						Duration:        90000,
+						Payload:         videoSample2,
+						IsNonSyncSample: true,
+					},
+				},
+				IsVideo: true,
+			},
+			{
+				ID: 2,
+				Samples: []*PartSample{{
+					Duration: 1024,
+					Payload:  audioSample,
+				}},
+			},
+		},
+	}
+
+	return part, [][]byte{videoSample1, videoSample2, audioSample}
+}
+
+func TestPartMarshalEncryptionCENC(t *testing.T) {
+	part, samples := testEncryptionPart()
+	part.Encryption = &Encryption{
+		Scheme: EncryptionSchemeCENC,
+		KeyID:  testEncryptionKeyID,
+		Key:    testEncryptionKey,
+	}
+
+	byts, err := part.Marshal()
+	require.NoError(t, err)
+
+	sencs := testFindBoxes(byts, "senc")
+	require.Equal(t, 2, len(sencs))
+	require.Equal(t, 2, len(testFindBoxes(byts, "saiz")))
+	require.Equal(t, 2, len(testFindBoxes(byts, "saio")))
+
+	// video
+	senc := sencs[0]
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x02}, senc[:4])
+	require.Equal(t, uint32(2), binary.BigEndian.Uint32(senc[4:]))
+	videoIV1 := senc[8:16]
+	require.Equal(t, []byte{
+		0x00, 0x01,
+		0x00, 0x30, 0x00, 0x00, 0x00, 0x40,
+	}, senc[16:24])
+	videoIV2 := senc[24:32]
+	require.Equal(t, []byte{
+		0x00, 0x01,
+		0x00, 0x18, 0x00, 0x00, 0x00, 0x00,
+	}, senc[32:40])
+
+	// the offset of the auxiliary information points to the first IV
+	saio := testFindBoxes(byts, "saio")[0]
+	off := binary.BigEndian.Uint32(saio[8:])
+	require.Equal(t, videoIV1, byts[off:off+8])
+
+	// audio
+	senc = sencs[1]
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x00}, senc[:4])
+	require.Equal(t, uint32(1), binary.BigEndian.Uint32(senc[4:]))
+	audioIV := senc[8:16]
+
+	block, err := aes.NewCipher(testEncryptionKey[:])
+	require.NoError(t, err)
+
+	decrypt := func(iv []byte, buf []byte) []byte {
+		var fullIV [16]byte
+		copy(fullIV[:], iv)
+		ret := make([]byte, len(buf))
+		cipher.NewCTR(block, fullIV[:]).XORKeyStream(ret, buf)
+		return ret
+	}
+
+	mdat := testFindBoxes(byts, "mdat")[0]
+	require.Equal(t, len(samples[0])+len(samples[1])+len(samples[2]), len(mdat))
+
+	sample := mdat[:len(samples[0])]
+	require.Equal(t, samples[0][:48], sample[:48])
+	require.NotEqual(t, samples[0][48:], sample[48:])
+	require.Equal(t, samples[0][48:], decrypt(videoIV1, sample[48:]))
+	mdat = mdat[len(samples[0]):]
+
+	// slices that are smaller than the clear prefix are left in clear
+	require.Equal(t, samples[1], mdat[:len(samples[1])])
+	require.NotEqual(t, videoIV1, videoIV2)
+	mdat = mdat[len(samples[1]):]
+
+	require.Equal(t, samples[2], decrypt(audioIV, mdat))
+
+	// the original samples are not modified
+	part2, _ := testEncryptionPart()
+	require.Equal(t, part2.Tracks, part.Tracks)
+}
+
+func TestPartMarshalEncryptionCBCS(t *testing.T) {
+	part, samples := testEncryptionPart()
+	part.Encryption = &Encryption{
+		Scheme:     EncryptionSchemeCBCS,
+		KeyID:      testEncryptionKeyID,
+		Key:        testEncryptionKey,
+		ConstantIV: [16]byte{0x21, 0x22, 0x23, 0x24},
+	}
+
+	byts, err := part.Marshal()
+	require.NoError(t, err)
+
+	// audio samples don't have auxiliary information
+	sencs := testFindBoxes(byts, "senc")
+	require.Equal(t, 1, len(sencs))
+
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x01,
+		0x00, 0x30, 0x00, 0x00, 0x00, 0x40,
+		0x00, 0x01,
+		0x00, 0x18, 0x00, 0x00, 0x00, 0x00,
+	}, sencs[0])
+
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x00,
+		0x08,
+		0x00, 0x00, 0x00, 0x02,
+	}, testFindBoxes(byts, "saiz")[0])
+
+	block, err := aes.NewCipher(testEncryptionKey[:])
+	require.NoError(t, err)
+
+	decrypt := func(buf []byte) []byte {
+		ret := make([]byte, len(buf))
+		cipher.NewCBCDecrypter(block, part.Encryption.ConstantIV[:]).CryptBlocks(ret, buf)
+		return ret
+	}
+
+	mdat := testFindBoxes(byts, "mdat")[0]
+
+	// the protected range is made of 4 blocks, and only the first one is encrypted
+	sample := mdat[:len(samples[0])]
+	require.Equal(t, samples[0][:48], sample[:48])
+	require.Equal(t, samples[0][48:64], decrypt(sample[48:64]))
+	require.Equal(t, samples[0][64:], sample[64:])
+	mdat = mdat[len(samples[0]):]
+
+	require.Equal(t, samples[1], mdat[:len(samples[1])])
+	mdat = mdat[len(samples[1]):]
+
+	// partial blocks are left in clear
+	require.Equal(t, samples[2][:16], decrypt(mdat[:16]))
+	require.Equal(t, samples[2][16:], mdat[16:])
+}
+
+func TestInitMarshalEncryption(t *testing.T) {
+	pssh := []byte{
+		0x00, 0x00, 0x00, 0x20,
+		'p', 's', 's', 'h',
+		0x00, 0x00, 0x00, 0x00,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	init := Init{
+		Tracks: []*InitTrack{
+			{
+				ID:        1,
+				TimeScale: 90000,
+				Format:    testVideoTrack,
+			},
+			{
+				ID:        2,
+				TimeScale: uint32(testAudioTrack.ClockRate()),
+				Format:    testAudioTrack,
+			},
+		},
+		Encryption: &Encryption{
+			Scheme:     EncryptionSchemeCBCS,
+			KeyID:      testEncryptionKeyID,
+			Key:        testEncryptionKey,
+			ConstantIV: [16]byte{0x21, 0x22, 0x23, 0x24},
+			PSSH:       [][]byte{pssh},
+		},
+	}
+
+	byts, err := init.Marshal()
+	require.NoError(t, err)
+
+	require.True(t, bytes.Contains(byts, []byte("encv")))
+	require.True(t, bytes.Contains(byts, []byte("enca")))
+	require.Equal(t, pssh, byts[len(byts)-len(pssh):])
+
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x0c, 'f', 'r', 'm', 'a', 'a', 'v', 'c', '1',
+		0x00, 0x00, 0x00, 0x14, 's', 'c', 'h', 'm',
+		0x00, 0x00, 0x00, 0x00, 'c', 'b', 'c', 's', 0x00, 0x01, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x39, 's', 'c', 'h', 'i',
+		0x00, 0x00, 0x00, 0x31, 't', 'e', 'n', 'c',
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x19, 0x01, 0x00,
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+		0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20,
+		0x10,
+		0x21, 0x22, 0x23, 0x24, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, init.Encryption.marshalSinf("avc1", true)[8:])
+
+	t.Run("unsupported format", func(t *testing.T) {
+		init := Init{
+			Tracks: []*InitTrack{{
+				ID:        1,
+				TimeScale: 90000,
+				Format:    &format.MJPEG{},
+			}},
+			Encryption: &Encryption{},
+		}
+
+		_, err := init.Marshal()
+		require.EqualError(t, err, "encryption of tracks with format *format.MJPEG is not supported")
+	})
+
+	t.Run("invalid pssh", func(t *testing.T) {
+		init := Init{
+			Tracks: []*InitTrack{{
+				ID:        1,
+				TimeScale: 90000,
+				Format:    testVideoTrack,
+			}},
+			Encryption: &Encryption{
+				PSSH: [][]byte{{0x00, 0x00, 0x00, 0x09, 'p', 's', 's', 'h'}},
+			},
+		}
+
+		_, err := init.Marshal()
+		require.EqualError(t, err, "invalid pssh box")
+	})
+}
+
+func TestEncryptionValidate(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		scheme EncryptionScheme
+		forma  format.Format
+		err    string
+	}{
+		{
+			"h264 cenc",
+			EncryptionSchemeCENC,
+			testVideoTrack,
+			"",
+		},
+		{
+			"mpeg4audio cbcs",
+			EncryptionSchemeCBCS,
+			testAudioTrack,
+			"",
+		},
+		{
+			"h265",
+			EncryptionSchemeCBCS,
+			&format.H265{PayloadTyp: 96},
+			"encryption of tracks with format *format.H265 is not supported",
+		},
+		{
+			"invalid scheme",
+			EncryptionScheme(5),
+			testVideoTrack,
+			"unsupported encryption scheme: 5",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			err := (&Encryption{Scheme: ca.scheme}).Validate(ca.forma)
+			if ca.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, ca.err)
+			}
+		})
+	}
+}
+
+func TestPartMarshalEncryptionManySlices(t *testing.T) {
+	sample := func(sliceCount int) []byte {
+		var ret []byte
+		for i := 0; i < sliceCount; i++ {
+			ret = append(ret, 0x00, 0x00, 0x00, 0x64)
+			ret = append(ret, 0x01) // non-IDR
+			ret = append(ret, bytes.Repeat([]byte{0x02}, 99)...)
+		}
+		return ret
+	}
+
+	part := func(sliceCount int) *Part {
+		return &Part{
+			Tracks: []*PartTrack{{
+				ID: 1,
+				Samples: []*PartSample{{
+					Duration: 90000,
+					Payload:  sample(sliceCount),
+				}},
+				IsVideo: true,
+			}},
+			Encryption: &Encryption{
+				Scheme: EncryptionSchemeCENC,
+				KeyID:  testEncryptionKeyID,
+				Key:    testEncryptionKey,
+			},
+		}
+	}
+
+	byts, err := part(40).Marshal()
+	require.NoError(t, err)
+
+	// the size of the auxiliary information is 8 (IV) + 2 (subsample count) + 40 * 6
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x00,
+		0xfa,
+		0x00, 0x00, 0x00, 0x01,
+	}, testFindBoxes(byts, "saiz")[0])
+
+	_, err = part(41).Marshal()
+	require.EqualError(t, err, "auxiliary information of sample is too big (41 subsamples)")
+}
@@ -11,7 +11,12 @@ import (
 
 // Init is a FMP4 initialization file.
 type Init struct {
+	// if true, the file is marked as a CMAF header.
+	CMAF   bool
 	Tracks []*InitTrack
+
+	// if present, tracks are marked as encrypted with Common Encryption.
+	Encryption *Encryption
 }
 
 // Unmarshal decodes a FMP4 initialization file.
@@ -192,11 +197,30 @@ func (i *Init) Marshal() ([]byte, error) {
 		  - trex
 		  - trex
 		  - ...
+		- pssh (encryption only)
+		- ...
 	*/
 
+	if i.Encryption != nil {
+		err := i.Encryption.validatePSSH()
+		if err != nil {
+			return nil, err
+		}
+
+		formats := make([]format.Format, len(i.Tracks))
+		for j, track := range i.Tracks {
+			formats[j] = track.Format
+		}
+
+		err = i.Encryption.Validate(formats...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	w := newMP4Writer()
 
-	_, err := w.WriteBox(&gomp4.Ftyp{ // <ftyp/>
+	ftyp := &gomp4.Ftyp{
 		MajorBrand:   [4]byte{'m', 'p', '4', '2'},
 		MinorVersion: 1,
 		CompatibleBrands: []gomp4.CompatibleBrandElem{
@@ -205,7 +229,23 @@ func (i *Init) Marshal() ([]byte, error) {
 			{CompatibleBrand: [4]byte{'i', 's', 'o', 'm'}},
 			{CompatibleBrand: [4]byte{'h', 'l', 's', 'f'}},
 		},
-	})
+	}
+
+	if i.CMAF {
+		// a CMAF header must contain the CMAF structural brand
+		// and a brand that supports version 1 of tfdt.
+		ftyp = &gomp4.Ftyp{
+			MajorBrand:   [4]byte{'c', 'm', 'f', 'c'},
+			MinorVersion: 0,
+			CompatibleBrands: []gomp4.CompatibleBrandElem{
+				{CompatibleBrand: [4]byte{'c', 'm', 'f', 'c'}},
+				{CompatibleBrand: [4]byte{'i', 's', 'o', '6'}},
+				{CompatibleBrand: [4]byte{'h', 'l', 's', 'f'}},
+			},
+		}
+	}
+
+	_, err := w.WriteBox(ftyp) // <ftyp/>
 	if err != nil {
 		return nil, err
 	}
@@ -227,7 +267,7 @@ func (i *Init) Marshal() ([]byte, error) {
 	}
 
 	for _, track := range i.Tracks {
-		err := track.marshal(w)
+		err := track.marshal(w, i.Encryption)
 		if err != nil {
 			return nil, err
 		}
@@ -253,6 +293,15 @@ func (i *Init) Marshal() ([]byte, error) {
 		return nil, err
 	}
 
+	if i.Encryption != nil {
+		for _, pssh := range i.Encryption.PSSH {
+			_, err = w.write(pssh) // <pssh/>
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	err = w.writeBoxEnd() // </moov>
 	if err != nil {
 		return nil, err
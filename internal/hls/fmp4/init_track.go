@@ -1,9 +1,14 @@
 package fmp4
 
 import (
+	"encoding/binary"
+
 	gomp4 "github.com/abema/go-mp4"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 )
 
 // InitTrack is a track of Init.
@@ -11,9 +16,14 @@ type InitTrack struct {
 	ID        int
 	TimeScale uint32
 	Format    format.Format
+
+	// size of the picture of M-JPEG tracks,
+	// whose format doesn't contain it.
+	Width  int
+	Height int
 }
 
-func (track *InitTrack) marshal(w *mp4Writer) error {
+func (track *InitTrack) marshal(w *mp4Writer, enc *Encryption) error {
 	/*
 	   trak
 	   - tkhd
@@ -28,13 +38,22 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 	           - url
 	       - stbl
 	         - stsd
-	           - avc1 (h264 only)
+	           - avc1 / encv (h264 only)
 	             - avcC
 	             - pasp
 	             - btrt
-	           - mp4a (mpeg4audio only)
+	             - sinf (encryption only)
+	           - mp4v (mjpeg only)
+	             - esds
+	           - mp4a / enca (mpeg4audio only)
 	             - esds
 	             - btrt
+	             - sinf (encryption only)
+	           - ac-3 / ec-3 / enca (ac3 only)
+	             - dac3 / dec3
+	             - sinf (encryption only)
+	           - ipcm (lpcm only)
+	             - pcmC
 	         - stts
 	         - stsc
 	         - stsz
@@ -65,6 +84,13 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 		width = spsp.Width()
 		height = spsp.Height()
 
+	case *format.MJPEG:
+		width = track.Width
+		height = track.Height
+	}
+
+	switch track.Format.(type) {
+	case *format.H264, *format.MJPEG:
 		_, err = w.WriteBox(&gomp4.Tkhd{ // <tkhd/>
 			FullBox: gomp4.FullBox{
 				Flags: [3]byte{0, 0, 3},
@@ -78,7 +104,7 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 			return err
 		}
 
-	case *format.MPEG4Audio:
+	case *format.MPEG4Audio, *ac3.Format, *format.LPCM:
 		_, err = w.WriteBox(&gomp4.Tkhd{ // <tkhd/>
 			FullBox: gomp4.FullBox{
 				Flags: [3]byte{0, 0, 3},
@@ -107,7 +133,7 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 	}
 
 	switch track.Format.(type) {
-	case *format.H264:
+	case *format.H264, *format.MJPEG:
 		_, err = w.WriteBox(&gomp4.Hdlr{ // <hdlr/>
 			HandlerType: [4]byte{'v', 'i', 'd', 'e'},
 			Name:        "VideoHandler",
@@ -116,7 +142,7 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 			return err
 		}
 
-	case *format.MPEG4Audio:
+	case *format.MPEG4Audio, *ac3.Format, *format.LPCM:
 		_, err = w.WriteBox(&gomp4.Hdlr{ // <hdlr/>
 			HandlerType: [4]byte{'s', 'o', 'u', 'n'},
 			Name:        "SoundHandler",
@@ -132,7 +158,7 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 	}
 
 	switch track.Format.(type) {
-	case *format.H264:
+	case *format.H264, *format.MJPEG:
 		_, err = w.WriteBox(&gomp4.Vmhd{ // <vmhd/>
 			FullBox: gomp4.FullBox{
 				Flags: [3]byte{0, 0, 1},
@@ -142,7 +168,7 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 			return err
 		}
 
-	case *format.MPEG4Audio:
+	case *format.MPEG4Audio, *ac3.Format, *format.LPCM:
 		_, err = w.WriteBox(&gomp4.Smhd{ // <smhd/>
 		})
 		if err != nil {
@@ -195,10 +221,17 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 
 	switch ttrack := track.Format.(type) {
 	case *format.H264:
-		_, err = w.writeBoxStart(&gomp4.VisualSampleEntry{ // <avc1>
+		// encrypted sample entries have the same content of the original ones,
+		// in addition to a sinf box.
+		typ := gomp4.BoxTypeAvc1()
+		if enc != nil {
+			typ = gomp4.StrToBoxType("encv")
+		}
+
+		_, err = w.writeBoxStart(&gomp4.VisualSampleEntry{ // <avc1> or <encv>
 			SampleEntry: gomp4.SampleEntry{
 				AnyTypeBox: gomp4.AnyTypeBox{
-					Type: gomp4.BoxTypeAvc1(),
+					Type: typ,
 				},
 				DataReferenceIndex: 1,
 			},
@@ -250,22 +283,53 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 			return err
 		}
 
-		err = w.writeBoxEnd() // </avc1>
+		if enc != nil {
+			_, err = w.write(enc.marshalSinf("avc1", true)) // <sinf/>
+			if err != nil {
+				return err
+			}
+		}
+
+		err = w.writeBoxEnd() // </avc1> or </encv>
+		if err != nil {
+			return err
+		}
+
+	case *format.MJPEG:
+		_, err = w.write(marshalMJPEGSampleEntry(track.ID, width, height)) // <mp4v/>
 		if err != nil {
 			return err
 		}
 
 	case *format.MPEG4Audio:
-		_, err = w.writeBoxStart(&gomp4.AudioSampleEntry{ // <mp4a>
+		// with SBR and PS, the output sample rate and channel count
+		// are different from the ones of the AAC-LC core.
+		sampleRate := ttrack.ClockRate()
+		channelCount := ttrack.Config.ChannelCount
+		switch ttrack.Config.ExtensionType {
+		case mpeg4audio.ObjectTypeSBR:
+			sampleRate = ttrack.Config.ExtensionSampleRate
+
+		case mpeg4audio.ObjectTypePS:
+			sampleRate = ttrack.Config.ExtensionSampleRate
+			channelCount = 2
+		}
+
+		typ := gomp4.BoxTypeMp4a()
+		if enc != nil {
+			typ = gomp4.StrToBoxType("enca")
+		}
+
+		_, err = w.writeBoxStart(&gomp4.AudioSampleEntry{ // <mp4a> or <enca>
 			SampleEntry: gomp4.SampleEntry{
 				AnyTypeBox: gomp4.AnyTypeBox{
-					Type: gomp4.BoxTypeMp4a(),
+					Type: typ,
 				},
 				DataReferenceIndex: 1,
 			},
-			ChannelCount: uint16(ttrack.Config.ChannelCount),
+			ChannelCount: uint16(channelCount),
 			SampleSize:   16,
-			SampleRate:   uint32(ttrack.ClockRate() * 65536),
+			SampleRate:   uint32(sampleRate * 65536),
 		})
 		if err != nil {
 			return err
@@ -322,7 +386,31 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 			return err
 		}
 
-		err = w.writeBoxEnd() // </mp4a>
+		if enc != nil {
+			_, err = w.write(enc.marshalSinf("mp4a", false)) // <sinf/>
+			if err != nil {
+				return err
+			}
+		}
+
+		err = w.writeBoxEnd() // </mp4a> or </enca>
+		if err != nil {
+			return err
+		}
+
+	case *ac3.Format:
+		entry := marshalAC3SampleEntry(ttrack.Config)
+		if enc != nil {
+			entry = enc.encryptSampleEntry(entry, "enca", false)
+		}
+
+		_, err = w.write(entry) // <ac-3/>, <ec-3/> or <enca/>
+		if err != nil {
+			return err
+		}
+
+	case *format.LPCM:
+		_, err = w.write(marshalLPCMSampleEntry(ttrack)) // <ipcm/>
 		if err != nil {
 			return err
 		}
@@ -379,3 +467,120 @@ func (track *InitTrack) marshal(w *mp4Writer) error {
 
 	return nil
 }
+
+// AC-3 and E-AC-3 sample entries are not supported by go-mp4,
+// therefore they are written manually, following ETSI TS 102 366, annex F.
+func marshalAC3SampleEntry(conf *ac3.Config) []byte {
+	lfeOn := uint8(0)
+	if conf.LFEOn {
+		lfeOn = 1
+	}
+
+	var typ string
+	var specificTyp string
+	var specific []byte
+
+	if !conf.Enhanced {
+		typ = "ac-3"
+		specificTyp = "dac3"
+		specific = []byte{
+			conf.Fscod<<6 | conf.Bsid<<1 | conf.Bsmod>>2,
+			conf.Bsmod<<6 | conf.Acmod<<3 | lfeOn<<2 | conf.BitRateCode>>3,
+			conf.BitRateCode << 5,
+		}
+	} else {
+		typ = "ec-3"
+		specificTyp = "dec3"
+
+		// data rate in kbit/s, followed by the number of independent substreams minus one
+		dataRate := conf.FrameSize * 8 * conf.SampleRate / conf.SamplesPerFrame() / 1000
+		specific = []byte{
+			byte(dataRate >> 5),
+			byte(dataRate << 3),
+			conf.Fscod<<6 | conf.Bsid<<1,
+			conf.Bsmod<<4 | conf.Acmod<<1 | lfeOn,
+			0,
+		}
+	}
+
+	specificSize := 8 + len(specific)
+	size := 8 + 28 + specificSize
+	buf := make([]byte, size)
+
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	copy(buf[4:], typ)
+	binary.BigEndian.PutUint16(buf[14:], 1) // data reference index
+	binary.BigEndian.PutUint16(buf[24:], uint16(conf.ChannelCount))
+	binary.BigEndian.PutUint16(buf[26:], 16) // sample size
+	binary.BigEndian.PutUint32(buf[32:], uint32(conf.SampleRate)<<16)
+
+	binary.BigEndian.PutUint32(buf[36:], uint32(specificSize))
+	copy(buf[40:], specificTyp)
+	copy(buf[44:], specific)
+
+	return buf
+}
+
+// the ipcm sample entry is not supported by go-mp4,
+// therefore it is written manually, following ISO/IEC 23003-5.
+// Samples of RTP LPCM tracks are in network byte order, that is big endian.
+func marshalLPCMSampleEntry(track *format.LPCM) []byte {
+	pcmCSize := 14
+	size := 8 + 28 + pcmCSize
+	buf := make([]byte, size)
+
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	copy(buf[4:], "ipcm")
+	binary.BigEndian.PutUint16(buf[14:], 1) // data reference index
+	binary.BigEndian.PutUint16(buf[24:], uint16(track.ChannelCount))
+	binary.BigEndian.PutUint16(buf[26:], uint16(track.BitDepth)) // sample size
+	binary.BigEndian.PutUint32(buf[32:], uint32(track.SampleRate)<<16)
+
+	binary.BigEndian.PutUint32(buf[36:], uint32(pcmCSize))
+	copy(buf[40:], "pcmC")
+	// version and flags are zero
+	buf[48] = 0 // format flags: big endian
+	buf[49] = byte(track.BitDepth)
+
+	return buf
+}
+
+// the mp4v sample entry is not supported by go-mp4,
+// therefore it is written manually, following ISO/IEC 14496-14.
+// JPEG images are identified by object type 0x6C.
+func marshalMJPEGSampleEntry(trackID int, width int, height int) []byte {
+	esds := []byte{
+		0x03, 21, // ES_Descriptor
+		byte(trackID >> 8), byte(trackID), // ES_ID
+		0,        // flags
+		0x04, 13, // DecoderConfigDescriptor
+		0x6C,    // object type indication (JPEG)
+		0x11,    // stream type (visual), reserved bit
+		0, 0, 0, // buffer size
+		0, 0, 0, 0, // max bitrate
+		0, 0, 0, 0, // average bitrate
+		0x06, 1, // SLConfigDescriptor
+		0x02,
+	}
+
+	esdsSize := 12 + len(esds)
+	size := 86 + esdsSize
+	buf := make([]byte, size)
+
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	copy(buf[4:], "mp4v")
+	binary.BigEndian.PutUint16(buf[14:], 1) // data reference index
+	binary.BigEndian.PutUint16(buf[32:], uint16(width))
+	binary.BigEndian.PutUint16(buf[34:], uint16(height))
+	binary.BigEndian.PutUint32(buf[36:], 0x00480000) // horizontal resolution, 72 dpi
+	binary.BigEndian.PutUint32(buf[40:], 0x00480000) // vertical resolution, 72 dpi
+	binary.BigEndian.PutUint16(buf[48:], 1)          // frame count
+	binary.BigEndian.PutUint16(buf[82:], 24)         // depth
+	binary.BigEndian.PutUint16(buf[84:], 0xFFFF)     // pre-defined
+
+	binary.BigEndian.PutUint32(buf[86:], uint32(esdsSize))
+	copy(buf[90:], "esds")
+	copy(buf[98:], esds) // version and flags are zero
+
+	return buf
+}
@@ -88,6 +88,15 @@ func (w *mp4Writer) rewriteBox(off int, box gomp4.IImmutableBox) error {
 	return nil
 }
 
+func (w *mp4Writer) offset() (int, error) {
+	off, err := w.w.Seek(0, io.SeekCurrent)
+	return int(off), err
+}
+
+func (w *mp4Writer) write(byts []byte) (int, error) {
+	return w.w.Write(byts)
+}
+
 func (w *mp4Writer) bytes() []byte {
 	return w.buf.Bytes()
 }
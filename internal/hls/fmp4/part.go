@@ -2,7 +2,9 @@ package fmp4
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"time"
 
 	gomp4 "github.com/abema/go-mp4"
 )
@@ -15,11 +17,71 @@ const (
 	trunFlagSampleCompositionTimeOffsetPresentOrV1 = 0x800
 
 	sampleFlagIsNonSyncSample = 1 << 16
+	sampleFlagDependsOnOthers = 1 << 24
+	sampleFlagDependsOnNone   = 2 << 24
+
+	prftSize = 32
+
+	// seconds between 1900-01-01 (NTP epoch) and 1970-01-01 (Unix epoch)
+	ntpEpochOffset = 2208988800
 )
 
+func ntpTimestampEncode(t time.Time) uint64 {
+	ns := uint64(t.UnixNano()) + ntpEpochOffset*uint64(time.Second)
+	return (ns/uint64(time.Second))<<32 | ((ns%uint64(time.Second))<<32)/uint64(time.Second)
+}
+
+func ntpTimestampDecode(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64(((v & 0xFFFFFFFF) * uint64(time.Second)) >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// PartProducerReferenceTime is the content of a prft box,
+// that maps the media time of a track to the wall clock.
+type PartProducerReferenceTime struct {
+	TrackID   int
+	NTP       time.Time
+	MediaTime uint64
+}
+
+func (prft *PartProducerReferenceTime) unmarshal(byts []byte) error {
+	if len(byts) != (prftSize - 8) {
+		return fmt.Errorf("invalid prft size")
+	}
+
+	if byts[0] != 1 {
+		return fmt.Errorf("unsupported prft version")
+	}
+
+	prft.TrackID = int(binary.BigEndian.Uint32(byts[4:]))
+	prft.NTP = ntpTimestampDecode(binary.BigEndian.Uint64(byts[8:]))
+	prft.MediaTime = binary.BigEndian.Uint64(byts[16:])
+
+	return nil
+}
+
+func (prft *PartProducerReferenceTime) marshal() []byte {
+	// prft is written manually since it's not supported by go-mp4
+	byts := make([]byte, prftSize)
+	binary.BigEndian.PutUint32(byts[0:], prftSize)
+	copy(byts[4:], "prft")
+	byts[8] = 1 // version
+	binary.BigEndian.PutUint32(byts[12:], uint32(prft.TrackID))
+	binary.BigEndian.PutUint64(byts[16:], ntpTimestampEncode(prft.NTP))
+	binary.BigEndian.PutUint64(byts[24:], prft.MediaTime)
+	return byts
+}
+
 // Part is a FMP4 part file.
 type Part struct {
-	Tracks []*PartTrack
+	// if present, a prft box is written before the moof box.
+	ProducerReferenceTime *PartProducerReferenceTime
+	SequenceNumber        uint32
+	Tracks                []*PartTrack
+
+	// if present, samples are encrypted with Common Encryption (marshal only).
+	Encryption *Encryption
 }
 
 // Parts is a sequence of FMP4 parts.
@@ -41,19 +103,62 @@ func (ps *Parts) Unmarshal(byts []byte) error {
 	var curTrack *PartTrack
 	var tfdt *gomp4.Tfdt
 	var tfhd *gomp4.Tfhd
+	var prft *PartProducerReferenceTime
 
 	_, err := gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
 		switch h.BoxInfo.Type.String() {
+		case "styp":
+			if state != waitingMoof || prft != nil {
+				return nil, fmt.Errorf("unexpected styp")
+			}
+
+			return nil, nil
+
+		case "prft":
+			if state != waitingMoof || prft != nil {
+				return nil, fmt.Errorf("unexpected prft")
+			}
+
+			start := h.BoxInfo.Offset + h.BoxInfo.HeaderSize
+			end := h.BoxInfo.Offset + h.BoxInfo.Size
+			if end > uint64(len(byts)) {
+				return nil, fmt.Errorf("invalid prft size")
+			}
+
+			prft = &PartProducerReferenceTime{}
+			err := prft.unmarshal(byts[start:end])
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, nil
+
 		case "moof":
 			if state != waitingMoof {
 				return nil, fmt.Errorf("unexpected moof")
 			}
 
-			curPart = &Part{}
+			curPart = &Part{
+				ProducerReferenceTime: prft,
+			}
+			prft = nil
 			*ps = append(*ps, curPart)
 			moofOffset = h.BoxInfo.Offset
 			state = waitingTraf
 
+		case "mfhd":
+			if state != waitingTraf {
+				return nil, fmt.Errorf("unexpected mfhd")
+			}
+
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+
+			curPart.SequenceNumber = box.(*gomp4.Mfhd).SequenceNumber
+			return nil, nil
+
 		case "traf":
 			if state != waitingTraf && state != waitingTfdtTfhdTrun {
 				return nil, fmt.Errorf("unexpected traf")
@@ -178,7 +283,7 @@ func (ps *Parts) Unmarshal(byts []byte) error {
 		return err
 	}
 
-	if state != waitingMoof {
+	if state != waitingMoof || prft != nil {
 		return fmt.Errorf("decode error")
 	}
 
@@ -188,22 +293,33 @@ func (ps *Parts) Unmarshal(byts []byte) error {
 // Marshal encodes a FMP4 part file.
 func (p *Part) Marshal() ([]byte, error) {
 	/*
+		prft (optional)
 		moof
 		- mfhd
 		- traf (video)
 		- traf (audio)
 		mdat
+
+		when encryption is enabled, tracks are encrypted before being written,
+		and traf boxes contain senc, saiz and saio boxes.
 	*/
 
 	w := newMP4Writer()
 
+	if p.ProducerReferenceTime != nil {
+		_, err := w.write(p.ProducerReferenceTime.marshal()) // <prft/>
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	moofOffset, err := w.writeBoxStart(&gomp4.Moof{}) // <moof>
 	if err != nil {
 		return nil, err
 	}
 
 	_, err = w.WriteBox(&gomp4.Mfhd{ // <mfhd/>
-		SequenceNumber: 0,
+		SequenceNumber: p.SequenceNumber,
 	})
 	if err != nil {
 		return nil, err
@@ -213,10 +329,19 @@ func (p *Part) Marshal() ([]byte, error) {
 	truns := make([]*gomp4.Trun, trackLen)
 	trunOffsets := make([]int, trackLen)
 	dataOffsets := make([]int, trackLen)
+	payloads := make([][][]byte, trackLen)
 	dataSize := 0
 
 	for i, track := range p.Tracks {
-		trun, trunOffset, err := track.marshal(w)
+		var encInfos []encryptionSampleInfo
+		if p.Encryption != nil {
+			payloads[i], encInfos, err = p.Encryption.encryptTrack(track)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		trun, trunOffset, err := track.marshal(w, moofOffset, encInfos)
 		if err != nil {
 			return nil, err
 		}
@@ -240,9 +365,13 @@ func (p *Part) Marshal() ([]byte, error) {
 	mdat.Data = make([]byte, dataSize)
 	pos := 0
 
-	for _, track := range p.Tracks {
-		for _, sample := range track.Samples {
-			pos += copy(mdat.Data[pos:], sample.Payload)
+	for i, track := range p.Tracks {
+		for j, sample := range track.Samples {
+			if payloads[i] != nil {
+				pos += copy(mdat.Data[pos:], payloads[i][j])
+			} else {
+				pos += copy(mdat.Data[pos:], sample.Payload)
+			}
 		}
 	}
 
@@ -3,6 +3,7 @@ package fmp4
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	gomp4 "github.com/abema/go-mp4"
 	"github.com/stretchr/testify/require"
@@ -247,3 +248,46 @@ func TestPartUnmarshal(t *testing.T) {
 		},
 	}}, parts)
 }
+
+func TestPartProducerReferenceTime(t *testing.T) {
+	part := &Part{
+		ProducerReferenceTime: &PartProducerReferenceTime{
+			TrackID:   1,
+			NTP:       time.Date(2010, 1, 1, 1, 1, 1, 500000000, time.UTC),
+			MediaTime: 3 * 90000,
+		},
+		Tracks: []*PartTrack{
+			{
+				ID:       1,
+				BaseTime: 3 * 90000,
+				Samples: []*PartSample{
+					{
+						Duration: 2 * 90000,
+						Payload: []byte{
+							0x00, 0x00, 0x00, 0x01,
+							0x05, // IDR
+						},
+					},
+				},
+				IsVideo: true,
+			},
+		},
+	}
+
+	byts, err := part.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x20, 'p', 'r', 'f', 't',
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	}, byts[:16])
+
+	var parts Parts
+	err = parts.Unmarshal(byts)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(parts))
+	require.Equal(t, 1, parts[0].ProducerReferenceTime.TrackID)
+	require.Equal(t, uint64(3*90000), parts[0].ProducerReferenceTime.MediaTime)
+	require.WithinDuration(t, part.ProducerReferenceTime.NTP,
+		parts[0].ProducerReferenceTime.NTP, time.Microsecond)
+	require.Equal(t, part.Tracks[0].Samples[0].Payload, parts[0].Tracks[0].Samples[0].Payload)
+}
@@ -20,12 +20,19 @@ type PartTrack struct {
 	IsVideo  bool // marshal only
 }
 
-func (pt *PartTrack) marshal(w *mp4Writer) (*gomp4.Trun, int, error) {
+func (pt *PartTrack) marshal(
+	w *mp4Writer,
+	moofOffset int,
+	encInfos []encryptionSampleInfo,
+) (*gomp4.Trun, int, error) {
 	/*
 		traf
 		- tfhd
 		- tfdt
 		- trun
+		- senc (encryption only)
+		- saiz (encryption only)
+		- saio (encryption only)
 	*/
 
 	_, err := w.writeBoxStart(&gomp4.Traf{}) // <traf>
@@ -78,9 +85,13 @@ func (pt *PartTrack) marshal(w *mp4Writer) (*gomp4.Trun, int, error) {
 
 	for _, sample := range pt.Samples {
 		if pt.IsVideo {
+			// sync samples don't depend on other samples,
+			// while non-sync samples do.
 			var flags uint32
 			if sample.IsNonSyncSample {
-				flags |= sampleFlagIsNonSyncSample
+				flags = sampleFlagDependsOnOthers | sampleFlagIsNonSyncSample
+			} else {
+				flags = sampleFlagDependsOnNone
 			}
 
 			trun.Entries = append(trun.Entries, gomp4.TrunEntry{
@@ -102,6 +113,11 @@ func (pt *PartTrack) marshal(w *mp4Writer) (*gomp4.Trun, int, error) {
 		return nil, 0, err
 	}
 
+	err = pt.marshalEncryptionInfo(w, moofOffset, encInfos)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	err = w.writeBoxEnd() // </traf>
 	if err != nil {
 		return nil, 0, err
@@ -109,3 +125,43 @@ func (pt *PartTrack) marshal(w *mp4Writer) (*gomp4.Trun, int, error) {
 
 	return trun, trunOffset, nil
 }
+
+func (pt *PartTrack) marshalEncryptionInfo(
+	w *mp4Writer,
+	moofOffset int,
+	encInfos []encryptionSampleInfo,
+) error {
+	// video samples are encrypted with subsample encryption.
+	useSubsamples := pt.IsVideo
+
+	// auxiliary information is empty when samples have a constant IV
+	// and are fully encrypted, and in this case boxes are omitted.
+	if len(encInfos) == 0 || encInfos[0].size(useSubsamples) == 0 {
+		return nil
+	}
+
+	sencOffset, err := w.offset()
+	if err != nil {
+		return err
+	}
+
+	saiz, err := marshalSaiz(encInfos, useSubsamples)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.write(marshalSenc(encInfos, useSubsamples)) // <senc/>
+	if err != nil {
+		return err
+	}
+
+	_, err = w.write(saiz) // <saiz/>
+	if err != nil {
+		return err
+	}
+
+	// auxiliary information starts after the header of senc and the sample count,
+	// and its offset is relative to the moof box, since tfhd has the default-base-is-moof flag.
+	_, err = w.write(marshalSaio(sencOffset + 16 - moofOffset)) // <saio/>
+	return err
+}
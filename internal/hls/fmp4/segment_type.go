@@ -0,0 +1,49 @@
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// SegmentType is the content of a styp box,
+// that can be placed at the beginning of a segment.
+type SegmentType struct {
+	MajorBrand       [4]byte
+	MinorVersion     uint32
+	CompatibleBrands [][4]byte
+}
+
+// CMAFSegmentType returns the styp box of a CMAF segment.
+// If chunked is true, the segment is marked as made of multiple CMAF chunks,
+// each one consisting of a single moof and mdat pair.
+func CMAFSegmentType(chunked bool) *SegmentType {
+	st := &SegmentType{
+		MajorBrand: [4]byte{'c', 'm', 'f', 's'},
+		CompatibleBrands: [][4]byte{
+			{'c', 'm', 'f', 's'},
+			{'c', 'm', 'f', 'f'},
+		},
+	}
+
+	if chunked {
+		st.CompatibleBrands = append(st.CompatibleBrands, [4]byte{'c', 'm', 'f', 'l'})
+	}
+
+	return st
+}
+
+// Marshal encodes a styp box.
+func (st *SegmentType) Marshal() []byte {
+	// styp is written manually since it's not supported by go-mp4
+	size := 16 + 4*len(st.CompatibleBrands)
+	byts := make([]byte, size)
+	binary.BigEndian.PutUint32(byts[0:], uint32(size))
+	copy(byts[4:], "styp")
+	copy(byts[8:], st.MajorBrand[:])
+	binary.BigEndian.PutUint32(byts[12:], st.MinorVersion)
+
+	for i, brand := range st.CompatibleBrands {
+		copy(byts[16+4*i:], brand[:])
+	}
+
+	return byts
+}
@@ -0,0 +1,41 @@
+package fmp4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentTypeMarshal(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		chunked bool
+		byts    []byte
+	}{
+		{
+			"standard",
+			false,
+			[]byte{
+				0x00, 0x00, 0x00, 0x18,
+				's', 't', 'y', 'p',
+				'c', 'm', 'f', 's', 0x00, 0x00, 0x00, 0x00,
+				'c', 'm', 'f', 's', 'c', 'm', 'f', 'f',
+			},
+		},
+		{
+			"chunked",
+			true,
+			[]byte{
+				0x00, 0x00, 0x00, 0x1c,
+				's', 't', 'y', 'p',
+				'c', 'm', 'f', 's', 0x00, 0x00, 0x00, 0x00,
+				'c', 'm', 'f', 's', 'c', 'm', 'f', 'f',
+				'c', 'm', 'f', 'l',
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.byts, CMAFSegmentType(ca.chunked).Marshal())
+		})
+	}
+}
@@ -10,10 +10,18 @@ import (
 	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/asticode/go-astits"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 )
 
+// PCROffset is the offset that is added to the timestamps of samples,
+// in order to make them greater than the PCR.
+const PCROffset = 400 * time.Millisecond // 2 samples @ 5fps
+
+// stream types of AC-3 and E-AC-3, as defined by ATSC A/52.
 const (
-	pcrOffset = 400 * time.Millisecond // 2 samples @ 5fps
+	streamTypeAC3  = astits.StreamType(0x81)
+	streamTypeEAC3 = astits.StreamType(0x87)
 )
 
 type writerFunc func(p []byte) (int, error)
@@ -25,7 +33,7 @@ func (f writerFunc) Write(p []byte) (int, error) {
 // Writer is a MPEG-TS writer.
 type Writer struct {
 	videoFormat *format.H264
-	audioFormat *format.MPEG4Audio
+	audioFormat format.Format
 
 	buf        *bytes.Buffer
 	inner      *astits.Muxer
@@ -35,7 +43,7 @@ type Writer struct {
 // NewWriter allocates a Writer.
 func NewWriter(
 	videoFormat *format.H264,
-	audioFormat *format.MPEG4Audio,
+	audioFormat format.Format,
 ) *Writer {
 	w := &Writer{
 		videoFormat: videoFormat,
@@ -57,9 +65,18 @@ func NewWriter(
 	}
 
 	if audioFormat != nil {
+		streamType := astits.StreamTypeAACAudio
+		if ac3Format, ok := audioFormat.(*ac3.Format); ok {
+			if ac3Format.Config.Enhanced {
+				streamType = streamTypeEAC3
+			} else {
+				streamType = streamTypeAC3
+			}
+		}
+
 		w.inner.AddElementaryStream(astits.PMTElementaryStream{
 			ElementaryPID: 257,
-			StreamType:    astits.StreamTypeAACAudio,
+			StreamType:    streamType,
 		})
 	}
 
@@ -126,11 +143,11 @@ func (w *Writer) WriteH264(
 
 	if dts == pts {
 		oh.PTSDTSIndicator = astits.PTSDTSIndicatorOnlyPTS
-		oh.PTS = &astits.ClockReference{Base: int64((pts + pcrOffset).Seconds() * 90000)}
+		oh.PTS = &astits.ClockReference{Base: int64((pts + PCROffset).Seconds() * 90000)}
 	} else {
 		oh.PTSDTSIndicator = astits.PTSDTSIndicatorBothPresent
-		oh.DTS = &astits.ClockReference{Base: int64((dts + pcrOffset).Seconds() * 90000)}
-		oh.PTS = &astits.ClockReference{Base: int64((pts + pcrOffset).Seconds() * 90000)}
+		oh.DTS = &astits.ClockReference{Base: int64((dts + PCROffset).Seconds() * 90000)}
+		oh.PTS = &astits.ClockReference{Base: int64((pts + PCROffset).Seconds() * 90000)}
 	}
 
 	_, err = w.inner.WriteData(&astits.MuxerData{
@@ -153,11 +170,13 @@ func (w *Writer) WriteAAC(
 	pts time.Duration,
 	au []byte,
 ) error {
+	audioFormat := w.audioFormat.(*format.MPEG4Audio)
+
 	pkts := mpeg4audio.ADTSPackets{
 		{
-			Type:         w.audioFormat.Config.Type,
-			SampleRate:   w.audioFormat.Config.SampleRate,
-			ChannelCount: w.audioFormat.Config.ChannelCount,
+			Type:         audioFormat.Config.Type,
+			SampleRate:   audioFormat.Config.SampleRate,
+			ChannelCount: audioFormat.Config.ChannelCount,
 			AU:           au,
 		},
 	}
@@ -167,6 +186,24 @@ func (w *Writer) WriteAAC(
 		return err
 	}
 
+	return w.writeAudio(pcr, pts, enc, 192) // audio
+}
+
+// WriteAC3 writes an AC-3 or E-AC-3 frame.
+func (w *Writer) WriteAC3(
+	pcr time.Duration,
+	pts time.Duration,
+	frame []byte,
+) error {
+	return w.writeAudio(pcr, pts, frame, 189) // private stream 1
+}
+
+func (w *Writer) writeAudio(
+	pcr time.Duration,
+	pts time.Duration,
+	enc []byte,
+	streamID uint8,
+) error {
 	af := &astits.PacketAdaptationField{
 		RandomAccessIndicator: true,
 	}
@@ -181,7 +218,7 @@ func (w *Writer) WriteAAC(
 		w.pcrCounter--
 	}
 
-	_, err = w.inner.WriteData(&astits.MuxerData{
+	_, err := w.inner.WriteData(&astits.MuxerData{
 		PID:             257,
 		AdaptationField: af,
 		PES: &astits.PESData{
@@ -189,10 +226,10 @@ func (w *Writer) WriteAAC(
 				OptionalHeader: &astits.PESOptionalHeader{
 					MarkerBits:      2,
 					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
-					PTS:             &astits.ClockReference{Base: int64((pts + pcrOffset).Seconds() * 90000)},
+					PTS:             &astits.ClockReference{Base: int64((pts + PCROffset).Seconds() * 90000)},
 				},
 				PacketLength: uint16(len(enc) + 8),
-				StreamID:     192, // audio
+				StreamID:     streamID,
 			},
 			Data: enc,
 		},
@@ -2,36 +2,175 @@
 package hls
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
+
+	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 // MuxerFileResponse is a response of the Muxer's File() func.
+// Errors are reported with the following statuses:
+//   - 400 Bad Request, when _HLS_msn or _HLS_part are malformed or too far in the future;
+//   - 404 Not Found, when the file doesn't exist or has been deleted;
+//   - 503 Service Unavailable, when a blocking request times out before the requested
+//     playlist or part is available. The Retry-After header is set;
+//   - 500 Internal Server Error, when the muxer is closed.
+//
+// Error responses contain the "Cache-Control: no-store" header,
+// in order to prevent CDNs from caching them.
 type MuxerFileResponse struct {
 	Status int
 	Header map[string]string
 	Body   io.Reader
 }
 
+// delay after which clients can retry requests that failed with status 503, in seconds.
+const muxerRetryAfter = "1"
+
+// NewMuxerFileResponseError allocates an error response with the headers listed in MuxerFileResponse.
+// It allows servers that wrap the Muxer to answer with the same headers.
+func NewMuxerFileResponseError(status int) *MuxerFileResponse {
+	header := map[string]string{
+		"Cache-Control": "no-store",
+	}
+
+	if status == http.StatusServiceUnavailable {
+		header["Retry-After"] = muxerRetryAfter
+	}
+
+	return &MuxerFileResponse{
+		Status: status,
+		Header: header,
+	}
+}
+
+var errMuxerFinished = errors.New("muxer is finished")
+
+// MuxerLogger allows to receive log lines.
+type MuxerLogger interface {
+	Log(level logger.Level, format string, args ...interface{})
+}
+
 // Muxer is a HLS muxer.
 type Muxer struct {
+	storage         SegmentStorage
+	fileNameToken   string
+	segmentCount    int
 	primaryPlaylist *muxerPrimaryPlaylist
 	variant         muxerVariant
+	subtitles       *muxerSubtitles
+	logger          MuxerLogger
+	videoTrack      format.Format
+	audioTrack      format.Format
+	finished        bool
+	lastWriteTime   *int64
+	g711Transcoder  *muxerG711Transcoder
+	avSync          *muxerAVSync
+	h264RTPDecoder  *rtph264.Decoder
+
+	// segments can start with a non-keyframe when their duration is capped
+	// or when they follow a stall
+	segmentMaxDeviation time.Duration
+	targetDuration      time.Duration
+	stallTimeout        time.Duration
 }
 
+// MuxerLowLatencyMinSegmentCount is the minimum number of segments of the Low-Latency variant.
+// The playlist must be longer than the skip boundary (six times the target duration)
+// in order to allow delta updates.
+const MuxerLowLatencyMinSegmentCount = 7
+
 // NewMuxer allocates a Muxer.
+// Segments are stored in RAM, unless a storage is set with SetSegmentStorage().
+// Segments that would exceed segmentMaxSize are finalized; if the next video frame
+// is not an IDR, frames are discarded until the next IDR.
+// videoTrack can be a H264 track or, with the fMP4 and Low-Latency variants, a M-JPEG track.
+// audioTrack can be a MPEG-4 Audio or AC-3 track or, with the fMP4 and Low-Latency variants,
+// a 16-bit or 24-bit LPCM track.
 func NewMuxer(
 	variant MuxerVariant,
 	segmentCount int,
 	segmentDuration time.Duration,
 	partDuration time.Duration,
 	segmentMaxSize uint64,
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	videoTrack format.Format,
+	audioTrack format.Format,
 ) (*Muxer, error) {
-	m := &Muxer{}
+	var h264Track *format.H264
+
+	switch tvideoTrack := videoTrack.(type) {
+	case *format.H264:
+		h264Track = tvideoTrack
+
+	case *format.MJPEG:
+		if variant == MuxerVariantMPEGTS {
+			return nil, fmt.Errorf("M-JPEG requires the fMP4 or Low-Latency variant")
+		}
+
+	case nil: // audio-only stream
+
+	default:
+		return nil, fmt.Errorf("unsupported video track: %s", videoTrack)
+	}
+
+	if lpcmTrack, ok := audioTrack.(*format.LPCM); ok {
+		if variant == MuxerVariantMPEGTS {
+			return nil, fmt.Errorf("LPCM requires the fMP4 or Low-Latency variant")
+		}
+
+		if lpcmTrack.BitDepth != 16 && lpcmTrack.BitDepth != 24 {
+			return nil, fmt.Errorf("unsupported LPCM bit depth: %d", lpcmTrack.BitDepth)
+		}
+
+		if lpcmTrack.ChannelCount <= 0 {
+			return nil, fmt.Errorf("invalid LPCM channel count: %d", lpcmTrack.ChannelCount)
+		}
+	}
+
+	if variant == MuxerVariantLowLatency {
+		if segmentCount < MuxerLowLatencyMinSegmentCount {
+			return nil, fmt.Errorf("the Low-Latency variant requires at least %d segments", MuxerLowLatencyMinSegmentCount)
+		}
+	}
+
+	err := checkDurations(variant == MuxerVariantLowLatency, segmentDuration, 0, partDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newMuxerFileNameToken()
+	if err != nil {
+		return nil, err
+	}
+
+	segmentNames, partNames, err := newMuxerFileNameTemplates(
+		MuxerDefaultSegmentNameTemplate, MuxerDefaultPartNameTemplate, token)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := NewSegmentStorageMemory()
+
+	m := &Muxer{
+		storage:       storage,
+		fileNameToken: token,
+		segmentCount:  segmentCount,
+		videoTrack:    videoTrack,
+		audioTrack:    audioTrack,
+		lastWriteTime: new(int64),
+	}
 
 	switch variant {
 	case MuxerVariantMPEGTS:
@@ -39,8 +178,12 @@ func NewMuxer(
 			segmentCount,
 			segmentDuration,
 			segmentMaxSize,
-			videoTrack,
+			0,
+			segmentNames,
+			storage,
+			h264Track,
 			audioTrack,
+			m.onSegmentFinalized,
 		)
 
 	case MuxerVariantFMP4:
@@ -50,8 +193,16 @@ func NewMuxer(
 			segmentDuration,
 			partDuration,
 			segmentMaxSize,
+			0,
+			segmentNames,
+			partNames,
+			storage,
+			false,
+			false,
 			videoTrack,
 			audioTrack,
+			m.onSegmentFinalized,
+			m.log,
 		)
 
 	default: // MuxerVariantLowLatency
@@ -61,36 +212,732 @@ func NewMuxer(
 			segmentDuration,
 			partDuration,
 			segmentMaxSize,
+			0,
+			segmentNames,
+			partNames,
+			storage,
+			false,
+			false,
 			videoTrack,
 			audioTrack,
+			m.onSegmentFinalized,
+			m.log,
 		)
 	}
 
-	m.primaryPlaylist = newMuxerPrimaryPlaylist(variant != MuxerVariantMPEGTS, videoTrack, audioTrack)
+	m.primaryPlaylist = newMuxerPrimaryPlaylist(
+		variant != MuxerVariantMPEGTS,
+		true,
+		videoTrack,
+		audioTrack,
+		m.variant.bandwidth,
+	)
 
 	return m, nil
 }
 
+// checkDurations checks that segment and part durations are compatible with each other
+// and with the target duration.
+func checkDurations(
+	lowLatency bool,
+	segmentDuration time.Duration,
+	targetDuration time.Duration,
+	partDuration time.Duration,
+) error {
+	// the last two segments must contain enough parts to fill the part hold back,
+	// that is 2.5 times the part target duration.
+	if lowLatency && (partDuration <= 0 || (partDuration*5/4) > segmentDuration) {
+		return fmt.Errorf("part duration must be at most 4/5 of segment duration")
+	}
+
+	if targetDuration != 0 && targetDuration < segmentDuration {
+		return fmt.Errorf("target duration can't be less than segment duration")
+	}
+
+	return nil
+}
+
+// SetLogger sets a MuxerLogger that receives anomalies that don't cause errors,
+// like skipped NALUs or segments cut at a non-IDR frame.
+// If it is not set, they are discarded. It must be called before writing data.
+func (m *Muxer) SetLogger(l MuxerLogger) {
+	m.logger = l
+}
+
+func (m *Muxer) log(level logger.Level, format string, args ...interface{}) {
+	if m.logger != nil {
+		m.logger.Log(level, format, args...)
+	}
+}
+
+// EnableSubtitles adds a WebVTT subtitle rendition to the stream, whose cues are provided with WriteSubtitle().
+// WebVTT segments are aligned with the media segments and their X-TIMESTAMP-MAP header maps them
+// to the timeline of the media segments.
+// name is the name of the rendition, while language is its RFC 5646 language tag and can be empty.
+// It must be called before writing data.
+func (m *Muxer) EnableSubtitles(name string, language string) {
+	m.subtitles = newMuxerSubtitles(name, language, m.segmentCount)
+	m.primaryPlaylist.subtitles = m.subtitles
+}
+
+// EnableSegmentValidation enables a check of the integrity of segments and parts
+// before they are served by File(). Segments whose size doesn't match the written one,
+// or that contain truncated MPEG-TS packets or fMP4 boxes, are answered with 404 instead
+// of a truncated body. The check reads only packet and box headers.
+// It is useful with storages that can be corrupted, like SegmentStorageDisk.
+func (m *Muxer) EnableSegmentValidation() {
+	m.variant.enableSegmentValidation()
+}
+
+// EnableSegmentBitrate adds a EXT-X-BITRATE tag before each segment of the media playlist,
+// containing the bitrate of the segment in kbit/s.
+func (m *Muxer) EnableSegmentBitrate() {
+	m.variant.enableSegmentBitrate()
+}
+
+// checkNonIDRCuts checks whether segments can be cut at a non-IDR frame.
+// CMAF requires each fragment to start with a stream access point.
+func (m *Muxer) checkNonIDRCuts(feature string) error {
+	if v, ok := m.variant.(*muxerVariantFMP4); ok && v.cmaf {
+		return fmt.Errorf("%s is not compatible with CMAF, that requires segments to start with a keyframe",
+			feature)
+	}
+	return nil
+}
+
+// SetSegmentRetention keeps segments and parts that are removed from the playlist
+// available for segmentRetention, in order to allow clients with a high latency
+// to fetch them instead of receiving a 404 error. It must be called before writing data.
+func (m *Muxer) SetSegmentRetention(segmentRetention time.Duration) error {
+	if segmentRetention < 0 {
+		return fmt.Errorf("segment retention can't be negative")
+	}
+
+	m.variant.setSegmentRetention(segmentRetention)
+	return nil
+}
+
+// SetFileNameTemplates sets the templates of the file names of segments and parts,
+// in place of MuxerDefaultSegmentNameTemplate and MuxerDefaultPartNameTemplate.
+// $Number$ is replaced with the sequence number of the file and is mandatory,
+// while $Token$ is replaced with a random token that is unique for every muxer.
+// Templates can be validated in advance with ValidateFileNameTemplates().
+// It must be called before writing data.
+func (m *Muxer) SetFileNameTemplates(segmentNameTemplate string, partNameTemplate string) error {
+	segmentNames, partNames, err := newMuxerFileNameTemplates(segmentNameTemplate, partNameTemplate, m.fileNameToken)
+	if err != nil {
+		return err
+	}
+
+	m.variant.setFileNames(segmentNames, partNames)
+	return nil
+}
+
+// SetSegmentStorage sets the storage of segments and parts, in place of RAM.
+// The storage is closed by Close(). It must be called before writing data.
+func (m *Muxer) SetSegmentStorage(storage SegmentStorage) {
+	m.storage.Close()
+	m.storage = storage
+	m.variant.setStorage(storage)
+}
+
+// EnableProducerReferenceTime writes a prft box before every fMP4 part, mapping media time
+// to the wall clock at which the first sample was received, in order to allow players
+// to compute the end-to-end latency. It must be called before writing data.
+func (m *Muxer) EnableProducerReferenceTime() error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("producer reference time requires the fMP4 or Low-Latency variant")
+	}
+
+	v.segmenter.producerReferenceTime = true
+	return nil
+}
+
+// EnableCMAF makes fMP4 segments and parts compliant with CMAF: each segment starts with
+// a styp box, parts are CMAF chunks and no sidx box is written.
+// Streams with both video and audio are not supported, since a CMAF track file
+// can contain a single track. Since every segment must start with a keyframe,
+// it can't be used with SetSegmentMaxDeviation(), SetTargetDuration() and SetStallTimeout().
+// It must be called before writing data.
+func (m *Muxer) EnableCMAF() error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("CMAF requires the fMP4 or Low-Latency variant")
+	}
+
+	// a CMAF track file can't contain more than one track.
+	if m.videoTrack != nil && m.audioTrack != nil {
+		return fmt.Errorf("CMAF doesn't support streams with both video and audio")
+	}
+
+	if m.segmentMaxDeviation > 0 || m.targetDuration > 0 || m.stallTimeout > 0 {
+		return fmt.Errorf("CMAF requires segments to start with a keyframe, therefore it can't be used " +
+			"with a segment max deviation, a target duration or a stall timeout")
+	}
+
+	return v.enableCMAF()
+}
+
+// SetSegmentMaxDeviation sets the maximum deviation of the duration of fMP4 segments:
+// segments that would last more than the segment duration plus segmentMaxDeviation
+// are cut at a non-IDR frame. It can't be used with CMAF. It must be called before writing data.
+func (m *Muxer) SetSegmentMaxDeviation(segmentMaxDeviation time.Duration) error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("segment max deviation requires the fMP4 or Low-Latency variant")
+	}
+
+	if segmentMaxDeviation < 0 {
+		return fmt.Errorf("segment max deviation can't be negative")
+	}
+
+	if segmentMaxDeviation > 0 {
+		err := m.checkNonIDRCuts("segment max deviation")
+		if err != nil {
+			return err
+		}
+	}
+
+	v.segmenter.segmentMaxDeviation = segmentMaxDeviation
+
+	m.segmentMaxDeviation = segmentMaxDeviation
+	m.updateIndependentSegments()
+	return nil
+}
+
+// SetTargetDuration sets EXT-X-TARGETDURATION to targetDuration, instead of computing it
+// from segment durations, and cuts segments, at a non-IDR frame if necessary, before they exceed it.
+// It can't be used with CMAF. It must be called before writing data.
+func (m *Muxer) SetTargetDuration(targetDuration time.Duration) error {
+	// EXT-X-TARGETDURATION is an integer number of seconds.
+	if targetDuration%time.Second != 0 {
+		return fmt.Errorf("target duration must be an integer number of seconds")
+	}
+
+	if targetDuration > 0 {
+		err := m.checkNonIDRCuts("target duration")
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.variant.setTargetDuration(targetDuration)
+	if err != nil {
+		return err
+	}
+
+	m.targetDuration = targetDuration
+	m.updateIndependentSegments()
+	return nil
+}
+
+// SetFragmentDuration writes the samples of fMP4 segments and parts into fragments
+// (moof and mdat boxes) that last at least fragmentDuration.
+// In the Low-Latency variant each part contains one or more fragments, therefore
+// a fragmentDuration greater than or equal to the part duration has no effect.
+// It must be called before writing data.
+func (m *Muxer) SetFragmentDuration(fragmentDuration time.Duration) error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("fragments require the fMP4 or Low-Latency variant")
+	}
+
+	if fragmentDuration < 0 {
+		return fmt.Errorf("fragment duration can't be negative")
+	}
+
+	v.segmenter.fragmentDuration = fragmentDuration
+	return nil
+}
+
+// SetStallTimeout finalizes the current segment of the Low-Latency variant when no data is written
+// for stallTimeout, in order to keep the playlist advancing and allow blocking requests to be resolved.
+// It can't be used with CMAF. It must be called before writing data.
+func (m *Muxer) SetStallTimeout(stallTimeout time.Duration) error {
+	// stalls are detected in the Low-Latency variant only,
+	// where players wait for parts with blocking requests.
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok || !v.segmenter.lowLatency {
+		return fmt.Errorf("stall detection requires the Low-Latency variant")
+	}
+
+	if stallTimeout < 0 {
+		return fmt.Errorf("stall timeout can't be negative")
+	}
+
+	if stallTimeout > 0 {
+		err := m.checkNonIDRCuts("stall timeout")
+		if err != nil {
+			return err
+		}
+	}
+
+	v.setStallTimeout(stallTimeout)
+
+	m.stallTimeout = stallTimeout
+	m.updateIndependentSegments()
+	return nil
+}
+
+// updateIndependentSegments checks whether all segments start with a keyframe.
+func (m *Muxer) updateIndependentSegments() {
+	m.primaryPlaylist.independentSegments = m.segmentMaxDeviation <= 0 &&
+		m.targetDuration <= 0 &&
+		m.stallTimeout <= 0
+}
+
+// EnableFragmentInterleaving writes the video and audio samples of fMP4 segments and parts into
+// separate fragments, that are sorted by decode time, instead of into fragments that contain both tracks.
+// Combined with a fragment duration, this allows players with small buffers to receive both tracks
+// at regular intervals. It has effect only on streams with both a video and an audio track.
+// It must be called before writing data.
+func (m *Muxer) EnableFragmentInterleaving() error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("fragment interleaving requires the fMP4 or Low-Latency variant")
+	}
+
+	v.segmenter.interleaveFragments = true
+	return nil
+}
+
+// EnableInitPerDiscontinuity generates a new initialization segment every time the
+// parameters of the video track change, instead of regenerating the only one (init.mp4).
+// Segments that follow the change are preceded by EXT-X-DISCONTINUITY and by a EXT-X-MAP
+// tag that points to the new initialization segment, in order to allow players to decode
+// segments on both sides of a change of resolution.
+// It must be called before writing data.
+func (m *Muxer) EnableInitPerDiscontinuity() error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("an initialization segment per discontinuity requires the fMP4 or Low-Latency variant")
+	}
+
+	v.segmenter.genInit = v.genInit
+	return nil
+}
+
+// EnableAVSync enables the detection of drifts between the audio and the video timeline,
+// that happen when the source uses independent clocks for the two tracks.
+// The offset between the PTS of each track and the reception time is monitored and,
+// when the drift exceeds threshold, a warning is logged. If correct is true,
+// the audio timeline is brought back into sync by dropping or duplicating an audio frame
+// after each segment boundary, until the drift falls below threshold.
+// It requires a video and an audio track. It must be called before writing data.
+func (m *Muxer) EnableAVSync(threshold time.Duration, correct bool) error {
+	if m.videoTrack == nil || m.audioTrack == nil {
+		return fmt.Errorf("audio/video sync requires a video and an audio track")
+	}
+
+	if threshold <= 0 {
+		return fmt.Errorf("audio/video sync threshold must be greater than zero")
+	}
+
+	m.avSync = newMuxerAVSync(threshold, correct, m.audioTrack, m.log)
+	return nil
+}
+
+// EnableEncryption encrypts the samples of fMP4 segments and parts with Common Encryption,
+// in order to allow the delivery of protected content (FairPlay, Widevine, PlayReady).
+// The initialization segment signals the protection scheme and contains the pssh boxes of enc,
+// while playlists contain a EXT-X-KEY tag for each key, that tells players how to obtain it.
+// The video track must be H264, since NALU and slice headers are left in clear,
+// while the audio track must be MPEG-4 Audio or AC-3. Tracks and scheme are checked in advance.
+// It must be called before writing data.
+func (m *Muxer) EnableEncryption(enc *fmp4.Encryption, keys []MuxerEncryptionKey) error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("encryption requires the fMP4 or Low-Latency variant")
+	}
+
+	var formats []format.Format
+	if m.videoTrack != nil {
+		formats = append(formats, m.videoTrack)
+	}
+	if m.audioTrack != nil {
+		formats = append(formats, m.audioTrack)
+	}
+
+	err := enc.Validate(formats...)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one key is required")
+	}
+
+	for _, k := range keys {
+		err := k.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return v.enableEncryption(enc, marshalKeyTags(enc, keys))
+}
+
+// Reconfigure changes the part duration and the segment duration of the fMP4 and Low-Latency variants,
+// in order to allow tuning the latency without restarting the stream.
+// New durations are applied starting from the next segment, therefore the current segment
+// and the parts that are already referenced by the playlist are left untouched.
+// Durations must satisfy the same constraints of NewMuxer().
+// Since EXT-X-TARGETDURATION can't change during a session, a target duration must be set
+// with SetTargetDuration() and the segment duration can't exceed it.
+// The part duration of the Low-Latency variant can't be changed, since it is advertised
+// by PART-TARGET and PART-HOLD-BACK: changing it requires a new muxer, i.e. a new session.
+// It can be called from any routine.
+func (m *Muxer) Reconfigure(partDuration time.Duration, segmentDuration time.Duration) error {
+	v, ok := m.variant.(*muxerVariantFMP4)
+	if !ok {
+		return fmt.Errorf("reconfiguration requires the fMP4 or Low-Latency variant")
+	}
+
+	if segmentDuration <= 0 {
+		return fmt.Errorf("segment duration must be greater than zero")
+	}
+
+	return v.reconfigure(partDuration, segmentDuration)
+}
+
+func (m *Muxer) onSegmentFinalized(
+	name string,
+	startTime time.Time,
+	start time.Duration,
+	mediaTimestamp time.Duration,
+	duration time.Duration,
+) {
+	if m.subtitles != nil {
+		m.subtitles.onSegmentFinalized(name, startTime, start, mediaTimestamp, duration)
+	}
+
+	if m.avSync != nil {
+		m.avSync.onSegmentFinalized()
+	}
+}
+
 // Close closes a Muxer.
 func (m *Muxer) Close() {
 	m.variant.close()
+	m.storage.Close()
+
+	if m.g711Transcoder != nil {
+		m.g711Transcoder.encoder.Close()
+	}
+}
+
+// Finish finalizes the current segment and marks the playlist as complete,
+// by adding the EXT-X-ENDLIST tag. Players stop reloading the playlist and
+// can seek across the segments that are still available.
+// File() keeps serving the playlist and segments until Close() is called.
+// It must be called from the same routine that writes data.
+// After Finish(), writing data returns an error.
+func (m *Muxer) Finish() error {
+	if m.finished {
+		return nil
+	}
+	m.finished = true
+
+	err := m.variant.finish()
+	if err != nil {
+		return err
+	}
+
+	if m.subtitles != nil {
+		m.subtitles.end()
+	}
+
+	return nil
 }
 
 // WriteH264 writes H264 NALUs, grouped by timestamp.
+// NALUs are scanned in order to find out whether they contain an IDR.
 func (m *Muxer) WriteH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
-	return m.variant.writeH264(ntp, pts, nalus)
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	idrPresent := false
+	nonIDRPresent := false
+
+	for _, nalu := range nalus {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		switch typ {
+		case h264.NALUTypeIDR:
+			idrPresent = true
+
+		case h264.NALUTypeNonIDR:
+			nonIDRPresent = true
+		}
+	}
+
+	// skip groups without slices
+	if !idrPresent && !nonIDRPresent {
+		m.log(logger.Debug, "skipping group of NALUs without slices")
+		return nil
+	}
+
+	return m.writeH264(ntp, nil, pts, nalus, idrPresent)
+}
+
+// h264SlicesPresent checks whether H264 NALUs contain at least one slice.
+func h264SlicesPresent(nalus [][]byte) bool {
+	for _, nalu := range nalus {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+		if typ == h264.NALUTypeIDR || typ == h264.NALUTypeNonIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteH264WithIDRPresent writes H264 NALUs, grouped by timestamp.
+// It can be used by callers that already know whether NALUs contain an IDR,
+// like RTMP sources, in order to avoid scanning them.
+// The flag is used to decide where segments are cut: if it is set on NALUs
+// that don't contain an IDR, segments can't be decoded on their own.
+func (m *Muxer) WriteH264WithIDRPresent(ntp time.Time, pts time.Duration, nalus [][]byte, idrPresent bool) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	// skip groups without slices
+	if !h264SlicesPresent(nalus) {
+		m.log(logger.Debug, "skipping group of NALUs without slices")
+		return nil
+	}
+
+	return m.writeH264(ntp, nil, pts, nalus, idrPresent)
+}
+
+// WriteH264WithDTS writes H264 NALUs, grouped by timestamp.
+// It can be used by callers that already know the DTS of NALUs, like RTMP sources,
+// in order to preserve the decoding order of streams with B-frames,
+// instead of computing the DTS from NALUs.
+// As in WriteH264WithIDRPresent, the flag is used to decide where segments are cut
+// and it must be set only on NALUs that contain an IDR.
+func (m *Muxer) WriteH264WithDTS(
+	ntp time.Time,
+	dts time.Duration,
+	pts time.Duration,
+	nalus [][]byte,
+	idrPresent bool,
+) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	if pts < dts {
+		return fmt.Errorf("PTS (%v) is lower than DTS (%v)", pts, dts)
+	}
+
+	// skip groups without slices
+	if !h264SlicesPresent(nalus) {
+		m.log(logger.Debug, "skipping group of NALUs without slices")
+		return nil
+	}
+
+	return m.writeH264(ntp, &dts, pts, nalus, idrPresent)
 }
 
 // WriteAAC writes AAC AUs, grouped by timestamp.
 func (m *Muxer) WriteAAC(ntp time.Time, pts time.Duration, au []byte) error {
-	return m.variant.writeAAC(ntp, pts, au)
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	return m.writeAudio(ntp, pts, au)
+}
+
+// WriteAC3 writes an AC-3 or E-AC-3 frame.
+func (m *Muxer) WriteAC3(ntp time.Time, pts time.Duration, frame []byte) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	return m.writeAudio(ntp, pts, frame)
+}
+
+// WriteLPCM writes a LPCM frame, that contains big endian, interleaved samples.
+func (m *Muxer) WriteLPCM(ntp time.Time, pts time.Duration, samples []byte) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	return m.writeAudio(ntp, pts, samples)
+}
+
+func (m *Muxer) writeH264(
+	ntp time.Time,
+	dts *time.Duration,
+	pts time.Duration,
+	nalus [][]byte,
+	idrPresent bool,
+) error {
+	err := m.variant.writeH264(ntp, dts, pts, nalus, idrPresent)
+	if err != nil {
+		return err
+	}
+
+	if m.avSync != nil {
+		m.avSync.processVideo(ntp, pts)
+	}
+
+	atomic.StoreInt64(m.lastWriteTime, time.Now().UnixNano())
+	return nil
+}
+
+func (m *Muxer) writeAudio(ntp time.Time, pts time.Duration, au []byte) error {
+	ptss := []time.Duration{pts}
+	if m.avSync != nil {
+		ptss = m.avSync.processAudio(ntp, pts)
+	}
+
+	for _, cpts := range ptss {
+		err := m.variant.writeAudio(ntp.Add(cpts-ptss[0]), cpts, au)
+		if err != nil {
+			return err
+		}
+	}
+
+	atomic.StoreInt64(m.lastWriteTime, time.Now().UnixNano())
+	return nil
+}
+
+// LastWrite returns the time at which video or audio data was last written
+// successfully, or the zero time if no data has been written yet.
+// It can be called from any routine, in order to detect a muxer
+// that stopped receiving data.
+func (m *Muxer) LastWrite() time.Time {
+	v := atomic.LoadInt64(m.lastWriteTime)
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+// IsLive checks whether video or audio data has been written within the given duration.
+func (m *Muxer) IsLive(within time.Duration) bool {
+	v := atomic.LoadInt64(m.lastWriteTime)
+	return v != 0 && time.Since(time.Unix(0, v)) <= within
+}
+
+// WriteSubtitle writes a subtitle cue, that is displayed from pts for duration.
+// pts must be expressed in the same timeline of the video and audio data,
+// while ntp is accepted for consistency with the other write functions.
+// Cues must be written before the media segments that contain them are finalized;
+// cues that span multiple segments are repeated in each of them.
+// EnableSubtitles() must be called before.
+func (m *Muxer) WriteSubtitle(ntp time.Time, pts time.Duration, duration time.Duration, text string) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	if m.subtitles == nil {
+		return fmt.Errorf("subtitles are not enabled")
+	}
+
+	return m.subtitles.writeCue(pts, duration, text)
+}
+
+// InsertDateRange inserts an EXT-X-DATERANGE tag into the media playlist,
+// that can be used to signal ad breaks.
+// The tag is placed before the segment that contains the start date,
+// that must be expressed in the same clock of the ntp timestamps.
+// attrs contains additional attributes, like CLASS, X-<client-attribute>,
+// SCTE35-OUT and SCTE35-IN. SCTE35 values must be hexadecimal sequences (0x...).
+func (m *Muxer) InsertDateRange(
+	id string,
+	start time.Time,
+	duration time.Duration,
+	attrs map[string]string,
+) error {
+	d, err := newMuxerDateRange(id, start, duration, attrs)
+	if err != nil {
+		return err
+	}
+
+	m.variant.insertDateRange(d)
+	return nil
 }
 
 // File returns a file reader.
-func (m *Muxer) File(name string, msn string, part string, skip string) *MuxerFileResponse {
-	if name == "index.m3u8" {
-		return m.primaryPlaylist.file()
+// If gzipAccepted is true, playlists are compressed with gzip.
+// Playlists always contain the "Vary: Accept-Encoding" header,
+// in order to prevent caches from serving compressed playlists to clients that don't accept them.
+func (m *Muxer) File(
+	name string,
+	msn string,
+	part string,
+	skip string,
+	gzipAccepted bool,
+) *MuxerFileResponse {
+	var res *MuxerFileResponse
+	switch {
+	case name == "index.m3u8":
+		res = m.primaryPlaylist.file()
+
+	case m.subtitles != nil && (name == "subtitles.m3u8" || strings.HasSuffix(name, ".vtt")):
+		res = m.subtitles.file(name)
+
+	default:
+		res = m.variant.file(name, msn, part, skip)
+	}
+
+	return gzipPlaylist(res, gzipAccepted)
+}
+
+// PreloadHints returns the file names of the parts that are going to be produced next,
+// that can be pushed to clients or advertised with "Link: <...>; rel=preload" headers
+// or 103 Early Hints in order to save round trips.
+// File names are relative to the playlist and can be passed to File(),
+// that blocks until they are available.
+// It returns nil when the variant is not Low-Latency or the stream is complete.
+func (m *Muxer) PreloadHints() []string {
+	return m.variant.preloadHints()
+}
+
+func gzipPlaylist(res *MuxerFileResponse, gzipAccepted bool) *MuxerFileResponse {
+	// media segments are not compressible, compress playlists only
+	if res.Status != http.StatusOK ||
+		res.Body == nil ||
+		res.Header["Content-Type"] != `application/x-mpegURL` {
+		return res
+	}
+
+	header := make(map[string]string, len(res.Header)+2)
+	for k, v := range res.Header {
+		header[k] = v
+	}
+	header["Vary"] = "Accept-Encoding"
+
+	if !gzipAccepted {
+		return &MuxerFileResponse{
+			Status: res.Status,
+			Header: header,
+			Body:   res.Body,
+		}
 	}
 
-	return m.variant.file(name, msn, part, skip)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	_, err := io.Copy(w, res.Body)
+	if err != nil {
+		return NewMuxerFileResponseError(http.StatusInternalServerError)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return NewMuxerFileResponseError(http.StatusInternalServerError)
+	}
+
+	header["Content-Encoding"] = "gzip"
+
+	return &MuxerFileResponse{
+		Status: res.Status,
+		Header: header,
+		Body:   &buf,
+	}
 }
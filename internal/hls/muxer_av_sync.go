@@ -0,0 +1,138 @@
+package hls
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+// weight of new samples in the moving average of the offsets between ntp and PTS,
+// that smooths the jitter of reception times.
+const muxerAVSyncSmoothing = 16
+
+// muxerAVSync detects the drift between the audio and the video timeline,
+// that happens when the clocks of the source are independent, by comparing
+// the PTS of each track with the reception time, and optionally corrects it
+// by dropping or duplicating audio frames after segment boundaries.
+type muxerAVSync struct {
+	threshold     time.Duration
+	correct       bool
+	frameDuration time.Duration
+	log           func(logger.Level, string, ...interface{})
+
+	// set by onSegmentFinalized(), that can be called by the stall timer.
+	segmentFinalized int32
+
+	ntpStart      *time.Time
+	videoOffset   *time.Duration
+	audioOffset   *time.Duration
+	initialDiff   *time.Duration
+	audioPTSShift time.Duration
+	outOfSync     bool
+}
+
+func newMuxerAVSync(
+	threshold time.Duration,
+	correct bool,
+	audioTrack format.Format,
+	log func(logger.Level, string, ...interface{}),
+) *muxerAVSync {
+	var frameDuration time.Duration
+
+	switch taudioTrack := audioTrack.(type) {
+	case *format.MPEG4Audio:
+		frameDuration = mpeg4audio.SamplesPerAccessUnit * time.Second /
+			time.Duration(taudioTrack.ClockRate())
+
+	case *ac3.Format:
+		frameDuration = time.Duration(taudioTrack.Config.SamplesPerFrame()) * time.Second /
+			time.Duration(taudioTrack.Config.SampleRate)
+	}
+
+	return &muxerAVSync{
+		threshold:     threshold,
+		correct:       correct,
+		frameDuration: frameDuration,
+		log:           log,
+	}
+}
+
+func (s *muxerAVSync) onSegmentFinalized() {
+	atomic.StoreInt32(&s.segmentFinalized, 1)
+}
+
+// offset computes the moving average of the offset between the reception time and the PTS.
+func (s *muxerAVSync) offset(cur *time.Duration, ntp time.Time, pts time.Duration) *time.Duration {
+	if s.ntpStart == nil {
+		s.ntpStart = &ntp
+	}
+
+	v := ntp.Sub(*s.ntpStart) - pts
+
+	if cur != nil {
+		v = *cur + (v-*cur)/muxerAVSyncSmoothing
+	}
+
+	return &v
+}
+
+func (s *muxerAVSync) processVideo(ntp time.Time, pts time.Duration) {
+	s.videoOffset = s.offset(s.videoOffset, ntp, pts)
+}
+
+// drift returns how much the audio timeline is ahead of the video timeline,
+// with respect to the offset measured at the end of the first segment.
+func (s *muxerAVSync) drift() time.Duration {
+	// when the audio clock is faster, the audio PTS grow faster and the offset decreases.
+	diff := *s.videoOffset - *s.audioOffset
+	if s.initialDiff == nil {
+		s.initialDiff = &diff
+	}
+
+	return diff - *s.initialDiff + s.audioPTSShift
+}
+
+// processAudio returns the PTS of the frames that must be written in place of an audio frame:
+// none if the frame is dropped, two if it is duplicated.
+func (s *muxerAVSync) processAudio(ntp time.Time, pts time.Duration) []time.Duration {
+	s.audioOffset = s.offset(s.audioOffset, ntp, pts)
+
+	if s.videoOffset == nil || atomic.SwapInt32(&s.segmentFinalized, 0) == 0 {
+		return []time.Duration{pts + s.audioPTSShift}
+	}
+
+	drift := s.drift()
+
+	outOfSync := drift > s.threshold || drift < -s.threshold
+	if outOfSync != s.outOfSync {
+		s.outOfSync = outOfSync
+
+		if outOfSync {
+			s.log(logger.Warn, "audio and video are out of sync by %v", drift)
+		} else {
+			s.log(logger.Info, "audio and video are in sync again")
+		}
+	}
+
+	if !outOfSync || !s.correct || s.frameDuration == 0 {
+		return []time.Duration{pts + s.audioPTSShift}
+	}
+
+	// the frame is dropped and following frames take its place
+	if drift > 0 {
+		s.log(logger.Debug, "dropping an audio frame in order to correct a drift of %v", drift)
+		s.audioPTSShift -= s.frameDuration
+		return nil
+	}
+
+	// the frame is written twice and following frames are delayed
+	s.log(logger.Debug, "duplicating an audio frame in order to correct a drift of %v", drift)
+	ret := []time.Duration{pts + s.audioPTSShift, pts + s.audioPTSShift + s.frameDuration}
+	s.audioPTSShift += s.frameDuration
+	return ret
+}
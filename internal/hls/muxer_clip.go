@@ -0,0 +1,144 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MuxerClip is a VOD playlist that covers a wall-clock time range of the stream,
+// generated from the segments that are currently available.
+// Segments referenced by the playlist are not deleted until Release() is called,
+// therefore they can be fetched with File() without racing against their removal.
+type MuxerClip struct {
+	// content of the VOD playlist.
+	Playlist []byte
+
+	// file names of the segments referenced by the playlist, in order.
+	// In case of fMP4 variants, initialization segments are not included
+	// since they are available as long as the segments.
+	Segments []string
+
+	// segments at the boundaries of the range are included whole.
+	// In and Out are the positions of the requested start and end with respect
+	// to the beginning of the first segment, and can be used to trim the clip.
+	// The playlist contains a EXT-X-START tag that points to In.
+	In  time.Duration
+	Out time.Duration
+
+	releaseOnce sync.Once
+	release     func()
+}
+
+// Release allows the segments referenced by the clip to be deleted.
+// It can be called multiple times.
+func (c *MuxerClip) Release() {
+	c.releaseOnce.Do(c.release)
+}
+
+type muxerClipSegment struct {
+	name      string
+	startTime time.Time
+	duration  time.Duration
+
+	// name of the init segment, in case of fMP4 variants.
+	init string
+}
+
+func newMuxerClip(
+	segments []muxerClipSegment,
+	start time.Time,
+	end time.Time,
+	fmp4 bool,
+	keyTags string,
+) (*MuxerClip, error) {
+	if !end.After(start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no segments are available")
+	}
+
+	first := segments[0]
+	last := segments[len(segments)-1]
+
+	if start.Before(first.startTime) || end.After(last.startTime.Add(last.duration)) {
+		return nil, fmt.Errorf("requested range is outside the available window (%s - %s)",
+			first.startTime.Format(time.RFC3339Nano),
+			last.startTime.Add(last.duration).Format(time.RFC3339Nano))
+	}
+
+	var clipped []muxerClipSegment
+	for _, seg := range segments {
+		if seg.startTime.Before(end) && seg.startTime.Add(seg.duration).After(start) {
+			clipped = append(clipped, seg)
+		}
+	}
+
+	var version int
+	if !fmp4 {
+		version = 3
+	} else {
+		version = 9
+	}
+
+	targetDuration := uint(0)
+	for _, seg := range clipped {
+		v := uint(math.Round(seg.duration.Seconds()))
+		if v > targetDuration {
+			targetDuration = v
+		}
+	}
+
+	in := start.Sub(clipped[0].startTime)
+	out := end.Sub(clipped[0].startTime)
+
+	cnt := "#EXTM3U\n" +
+		"#EXT-X-VERSION:" + strconv.FormatInt(int64(version), 10) + "\n" +
+		"#EXT-X-TARGETDURATION:" + strconv.FormatUint(uint64(targetDuration), 10) + "\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXT-X-START:TIME-OFFSET=" + strconv.FormatFloat(in.Seconds(), 'f', 5, 64) + ",PRECISE=YES\n"
+
+	if fmp4 {
+		cnt += keyTags +
+			"#EXT-X-MAP:URI=\"" + clipped[0].init + "\"\n"
+	}
+
+	names := make([]string, len(clipped))
+
+	for i, seg := range clipped {
+		names[i] = seg.name
+
+		if i != 0 && seg.init != clipped[i-1].init {
+			cnt += "#EXT-X-DISCONTINUITY\n" +
+				"#EXT-X-MAP:URI=\"" + seg.init + "\"\n"
+		}
+
+		cnt += "#EXT-X-PROGRAM-DATE-TIME:" + seg.startTime.Format("2006-01-02T15:04:05.999Z07:00") + "\n" +
+			"#EXTINF:" + strconv.FormatFloat(seg.duration.Seconds(), 'f', 5, 64) + ",\n" +
+			seg.name + "\n"
+	}
+
+	cnt += "#EXT-X-ENDLIST\n"
+
+	return &MuxerClip{
+		Playlist: []byte(cnt),
+		Segments: names,
+		In:       in,
+		Out:      out,
+	}, nil
+}
+
+// Clip returns a VOD playlist that covers the given wall-clock range,
+// that must be expressed in the same clock of the ntp timestamps and must be
+// contained in the segments that are currently available.
+// Segments are located through their EXT-X-PROGRAM-DATE-TIME.
+// Release() must be called once the segments are not needed anymore,
+// otherwise they are never deleted.
+func (m *Muxer) Clip(start time.Time, end time.Time) (*MuxerClip, error) {
+	return m.variant.clip(start, end)
+}
@@ -0,0 +1,142 @@
+package hls
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dateRangeAttributeName = regexp.MustCompile("^[A-Z0-9-]+$")
+
+// attributes whose value is not a quoted string.
+var dateRangeUnquotedAttributes = map[string]struct{}{
+	"PLANNED-DURATION": {},
+	"END-ON-NEXT":      {},
+	"SCTE35-CMD":       {},
+	"SCTE35-OUT":       {},
+	"SCTE35-IN":        {},
+}
+
+// attributes that are filled by the muxer.
+var dateRangeReservedAttributes = map[string]struct{}{
+	"ID":         {},
+	"START-DATE": {},
+	"END-DATE":   {},
+	"DURATION":   {},
+}
+
+type muxerDateRange struct {
+	id       string
+	start    time.Time
+	duration time.Duration
+	attrs    map[string]string
+}
+
+func newMuxerDateRange(
+	id string,
+	start time.Time,
+	duration time.Duration,
+	attrs map[string]string,
+) (*muxerDateRange, error) {
+	if id == "" || strings.ContainsAny(id, "\"\r\n") {
+		return nil, fmt.Errorf("invalid date range ID '%s'", id)
+	}
+
+	if duration < 0 {
+		return nil, fmt.Errorf("invalid date range duration")
+	}
+
+	for k, v := range attrs {
+		if !dateRangeAttributeName.MatchString(k) {
+			return nil, fmt.Errorf("invalid date range attribute name '%s'", k)
+		}
+
+		if _, ok := dateRangeReservedAttributes[k]; ok {
+			return nil, fmt.Errorf("date range attribute '%s' is reserved", k)
+		}
+
+		if strings.HasPrefix(k, "SCTE35-") {
+			if !strings.HasPrefix(v, "0x") && !strings.HasPrefix(v, "0X") {
+				return nil, fmt.Errorf("date range attribute '%s' must be a hexadecimal sequence", k)
+			}
+		}
+
+		if strings.ContainsAny(v, "\"\r\n") {
+			return nil, fmt.Errorf("invalid value of date range attribute '%s'", k)
+		}
+	}
+
+	return &muxerDateRange{
+		id:       id,
+		start:    start,
+		duration: duration,
+		attrs:    attrs,
+	}, nil
+}
+
+func (d *muxerDateRange) end() time.Time {
+	return d.start.Add(d.duration)
+}
+
+func (d *muxerDateRange) marshal() string {
+	ret := "#EXT-X-DATERANGE:ID=\"" + d.id + "\"" +
+		",START-DATE=\"" + d.start.Format("2006-01-02T15:04:05.999Z07:00") + "\""
+
+	if d.duration != 0 {
+		ret += ",DURATION=" + strconv.FormatFloat(d.duration.Seconds(), 'f', -1, 64)
+	}
+
+	keys := make([]string, 0, len(d.attrs))
+	for k := range d.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if _, ok := dateRangeUnquotedAttributes[k]; ok {
+			ret += "," + k + "=" + d.attrs[k]
+		} else {
+			ret += "," + k + "=\"" + d.attrs[k] + "\""
+		}
+	}
+
+	return ret + "\n"
+}
+
+// muxerDateRanges is a list of date ranges, sorted by start date.
+type muxerDateRanges []*muxerDateRange
+
+// insert adds a date range, replacing the one with the same ID.
+func (rs muxerDateRanges) insert(d *muxerDateRange) muxerDateRanges {
+	for i, r := range rs {
+		if r.id == d.id {
+			rs = append(rs[:i], rs[i+1:]...)
+			break
+		}
+	}
+
+	i := sort.Search(len(rs), func(i int) bool {
+		return rs[i].start.After(d.start)
+	})
+
+	rs = append(rs, nil)
+	copy(rs[i+1:], rs[i:])
+	rs[i] = d
+
+	return rs
+}
+
+// purge removes date ranges that end before the given time.
+func (rs muxerDateRanges) purge(t time.Time) muxerDateRanges {
+	n := 0
+	for _, r := range rs {
+		if !r.end().Before(t) {
+			rs[n] = r
+			n++
+		}
+	}
+	return rs[:n]
+}
@@ -0,0 +1,54 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
+)
+
+// MuxerEncryptionKey is a key that is advertised to players through a EXT-X-KEY tag.
+type MuxerEncryptionKey struct {
+	// URI from which players can obtain the key, or the license, in case of DRM systems.
+	URI string
+
+	// format of the key (KEYFORMAT). If empty, the key is a raw AES-128 key ("identity").
+	Format string
+}
+
+func (k MuxerEncryptionKey) validate() error {
+	if k.URI == "" || strings.ContainsAny(k.URI, "\"\r\n") {
+		return fmt.Errorf("invalid key URI '%s'", k.URI)
+	}
+
+	if strings.ContainsAny(k.Format, "\"\r\n") {
+		return fmt.Errorf("invalid key format '%s'", k.Format)
+	}
+
+	return nil
+}
+
+// marshalKeyTags encodes the EXT-X-KEY tags of an encrypted stream.
+// The method depends on the protection scheme, while IVs are contained in the segments.
+func marshalKeyTags(enc *fmp4.Encryption, keys []MuxerEncryptionKey) string {
+	var method string
+	if enc.Scheme == fmp4.EncryptionSchemeCBCS {
+		method = "SAMPLE-AES"
+	} else {
+		method = "SAMPLE-AES-CTR"
+	}
+
+	cnt := ""
+
+	for _, k := range keys {
+		cnt += "#EXT-X-KEY:METHOD=" + method + ",URI=\"" + k.URI + "\""
+
+		if k.Format != "" {
+			cnt += ",KEYFORMAT=\"" + k.Format + "\",KEYFORMATVERSIONS=\"1\""
+		}
+
+		cnt += "\n"
+	}
+
+	return cnt
+}
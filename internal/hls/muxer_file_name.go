@@ -0,0 +1,134 @@
+package hls
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// default templates of segment and part file names.
+const (
+	MuxerDefaultSegmentNameTemplate = "seg$Number$"
+	MuxerDefaultPartNameTemplate    = "part$Number$"
+)
+
+// placeholders that can be used in file name templates.
+const (
+	fileNameTemplateNumber = "$Number$"
+	fileNameTemplateToken  = "$Token$"
+)
+
+// muxerFileNameTemplate generates file names from a template.
+// The template can contain:
+// - $Number$, replaced with the sequence number of the file
+// - $Token$, replaced with a random token that is unique for every Muxer
+type muxerFileNameTemplate struct {
+	template string
+	token    string
+}
+
+func newMuxerFileNameTemplate(template string, token string) (*muxerFileNameTemplate, error) {
+	if !strings.Contains(template, fileNameTemplateNumber) {
+		return nil, fmt.Errorf("file name template '%s' does not contain %s", template, fileNameTemplateNumber)
+	}
+
+	// file names are inserted into URLs and into quoted attributes of playlists
+	for _, c := range template {
+		if c == ' ' || unicode.IsControl(c) || strings.ContainsRune("/?#\"", c) {
+			return nil, fmt.Errorf("file name template '%s' contains invalid characters", template)
+		}
+	}
+
+	return &muxerFileNameTemplate{
+		template: template,
+		token:    token,
+	}, nil
+}
+
+// canCollide checks whether two templates can generate the same file name.
+// Numbers are made of digits and tokens are made of hexadecimal digits,
+// therefore names can be the same only when templates are the same
+// after removing placeholders and the characters they can be replaced with.
+func (t *muxerFileNameTemplate) canCollide(other *muxerFileNameTemplate) bool {
+	strip := func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return -1
+		}
+		return r
+	}
+
+	if strings.Contains(t.template, fileNameTemplateToken) ||
+		strings.Contains(other.template, fileNameTemplateToken) {
+		strip = func(r rune) rune {
+			if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') {
+				return -1
+			}
+			return r
+		}
+	}
+
+	removePlaceholders := strings.NewReplacer(
+		fileNameTemplateNumber, "",
+		fileNameTemplateToken, "",
+	)
+
+	return strings.Map(strip, removePlaceholders.Replace(t.template)) ==
+		strings.Map(strip, removePlaceholders.Replace(other.template))
+}
+
+func (t *muxerFileNameTemplate) name(id uint64) string {
+	return strings.NewReplacer(
+		fileNameTemplateNumber, strconv.FormatUint(id, 10),
+		fileNameTemplateToken, t.token,
+	).Replace(t.template)
+}
+
+// newMuxerFileNameTemplates allocates the templates of segment and part file names,
+// checking that they can't generate the same file name.
+func newMuxerFileNameTemplates(
+	segmentNameTemplate string,
+	partNameTemplate string,
+	token string,
+) (*muxerFileNameTemplate, *muxerFileNameTemplate, error) {
+	if segmentNameTemplate == partNameTemplate {
+		return nil, nil, fmt.Errorf("segment and part name templates must be different")
+	}
+
+	segmentNames, err := newMuxerFileNameTemplate(segmentNameTemplate, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	partNames, err := newMuxerFileNameTemplate(partNameTemplate, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if segmentNames.canCollide(partNames) {
+		return nil, nil, fmt.Errorf("file name templates '%s' and '%s' can generate the same file name",
+			segmentNameTemplate, partNameTemplate)
+	}
+
+	return segmentNames, partNames, nil
+}
+
+// ValidateFileNameTemplates checks whether templates of segment and part file names
+// can be used with SetFileNameTemplates().
+func ValidateFileNameTemplates(segmentNameTemplate string, partNameTemplate string) error {
+	// the token doesn't affect the validation
+	_, _, err := newMuxerFileNameTemplates(segmentNameTemplate, partNameTemplate, "")
+	return err
+}
+
+func newMuxerFileNameToken() (string, error) {
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
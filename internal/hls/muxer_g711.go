@@ -0,0 +1,160 @@
+package hls
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+)
+
+// G711SampleRate is the sample rate of G.711 audio.
+const G711SampleRate = 8000
+
+// AACEncoder is an AAC encoder, used to transcode audio that can't be stored in segments.
+type AACEncoder interface {
+	// Encode encodes mono, 16-bit signed PCM samples.
+	// It returns the access units that have been completed, if any.
+	// Each access unit contains mpeg4audio.SamplesPerAccessUnit samples.
+	Encode(samples []int16) ([][]byte, error)
+
+	// Close closes the encoder.
+	Close()
+}
+
+// G711AACTrack returns a MPEG-4 Audio track that can be used as audio track of a Muxer
+// in order to store G.711 audio transcoded into AAC.
+func G711AACTrack() *format.MPEG4Audio {
+	return &format.MPEG4Audio{
+		PayloadTyp: 96,
+		Config: &mpeg4audio.Config{
+			Type:         mpeg4audio.ObjectTypeAACLC,
+			SampleRate:   G711SampleRate,
+			ChannelCount: 1,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+}
+
+func g711MULawDecode(v byte) int16 {
+	v = ^v
+	t := (int32(v&0x0F) << 3) + 0x84
+	t <<= (v & 0x70) >> 4
+
+	if (v & 0x80) != 0 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
+
+func g711ALawDecode(v byte) int16 {
+	v ^= 0x55
+	t := int32(v&0x0F) << 4
+
+	switch seg := (v & 0x70) >> 4; seg {
+	case 0:
+		t += 8
+
+	case 1:
+		t += 0x108
+
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+
+	if (v & 0x80) != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+type muxerG711Transcoder struct {
+	mulaw   bool
+	encoder AACEncoder
+
+	startPTSFilled bool
+	startPTS       time.Duration
+	auCount        int
+}
+
+func (t *muxerG711Transcoder) transcode(pts time.Duration, samples []byte) ([][]byte, []time.Duration, error) {
+	if !t.startPTSFilled {
+		t.startPTSFilled = true
+		t.startPTS = pts
+	}
+
+	pcm := make([]int16, len(samples))
+	if t.mulaw {
+		for i, v := range samples {
+			pcm[i] = g711MULawDecode(v)
+		}
+	} else {
+		for i, v := range samples {
+			pcm[i] = g711ALawDecode(v)
+		}
+	}
+
+	aus, err := t.encoder.Encode(pcm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the encoder returns access units with a delay:
+	// timestamps are computed from the count of access units.
+	ptss := make([]time.Duration, len(aus))
+	for i := range aus {
+		ptss[i] = t.startPTS + time.Duration(t.auCount)*mpeg4audio.SamplesPerAccessUnit*
+			time.Second/G711SampleRate
+		t.auCount++
+	}
+
+	return aus, ptss, nil
+}
+
+// EnableG711Transcoding allows to write G.711 audio with WriteG711(), that is transcoded
+// into AAC by the given encoder. The audio track of the Muxer must be the one returned by G711AACTrack().
+// Encoding is expensive and AAC encoders can be subject to licensing, therefore the feature is opt-in.
+// The encoder is closed by Close().
+// It must be called before writing data.
+func (m *Muxer) EnableG711Transcoding(mulaw bool, encoder AACEncoder) error {
+	track, ok := m.audioTrack.(*format.MPEG4Audio)
+	if !ok || track.Config.SampleRate != G711SampleRate || track.Config.ChannelCount != 1 {
+		return fmt.Errorf("the audio track must be a mono MPEG-4 Audio track with a sample rate of %d",
+			G711SampleRate)
+	}
+
+	m.g711Transcoder = &muxerG711Transcoder{
+		mulaw:   mulaw,
+		encoder: encoder,
+	}
+	return nil
+}
+
+// WriteG711 writes G.711 samples, that are transcoded into AAC.
+// EnableG711Transcoding() must be called before.
+func (m *Muxer) WriteG711(ntp time.Time, pts time.Duration, samples []byte) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	if m.g711Transcoder == nil {
+		return fmt.Errorf("G711 transcoding is not enabled")
+	}
+
+	aus, ptss, err := m.g711Transcoder.transcode(pts, samples)
+	if err != nil {
+		return err
+	}
+
+	for i, au := range aus {
+		err := m.writeAudio(ntp.Add(ptss[i]-pts), ptss[i], au)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MasterPlaylistVariant is a variant of a MasterPlaylist.
+type MasterPlaylistVariant struct {
+	// Muxer that generates the variant.
+	Muxer *Muxer
+
+	// URI of the media playlist of the Muxer, relative to the master playlist,
+	// i.e. "720p/stream.m3u8".
+	// Other files of the Muxer, like subtitles, are expected in the same directory.
+	URI string
+}
+
+// uriPrefix returns the directory of the variant, relative to the master playlist.
+func (v MasterPlaylistVariant) uriPrefix() string {
+	i := strings.LastIndexByte(v.URI, '/')
+	if i < 0 {
+		return ""
+	}
+	return v.URI[:i+1]
+}
+
+// MasterPlaylist is a primary playlist that references the media playlists
+// of multiple Muxers, that encode the same content at different bitrates
+// or resolutions, allowing clients to perform adaptive bitrate streaming.
+// Bandwidth, resolution and codecs of each variant are filled automatically,
+// and subtitle renditions of variants are advertised with EXT-X-MEDIA tags.
+type MasterPlaylist struct {
+	variants []MasterPlaylistVariant
+}
+
+// NewMasterPlaylist allocates a MasterPlaylist.
+// Variants are listed in the given order.
+func NewMasterPlaylist(variants []MasterPlaylistVariant) (*MasterPlaylist, error) {
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("at least one variant must be provided")
+	}
+
+	for i, v := range variants {
+		if v.Muxer == nil {
+			return nil, fmt.Errorf("muxer of variant %d is nil", i)
+		}
+
+		if v.URI == "" {
+			return nil, fmt.Errorf("URI of variant %d is empty", i)
+		}
+
+		if strings.ContainsAny(v.URI, "\"\r\n") {
+			return nil, fmt.Errorf("URI of variant %d contains invalid characters", i)
+		}
+	}
+
+	return &MasterPlaylist{
+		variants: variants,
+	}, nil
+}
+
+// File returns the master playlist.
+func (p *MasterPlaylist) File() *MuxerFileResponse {
+	return &MuxerFileResponse{
+		Status: http.StatusOK,
+		Header: map[string]string{
+			"Content-Type": `application/x-mpegURL`,
+		},
+		Body: func() io.Reader {
+			// the version is the highest one required by variants, and segments are
+			// independent only if they are independent in every variant.
+			version := 0
+			independentSegments := true
+
+			for _, v := range p.variants {
+				pp := v.Muxer.primaryPlaylist
+
+				if pp.version() > version {
+					version = pp.version()
+				}
+
+				if !pp.independentSegments {
+					independentSegments = false
+				}
+			}
+
+			cnt := "#EXTM3U\n" +
+				"#EXT-X-VERSION:" + strconv.FormatInt(int64(version), 10) + "\n"
+
+			if independentSegments {
+				cnt += "#EXT-X-INDEPENDENT-SEGMENTS\n"
+			}
+
+			cnt += "\n"
+
+			// subtitles of each variant are placed in a dedicated group,
+			// since they are generated by different muxers.
+			subtitlesPresent := false
+			for i, v := range p.variants {
+				if v.Muxer.primaryPlaylist.subtitles != nil {
+					cnt += v.Muxer.primaryPlaylist.subtitles.mediaTag(subtitlesGroupID(i), v.uriPrefix())
+					subtitlesPresent = true
+				}
+			}
+
+			if subtitlesPresent {
+				cnt += "\n"
+			}
+
+			for i, v := range p.variants {
+				pp := v.Muxer.primaryPlaylist
+
+				cnt += "#EXT-X-STREAM-INF:" + pp.streamInf()
+
+				if width, height, ok := pp.resolution(); ok {
+					cnt += ",RESOLUTION=" + strconv.FormatInt(int64(width), 10) +
+						"x" + strconv.FormatInt(int64(height), 10)
+				}
+
+				if pp.subtitles != nil {
+					cnt += ",SUBTITLES=\"" + subtitlesGroupID(i) + "\""
+				}
+
+				cnt += "\n" + v.URI + "\n"
+			}
+
+			return bytes.NewReader([]byte(cnt))
+		}(),
+	}
+}
+
+func subtitlesGroupID(variantIndex int) string {
+	return "subs" + strconv.FormatInt(int64(variantIndex), 10)
+}
@@ -0,0 +1,92 @@
+package hls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+)
+
+// jpegSize returns the width and the height of a JPEG image,
+// that are contained in its start of frame marker.
+func jpegSize(frame []byte) (int, int, error) {
+	if len(frame) < 2 || frame[0] != 0xFF || frame[1] != 0xD8 {
+		return 0, 0, fmt.Errorf("start of image not found")
+	}
+
+	pos := 2
+
+	for {
+		if (len(frame) - pos) < 4 {
+			return 0, 0, fmt.Errorf("start of frame not found")
+		}
+
+		if frame[pos] != 0xFF {
+			return 0, 0, fmt.Errorf("invalid marker at offset %d", pos)
+		}
+
+		marker := frame[pos+1]
+
+		// fill bytes and markers without a length
+		if marker == 0xFF || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos++
+			if marker != 0xFF {
+				pos++
+			}
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(frame[pos+2:]))
+		if length < 2 || (len(frame)-pos-2) < length {
+			return 0, 0, fmt.Errorf("invalid marker length at offset %d", pos)
+		}
+
+		switch {
+		// start of frame markers, excluding DHT, JPG and DAC
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			if length < 7 {
+				return 0, 0, fmt.Errorf("invalid start of frame")
+			}
+
+			height := int(binary.BigEndian.Uint16(frame[pos+5:]))
+			width := int(binary.BigEndian.Uint16(frame[pos+7:]))
+			if width == 0 || height == 0 {
+				return 0, 0, fmt.Errorf("invalid size: %dx%d", width, height)
+			}
+
+			return width, height, nil
+
+		case marker == 0xDA: // start of scan
+			return 0, 0, fmt.Errorf("start of frame not found")
+		}
+
+		pos += 2 + length
+	}
+}
+
+// WriteMJPEG writes a M-JPEG frame.
+// Each frame is independent from the others, therefore segments can start with any frame.
+// The video track of the Muxer must be a M-JPEG track.
+func (m *Muxer) WriteMJPEG(ntp time.Time, pts time.Duration, frame []byte) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	if _, ok := m.videoTrack.(*format.MJPEG); !ok {
+		return fmt.Errorf("the video track is not a M-JPEG track")
+	}
+
+	err := m.variant.writeMJPEG(ntp, pts, frame)
+	if err != nil {
+		return err
+	}
+
+	if m.avSync != nil {
+		m.avSync.processVideo(ntp, pts)
+	}
+
+	atomic.StoreInt64(m.lastWriteTime, time.Now().UnixNano())
+	return nil
+}
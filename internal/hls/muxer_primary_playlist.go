@@ -8,27 +8,151 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 )
 
+// bandwidth used before the first segments are available.
+const muxerDefaultBandwidth = 200000
+
 type muxerPrimaryPlaylist struct {
-	fmp4       bool
-	videoTrack *format.H264
-	audioTrack *format.MPEG4Audio
+	fmp4                bool
+	independentSegments bool
+	videoTrack          format.Format
+	audioTrack          format.Format
+	bandwidth           func() (int, int)
+	subtitles           *muxerSubtitles
 }
 
 func newMuxerPrimaryPlaylist(
 	fmp4 bool,
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	independentSegments bool,
+	videoTrack format.Format,
+	audioTrack format.Format,
+	bandwidth func() (int, int),
 ) *muxerPrimaryPlaylist {
 	return &muxerPrimaryPlaylist{
-		fmp4:       fmp4,
-		videoTrack: videoTrack,
-		audioTrack: audioTrack,
+		fmp4:                fmp4,
+		independentSegments: independentSegments,
+		videoTrack:          videoTrack,
+		audioTrack:          audioTrack,
+		bandwidth:           bandwidth,
 	}
 }
 
+// codecParametersH264 returns the RFC 6381 codec parameter of a H264 track,
+// in the form avc1.PPCCLL, where PP is the profile, CC contains the constraint_set flags
+// and LL is the level. Constraint flags distinguish, for instance, constrained baseline (42e0)
+// from baseline (4200). Reserved bits are cleared, since some players refuse codecs with
+// unknown flags.
+func codecParametersH264(sps []byte) string {
+	var s h264.SPS
+	err := s.Unmarshal(sps)
+	if err != nil {
+		// fallback to the raw SPS header
+		if len(sps) < 4 {
+			return ""
+		}
+		return "avc1." + hex.EncodeToString([]byte{sps[1], sps[2] & 0xFC, sps[3]})
+	}
+
+	var flags byte
+	for i, flag := range []bool{
+		s.ConstraintSet0Flag,
+		s.ConstraintSet1Flag,
+		s.ConstraintSet2Flag,
+		s.ConstraintSet3Flag,
+		s.ConstraintSet4Flag,
+		s.ConstraintSet5Flag,
+	} {
+		if flag {
+			flags |= 1 << (7 - i)
+		}
+	}
+
+	return "avc1." + hex.EncodeToString([]byte{s.ProfileIdc, flags, s.LevelIdc})
+}
+
+func (p *muxerPrimaryPlaylist) version() int {
+	if !p.fmp4 {
+		return 3
+	}
+	return 9
+}
+
+func (p *muxerPrimaryPlaylist) codecs() []string {
+	var codecs []string
+
+	switch videoTrack := p.videoTrack.(type) {
+	case *format.H264:
+		if codec := codecParametersH264(videoTrack.SafeSPS()); codec != "" {
+			codecs = append(codecs, codec)
+		}
+
+	case *format.MJPEG:
+		// MPEG-4 Visual sample entry with the JPEG object type
+		codecs = append(codecs, "mp4v.6c")
+	}
+
+	// https://developer.mozilla.org/en-US/docs/Web/Media/Formats/codecs_parameter
+	switch audioTrack := p.audioTrack.(type) {
+	case *format.MPEG4Audio:
+		// HE-AAC and HE-AACv2 are identified by the type of the extension
+		typ := audioTrack.Config.Type
+		if audioTrack.Config.ExtensionType != 0 {
+			typ = audioTrack.Config.ExtensionType
+		}
+
+		codecs = append(codecs, "mp4a.40."+strconv.FormatInt(int64(typ), 10))
+
+	case *ac3.Format:
+		if audioTrack.Config.Enhanced {
+			codecs = append(codecs, "ec-3")
+		} else {
+			codecs = append(codecs, "ac-3")
+		}
+
+	case *format.LPCM:
+		codecs = append(codecs, "ipcm")
+	}
+
+	return codecs
+}
+
+// resolution returns the size of the video track, when it can be obtained from the SPS.
+func (p *muxerPrimaryPlaylist) resolution() (int, int, bool) {
+	videoTrack, ok := p.videoTrack.(*format.H264)
+	if !ok {
+		return 0, 0, false
+	}
+
+	var s h264.SPS
+	err := s.Unmarshal(videoTrack.SafeSPS())
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return s.Width(), s.Height(), true
+}
+
+// streamInf returns the BANDWIDTH, AVERAGE-BANDWIDTH and CODECS attributes
+// of the EXT-X-STREAM-INF tag.
+func (p *muxerPrimaryPlaylist) streamInf() string {
+	// use the peak and the average bitrate of the segments in the window
+	var bandwidth string
+	peak, average := p.bandwidth()
+	if peak != 0 {
+		bandwidth = "BANDWIDTH=" + strconv.FormatInt(int64(peak), 10) +
+			",AVERAGE-BANDWIDTH=" + strconv.FormatInt(int64(average), 10)
+	} else {
+		bandwidth = "BANDWIDTH=" + strconv.FormatInt(muxerDefaultBandwidth, 10)
+	}
+
+	return bandwidth + ",CODECS=\"" + strings.Join(p.codecs(), ",") + "\""
+}
+
 func (p *muxerPrimaryPlaylist) file() *MuxerFileResponse {
 	return &MuxerFileResponse{
 		Status: http.StatusOK,
@@ -36,32 +160,23 @@ func (p *muxerPrimaryPlaylist) file() *MuxerFileResponse {
 			"Content-Type": `application/x-mpegURL`,
 		},
 		Body: func() io.Reader {
-			var codecs []string
+			cnt := "#EXTM3U\n" +
+				"#EXT-X-VERSION:" + strconv.FormatInt(int64(p.version()), 10) + "\n"
 
-			if p.videoTrack != nil {
-				sps := p.videoTrack.SafeSPS()
-				if len(sps) >= 4 {
-					codecs = append(codecs, "avc1."+hex.EncodeToString(sps[1:4]))
-				}
+			if p.independentSegments {
+				cnt += "#EXT-X-INDEPENDENT-SEGMENTS\n"
 			}
 
-			// https://developer.mozilla.org/en-US/docs/Web/Media/Formats/codecs_parameter
-			if p.audioTrack != nil {
-				codecs = append(codecs, "mp4a.40."+strconv.FormatInt(int64(p.audioTrack.Config.Type), 10))
-			}
+			cnt += "\n"
 
-			var version int
-			if !p.fmp4 {
-				version = 3
-			} else {
-				version = 9
+			var subtitles string
+			if p.subtitles != nil {
+				cnt += p.subtitles.mediaTag("subs", "") + "\n"
+				subtitles = ",SUBTITLES=\"subs\""
 			}
 
-			return bytes.NewReader([]byte("#EXTM3U\n" +
-				"#EXT-X-VERSION:" + strconv.FormatInt(int64(version), 10) + "\n" +
-				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
-				"\n" +
-				"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"" + strings.Join(codecs, ",") + "\"\n" +
+			return bytes.NewReader([]byte(cnt +
+				"#EXT-X-STREAM-INF:" + p.streamInf() + subtitles + "\n" +
 				"stream.m3u8\n"))
 		}(),
 	}
@@ -0,0 +1,68 @@
+package hls
+
+import (
+	"time"
+)
+
+type muxerRetentionEntry struct {
+	expiration time.Time
+	remove     func()
+}
+
+// muxerRetention keeps files that are not referenced anymore by the playlist
+// for an additional period, in order to serve clients that
+// fetch them right after they are removed from the playlist.
+// Files are also kept as long as the retention is pinned by a snapshot.
+type muxerRetention struct {
+	duration time.Duration
+
+	entries  []muxerRetentionEntry
+	pinCount int
+}
+
+func newMuxerRetention(duration time.Duration) *muxerRetention {
+	return &muxerRetention{
+		duration: duration,
+	}
+}
+
+// add schedules the removal of a file.
+func (r *muxerRetention) add(now time.Time, remove func()) {
+	if r.duration <= 0 && r.pinCount == 0 {
+		remove()
+		return
+	}
+
+	r.entries = append(r.entries, muxerRetentionEntry{
+		expiration: now.Add(r.duration),
+		remove:     remove,
+	})
+}
+
+// pin prevents files from being removed until unpin() is called.
+func (r *muxerRetention) pin() {
+	r.pinCount++
+}
+
+// unpin releases a pin and removes files that expired in the meanwhile.
+func (r *muxerRetention) unpin(now time.Time) {
+	r.pinCount--
+	r.purge(now)
+}
+
+// purge removes expired files.
+func (r *muxerRetention) purge(now time.Time) {
+	if r.pinCount > 0 {
+		return
+	}
+
+	n := 0
+	for _, e := range r.entries {
+		if now.Before(e.expiration) {
+			break
+		}
+		e.remove()
+		n++
+	}
+	r.entries = r.entries[n:]
+}
@@ -0,0 +1,70 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/formatdecenc/rtph264"
+	"github.com/pion/rtp"
+)
+
+// WriteH264RTP writes H264 RTP packets, that are depacketized by the muxer.
+// It can be used by callers that receive RTP packets and don't need NALUs,
+// in order to avoid depacketizing them separately.
+// Packets must be provided in order and can contain partial access units,
+// that are written once the packet with the marker is received.
+// Parameters sent in-band are applied to the track.
+func (m *Muxer) WriteH264RTP(ntp time.Time, pkts []*rtp.Packet) error {
+	if m.finished {
+		return errMuxerFinished
+	}
+
+	h264Track, ok := m.videoTrack.(*format.H264)
+	if !ok {
+		return fmt.Errorf("the video track is not H264")
+	}
+
+	if m.h264RTPDecoder == nil {
+		m.h264RTPDecoder = h264Track.CreateDecoder()
+	}
+
+	for _, pkt := range pkts {
+		nalus, pts, err := m.h264RTPDecoder.DecodeUntilMarker(pkt)
+		if err != nil {
+			if err == rtph264.ErrNonStartingPacketAndNoPrevious || err == rtph264.ErrMorePacketsNeeded {
+				continue
+			}
+			return err
+		}
+
+		updateH264TrackParameters(h264Track, nalus)
+
+		err = m.WriteH264(ntp, pts, nalus)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateH264TrackParameters(track *format.H264, nalus [][]byte) {
+	for _, nalu := range nalus {
+		typ := h264.NALUType(nalu[0] & 0x1F)
+
+		switch typ {
+		case h264.NALUTypeSPS:
+			if !bytes.Equal(nalu, track.SafeSPS()) {
+				track.SafeSetSPS(nalu)
+			}
+
+		case h264.NALUTypePPS:
+			if !bytes.Equal(nalu, track.SafePPS()) {
+				track.SafeSetPPS(nalu)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package hls
+
+import (
+	"io"
+)
+
+// SegmentStorageFile is a file of a SegmentStorage.
+type SegmentStorageFile interface {
+	// Write appends data to the file.
+	// It can be called while portions of the file are being read.
+	Write(p []byte) (int, error)
+
+	// Reader returns a reader of a portion of the file.
+	// The reader must be closed when it is not needed anymore.
+	Reader(offset uint64, size uint64) io.ReadCloser
+
+	// Size returns the current size of the file.
+	Size() uint64
+
+	// Remove removes the file.
+	// Readers that are still open keep working until they are closed.
+	Remove()
+}
+
+// SegmentStorage is a storage of segments and parts, used by the Muxer.
+type SegmentStorage interface {
+	// Create creates a file.
+	Create(name string) (SegmentStorageFile, error)
+
+	// Close removes all files, including the ones that are being read.
+	Close()
+}
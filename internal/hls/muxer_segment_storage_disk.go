@@ -0,0 +1,176 @@
+package hls
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type segmentStorageDiskReader struct {
+	file *segmentStorageDiskFile
+	r    *io.SectionReader
+	once sync.Once
+}
+
+// Read implements io.Reader.
+func (r *segmentStorageDiskReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	// the reader is released as soon as it's exhausted,
+	// in order not to depend on callers that don't call Close().
+	if err != nil {
+		r.Close()
+	}
+
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *segmentStorageDiskReader) Close() error {
+	r.once.Do(r.file.releaseReader)
+	return nil
+}
+
+type segmentStorageDiskFile struct {
+	storage *SegmentStorageDisk
+	path    string
+	f       *os.File
+
+	mutex   sync.RWMutex
+	size    uint64
+	readers int
+	removed bool
+	closed  bool
+}
+
+// Write implements SegmentStorageFile.
+func (f *segmentStorageDiskFile) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+
+	f.mutex.Lock()
+	f.size += uint64(n)
+	f.mutex.Unlock()
+
+	return n, err
+}
+
+// Reader implements SegmentStorageFile.
+func (f *segmentStorageDiskFile) Reader(offset uint64, size uint64) io.ReadCloser {
+	f.mutex.Lock()
+	f.readers++
+	f.mutex.Unlock()
+
+	return &segmentStorageDiskReader{
+		file: f,
+		r:    io.NewSectionReader(f.f, int64(offset), int64(size)),
+	}
+}
+
+// Size implements SegmentStorageFile.
+func (f *segmentStorageDiskFile) Size() uint64 {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.size
+}
+
+// Remove implements SegmentStorageFile.
+func (f *segmentStorageDiskFile) Remove() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.removed = true
+
+	// the file is closed when the last reader is released,
+	// otherwise ongoing downloads would be truncated.
+	if f.readers == 0 {
+		f.close()
+	}
+}
+
+func (f *segmentStorageDiskFile) releaseReader() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.readers--
+
+	if f.readers == 0 && f.removed {
+		f.close()
+	}
+}
+
+// close must be called with the mutex locked.
+func (f *segmentStorageDiskFile) close() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+
+	f.f.Close()
+	os.Remove(f.path)
+	f.storage.remove(f)
+}
+
+// SegmentStorageDisk is a SegmentStorage that stores files on disk,
+// in order to reduce RAM usage.
+type SegmentStorageDisk struct {
+	dir string
+
+	mutex sync.Mutex
+	files map[*segmentStorageDiskFile]struct{}
+}
+
+// NewSegmentStorageDisk allocates a SegmentStorageDisk.
+// Files are stored inside the given directory, that must exist.
+func NewSegmentStorageDisk(dir string) *SegmentStorageDisk {
+	return &SegmentStorageDisk{
+		dir:   dir,
+		files: make(map[*segmentStorageDiskFile]struct{}),
+	}
+}
+
+// Create implements SegmentStorage.
+func (s *SegmentStorageDisk) Create(name string) (SegmentStorageFile, error) {
+	path := filepath.Join(s.dir, name)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &segmentStorageDiskFile{
+		storage: s,
+		path:    path,
+		f:       f,
+	}
+
+	s.mutex.Lock()
+	s.files[file] = struct{}{}
+	s.mutex.Unlock()
+
+	return file, nil
+}
+
+// Close implements SegmentStorage.
+func (s *SegmentStorageDisk) Close() {
+	s.mutex.Lock()
+	files := make([]*segmentStorageDiskFile, 0, len(s.files))
+	for file := range s.files {
+		files = append(files, file)
+	}
+	s.mutex.Unlock()
+
+	for _, file := range files {
+		file.mutex.Lock()
+		file.removed = true
+		file.close()
+		file.mutex.Unlock()
+	}
+}
+
+func (s *SegmentStorageDisk) remove(file *segmentStorageDiskFile) {
+	s.mutex.Lock()
+	delete(s.files, file)
+	s.mutex.Unlock()
+}
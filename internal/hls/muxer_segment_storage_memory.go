@@ -0,0 +1,60 @@
+package hls
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+type segmentStorageMemoryFile struct {
+	mutex sync.RWMutex
+	buf   []byte
+}
+
+// Write implements SegmentStorageFile.
+func (f *segmentStorageMemoryFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// existing readers keep referencing the previous buffer,
+	// whose content is never modified.
+	f.buf = append(f.buf, p...)
+	return len(p), nil
+}
+
+// Reader implements SegmentStorageFile.
+func (f *segmentStorageMemoryFile) Reader(offset uint64, size uint64) io.ReadCloser {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return io.NopCloser(bytes.NewReader(f.buf[offset : offset+size]))
+}
+
+// Size implements SegmentStorageFile.
+func (f *segmentStorageMemoryFile) Size() uint64 {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return uint64(len(f.buf))
+}
+
+// Remove implements SegmentStorageFile.
+func (f *segmentStorageMemoryFile) Remove() {
+}
+
+// SegmentStorageMemory is a SegmentStorage that stores files in RAM.
+type SegmentStorageMemory struct{}
+
+// NewSegmentStorageMemory allocates a SegmentStorageMemory.
+func NewSegmentStorageMemory() *SegmentStorageMemory {
+	return &SegmentStorageMemory{}
+}
+
+// Create implements SegmentStorage.
+func (s *SegmentStorageMemory) Create(name string) (SegmentStorageFile, error) {
+	return &segmentStorageMemoryFile{}, nil
+}
+
+// Close implements SegmentStorage.
+func (s *SegmentStorageMemory) Close() {
+}
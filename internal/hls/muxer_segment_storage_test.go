@@ -0,0 +1,112 @@
+package hls
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentStorage(t *testing.T) {
+	for _, ca := range []string{
+		"memory",
+		"disk",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			var s SegmentStorage
+			dir := t.TempDir()
+
+			if ca == "memory" {
+				s = NewSegmentStorageMemory()
+			} else {
+				s = NewSegmentStorageDisk(dir)
+			}
+
+			f, err := s.Create("seg0.mp4")
+			require.NoError(t, err)
+
+			_, err = f.Write([]byte{1, 2, 3, 4})
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), f.Size())
+
+			r := f.Reader(1, 2)
+
+			// readers of previous portions are not affected by appends
+			_, err = f.Write([]byte{5, 6})
+			require.NoError(t, err)
+			require.Equal(t, uint64(6), f.Size())
+
+			byts, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, []byte{2, 3}, byts)
+
+			byts, err = io.ReadAll(f.Reader(0, f.Size()))
+			require.NoError(t, err)
+			require.Equal(t, []byte{1, 2, 3, 4, 5, 6}, byts)
+
+			f.Remove()
+
+			if ca == "disk" {
+				_, err = os.Stat(filepath.Join(dir, "seg0.mp4"))
+				require.Equal(t, true, os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestSegmentStorageDiskRemoveWhileReading(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSegmentStorageDisk(dir)
+
+	f, err := s.Create("seg0.mp4")
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte{1, 2, 3, 4})
+	require.NoError(t, err)
+
+	r := f.Reader(0, 4)
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+
+	// the segment rotates out while a slow client is downloading it
+	f.Remove()
+
+	_, err = os.Stat(filepath.Join(dir, "seg0.mp4"))
+	require.NoError(t, err)
+
+	byts, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3, 4}, byts)
+
+	err = r.Close()
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "seg0.mp4"))
+	require.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestSegmentStorageDiskClose(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSegmentStorageDisk(dir)
+
+	f1, err := s.Create("seg0.mp4")
+	require.NoError(t, err)
+
+	f2, err := s.Create("seg1.mp4")
+	require.NoError(t, err)
+
+	// an unfinished download doesn't prevent the storage from being closed
+	r := f2.Reader(0, 0)
+	defer r.Close()
+
+	f1.Remove()
+	s.Close()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(entries))
+}
@@ -0,0 +1,134 @@
+package hls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const mpegtsPacketSize = 188
+
+// skipBytes discards n bytes of a reader, seeking when possible.
+func skipBytes(r io.Reader, n int64) error {
+	if rs, ok := r.(io.Seeker); ok {
+		_, err := rs.Seek(n, io.SeekCurrent)
+		return err
+	}
+
+	_, err := io.CopyN(io.Discard, r, n)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// checkLastByte checks that the byte that precedes the current position can be read,
+// in order to detect files that are shorter than expected when seeking.
+func checkLastByte(r io.Reader) error {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return nil
+	}
+
+	_, err := rs.Seek(-1, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(rs, make([]byte, 1))
+	return err
+}
+
+// validateMP4 checks that a fMP4 segment or part is made of complete boxes
+// and has the given size. Only box headers are read.
+func validateMP4(r io.Reader, size uint64) error {
+	if size == 0 {
+		return fmt.Errorf("segment is empty")
+	}
+
+	pos := uint64(0)
+	buf := make([]byte, 16)
+
+	for pos < size {
+		if (size - pos) < 8 {
+			return fmt.Errorf("truncated box header at offset %d", pos)
+		}
+
+		_, err := io.ReadFull(r, buf[:8])
+		if err != nil {
+			return fmt.Errorf("truncated box header at offset %d", pos)
+		}
+
+		boxSize := uint64(binary.BigEndian.Uint32(buf))
+		headerSize := uint64(8)
+
+		switch boxSize {
+		case 0: // box extends to the end of the file
+			boxSize = size - pos
+
+		case 1: // 64-bit size
+			if (size - pos) < 16 {
+				return fmt.Errorf("truncated box header at offset %d", pos)
+			}
+
+			_, err := io.ReadFull(r, buf[8:16])
+			if err != nil {
+				return fmt.Errorf("truncated box header at offset %d", pos)
+			}
+
+			boxSize = binary.BigEndian.Uint64(buf[8:])
+			headerSize = 16
+		}
+
+		if boxSize < headerSize || boxSize > (size-pos) {
+			return fmt.Errorf("box at offset %d exceeds the segment size", pos)
+		}
+
+		err = skipBytes(r, int64(boxSize-headerSize))
+		if err != nil {
+			return fmt.Errorf("truncated box at offset %d", pos)
+		}
+
+		pos += boxSize
+	}
+
+	err := checkLastByte(r)
+	if err != nil {
+		return fmt.Errorf("segment is shorter than %d bytes", size)
+	}
+
+	return nil
+}
+
+// validateMPEGTS checks that a MPEG-TS segment is made of complete packets
+// and has the given size. Only the sync byte of each packet is read.
+func validateMPEGTS(r io.Reader, size uint64) error {
+	if size == 0 || (size%mpegtsPacketSize) != 0 {
+		return fmt.Errorf("segment size is not a multiple of the packet size")
+	}
+
+	buf := make([]byte, 1)
+
+	for pos := uint64(0); pos < size; pos += mpegtsPacketSize {
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return fmt.Errorf("truncated packet at offset %d", pos)
+		}
+
+		if buf[0] != 0x47 {
+			return fmt.Errorf("missing sync byte at offset %d", pos)
+		}
+
+		err = skipBytes(r, mpegtsPacketSize-1)
+		if err != nil {
+			return fmt.Errorf("truncated packet at offset %d", pos)
+		}
+	}
+
+	err := checkLastByte(r)
+	if err != nil {
+		return fmt.Errorf("segment is shorter than %d bytes", size)
+	}
+
+	return nil
+}
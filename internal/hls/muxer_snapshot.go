@@ -0,0 +1,40 @@
+package hls
+
+import (
+	"io"
+	"sync"
+)
+
+// MuxerSnapshot is an instantaneous copy of the playlist of a Muxer.
+// Segments referenced by the playlist are not deleted until Release() is called,
+// therefore they can be fetched with File() without racing against their removal.
+type MuxerSnapshot struct {
+	// content of the playlist (stream.m3u8).
+	Playlist []byte
+
+	// file names of the complete segments referenced by the playlist, in order.
+	// In case of fMP4 variants, the initialization segment (init.mp4) is not included
+	// since it is always available.
+	Segments []string
+
+	releaseOnce sync.Once
+	release     func()
+}
+
+// Release allows the segments referenced by the snapshot to be deleted.
+// It can be called multiple times.
+func (s *MuxerSnapshot) Release() {
+	s.releaseOnce.Do(s.release)
+}
+
+// Snapshot returns a snapshot of the playlist and of the segments it references.
+// Release() must be called once the segments are not needed anymore,
+// otherwise they are never deleted.
+func (m *Muxer) Snapshot() (*MuxerSnapshot, error) {
+	return m.variant.snapshot()
+}
+
+func readSnapshotPlaylist(r io.Reader) []byte {
+	byts, _ := io.ReadAll(r)
+	return byts
+}
@@ -0,0 +1,249 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the MPEG-TS timestamp wraps around every 2^33 ticks.
+const mpegtsTimestampMax = 1 << 33
+
+type muxerSubtitleCue struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+type muxerSubtitleSegment struct {
+	name      string
+	startTime time.Time
+	duration  time.Duration
+	content   []byte
+}
+
+// muxerSubtitles is a WebVTT subtitle rendition.
+// Its segments are aligned with the media segments: when a media segment is finalized,
+// a WebVTT segment with the same name and duration is generated with the cues that overlap with it.
+type muxerSubtitles struct {
+	name         string
+	language     string
+	segmentCount int
+
+	mutex              sync.Mutex
+	ended              bool
+	cues               []*muxerSubtitleCue
+	segments           []*muxerSubtitleSegment
+	segmentByName      map[string]*muxerSubtitleSegment
+	segmentDeleteCount int
+}
+
+func newMuxerSubtitles(
+	name string,
+	language string,
+	segmentCount int,
+) *muxerSubtitles {
+	return &muxerSubtitles{
+		name:          name,
+		language:      language,
+		segmentCount:  segmentCount,
+		segmentByName: make(map[string]*muxerSubtitleSegment),
+	}
+}
+
+// marshalVTTTimestamp encodes a WebVTT timestamp, in the form HH:MM:SS.mmm.
+func marshalVTTTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		ms/3600000,
+		(ms/60000)%60,
+		(ms/1000)%60,
+		ms%1000)
+}
+
+// writeCue adds a cue, that is displayed from start (in the timeline of the media data) for duration.
+func (s *muxerSubtitles) writeCue(start time.Duration, duration time.Duration, text string) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid cue duration: %v", duration)
+	}
+
+	// lines are separated by LF, blank lines would terminate the cue
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		if strings.Contains(line, "-->") {
+			return fmt.Errorf("cue text can't contain '-->'")
+		}
+
+		lines = append(lines, line)
+	}
+
+	if lines == nil {
+		return fmt.Errorf("cue text is empty")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cues = append(s.cues, &muxerSubtitleCue{
+		start: start,
+		end:   start + duration,
+		text:  strings.Join(lines, "\n"),
+	})
+
+	return nil
+}
+
+// onSegmentFinalized generates the WebVTT segment that is aligned with a media segment.
+// start is the start of the media segment in the timeline of the media data,
+// while mediaTimestamp is the timestamp of its first sample, inside the segment.
+func (s *muxerSubtitles) onSegmentFinalized(
+	name string,
+	startTime time.Time,
+	start time.Duration,
+	mediaTimestamp time.Duration,
+	duration time.Duration,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	end := start + duration
+
+	// LOCAL 00:00:00.000 corresponds to the start of the segment
+	ts := int64(math.Round(mediaTimestamp.Seconds()*90000)) % mpegtsTimestampMax
+	cnt := "WEBVTT\n" +
+		"X-TIMESTAMP-MAP=MPEGTS:" + strconv.FormatInt(ts, 10) + ",LOCAL:00:00:00.000\n"
+
+	n := 0
+	for _, cue := range s.cues {
+		// cues that overlap with multiple segments are repeated in each of them
+		if cue.start < end && cue.end > start {
+			cnt += "\n" + marshalVTTTimestamp(cue.start-start) + " --> " + marshalVTTTimestamp(cue.end-start) + "\n" +
+				cue.text + "\n"
+		}
+
+		// keep cues that overlap with next segments
+		if cue.end > end {
+			s.cues[n] = cue
+			n++
+		}
+	}
+	s.cues = s.cues[:n]
+
+	seg := &muxerSubtitleSegment{
+		name:      name,
+		startTime: startTime,
+		duration:  duration,
+		content:   []byte(cnt),
+	}
+
+	s.segmentByName[seg.name] = seg
+	s.segments = append(s.segments, seg)
+
+	if len(s.segments) > s.segmentCount {
+		delete(s.segmentByName, s.segments[0].name)
+		s.segments = s.segments[1:]
+		s.segmentDeleteCount++
+	}
+}
+
+// end marks the playlist as complete.
+func (s *muxerSubtitles) end() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ended = true
+}
+
+// mediaTag returns the EXT-X-MEDIA tag of the rendition.
+// mediaTag returns the EXT-X-MEDIA tag of the rendition.
+// uriPrefix is the path of the Muxer relative to the playlist that contains the tag.
+func (s *muxerSubtitles) mediaTag(groupID string, uriPrefix string) string {
+	cnt := "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"" + groupID + "\",NAME=\"" + s.name + "\""
+	if s.language != "" {
+		cnt += ",LANGUAGE=\"" + s.language + "\""
+	}
+	cnt += ",DEFAULT=YES,AUTOSELECT=YES,URI=\"" + uriPrefix + "subtitles.m3u8\"\n"
+	return cnt
+}
+
+func (s *muxerSubtitles) file(name string) *MuxerFileResponse {
+	switch {
+	case name == "subtitles.m3u8":
+		return s.playlistReader()
+
+	case strings.HasSuffix(name, ".vtt"):
+		return s.segmentReader(name)
+
+	default:
+		return NewMuxerFileResponseError(http.StatusNotFound)
+	}
+}
+
+func (s *muxerSubtitles) playlistReader() *MuxerFileResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cnt := "#EXTM3U\n"
+	cnt += "#EXT-X-VERSION:3\n"
+
+	targetDuration := uint(0)
+	for _, seg := range s.segments {
+		v := uint(math.Round(seg.duration.Seconds()))
+		if v > targetDuration {
+			targetDuration = v
+		}
+	}
+	cnt += "#EXT-X-TARGETDURATION:" + strconv.FormatUint(uint64(targetDuration), 10) + "\n"
+
+	cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(s.segmentDeleteCount), 10) + "\n"
+
+	for _, seg := range s.segments {
+		cnt += "#EXT-X-PROGRAM-DATE-TIME:" + seg.startTime.Format("2006-01-02T15:04:05.999Z07:00") + "\n" +
+			"#EXTINF:" + strconv.FormatFloat(seg.duration.Seconds(), 'f', 5, 64) + ",\n" +
+			seg.name + ".vtt\n"
+	}
+
+	if s.ended {
+		cnt += "#EXT-X-ENDLIST\n"
+	}
+
+	return &MuxerFileResponse{
+		Status: http.StatusOK,
+		Header: map[string]string{
+			"Content-Type": `application/x-mpegURL`,
+		},
+		Body: bytes.NewReader([]byte(cnt)),
+	}
+}
+
+func (s *muxerSubtitles) segmentReader(fname string) *MuxerFileResponse {
+	base := strings.TrimSuffix(fname, ".vtt")
+
+	s.mutex.Lock()
+	seg, ok := s.segmentByName[base]
+	s.mutex.Unlock()
+
+	if !ok {
+		return NewMuxerFileResponseError(http.StatusNotFound)
+	}
+
+	return &MuxerFileResponse{
+		Status: http.StatusOK,
+		Header: map[string]string{
+			"Content-Type": "text/vtt",
+		},
+		Body: bytes.NewReader(seg.content),
+	}
+}
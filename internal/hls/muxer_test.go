@@ -1,14 +1,28 @@
 package hls
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"testing"
 	"time"
 
+	gomp4 "github.com/abema/go-mp4"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 var testTime = time.Date(2010, 0o1, 0o1, 0o1, 0o1, 0o1, 0, time.UTC)
@@ -21,6 +35,15 @@ var testSPS = []byte{
 	0x20,
 }
 
+// testBandwidth returns the BANDWIDTH and AVERAGE-BANDWIDTH attributes
+// that the primary playlist of a muxer is expected to contain.
+func testBandwidth(t *testing.T, m *Muxer) string {
+	peak, average := m.variant.bandwidth()
+	require.NotEqual(t, 0, peak)
+	return "BANDWIDTH=" + strconv.FormatInt(int64(peak), 10) +
+		",AVERAGE-BANDWIDTH=" + strconv.FormatInt(int64(average), 10)
+}
+
 func TestMuxerVideoAudio(t *testing.T) {
 	videoTrack := &format.H264{
 		PayloadTyp:        96,
@@ -53,7 +76,15 @@ func TestMuxerVideoAudio(t *testing.T) {
 				v = MuxerVariantFMP4
 			}
 
-			m, err := NewMuxer(v, 3, 1*time.Second, 0, 50*1024*1024, videoTrack, audioTrack)
+			m, err := NewMuxer(
+				v,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				audioTrack,
+			)
 			require.NoError(t, err)
 			defer m.Close()
 
@@ -113,7 +144,7 @@ func TestMuxerVideoAudio(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "").Body)
+			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
 			require.NoError(t, err)
 
 			if ca == "mpegts" {
@@ -121,18 +152,18 @@ func TestMuxerVideoAudio(t *testing.T) {
 					"#EXT-X-VERSION:3\n"+
 					"#EXT-X-INDEPENDENT-SEGMENTS\n"+
 					"\n"+
-					"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"avc1.42c028,mp4a.40.2\"\n"+
+					"#EXT-X-STREAM-INF:"+testBandwidth(t, m)+",CODECS=\"avc1.42c028,mp4a.40.2\"\n"+
 					"stream.m3u8\n", string(byts))
 			} else {
 				require.Equal(t, "#EXTM3U\n"+
 					"#EXT-X-VERSION:9\n"+
 					"#EXT-X-INDEPENDENT-SEGMENTS\n"+
 					"\n"+
-					"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"avc1.42c028,mp4a.40.2\"\n"+
+					"#EXT-X-STREAM-INF:"+testBandwidth(t, m)+",CODECS=\"avc1.42c028,mp4a.40.2\"\n"+
 					"stream.m3u8\n", string(byts))
 			}
 
-			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "").Body)
+			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
 			require.NoError(t, err)
 
 			var ma []string
@@ -166,13 +197,13 @@ func TestMuxerVideoAudio(t *testing.T) {
 			require.NotEqual(t, 0, len(ma))
 
 			if ca == "mpegts" {
-				_, err := io.ReadAll(m.File(ma[2], "", "", "").Body)
+				_, err := io.ReadAll(m.File(ma[2], "", "", "", false).Body)
 				require.NoError(t, err)
 			} else {
-				_, err := io.ReadAll(m.File("init.mp4", "", "", "").Body)
+				_, err := io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
 				require.NoError(t, err)
 
-				_, err = io.ReadAll(m.File(ma[2], "", "", "").Body)
+				_, err = io.ReadAll(m.File(ma[2], "", "", "", false).Body)
 				require.NoError(t, err)
 			}
 		})
@@ -199,7 +230,15 @@ func TestMuxerVideoOnly(t *testing.T) {
 				v = MuxerVariantFMP4
 			}
 
-			m, err := NewMuxer(v, 3, 1*time.Second, 0, 50*1024*1024, videoTrack, nil)
+			m, err := NewMuxer(
+				v,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
 			require.NoError(t, err)
 			defer m.Close()
 
@@ -226,7 +265,7 @@ func TestMuxerVideoOnly(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "").Body)
+			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
 			require.NoError(t, err)
 
 			if ca == "mpegts" {
@@ -234,18 +273,18 @@ func TestMuxerVideoOnly(t *testing.T) {
 					"#EXT-X-VERSION:3\n"+
 					"#EXT-X-INDEPENDENT-SEGMENTS\n"+
 					"\n"+
-					"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"avc1.42c028\"\n"+
+					"#EXT-X-STREAM-INF:"+testBandwidth(t, m)+",CODECS=\"avc1.42c028\"\n"+
 					"stream.m3u8\n", string(byts))
 			} else {
 				require.Equal(t, "#EXTM3U\n"+
 					"#EXT-X-VERSION:9\n"+
 					"#EXT-X-INDEPENDENT-SEGMENTS\n"+
 					"\n"+
-					"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"avc1.42c028\"\n"+
+					"#EXT-X-STREAM-INF:"+testBandwidth(t, m)+",CODECS=\"avc1.42c028\"\n"+
 					"stream.m3u8\n", string(byts))
 			}
 
-			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "").Body)
+			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
 			require.NoError(t, err)
 
 			var ma []string
@@ -279,13 +318,13 @@ func TestMuxerVideoOnly(t *testing.T) {
 			require.NotEqual(t, 0, len(ma))
 
 			if ca == "mpegts" {
-				_, err := io.ReadAll(m.File(ma[2], "", "", "").Body)
+				_, err := io.ReadAll(m.File(ma[2], "", "", "", false).Body)
 				require.NoError(t, err)
 			} else {
-				_, err := io.ReadAll(m.File("init.mp4", "", "", "").Body)
+				_, err := io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
 				require.NoError(t, err)
 
-				_, err = io.ReadAll(m.File(ma[2], "", "", "").Body)
+				_, err = io.ReadAll(m.File(ma[2], "", "", "", false).Body)
 				require.NoError(t, err)
 			}
 		})
@@ -317,7 +356,15 @@ func TestMuxerAudioOnly(t *testing.T) {
 				v = MuxerVariantFMP4
 			}
 
-			m, err := NewMuxer(v, 3, 1*time.Second, 0, 50*1024*1024, nil, audioTrack)
+			m, err := NewMuxer(
+				v,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				nil,
+				audioTrack,
+			)
 			require.NoError(t, err)
 			defer m.Close()
 
@@ -341,7 +388,7 @@ func TestMuxerAudioOnly(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "").Body)
+			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
 			require.NoError(t, err)
 
 			if ca == "mpegts" {
@@ -349,18 +396,18 @@ func TestMuxerAudioOnly(t *testing.T) {
 					"#EXT-X-VERSION:3\n"+
 					"#EXT-X-INDEPENDENT-SEGMENTS\n"+
 					"\n"+
-					"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"mp4a.40.2\"\n"+
+					"#EXT-X-STREAM-INF:"+testBandwidth(t, m)+",CODECS=\"mp4a.40.2\"\n"+
 					"stream.m3u8\n", string(byts))
 			} else {
 				require.Equal(t, "#EXTM3U\n"+
 					"#EXT-X-VERSION:9\n"+
 					"#EXT-X-INDEPENDENT-SEGMENTS\n"+
 					"\n"+
-					"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"mp4a.40.2\"\n"+
+					"#EXT-X-STREAM-INF:"+testBandwidth(t, m)+",CODECS=\"mp4a.40.2\"\n"+
 					"stream.m3u8\n", string(byts))
 			}
 
-			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "").Body)
+			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
 			require.NoError(t, err)
 
 			var ma []string
@@ -372,7 +419,10 @@ func TestMuxerAudioOnly(t *testing.T) {
 					`#EXT-X-MEDIA-SEQUENCE:0\n` +
 					`#EXT-X-PROGRAM-DATE-TIME:(.*?)\n` +
 					`#EXTINF:1,\n` +
-					`(seg0\.ts)\n$`)
+					`(seg0\.ts)\n` +
+					`#EXT-X-PROGRAM-DATE-TIME:(.*?)\n` +
+					`#EXTINF:1,\n` +
+					`(seg1\.ts)\n$`)
 				ma = re.FindStringSubmatch(string(byts))
 			} else {
 				re := regexp.MustCompile(`^#EXTM3U\n` +
@@ -391,20 +441,86 @@ func TestMuxerAudioOnly(t *testing.T) {
 			require.NotEqual(t, 0, len(ma))
 
 			if ca == "mpegts" {
-				_, err := io.ReadAll(m.File(ma[2], "", "", "").Body)
+				_, err := io.ReadAll(m.File(ma[2], "", "", "", false).Body)
 				require.NoError(t, err)
 			} else {
-				_, err := io.ReadAll(m.File("init.mp4", "", "", "").Body)
+				_, err := io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
 				require.NoError(t, err)
 
-				_, err = io.ReadAll(m.File(ma[2], "", "", "").Body)
+				_, err = io.ReadAll(m.File(ma[2], "", "", "", false).Body)
 				require.NoError(t, err)
 			}
 		})
 	}
 }
 
-func TestMuxerCloseBeforeFirstSegmentReader(t *testing.T) {
+func TestMuxerAudioOnlySegmentDuration(t *testing.T) {
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			var v MuxerVariant
+			if ca == "mpegts" {
+				v = MuxerVariantMPEGTS
+			} else {
+				v = MuxerVariantFMP4
+			}
+
+			m, err := NewMuxer(
+				v,
+				7,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				nil,
+				audioTrack,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			for i := 0; i < 230; i++ {
+				pts := time.Duration(i) * mpeg4audio.SamplesPerAccessUnit * time.Second / 44100
+				err = m.WriteAAC(testTime.Add(pts), pts, []byte{
+					0x01, 0x02, 0x03, 0x04,
+				})
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+			require.Contains(t, string(byts), `CODECS="mp4a.40.2"`)
+
+			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			// segments are split on the first access unit at or after the segment duration,
+			// therefore each of them contains 44 access units.
+			durations := regexp.MustCompile(`(?m)^#EXTINF:([0-9.]+),$`).FindAllStringSubmatch(string(byts), -1)
+			require.Equal(t, 5, len(durations))
+
+			for _, du := range durations {
+				v, err := strconv.ParseFloat(du[1], 64)
+				require.NoError(t, err)
+				require.InDelta(t, float64(44*mpeg4audio.SamplesPerAccessUnit)/44100, v, 0.0001)
+			}
+		})
+	}
+}
+
+func TestMuxerFMP4AudioSplicing(t *testing.T) {
 	videoTrack := &format.H264{
 		PayloadTyp:        96,
 		SPS:               testSPS,
@@ -412,24 +528,111 @@ func TestMuxerCloseBeforeFirstSegmentReader(t *testing.T) {
 		PacketizationMode: 1,
 	}
 
-	m, err := NewMuxer(MuxerVariantMPEGTS, 3, 1*time.Second, 0, 50*1024*1024, videoTrack, nil)
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   48000,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		10,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		audioTrack,
+	)
 	require.NoError(t, err)
+	defer m.Close()
 
-	// group with IDR
-	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
-		testSPS, // SPS
-		{8},     // PPS
-		{5},     // IDR
-	})
+	audioDTS := func(i int) time.Duration {
+		return time.Duration(i) * time.Duration(mpeg4audio.SamplesPerAccessUnit) * time.Second / 48000
+	}
+
+	// audio is written ahead of video, therefore AAC frames
+	// straddle the boundaries between segments.
+	audioCount := 0
+
+	for i := 0; i <= 20; i++ {
+		pts := time.Duration(i) * 200 * time.Millisecond
+
+		for ; audioDTS(audioCount) < pts+100*time.Millisecond; audioCount++ {
+			err = m.WriteAAC(testTime.Add(audioDTS(audioCount)), audioDTS(audioCount), []byte{
+				0x01, 0x02, 0x03, 0x04,
+			})
+			require.NoError(t, err)
+		}
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 5) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
 	require.NoError(t, err)
 
-	m.Close()
+	segmentNames := regexp.MustCompile(`(?m)^seg[0-9]+\.mp4$`).FindAllString(string(byts), -1)
+	require.Equal(t, 4, len(segmentNames))
 
-	b := m.File("stream.m3u8", "", "", "").Body
-	require.Equal(t, nil, b)
+	var prevAudioEnd uint64
+
+	for i, name := range segmentNames {
+		segment, err := io.ReadAll(m.File(name, "", "", "", false).Body)
+		require.NoError(t, err)
+
+		var parts fmp4.Parts
+		err = parts.Unmarshal(segment)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(parts))
+		require.Equal(t, 2, len(parts[0].Tracks))
+
+		videoPartTrack := parts[0].Tracks[0]
+		audioPartTrack := parts[0].Tracks[1]
+
+		videoStart := durationMp4ToGo(videoPartTrack.BaseTime, 90000)
+		videoDuration := uint64(0)
+		for _, sample := range videoPartTrack.Samples {
+			videoDuration += uint64(sample.Duration)
+		}
+		videoEnd := durationMp4ToGo(videoPartTrack.BaseTime+videoDuration, 90000)
+
+		audioDuration := uint64(0)
+		for _, sample := range audioPartTrack.Samples {
+			audioDuration += uint64(sample.Duration)
+		}
+
+		// every audio sample starts inside the segment
+		audioStart := durationMp4ToGo(audioPartTrack.BaseTime, 48000)
+		audioLastStart := durationMp4ToGo(audioPartTrack.BaseTime+audioDuration-
+			uint64(audioPartTrack.Samples[len(audioPartTrack.Samples)-1].Duration), 48000)
+		require.GreaterOrEqual(t, audioStart, videoStart)
+		require.Less(t, audioLastStart, videoEnd)
+
+		// audio is contiguous across segments
+		if i != 0 {
+			require.Equal(t, prevAudioEnd, audioPartTrack.BaseTime)
+		}
+		prevAudioEnd = audioPartTrack.BaseTime + audioDuration
+	}
 }
 
-func TestMuxerMaxSegmentSize(t *testing.T) {
+func TestMuxerLowLatencyPartBoundaries(t *testing.T) {
 	videoTrack := &format.H264{
 		PayloadTyp:        96,
 		SPS:               testSPS,
@@ -437,18 +640,330 @@ func TestMuxerMaxSegmentSize(t *testing.T) {
 		PacketizationMode: 1,
 	}
 
-	m, err := NewMuxer(MuxerVariantMPEGTS, 3, 1*time.Second, 0, 0, videoTrack, nil)
+	m, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		333*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
 	require.NoError(t, err)
 	defer m.Close()
 
-	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
-		testSPS,
-		{5}, // IDR
+	// 30fps, with an IDR every second
+	for i := 0; i <= 90; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	parts := regexp.MustCompile(`(?m)^#EXT-X-PART:DURATION=([0-9.]+),URI="[^"]+"(,INDEPENDENT=YES)?$`).
+		FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 6, len(parts))
+
+	for i, part := range parts {
+		// each part contains 10 frames
+		require.Equal(t, "0.33333", part[1])
+
+		// only the first part of each segment starts with an IDR
+		if (i % 3) == 0 {
+			require.Equal(t, ",INDEPENDENT=YES", part[2])
+		} else {
+			require.Equal(t, "", part[2])
+		}
+	}
+}
+
+// checkCMAFHeader checks that a initialization file is a valid CMAF header.
+func checkCMAFHeader(t *testing.T, byts []byte) {
+	var boxes []string
+	hasCMAFBrand := false
+
+	_, err := gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
+		typ := h.BoxInfo.Type.String()
+		boxes = append(boxes, typ)
+
+		if typ == "ftyp" {
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, b := range box.(*gomp4.Ftyp).CompatibleBrands {
+				if b.CompatibleBrand == [4]byte{'c', 'm', 'f', 'c'} {
+					hasCMAFBrand = true
+				}
+			}
+			return nil, nil
+		}
+
+		return h.Expand()
 	})
-	require.EqualError(t, err, "reached maximum segment size")
+	require.NoError(t, err)
+
+	require.Equal(t, "ftyp", boxes[0])
+	require.True(t, hasCMAFBrand)
+	require.Contains(t, boxes, "mvex")
+	require.NotContains(t, boxes, "moof")
+	require.NotContains(t, boxes, "mdat")
 }
 
-func TestMuxerDoubleRead(t *testing.T) {
+// checkCMAFSegment checks that a segment is a valid CMAF segment
+// and returns the sequence number of its last fragment.
+func checkCMAFSegment(t *testing.T, byts []byte, chunked bool, prevSequenceNumber uint32) uint32 {
+	require.Equal(t, []byte{'s', 't', 'y', 'p'}, byts[4:8])
+	require.Equal(t, []byte{'c', 'm', 'f', 's'}, byts[8:12])
+	stypSize := binary.BigEndian.Uint32(byts)
+
+	var brands []string
+	for i := uint32(16); i < stypSize; i += 4 {
+		brands = append(brands, string(byts[i:i+4]))
+	}
+	require.Contains(t, brands, "cmff")
+	if chunked {
+		require.Contains(t, brands, "cmfl")
+	}
+
+	var topLevel []string
+	trafCount := 0
+
+	_, err := gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
+		typ := h.BoxInfo.Type.String()
+		if len(h.Path) == 1 {
+			topLevel = append(topLevel, typ)
+		}
+
+		switch typ {
+		case "styp", "prft", "mdat":
+			return nil, nil
+
+		case "moof":
+			trafCount = 0
+			_, err := h.Expand()
+			if err != nil {
+				return nil, err
+			}
+
+			// a CMAF chunk contains a single track
+			require.Equal(t, 1, trafCount)
+			return nil, nil
+
+		case "mfhd":
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+
+			seq := box.(*gomp4.Mfhd).SequenceNumber
+			require.Greater(t, seq, prevSequenceNumber)
+			prevSequenceNumber = seq
+			return nil, nil
+
+		case "traf":
+			trafCount++
+
+		case "tfhd":
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+
+			// default-base-is-moof must be set, base-data-offset must not
+			flags := box.(*gomp4.Tfhd).GetFlags()
+			require.NotZero(t, flags&0x020000)
+			require.Zero(t, flags&0x01)
+			return nil, nil
+
+		case "trun":
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+
+			// data-offset must be present
+			require.NotZero(t, box.(*gomp4.Trun).GetFlags()&0x01)
+			return nil, nil
+		}
+
+		return h.Expand()
+	})
+	require.NoError(t, err)
+
+	require.NotContains(t, topLevel, "sidx")
+	require.Equal(t, "styp", topLevel[0])
+
+	// each moof is followed by a mdat
+	chunks := 0
+	for i, typ := range topLevel {
+		if typ == "moof" {
+			require.Less(t, i+1, len(topLevel))
+			require.Equal(t, "mdat", topLevel[i+1])
+			chunks++
+		}
+	}
+
+	if chunked {
+		require.GreaterOrEqual(t, chunks, 1)
+	} else {
+		require.Equal(t, 1, chunks)
+	}
+
+	return prevSequenceNumber
+}
+
+func TestMuxerCMAF(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{
+		"fmp4",
+		"lowLatency",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			v := MuxerVariantFMP4
+			segmentCount := 3
+			if ca == "lowLatency" {
+				v = MuxerVariantLowLatency
+				segmentCount = 7
+			}
+
+			m, err := NewMuxer(
+				v,
+				segmentCount,
+				1*time.Second,
+				333*time.Millisecond,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.EnableCMAF()
+			require.NoError(t, err)
+
+			// 30fps, with an IDR every second
+			for i := 0; i <= 90; i++ {
+				pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+				var nalus [][]byte
+				switch {
+				case i == 0:
+					nalus = [][]byte{testSPS, {8}, {5}}
+				case (i % 30) == 0:
+					nalus = [][]byte{{5}}
+				default:
+					nalus = [][]byte{{1}}
+				}
+
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
+			require.NoError(t, err)
+			checkCMAFHeader(t, byts)
+
+			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			var segments []string
+			for _, ma := range regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1) {
+				if ma[1] != "gap.mp4" {
+					segments = append(segments, ma[1])
+				}
+			}
+			require.Equal(t, 3, len(segments))
+
+			seq := uint32(0)
+			for _, seg := range segments {
+				byts, err := io.ReadAll(m.File(seg, "", "", "", false).Body)
+				require.NoError(t, err)
+				seq = checkCMAFSegment(t, byts, ca == "lowLatency", seq)
+			}
+		})
+	}
+}
+
+func TestMuxerCMAFInvalidParams(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	for _, ca := range []struct {
+		name       string
+		variant    MuxerVariant
+		audioTrack format.Format
+		err        string
+	}{
+		{
+			"mpegts",
+			MuxerVariantMPEGTS,
+			nil,
+			"CMAF requires the fMP4 or Low-Latency variant",
+		},
+		{
+			"video and audio",
+			MuxerVariantFMP4,
+			audioTrack,
+			"CMAF doesn't support streams with both video and audio",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				ca.audioTrack,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.EnableCMAF()
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerCMAFNonIDRCuts(t *testing.T) {
 	videoTrack := &format.H264{
 		PayloadTyp:        96,
 		SPS:               testSPS,
@@ -456,41 +971,3411 @@ func TestMuxerDoubleRead(t *testing.T) {
 		PacketizationMode: 1,
 	}
 
-	m, err := NewMuxer(MuxerVariantMPEGTS, 3, 1*time.Second, 0, 50*1024*1024, videoTrack, nil)
+	m, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		200*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
 	require.NoError(t, err)
 	defer m.Close()
 
-	err = m.WriteH264(testTime, 0, [][]byte{
-		testSPS,
-		{5}, // IDR
-		{1},
-	})
+	err = m.EnableCMAF()
 	require.NoError(t, err)
 
-	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
-		{5}, // IDR
-		{2},
-	})
-	require.NoError(t, err)
+	err = m.SetSegmentMaxDeviation(500 * time.Millisecond)
+	require.EqualError(t, err, "segment max deviation is not compatible with CMAF, "+
+		"that requires segments to start with a keyframe")
+
+	err = m.SetTargetDuration(2 * time.Second)
+	require.EqualError(t, err, "target duration is not compatible with CMAF, "+
+		"that requires segments to start with a keyframe")
 
-	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "").Body)
+	err = m.SetStallTimeout(300 * time.Millisecond)
+	require.EqualError(t, err, "stall timeout is not compatible with CMAF, "+
+		"that requires segments to start with a keyframe")
+
+	// disabled features are accepted
+	err = m.SetSegmentMaxDeviation(0)
 	require.NoError(t, err)
 
-	re := regexp.MustCompile(`^#EXTM3U\n` +
-		`#EXT-X-VERSION:3\n` +
-		`#EXT-X-ALLOW-CACHE:NO\n` +
-		`#EXT-X-TARGETDURATION:2\n` +
-		`#EXT-X-MEDIA-SEQUENCE:0\n` +
-		`#EXT-X-PROGRAM-DATE-TIME:(.*?)\n` +
-		`#EXTINF:2,\n` +
-		`(seg0\.ts)\n$`)
-	ma := re.FindStringSubmatch(string(byts))
-	require.NotEqual(t, 0, len(ma))
+	err = m.SetStallTimeout(0)
+	require.NoError(t, err)
 
-	byts1, err := io.ReadAll(m.File(ma[2], "", "", "").Body)
+	// CMAF can't be enabled after cuts at non-IDR frames
+	m2, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		200*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
 	require.NoError(t, err)
+	defer m2.Close()
 
-	byts2, err := io.ReadAll(m.File(ma[2], "", "", "").Body)
+	err = m2.SetStallTimeout(300 * time.Millisecond)
 	require.NoError(t, err)
-	require.Equal(t, byts1, byts2)
+
+	err = m2.EnableCMAF()
+	require.EqualError(t, err, "CMAF requires segments to start with a keyframe, therefore it can't be used "+
+		"with a segment max deviation, a target duration or a stall timeout")
+}
+
+func TestMuxerWriteH264WithIDRPresent(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			v := MuxerVariantMPEGTS
+			if ca == "fmp4" {
+				v = MuxerVariantFMP4
+			}
+
+			var playlists []string
+
+			for _, known := range []bool{false, true} {
+				m, err := NewMuxer(
+					v,
+					3,
+					1*time.Second,
+					0,
+					50*1024*1024,
+					videoTrack,
+					nil,
+				)
+				require.NoError(t, err)
+				defer m.Close()
+
+				for i := 0; i <= 90; i++ {
+					pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+					var nalus [][]byte
+					switch {
+					case i == 0:
+						nalus = [][]byte{testSPS, {8}, {5}}
+					case (i % 30) == 0:
+						nalus = [][]byte{{5}}
+					case i == 10:
+						// parameters without slices
+						nalus = [][]byte{testSPS, {8}}
+					default:
+						nalus = [][]byte{{1}}
+					}
+
+					if known {
+						err = m.WriteH264WithIDRPresent(testTime.Add(pts), pts, nalus, (i%30) == 0)
+					} else {
+						err = m.WriteH264(testTime.Add(pts), pts, nalus)
+					}
+					require.NoError(t, err)
+				}
+
+				byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+				require.NoError(t, err)
+				playlists = append(playlists, string(byts))
+			}
+
+			// asserting the presence of IDRs produces the same segments
+			require.Equal(t, playlists[0], playlists[1])
+		})
+	}
+}
+
+func TestMuxerFMP4SampleFlags(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	// 30fps, with an IDR every half second
+	for i := 0; i <= 60; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 15) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	segments := regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 2, len(segments))
+
+	var sampleFlags []uint32
+
+	for _, seg := range segments {
+		byts, err := io.ReadAll(m.File(seg[1], "", "", "", false).Body)
+		require.NoError(t, err)
+
+		_, err = gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
+			if h.BoxInfo.Type.String() == "trun" {
+				box, _, err := h.ReadPayload()
+				if err != nil {
+					return nil, err
+				}
+
+				trun := box.(*gomp4.Trun)
+				require.NotZero(t, trun.GetFlags()&0x400) // sample-flags-present
+
+				for _, e := range trun.Entries {
+					sampleFlags = append(sampleFlags, e.SampleFlags)
+				}
+				return nil, nil
+			}
+
+			return h.Expand()
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 60, len(sampleFlags))
+
+	for i, flags := range sampleFlags {
+		if (i % 15) == 0 {
+			// sync sample that doesn't depend on others
+			require.Equal(t, uint32(0x02000000), flags)
+		} else {
+			// non-sync sample that depends on others
+			require.Equal(t, uint32(0x01010000), flags)
+		}
+	}
+}
+
+func TestMuxerWriteH264WithDTS(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	frameDuration := 33333334 * time.Nanosecond
+
+	// 30fps, with an IDR every second and two B-frames after each reference frame,
+	// in decoding order: I B B P B B P ...
+	for i := 0; i <= 60; i++ {
+		dts := time.Duration(i) * frameDuration
+
+		var cts time.Duration
+		if (i % 3) == 0 {
+			cts = 3 * frameDuration
+		}
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264WithDTS(testTime.Add(dts), dts, dts+cts, nalus, (i%30) == 0)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	segments := regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 2, len(segments))
+
+	var offsets []int32
+
+	for _, seg := range segments {
+		byts, err := io.ReadAll(m.File(seg[1], "", "", "", false).Body)
+		require.NoError(t, err)
+
+		_, err = gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
+			if h.BoxInfo.Type.String() == "trun" {
+				box, _, err := h.ReadPayload()
+				if err != nil {
+					return nil, err
+				}
+
+				trun := box.(*gomp4.Trun)
+				require.Equal(t, uint8(1), trun.GetVersion()) // signed offsets
+				require.NotZero(t, trun.GetFlags()&0x800)     // sample-composition-time-offsets-present
+
+				for _, e := range trun.Entries {
+					offsets = append(offsets, e.SampleCompositionTimeOffsetV1)
+				}
+				return nil, nil
+			}
+
+			return h.Expand()
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 60, len(offsets))
+
+	for i, offset := range offsets {
+		if (i % 3) == 0 {
+			require.Equal(t, int32(9000), offset)
+		} else {
+			require.Equal(t, int32(0), offset)
+		}
+	}
+}
+
+func TestMuxerWriteH264WithDTSInvalid(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteH264WithDTS(testTime, 2*time.Second, 1*time.Second, [][]byte{testSPS, {8}, {5}}, true)
+	require.EqualError(t, err, "PTS (1s) is lower than DTS (2s)")
+}
+
+func TestMuxerSegmentMaxDeviation(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		7,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.SetSegmentMaxDeviation(500 * time.Millisecond)
+	require.NoError(t, err)
+
+	// 30fps, with an IDR every 3 seconds
+	for i := 0; i <= 180; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 90) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(byts), "#EXT-X-INDEPENDENT-SEGMENTS")
+
+	byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	// segments are cut at target + deviation, or at the next IDR
+	durations := regexp.MustCompile(`(?m)^#EXTINF:([0-9.]+),$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 4, len(durations))
+	for _, du := range durations {
+		require.Equal(t, "1.50000", du[1])
+	}
+
+	segments := regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 4, len(segments))
+
+	for i, seg := range segments {
+		byts, err := io.ReadAll(m.File(seg[1], "", "", "", false).Body)
+		require.NoError(t, err)
+
+		var parts fmp4.Parts
+		err = parts.Unmarshal(byts)
+		require.NoError(t, err)
+
+		first := parts[0].Tracks[0].Samples[0]
+
+		// segments cut at a non-IDR frame start with parameters
+		if (i % 2) == 1 {
+			require.Equal(t, true, first.IsNonSyncSample)
+			require.Equal(t, byte(h264.NALUTypeSPS), first.Payload[4]&0x1F)
+		} else {
+			require.Equal(t, false, first.IsNonSyncSample)
+		}
+	}
+}
+
+func TestMuxerTargetDuration(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			v := MuxerVariantMPEGTS
+			if ca == "fmp4" {
+				v = MuxerVariantFMP4
+			}
+
+			m, err := NewMuxer(
+				v,
+				7,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.SetTargetDuration(2 * time.Second)
+			require.NoError(t, err)
+
+			// 30fps, with an IDR every 5 seconds
+			for i := 0; i <= 300; i++ {
+				pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+				var nalus [][]byte
+				switch {
+				case i == 0:
+					nalus = [][]byte{testSPS, {8}, {5}}
+				case (i % 150) == 0:
+					nalus = [][]byte{{5}}
+				default:
+					nalus = [][]byte{{1}}
+				}
+
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+			require.NotContains(t, string(byts), "#EXT-X-INDEPENDENT-SEGMENTS")
+
+			byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+			require.Contains(t, string(byts), "#EXT-X-TARGETDURATION:2\n")
+
+			// segments never exceed the target duration, even without IDRs
+			durations := regexp.MustCompile(`(?m)^#EXTINF:([0-9.]+),$`).FindAllStringSubmatch(string(byts), -1)
+			require.GreaterOrEqual(t, len(durations), 4)
+			for _, du := range durations {
+				d, err := strconv.ParseFloat(du[1], 64)
+				require.NoError(t, err)
+				require.LessOrEqual(t, d, 2.0)
+			}
+		})
+	}
+}
+
+func TestMuxerTargetDurationInvalid(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name           string
+		targetDuration time.Duration
+		err            string
+	}{
+		{
+			"not integer",
+			1500 * time.Millisecond,
+			"target duration must be an integer number of seconds",
+		},
+		{
+			"less than segment duration",
+			1 * time.Second,
+			"target duration can't be less than segment duration",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				MuxerVariantMPEGTS,
+				3,
+				2*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.SetTargetDuration(ca.targetDuration)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerDurationsInvalidVariant(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	newMuxer := func(v MuxerVariant) *Muxer {
+		m, err := NewMuxer(
+			v,
+			7,
+			1*time.Second,
+			200*time.Millisecond,
+			50*1024*1024,
+			videoTrack,
+			nil,
+		)
+		require.NoError(t, err)
+		return m
+	}
+
+	m := newMuxer(MuxerVariantMPEGTS)
+	defer m.Close()
+
+	err := m.SetSegmentMaxDeviation(500 * time.Millisecond)
+	require.EqualError(t, err, "segment max deviation requires the fMP4 or Low-Latency variant")
+
+	err = m.SetFragmentDuration(100 * time.Millisecond)
+	require.EqualError(t, err, "fragments require the fMP4 or Low-Latency variant")
+
+	m = newMuxer(MuxerVariantFMP4)
+	defer m.Close()
+
+	err = m.SetStallTimeout(300 * time.Millisecond)
+	require.EqualError(t, err, "stall detection requires the Low-Latency variant")
+
+	err = m.SetFragmentDuration(-1)
+	require.EqualError(t, err, "fragment duration can't be negative")
+}
+
+func TestMuxerLowLatencyStall(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		200*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.SetStallTimeout(300 * time.Millisecond)
+	require.NoError(t, err)
+
+	writeFrames := func(from int, to int) {
+		// 30fps, with an IDR every second
+		for i := from; i <= to; i++ {
+			pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+			var nalus [][]byte
+			switch {
+			case i == 0:
+				nalus = [][]byte{testSPS, {8}, {5}}
+			case (i % 30) == 0:
+				nalus = [][]byte{{5}}
+			default:
+				nalus = [][]byte{{1}}
+			}
+
+			err := m.WriteH264(testTime.Add(pts), pts, nalus)
+			require.NoError(t, err)
+		}
+	}
+
+	// returns names and durations of segments, excluding gaps
+	readSegments := func() ([]string, []string) {
+		byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+		require.NoError(t, err)
+
+		var names []string
+		var durations []string
+		for _, seg := range regexp.MustCompile(`(?m)^#EXTINF:([0-9.]+),\n([^#\n]+\.mp4)$`).
+			FindAllStringSubmatch(string(byts), -1) {
+			if seg[2] != "gap.mp4" {
+				names = append(names, seg[2])
+				durations = append(durations, seg[1])
+			}
+		}
+		return names, durations
+	}
+
+	writeFrames(0, 45)
+	_, durations := readSegments()
+	require.Equal(t, []string{"1.00000"}, durations)
+
+	// the source is idle: frames that were already received are flushed
+	time.Sleep(600 * time.Millisecond)
+	_, durations = readSegments()
+	require.Equal(t, []string{"1.00000", "0.53333"}, durations)
+
+	byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(byts), "#EXT-X-INDEPENDENT-SEGMENTS")
+
+	// the next segment starts with a non-IDR frame and lasts until the second IDR
+	writeFrames(46, 90)
+	names, durations := readSegments()
+	require.Equal(t, []string{"1.00000", "0.53333", "1.46667"}, durations)
+
+	byts, err = io.ReadAll(m.File(names[2], "", "", "", false).Body)
+	require.NoError(t, err)
+
+	var parts fmp4.Parts
+	err = parts.Unmarshal(byts)
+	require.NoError(t, err)
+
+	first := parts[0].Tracks[0].Samples[0]
+	require.Equal(t, true, first.IsNonSyncSample)
+	require.Equal(t, byte(h264.NALUTypeSPS), first.Payload[4]&0x1F)
+}
+
+func TestMuxerSubtitles(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name           string
+		variant        MuxerVariant
+		mediaTimestamp string
+	}{
+		{
+			"mpegts",
+			MuxerVariantMPEGTS,
+			"36000",
+		},
+		{
+			"fmp4",
+			MuxerVariantFMP4,
+			"0",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			m.EnableSubtitles("English", "en")
+
+			err = m.WriteSubtitle(testTime, 500*time.Millisecond, 1*time.Second, "hello")
+			require.NoError(t, err)
+
+			err = m.WriteSubtitle(testTime, 1600*time.Millisecond, 200*time.Millisecond, "multiple\r\nlines")
+			require.NoError(t, err)
+
+			err = m.WriteSubtitle(testTime, 1*time.Second, 1*time.Second, "invalid --> text")
+			require.EqualError(t, err, "cue text can't contain '-->'")
+
+			// 30fps, with an IDR every second
+			for i := 0; i <= 90; i++ {
+				pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+				var nalus [][]byte
+				switch {
+				case i == 0:
+					nalus = [][]byte{testSPS, {8}, {5}}
+				case (i % 30) == 0:
+					nalus = [][]byte{{5}}
+				default:
+					nalus = [][]byte{{1}}
+				}
+
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+			require.Contains(t, string(byts), "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"English\","+
+				"LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES,URI=\"subtitles.m3u8\"\n")
+			require.Contains(t, string(byts), "#EXT-X-STREAM-INF:"+testBandwidth(t, m)+
+				",CODECS=\"avc1.42c028\",SUBTITLES=\"subs\"\n")
+
+			byts, err = io.ReadAll(m.File("subtitles.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			// WebVTT segments are aligned with media segments
+			segments := regexp.MustCompile(`(?m)^#EXTINF:1.00000,\n([^#\n]+\.vtt)$`).FindAllStringSubmatch(string(byts), -1)
+			require.Equal(t, 3, len(segments))
+
+			res := m.File(segments[0][1], "", "", "", false)
+			require.Equal(t, "text/vtt", res.Header["Content-Type"])
+			byts, err = io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, "WEBVTT\n"+
+				"X-TIMESTAMP-MAP=MPEGTS:"+ca.mediaTimestamp+",LOCAL:00:00:00.000\n"+
+				"\n"+
+				"00:00:00.500 --> 00:00:01.500\n"+
+				"hello\n", string(byts))
+
+			// cues are repeated in all segments that overlap with them
+			byts, err = io.ReadAll(m.File(segments[1][1], "", "", "", false).Body)
+			require.NoError(t, err)
+			require.Contains(t, string(byts), "\nhello\n")
+			require.Contains(t, string(byts), "\nmultiple\nlines\n")
+
+			byts, err = io.ReadAll(m.File(segments[2][1], "", "", "", false).Body)
+			require.NoError(t, err)
+			require.NotContains(t, string(byts), "-->")
+		})
+	}
+}
+
+type testMuxerLogger struct {
+	lines []string
+}
+
+func (l *testMuxerLogger) Log(level logger.Level, format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestMuxerPendingAudioLimit(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		audioTrack,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	l := &testMuxerLogger{}
+	m.SetLogger(l)
+
+	err = m.WriteH264(testTime, 0, [][]byte{testSPS, {8}, {5}})
+	require.NoError(t, err)
+
+	// the video track stops, while the audio track goes on for 30 seconds
+	for i := 0; i < 30*44100/mpeg4audio.SamplesPerAccessUnit; i++ {
+		pts := time.Duration(i) * mpeg4audio.SamplesPerAccessUnit * time.Second / 44100
+
+		err = m.WriteAAC(testTime.Add(pts), pts, []byte{0x01, 0x02, 0x03, 0x04})
+		require.NoError(t, err)
+	}
+
+	pending := m.variant.(*muxerVariantFMP4).segmenter.pendingAudioSamples
+	require.LessOrEqual(t, pending[len(pending)-1].dts-pending[0].dts, fmp4MaxPendingAudioDuration)
+
+	require.Equal(t, []string{
+		"video track is late by more than 10s, discarding audio samples",
+	}, l.lines)
+}
+
+func TestMuxerLogger(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		7,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.SetSegmentMaxDeviation(500 * time.Millisecond)
+	require.NoError(t, err)
+
+	l := &testMuxerLogger{}
+	m.SetLogger(l)
+
+	// 30fps, with an IDR every 3 seconds
+	for i := 0; i <= 90; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case (i % 90) == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case i == 10:
+			// parameters without slices
+			nalus = [][]byte{testSPS, {8}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "skipping group of NALUs without slices", l.lines[0])
+	require.Equal(t, 2, len(l.lines))
+	require.Regexp(t, `^no IDR received in .+, cutting segment at a non-IDR frame$`, l.lines[1])
+}
+
+func TestMuxerAVSync(t *testing.T) {
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	frameDuration := 1024 * time.Second / 44100
+
+	for _, correct := range []bool{false, true} {
+		t.Run(strconv.FormatBool(correct), func(t *testing.T) {
+			l := &testMuxerLogger{}
+			s := newMuxerAVSync(100*time.Millisecond, correct, audioTrack, l.Log)
+
+			dropped := 0
+			duplicated := 0
+			var lastPTS *time.Duration
+			audioFrame := 0
+
+			// 30fps video, audio whose clock is 1% faster, a segment every second
+			for i := 0; i <= 30*60; i++ {
+				pts := time.Duration(i) * 33333334 * time.Nanosecond
+				s.processVideo(testTime.Add(pts), pts)
+
+				if i != 0 && (i%30) == 0 {
+					s.onSegmentFinalized()
+				}
+
+				for {
+					apts := time.Duration(audioFrame) * frameDuration
+					antp := testTime.Add(apts * 100 / 101)
+					if antp.After(testTime.Add(pts)) {
+						break
+					}
+					audioFrame++
+
+					ptss := s.processAudio(antp, apts)
+					switch len(ptss) {
+					case 0:
+						dropped++
+
+					case 2:
+						duplicated++
+					}
+
+					for _, cpts := range ptss {
+						if lastPTS != nil {
+							require.Equal(t, *lastPTS+frameDuration, cpts)
+						}
+						v := cpts
+						lastPTS = &v
+					}
+				}
+			}
+
+			require.Equal(t, 0, duplicated)
+			require.Regexp(t, `^audio and video are out of sync by .+$`, l.lines[0])
+
+			if !correct {
+				require.Equal(t, 0, dropped)
+				require.Equal(t, 1, len(l.lines))
+			} else {
+				require.NotZero(t, dropped)
+				drift := s.drift()
+				require.LessOrEqual(t, drift, 100*time.Millisecond+frameDuration)
+			}
+		})
+	}
+}
+
+func TestMuxerPrimaryPlaylistHEAAC(t *testing.T) {
+	for _, ca := range []struct {
+		name          string
+		extensionType mpeg4audio.ObjectType
+		codec         string
+	}{
+		{
+			"aac-lc",
+			0,
+			"mp4a.40.2",
+		},
+		{
+			"sbr",
+			mpeg4audio.ObjectTypeSBR,
+			"mp4a.40.5",
+		},
+		{
+			"ps",
+			mpeg4audio.ObjectTypePS,
+			"mp4a.40.29",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			audioTrack := &format.MPEG4Audio{
+				PayloadTyp: 97,
+				Config: &mpeg4audio.Config{
+					Type:                mpeg4audio.ObjectTypeAACLC,
+					SampleRate:          24000,
+					ChannelCount:        1,
+					ExtensionType:       ca.extensionType,
+					ExtensionSampleRate: 48000,
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			}
+
+			p := newMuxerPrimaryPlaylist(true, true, nil, audioTrack, func() (int, int) {
+				return 0, 0
+			})
+
+			byts, err := io.ReadAll(p.file().Body)
+			require.NoError(t, err)
+			require.Contains(t, string(byts), "CODECS=\""+ca.codec+"\"")
+		})
+	}
+}
+
+func TestMuxerPrimaryPlaylistH264Profiles(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		sps   []byte
+		codec string
+	}{
+		{
+			"baseline",
+			append([]byte{0x67, 0x42, 0x00, 0x28}, testSPS[4:]...),
+			"avc1.420028",
+		},
+		{
+			"constrained baseline",
+			append([]byte{0x67, 0x42, 0xe0, 0x28}, testSPS[4:]...),
+			"avc1.42e028",
+		},
+		{
+			"main",
+			append([]byte{0x67, 0x4d, 0x40, 0x28}, testSPS[4:]...),
+			"avc1.4d4028",
+		},
+		{
+			"high",
+			[]byte{
+				0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+				0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+				0x00, 0x03, 0x00, 0x3d, 0x08,
+			},
+			"avc1.64000c",
+		},
+		{
+			"reserved bits",
+			append([]byte{0x67, 0x42, 0xc3, 0x28}, testSPS[4:]...),
+			"avc1.42c028",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			videoTrack := &format.H264{
+				PayloadTyp:        96,
+				SPS:               ca.sps,
+				PPS:               []byte{0x08},
+				PacketizationMode: 1,
+			}
+
+			p := newMuxerPrimaryPlaylist(true, true, videoTrack, nil, func() (int, int) {
+				return 0, 0
+			})
+
+			byts, err := io.ReadAll(p.file().Body)
+			require.NoError(t, err)
+			require.Contains(t, string(byts), "CODECS=\""+ca.codec+"\"")
+		})
+	}
+}
+
+func TestMasterPlaylist(t *testing.T) {
+	videoTrack1 := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	videoTrack2 := &format.H264{
+		PayloadTyp: 96,
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m1 := &Muxer{
+		primaryPlaylist: newMuxerPrimaryPlaylist(true, true, videoTrack1, audioTrack, func() (int, int) {
+			return 4000000, 3000000
+		}),
+	}
+
+	m2 := &Muxer{
+		primaryPlaylist: newMuxerPrimaryPlaylist(false, true, videoTrack2, nil, func() (int, int) {
+			return 0, 0
+		}),
+	}
+
+	p, err := NewMasterPlaylist([]MasterPlaylistVariant{
+		{Muxer: m1, URI: "1080p/stream.m3u8"},
+		{Muxer: m2, URI: "288p/stream.m3u8"},
+	})
+	require.NoError(t, err)
+
+	res := p.File()
+	require.Equal(t, http.StatusOK, res.Status)
+
+	byts, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "#EXTM3U\n"+
+		"#EXT-X-VERSION:9\n"+
+		"#EXT-X-INDEPENDENT-SEGMENTS\n"+
+		"\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=4000000,AVERAGE-BANDWIDTH=3000000,"+
+		"CODECS=\"avc1.42c028,mp4a.40.2\",RESOLUTION=1920x1080\n"+
+		"1080p/stream.m3u8\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=200000,CODECS=\"avc1.64000c\",RESOLUTION=352x288\n"+
+		"288p/stream.m3u8\n", string(byts))
+}
+
+func TestMasterPlaylistSubtitles(t *testing.T) {
+	m1 := &Muxer{
+		primaryPlaylist: newMuxerPrimaryPlaylist(true, true, nil, nil, func() (int, int) {
+			return 0, 0
+		}),
+	}
+	m1.primaryPlaylist.subtitles = newMuxerSubtitles("English", "en", 3)
+
+	m2 := &Muxer{
+		primaryPlaylist: newMuxerPrimaryPlaylist(true, true, nil, nil, func() (int, int) {
+			return 0, 0
+		}),
+	}
+
+	p, err := NewMasterPlaylist([]MasterPlaylistVariant{
+		{Muxer: m1, URI: "high/stream.m3u8"},
+		{Muxer: m2, URI: "stream.m3u8"},
+	})
+	require.NoError(t, err)
+
+	byts, err := io.ReadAll(p.File().Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs0\",NAME=\"English\","+
+		"LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES,URI=\"high/subtitles.m3u8\"\n")
+	require.Contains(t, string(byts), ",SUBTITLES=\"subs0\"\nhigh/stream.m3u8\n")
+	require.NotContains(t, string(byts), "subs1")
+}
+
+func TestMasterPlaylistInvalidVariants(t *testing.T) {
+	m := &Muxer{
+		primaryPlaylist: newMuxerPrimaryPlaylist(true, true, nil, nil, func() (int, int) {
+			return 0, 0
+		}),
+	}
+
+	for _, ca := range []struct {
+		name     string
+		variants []MasterPlaylistVariant
+		err      string
+	}{
+		{
+			"no variants",
+			nil,
+			"at least one variant must be provided",
+		},
+		{
+			"nil muxer",
+			[]MasterPlaylistVariant{{URI: "stream.m3u8"}},
+			"muxer of variant 0 is nil",
+		},
+		{
+			"empty uri",
+			[]MasterPlaylistVariant{{Muxer: m, URI: "a/stream.m3u8"}, {Muxer: m}},
+			"URI of variant 1 is empty",
+		},
+		{
+			"invalid uri",
+			[]MasterPlaylistVariant{{Muxer: m, URI: "a/stream.m3u8\"\n#EXT-X-ENDLIST"}},
+			"URI of variant 0 contains invalid characters",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := NewMasterPlaylist(ca.variants)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerAC3(t *testing.T) {
+	audioTrack := ac3.NewFormat(97, &ac3.Config{
+		SampleRate:   48000,
+		ChannelCount: 6,
+		BlockCount:   6,
+		Bsid:         8,
+		Acmod:        7,
+		LFEOn:        true,
+		BitRateCode:  10,
+		FrameSize:    768,
+	})
+
+	p := newMuxerPrimaryPlaylist(true, true, nil, audioTrack, func() (int, int) {
+		return 0, 0
+	})
+
+	byts, err := io.ReadAll(p.file().Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "CODECS=\"ac-3\"")
+
+	ini := fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        1,
+			TimeScale: 48000,
+			Format:    audioTrack,
+		}},
+	}
+
+	byts, err = ini.Marshal()
+	require.NoError(t, err)
+	require.Contains(t, string(byts), string([]byte{0x00, 0x00, 0x00, 0x0b, 'd', 'a', 'c', '3', 0x10, 0x3d, 0x40}))
+}
+
+func TestMuxerLPCM(t *testing.T) {
+	audioTrack := &format.LPCM{
+		PayloadTyp:   96,
+		BitDepth:     24,
+		SampleRate:   48000,
+		ChannelCount: 2,
+	}
+
+	_, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		nil,
+		audioTrack,
+	)
+	require.EqualError(t, err, "LPCM requires the fMP4 or Low-Latency variant")
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		nil,
+		audioTrack,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	// 20ms of samples
+	frame := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6}, 960)
+
+	for i := 0; i < 150; i++ {
+		pts := time.Duration(i) * 20 * time.Millisecond
+		err = m.WriteLPCM(testTime.Add(pts), pts, frame)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "CODECS=\"ipcm\"")
+
+	byts, err = io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), string([]byte{
+		0x00, 0x00, 0x00, 0x0e, 'p', 'c', 'm', 'C',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x18,
+	}))
+
+	byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "seg0.mp4")
+
+	byts, err = io.ReadAll(m.File("seg0.mp4", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), string(frame))
+}
+
+func TestMuxerMJPEG(t *testing.T) {
+	videoTrack := &format.MJPEG{}
+
+	_, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.EqualError(t, err, "M-JPEG requires the fMP4 or Low-Latency variant")
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteMJPEG(testTime, 0, []byte{0xFF, 0xD8, 0xFF, 0xD9})
+	require.EqualError(t, err, "start of frame not found")
+
+	frame := []byte{
+		0xFF, 0xD8, // start of image
+		0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00, // application data
+		0xFF, 0xC0, 0x00, 0x11, 0x08, // start of frame, 8 bits
+		0x00, 0xF0, // height
+		0x01, 0x40, // width
+		0x03, 0x00, 0x22, 0x00, 0x01, 0x11, 0x01, 0x02, 0x11, 0x01,
+		0xFF, 0xDA, 0x00, 0x02, // start of scan
+		0x01, 0x02, 0x03,
+		0xFF, 0xD9, // end of image
+	}
+
+	// 5fps
+	for i := 0; i <= 15; i++ {
+		pts := time.Duration(i) * 200 * time.Millisecond
+		err = m.WriteMJPEG(testTime.Add(pts), pts, frame)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("index.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "CODECS=\"mp4v.6c\"")
+
+	byts, err = io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "mp4v")
+
+	var tkhd *gomp4.Tkhd
+	_, err = gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
+		switch h.BoxInfo.Type.String() {
+		case "moov", "trak":
+			return h.Expand()
+
+		case "tkhd":
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+			tkhd = box.(*gomp4.Tkhd)
+		}
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(320*65536), tkhd.Width)
+	require.Equal(t, uint32(240*65536), tkhd.Height)
+
+	byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	// frames are sync samples, therefore segments are cut every segment duration
+	segments := regexp.MustCompile(`(?m)^#EXTINF:([0-9.]+),\n[^#\n]+\.mp4$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 3, len(segments))
+	for _, seg := range segments {
+		require.Equal(t, "1.00000", seg[1])
+	}
+}
+
+func TestMuxerCloseBeforeFirstSegmentReader(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+
+	// group with IDR
+	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
+		testSPS, // SPS
+		{8},     // PPS
+		{5},     // IDR
+	})
+	require.NoError(t, err)
+
+	m.Close()
+
+	b := m.File("stream.m3u8", "", "", "", false).Body
+	require.Equal(t, nil, b)
+}
+
+func TestMuxerMaxSegmentSize(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		0,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
+		testSPS,
+		{5}, // IDR
+	})
+	require.EqualError(t, err, "reached maximum segment size")
+}
+
+func TestMuxerMaxSegmentSizeWithoutIDR(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			v := MuxerVariantMPEGTS
+			if ca == "fmp4" {
+				v = MuxerVariantFMP4
+			}
+
+			m, err := NewMuxer(
+				v,
+				7,
+				1*time.Second,
+				0,
+				10*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			// 30fps, with an IDR every 2 seconds
+			for i := 0; i <= 300; i++ {
+				pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+				var nalus [][]byte
+				if (i % 60) == 0 {
+					nalus = [][]byte{testSPS, {8}, {5}}
+				} else {
+					nalus = [][]byte{append([]byte{1}, bytes.Repeat([]byte{0}, 1023)...)}
+				}
+
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			// segments are finalized when they reach the maximum size,
+			// and the following ones start at the next IDR.
+			segments := regexp.MustCompile(`(?m)^#EXTINF:([0-9.]+),\n([^#\n]+\.(ts|mp4))$`).
+				FindAllStringSubmatch(string(byts), -1)
+			require.Equal(t, 5, len(segments))
+
+			for _, seg := range segments {
+				d, err := strconv.ParseFloat(seg[1], 64)
+				require.NoError(t, err)
+				require.Less(t, d, 1.0)
+			}
+
+			for _, seg := range segments {
+				byts, err := io.ReadAll(m.File(seg[2], "", "", "", false).Body)
+				require.NoError(t, err)
+				require.Less(t, len(byts), 2*10*1024)
+			}
+		})
+	}
+}
+
+func TestMuxerFragmentDuration(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.EnableCMAF()
+	require.NoError(t, err)
+
+	err = m.SetFragmentDuration(200 * time.Millisecond)
+	require.NoError(t, err)
+
+	// 30fps, with an IDR every second
+	for i := 0; i <= 90; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	segments := regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 3, len(segments))
+
+	seq := uint32(0)
+	for _, seg := range segments {
+		byts, err := io.ReadAll(m.File(seg[1], "", "", "", false).Body)
+		require.NoError(t, err)
+
+		// sequence numbers increase between fragments
+		seq = checkCMAFSegment(t, byts, true, seq)
+
+		fragments := 0
+		_, err = gomp4.ReadBoxStructure(bytes.NewReader(byts), func(h *gomp4.ReadHandle) (interface{}, error) {
+			if h.BoxInfo.Type.String() == "moof" {
+				fragments++
+			}
+			return nil, nil
+		})
+		require.NoError(t, err)
+
+		// each segment lasts 1 second and is split into fragments of 200ms
+		require.Equal(t, 5, fragments)
+	}
+}
+
+func TestMuxerFragmentInterleaving(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	audioTrack := &format.MPEG4Audio{
+		PayloadTyp: 97,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		audioTrack,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.SetFragmentDuration(200 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = m.EnableFragmentInterleaving()
+	require.NoError(t, err)
+
+	audioCount := 0
+
+	// 30fps, with an IDR every second, and audio written in decode-time order
+	for i := 0; i <= 90; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		for {
+			audioPTS := time.Duration(audioCount) * mpeg4audio.SamplesPerAccessUnit * time.Second / 44100
+			if audioPTS >= pts {
+				break
+			}
+
+			err = m.WriteAAC(testTime.Add(audioPTS), audioPTS, []byte{0x01, 0x02, 0x03, 0x04})
+			require.NoError(t, err)
+			audioCount++
+		}
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	segments := regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1)
+	require.Equal(t, 3, len(segments))
+
+	for _, seg := range segments {
+		byts, err := io.ReadAll(m.File(seg[1], "", "", "", false).Body)
+		require.NoError(t, err)
+
+		var parts fmp4.Parts
+		err = parts.Unmarshal(byts)
+		require.NoError(t, err)
+
+		videoFragments := 0
+		audioFragments := 0
+		var prevTime time.Duration
+
+		for _, part := range parts {
+			// each fragment contains a single track
+			require.Equal(t, 1, len(part.Tracks))
+
+			var ti time.Duration
+			if part.Tracks[0].ID == 1 {
+				videoFragments++
+				ti = durationMp4ToGo(part.Tracks[0].BaseTime, 90000)
+			} else {
+				audioFragments++
+				ti = durationMp4ToGo(part.Tracks[0].BaseTime, 44100)
+			}
+
+			// fragments are sorted by decode time
+			require.GreaterOrEqual(t, ti, prevTime)
+			prevTime = ti
+		}
+
+		// fragments are cut on video samples every 200ms,
+		// audio samples that follow the last cut are written into an additional fragment.
+		require.Equal(t, 5, videoFragments)
+		require.GreaterOrEqual(t, audioFragments, 5)
+	}
+}
+
+func TestMuxerFragmentInterleavingInvalidVariant(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.EnableFragmentInterleaving()
+	require.EqualError(t, err, "fragment interleaving requires the fMP4 or Low-Latency variant")
+}
+
+func TestMuxerInitPerDiscontinuity(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.EnableInitPerDiscontinuity()
+	require.NoError(t, err)
+
+	// same SPS with a different level
+	sps2 := append([]byte{0x67, 0x42, 0xc0, 0x29}, testSPS[4:]...)
+
+	// 30fps, with an IDR every second and a change of parameters after 2 seconds
+	for i := 0; i <= 120; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case i == 60:
+			videoTrack.SafeSetSPS(sps2)
+			nalus = [][]byte{sps2, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	require.Contains(t, string(byts), "#EXT-X-MEDIA-SEQUENCE:1\n"+
+		"#EXT-X-MAP:URI=\"init0.mp4\"\n")
+	require.Contains(t, string(byts), "seg1.mp4\n"+
+		"#EXT-X-DISCONTINUITY\n"+
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n")
+	require.NotContains(t, string(byts), "#EXT-X-DISCONTINUITY-SEQUENCE")
+
+	res := m.File("init0.mp4", "", "", "", false)
+	require.Equal(t, http.StatusOK, res.Status)
+	init0, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	res = m.File("init1.mp4", "", "", "", false)
+	require.Equal(t, http.StatusOK, res.Status)
+	init1, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	require.NotEqual(t, init0, init1)
+
+	var init fmp4.Init
+	err = init.Unmarshal(init1)
+	require.NoError(t, err)
+	require.Equal(t, sps2, init.Tracks[0].Format.(*format.H264).SPS)
+}
+
+func TestMuxerInitPerDiscontinuityPPSChange(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		5,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.EnableInitPerDiscontinuity()
+	require.NoError(t, err)
+
+	pps2 := []byte{0x08, 0x01}
+
+	// 30fps, with an IDR every 2 seconds and a change of the PPS after half a second
+	for i := 0; i <= 120; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case i == 15:
+			videoTrack.SafeSetPPS(pps2)
+			nalus = [][]byte{testSPS, pps2, {5}}
+		case (i % 60) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	// a segment is cut at the change of parameters, even if it's shorter than the segment duration
+	require.Contains(t, string(byts), "seg0.mp4\n"+
+		"#EXT-X-DISCONTINUITY\n"+
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n")
+
+	res := m.File("init1.mp4", "", "", "", false)
+	require.Equal(t, http.StatusOK, res.Status)
+	init1, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	var init fmp4.Init
+	err = init.Unmarshal(init1)
+	require.NoError(t, err)
+	require.Equal(t, pps2, init.Tracks[0].Format.(*format.H264).PPS)
+}
+
+func TestMuxerInitPerDiscontinuityInvalidVariant(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.EnableInitPerDiscontinuity()
+	require.EqualError(t, err,
+		"an initialization segment per discontinuity requires the fMP4 or Low-Latency variant")
+}
+
+func TestMuxerReconfigure(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		200*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.SetTargetDuration(2 * time.Second)
+	require.NoError(t, err)
+
+	// 30fps, with an IDR every second and a reconfiguration in the middle of the second segment
+	for i := 0; i <= 150; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+
+		if i == 45 {
+			err = m.Reconfigure(200*time.Millisecond, 2*time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	// the segment that was being written keeps the previous duration
+	require.Contains(t, string(byts), "#EXTINF:1.00000,\n"+
+		"seg8.mp4\n")
+	require.Contains(t, string(byts), "#EXTINF:2.00000,\n"+
+		"seg9.mp4\n")
+
+	// advertised durations are left untouched
+	require.Contains(t, string(byts), "#EXT-X-TARGETDURATION:2\n")
+
+	parts := regexp.MustCompile(`(?m)^#EXT-X-PART:DURATION=([0-9.]+),URI="[^"]+"(,INDEPENDENT=YES)?$`).
+		FindAllStringSubmatch(string(byts), -1)
+	require.Greater(t, len(parts), 10)
+
+	for _, part := range parts {
+		require.Equal(t, "0.20000", part[1])
+	}
+}
+
+func TestMuxerReconfigureInvalid(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name            string
+		variant         MuxerVariant
+		targetDuration  time.Duration
+		segmentDuration time.Duration
+		partDuration    time.Duration
+		err             string
+	}{
+		{
+			"variant",
+			MuxerVariantMPEGTS,
+			2 * time.Second,
+			1 * time.Second,
+			0,
+			"reconfiguration requires the fMP4 or Low-Latency variant",
+		},
+		{
+			"segment duration",
+			MuxerVariantFMP4,
+			2 * time.Second,
+			0,
+			0,
+			"segment duration must be greater than zero",
+		},
+		{
+			"target duration unset",
+			MuxerVariantFMP4,
+			0,
+			1 * time.Second,
+			0,
+			"reconfiguration requires a target duration",
+		},
+		{
+			"part duration change",
+			MuxerVariantLowLatency,
+			2 * time.Second,
+			1 * time.Second,
+			100 * time.Millisecond,
+			"the part duration of the Low-Latency variant can't be changed",
+		},
+		{
+			"part duration",
+			MuxerVariantLowLatency,
+			2 * time.Second,
+			200 * time.Millisecond,
+			200 * time.Millisecond,
+			"part duration must be at most 4/5 of segment duration",
+		},
+		{
+			"target duration",
+			MuxerVariantLowLatency,
+			2 * time.Second,
+			3 * time.Second,
+			200 * time.Millisecond,
+			"target duration can't be less than segment duration",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				7,
+				1*time.Second,
+				200*time.Millisecond,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			if ca.targetDuration != 0 {
+				err = m.SetTargetDuration(ca.targetDuration)
+				require.NoError(t, err)
+			}
+
+			err = m.Reconfigure(ca.partDuration, ca.segmentDuration)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerEncryption(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.EnableEncryption(&fmp4.Encryption{
+		Scheme:     fmp4.EncryptionSchemeCBCS,
+		KeyID:      [16]byte{1, 2, 3, 4},
+		Key:        [16]byte{5, 6, 7, 8},
+		ConstantIV: [16]byte{9, 10, 11, 12},
+	}, []MuxerEncryptionKey{{
+		URI:    "skd://key",
+		Format: "com.apple.streamingkeydelivery",
+	}})
+	require.NoError(t, err)
+
+	// 30fps, with an IDR every second
+	for i := 0; i <= 90; i++ {
+		pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 30) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	// the init segment, that is generated before the call to EnableEncryption(), is regenerated
+	byts, err := io.ReadAll(m.File("init.mp4", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(byts, []byte("encv")))
+	require.True(t, bytes.Contains(byts, []byte("cbcs")))
+
+	byts, err = io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://key\","+
+		"KEYFORMAT=\"com.apple.streamingkeydelivery\",KEYFORMATVERSIONS=\"1\"\n"+
+		"#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	segments := regexp.MustCompile(`(?m)^([^#\n]+\.mp4)$`).FindAllStringSubmatch(string(byts), -1)
+	require.GreaterOrEqual(t, len(segments), 1)
+
+	byts, err = io.ReadAll(m.File(segments[0][1], "", "", "", false).Body)
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(byts, []byte("senc")))
+}
+
+func TestMuxerEncryptionInvalid(t *testing.T) {
+	for _, ca := range []struct {
+		name       string
+		variant    MuxerVariant
+		videoTrack format.Format
+		scheme     fmp4.EncryptionScheme
+		keys       []MuxerEncryptionKey
+		err        string
+	}{
+		{
+			"variant",
+			MuxerVariantMPEGTS,
+			&format.H264{PayloadTyp: 96, PacketizationMode: 1},
+			fmp4.EncryptionSchemeCENC,
+			[]MuxerEncryptionKey{{URI: "https://key"}},
+			"encryption requires the fMP4 or Low-Latency variant",
+		},
+		{
+			"mjpeg",
+			MuxerVariantFMP4,
+			&format.MJPEG{},
+			fmp4.EncryptionSchemeCENC,
+			[]MuxerEncryptionKey{{URI: "https://key"}},
+			"encryption of tracks with format *format.MJPEG is not supported",
+		},
+		{
+			"invalid scheme",
+			MuxerVariantFMP4,
+			&format.H264{PayloadTyp: 96, PacketizationMode: 1},
+			fmp4.EncryptionScheme(5),
+			[]MuxerEncryptionKey{{URI: "https://key"}},
+			"unsupported encryption scheme: 5",
+		},
+		{
+			"no keys",
+			MuxerVariantFMP4,
+			&format.H264{PayloadTyp: 96, PacketizationMode: 1},
+			fmp4.EncryptionSchemeCENC,
+			nil,
+			"at least one key is required",
+		},
+		{
+			"invalid key",
+			MuxerVariantFMP4,
+			&format.H264{PayloadTyp: 96, PacketizationMode: 1},
+			fmp4.EncryptionSchemeCENC,
+			[]MuxerEncryptionKey{{URI: "https://\"key"}},
+			"invalid key URI 'https://\"key'",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				ca.videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.EnableEncryption(&fmp4.Encryption{Scheme: ca.scheme}, ca.keys)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerGzipPlaylist(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteH264(testTime, 0, [][]byte{
+		testSPS,
+		{5}, // IDR
+	})
+	require.NoError(t, err)
+
+	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
+		{5}, // IDR
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"index.m3u8", "stream.m3u8"} {
+		res := m.File(name, "", "", "", false)
+		require.Equal(t, "", res.Header["Content-Encoding"])
+		require.Equal(t, "Accept-Encoding", res.Header["Vary"])
+
+		plain, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		res = m.File(name, "", "", "", true)
+		require.Equal(t, "gzip", res.Header["Content-Encoding"])
+		require.Equal(t, "Accept-Encoding", res.Header["Vary"])
+
+		r, err := gzip.NewReader(res.Body)
+		require.NoError(t, err)
+
+		decompressed, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, plain, decompressed)
+	}
+
+	res := m.File("seg0.ts", "", "", "", true)
+	require.Equal(t, "", res.Header["Content-Encoding"])
+	require.Equal(t, "", res.Header["Vary"])
+}
+
+func TestMuxerFileNameTemplate(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			var v MuxerVariant
+			var ext string
+			if ca == "mpegts" {
+				v = MuxerVariantMPEGTS
+				ext = "ts"
+			} else {
+				v = MuxerVariantFMP4
+				ext = "mp4"
+			}
+
+			m, err := NewMuxer(
+				v,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.SetFileNameTemplates("live-$Token$-$Number$", "live-$Token$-part$Number$")
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				err = m.WriteH264(testTime, time.Duration(i)*2*time.Second, [][]byte{
+					testSPS,
+					{5}, // IDR
+				})
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			ma := regexp.MustCompile(`(?m)^live-([0-9a-f]{8})-([0-9]+)\.`+ext+`$`).FindAllStringSubmatch(string(byts), -1)
+			require.Equal(t, 2, len(ma))
+			require.Equal(t, ma[0][1], ma[1][1])
+			require.Equal(t, "0", ma[0][2])
+			require.Equal(t, "1", ma[1][2])
+
+			for _, e := range ma {
+				res := m.File(e[0], "", "", "", false)
+				require.Equal(t, http.StatusOK, res.Status)
+			}
+
+			res := m.File("seg0."+ext, "", "", "", false)
+			require.Equal(t, http.StatusNotFound, res.Status)
+		})
+	}
+}
+
+func TestMuxerFileNameTemplateInvalid(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name            string
+		segmentTemplate string
+		partTemplate    string
+		err             string
+	}{
+		{
+			"number",
+			"seg",
+			MuxerDefaultPartNameTemplate,
+			"file name template 'seg' does not contain $Number$",
+		},
+		{
+			"quote",
+			"seg\"$Number$",
+			MuxerDefaultPartNameTemplate,
+			"file name template 'seg\"$Number$' contains invalid characters",
+		},
+		{
+			"space",
+			"seg $Number$",
+			MuxerDefaultPartNameTemplate,
+			"file name template 'seg $Number$' contains invalid characters",
+		},
+		{
+			"newline",
+			MuxerDefaultSegmentNameTemplate,
+			"part$Number$\n",
+			"file name template 'part$Number$\n' contains invalid characters",
+		},
+		{
+			"same",
+			"seg$Number$",
+			"seg$Number$",
+			"file name templates 'seg$Number$' and 'seg$Number$' can generate the same file name",
+		},
+		{
+			"collision",
+			"seg$Number$",
+			"seg1$Number$",
+			"file name templates 'seg$Number$' and 'seg1$Number$' can generate the same file name",
+		},
+		{
+			"token collision",
+			"seg$Token$$Number$",
+			"seg$Number$",
+			"file name templates 'seg$Token$$Number$' and 'seg$Number$' can generate the same file name",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				MuxerVariantMPEGTS,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.SetFileNameTemplates(ca.segmentTemplate, ca.partTemplate)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerLowLatencyBlockingRequestTimeout(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		200*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	for i := 0; i <= 30; i++ {
+		pts := time.Duration(i) * 40 * time.Millisecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 25) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	// the player requests a part that is never produced
+	start := time.Now()
+	res := m.File("stream.m3u8", "8", "5", "", false)
+	require.Equal(t, http.StatusOK, res.Status)
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	byts, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "#EXT-X-PRELOAD-HINT")
+
+	// the player requests the preload hint, that is never produced
+	preloadHint := regexp.MustCompile(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="(.+?)"`).FindStringSubmatch(string(byts))
+	require.NotEqual(t, 0, len(preloadHint))
+
+	start = time.Now()
+	res = m.File(preloadHint[1], "", "", "", false)
+	require.Equal(t, http.StatusServiceUnavailable, res.Status)
+	require.Equal(t, "1", res.Header["Retry-After"])
+	require.Equal(t, "no-store", res.Header["Cache-Control"])
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestMuxerPreloadHints(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{"mpegts", "lowlatency"} {
+		t.Run(ca, func(t *testing.T) {
+			var v MuxerVariant
+			if ca == "mpegts" {
+				v = MuxerVariantMPEGTS
+			} else {
+				v = MuxerVariantLowLatency
+			}
+
+			m, err := NewMuxer(
+				v,
+				7,
+				1*time.Second,
+				200*time.Millisecond,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			for i := 0; i <= 30; i++ {
+				pts := time.Duration(i) * 40 * time.Millisecond
+
+				var nalus [][]byte
+				switch {
+				case i == 0:
+					nalus = [][]byte{testSPS, {8}, {5}}
+				case (i % 25) == 0:
+					nalus = [][]byte{{5}}
+				default:
+					nalus = [][]byte{{1}}
+				}
+
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			if ca == "mpegts" {
+				require.Equal(t, []string(nil), m.PreloadHints())
+				return
+			}
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			preloadHint := regexp.MustCompile(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="(.+?)"`).FindStringSubmatch(string(byts))
+			require.NotEqual(t, 0, len(preloadHint))
+			require.Equal(t, []string{preloadHint[1]}, m.PreloadHints())
+
+			// a complete stream has no next part
+			err = m.Finish()
+			require.NoError(t, err)
+			require.Equal(t, []string(nil), m.PreloadHints())
+		})
+	}
+}
+
+func TestMuxerInitBeforeFirstIDR(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantFMP4,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	start := time.Now()
+	res := m.File("init.mp4", "", "", "", false)
+	require.Equal(t, http.StatusOK, res.Status)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+
+	byts, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	var init fmp4.Init
+	err = init.Unmarshal(byts)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(init.Tracks))
+}
+
+func TestMuxerInitInBandParams(t *testing.T) {
+	for _, ca := range []string{
+		"received",
+		"timed out",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			videoTrack := &format.H264{
+				PayloadTyp:        96,
+				PacketizationMode: 1,
+			}
+
+			m, err := NewMuxer(
+				MuxerVariantFMP4,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			done := make(chan *MuxerFileResponse)
+			go func() {
+				done <- m.File("init.mp4", "", "", "", false)
+			}()
+
+			if ca == "received" {
+				time.Sleep(100 * time.Millisecond)
+
+				// parameters are extracted from the stream by the caller
+				videoTrack.SafeSetSPS(testSPS)
+				videoTrack.SafeSetPPS([]byte{0x08})
+
+				err = m.WriteH264(testTime, 0, [][]byte{testSPS, {8}, {5}})
+				require.NoError(t, err)
+
+				res := <-done
+				require.Equal(t, http.StatusOK, res.Status)
+			} else {
+				res := <-done
+				require.Equal(t, http.StatusServiceUnavailable, res.Status)
+				require.Equal(t, "1", res.Header["Retry-After"])
+			}
+		})
+	}
+}
+
+func TestMuxerErrorResponses(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantLowLatency,
+		7,
+		1*time.Second,
+		200*time.Millisecond,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	for i := 0; i <= 30; i++ {
+		pts := time.Duration(i) * 40 * time.Millisecond
+
+		var nalus [][]byte
+		switch {
+		case i == 0:
+			nalus = [][]byte{testSPS, {8}, {5}}
+		case (i % 25) == 0:
+			nalus = [][]byte{{5}}
+		default:
+			nalus = [][]byte{{1}}
+		}
+
+		err = m.WriteH264(testTime.Add(pts), pts, nalus)
+		require.NoError(t, err)
+	}
+
+	for _, ca := range []struct {
+		name   string
+		file   string
+		msn    string
+		part   string
+		status int
+	}{
+		{
+			"missing segment",
+			"missing.mp4",
+			"",
+			"",
+			http.StatusNotFound,
+		},
+		{
+			"unknown file",
+			"unknown.txt",
+			"",
+			"",
+			http.StatusNotFound,
+		},
+		{
+			"malformed msn",
+			"stream.m3u8",
+			"abc",
+			"",
+			http.StatusBadRequest,
+		},
+		{
+			"malformed part",
+			"stream.m3u8",
+			"8",
+			"abc",
+			http.StatusBadRequest,
+		},
+		{
+			"msn too far",
+			"stream.m3u8",
+			"1000",
+			"",
+			http.StatusBadRequest,
+		},
+		{
+			"part without msn",
+			"stream.m3u8",
+			"",
+			"1",
+			http.StatusBadRequest,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			res := m.File(ca.file, ca.msn, ca.part, "", false)
+			require.Equal(t, ca.status, res.Status)
+			require.Equal(t, map[string]string{
+				"Cache-Control": "no-store",
+			}, res.Header)
+		})
+	}
+}
+
+func TestMuxerLowLatencyInvalidParams(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name            string
+		segmentCount    int
+		segmentDuration time.Duration
+		partDuration    time.Duration
+		err             string
+	}{
+		{
+			"segment count",
+			3,
+			1 * time.Second,
+			200 * time.Millisecond,
+			"the Low-Latency variant requires at least 7 segments",
+		},
+		{
+			"part duration",
+			7,
+			1 * time.Second,
+			900 * time.Millisecond,
+			"part duration must be at most 4/5 of segment duration",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := NewMuxer(
+				MuxerVariantLowLatency,
+				ca.segmentCount,
+				ca.segmentDuration,
+				ca.partDuration,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestMuxerDoubleRead(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteH264(testTime, 0, [][]byte{
+		testSPS,
+		{5}, // IDR
+		{1},
+	})
+	require.NoError(t, err)
+
+	err = m.WriteH264(testTime, 2*time.Second, [][]byte{
+		{5}, // IDR
+		{2},
+	})
+	require.NoError(t, err)
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+
+	re := regexp.MustCompile(`^#EXTM3U\n` +
+		`#EXT-X-VERSION:3\n` +
+		`#EXT-X-ALLOW-CACHE:NO\n` +
+		`#EXT-X-TARGETDURATION:2\n` +
+		`#EXT-X-MEDIA-SEQUENCE:0\n` +
+		`#EXT-X-PROGRAM-DATE-TIME:(.*?)\n` +
+		`#EXTINF:2,\n` +
+		`(seg0\.ts)\n$`)
+	ma := re.FindStringSubmatch(string(byts))
+	require.NotEqual(t, 0, len(ma))
+
+	byts1, err := io.ReadAll(m.File(ma[2], "", "", "", false).Body)
+	require.NoError(t, err)
+
+	byts2, err := io.ReadAll(m.File(ma[2], "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Equal(t, byts1, byts2)
+}
+
+func TestMuxerSegmentBitrate(t *testing.T) {
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			videoTrack := &format.H264{
+				PayloadTyp:        96,
+				SPS:               testSPS,
+				PPS:               []byte{0x08},
+				PacketizationMode: 1,
+			}
+
+			var v MuxerVariant
+			if ca == "mpegts" {
+				v = MuxerVariantMPEGTS
+			} else {
+				v = MuxerVariantFMP4
+			}
+
+			m, err := NewMuxer(
+				v,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			m.EnableSegmentBitrate()
+
+			for i := 0; i < 3; i++ {
+				d := time.Duration(i) * 2 * time.Second
+				err = m.WriteH264(testTime.Add(d), d, [][]byte{
+					testSPS,
+					{5}, // IDR
+					bytes.Repeat([]byte{1}, 1000),
+				})
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			ma := regexp.MustCompile(`(?m)^#EXT-X-BITRATE:([0-9]+)\n` +
+				`#EXT-X-PROGRAM-DATE-TIME:.*?\n` +
+				`#EXTINF:2(\.00000)?,\n` +
+				`(seg0\.(ts|mp4))$`).FindStringSubmatch(string(byts))
+			require.NotEqual(t, 0, len(ma))
+
+			seg, err := io.ReadAll(m.File(ma[3], "", "", "", false).Body)
+			require.NoError(t, err)
+
+			// the bitrate is expressed in kbit/s
+			require.Equal(t, strconv.FormatInt(int64(len(seg)*8/2/1000), 10), ma[1])
+		})
+	}
+}
+
+func TestMuxerSegmentRetention(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name      string
+		retention time.Duration
+		status    int
+	}{
+		{
+			"disabled",
+			0,
+			http.StatusNotFound,
+		},
+		{
+			"enabled",
+			1 * time.Minute,
+			http.StatusOK,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				MuxerVariantMPEGTS,
+				1,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			err = m.SetSegmentRetention(ca.retention)
+			require.NoError(t, err)
+
+			err = m.WriteH264(testTime, 0, [][]byte{
+				testSPS,
+				{5}, // IDR
+			})
+			require.NoError(t, err)
+
+			err = m.WriteH264(testTime, 2*time.Second, [][]byte{
+				{5}, // IDR
+			})
+			require.NoError(t, err)
+
+			err = m.WriteH264(testTime, 4*time.Second, [][]byte{
+				{5}, // IDR
+			})
+			require.NoError(t, err)
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+			require.NotContains(t, string(byts), "seg0.ts")
+			require.Contains(t, string(byts), "seg1.ts")
+
+			require.Equal(t, ca.status, m.File("seg0.ts", "", "", "", false).Status)
+		})
+	}
+}
+
+func TestMuxerWriteH264RTP(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	enc := videoTrack.CreateEncoder()
+
+	// same SPS with a different level
+	sps2 := append([]byte{0x67, 0x42, 0xc0, 0x29}, testSPS[4:]...)
+
+	for i := 0; i < 3; i++ {
+		pts := time.Duration(i) * 2 * time.Second
+
+		sps := testSPS
+		if i == 2 {
+			sps = sps2
+		}
+
+		// the IDR is split into multiple packets
+		pkts, err := enc.Encode([][]byte{
+			sps,
+			{8},
+			append([]byte{5}, bytes.Repeat([]byte{1}, 3000)...),
+		}, pts)
+		require.NoError(t, err)
+		require.Greater(t, len(pkts), 1)
+
+		err = m.WriteH264RTP(testTime.Add(pts), pkts)
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "#EXTINF:2,\nseg0.ts\n")
+	require.Contains(t, string(byts), "#EXTINF:2,\nseg1.ts\n")
+
+	// parameters sent in-band are applied to the track
+	require.Equal(t, sps2, videoTrack.SafeSPS())
+}
+
+func TestMuxerSnapshot(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		variant MuxerVariant
+		ext     string
+		writes  int
+	}{
+		{MuxerVariantMPEGTS, ".ts", 3},
+		// fMP4 segments are finalized one sample later
+		{MuxerVariantFMP4, ".mp4", 4},
+	} {
+		t.Run(ca.ext, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				2,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			_, err = m.Snapshot()
+			require.EqualError(t, err, "no segments are available")
+
+			pts := time.Duration(0)
+
+			writeSegment := func() {
+				err := m.WriteH264(testTime.Add(pts), pts, [][]byte{
+					testSPS,
+					{8},
+					{5}, // IDR
+				})
+				require.NoError(t, err)
+				pts += 2 * time.Second
+			}
+
+			for i := 0; i < ca.writes; i++ {
+				writeSegment()
+			}
+
+			snap, err := m.Snapshot()
+			require.NoError(t, err)
+			require.Equal(t, []string{"seg0" + ca.ext, "seg1" + ca.ext}, snap.Segments)
+
+			for _, seg := range snap.Segments {
+				require.Contains(t, string(snap.Playlist), seg+"\n")
+			}
+
+			// segments referenced by the snapshot are not deleted
+			for i := 0; i < 3; i++ {
+				writeSegment()
+			}
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+			require.NotContains(t, string(byts), "seg0"+ca.ext)
+
+			for _, seg := range snap.Segments {
+				require.Equal(t, http.StatusOK, m.File(seg, "", "", "", false).Status)
+			}
+
+			// segments are deleted after the snapshot is released
+			snap.Release()
+			snap.Release()
+
+			for _, seg := range snap.Segments {
+				require.Equal(t, http.StatusNotFound, m.File(seg, "", "", "", false).Status)
+			}
+		})
+	}
+}
+
+func TestMuxerClip(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		variant MuxerVariant
+		ext     string
+		writes  int
+	}{
+		{MuxerVariantMPEGTS, ".ts", 4},
+		// fMP4 segments are finalized one sample later
+		{MuxerVariantFMP4, ".mp4", 5},
+	} {
+		t.Run(ca.ext, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				2,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			pts := time.Duration(0)
+
+			writeSegment := func() {
+				err := m.WriteH264(testTime.Add(pts), pts, [][]byte{
+					testSPS,
+					{8},
+					{5}, // IDR
+				})
+				require.NoError(t, err)
+				pts += 2 * time.Second
+			}
+
+			for i := 0; i < ca.writes; i++ {
+				writeSegment()
+			}
+
+			_, err = m.Clip(testTime.Add(3*time.Second), testTime.Add(1*time.Second))
+			require.EqualError(t, err, "end must be after start")
+
+			_, err = m.Clip(testTime.Add(1*time.Second), testTime.Add(10*time.Second))
+			require.Error(t, err)
+
+			// boundary segments are included whole
+			c, err := m.Clip(testTime.Add(1*time.Second), testTime.Add(3*time.Second))
+			require.NoError(t, err)
+			require.Equal(t, []string{"seg0" + ca.ext, "seg1" + ca.ext}, c.Segments)
+			require.Equal(t, 1*time.Second, c.In)
+			require.Equal(t, 3*time.Second, c.Out)
+
+			require.Regexp(t, `^#EXTM3U\n`+
+				`#EXT-X-VERSION:[0-9]+\n`+
+				`#EXT-X-TARGETDURATION:2\n`+
+				`#EXT-X-MEDIA-SEQUENCE:0\n`+
+				`#EXT-X-PLAYLIST-TYPE:VOD\n`+
+				`#EXT-X-START:TIME-OFFSET=1.00000,PRECISE=YES\n`+
+				`(#EXT-X-MAP:URI="init.mp4"\n)?`+
+				`#EXT-X-PROGRAM-DATE-TIME:2010-01-01T01:01:01Z\n`+
+				`#EXTINF:2\.0+,\n`+
+				`seg0\`+ca.ext+`\n`+
+				`#EXT-X-PROGRAM-DATE-TIME:2010-01-01T01:01:03Z\n`+
+				`#EXTINF:2\.0+,\n`+
+				`seg1\`+ca.ext+`\n`+
+				`#EXT-X-ENDLIST\n$`, string(c.Playlist))
+
+			// segments referenced by the clip are not deleted
+			for i := 0; i < 3; i++ {
+				writeSegment()
+			}
+
+			for _, seg := range c.Segments {
+				require.Equal(t, http.StatusOK, m.File(seg, "", "", "", false).Status)
+			}
+
+			// segments are deleted after the clip is released
+			c.Release()
+
+			for _, seg := range c.Segments {
+				require.Equal(t, http.StatusNotFound, m.File(seg, "", "", "", false).Status)
+			}
+
+			_, err = m.Clip(testTime.Add(1*time.Second), testTime.Add(3*time.Second))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMuxerDateRange(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	for i, d := range []time.Duration{0, 2 * time.Second, 4 * time.Second} {
+		nalus := [][]byte{
+			{5}, // IDR
+		}
+		if i == 0 {
+			nalus = append([][]byte{testSPS}, nalus...)
+		}
+
+		err = m.WriteH264(testTime.Add(d), d, nalus)
+		require.NoError(t, err)
+	}
+
+	err = m.InsertDateRange("ad1", testTime.Add(2500*time.Millisecond), 30*time.Second, map[string]string{
+		"CLASS":      "com.example.ad",
+		"SCTE35-OUT": "0xFC30",
+	})
+	require.NoError(t, err)
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`seg0\.ts\n`+
+		`#EXT-X-DATERANGE:ID="ad1",START-DATE="2010-01-01T01:01:03.5Z",DURATION=30,`+
+		`CLASS="com.example.ad",SCTE35-OUT=0xFC30\n`+
+		`#EXT-X-PROGRAM-DATE-TIME:2010-01-01T01:01:03Z\n`+
+		`#EXTINF:2,\n`+
+		`seg1\.ts\n$`), string(byts))
+
+	for _, attrs := range []map[string]string{
+		{"ID": "ad2"},
+		{"X-COMMENT": "\"quoted\""},
+		{"SCTE35-IN": "FC30"},
+		{"lowercase": "value"},
+	} {
+		err = m.InsertDateRange("ad2", testTime, 0, attrs)
+		require.Error(t, err)
+	}
+}
+
+func TestMuxerFinish(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []struct {
+		name    string
+		variant MuxerVariant
+		segment string
+	}{
+		{
+			"mpegts",
+			MuxerVariantMPEGTS,
+			"seg1.ts",
+		},
+		{
+			"fmp4",
+			MuxerVariantFMP4,
+			"seg1.mp4",
+		},
+		{
+			"lowLatency",
+			MuxerVariantLowLatency,
+			"seg8.mp4",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			m, err := NewMuxer(
+				ca.variant,
+				7,
+				1*time.Second,
+				200*time.Millisecond,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			for i, nalus := range [][][]byte{
+				{testSPS, {8}, {5}}, // IDR
+				{{1}},               // non-IDR
+				{{5}},               // IDR
+				{{1}},               // non-IDR
+			} {
+				pts := time.Duration(i) * 500 * time.Millisecond
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			err = m.Finish()
+			require.NoError(t, err)
+
+			err = m.WriteH264(testTime.Add(2*time.Second), 2*time.Second, [][]byte{{5}})
+			require.Error(t, err)
+
+			// blocking requests are not blocked by a complete playlist
+			start := time.Now()
+			res := m.File("stream.m3u8", "", "", "", false)
+			if ca.variant == MuxerVariantLowLatency {
+				res = m.File("stream.m3u8", "9", "0", "", false)
+			}
+			require.Equal(t, http.StatusOK, res.Status)
+			require.Less(t, time.Since(start), 500*time.Millisecond)
+
+			byts, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Regexp(t, `#EXTINF:1(\.00000)?,\n`+ca.segment+`\n#EXT-X-ENDLIST\n$`, string(byts))
+			require.NotContains(t, string(byts), "#EXT-X-PRELOAD-HINT")
+
+			res = m.File(ca.segment, "", "", "", false)
+			require.Equal(t, http.StatusOK, res.Status)
+		})
+	}
+}
+
+func TestMuxerLastWrite(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		videoTrack,
+		nil,
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.True(t, m.LastWrite().IsZero())
+	require.False(t, m.IsLive(time.Hour))
+
+	before := time.Now()
+
+	err = m.WriteH264(testTime, 0, [][]byte{testSPS, {8}, {5}})
+	require.NoError(t, err)
+
+	require.False(t, m.LastWrite().Before(before))
+	require.True(t, m.IsLive(time.Hour))
+}
+
+func TestMuxerSegmentValidation(t *testing.T) {
+	videoTrack := &format.H264{
+		PayloadTyp:        96,
+		SPS:               testSPS,
+		PPS:               []byte{0x08},
+		PacketizationMode: 1,
+	}
+
+	for _, ca := range []string{
+		"mpegts",
+		"fmp4",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			v := MuxerVariantMPEGTS
+			if ca == "fmp4" {
+				v = MuxerVariantFMP4
+			}
+
+			dir := t.TempDir()
+
+			m, err := NewMuxer(
+				v,
+				3,
+				1*time.Second,
+				0,
+				50*1024*1024,
+				videoTrack,
+				nil,
+			)
+			require.NoError(t, err)
+			defer m.Close()
+
+			m.SetSegmentStorage(NewSegmentStorageDisk(dir))
+
+			m.EnableSegmentValidation()
+
+			// 30fps, with an IDR every second
+			for i := 0; i <= 90; i++ {
+				pts := time.Duration(i) * 33333334 * time.Nanosecond
+
+				var nalus [][]byte
+				switch {
+				case i == 0:
+					nalus = [][]byte{testSPS, {8}, {5}}
+				case (i % 30) == 0:
+					nalus = [][]byte{{5}}
+				default:
+					nalus = [][]byte{{1}}
+				}
+
+				err = m.WriteH264(testTime.Add(pts), pts, nalus)
+				require.NoError(t, err)
+			}
+
+			byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+			require.NoError(t, err)
+
+			segments := regexp.MustCompile(`(?m)^([^#\n]+\.(ts|mp4))$`).FindAllStringSubmatch(string(byts), -1)
+			require.GreaterOrEqual(t, len(segments), 2)
+
+			res := m.File(segments[1][1], "", "", "", false)
+			require.Equal(t, http.StatusOK, res.Status)
+
+			// simulate a crash during the write of the segment
+			fpath := filepath.Join(dir, segments[0][1])
+			fi, err := os.Stat(fpath)
+			require.NoError(t, err)
+			err = os.Truncate(fpath, fi.Size()-10)
+			require.NoError(t, err)
+
+			res = m.File(segments[0][1], "", "", "", false)
+			require.Equal(t, http.StatusNotFound, res.Status)
+		})
+	}
+}
+
+type testAACEncoder struct {
+	samples []int16
+}
+
+func (e *testAACEncoder) Encode(samples []int16) ([][]byte, error) {
+	e.samples = append(e.samples, samples...)
+
+	var aus [][]byte
+	for len(e.samples) >= mpeg4audio.SamplesPerAccessUnit {
+		aus = append(aus, []byte{1, 2, 3, 4})
+		e.samples = e.samples[mpeg4audio.SamplesPerAccessUnit:]
+	}
+	return aus, nil
+}
+
+func (e *testAACEncoder) Close() {}
+
+func TestMuxerG711Transcoding(t *testing.T) {
+	require.Equal(t, int16(0), g711MULawDecode(0xFF))
+	require.Equal(t, int16(-32124), g711MULawDecode(0x00))
+	require.Equal(t, int16(8), g711ALawDecode(0xD5))
+	require.Equal(t, int16(-8), g711ALawDecode(0x55))
+
+	m, err := NewMuxer(
+		MuxerVariantMPEGTS,
+		3,
+		1*time.Second,
+		0,
+		50*1024*1024,
+		nil,
+		G711AACTrack(),
+	)
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.WriteG711(testTime, 0, make([]byte, 160))
+	require.EqualError(t, err, "G711 transcoding is not enabled")
+
+	enc := &testAACEncoder{}
+	err = m.EnableG711Transcoding(true, enc)
+	require.NoError(t, err)
+
+	// 20ms packets
+	for i := 0; i < 250; i++ {
+		pts := time.Duration(i) * 20 * time.Millisecond
+		err = m.WriteG711(testTime.Add(pts), pts, bytes.Repeat([]byte{0xFF}, 160))
+		require.NoError(t, err)
+	}
+
+	byts, err := io.ReadAll(m.File("stream.m3u8", "", "", "", false).Body)
+	require.NoError(t, err)
+	require.Regexp(t, `(?m)^[^#\n]+\.ts$`, string(byts))
 }
@@ -2,6 +2,11 @@ package hls
 
 import (
 	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 )
 
 // MuxerVariant is a muxer variant.
@@ -16,7 +21,61 @@ const (
 
 type muxerVariant interface {
 	close()
-	writeH264(ntp time.Time, pts time.Duration, nalus [][]byte) error
-	writeAAC(ntp time.Time, pts time.Duration, au []byte) error
+	finish() error
+	writeH264(ntp time.Time, dts *time.Duration, pts time.Duration, nalus [][]byte, idrPresent bool) error
+	writeMJPEG(ntp time.Time, pts time.Duration, frame []byte) error
+	writeAudio(ntp time.Time, pts time.Duration, au []byte) error
 	file(name string, msn string, part string, skip string) *MuxerFileResponse
+	bandwidth() (int, int)
+	insertDateRange(d *muxerDateRange)
+	enableSegmentValidation()
+	enableSegmentBitrate()
+	setTargetDuration(targetDuration time.Duration) error
+	setSegmentRetention(segmentRetention time.Duration)
+	setFileNames(segmentNames *muxerFileNameTemplate, partNames *muxerFileNameTemplate)
+	setStorage(storage SegmentStorage)
+	snapshot() (*MuxerSnapshot, error)
+	clip(start time.Time, end time.Time) (*MuxerClip, error)
+	preloadHints() []string
+}
+
+// lpcmSampleCount returns the number of samples contained in a LPCM frame.
+func lpcmSampleCount(track *format.LPCM, frame []byte) int {
+	return len(frame) / (track.BitDepth / 8 * track.ChannelCount)
+}
+
+// audioSamplesPerAU returns the number of samples contained in an access unit of an audio track.
+// LPCM frames contain a variable number of samples, that is returned by lpcmSampleCount().
+func audioSamplesPerAU(track format.Format) int {
+	if ttrack, ok := track.(*ac3.Format); ok {
+		return ttrack.Config.SamplesPerFrame()
+	}
+	return mpeg4audio.SamplesPerAccessUnit
+}
+
+// segmentBitrate returns the bitrate of a segment, in bit/s.
+func segmentBitrate(size uint64, duration time.Duration) int {
+	if duration <= 0 {
+		return 0
+	}
+	return int(float64(size*8) / duration.Seconds())
+}
+
+// bandwidth returns the peak and the average bitrate of a sequence of segments, in bit/s.
+func bandwidth(sizes []uint64, durations []time.Duration) (int, int) {
+	peak := 0
+	totalSize := uint64(0)
+	totalDuration := time.Duration(0)
+
+	for i, size := range sizes {
+		v := segmentBitrate(size, durations[i])
+		if v > peak {
+			peak = v
+		}
+
+		totalSize += size
+		totalDuration += durations[i]
+	}
+
+	return peak, segmentBitrate(totalSize, totalDuration)
 }
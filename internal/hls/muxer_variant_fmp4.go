@@ -2,25 +2,50 @@ package hls
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/format"
 
 	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+// muxerVariantFMP4Init is an init segment that is shared by consecutive segments.
+type muxerVariantFMP4Init struct {
+	name    string
+	content []byte
+}
+
 type muxerVariantFMP4 struct {
-	playlist   *muxerVariantFMP4Playlist
-	segmenter  *muxerVariantFMP4Segmenter
-	videoTrack *format.H264
-	audioTrack *format.MPEG4Audio
+	playlist        *muxerVariantFMP4Playlist
+	segmenter       *muxerVariantFMP4Segmenter
+	segmentDuration time.Duration
+	stallTimeout    time.Duration
+	cmaf            bool
+	videoTrack      format.Format
+	audioTrack      format.Format
+	log             func(logger.Level, string, ...interface{})
+
+	// protects the segmenter, that is used by writers and by the stall timer
+	writeMutex sync.Mutex
+	stallTimer *time.Timer
 
-	mutex        sync.Mutex
-	videoLastSPS []byte
-	videoLastPPS []byte
-	initContent  []byte
+	mutex           sync.Mutex
+	cond            *sync.Cond
+	closed          bool
+	mjpegWidth      int
+	mjpegHeight     int
+	videoLastSPS    []byte
+	videoLastPPS    []byte
+	videoLastWidth  int
+	videoLastHeight int
+	initContent     []byte
+	nextInitID      uint64
+	encryption      *fmp4.Encryption
 }
 
 func newMuxerVariantFMP4(
@@ -29,17 +54,33 @@ func newMuxerVariantFMP4(
 	segmentDuration time.Duration,
 	partDuration time.Duration,
 	segmentMaxSize uint64,
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	segmentRetention time.Duration,
+	segmentNames *muxerFileNameTemplate,
+	partNames *muxerFileNameTemplate,
+	storage SegmentStorage,
+	producerReferenceTime bool,
+	cmaf bool,
+	videoTrack format.Format,
+	audioTrack format.Format,
+	onSegmentFinalized func(string, time.Time, time.Duration, time.Duration, time.Duration),
+	log func(logger.Level, string, ...interface{}),
 ) *muxerVariantFMP4 {
 	v := &muxerVariantFMP4{
-		videoTrack: videoTrack,
-		audioTrack: audioTrack,
+		segmentDuration: segmentDuration,
+		cmaf:            cmaf,
+		videoTrack:      videoTrack,
+		audioTrack:      audioTrack,
+		log:             log,
 	}
 
+	v.cond = sync.NewCond(&v.mutex)
+
 	v.playlist = newMuxerVariantFMP4Playlist(
 		lowLatency,
 		segmentCount,
+		partDuration,
+		segmentRetention,
+		partNames,
 		videoTrack,
 		audioTrack,
 	)
@@ -50,78 +91,459 @@ func newMuxerVariantFMP4(
 		segmentDuration,
 		partDuration,
 		segmentMaxSize,
+		segmentNames,
+		storage,
+		producerReferenceTime,
+		cmaf,
 		videoTrack,
 		audioTrack,
-		v.playlist.onSegmentFinalized,
+		func(seg *muxerVariantFMP4Segment) {
+			v.playlist.onSegmentFinalized(seg)
+			onSegmentFinalized(
+				seg.name,
+				seg.startTime,
+				seg.startDTS+v.segmenter.startDTS,
+				seg.startDTS,
+				seg.renderedDuration)
+		},
 		v.playlist.onPartFinalized,
+		v.playlist.setPartDuration,
+		log,
 	)
 
+	// generate the init segment immediately when parameters are known in advance,
+	// in order to allow players to fetch it before the first IDR.
+	if v.videoParamsAvailable() {
+		v.updateInit()
+	}
+
 	return v
 }
 
 func (v *muxerVariantFMP4) close() {
+	func() {
+		v.writeMutex.Lock()
+		defer v.writeMutex.Unlock()
+
+		if v.stallTimer != nil {
+			v.stallTimer.Stop()
+		}
+
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		v.closed = true
+	}()
+
+	v.cond.Broadcast()
+
 	v.playlist.close()
 }
 
-func (v *muxerVariantFMP4) writeH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
-	return v.segmenter.writeH264(ntp, pts, nalus)
+func (v *muxerVariantFMP4) finish() error {
+	err := func() error {
+		v.writeMutex.Lock()
+		defer v.writeMutex.Unlock()
+
+		if v.stallTimer != nil {
+			v.stallTimer.Stop()
+		}
+
+		return v.segmenter.finish()
+	}()
+	if err != nil {
+		return err
+	}
+
+	v.playlist.end()
+	return nil
+}
+
+// resetStallTimer restarts the stall timer. It must be called with writeMutex locked.
+func (v *muxerVariantFMP4) resetStallTimer() {
+	if v.stallTimeout <= 0 {
+		return
+	}
+
+	if v.stallTimer == nil {
+		v.stallTimer = time.AfterFunc(v.stallTimeout, v.onStall)
+	} else {
+		v.stallTimer.Reset(v.stallTimeout)
+	}
 }
 
-func (v *muxerVariantFMP4) writeAAC(ntp time.Time, pts time.Duration, au []byte) error {
-	return v.segmenter.writeAAC(ntp, pts, au)
+// onStall is called when no data is written for stallTimeout.
+// It finalizes the current segment, without generating any sample,
+// in order to keep the playlist advancing and resolve blocking requests.
+func (v *muxerVariantFMP4) onStall() {
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	v.mutex.Lock()
+	closed := v.closed
+	v.mutex.Unlock()
+
+	if closed {
+		return
+	}
+
+	v.log(logger.Debug, "no data received in %v, finalizing the current segment", v.stallTimeout)
+
+	err := v.segmenter.finish()
+	if err != nil {
+		v.log(logger.Warn, "unable to finalize the current segment: %v", err)
+	}
 }
 
-func (v *muxerVariantFMP4) file(name string, msn string, part string, skip string) *MuxerFileResponse {
-	if name == "init.mp4" {
+func (v *muxerVariantFMP4) writeH264(
+	ntp time.Time,
+	dts *time.Duration,
+	pts time.Duration,
+	nalus [][]byte,
+	idrPresent bool,
+) error {
+	err := func() error {
+		v.writeMutex.Lock()
+		defer v.writeMutex.Unlock()
+
+		v.resetStallTimer()
+		return v.segmenter.writeH264(ntp, dts, pts, nalus, idrPresent)
+	}()
+
+	// wake up init requests that are waiting for parameters
+	if idrPresent {
+		v.mutex.Lock()
+		v.cond.Broadcast()
+		v.mutex.Unlock()
+	}
+
+	return err
+}
+
+func (v *muxerVariantFMP4) writeMJPEG(ntp time.Time, pts time.Duration, frame []byte) error {
+	// the size of the picture is needed by the init segment
+	width, height, err := jpegSize(frame)
+	if err != nil {
+		return err
+	}
+
+	func() {
 		v.mutex.Lock()
 		defer v.mutex.Unlock()
 
-		var sps []byte
-		var pps []byte
-		if v.videoTrack != nil {
-			sps = v.videoTrack.SafeSPS()
-			pps = v.videoTrack.SafePPS()
+		if width != v.mjpegWidth || height != v.mjpegHeight {
+			v.mjpegWidth = width
+			v.mjpegHeight = height
+
+			// wake up init requests that are waiting for parameters
+			v.cond.Broadcast()
+		}
+	}()
+
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	v.resetStallTimer()
+	return v.segmenter.writeMJPEG(ntp, pts, frame)
+}
+
+func (v *muxerVariantFMP4) writeAudio(ntp time.Time, pts time.Duration, au []byte) error {
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	v.resetStallTimer()
+	return v.segmenter.writeAudio(ntp, pts, au)
+}
+
+func (v *muxerVariantFMP4) reconfigure(partDuration time.Duration, segmentDuration time.Duration) error {
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	// otherwise EXT-X-TARGETDURATION would follow the new segment duration
+	if v.segmenter.targetDuration == 0 {
+		return fmt.Errorf("reconfiguration requires a target duration")
+	}
+
+	// PART-TARGET and PART-HOLD-BACK can't change during a session
+	if v.segmenter.lowLatency && partDuration != v.segmenter.partDuration {
+		return fmt.Errorf("the part duration of the Low-Latency variant can't be changed")
+	}
+
+	err := checkDurations(v.segmenter.lowLatency, segmentDuration, v.segmenter.targetDuration, partDuration)
+	if err != nil {
+		return err
+	}
+
+	v.segmenter.reconfigure(partDuration, segmentDuration)
+
+	v.mutex.Lock()
+	v.segmentDuration = segmentDuration
+	v.mutex.Unlock()
+
+	return nil
+}
+
+func (v *muxerVariantFMP4) setTargetDuration(targetDuration time.Duration) error {
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	err := checkDurations(v.segmenter.lowLatency, v.segmenter.segmentDuration, targetDuration, v.segmenter.partDuration)
+	if err != nil {
+		return err
+	}
+
+	v.segmenter.targetDuration = targetDuration
+	v.playlist.setTargetDuration(targetDuration)
+	return nil
+}
+
+func (v *muxerVariantFMP4) setStallTimeout(stallTimeout time.Duration) {
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	v.stallTimeout = stallTimeout
+}
+
+func (v *muxerVariantFMP4) setSegmentRetention(segmentRetention time.Duration) {
+	v.playlist.setSegmentRetention(segmentRetention)
+}
+
+func (v *muxerVariantFMP4) setFileNames(segmentNames *muxerFileNameTemplate, partNames *muxerFileNameTemplate) {
+	v.writeMutex.Lock()
+	v.segmenter.segmentNames = segmentNames
+	v.writeMutex.Unlock()
+
+	v.playlist.setPartNames(partNames)
+}
+
+func (v *muxerVariantFMP4) setStorage(storage SegmentStorage) {
+	v.writeMutex.Lock()
+	defer v.writeMutex.Unlock()
+
+	v.segmenter.storage = storage
+}
+
+func (v *muxerVariantFMP4) enableCMAF() error {
+	v.writeMutex.Lock()
+	v.segmenter.cmaf = true
+	v.writeMutex.Unlock()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.cmaf = true
+
+	// the init segment may have been generated in advance
+	if v.initContent != nil {
+		initContent, err := v.marshalInit()
+		if err != nil {
+			return err
 		}
+		v.initContent = initContent
+	}
+
+	return nil
+}
+
+func (v *muxerVariantFMP4) enableEncryption(enc *fmp4.Encryption, keyTags string) error {
+	v.writeMutex.Lock()
+	v.segmenter.encryption = enc
+	v.writeMutex.Unlock()
+
+	v.playlist.setKeyTags(keyTags)
 
-		if v.initContent == nil ||
-			(v.videoTrack != nil && (!bytes.Equal(v.videoLastSPS, sps) || !bytes.Equal(v.videoLastPPS, pps))) {
-			init := fmp4.Init{}
-			trackID := 1
-
-			if v.videoTrack != nil {
-				init.Tracks = append(init.Tracks, &fmp4.InitTrack{
-					ID:        trackID,
-					TimeScale: 90000,
-					Format:    v.videoTrack,
-				})
-				trackID++
-			}
-
-			if v.audioTrack != nil {
-				init.Tracks = append(init.Tracks, &fmp4.InitTrack{
-					ID:        trackID,
-					TimeScale: uint32(v.audioTrack.ClockRate()),
-					Format:    v.audioTrack,
-				})
-			}
-
-			initContent, err := init.Marshal()
-			if err != nil {
-				return &MuxerFileResponse{Status: http.StatusInternalServerError}
-			}
-
-			v.videoLastSPS = sps
-			v.videoLastPPS = pps
-			v.initContent = initContent
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.encryption = enc
+
+	// the init segment may have been generated in advance
+	if v.initContent != nil {
+		initContent, err := v.marshalInit()
+		if err != nil {
+			return err
 		}
+		v.initContent = initContent
+	}
+
+	return nil
+}
+
+func (v *muxerVariantFMP4) insertDateRange(d *muxerDateRange) {
+	v.playlist.insertDateRange(d)
+}
+
+func (v *muxerVariantFMP4) enableSegmentValidation() {
+	v.playlist.enableSegmentValidation()
+}
+
+func (v *muxerVariantFMP4) enableSegmentBitrate() {
+	v.playlist.enableSegmentBitrate()
+}
+
+func (v *muxerVariantFMP4) snapshot() (*MuxerSnapshot, error) {
+	return v.playlist.snapshot()
+}
+
+func (v *muxerVariantFMP4) clip(start time.Time, end time.Time) (*MuxerClip, error) {
+	return v.playlist.clip(start, end)
+}
+
+func (v *muxerVariantFMP4) preloadHints() []string {
+	return v.playlist.preloadHints()
+}
+
+func (v *muxerVariantFMP4) bandwidth() (int, int) {
+	return v.playlist.bandwidth()
+}
+
+// videoParamsAvailable checks whether the parameters of the video track,
+// that are needed by the init segment, are available.
+func (v *muxerVariantFMP4) videoParamsAvailable() bool {
+	switch videoTrack := v.videoTrack.(type) {
+	case *format.H264:
+		return videoTrack.SafeSPS() != nil && videoTrack.SafePPS() != nil
+
+	case *format.MJPEG:
+		return v.mjpegWidth != 0
+
+	default:
+		return true
+	}
+}
+
+// updateInit generates the init segment, if it's not been generated yet
+// or if parameters of the video track have changed.
+// It must be called with the mutex locked.
+func (v *muxerVariantFMP4) updateInit() error {
+	var sps []byte
+	var pps []byte
+	if videoTrack, ok := v.videoTrack.(*format.H264); ok {
+		sps = videoTrack.SafeSPS()
+		pps = videoTrack.SafePPS()
+	}
+
+	if v.initContent != nil &&
+		bytes.Equal(v.videoLastSPS, sps) && bytes.Equal(v.videoLastPPS, pps) &&
+		v.videoLastWidth == v.mjpegWidth && v.videoLastHeight == v.mjpegHeight {
+		return nil
+	}
 
-		return &MuxerFileResponse{
-			Status: http.StatusOK,
-			Header: map[string]string{
-				"Content-Type": "video/mp4",
-			},
-			Body: bytes.NewReader(v.initContent),
+	initContent, err := v.marshalInit()
+	if err != nil {
+		return err
+	}
+
+	v.videoLastSPS = sps
+	v.videoLastPPS = pps
+	v.videoLastWidth = v.mjpegWidth
+	v.videoLastHeight = v.mjpegHeight
+	v.initContent = initContent
+
+	return nil
+}
+
+// marshalInit generates an init segment with the current parameters of the tracks.
+// It must be called with the mutex locked.
+func (v *muxerVariantFMP4) marshalInit() ([]byte, error) {
+	init := fmp4.Init{
+		CMAF:       v.cmaf,
+		Encryption: v.encryption,
+	}
+	trackID := 1
+
+	if v.videoTrack != nil {
+		init.Tracks = append(init.Tracks, &fmp4.InitTrack{
+			ID:        trackID,
+			TimeScale: 90000,
+			Format:    v.videoTrack,
+			Width:     v.mjpegWidth,
+			Height:    v.mjpegHeight,
+		})
+		trackID++
+	}
+
+	if v.audioTrack != nil {
+		init.Tracks = append(init.Tracks, &fmp4.InitTrack{
+			ID:        trackID,
+			TimeScale: uint32(v.audioTrack.ClockRate()),
+			Format:    v.audioTrack,
+		})
+	}
+
+	return init.Marshal()
+}
+
+// genInit generates an init segment that is used by the segments that are created
+// until the parameters of the video track change again.
+// It is called by the segmenter when an init segment is generated per discontinuity.
+func (v *muxerVariantFMP4) genInit() (*muxerVariantFMP4Init, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	content, err := v.marshalInit()
+	if err != nil {
+		return nil, err
+	}
+
+	init := &muxerVariantFMP4Init{
+		name:    "init" + strconv.FormatUint(v.nextInitID, 10) + ".mp4",
+		content: content,
+	}
+	v.nextInitID++
+
+	return init, nil
+}
+
+// waitVideoParams waits until parameters of the video track are available,
+// for at most a segment duration, since they're sent with the first IDR.
+// It must be called with the mutex locked.
+func (v *muxerVariantFMP4) waitVideoParams() bool {
+	timedOut := false
+	timer := time.AfterFunc(v.segmentDuration, func() {
+		v.mutex.Lock()
+		timedOut = true
+		v.mutex.Unlock()
+
+		v.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	for !v.closed && !timedOut && !v.videoParamsAvailable() {
+		v.cond.Wait()
+	}
+
+	return v.videoParamsAvailable()
+}
+
+func (v *muxerVariantFMP4) initReader() *MuxerFileResponse {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	// parameters are not available yet: they may be sent in-band.
+	if !v.waitVideoParams() {
+		if v.closed {
+			return NewMuxerFileResponseError(http.StatusInternalServerError)
 		}
+		return NewMuxerFileResponseError(http.StatusServiceUnavailable)
+	}
+
+	err := v.updateInit()
+	if err != nil {
+		return NewMuxerFileResponseError(http.StatusInternalServerError)
+	}
+
+	return &MuxerFileResponse{
+		Status: http.StatusOK,
+		Header: map[string]string{
+			"Content-Type": "video/mp4",
+		},
+		Body: bytes.NewReader(v.initContent),
+	}
+}
+
+func (v *muxerVariantFMP4) file(name string, msn string, part string, skip string) *MuxerFileResponse {
+	if name == "init.mp4" {
+		return v.initReader()
 	}
 
 	return v.playlist.file(name, msn, part, skip)
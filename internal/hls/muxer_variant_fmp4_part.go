@@ -1,46 +1,67 @@
 package hls
 
 import (
-	"bytes"
 	"io"
-	"strconv"
 	"time"
 
-	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 
 	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
 )
 
-func fmp4PartName(id uint64) string {
-	return "part" + strconv.FormatUint(id, 10)
-}
-
 type muxerVariantFMP4Part struct {
-	videoTrack *format.H264
-	audioTrack *format.MPEG4Audio
-	id         uint64
+	producerReferenceTime bool
+	cmaf                  bool
+	fragmentDuration      time.Duration
+	interleaveFragments   bool
+	encryption            *fmp4.Encryption
+	videoTrack            format.Format
+	audioTrack            format.Format
+	init                  *muxerVariantFMP4Init
+	id                    uint64
+	file                  SegmentStorageFile
+	genSequenceNumber     func() uint32
 
 	isIndependent       bool
+	writtenDuration     time.Duration
 	videoSamples        []*fmp4.PartSample
 	audioSamples        []*fmp4.PartSample
-	content             []byte
+	offset              uint64
+	size                uint64
 	renderedDuration    time.Duration
 	videoStartDTSFilled bool
 	videoStartDTS       time.Duration
+	videoStartNTP       time.Time
 	audioStartDTSFilled bool
 	audioStartDTS       time.Duration
+	audioStartNTP       time.Time
 }
 
 func newMuxerVariantFMP4Part(
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	producerReferenceTime bool,
+	cmaf bool,
+	fragmentDuration time.Duration,
+	interleaveFragments bool,
+	encryption *fmp4.Encryption,
+	videoTrack format.Format,
+	audioTrack format.Format,
+	init *muxerVariantFMP4Init,
 	id uint64,
+	file SegmentStorageFile,
+	genSequenceNumber func() uint32,
 ) *muxerVariantFMP4Part {
 	p := &muxerVariantFMP4Part{
-		videoTrack: videoTrack,
-		audioTrack: audioTrack,
-		id:         id,
+		producerReferenceTime: producerReferenceTime,
+		cmaf:                  cmaf,
+		fragmentDuration:      fragmentDuration,
+		interleaveFragments:   interleaveFragments,
+		encryption:            encryption,
+		videoTrack:            videoTrack,
+		audioTrack:            audioTrack,
+		init:                  init,
+		id:                    id,
+		file:                  file,
+		genSequenceNumber:     genSequenceNumber,
 	}
 
 	if videoTrack == nil {
@@ -50,15 +71,23 @@ func newMuxerVariantFMP4Part(
 	return p
 }
 
-func (p *muxerVariantFMP4Part) name() string {
-	return fmp4PartName(p.id)
+func (p *muxerVariantFMP4Part) reader() io.ReadCloser {
+	return p.file.Reader(p.offset, p.size)
 }
 
-func (p *muxerVariantFMP4Part) reader() io.Reader {
-	return bytes.NewReader(p.content)
+func (p *muxerVariantFMP4Part) validate() error {
+	r := p.reader()
+	defer r.Close()
+
+	return validateMP4(r, p.size)
 }
 
 func (p *muxerVariantFMP4Part) duration() time.Duration {
+	return p.writtenDuration + p.pendingDuration()
+}
+
+// pendingDuration returns the duration of the samples that have not been written yet.
+func (p *muxerVariantFMP4Part) pendingDuration() time.Duration {
 	if p.videoTrack != nil {
 		ret := uint64(0)
 		for _, e := range p.videoSamples {
@@ -67,74 +96,188 @@ func (p *muxerVariantFMP4Part) duration() time.Duration {
 		return durationMp4ToGo(ret, 90000)
 	}
 
+	// LPCM frames don't have a default duration
+	if _, ok := p.audioTrack.(*format.LPCM); ok {
+		ret := uint64(0)
+		for _, e := range p.audioSamples {
+			ret += uint64(e.Duration)
+		}
+		return durationMp4ToGo(ret, uint32(p.audioTrack.ClockRate()))
+	}
+
 	// use the sum of the default duration of all samples,
 	// not the real duration,
 	// otherwise on iPhone iOS the stream freezes.
 	return time.Duration(len(p.audioSamples)) * time.Second *
-		time.Duration(mpeg4audio.SamplesPerAccessUnit) / time.Duration(p.audioTrack.ClockRate())
+		time.Duration(audioSamplesPerAU(p.audioTrack)) / time.Duration(p.audioTrack.ClockRate())
 }
 
-func (p *muxerVariantFMP4Part) finalize() error {
-	if p.videoSamples != nil || p.audioSamples != nil {
-		part := fmp4.Part{}
-
-		if p.videoSamples != nil {
-			part.Tracks = append(part.Tracks, &fmp4.PartTrack{
-				ID:       1,
-				BaseTime: durationGoToMp4(p.videoStartDTS, 90000),
-				Samples:  p.videoSamples,
-				IsVideo:  true,
-			})
+// writeFragment writes pending samples into a fragment (a moof and a mdat box)
+// and appends it to the file of the segment.
+// A part is made of one or more fragments.
+// When fragments are interleaved, the samples of each track are written into a separate fragment,
+// and fragments are sorted by decode time.
+func (p *muxerVariantFMP4Part) writeFragment() error {
+	if p.videoSamples == nil && p.audioSamples == nil {
+		return nil
+	}
+
+	var videoTrack *fmp4.PartTrack
+	if p.videoSamples != nil {
+		videoTrack = &fmp4.PartTrack{
+			ID:       1,
+			BaseTime: durationGoToMp4(p.videoStartDTS, 90000),
+			Samples:  p.videoSamples,
+			IsVideo:  true,
+		}
+	}
+
+	var audioTrack *fmp4.PartTrack
+	if p.audioSamples != nil {
+		var id int
+		if p.videoTrack != nil {
+			id = 2
+		} else {
+			id = 1
 		}
 
-		if p.audioSamples != nil {
-			var id int
-			if p.videoTrack != nil {
-				id = 2
-			} else {
-				id = 1
-			}
-
-			part.Tracks = append(part.Tracks, &fmp4.PartTrack{
-				ID:       id,
-				BaseTime: durationGoToMp4(p.audioStartDTS, uint32(p.audioTrack.ClockRate())),
-				Samples:  p.audioSamples,
-			})
+		audioTrack = &fmp4.PartTrack{
+			ID:       id,
+			BaseTime: durationGoToMp4(p.audioStartDTS, uint32(p.audioTrack.ClockRate())),
+			Samples:  p.audioSamples,
+		}
+	}
+
+	var content []byte
+
+	switch {
+	case p.interleaveFragments && videoTrack != nil && audioTrack != nil:
+		videoContent, err := p.marshalFragment([]*fmp4.PartTrack{videoTrack}, p.videoStartNTP)
+		if err != nil {
+			return err
+		}
+
+		audioContent, err := p.marshalFragment([]*fmp4.PartTrack{audioTrack}, p.audioStartNTP)
+		if err != nil {
+			return err
+		}
+
+		if p.audioStartDTS < p.videoStartDTS {
+			content = append(audioContent, videoContent...)
+		} else {
+			content = append(videoContent, audioContent...)
+		}
+
+	case videoTrack != nil:
+		tracks := []*fmp4.PartTrack{videoTrack}
+		if audioTrack != nil {
+			tracks = append(tracks, audioTrack)
 		}
 
 		var err error
-		p.content, err = part.Marshal()
+		content, err = p.marshalFragment(tracks, p.videoStartNTP)
 		if err != nil {
 			return err
 		}
 
-		p.renderedDuration = p.duration()
+	default:
+		var err error
+		content, err = p.marshalFragment([]*fmp4.PartTrack{audioTrack}, p.audioStartNTP)
+		if err != nil {
+			return err
+		}
+	}
+
+	// parts are appended to the file of the segment
+	if p.size == 0 {
+		p.offset = p.file.Size()
+	}
+	_, err := p.file.Write(content)
+	if err != nil {
+		return err
 	}
+	p.size += uint64(len(content))
+
+	p.writtenDuration += p.pendingDuration()
 
 	p.videoSamples = nil
 	p.audioSamples = nil
+	p.videoStartDTSFilled = false
+	p.audioStartDTSFilled = false
+
+	return nil
+}
+
+// marshalFragment encodes a fragment that contains the given tracks.
+// ntp is the NTP time of the first sample of the first track.
+func (p *muxerVariantFMP4Part) marshalFragment(tracks []*fmp4.PartTrack, ntp time.Time) ([]byte, error) {
+	part := fmp4.Part{
+		Tracks:     tracks,
+		Encryption: p.encryption,
+	}
+
+	// CMAF requires sequence numbers to start from 1 and to increase
+	if p.cmaf {
+		part.SequenceNumber = p.genSequenceNumber()
+	}
+
+	// reference the first sample of the first track
+	if p.producerReferenceTime {
+		part.ProducerReferenceTime = &fmp4.PartProducerReferenceTime{
+			TrackID:   tracks[0].ID,
+			NTP:       ntp,
+			MediaTime: tracks[0].BaseTime,
+		}
+	}
+
+	return part.Marshal()
+}
+
+func (p *muxerVariantFMP4Part) finalize() error {
+	err := p.writeFragment()
+	if err != nil {
+		return err
+	}
+
+	p.renderedDuration = p.writtenDuration
 
 	return nil
 }
 
-func (p *muxerVariantFMP4Part) writeH264(sample *augmentedVideoSample) {
+func (p *muxerVariantFMP4Part) writeVideo(sample *augmentedVideoSample) error {
 	if !p.videoStartDTSFilled {
 		p.videoStartDTSFilled = true
 		p.videoStartDTS = sample.dts
-	}
+		p.videoStartNTP = sample.ntp
 
-	if !sample.IsNonSyncSample {
-		p.isIndependent = true
+		// a part is independent only if it can be decoded on its own
+		if p.size == 0 {
+			p.isIndependent = !sample.IsNonSyncSample
+		}
 	}
 
 	p.videoSamples = append(p.videoSamples, &sample.PartSample)
+
+	if p.fragmentDuration > 0 && p.pendingDuration() >= p.fragmentDuration {
+		return p.writeFragment()
+	}
+
+	return nil
 }
 
-func (p *muxerVariantFMP4Part) writeAAC(sample *augmentedAudioSample) {
+func (p *muxerVariantFMP4Part) writeAudio(sample *augmentedAudioSample) error {
 	if !p.audioStartDTSFilled {
 		p.audioStartDTSFilled = true
 		p.audioStartDTS = sample.dts
+		p.audioStartNTP = sample.ntp
 	}
 
 	p.audioSamples = append(p.audioSamples, &sample.PartSample)
+
+	// when there's a video track, fragments are cut on video samples
+	if p.videoTrack == nil && p.fragmentDuration > 0 && p.pendingDuration() >= p.fragmentDuration {
+		return p.writeFragment()
+	}
+
+	return nil
 }
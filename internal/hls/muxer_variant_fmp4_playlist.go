@@ -2,6 +2,7 @@ package hls
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"math"
 	"net/http"
@@ -25,8 +26,8 @@ func (g muxerVariantFMP4Gap) getRenderedDuration() time.Duration {
 	return g.renderedDuration
 }
 
-func targetDuration(segments []muxerVariantFMP4SegmentOrGap) uint {
-	ret := uint(0)
+func targetDuration(segments []muxerVariantFMP4SegmentOrGap, pinned time.Duration) uint {
+	ret := uint(pinned / time.Second)
 
 	// EXTINF, when rounded to the nearest integer, must be <= EXT-X-TARGETDURATION
 	for _, sog := range segments {
@@ -67,38 +68,60 @@ func partTargetDuration(
 	return ret
 }
 
+// maximum number of blocking requests that can be pending at the same time.
+const muxerVariantFMP4MaxPendingRequests = 64
+
 type muxerVariantFMP4Playlist struct {
-	lowLatency   bool
-	segmentCount int
-	videoTrack   *format.H264
-	audioTrack   *format.MPEG4Audio
+	lowLatency     bool
+	segmentCount   int
+	targetDuration time.Duration
+	partDuration   time.Duration
+	retention      *muxerRetention
+	partNames      *muxerFileNameTemplate
+	videoTrack     format.Format
+	audioTrack     format.Format
 
 	mutex              sync.Mutex
 	cond               *sync.Cond
 	closed             bool
+	ended              bool
 	segments           []muxerVariantFMP4SegmentOrGap
 	segmentsByName     map[string]*muxerVariantFMP4Segment
 	segmentDeleteCount int
+	discontinuityCount int
+	initsByName        map[string]*muxerVariantFMP4Init
+	dateRanges         muxerDateRanges
 	parts              []*muxerVariantFMP4Part
 	partsByName        map[string]*muxerVariantFMP4Part
 	nextSegmentID      uint64
 	nextSegmentParts   []*muxerVariantFMP4Part
 	nextPartID         uint64
+	pendingRequests    int
+	validateSegments   bool
+	segmentBitrate     bool
+	keyTags            string
 }
 
 func newMuxerVariantFMP4Playlist(
 	lowLatency bool,
 	segmentCount int,
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	partDuration time.Duration,
+	segmentRetention time.Duration,
+	partNames *muxerFileNameTemplate,
+	videoTrack format.Format,
+	audioTrack format.Format,
 ) *muxerVariantFMP4Playlist {
 	p := &muxerVariantFMP4Playlist{
 		lowLatency:     lowLatency,
 		segmentCount:   segmentCount,
+		partDuration:   partDuration,
+		retention:      newMuxerRetention(segmentRetention),
+		partNames:      partNames,
 		videoTrack:     videoTrack,
 		audioTrack:     audioTrack,
 		segmentsByName: make(map[string]*muxerVariantFMP4Segment),
 		partsByName:    make(map[string]*muxerVariantFMP4Part),
+		initsByName:    make(map[string]*muxerVariantFMP4Init),
 	}
 	p.cond = sync.NewCond(&p.mutex)
 
@@ -115,7 +138,22 @@ func (p *muxerVariantFMP4Playlist) close() {
 	p.cond.Broadcast()
 }
 
+// end marks the playlist as complete.
+func (p *muxerVariantFMP4Playlist) end() {
+	func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.ended = true
+	}()
+
+	p.cond.Broadcast()
+}
+
 func (p *muxerVariantFMP4Playlist) hasContent() bool {
+	// a complete playlist doesn't change anymore
+	if p.ended {
+		return true
+	}
 	if p.lowLatency {
 		return len(p.segments) >= 1
 	}
@@ -160,6 +198,50 @@ func (p *muxerVariantFMP4Playlist) hasPart(segmentID uint64, partID uint64) bool
 	return true
 }
 
+// blocking requests are released after three times the part target duration,
+// in order not to accumulate requests of players that stopped fetching parts.
+func (p *muxerVariantFMP4Playlist) blockingRequestTimeout() time.Duration {
+	ret := partTargetDuration(p.segments, p.nextSegmentParts)
+	if ret < p.partDuration {
+		ret = p.partDuration
+	}
+	return 3 * ret
+}
+
+// waitBlockingRequest waits until cond() is true or the playlist is closed or complete.
+// It must be called with the mutex locked.
+// It returns false when the request timed out or when there are too many pending requests.
+func (p *muxerVariantFMP4Playlist) waitBlockingRequest(cond func() bool) bool {
+	if p.closed || p.ended || cond() {
+		return true
+	}
+
+	if p.pendingRequests >= muxerVariantFMP4MaxPendingRequests {
+		return false
+	}
+
+	p.pendingRequests++
+	defer func() {
+		p.pendingRequests--
+	}()
+
+	timedOut := false
+	timer := time.AfterFunc(p.blockingRequestTimeout(), func() {
+		p.mutex.Lock()
+		timedOut = true
+		p.mutex.Unlock()
+
+		p.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	for !p.closed && !p.ended && !timedOut && !cond() {
+		p.cond.Wait()
+	}
+
+	return p.closed || p.ended || cond()
+}
+
 func (p *muxerVariantFMP4Playlist) file(name string, msn string, part string, skip string) *MuxerFileResponse {
 	switch {
 	case name == "stream.m3u8":
@@ -169,10 +251,27 @@ func (p *muxerVariantFMP4Playlist) file(name string, msn string, part string, sk
 		return p.segmentReader(name)
 
 	default:
-		return &MuxerFileResponse{Status: http.StatusNotFound}
+		return NewMuxerFileResponseError(http.StatusNotFound)
 	}
 }
 
+func (p *muxerVariantFMP4Playlist) bandwidth() (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var sizes []uint64
+	var durations []time.Duration
+
+	for _, sog := range p.segments {
+		if seg, ok := sog.(*muxerVariantFMP4Segment); ok {
+			sizes = append(sizes, seg.renderedSize)
+			durations = append(durations, seg.renderedDuration)
+		}
+	}
+
+	return bandwidth(sizes, durations)
+}
+
 func (p *muxerVariantFMP4Playlist) playlistReader(msn string, part string, skip string) *MuxerFileResponse {
 	isDeltaUpdate := false
 
@@ -184,7 +283,7 @@ func (p *muxerVariantFMP4Playlist) playlistReader(msn string, part string, skip
 			var err error
 			msnint, err = strconv.ParseUint(msn, 10, 64)
 			if err != nil {
-				return &MuxerFileResponse{Status: http.StatusBadRequest}
+				return NewMuxerFileResponseError(http.StatusBadRequest)
 			}
 		}
 
@@ -193,7 +292,7 @@ func (p *muxerVariantFMP4Playlist) playlistReader(msn string, part string, skip
 			var err error
 			partint, err = strconv.ParseUint(part, 10, 64)
 			if err != nil {
-				return &MuxerFileResponse{Status: http.StatusBadRequest}
+				return NewMuxerFileResponseError(http.StatusBadRequest)
 			}
 		}
 
@@ -207,15 +306,20 @@ func (p *muxerVariantFMP4Playlist) playlistReader(msn string, part string, skip
 			// Advance Part Limit, then the server SHOULD immediately return Bad
 			// Request, such as HTTP 400.
 			if msnint > (p.nextSegmentID + 1) {
-				return &MuxerFileResponse{Status: http.StatusBadRequest}
+				return NewMuxerFileResponseError(http.StatusBadRequest)
 			}
 
-			for !p.closed && !p.hasPart(msnint, partint) {
-				p.cond.Wait()
-			}
+			ok := p.waitBlockingRequest(func() bool {
+				return p.hasPart(msnint, partint)
+			})
 
 			if p.closed {
-				return &MuxerFileResponse{Status: http.StatusInternalServerError}
+				return NewMuxerFileResponseError(http.StatusInternalServerError)
+			}
+
+			// the request timed out or was rejected: return the current playlist, if available
+			if !ok && !p.hasContent() {
+				return NewMuxerFileResponseError(http.StatusServiceUnavailable)
 			}
 
 			return &MuxerFileResponse{
@@ -229,7 +333,7 @@ func (p *muxerVariantFMP4Playlist) playlistReader(msn string, part string, skip
 
 		// part without msn is not supported.
 		if part != "" {
-			return &MuxerFileResponse{Status: http.StatusBadRequest}
+			return NewMuxerFileResponseError(http.StatusBadRequest)
 		}
 	}
 
@@ -241,7 +345,7 @@ func (p *muxerVariantFMP4Playlist) playlistReader(msn string, part string, skip
 	}
 
 	if p.closed {
-		return &MuxerFileResponse{Status: http.StatusInternalServerError}
+		return NewMuxerFileResponseError(http.StatusInternalServerError)
 	}
 
 	return &MuxerFileResponse{
@@ -257,7 +361,7 @@ func (p *muxerVariantFMP4Playlist) fullPlaylist(isDeltaUpdate bool) io.Reader {
 	cnt := "#EXTM3U\n"
 	cnt += "#EXT-X-VERSION:9\n"
 
-	targetDuration := targetDuration(p.segments)
+	targetDuration := targetDuration(p.segments, p.targetDuration)
 	cnt += "#EXT-X-TARGETDURATION:" + strconv.FormatUint(uint64(targetDuration), 10) + "\n"
 
 	skipBoundary := float64(targetDuration * 6)
@@ -290,10 +394,17 @@ func (p *muxerVariantFMP4Playlist) fullPlaylist(isDeltaUpdate bool) io.Reader {
 
 	cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(p.segmentDeleteCount), 10) + "\n"
 
+	if p.discontinuityCount != 0 {
+		cnt += "#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.FormatInt(int64(p.discontinuityCount), 10) + "\n"
+	}
+
+	// keys apply to all segments, including skipped ones
+	cnt += p.keyTags
+
 	skipped := 0
 
 	if !isDeltaUpdate {
-		cnt += "#EXT-X-MAP:URI=\"init.mp4\"\n"
+		cnt += "#EXT-X-MAP:URI=\"" + p.firstInitName() + "\"\n"
 	} else {
 		var curDuration time.Duration
 		shown := 0
@@ -308,13 +419,38 @@ func (p *muxerVariantFMP4Playlist) fullPlaylist(isDeltaUpdate bool) io.Reader {
 		cnt += "#EXT-X-SKIP:SKIPPED-SEGMENTS=" + strconv.FormatInt(int64(skipped), 10) + "\n"
 	}
 
+	dri := 0
+	var lastInit *muxerVariantFMP4Init
+
 	for i, sog := range p.segments {
+		// the init segment of skipped segments is tracked too,
+		// since it is the one in use at the first segment that is shown.
 		if i < skipped {
+			if seg, ok := sog.(*muxerVariantFMP4Segment); ok {
+				lastInit = seg.init
+			}
 			continue
 		}
 
 		switch seg := sog.(type) {
 		case *muxerVariantFMP4Segment:
+			if initChanged(lastInit, seg.init) {
+				cnt += "#EXT-X-DISCONTINUITY\n" +
+					"#EXT-X-MAP:URI=\"" + seg.init.name + "\"\n"
+			}
+			lastInit = seg.init
+
+			// place date ranges before the segment that contains their start date.
+			// date ranges of skipped segments are placed before the first segment.
+			for ; dri < len(p.dateRanges) &&
+				p.dateRanges[dri].start.Before(seg.startTime.Add(seg.renderedDuration)); dri++ {
+				cnt += p.dateRanges[dri].marshal()
+			}
+
+			if p.segmentBitrate {
+				cnt += "#EXT-X-BITRATE:" + strconv.FormatInt(int64(seg.bitrate()/1000), 10) + "\n"
+			}
+
 			if (len(p.segments) - i) <= 2 {
 				cnt += "#EXT-X-PROGRAM-DATE-TIME:" + seg.startTime.Format("2006-01-02T15:04:05.999Z07:00") + "\n"
 			}
@@ -322,7 +458,7 @@ func (p *muxerVariantFMP4Playlist) fullPlaylist(isDeltaUpdate bool) io.Reader {
 			if p.lowLatency && (len(p.segments)-i) <= 2 {
 				for _, part := range seg.parts {
 					cnt += "#EXT-X-PART:DURATION=" + strconv.FormatFloat(part.renderedDuration.Seconds(), 'f', 5, 64) +
-						",URI=\"" + part.name() + ".mp4\""
+						",URI=\"" + p.partNames.name(part.id) + ".mp4\""
 					if part.isIndependent {
 						cnt += ",INDEPENDENT=YES"
 					}
@@ -340,10 +476,19 @@ func (p *muxerVariantFMP4Playlist) fullPlaylist(isDeltaUpdate bool) io.Reader {
 		}
 	}
 
+	for ; dri < len(p.dateRanges); dri++ {
+		cnt += p.dateRanges[dri].marshal()
+	}
+
 	if p.lowLatency {
+		if len(p.nextSegmentParts) != 0 && initChanged(lastInit, p.nextSegmentParts[0].init) {
+			cnt += "#EXT-X-DISCONTINUITY\n" +
+				"#EXT-X-MAP:URI=\"" + p.nextSegmentParts[0].init.name + "\"\n"
+		}
+
 		for _, part := range p.nextSegmentParts {
 			cnt += "#EXT-X-PART:DURATION=" + strconv.FormatFloat(part.renderedDuration.Seconds(), 'f', 5, 64) +
-				",URI=\"" + part.name() + ".mp4\""
+				",URI=\"" + p.partNames.name(part.id) + ".mp4\""
 			if part.isIndependent {
 				cnt += ",INDEPENDENT=YES"
 			}
@@ -351,24 +496,86 @@ func (p *muxerVariantFMP4Playlist) fullPlaylist(isDeltaUpdate bool) io.Reader {
 		}
 
 		// preload hint must always be present
-		// otherwise hls.js goes into a loop
-		cnt += "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + fmp4PartName(p.nextPartID) + ".mp4\"\n"
+		// otherwise hls.js goes into a loop.
+		// A complete playlist has no next part.
+		if !p.ended {
+			cnt += "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + p.partNames.name(p.nextPartID) + ".mp4\"\n"
+		}
+	}
+
+	if p.ended {
+		cnt += "#EXT-X-ENDLIST\n"
 	}
 
 	return bytes.NewReader([]byte(cnt))
 }
 
+// initChanged checks whether a segment uses a different init segment than the previous one,
+// that happens when an init segment is generated per discontinuity.
+func initChanged(prev *muxerVariantFMP4Init, cur *muxerVariantFMP4Init) bool {
+	return prev != nil && cur != nil && prev != cur
+}
+
+// firstInitName returns the name of the init segment of the first segment of the playlist.
+func (p *muxerVariantFMP4Playlist) firstInitName() string {
+	for _, sog := range p.segments {
+		if seg, ok := sog.(*muxerVariantFMP4Segment); ok && seg.init != nil {
+			return seg.init.name
+		}
+	}
+
+	if len(p.nextSegmentParts) != 0 && p.nextSegmentParts[0].init != nil {
+		return p.nextSegmentParts[0].init.name
+	}
+
+	return "init.mp4"
+}
+
+// initInUse checks whether an init segment is used by a segment that is still available.
+func (p *muxerVariantFMP4Playlist) initInUse(init *muxerVariantFMP4Init) bool {
+	for _, seg := range p.segmentsByName {
+		if seg.init == init {
+			return true
+		}
+	}
+
+	for _, part := range p.nextSegmentParts {
+		if part.init == init {
+			return true
+		}
+	}
+
+	return false
+}
+
+// preloadHints returns the parts that are advertised with EXT-X-PRELOAD-HINT.
+func (p *muxerVariantFMP4Playlist) preloadHints() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.lowLatency || p.closed || p.ended {
+		return nil
+	}
+
+	return []string{p.partNames.name(p.nextPartID) + ".mp4"}
+}
+
 func (p *muxerVariantFMP4Playlist) segmentReader(fname string) *MuxerFileResponse {
-	switch {
-	case strings.HasPrefix(fname, "seg"):
-		base := strings.TrimSuffix(fname, ".mp4")
+	base := strings.TrimSuffix(fname, ".mp4")
 
-		p.mutex.Lock()
-		segment, ok := p.segmentsByName[base]
-		p.mutex.Unlock()
+	p.mutex.Lock()
+	segment, segmentOK := p.segmentsByName[base]
+	part, partOK := p.partsByName[base]
+	init, initOK := p.initsByName[fname]
+	nextPartID := p.nextPartID
+	validate := p.validateSegments
+	p.mutex.Unlock()
 
-		if !ok {
-			return &MuxerFileResponse{Status: http.StatusNotFound}
+	switch {
+	case segmentOK:
+		// do not serve segments that have been corrupted or truncated by the storage
+		if validate && segment.validate() != nil {
+			return NewMuxerFileResponseError(http.StatusNotFound)
 		}
 
 		return &MuxerFileResponse{
@@ -379,57 +586,64 @@ func (p *muxerVariantFMP4Playlist) segmentReader(fname string) *MuxerFileRespons
 			Body: segment.reader(),
 		}
 
-	case strings.HasPrefix(fname, "part"):
-		base := strings.TrimSuffix(fname, ".mp4")
+	case partOK:
+		if validate && part.validate() != nil {
+			return NewMuxerFileResponseError(http.StatusNotFound)
+		}
 
-		p.mutex.Lock()
-		part, ok := p.partsByName[base]
-		nextPartID := p.nextPartID
-		p.mutex.Unlock()
+		return &MuxerFileResponse{
+			Status: http.StatusOK,
+			Header: map[string]string{
+				"Content-Type": "video/mp4",
+			},
+			Body: part.reader(),
+		}
 
-		if ok {
-			return &MuxerFileResponse{
-				Status: http.StatusOK,
-				Header: map[string]string{
-					"Content-Type": "video/mp4",
-				},
-				Body: part.reader(),
-			}
+	case initOK:
+		return &MuxerFileResponse{
+			Status: http.StatusOK,
+			Header: map[string]string{
+				"Content-Type": "video/mp4",
+			},
+			Body: bytes.NewReader(init.content),
 		}
 
-		if fname == fmp4PartName(p.nextPartID) {
-			p.mutex.Lock()
-			defer p.mutex.Unlock()
+	case base == p.partNames.name(nextPartID):
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
 
-			for {
-				if p.closed {
-					break
-				}
+		ok := p.waitBlockingRequest(func() bool {
+			return p.nextPartID > nextPartID
+		})
 
-				if p.nextPartID > nextPartID {
-					break
-				}
+		if p.closed {
+			return NewMuxerFileResponseError(http.StatusInternalServerError)
+		}
 
-				p.cond.Wait()
-			}
+		if !ok {
+			return NewMuxerFileResponseError(http.StatusServiceUnavailable)
+		}
 
-			if p.closed {
-				return &MuxerFileResponse{Status: http.StatusInternalServerError}
-			}
+		// the playlist has been completed before the part was generated
+		part, ok := p.partsByName[p.partNames.name(nextPartID)]
+		if !ok {
+			return NewMuxerFileResponseError(http.StatusNotFound)
+		}
 
-			return &MuxerFileResponse{
-				Status: http.StatusOK,
-				Header: map[string]string{
-					"Content-Type": "video/mp4",
-				},
-				Body: p.partsByName[fmp4PartName(nextPartID)].reader(),
-			}
+		if validate && part.validate() != nil {
+			return NewMuxerFileResponseError(http.StatusNotFound)
 		}
 
-		return &MuxerFileResponse{Status: http.StatusNotFound}
+		return &MuxerFileResponse{
+			Status: http.StatusOK,
+			Header: map[string]string{
+				"Content-Type": "video/mp4",
+			},
+			Body: part.reader(),
+		}
 
 	default:
-		return &MuxerFileResponse{Status: http.StatusNotFound}
+		return NewMuxerFileResponseError(http.StatusNotFound)
 	}
 }
 
@@ -448,36 +662,123 @@ func (p *muxerVariantFMP4Playlist) onSegmentFinalized(segment *muxerVariantFMP4S
 		}
 
 		p.segmentsByName[segment.name] = segment
+		if segment.init != nil {
+			p.initsByName[segment.init.name] = segment.init
+		}
 		p.segments = append(p.segments, segment)
 		p.nextSegmentID = segment.id + 1
 		p.nextSegmentParts = p.nextSegmentParts[:0]
 
+		now := time.Now()
+		p.retention.purge(now)
+
 		if len(p.segments) > p.segmentCount {
 			toDelete := p.segments[0]
 
 			if toDeleteSeg, ok := toDelete.(*muxerVariantFMP4Segment); ok {
-				for _, part := range toDeleteSeg.parts {
-					delete(p.partsByName, part.name())
-				}
 				p.parts = p.parts[len(toDeleteSeg.parts):]
 
-				delete(p.segmentsByName, toDeleteSeg.name)
+				p.retention.add(now, func() {
+					for _, part := range toDeleteSeg.parts {
+						delete(p.partsByName, p.partNames.name(part.id))
+					}
+					delete(p.segmentsByName, toDeleteSeg.name)
+					toDeleteSeg.file.Remove()
+
+					// an init segment is deleted together with the last segment that uses it
+					if toDeleteSeg.init != nil && !p.initInUse(toDeleteSeg.init) {
+						delete(p.initsByName, toDeleteSeg.init.name)
+					}
+				})
 			}
 
 			p.segments = p.segments[1:]
 			p.segmentDeleteCount++
+
+			// the discontinuity that precedes the new first segment is not shown anymore
+			if toDeleteSeg, ok := toDelete.(*muxerVariantFMP4Segment); ok {
+				if seg, ok := p.segments[0].(*muxerVariantFMP4Segment); ok && initChanged(toDeleteSeg.init, seg.init) {
+					p.discontinuityCount++
+				}
+			}
+
+			for _, sog := range p.segments {
+				if seg, ok := sog.(*muxerVariantFMP4Segment); ok {
+					p.dateRanges = p.dateRanges.purge(seg.startTime)
+					break
+				}
+			}
 		}
 	}()
 
 	p.cond.Broadcast()
 }
 
+func (p *muxerVariantFMP4Playlist) insertDateRange(d *muxerDateRange) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.dateRanges = p.dateRanges.insert(d)
+}
+
+func (p *muxerVariantFMP4Playlist) enableSegmentValidation() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.validateSegments = true
+}
+
+func (p *muxerVariantFMP4Playlist) setSegmentRetention(segmentRetention time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.retention = newMuxerRetention(segmentRetention)
+}
+
+func (p *muxerVariantFMP4Playlist) setPartNames(partNames *muxerFileNameTemplate) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.partNames = partNames
+}
+
+func (p *muxerVariantFMP4Playlist) setTargetDuration(targetDuration time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.targetDuration = targetDuration
+}
+
+func (p *muxerVariantFMP4Playlist) enableSegmentBitrate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.segmentBitrate = true
+}
+
+func (p *muxerVariantFMP4Playlist) setKeyTags(keyTags string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.keyTags = keyTags
+}
+
+func (p *muxerVariantFMP4Playlist) setPartDuration(partDuration time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.partDuration = partDuration
+}
+
 func (p *muxerVariantFMP4Playlist) onPartFinalized(part *muxerVariantFMP4Part) {
 	func() {
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
 
-		p.partsByName[part.name()] = part
+		p.partsByName[p.partNames.name(part.id)] = part
+		if part.init != nil {
+			p.initsByName[part.init.name] = part.init
+		}
 		p.parts = append(p.parts, part)
 		p.nextSegmentParts = append(p.nextSegmentParts, part)
 		p.nextPartID = part.id + 1
@@ -485,3 +786,76 @@ func (p *muxerVariantFMP4Playlist) onPartFinalized(part *muxerVariantFMP4Part) {
 
 	p.cond.Broadcast()
 }
+
+func (p *muxerVariantFMP4Playlist) snapshot() (*MuxerSnapshot, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, fmt.Errorf("muxer is closed")
+	}
+
+	if !p.hasContent() {
+		return nil, fmt.Errorf("no segments are available")
+	}
+
+	var segments []string
+	for _, sog := range p.segments {
+		if seg, ok := sog.(*muxerVariantFMP4Segment); ok {
+			segments = append(segments, seg.name+".mp4")
+		}
+	}
+
+	p.retention.pin()
+
+	return &MuxerSnapshot{
+		Playlist: readSnapshotPlaylist(p.fullPlaylist(false)),
+		Segments: segments,
+		release: func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			p.retention.unpin(time.Now())
+		},
+	}, nil
+}
+
+func (p *muxerVariantFMP4Playlist) clip(start time.Time, end time.Time) (*MuxerClip, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, fmt.Errorf("muxer is closed")
+	}
+
+	// gaps are not included since they don't contain data
+	var segments []muxerClipSegment
+	for _, sog := range p.segments {
+		if seg, ok := sog.(*muxerVariantFMP4Segment); ok {
+			clipSeg := muxerClipSegment{
+				name:      seg.name + ".mp4",
+				startTime: seg.startTime,
+				duration:  seg.renderedDuration,
+				init:      "init.mp4",
+			}
+			if seg.init != nil {
+				clipSeg.init = seg.init.name
+			}
+			segments = append(segments, clipSeg)
+		}
+	}
+
+	c, err := newMuxerClip(segments, start, end, true, p.keyTags)
+	if err != nil {
+		return nil, err
+	}
+
+	p.retention.pin()
+
+	c.release = func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.retention.unpin(time.Now())
+	}
+
+	return c, nil
+}
@@ -3,101 +3,134 @@ package hls
 import (
 	"fmt"
 	"io"
-	"strconv"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/format"
-)
-
-type partsReader struct {
-	parts   []*muxerVariantFMP4Part
-	curPart int
-	curPos  int
-}
-
-func (mbr *partsReader) Read(p []byte) (int, error) {
-	n := 0
-	lenp := len(p)
-
-	for {
-		if mbr.curPart >= len(mbr.parts) {
-			return n, io.EOF
-		}
-
-		copied := copy(p[n:], mbr.parts[mbr.curPart].content[mbr.curPos:])
-		mbr.curPos += copied
-		n += copied
-
-		if mbr.curPos == len(mbr.parts[mbr.curPart].content) {
-			mbr.curPart++
-			mbr.curPos = 0
-		}
 
-		if n == lenp {
-			return n, nil
-		}
-	}
-}
+	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
+)
 
 type muxerVariantFMP4Segment struct {
-	lowLatency      bool
-	id              uint64
-	startTime       time.Time
-	startDTS        time.Duration
-	segmentMaxSize  uint64
-	videoTrack      *format.H264
-	audioTrack      *format.MPEG4Audio
-	genPartID       func() uint64
-	onPartFinalized func(*muxerVariantFMP4Part)
+	lowLatency            bool
+	id                    uint64
+	startTime             time.Time
+	startDTS              time.Duration
+	segmentMaxSize        uint64
+	storage               SegmentStorage
+	producerReferenceTime bool
+	cmaf                  bool
+	fragmentDuration      time.Duration
+	interleaveFragments   bool
+	encryption            *fmp4.Encryption
+	videoTrack            format.Format
+	audioTrack            format.Format
+	init                  *muxerVariantFMP4Init
+	genPartID             func() uint64
+	genSequenceNumber     func() uint32
+	onPartFinalized       func(*muxerVariantFMP4Part)
 
 	name             string
+	file             SegmentStorageFile
 	size             uint64
 	parts            []*muxerVariantFMP4Part
 	currentPart      *muxerVariantFMP4Part
 	renderedDuration time.Duration
+	renderedSize     uint64
 }
 
 func newMuxerVariantFMP4Segment(
 	lowLatency bool,
 	id uint64,
+	names *muxerFileNameTemplate,
 	startTime time.Time,
 	startDTS time.Duration,
 	segmentMaxSize uint64,
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	storage SegmentStorage,
+	producerReferenceTime bool,
+	cmaf bool,
+	fragmentDuration time.Duration,
+	interleaveFragments bool,
+	encryption *fmp4.Encryption,
+	videoTrack format.Format,
+	audioTrack format.Format,
+	init *muxerVariantFMP4Init,
 	genPartID func() uint64,
+	genSequenceNumber func() uint32,
 	onPartFinalized func(*muxerVariantFMP4Part),
-) *muxerVariantFMP4Segment {
+) (*muxerVariantFMP4Segment, error) {
 	s := &muxerVariantFMP4Segment{
-		lowLatency:      lowLatency,
-		id:              id,
-		startTime:       startTime,
-		startDTS:        startDTS,
-		segmentMaxSize:  segmentMaxSize,
-		videoTrack:      videoTrack,
-		audioTrack:      audioTrack,
-		genPartID:       genPartID,
-		onPartFinalized: onPartFinalized,
-		name:            "seg" + strconv.FormatUint(id, 10),
+		lowLatency:            lowLatency,
+		id:                    id,
+		startTime:             startTime,
+		startDTS:              startDTS,
+		segmentMaxSize:        segmentMaxSize,
+		storage:               storage,
+		producerReferenceTime: producerReferenceTime,
+		cmaf:                  cmaf,
+		fragmentDuration:      fragmentDuration,
+		interleaveFragments:   interleaveFragments,
+		encryption:            encryption,
+		videoTrack:            videoTrack,
+		audioTrack:            audioTrack,
+		init:                  init,
+		genPartID:             genPartID,
+		genSequenceNumber:     genSequenceNumber,
+		onPartFinalized:       onPartFinalized,
+		name:                  names.name(id),
+	}
+
+	var err error
+	s.file, err = storage.Create(s.name + ".mp4")
+	if err != nil {
+		return nil, err
+	}
+
+	// in case of Low-Latency, each part is a CMAF chunk.
+	// segments are chunked too when they're split into fragments.
+	if s.cmaf {
+		_, err = s.file.Write(fmp4.CMAFSegmentType(s.lowLatency || s.fragmentDuration > 0).Marshal())
+		if err != nil {
+			s.file.Remove()
+			return nil, err
+		}
 	}
 
 	s.currentPart = newMuxerVariantFMP4Part(
+		s.producerReferenceTime,
+		s.cmaf,
+		s.fragmentDuration,
+		s.interleaveFragments,
+		s.encryption,
 		s.videoTrack,
 		s.audioTrack,
+		s.init,
 		s.genPartID(),
+		s.file,
+		s.genSequenceNumber,
 	)
 
-	return s
+	return s, nil
 }
 
-func (s *muxerVariantFMP4Segment) reader() io.Reader {
-	return &partsReader{parts: s.parts}
+func (s *muxerVariantFMP4Segment) reader() io.ReadCloser {
+	return s.file.Reader(0, s.renderedSize)
+}
+
+func (s *muxerVariantFMP4Segment) validate() error {
+	r := s.reader()
+	defer r.Close()
+
+	return validateMP4(r, s.renderedSize)
 }
 
 func (s *muxerVariantFMP4Segment) getRenderedDuration() time.Duration {
 	return s.renderedDuration
 }
 
+func (s *muxerVariantFMP4Segment) bitrate() int {
+	return segmentBitrate(s.renderedSize, s.renderedDuration)
+}
+
 func (s *muxerVariantFMP4Segment) finalize(
 	nextVideoSampleDTS time.Duration,
 ) error {
@@ -106,13 +139,15 @@ func (s *muxerVariantFMP4Segment) finalize(
 		return err
 	}
 
-	if s.currentPart.content != nil {
+	if s.currentPart.size != 0 {
 		s.onPartFinalized(s.currentPart)
 		s.parts = append(s.parts, s.currentPart)
 	}
 
 	s.currentPart = nil
 
+	s.renderedSize = s.file.Size()
+
 	if s.videoTrack != nil {
 		s.renderedDuration = nextVideoSampleDTS - s.startDTS
 	} else {
@@ -125,62 +160,86 @@ func (s *muxerVariantFMP4Segment) finalize(
 	return nil
 }
 
-func (s *muxerVariantFMP4Segment) writeH264(sample *augmentedVideoSample, adjustedPartDuration time.Duration) error {
+// exceedsMaxSize checks whether the segment would exceed the maximum size
+// if a sample with the given size was added to it.
+func (s *muxerVariantFMP4Segment) exceedsMaxSize(size uint64) bool {
+	return (s.size + size) > s.segmentMaxSize
+}
+
+func (s *muxerVariantFMP4Segment) writeVideo(sample *augmentedVideoSample, adjustedPartDuration time.Duration) error {
 	size := uint64(len(sample.Payload))
-	if (s.size + size) > s.segmentMaxSize {
+	if s.exceedsMaxSize(size) {
 		return fmt.Errorf("reached maximum segment size")
 	}
 	s.size += size
 
-	s.currentPart.writeH264(sample)
-
-	// switch part
-	if s.lowLatency &&
-		s.currentPart.duration() >= adjustedPartDuration {
-		err := s.currentPart.finalize()
+	// switch part before the sample if the part would exceed the maximum duration
+	sampleDuration := durationMp4ToGo(uint64(sample.Duration), 90000)
+	if s.lowLatency && s.currentPart.duration() != 0 &&
+		(s.currentPart.duration()+sampleDuration) > partMaxDuration(adjustedPartDuration) {
+		err := s.switchPart()
 		if err != nil {
 			return err
 		}
+	}
 
-		s.parts = append(s.parts, s.currentPart)
-		s.onPartFinalized(s.currentPart)
+	err := s.currentPart.writeVideo(sample)
+	if err != nil {
+		return err
+	}
 
-		s.currentPart = newMuxerVariantFMP4Part(
-			s.videoTrack,
-			s.audioTrack,
-			s.genPartID(),
-		)
+	// switch part on the first frame boundary at or after the target duration
+	if s.lowLatency &&
+		s.currentPart.duration() >= adjustedPartDuration {
+		return s.switchPart()
 	}
 
 	return nil
 }
 
-func (s *muxerVariantFMP4Segment) writeAAC(sample *augmentedAudioSample, adjustedPartDuration time.Duration) error {
+func (s *muxerVariantFMP4Segment) writeAudio(sample *augmentedAudioSample, adjustedPartDuration time.Duration) error {
 	size := uint64(len(sample.Payload))
-	if (s.size + size) > s.segmentMaxSize {
+	if s.exceedsMaxSize(size) {
 		return fmt.Errorf("reached maximum segment size")
 	}
 	s.size += size
 
-	s.currentPart.writeAAC(sample)
+	err := s.currentPart.writeAudio(sample)
+	if err != nil {
+		return err
+	}
 
 	// switch part
 	if s.lowLatency && s.videoTrack == nil &&
 		s.currentPart.duration() >= adjustedPartDuration {
-		err := s.currentPart.finalize()
-		if err != nil {
-			return err
-		}
+		return s.switchPart()
+	}
 
-		s.parts = append(s.parts, s.currentPart)
-		s.onPartFinalized(s.currentPart)
+	return nil
+}
 
-		s.currentPart = newMuxerVariantFMP4Part(
-			s.videoTrack,
-			s.audioTrack,
-			s.genPartID(),
-		)
+func (s *muxerVariantFMP4Segment) switchPart() error {
+	err := s.currentPart.finalize()
+	if err != nil {
+		return err
 	}
 
+	s.parts = append(s.parts, s.currentPart)
+	s.onPartFinalized(s.currentPart)
+
+	s.currentPart = newMuxerVariantFMP4Part(
+		s.producerReferenceTime,
+		s.cmaf,
+		s.fragmentDuration,
+		s.interleaveFragments,
+		s.encryption,
+		s.videoTrack,
+		s.audioTrack,
+		s.init,
+		s.genPartID(),
+		s.file,
+		s.genSequenceNumber,
+	)
+
 	return nil
 }
@@ -8,8 +8,12 @@ import (
 	"github.com/aler9/gortsplib/v2/pkg/format"
 
 	"github.com/aler9/rtsp-simple-server/internal/hls/fmp4"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+// maximum time span of audio samples that are held while waiting for the video track.
+const fmp4MaxPendingAudioDuration = 10 * time.Second
+
 func partDurationIsCompatible(partDuration time.Duration, sampleDuration time.Duration) bool {
 	if sampleDuration > partDuration {
 		return false
@@ -24,6 +28,13 @@ func partDurationIsCompatible(partDuration time.Duration, sampleDuration time.Du
 	return partDuration > ((f * 85) / 100)
 }
 
+// partMaxDuration returns the duration that a part must never exceed.
+// Parts are closed on the first frame boundary at or after the target duration,
+// but a sample is moved into the next part if it would push the current part past this limit.
+func partMaxDuration(partDuration time.Duration) time.Duration {
+	return (partDuration * 3) / 2
+}
+
 func findCompatiblePartDuration(
 	minPartDuration time.Duration,
 	sampleDurations map[time.Duration]struct{},
@@ -58,25 +69,50 @@ type augmentedAudioSample struct {
 }
 
 type muxerVariantFMP4Segmenter struct {
-	lowLatency         bool
-	segmentDuration    time.Duration
-	partDuration       time.Duration
-	segmentMaxSize     uint64
-	videoTrack         *format.H264
-	audioTrack         *format.MPEG4Audio
-	onSegmentFinalized func(*muxerVariantFMP4Segment)
-	onPartFinalized    func(*muxerVariantFMP4Part)
+	lowLatency            bool
+	segmentDuration       time.Duration
+	segmentMaxDeviation   time.Duration
+	targetDuration        time.Duration
+	partDuration          time.Duration
+	fragmentDuration      time.Duration
+	segmentMaxSize        uint64
+	segmentNames          *muxerFileNameTemplate
+	storage               SegmentStorage
+	producerReferenceTime bool
+	cmaf                  bool
+	interleaveFragments   bool
+	encryption            *fmp4.Encryption
+	videoTrack            format.Format
+	audioTrack            format.Format
+	onSegmentFinalized    func(*muxerVariantFMP4Segment)
+	onPartFinalized       func(*muxerVariantFMP4Part)
+	onPartDurationChanged func(time.Duration)
+	log                   func(logger.Level, string, ...interface{})
+
+	// set when an init segment is generated per discontinuity.
+	genInit func() (*muxerVariantFMP4Init, error)
+
+	// set by reconfigure(), applied when the next segment is created.
+	pendingSegmentDuration time.Duration
+	pendingPartDuration    time.Duration
 
 	startDTS              time.Duration
 	videoFirstIDRReceived bool
 	videoDTSExtractor     *h264.DTSExtractor
 	videoSPS              []byte
+	videoPPS              []byte
+	currentInit           *muxerVariantFMP4Init
 	currentSegment        *muxerVariantFMP4Segment
 	nextSegmentID         uint64
 	nextPartID            uint64
+	nextSequenceNumber    uint32
 	nextVideoSample       *augmentedVideoSample
+	lastVideoDuration     uint32
 	nextAudioSample       *augmentedAudioSample
+	pendingAudioSamples   []*augmentedAudioSample
+	pendingAudioDropped   bool
 	firstSegmentFinalized bool
+	waitingIDR            bool
 	sampleDurations       map[time.Duration]struct{}
 	adjustedPartDuration  time.Duration
 }
@@ -87,21 +123,34 @@ func newMuxerVariantFMP4Segmenter(
 	segmentDuration time.Duration,
 	partDuration time.Duration,
 	segmentMaxSize uint64,
-	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	segmentNames *muxerFileNameTemplate,
+	storage SegmentStorage,
+	producerReferenceTime bool,
+	cmaf bool,
+	videoTrack format.Format,
+	audioTrack format.Format,
 	onSegmentFinalized func(*muxerVariantFMP4Segment),
 	onPartFinalized func(*muxerVariantFMP4Part),
+	onPartDurationChanged func(time.Duration),
+	log func(logger.Level, string, ...interface{}),
 ) *muxerVariantFMP4Segmenter {
 	m := &muxerVariantFMP4Segmenter{
-		lowLatency:         lowLatency,
-		segmentDuration:    segmentDuration,
-		partDuration:       partDuration,
-		segmentMaxSize:     segmentMaxSize,
-		videoTrack:         videoTrack,
-		audioTrack:         audioTrack,
-		onSegmentFinalized: onSegmentFinalized,
-		onPartFinalized:    onPartFinalized,
-		sampleDurations:    make(map[time.Duration]struct{}),
+		lowLatency:            lowLatency,
+		segmentDuration:       segmentDuration,
+		partDuration:          partDuration,
+		segmentMaxSize:        segmentMaxSize,
+		segmentNames:          segmentNames,
+		storage:               storage,
+		producerReferenceTime: producerReferenceTime,
+		cmaf:                  cmaf,
+		videoTrack:            videoTrack,
+		audioTrack:            audioTrack,
+		onSegmentFinalized:    onSegmentFinalized,
+		onPartFinalized:       onPartFinalized,
+		onPartDurationChanged: onPartDurationChanged,
+		log:                   log,
+		sampleDurations:       make(map[time.Duration]struct{}),
+		nextSequenceNumber:    1,
 	}
 
 	// add initial gaps, required by iOS LL-HLS
@@ -124,6 +173,12 @@ func (m *muxerVariantFMP4Segmenter) genPartID() uint64 {
 	return id
 }
 
+func (m *muxerVariantFMP4Segmenter) genSequenceNumber() uint32 {
+	n := m.nextSequenceNumber
+	m.nextSequenceNumber++
+	return n
+}
+
 // iPhone iOS fails if part durations are less than 85% of maximum part duration.
 // find a part duration that is compatible with all received sample durations
 func (m *muxerVariantFMP4Segmenter) adjustPartDuration(du time.Duration) {
@@ -140,30 +195,55 @@ func (m *muxerVariantFMP4Segmenter) adjustPartDuration(du time.Duration) {
 	}
 }
 
-func (m *muxerVariantFMP4Segmenter) writeH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
-	idrPresent := false
-	nonIDRPresent := false
-
-	for _, nalu := range nalus {
-		typ := h264.NALUType(nalu[0] & 0x1F)
-		switch typ {
-		case h264.NALUTypeIDR:
-			idrPresent = true
+// reconfigure sets durations that are applied when the next segment is created,
+// in order not to change the parts of the current segment, that may be already referenced by the playlist.
+func (m *muxerVariantFMP4Segmenter) reconfigure(partDuration time.Duration, segmentDuration time.Duration) {
+	m.pendingSegmentDuration = segmentDuration
+	m.pendingPartDuration = partDuration
+}
 
-		case h264.NALUTypeNonIDR:
-			nonIDRPresent = true
-		}
+// applyPendingDurations applies the durations set by reconfigure(), if any.
+// It must be called before creating a segment.
+func (m *muxerVariantFMP4Segmenter) applyPendingDurations() {
+	if m.pendingSegmentDuration == 0 {
+		return
 	}
 
-	if !idrPresent && !nonIDRPresent {
-		return nil
+	m.log(logger.Debug, "applying segment duration %v and part duration %v",
+		m.pendingSegmentDuration, m.pendingPartDuration)
+
+	m.segmentDuration = m.pendingSegmentDuration
+
+	if m.pendingPartDuration != m.partDuration {
+		m.partDuration = m.pendingPartDuration
+
+		// find again a part duration that is compatible with sample durations
+		m.firstSegmentFinalized = false
+		m.sampleDurations = make(map[time.Duration]struct{})
+
+		m.onPartDurationChanged(m.partDuration)
 	}
 
-	return m.writeH264Entry(ntp, pts, nalus, idrPresent)
+	m.pendingSegmentDuration = 0
+	m.pendingPartDuration = 0
+}
+
+// extractDTS returns the DTS provided by the caller if available,
+// otherwise it computes the DTS from NALUs.
+func (m *muxerVariantFMP4Segmenter) extractDTS(
+	nalus [][]byte,
+	providedDTS *time.Duration,
+	pts time.Duration,
+) (time.Duration, error) {
+	if providedDTS != nil {
+		return *providedDTS, nil
+	}
+	return m.videoDTSExtractor.Extract(nalus, pts)
 }
 
-func (m *muxerVariantFMP4Segmenter) writeH264Entry(
+func (m *muxerVariantFMP4Segmenter) writeH264(
 	ntp time.Time,
+	providedDTS *time.Duration,
 	pts time.Duration,
 	nalus [][]byte,
 	idrPresent bool,
@@ -178,10 +258,10 @@ func (m *muxerVariantFMP4Segmenter) writeH264Entry(
 
 		m.videoFirstIDRReceived = true
 		m.videoDTSExtractor = h264.NewDTSExtractor()
-		m.videoSPS = m.videoTrack.SafeSPS()
+		m.videoSPS, m.videoPPS = m.currentVideoParams()
 
 		var err error
-		dts, err = m.videoDTSExtractor.Extract(nalus, pts)
+		dts, err = m.extractDTS(nalus, providedDTS, pts)
 		if err != nil {
 			return err
 		}
@@ -191,7 +271,7 @@ func (m *muxerVariantFMP4Segmenter) writeH264Entry(
 		pts -= m.startDTS
 	} else {
 		var err error
-		dts, err = m.videoDTSExtractor.Extract(nalus, pts)
+		dts, err = m.extractDTS(nalus, providedDTS, pts)
 		if err != nil {
 			return err
 		}
@@ -215,6 +295,72 @@ func (m *muxerVariantFMP4Segmenter) writeH264Entry(
 		ntp: ntp,
 	}
 
+	return m.writeVideoSample(sample, idrPresent)
+}
+
+func (m *muxerVariantFMP4Segmenter) writeMJPEG(ntp time.Time, pts time.Duration, frame []byte) error {
+	// frames are independent from each other, therefore they're all sync samples
+	if !m.videoFirstIDRReceived {
+		m.videoFirstIDRReceived = true
+		m.startDTS = pts
+	}
+	pts -= m.startDTS
+
+	sample := &augmentedVideoSample{
+		PartSample: fmp4.PartSample{
+			Payload: frame,
+		},
+		dts: pts,
+		ntp: ntp,
+	}
+
+	return m.writeVideoSample(sample, true)
+}
+
+// updateInit generates the init segment of the segments that are created afterwards,
+// if it's not been generated yet or if parameters of the video track have changed.
+// It has effect only when an init segment is generated per discontinuity.
+func (m *muxerVariantFMP4Segmenter) updateInit(paramsChanged bool) error {
+	if m.genInit == nil || (m.currentInit != nil && !paramsChanged) {
+		return nil
+	}
+
+	init, err := m.genInit()
+	if err != nil {
+		return err
+	}
+
+	m.currentInit = init
+	return nil
+}
+
+// currentVideoParams returns the current SPS and PPS of the video track, if any.
+func (m *muxerVariantFMP4Segmenter) currentVideoParams() ([]byte, []byte) {
+	if track, ok := m.videoTrack.(*format.H264); ok {
+		return track.SafeSPS(), track.SafePPS()
+	}
+	return nil, nil
+}
+
+// videoParams returns the parameters of the video track, that are inserted
+// into samples that start a segment without being sync samples.
+func (m *muxerVariantFMP4Segmenter) videoParams() ([]byte, error) {
+	if track, ok := m.videoTrack.(*format.H264); ok {
+		return h264.AVCCMarshal([][]byte{track.SafeSPS(), track.SafePPS()})
+	}
+	return nil, nil
+}
+
+func (m *muxerVariantFMP4Segmenter) writeVideoSample(sample *augmentedVideoSample, idrPresent bool) error {
+	// the current segment has been finalized, start a new one with the next IDR
+	if m.waitingIDR {
+		if !idrPresent {
+			return nil
+		}
+		m.waitingIDR = false
+		m.nextVideoSample = nil
+	}
+
 	// put samples into a queue in order to
 	// - compute sample duration
 	// - check if next sample is IDR
@@ -223,36 +369,92 @@ func (m *muxerVariantFMP4Segmenter) writeH264Entry(
 		return nil
 	}
 	sample.Duration = uint32(durationGoToMp4(m.nextVideoSample.dts-sample.dts, 90000))
+	m.lastVideoDuration = sample.Duration
+
+	var err error
 
 	if m.currentSegment == nil {
-		// create first segment
-		m.currentSegment = newMuxerVariantFMP4Segment(
+		err = m.updateInit(false)
+		if err != nil {
+			return err
+		}
+
+		m.applyPendingDurations()
+
+		// create first segment, or the first segment after finish()
+		m.currentSegment, err = newMuxerVariantFMP4Segment(
 			m.lowLatency,
 			m.genSegmentID(),
+			m.segmentNames,
 			sample.ntp,
 			sample.dts,
 			m.segmentMaxSize,
+			m.storage,
+			m.producerReferenceTime,
+			m.cmaf,
+			m.fragmentDuration,
+			m.interleaveFragments,
+			m.encryption,
 			m.videoTrack,
 			m.audioTrack,
+			m.currentInit,
 			m.genPartID,
+			m.genSequenceNumber,
 			m.onPartFinalized,
 		)
+		if err != nil {
+			return err
+		}
+
+		// segments that follow finish() can start with a non-IDR frame.
+		// insert parameters in order to allow decoders to start from there.
+		if sample.IsNonSyncSample {
+			params, err := m.videoParams()
+			if err != nil {
+				return err
+			}
+			sample.Payload = append(params, sample.Payload...)
+		}
+
+		// discard audio samples that precede the segment
+		n := 0
+		for n < len(m.pendingAudioSamples) && m.pendingAudioSamples[n].dts < sample.dts {
+			n++
+		}
+		m.pendingAudioSamples = m.pendingAudioSamples[n:]
 	}
 
 	m.adjustPartDuration(durationMp4ToGo(uint64(sample.Duration), 90000))
 
-	err = m.currentSegment.writeH264(sample, m.adjustedPartDuration)
+	err = m.currentSegment.writeVideo(sample, m.adjustedPartDuration)
+	if err != nil {
+		return err
+	}
+
+	// write audio samples that start before the next video sample,
+	// in order to place them in the segment that contains their start time.
+	err = m.writePendingAudioSamples(m.nextVideoSample.dts)
 	if err != nil {
 		return err
 	}
 
 	// switch segment
+	exceedsTarget := m.exceedsTargetDuration(m.nextVideoSample.dts, m.nextVideoSample.dts-sample.dts)
+
+	// check whether the segment would exceed the maximum size
+	// with the next video sample and the audio samples that follow it.
+	nextSize := uint64(len(m.nextVideoSample.Payload))
+	for _, sample := range m.pendingAudioSamples {
+		nextSize += uint64(len(sample.Payload))
+	}
+	exceedsMaxSize := m.currentSegment.exceedsMaxSize(nextSize)
+
 	if idrPresent {
-		sps := m.videoTrack.SafeSPS()
-		spsChanged := !bytes.Equal(m.videoSPS, sps)
+		sps, pps := m.currentVideoParams()
+		paramsChanged := !bytes.Equal(m.videoSPS, sps) || !bytes.Equal(m.videoPPS, pps)
 
 		if (m.nextVideoSample.dts-m.currentSegment.startDTS) >= m.segmentDuration ||
-			spsChanged {
+			paramsChanged || exceedsTarget || exceedsMaxSize {
 			err := m.currentSegment.finalize(m.nextVideoSample.dts)
 			if err != nil {
 				return err
@@ -261,31 +463,103 @@ func (m *muxerVariantFMP4Segmenter) writeH264Entry(
 
 			m.firstSegmentFinalized = true
 
-			m.currentSegment = newMuxerVariantFMP4Segment(
+			// segments that follow a change of parameters are decoded with a new init segment
+			err = m.updateInit(paramsChanged)
+			if err != nil {
+				return err
+			}
+
+			m.applyPendingDurations()
+
+			m.currentSegment, err = newMuxerVariantFMP4Segment(
 				m.lowLatency,
 				m.genSegmentID(),
+				m.segmentNames,
 				m.nextVideoSample.ntp,
 				m.nextVideoSample.dts,
 				m.segmentMaxSize,
+				m.storage,
+				m.producerReferenceTime,
+				m.cmaf,
+				m.fragmentDuration,
+				m.interleaveFragments,
+				m.encryption,
 				m.videoTrack,
 				m.audioTrack,
+				m.currentInit,
 				m.genPartID,
+				m.genSequenceNumber,
 				m.onPartFinalized,
 			)
+			if err != nil {
+				return err
+			}
 
-			// if SPS changed, reset adjusted part duration
-			if spsChanged {
+			// if parameters changed, reset adjusted part duration
+			if paramsChanged {
+				m.log(logger.Debug, "H264 parameters changed, starting a new segment")
 				m.videoSPS = sps
+				m.videoPPS = pps
 				m.firstSegmentFinalized = false
 				m.sampleDurations = make(map[time.Duration]struct{})
 			}
 		}
+	} else if exceedsMaxSize {
+		return m.finalizeWithoutIDR()
+	} else if exceedsTarget || (m.segmentMaxDeviation > 0 &&
+		(m.nextVideoSample.dts-m.currentSegment.startDTS) >= (m.segmentDuration+m.segmentMaxDeviation)) {
+		// the keyframe is late: cut the segment at a non-keyframe,
+		// in order to keep segment durations consistent.
+		m.log(logger.Debug, "no IDR received in %v, cutting segment at a non-IDR frame",
+			m.nextVideoSample.dts-m.currentSegment.startDTS)
+
+		err := m.currentSegment.finalize(m.nextVideoSample.dts)
+		if err != nil {
+			return err
+		}
+		m.onSegmentFinalized(m.currentSegment)
+
+		m.firstSegmentFinalized = true
+
+		m.applyPendingDurations()
+
+		m.currentSegment, err = newMuxerVariantFMP4Segment(
+			m.lowLatency,
+			m.genSegmentID(),
+			m.segmentNames,
+			m.nextVideoSample.ntp,
+			m.nextVideoSample.dts,
+			m.segmentMaxSize,
+			m.storage,
+			m.producerReferenceTime,
+			m.cmaf,
+			m.fragmentDuration,
+			m.interleaveFragments,
+			m.encryption,
+			m.videoTrack,
+			m.audioTrack,
+			m.currentInit,
+			m.genPartID,
+			m.genSequenceNumber,
+			m.onPartFinalized,
+		)
+		if err != nil {
+			return err
+		}
+
+		// insert parameters into the first sample of the new segment,
+		// in order to allow decoders to start from there.
+		params, err := m.videoParams()
+		if err != nil {
+			return err
+		}
+		m.nextVideoSample.Payload = append(params, m.nextVideoSample.Payload...)
 	}
 
 	return nil
 }
 
-func (m *muxerVariantFMP4Segmenter) writeAAC(ntp time.Time, dts time.Duration, au []byte) error {
+func (m *muxerVariantFMP4Segmenter) writeAudio(ntp time.Time, dts time.Duration, au []byte) error {
 	if m.videoTrack != nil {
 		// wait for the video track
 		if !m.videoFirstIDRReceived {
@@ -315,34 +589,80 @@ func (m *muxerVariantFMP4Segmenter) writeAAC(ntp time.Time, dts time.Duration, a
 
 	if m.videoTrack == nil {
 		if m.currentSegment == nil {
+			err := m.updateInit(false)
+			if err != nil {
+				return err
+			}
+
+			m.applyPendingDurations()
+
 			// create first segment
-			m.currentSegment = newMuxerVariantFMP4Segment(
+			m.currentSegment, err = newMuxerVariantFMP4Segment(
 				m.lowLatency,
 				m.genSegmentID(),
+				m.segmentNames,
 				sample.ntp,
 				sample.dts,
 				m.segmentMaxSize,
+				m.storage,
+				m.producerReferenceTime,
+				m.cmaf,
+				m.fragmentDuration,
+				m.interleaveFragments,
+				m.encryption,
 				m.videoTrack,
 				m.audioTrack,
+				m.currentInit,
 				m.genPartID,
+				m.genSequenceNumber,
 				m.onPartFinalized,
 			)
+			if err != nil {
+				return err
+			}
 		}
 	} else {
+		// samples are discarded until the next IDR
+		if m.waitingIDR {
+			return nil
+		}
+
+		// an audio sample can straddle the boundary between two segments.
+		// hold it until the video track has reached its start time,
+		// then write it into the segment that contains its start time.
+		m.pendingAudioSamples = append(m.pendingAudioSamples, sample)
+		m.limitPendingAudioSamples()
+
 		// wait for the video track
 		if m.currentSegment == nil {
 			return nil
 		}
+
+		nextSize := uint64(0)
+		for _, sample := range m.pendingAudioSamples {
+			if sample.dts >= m.nextVideoSample.dts {
+				break
+			}
+			nextSize += uint64(len(sample.Payload))
+		}
+
+		if m.currentSegment.exceedsMaxSize(nextSize) {
+			return m.finalizeWithoutIDR()
+		}
+
+		return m.writePendingAudioSamples(m.nextVideoSample.dts)
 	}
 
-	err := m.currentSegment.writeAAC(sample, m.partDuration)
+	err := m.currentSegment.writeAudio(sample, m.partDuration)
 	if err != nil {
 		return err
 	}
 
 	// switch segment
 	if m.videoTrack == nil &&
-		(m.nextAudioSample.dts-m.currentSegment.startDTS) >= m.segmentDuration {
+		((m.nextAudioSample.dts-m.currentSegment.startDTS) >= m.segmentDuration ||
+			m.exceedsTargetDuration(m.nextAudioSample.dts, m.nextAudioSample.dts-sample.dts) ||
+			m.currentSegment.exceedsMaxSize(uint64(len(m.nextAudioSample.Payload)))) {
 		err := m.currentSegment.finalize(0)
 		if err != nil {
 			return err
@@ -351,18 +671,170 @@ func (m *muxerVariantFMP4Segmenter) writeAAC(ntp time.Time, dts time.Duration, a
 
 		m.firstSegmentFinalized = true
 
-		m.currentSegment = newMuxerVariantFMP4Segment(
+		m.applyPendingDurations()
+
+		m.currentSegment, err = newMuxerVariantFMP4Segment(
 			m.lowLatency,
 			m.genSegmentID(),
+			m.segmentNames,
 			m.nextAudioSample.ntp,
 			m.nextAudioSample.dts,
 			m.segmentMaxSize,
+			m.storage,
+			m.producerReferenceTime,
+			m.cmaf,
+			m.fragmentDuration,
+			m.interleaveFragments,
+			m.encryption,
 			m.videoTrack,
 			m.audioTrack,
+			m.currentInit,
 			m.genPartID,
+			m.genSequenceNumber,
 			m.onPartFinalized,
 		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finalizeWithoutIDR finalizes the current segment when it would exceed the maximum size
+// before the next IDR. Samples are discarded until the next IDR, in order to bound memory usage
+// without producing segments that can't be decoded on their own.
+func (m *muxerVariantFMP4Segmenter) finalizeWithoutIDR() error {
+	m.log(logger.Warn, "segment reached the maximum size without IDRs, discarding frames until the next IDR")
+
+	err := m.currentSegment.finalize(m.nextVideoSample.dts)
+	if err != nil {
+		return err
+	}
+	m.onSegmentFinalized(m.currentSegment)
+
+	m.firstSegmentFinalized = true
+	m.currentSegment = nil
+	m.pendingAudioSamples = nil
+	m.waitingIDR = true
+
+	return nil
+}
+
+// exceedsTargetDuration checks whether the current segment would last more than the target duration
+// if the sample that starts at nextDTS was added to it, assuming that it lasts as the previous one.
+func (m *muxerVariantFMP4Segmenter) exceedsTargetDuration(nextDTS time.Duration, prevDuration time.Duration) bool {
+	return m.targetDuration > 0 &&
+		(nextDTS+prevDuration-m.currentSegment.startDTS) > m.targetDuration
+}
+
+// finish writes the queued samples and finalizes the current segment.
+// The duration of the last video sample is assumed to be equal to the one of the previous sample.
+// If samples are written afterwards, a new segment is created.
+func (m *muxerVariantFMP4Segmenter) finish() error {
+	// a segment is created when the second sample is received
+	if m.currentSegment == nil {
+		return nil
+	}
+
+	var endDTS time.Duration
+
+	if m.videoTrack != nil {
+		sample := m.nextVideoSample
+		m.nextVideoSample = nil
+		sample.Duration = m.lastVideoDuration
+		endDTS = sample.dts + durationMp4ToGo(uint64(sample.Duration), 90000)
+
+		err := m.currentSegment.writeVideo(sample, m.adjustedPartDuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.nextAudioSample != nil {
+		sample := m.nextAudioSample
+		m.nextAudioSample = nil
+		if lpcmTrack, ok := m.audioTrack.(*format.LPCM); ok {
+			sample.Duration = uint32(lpcmSampleCount(lpcmTrack, sample.Payload))
+		} else {
+			sample.Duration = uint32(audioSamplesPerAU(m.audioTrack))
+		}
+
+		if m.videoTrack != nil {
+			m.pendingAudioSamples = append(m.pendingAudioSamples, sample)
+		} else {
+			err := m.currentSegment.writeAudio(sample, m.partDuration)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.videoTrack != nil {
+		err := m.writePendingAudioSamples(endDTS)
+		if err != nil {
+			return err
+		}
+		m.pendingAudioSamples = nil
+	}
+
+	err := m.currentSegment.finalize(endDTS)
+	if err != nil {
+		return err
+	}
+	m.onSegmentFinalized(m.currentSegment)
+	m.currentSegment = nil
+
+	return nil
+}
+
+// limitPendingAudioSamples discards the oldest pending audio samples when the video track
+// is late by more than fmp4MaxPendingAudioDuration, in order to bound memory usage.
+// The event is logged once, until the video track catches up.
+func (m *muxerVariantFMP4Segmenter) limitPendingAudioSamples() {
+	lastDTS := m.pendingAudioSamples[len(m.pendingAudioSamples)-1].dts
+
+	n := 0
+	for n < len(m.pendingAudioSamples) && (lastDTS-m.pendingAudioSamples[n].dts) > fmp4MaxPendingAudioDuration {
+		n++
 	}
 
+	if n == 0 {
+		return
+	}
+
+	if !m.pendingAudioDropped {
+		m.pendingAudioDropped = true
+		m.log(logger.Warn, "video track is late by more than %v, discarding audio samples",
+			fmp4MaxPendingAudioDuration)
+	}
+
+	m.pendingAudioSamples = m.pendingAudioSamples[n:]
+}
+
+// writePendingAudioSamples writes into the current segment the pending audio samples
+// whose start time precedes the given video DTS.
+func (m *muxerVariantFMP4Segmenter) writePendingAudioSamples(videoDTS time.Duration) error {
+	n := 0
+
+	for _, sample := range m.pendingAudioSamples {
+		if sample.dts >= videoDTS {
+			break
+		}
+
+		err := m.currentSegment.writeAudio(sample, m.partDuration)
+		if err != nil {
+			return err
+		}
+
+		n++
+	}
+
+	if n > 0 {
+		m.pendingAudioDropped = false
+	}
+
+	m.pendingAudioSamples = m.pendingAudioSamples[n:]
+
 	return nil
 }
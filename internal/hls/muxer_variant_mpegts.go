@@ -1,9 +1,12 @@
 package hls
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/hls/mpegts"
 )
 
 type muxerVariantMPEGTS struct {
@@ -15,36 +18,124 @@ func newMuxerVariantMPEGTS(
 	segmentCount int,
 	segmentDuration time.Duration,
 	segmentMaxSize uint64,
+	segmentRetention time.Duration,
+	segmentNames *muxerFileNameTemplate,
+	storage SegmentStorage,
 	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	audioTrack format.Format,
+	onSegmentFinalized func(string, time.Time, time.Duration, time.Duration, time.Duration),
 ) *muxerVariantMPEGTS {
 	v := &muxerVariantMPEGTS{}
 
-	v.playlist = newMuxerVariantMPEGTSPlaylist(segmentCount)
+	v.playlist = newMuxerVariantMPEGTSPlaylist(
+		segmentCount,
+		segmentRetention,
+	)
 
 	v.segmenter = newMuxerVariantMPEGTSSegmenter(
 		segmentDuration,
 		segmentMaxSize,
+		segmentNames,
+		storage,
 		videoTrack,
 		audioTrack,
 		func(seg *muxerVariantMPEGTSSegment) {
 			v.playlist.pushSegment(seg)
+			onSegmentFinalized(
+				seg.name,
+				seg.startTime,
+				*seg.startDTS+v.segmenter.startDTS,
+				*seg.startDTS+mpegts.PCROffset,
+				seg.duration())
 		},
 	)
 
 	return v
 }
 
+func (v *muxerVariantMPEGTS) insertDateRange(d *muxerDateRange) {
+	v.playlist.insertDateRange(d)
+}
+
+func (v *muxerVariantMPEGTS) enableSegmentValidation() {
+	v.playlist.enableSegmentValidation()
+}
+
+func (v *muxerVariantMPEGTS) setTargetDuration(targetDuration time.Duration) error {
+	err := checkDurations(false, v.segmenter.segmentDuration, targetDuration, 0)
+	if err != nil {
+		return err
+	}
+
+	v.segmenter.targetDuration = targetDuration
+	v.playlist.setTargetDuration(targetDuration)
+	return nil
+}
+
+func (v *muxerVariantMPEGTS) setSegmentRetention(segmentRetention time.Duration) {
+	v.playlist.setSegmentRetention(segmentRetention)
+}
+
+func (v *muxerVariantMPEGTS) setFileNames(segmentNames *muxerFileNameTemplate, _ *muxerFileNameTemplate) {
+	// parts are not supported
+	v.segmenter.segmentNames = segmentNames
+}
+
+func (v *muxerVariantMPEGTS) setStorage(storage SegmentStorage) {
+	v.segmenter.storage = storage
+}
+
+func (v *muxerVariantMPEGTS) enableSegmentBitrate() {
+	v.playlist.enableSegmentBitrate()
+}
+
+func (v *muxerVariantMPEGTS) snapshot() (*MuxerSnapshot, error) {
+	return v.playlist.snapshot()
+}
+
+func (v *muxerVariantMPEGTS) clip(start time.Time, end time.Time) (*MuxerClip, error) {
+	return v.playlist.clip(start, end)
+}
+
+func (v *muxerVariantMPEGTS) preloadHints() []string {
+	// parts are not supported
+	return nil
+}
+
 func (v *muxerVariantMPEGTS) close() {
 	v.playlist.close()
 }
 
-func (v *muxerVariantMPEGTS) writeH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
-	return v.segmenter.writeH264(ntp, pts, nalus)
+func (v *muxerVariantMPEGTS) finish() error {
+	err := v.segmenter.finish()
+	if err != nil {
+		return err
+	}
+
+	v.playlist.end()
+	return nil
+}
+
+func (v *muxerVariantMPEGTS) writeH264(
+	ntp time.Time,
+	dts *time.Duration,
+	pts time.Duration,
+	nalus [][]byte,
+	idrPresent bool,
+) error {
+	return v.segmenter.writeH264(ntp, dts, pts, nalus, idrPresent)
+}
+
+func (v *muxerVariantMPEGTS) writeMJPEG(ntp time.Time, pts time.Duration, frame []byte) error {
+	return fmt.Errorf("M-JPEG is not supported by the MPEG-TS variant")
+}
+
+func (v *muxerVariantMPEGTS) writeAudio(ntp time.Time, pts time.Duration, au []byte) error {
+	return v.segmenter.writeAudio(ntp, pts, au)
 }
 
-func (v *muxerVariantMPEGTS) writeAAC(ntp time.Time, pts time.Duration, au []byte) error {
-	return v.segmenter.writeAAC(ntp, pts, au)
+func (v *muxerVariantMPEGTS) bandwidth() (int, int) {
+	return v.playlist.bandwidth()
 }
 
 func (v *muxerVariantMPEGTS) file(name string, msn string, part string, skip string) *MuxerFileResponse {
@@ -2,28 +2,40 @@ package hls
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type muxerVariantMPEGTSPlaylist struct {
-	segmentCount int
+	segmentCount   int
+	targetDuration time.Duration
+	retention      *muxerRetention
 
 	mutex              sync.Mutex
 	cond               *sync.Cond
 	closed             bool
+	ended              bool
 	segments           []*muxerVariantMPEGTSSegment
 	segmentByName      map[string]*muxerVariantMPEGTSSegment
 	segmentDeleteCount int
+	dateRanges         muxerDateRanges
+	validateSegments   bool
+	segmentBitrate     bool
 }
 
-func newMuxerVariantMPEGTSPlaylist(segmentCount int) *muxerVariantMPEGTSPlaylist {
+func newMuxerVariantMPEGTSPlaylist(
+	segmentCount int,
+	segmentRetention time.Duration,
+) *muxerVariantMPEGTSPlaylist {
 	p := &muxerVariantMPEGTSPlaylist{
 		segmentCount:  segmentCount,
+		retention:     newMuxerRetention(segmentRetention),
 		segmentByName: make(map[string]*muxerVariantMPEGTSSegment),
 	}
 	p.cond = sync.NewCond(&p.mutex)
@@ -41,6 +53,17 @@ func (p *muxerVariantMPEGTSPlaylist) close() {
 	p.cond.Broadcast()
 }
 
+// end marks the playlist as complete.
+func (p *muxerVariantMPEGTSPlaylist) end() {
+	func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.ended = true
+	}()
+
+	p.cond.Broadcast()
+}
+
 func (p *muxerVariantMPEGTSPlaylist) file(name string) *MuxerFileResponse {
 	switch {
 	case name == "stream.m3u8":
@@ -50,7 +73,7 @@ func (p *muxerVariantMPEGTSPlaylist) file(name string) *MuxerFileResponse {
 		return p.segmentReader(name)
 
 	default:
-		return &MuxerFileResponse{Status: http.StatusNotFound}
+		return NewMuxerFileResponseError(http.StatusNotFound)
 	}
 }
 
@@ -60,7 +83,7 @@ func (p *muxerVariantMPEGTSPlaylist) playlist() io.Reader {
 	cnt += "#EXT-X-ALLOW-CACHE:NO\n"
 
 	targetDuration := func() uint {
-		ret := uint(0)
+		ret := uint(p.targetDuration / time.Second)
 
 		// EXTINF, when rounded to the nearest integer, must be <= EXT-X-TARGETDURATION
 		for _, s := range p.segments {
@@ -76,25 +99,59 @@ func (p *muxerVariantMPEGTSPlaylist) playlist() io.Reader {
 
 	cnt += "#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatInt(int64(p.segmentDeleteCount), 10) + "\n"
 
+	dri := 0
+
 	for _, s := range p.segments {
+		// place date ranges before the segment that contains their start date
+		for ; dri < len(p.dateRanges) && p.dateRanges[dri].start.Before(s.startTime.Add(s.duration())); dri++ {
+			cnt += p.dateRanges[dri].marshal()
+		}
+
+		if p.segmentBitrate {
+			cnt += "#EXT-X-BITRATE:" + strconv.FormatInt(int64(s.bitrate()/1000), 10) + "\n"
+		}
+
 		cnt += "#EXT-X-PROGRAM-DATE-TIME:" + s.startTime.Format("2006-01-02T15:04:05.999Z07:00") + "\n" +
 			"#EXTINF:" + strconv.FormatFloat(s.duration().Seconds(), 'f', -1, 64) + ",\n" +
 			s.name + ".ts\n"
 	}
 
+	for ; dri < len(p.dateRanges); dri++ {
+		cnt += p.dateRanges[dri].marshal()
+	}
+
+	if p.ended {
+		cnt += "#EXT-X-ENDLIST\n"
+	}
+
 	return bytes.NewReader([]byte(cnt))
 }
 
+func (p *muxerVariantMPEGTSPlaylist) bandwidth() (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sizes := make([]uint64, len(p.segments))
+	durations := make([]time.Duration, len(p.segments))
+
+	for i, s := range p.segments {
+		sizes[i] = s.file.Size()
+		durations[i] = s.duration()
+	}
+
+	return bandwidth(sizes, durations)
+}
+
 func (p *muxerVariantMPEGTSPlaylist) playlistReader() *MuxerFileResponse {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	if !p.closed && len(p.segments) == 0 {
+	if !p.closed && !p.ended && len(p.segments) == 0 {
 		p.cond.Wait()
 	}
 
 	if p.closed {
-		return &MuxerFileResponse{Status: http.StatusInternalServerError}
+		return NewMuxerFileResponseError(http.StatusInternalServerError)
 	}
 
 	return &MuxerFileResponse{
@@ -111,10 +168,16 @@ func (p *muxerVariantMPEGTSPlaylist) segmentReader(fname string) *MuxerFileRespo
 
 	p.mutex.Lock()
 	f, ok := p.segmentByName[base]
+	validate := p.validateSegments
 	p.mutex.Unlock()
 
 	if !ok {
-		return &MuxerFileResponse{Status: http.StatusNotFound}
+		return NewMuxerFileResponseError(http.StatusNotFound)
+	}
+
+	// do not serve segments that have been corrupted or truncated by the storage
+	if validate && f.validate() != nil {
+		return NewMuxerFileResponseError(http.StatusNotFound)
 	}
 
 	return &MuxerFileResponse{
@@ -134,12 +197,120 @@ func (p *muxerVariantMPEGTSPlaylist) pushSegment(t *muxerVariantMPEGTSSegment) {
 		p.segmentByName[t.name] = t
 		p.segments = append(p.segments, t)
 
+		now := time.Now()
+		p.retention.purge(now)
+
 		if len(p.segments) > p.segmentCount {
-			delete(p.segmentByName, p.segments[0].name)
+			toDelete := p.segments[0]
+			p.retention.add(now, func() {
+				delete(p.segmentByName, toDelete.name)
+				toDelete.file.Remove()
+			})
+
 			p.segments = p.segments[1:]
 			p.segmentDeleteCount++
+
+			p.dateRanges = p.dateRanges.purge(p.segments[0].startTime)
 		}
 	}()
 
 	p.cond.Broadcast()
 }
+
+func (p *muxerVariantMPEGTSPlaylist) insertDateRange(d *muxerDateRange) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.dateRanges = p.dateRanges.insert(d)
+}
+
+func (p *muxerVariantMPEGTSPlaylist) enableSegmentValidation() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.validateSegments = true
+}
+
+func (p *muxerVariantMPEGTSPlaylist) setSegmentRetention(segmentRetention time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.retention = newMuxerRetention(segmentRetention)
+}
+
+func (p *muxerVariantMPEGTSPlaylist) setTargetDuration(targetDuration time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.targetDuration = targetDuration
+}
+
+func (p *muxerVariantMPEGTSPlaylist) enableSegmentBitrate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.segmentBitrate = true
+}
+
+func (p *muxerVariantMPEGTSPlaylist) snapshot() (*MuxerSnapshot, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, fmt.Errorf("muxer is closed")
+	}
+
+	if len(p.segments) == 0 {
+		return nil, fmt.Errorf("no segments are available")
+	}
+
+	segments := make([]string, len(p.segments))
+	for i, s := range p.segments {
+		segments[i] = s.name + ".ts"
+	}
+
+	p.retention.pin()
+
+	return &MuxerSnapshot{
+		Playlist: readSnapshotPlaylist(p.playlist()),
+		Segments: segments,
+		release: func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			p.retention.unpin(time.Now())
+		},
+	}, nil
+}
+
+func (p *muxerVariantMPEGTSPlaylist) clip(start time.Time, end time.Time) (*MuxerClip, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, fmt.Errorf("muxer is closed")
+	}
+
+	segments := make([]muxerClipSegment, len(p.segments))
+	for i, s := range p.segments {
+		segments[i] = muxerClipSegment{
+			name:      s.name + ".ts",
+			startTime: s.startTime,
+			duration:  s.duration(),
+		}
+	}
+
+	c, err := newMuxerClip(segments, start, end, false, "")
+	if err != nil {
+		return nil, err
+	}
+
+	p.retention.pin()
+
+	c.release = func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.retention.unpin(time.Now())
+	}
+
+	return c, nil
+}
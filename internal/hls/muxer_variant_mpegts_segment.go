@@ -1,21 +1,21 @@
 package hls
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"strconv"
 	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/format"
 
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
 	"github.com/aler9/rtsp-simple-server/internal/hls/mpegts"
 )
 
 type muxerVariantMPEGTSSegment struct {
 	segmentMaxSize uint64
+	storage        SegmentStorage
 	videoTrack     *format.H264
-	audioTrack     *format.MPEG4Audio
+	audioTrack     format.Format
 	writer         *mpegts.Writer
 
 	size         uint64
@@ -23,25 +23,27 @@ type muxerVariantMPEGTSSegment struct {
 	name         string
 	startDTS     *time.Duration
 	endDTS       time.Duration
-	audioAUCount int
-	content      []byte
+	lastDuration time.Duration
+	file         SegmentStorageFile
 }
 
 func newMuxerVariantMPEGTSSegment(
-	id uint64,
+	name string,
 	startTime time.Time,
 	segmentMaxSize uint64,
+	storage SegmentStorage,
 	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	audioTrack format.Format,
 	writer *mpegts.Writer,
 ) *muxerVariantMPEGTSSegment {
 	t := &muxerVariantMPEGTSSegment{
 		segmentMaxSize: segmentMaxSize,
+		storage:        storage,
 		videoTrack:     videoTrack,
 		audioTrack:     audioTrack,
 		writer:         writer,
 		startTime:      startTime,
-		name:           "seg" + strconv.FormatUint(id, 10),
+		name:           name,
 	}
 
 	return t
@@ -51,13 +53,43 @@ func (t *muxerVariantMPEGTSSegment) duration() time.Duration {
 	return t.endDTS - *t.startDTS
 }
 
-func (t *muxerVariantMPEGTSSegment) reader() io.Reader {
-	return bytes.NewReader(t.content)
+func (t *muxerVariantMPEGTSSegment) bitrate() int {
+	return segmentBitrate(t.file.Size(), t.duration())
 }
 
-func (t *muxerVariantMPEGTSSegment) finalize(endDTS time.Duration) {
+func (t *muxerVariantMPEGTSSegment) reader() io.ReadCloser {
+	return t.file.Reader(0, t.file.Size())
+}
+
+func (t *muxerVariantMPEGTSSegment) validate() error {
+	r := t.reader()
+	defer r.Close()
+
+	return validateMPEGTS(r, t.file.Size())
+}
+
+// exceedsMaxSize checks whether the segment would exceed the maximum size
+// if data with the given size was added to it.
+func (t *muxerVariantMPEGTSSegment) exceedsMaxSize(size uint64) bool {
+	return (t.size + size) > t.segmentMaxSize
+}
+
+func (t *muxerVariantMPEGTSSegment) finalize(endDTS time.Duration) error {
 	t.endDTS = endDTS
-	t.content = t.writer.GenerateSegment()
+
+	var err error
+	t.file, err = t.storage.Create(t.name + ".ts")
+	if err != nil {
+		return err
+	}
+
+	_, err = t.file.Write(t.writer.GenerateSegment())
+	if err != nil {
+		t.file.Remove()
+		return err
+	}
+
+	return nil
 }
 
 func (t *muxerVariantMPEGTSSegment) writeH264(
@@ -71,7 +103,7 @@ func (t *muxerVariantMPEGTSSegment) writeH264(
 	for _, nalu := range nalus {
 		size += uint64(len(nalu))
 	}
-	if (t.size + size) > t.segmentMaxSize {
+	if t.exceedsMaxSize(size) {
 		return fmt.Errorf("reached maximum segment size")
 	}
 	t.size += size
@@ -83,33 +115,40 @@ func (t *muxerVariantMPEGTSSegment) writeH264(
 
 	if t.startDTS == nil {
 		t.startDTS = &dts
+	} else {
+		t.lastDuration = dts - t.endDTS
 	}
 	t.endDTS = dts
 
 	return nil
 }
 
-func (t *muxerVariantMPEGTSSegment) writeAAC(
+func (t *muxerVariantMPEGTSSegment) writeAudio(
 	pcr time.Duration,
 	pts time.Duration,
 	au []byte,
 ) error {
 	size := uint64(len(au))
-	if (t.size + size) > t.segmentMaxSize {
+	if t.exceedsMaxSize(size) {
 		return fmt.Errorf("reached maximum segment size")
 	}
 	t.size += size
 
-	err := t.writer.WriteAAC(pcr, pts, au)
+	var err error
+	if _, ok := t.audioTrack.(*ac3.Format); ok {
+		err = t.writer.WriteAC3(pcr, pts, au)
+	} else {
+		err = t.writer.WriteAAC(pcr, pts, au)
+	}
 	if err != nil {
 		return err
 	}
 
 	if t.videoTrack == nil {
-		t.audioAUCount++
-
 		if t.startDTS == nil {
 			t.startDTS = &pts
+		} else {
+			t.lastDuration = pts - t.endDTS
 		}
 		t.endDTS = pts
 	}
@@ -9,15 +9,14 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/hls/mpegts"
 )
 
-const (
-	mpegtsSegmentMinAUCount = 100
-)
-
 type muxerVariantMPEGTSSegmenter struct {
 	segmentDuration time.Duration
+	targetDuration  time.Duration
 	segmentMaxSize  uint64
+	segmentNames    *muxerFileNameTemplate
+	storage         SegmentStorage
 	videoTrack      *format.H264
-	audioTrack      *format.MPEG4Audio
+	audioTrack      format.Format
 	onSegmentReady  func(*muxerVariantMPEGTSSegment)
 
 	writer            *mpegts.Writer
@@ -26,18 +25,23 @@ type muxerVariantMPEGTSSegmenter struct {
 	videoDTSExtractor *h264.DTSExtractor
 	startPCR          time.Time
 	startDTS          time.Duration
+	waitingIDR        bool
 }
 
 func newMuxerVariantMPEGTSSegmenter(
 	segmentDuration time.Duration,
 	segmentMaxSize uint64,
+	segmentNames *muxerFileNameTemplate,
+	storage SegmentStorage,
 	videoTrack *format.H264,
-	audioTrack *format.MPEG4Audio,
+	audioTrack format.Format,
 	onSegmentReady func(*muxerVariantMPEGTSSegment),
 ) *muxerVariantMPEGTSSegmenter {
 	m := &muxerVariantMPEGTSSegmenter{
 		segmentDuration: segmentDuration,
 		segmentMaxSize:  segmentMaxSize,
+		segmentNames:    segmentNames,
+		storage:         storage,
 		videoTrack:      videoTrack,
 		audioTrack:      audioTrack,
 		onSegmentReady:  onSegmentReady,
@@ -50,27 +54,87 @@ func newMuxerVariantMPEGTSSegmenter(
 	return m
 }
 
-func (m *muxerVariantMPEGTSSegmenter) genSegmentID() uint64 {
+func (m *muxerVariantMPEGTSSegmenter) genSegmentName() string {
 	id := m.nextSegmentID
 	m.nextSegmentID++
-	return id
+	return m.segmentNames.name(id)
 }
 
-func (m *muxerVariantMPEGTSSegmenter) writeH264(ntp time.Time, pts time.Duration, nalus [][]byte) error {
-	idrPresent := false
-	nonIDRPresent := false
+// finish finalizes the current segment.
+// The duration of the last sample is assumed to be equal to the one of the previous sample.
+func (m *muxerVariantMPEGTSSegmenter) finish() error {
+	// the current segment has already been finalized
+	if m.waitingIDR {
+		m.waitingIDR = false
+		m.currentSegment = nil
+		return nil
+	}
 
-	for _, nalu := range nalus {
-		typ := h264.NALUType(nalu[0] & 0x1F)
-		switch typ {
-		case h264.NALUTypeIDR:
-			idrPresent = true
+	if m.currentSegment == nil || m.currentSegment.startDTS == nil {
+		return nil
+	}
 
-		case h264.NALUTypeNonIDR:
-			nonIDRPresent = true
-		}
+	err := m.currentSegment.finalize(m.currentSegment.endDTS + m.currentSegment.lastDuration)
+	if err != nil {
+		return err
+	}
+	m.onSegmentReady(m.currentSegment)
+	m.currentSegment = nil
+
+	return nil
+}
+
+// exceedsTargetDuration checks whether the current segment would last more than the target duration
+// if the sample that starts at dts was added to it, assuming that it lasts as the previous one.
+func (m *muxerVariantMPEGTSSegmenter) exceedsTargetDuration(dts time.Duration) bool {
+	if m.targetDuration <= 0 {
+		return false
+	}
+
+	prevDuration := dts - m.currentSegment.endDTS
+	return (dts + prevDuration - *m.currentSegment.startDTS) > m.targetDuration
+}
+
+// exceedsMaxSize checks whether the current segment would exceed the maximum size
+// if data with the given size was added to it. Empty segments are never split.
+func (m *muxerVariantMPEGTSSegmenter) exceedsMaxSize(size uint64) bool {
+	return m.currentSegment.startDTS != nil && m.currentSegment.exceedsMaxSize(size)
+}
+
+// finalizeWithoutIDR finalizes the current segment when it would exceed the maximum size
+// before the next IDR. Frames are discarded until the next IDR, in order to bound memory usage
+// without producing segments that can't be decoded on their own.
+func (m *muxerVariantMPEGTSSegmenter) finalizeWithoutIDR(endDTS time.Duration) error {
+	err := m.currentSegment.finalize(endDTS)
+	if err != nil {
+		return err
+	}
+	m.onSegmentReady(m.currentSegment)
+	m.waitingIDR = true
+
+	return nil
+}
+
+// extractDTS returns the DTS provided by the caller if available,
+// otherwise it computes the DTS from NALUs.
+func (m *muxerVariantMPEGTSSegmenter) extractDTS(
+	nalus [][]byte,
+	providedDTS *time.Duration,
+	pts time.Duration,
+) (time.Duration, error) {
+	if providedDTS != nil {
+		return *providedDTS, nil
 	}
+	return m.videoDTSExtractor.Extract(nalus, pts)
+}
 
+func (m *muxerVariantMPEGTSSegmenter) writeH264(
+	ntp time.Time,
+	providedDTS *time.Duration,
+	pts time.Duration,
+	nalus [][]byte,
+	idrPresent bool,
+) error {
 	var dts time.Duration
 
 	if m.currentSegment == nil {
@@ -82,7 +146,7 @@ func (m *muxerVariantMPEGTSSegmenter) writeH264(ntp time.Time, pts time.Duration
 		m.videoDTSExtractor = h264.NewDTSExtractor()
 
 		var err error
-		dts, err = m.videoDTSExtractor.Extract(nalus, pts)
+		dts, err = m.extractDTS(nalus, providedDTS, pts)
 		if err != nil {
 			return err
 		}
@@ -94,19 +158,16 @@ func (m *muxerVariantMPEGTSSegmenter) writeH264(ntp time.Time, pts time.Duration
 
 		// create first segment
 		m.currentSegment = newMuxerVariantMPEGTSSegment(
-			m.genSegmentID(),
+			m.genSegmentName(),
 			ntp,
 			m.segmentMaxSize,
+			m.storage,
 			m.videoTrack,
 			m.audioTrack,
 			m.writer)
 	} else {
-		if !idrPresent && !nonIDRPresent {
-			return nil
-		}
-
 		var err error
-		dts, err = m.videoDTSExtractor.Extract(nalus, pts)
+		dts, err = m.extractDTS(nalus, providedDTS, pts)
 		if err != nil {
 			return err
 		}
@@ -114,18 +175,56 @@ func (m *muxerVariantMPEGTSSegmenter) writeH264(ntp time.Time, pts time.Duration
 		dts -= m.startDTS
 		pts -= m.startDTS
 
-		// switch segment
-		if idrPresent &&
-			(dts-*m.currentSegment.startDTS) >= m.segmentDuration {
-			m.currentSegment.finalize(dts)
-			m.onSegmentReady(m.currentSegment)
+		if m.waitingIDR {
+			// the current segment has been finalized, start a new one with the next IDR
+			if !idrPresent {
+				return nil
+			}
+			m.waitingIDR = false
+
 			m.currentSegment = newMuxerVariantMPEGTSSegment(
-				m.genSegmentID(),
+				m.genSegmentName(),
 				ntp,
 				m.segmentMaxSize,
+				m.storage,
 				m.videoTrack,
 				m.audioTrack,
 				m.writer)
+		} else {
+			size := uint64(0)
+			for _, nalu := range nalus {
+				size += uint64(len(nalu))
+			}
+
+			if !idrPresent && m.exceedsMaxSize(size) {
+				return m.finalizeWithoutIDR(dts)
+			}
+
+			// switch segment
+			if (idrPresent &&
+				((dts-*m.currentSegment.startDTS) >= m.segmentDuration ||
+					m.exceedsMaxSize(size))) ||
+				m.exceedsTargetDuration(dts) {
+				err = m.currentSegment.finalize(dts)
+				if err != nil {
+					return err
+				}
+				m.onSegmentReady(m.currentSegment)
+				m.currentSegment = newMuxerVariantMPEGTSSegment(
+					m.genSegmentName(),
+					ntp,
+					m.segmentMaxSize,
+					m.storage,
+					m.videoTrack,
+					m.audioTrack,
+					m.writer)
+
+				// insert parameters into segments that start with a non-IDR frame,
+				// in order to allow decoders to start from there.
+				if !idrPresent {
+					nalus = append([][]byte{m.videoTrack.SafeSPS(), m.videoTrack.SafePPS()}, nalus...)
+				}
+			}
 		}
 	}
 
@@ -142,7 +241,7 @@ func (m *muxerVariantMPEGTSSegmenter) writeH264(ntp time.Time, pts time.Duration
 	return nil
 }
 
-func (m *muxerVariantMPEGTSSegmenter) writeAAC(ntp time.Time, pts time.Duration, au []byte) error {
+func (m *muxerVariantMPEGTSSegmenter) writeAudio(ntp time.Time, pts time.Duration, au []byte) error {
 	if m.videoTrack == nil {
 		if m.currentSegment == nil {
 			m.startPCR = ntp
@@ -151,24 +250,31 @@ func (m *muxerVariantMPEGTSSegmenter) writeAAC(ntp time.Time, pts time.Duration,
 
 			// create first segment
 			m.currentSegment = newMuxerVariantMPEGTSSegment(
-				m.genSegmentID(),
+				m.genSegmentName(),
 				ntp,
 				m.segmentMaxSize,
+				m.storage,
 				m.videoTrack,
 				m.audioTrack,
 				m.writer)
 		} else {
 			pts -= m.startDTS
 
-			// switch segment
-			if m.currentSegment.audioAUCount >= mpegtsSegmentMinAUCount &&
-				(pts-*m.currentSegment.startDTS) >= m.segmentDuration {
-				m.currentSegment.finalize(pts)
+			// there are no key frames: switch segment on the first frame boundary
+			// at or after the segment duration, in order to produce evenly-sized segments.
+			if (pts-*m.currentSegment.startDTS) >= m.segmentDuration ||
+				m.exceedsTargetDuration(pts) ||
+				m.exceedsMaxSize(uint64(len(au))) {
+				err := m.currentSegment.finalize(pts)
+				if err != nil {
+					return err
+				}
 				m.onSegmentReady(m.currentSegment)
 				m.currentSegment = newMuxerVariantMPEGTSSegment(
-					m.genSegmentID(),
+					m.genSegmentName(),
 					ntp,
 					m.segmentMaxSize,
+					m.storage,
 					m.videoTrack,
 					m.audioTrack,
 					m.writer)
@@ -176,14 +282,18 @@ func (m *muxerVariantMPEGTSSegmenter) writeAAC(ntp time.Time, pts time.Duration,
 		}
 	} else {
 		// wait for the video track
-		if m.currentSegment == nil {
+		if m.currentSegment == nil || m.waitingIDR {
 			return nil
 		}
 
 		pts -= m.startDTS
+
+		if m.exceedsMaxSize(uint64(len(au))) {
+			return m.finalizeWithoutIDR(pts)
+		}
 	}
 
-	err := m.currentSegment.writeAAC(ntp.Sub(m.startPCR), pts, au)
+	err := m.currentSegment.writeAudio(ntp.Sub(m.startPCR), pts, au)
 	if err != nil {
 		return err
 	}
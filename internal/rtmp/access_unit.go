@@ -0,0 +1,302 @@
+package rtmp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+// VideoCodec is the codec of a video track.
+type VideoCodec int
+
+// video codecs.
+const (
+	VideoCodecNone VideoCodec = iota
+	VideoCodecH264
+	VideoCodecH265
+)
+
+// AudioCodec is the codec of an audio track.
+type AudioCodec int
+
+// audio codecs.
+const (
+	AudioCodecNone AudioCodec = iota
+	AudioCodecMPEG4Audio
+	AudioCodecAC3
+)
+
+// StreamInfo describes the tracks of a stream, without depending on RTSP formats.
+type StreamInfo struct {
+	VideoCodec VideoCodec
+
+	// H265 only.
+	VPS []byte
+
+	// H264 and H265 only.
+	SPS []byte
+	PPS []byte
+
+	AudioCodec AudioCodec
+
+	// MPEG-4 Audio only: the AudioSpecificConfig.
+	AudioConfig []byte
+
+	AudioSampleRate   int
+	AudioChannelCount int
+}
+
+// AccessUnit is a video or audio access unit, read by ReadAccessUnit().
+type AccessUnit struct {
+	IsVideo bool
+
+	// time of reception.
+	NTP time.Time
+
+	// in case of audio, DTS is equal to PTS.
+	DTS time.Duration
+	PTS time.Duration
+
+	// video only.
+	NALUs      [][]byte
+	IsKeyFrame bool
+
+	// audio only: a MPEG-4 Audio access unit or an AC-3 frame.
+	AU []byte
+}
+
+func streamInfoFromTracks(videoTrack format.Format, audioTrack format.Format) (*StreamInfo, error) {
+	info := &StreamInfo{}
+
+	switch track := videoTrack.(type) {
+	case *format.H264:
+		info.VideoCodec = VideoCodecH264
+		info.SPS = track.SafeSPS()
+		info.PPS = track.SafePPS()
+
+	case *format.H265:
+		info.VideoCodec = VideoCodecH265
+		info.VPS = track.SafeVPS()
+		info.SPS = track.SafeSPS()
+		info.PPS = track.SafePPS()
+	}
+
+	switch track := audioTrack.(type) {
+	case *format.MPEG4Audio:
+		conf, err := track.Config.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		info.AudioCodec = AudioCodecMPEG4Audio
+		info.AudioConfig = conf
+		info.AudioSampleRate = track.Config.SampleRate
+		info.AudioChannelCount = track.Config.ChannelCount
+
+	case *ac3.Format:
+		info.AudioCodec = AudioCodecAC3
+		info.AudioSampleRate = track.Config.SampleRate
+		info.AudioChannelCount = track.Config.ChannelCount
+	}
+
+	return info, nil
+}
+
+// ReadStreamInfo reads the tracks of the stream, like ReadTracks(),
+// and returns them without depending on RTSP formats.
+// Access units can then be read with ReadAccessUnit().
+func (c *Conn) ReadStreamInfo() (*StreamInfo, error) {
+	videoTrack, audioTrack, err := c.ReadTracks()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := streamInfoFromTracks(videoTrack, audioTrack)
+	if err != nil {
+		return nil, err
+	}
+
+	c.auVideoTrack = videoTrack
+	c.auAudioTrack = audioTrack
+
+	return info, nil
+}
+
+// RemoveEmptyNALUs removes NALUs without content, that are sent by some DJI drones.
+func RemoveEmptyNALUs(nalus [][]byte) [][]byte {
+	n := 0
+	for _, nalu := range nalus {
+		if len(nalu) != 0 {
+			n++
+		}
+	}
+
+	if n == len(nalus) {
+		return nalus
+	}
+
+	ret := make([][]byte, 0, n)
+	for _, nalu := range nalus {
+		if len(nalu) != 0 {
+			ret = append(ret, nalu)
+		}
+	}
+	return ret
+}
+
+// ReadAccessUnit reads the next video or audio access unit.
+// Other messages, and audio messages of additional tracks of multitrack streams, are skipped.
+// H264 and H265 parameters that change during the stream are prepended to the NALUs of the following access unit.
+// ReadStreamInfo() must be called before.
+func (c *Conn) ReadAccessUnit() (*AccessUnit, error) {
+	if c.auPending != nil {
+		au := c.auPending[0]
+		c.auPending = c.auPending[1:]
+		if len(c.auPending) == 0 {
+			c.auPending = nil
+		}
+		return au, nil
+	}
+
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tmsg := msg.(type) {
+		case *message.MsgVideo:
+			au, err := c.videoAccessUnit(tmsg)
+			if err != nil {
+				return nil, err
+			}
+
+			if au != nil {
+				return au, nil
+			}
+
+		case *message.MsgAudio:
+			aus, err := c.audioAccessUnits(tmsg)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(aus) != 0 {
+				if len(aus) > 1 {
+					c.auPending = aus[1:]
+				}
+				return aus[0], nil
+			}
+		}
+	}
+}
+
+func (c *Conn) videoAccessUnit(msg *message.MsgVideo) (*AccessUnit, error) {
+	switch msg.H264Type {
+	case flvio.AVC_SEQHDR:
+		// a new decoder configuration is sent in case of a resolution change
+		var changed bool
+		var err error
+
+		switch track := c.auVideoTrack.(type) {
+		case *format.H264:
+			changed, err = UpdateH264TrackFromDecoderConfig(track, msg.Payload)
+
+		case *format.H265:
+			changed, err = UpdateH265TrackFromDecoderConfig(track, msg.Payload)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			c.auVideoParamsChanged = true
+		}
+
+	case flvio.AVC_NALU:
+		if c.auVideoTrack == nil {
+			return nil, fmt.Errorf("received a video packet, but track is not set up")
+		}
+
+		nalus, err := h264.AVCCUnmarshal(msg.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode AVCC: %v", err)
+		}
+
+		nalus = RemoveEmptyNALUs(nalus)
+		if len(nalus) == 0 {
+			return nil, nil
+		}
+
+		if c.auVideoParamsChanged {
+			c.auVideoParamsChanged = false
+
+			switch track := c.auVideoTrack.(type) {
+			case *format.H264:
+				nalus = append([][]byte{track.SafeSPS(), track.SafePPS()}, nalus...)
+
+			case *format.H265:
+				nalus = append([][]byte{track.SafeVPS(), track.SafeSPS(), track.SafePPS()}, nalus...)
+			}
+		}
+
+		return &AccessUnit{
+			IsVideo:    true,
+			NTP:        time.Now(),
+			DTS:        msg.DTS,
+			PTS:        msg.DTS + msg.PTSDelta,
+			NALUs:      nalus,
+			IsKeyFrame: msg.IsKeyFrame,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (c *Conn) audioAccessUnits(msg *message.MsgAudio) ([]*AccessUnit, error) {
+	// additional audio tracks of multitrack streams are skipped
+	if msg.TrackID != 0 || msg.AACType != flvio.AAC_RAW {
+		return nil, nil
+	}
+
+	if c.auAudioTrack == nil {
+		return nil, fmt.Errorf("received an audio packet, but track is not set up")
+	}
+
+	ntp := time.Now()
+
+	track, ok := c.auAudioTrack.(*ac3.Format)
+	if !ok {
+		return []*AccessUnit{{
+			NTP: ntp,
+			DTS: msg.DTS,
+			PTS: msg.DTS,
+			AU:  msg.Payload,
+		}}, nil
+	}
+
+	frames, err := ac3.SplitFrames(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode AC-3 frames: %v", err)
+	}
+
+	ret := make([]*AccessUnit, len(frames))
+	for i, frame := range frames {
+		pts := msg.DTS + time.Duration(i*track.Config.SamplesPerFrame())*
+			time.Second/time.Duration(track.Config.SampleRate)
+
+		ret[i] = &AccessUnit{
+			NTP: ntp,
+			DTS: pts,
+			PTS: pts,
+			AU:  frame,
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,290 @@
+package rtmp
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h265conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+func TestReadAccessUnit(t *testing.T) {
+	sps1 := []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+
+	sps2 := []byte{
+		0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+		0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+		0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9,
+		0x20,
+	}
+
+	pps := []byte{
+		0x68, 0xee, 0x3c, 0x80,
+	}
+
+	enc, err := mpeg4audio.Config{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Marshal()
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		buf1, err := h264conf.Conf{
+			SPS: sps1,
+			PPS: pps,
+		}.Marshal()
+		require.NoError(t, err)
+
+		buf2, err := h264conf.Conf{
+			SPS: sps2,
+			PPS: pps,
+		}.Marshal()
+		require.NoError(t, err)
+
+		for _, msg := range []message.Message{
+			&message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					flvio.AMFMap{
+						{K: "videocodecid", V: float64(codecH264)},
+						{K: "audiocodecid", V: float64(codecAAC)},
+					},
+				},
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				Payload:         buf1,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+				Payload:         enc,
+			},
+			// empty NALUs must be removed
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_NALU,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x65, 0x01},
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_RAW,
+				Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+				DTS:             10 * time.Millisecond,
+			},
+			// parameters changed
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				Payload:         buf2,
+				DTS:             33 * time.Millisecond,
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				H264Type:        flvio.AVC_NALU,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x02, 0x41, 0x02},
+				DTS:             33 * time.Millisecond,
+				PTSDelta:        33 * time.Millisecond,
+			},
+		} {
+			err = conn.WriteMessage(msg)
+			require.NoError(t, err)
+		}
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	info, err := conn.ReadStreamInfo()
+	require.NoError(t, err)
+	require.Equal(t, &StreamInfo{
+		VideoCodec:        VideoCodecH264,
+		SPS:               sps1,
+		PPS:               pps,
+		AudioCodec:        AudioCodecMPEG4Audio,
+		AudioConfig:       enc,
+		AudioSampleRate:   44100,
+		AudioChannelCount: 2,
+	}, info)
+
+	for _, expected := range []*AccessUnit{
+		{
+			IsVideo:    true,
+			NALUs:      [][]byte{{0x65, 0x01}},
+			IsKeyFrame: true,
+		},
+		{
+			DTS: 10 * time.Millisecond,
+			PTS: 10 * time.Millisecond,
+			AU:  []byte{0x01, 0x02, 0x03, 0x04},
+		},
+		{
+			IsVideo: true,
+			DTS:     33 * time.Millisecond,
+			PTS:     66 * time.Millisecond,
+			NALUs:   [][]byte{sps2, pps, {0x41, 0x02}},
+		},
+	} {
+		au, err := conn.ReadAccessUnit()
+		require.NoError(t, err)
+		require.NotZero(t, au.NTP)
+
+		au.NTP = time.Time{}
+		require.Equal(t, expected, au)
+	}
+
+	<-done
+}
+
+func TestReadAccessUnitH265ParamsChange(t *testing.T) {
+	track := &format.H265{
+		PayloadTyp: 96,
+		VPS: []byte{
+			0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
+			0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+			0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
+		},
+		SPS: []byte{
+			0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
+			0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+			0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
+			0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
+			0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
+			0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
+			0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
+			0x00, 0x04, 0xc4, 0xb4, 0x20,
+		},
+		PPS: []byte{
+			0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+		},
+	}
+
+	pps2 := []byte{0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x91}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		err = conn.WriteTracks(track, nil)
+		require.NoError(t, err)
+
+		buf, err := h265conf.Conf{
+			VPS: track.VPS,
+			SPS: track.SPS,
+			PPS: pps2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		for _, msg := range []message.Message{
+			// parameters changed
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				FourCC:          message.FourCCHEVC,
+				H264Type:        flvio.AVC_SEQHDR,
+				Payload:         buf,
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				FourCC:          message.FourCCHEVC,
+				H264Type:        flvio.AVC_NALU,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x03, 0x02, 0x01, 0x03},
+			},
+		} {
+			err = conn.WriteMessage(msg)
+			require.NoError(t, err)
+		}
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	info, err := conn.ReadStreamInfo()
+	require.NoError(t, err)
+	require.Equal(t, VideoCodecH265, info.VideoCodec)
+
+	au, err := conn.ReadAccessUnit()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{track.VPS, track.SPS, pps2, {0x02, 0x01, 0x03}}, au.NALUs)
+
+	<-done
+}
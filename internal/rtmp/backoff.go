@@ -0,0 +1,96 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Backoff computes the delays between attempts to connect to a server,
+// in order not to overload it when it's down or refusing connections.
+// Delays grow exponentially from min to max, and a random jitter is applied
+// in order to spread the attempts of multiple clients.
+// It must be used by a single routine.
+type Backoff struct {
+	min  time.Duration
+	max  time.Duration
+	rand func() float64
+
+	attempt int
+}
+
+// NewBackoff allocates a Backoff.
+// min must be greater than zero.
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	return &Backoff{
+		min:  min,
+		max:  max,
+		rand: rand.Float64,
+	}
+}
+
+// Next returns the delay to wait before the next attempt.
+// The delay is chosen randomly between half and the whole of the current
+// exponential step.
+func (b *Backoff) Next() time.Duration {
+	d := b.min
+	for i := 0; i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+
+	// stop increasing the attempt count once the maximum is reached,
+	// in order not to overflow.
+	if d < b.max {
+		b.attempt++
+	}
+
+	return d/2 + time.Duration(b.rand()*float64(d/2))
+}
+
+// Reset restores the initial delay.
+// It must be called after a connection has been established successfully.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Wait waits for the delay returned by Next(), or until the context is canceled.
+// When the context is canceled, the error of the context is returned.
+func (b *Backoff) Wait(ctx context.Context) error {
+	t := time.NewTimer(b.Next())
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsRetriableError checks whether a connection attempt that failed with err
+// can be retried: network errors, timeouts and connections closed by the server
+// are retriable, while requests refused by the server (ConnectError),
+// canceled contexts and protocol errors are not.
+func IsRetriableError(err error) bool {
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
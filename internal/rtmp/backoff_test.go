@@ -0,0 +1,90 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(1*time.Second, 10*time.Second)
+
+	// without jitter, delays are half of the exponential step
+	b.rand = func() float64 { return 0 }
+	require.Equal(t, 500*time.Millisecond, b.Next())
+	require.Equal(t, 1*time.Second, b.Next())
+	require.Equal(t, 2*time.Second, b.Next())
+	require.Equal(t, 4*time.Second, b.Next())
+	require.Equal(t, 5*time.Second, b.Next())
+	require.Equal(t, 5*time.Second, b.Next())
+
+	// with maximum jitter, delays are the whole step
+	b.rand = func() float64 { return 1 }
+	require.Equal(t, 10*time.Second, b.Next())
+
+	b.Reset()
+	require.Equal(t, 1*time.Second, b.Next())
+}
+
+func TestBackoffWaitCanceled(t *testing.T) {
+	b := NewBackoff(1*time.Minute, 1*time.Minute)
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	ctxCancel()
+
+	err := b.Wait(ctx)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestIsRetriableError(t *testing.T) {
+	for _, ca := range []struct {
+		name      string
+		err       error
+		retriable bool
+	}{
+		{
+			"network",
+			&net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")},
+			true,
+		},
+		{
+			"timeout",
+			context.DeadlineExceeded,
+			true,
+		},
+		{
+			"eof",
+			io.EOF,
+			true,
+		},
+		{
+			"refused",
+			&ConnectError{Request: "connect", Code: "NetConnection.Connect.Rejected"},
+			false,
+		},
+		{
+			"wrapped refused",
+			fmt.Errorf("unable to connect: %w", &ConnectError{Request: "publish"}),
+			false,
+		},
+		{
+			"canceled",
+			context.Canceled,
+			false,
+		},
+		{
+			"protocol",
+			fmt.Errorf("invalid metadata"),
+			false,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.retriable, IsRetriableError(ca.err))
+		})
+	}
+}
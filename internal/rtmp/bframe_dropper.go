@@ -0,0 +1,153 @@
+package rtmp
+
+import (
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/bits"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+// h264 slice types, as defined in table 7-6 of ITU-T H.264.
+// Values from 5 to 9 have the same meaning of values from 0 to 4.
+const (
+	h264SliceTypeB = 1
+)
+
+// h264SliceIsB checks whether a slice NALU contains a B-slice,
+// by parsing the first fields of its header.
+func h264SliceIsB(nalu []byte) (bool, error) {
+	// the first fields are enough to read the slice type,
+	// emulation prevention bytes are removed from them only.
+	buf := nalu[1:]
+	if len(buf) > 8 {
+		buf = buf[:8]
+	}
+	buf = h264.EmulationPreventionRemove(buf)
+
+	pos := 0
+
+	// first_mb_in_slice
+	_, err := bits.ReadGolombUnsigned(buf, &pos)
+	if err != nil {
+		return false, err
+	}
+
+	sliceType, err := bits.ReadGolombUnsigned(buf, &pos)
+	if err != nil {
+		return false, err
+	}
+
+	return (sliceType % 5) == h264SliceTypeB, nil
+}
+
+// h264IsBFrame checks whether a H264 access unit is a B-frame,
+// and whether the B-frame is used as reference by other frames (nal_ref_idc != 0).
+func h264IsBFrame(nalus [][]byte) (bool, bool, error) {
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeIDR:
+			return false, false, nil
+
+		case h264.NALUTypeNonIDR:
+			isB, err := h264SliceIsB(nalu)
+			if err != nil {
+				return false, false, err
+			}
+
+			return isB, isB && ((nalu[0]>>5)&0x03) != 0, nil
+		}
+	}
+
+	return false, false, nil
+}
+
+// decoderConfigIsH264 checks whether a decoder configuration (AVC_SEQHDR) is a
+// AVCDecoderConfigurationRecord, since H265 can be sent with the same codec ID.
+func decoderConfigIsH264(buf []byte) bool {
+	var conf h264conf.Conf
+	err := conf.Unmarshal(buf)
+	if err != nil {
+		return false
+	}
+
+	return len(conf.SPS) != 0 && h264.NALUType(conf.SPS[0]&0x1F) == h264.NALUTypeSPS
+}
+
+// bFrameDropper removes B-frames from H264 streams, leaving I-frames and P-frames only,
+// in order to remove the delay caused by the reorder buffer of decoders.
+// B-frames used as references (b-pyramid) are kept, since other frames depend on them.
+type bFrameDropper struct {
+	isH264 bool
+
+	// reference B-frames have been found, therefore the reorder buffer
+	// is still needed and timestamps are only shifted by a constant.
+	refBFrames bool
+	dtsOffset  time.Duration
+	lastDTS    time.Duration
+}
+
+// process processes a video message. It returns false when the message must be dropped.
+func (d *bFrameDropper) process(msg *message.MsgVideo) (bool, error) {
+	// enhanced RTMP codecs are not H264
+	if msg.FourCC != 0 {
+		return true, nil
+	}
+
+	switch msg.H264Type {
+	case flvio.AVC_SEQHDR:
+		d.isH264 = decoderConfigIsH264(msg.Payload)
+
+	case flvio.AVC_NALU:
+		// streams are processed only after the decoder configuration has been received,
+		// in order to avoid parsing H265 NALUs as H264 ones.
+		if !d.isH264 {
+			return true, nil
+		}
+
+		nalus, err := h264.AVCCUnmarshal(msg.Payload)
+		if err != nil {
+			return false, err
+		}
+
+		isB, isRef, err := h264IsBFrame(nalus)
+		if err != nil {
+			return false, err
+		}
+
+		// B-frames that are not used as references can always be removed.
+		if isB && !isRef {
+			return false, nil
+		}
+
+		if isRef && !d.refBFrames {
+			d.refBFrames = true
+
+			// timestamps of previous frames were moved forward:
+			// move the following ones too, in order to keep the DTS monotonic.
+			if d.lastDTS > msg.DTS {
+				d.dtsOffset = d.lastDTS - msg.DTS
+			}
+		}
+
+		if d.refBFrames {
+			msg.DTS += d.dtsOffset
+		} else {
+			// in a stream without B-frames, decoding order is equal to presentation order,
+			// therefore frames can be decoded when they are presented.
+			msg.DTS += msg.PTSDelta
+			msg.PTSDelta = 0
+		}
+
+		d.lastDTS = msg.DTS
+	}
+
+	return true, nil
+}
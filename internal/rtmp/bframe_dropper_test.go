@@ -0,0 +1,233 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+func TestH264IsBFrame(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		nalus [][]byte
+		isB   bool
+		isRef bool
+	}{
+		{
+			"idr",
+			[][]byte{{0x65, 0x88}},
+			false,
+			false,
+		},
+		{
+			"i",
+			[][]byte{{0x41, 0x88}},
+			false,
+			false,
+		},
+		{
+			"p",
+			[][]byte{{0x09, 0xf0}, {0x41, 0xc0}},
+			false,
+			false,
+		},
+		{
+			"b",
+			[][]byte{{0x09, 0xf0}, {0x01, 0xa0}},
+			true,
+			false,
+		},
+		{
+			"b all slices",
+			[][]byte{{0x21, 0x9c}},
+			true,
+			true,
+		},
+		{
+			"b non-reference",
+			[][]byte{{0x01, 0x9c}},
+			true,
+			false,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			isB, isRef, err := h264IsBFrame(ca.nalus)
+			require.NoError(t, err)
+			require.Equal(t, ca.isB, isB)
+			require.Equal(t, ca.isRef, isRef)
+		})
+	}
+}
+
+func TestH264IsBFrameError(t *testing.T) {
+	_, _, err := h264IsBFrame([][]byte{{0x01, 0x00}})
+	require.Error(t, err)
+}
+
+func TestBFrameDropper(t *testing.T) {
+	videoConfig, err := h264conf.Conf{
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS: []byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+	}.Marshal()
+	require.NoError(t, err)
+
+	avcc := func(nalu []byte) []byte {
+		buf, err := h264.AVCCMarshal([][]byte{nalu})
+		require.NoError(t, err)
+		return buf
+	}
+
+	d := &bFrameDropper{}
+
+	// NALUs are not parsed before the decoder configuration
+	keep, err := d.process(&message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		Payload:  avcc([]byte{0x01, 0xa0}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+
+	keep, err = d.process(&message.MsgVideo{
+		IsKeyFrame: true,
+		H264Type:   flvio.AVC_SEQHDR,
+		Payload:    videoConfig,
+	})
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+
+	msg := &message.MsgVideo{
+		IsKeyFrame: true,
+		H264Type:   flvio.AVC_NALU,
+		DTS:        0,
+		PTSDelta:   66 * time.Millisecond,
+		Payload:    avcc([]byte{0x65, 0x88}),
+	}
+	keep, err = d.process(msg)
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+	require.Equal(t, 66*time.Millisecond, msg.DTS)
+	require.Equal(t, time.Duration(0), msg.PTSDelta)
+
+	msg = &message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      33 * time.Millisecond,
+		PTSDelta: 100 * time.Millisecond,
+		Payload:  avcc([]byte{0x41, 0xc0}),
+	}
+	keep, err = d.process(msg)
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+	require.Equal(t, 133*time.Millisecond, msg.DTS)
+	require.Equal(t, time.Duration(0), msg.PTSDelta)
+
+	keep, err = d.process(&message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      66 * time.Millisecond,
+		Payload:  avcc([]byte{0x01, 0xa0}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, false, keep)
+}
+
+func TestBFrameDropperReferenceBFrames(t *testing.T) {
+	videoConfig, err := h264conf.Conf{
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS: []byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+	}.Marshal()
+	require.NoError(t, err)
+
+	avcc := func(nalu []byte) []byte {
+		buf, err := h264.AVCCMarshal([][]byte{nalu})
+		require.NoError(t, err)
+		return buf
+	}
+
+	d := &bFrameDropper{}
+
+	keep, err := d.process(&message.MsgVideo{
+		IsKeyFrame: true,
+		H264Type:   flvio.AVC_SEQHDR,
+		Payload:    videoConfig,
+	})
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+
+	// b-pyramid: I0 P4 Bref2 b1 b3, in decoding order
+	msg := &message.MsgVideo{
+		IsKeyFrame: true,
+		H264Type:   flvio.AVC_NALU,
+		DTS:        0,
+		PTSDelta:   66 * time.Millisecond,
+		Payload:    avcc([]byte{0x65, 0x88}),
+	}
+	keep, err = d.process(msg)
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+	require.Equal(t, 66*time.Millisecond, msg.DTS)
+	require.Equal(t, time.Duration(0), msg.PTSDelta)
+
+	msg = &message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      33 * time.Millisecond,
+		PTSDelta: 166 * time.Millisecond,
+		Payload:  avcc([]byte{0x41, 0xc0}),
+	}
+	keep, err = d.process(msg)
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+	require.Equal(t, 199*time.Millisecond, msg.DTS)
+	require.Equal(t, time.Duration(0), msg.PTSDelta)
+
+	// the reference B-frame is kept, since the following frames depend on it
+	msg = &message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      66 * time.Millisecond,
+		PTSDelta: 66 * time.Millisecond,
+		Payload:  avcc([]byte{0x21, 0xa0}),
+	}
+	keep, err = d.process(msg)
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+	require.Equal(t, 199*time.Millisecond, msg.DTS)
+	require.Equal(t, 66*time.Millisecond, msg.PTSDelta)
+
+	// non-reference B-frames are still dropped
+	keep, err = d.process(&message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      100 * time.Millisecond,
+		Payload:  avcc([]byte{0x01, 0xa0}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, false, keep)
+
+	// timestamps are shifted by a constant, keeping the DTS monotonic
+	msg = &message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      166 * time.Millisecond,
+		PTSDelta: 166 * time.Millisecond,
+		Payload:  avcc([]byte{0x41, 0xc0}),
+	}
+	keep, err = d.process(msg)
+	require.NoError(t, err)
+	require.Equal(t, true, keep)
+	require.Equal(t, 299*time.Millisecond, msg.DTS)
+	require.Equal(t, 166*time.Millisecond, msg.PTSDelta)
+}
@@ -0,0 +1,69 @@
+package rtmp
+
+import (
+	"fmt"
+	"time"
+)
+
+// number of samples of the byte counter that are taken in a window.
+const bitrateLimiterSamplesPerWindow = 10
+
+type bitrateLimiterSample struct {
+	time  time.Time
+	bytes uint64
+}
+
+// bitrateLimiter measures the bitrate of a connection over a sliding window,
+// by sampling its byte counter, and reports when it exceeds a maximum.
+type bitrateLimiter struct {
+	maxBitrate uint64
+	window     time.Duration
+	now        func() time.Time
+
+	samples []bitrateLimiterSample
+}
+
+func newBitrateLimiter(maxBitrate uint64, window time.Duration) *bitrateLimiter {
+	return &bitrateLimiter{
+		maxBitrate: maxBitrate,
+		window:     window,
+		now:        time.Now,
+	}
+}
+
+// check samples the byte counter and returns an error if the bitrate
+// measured over the window exceeds the maximum.
+func (l *bitrateLimiter) check(bytes uint64) error {
+	now := l.now()
+
+	// samples are taken at most a few times per window in order to bound memory usage.
+	if len(l.samples) == 0 ||
+		now.Sub(l.samples[len(l.samples)-1].time) >= l.window/bitrateLimiterSamplesPerWindow {
+		l.samples = append(l.samples, bitrateLimiterSample{
+			time:  now,
+			bytes: bytes,
+		})
+	}
+
+	// remove samples that are out of the window, except the most recent one,
+	// that is used as start of the window.
+	n := 0
+	for n < (len(l.samples)-1) && now.Sub(l.samples[n+1].time) >= l.window {
+		n++
+	}
+	l.samples = l.samples[n:]
+
+	// the bitrate is measured only when a whole window is available,
+	// in order not to react to the burst that follows the connection setup.
+	elapsed := now.Sub(l.samples[0].time)
+	if elapsed < l.window {
+		return nil
+	}
+
+	bitrate := uint64(float64(bytes-l.samples[0].bytes) * 8 / elapsed.Seconds())
+	if bitrate > l.maxBitrate {
+		return fmt.Errorf("bitrate (%d bit/s) exceeds the maximum (%d bit/s)", bitrate, l.maxBitrate)
+	}
+
+	return nil
+}
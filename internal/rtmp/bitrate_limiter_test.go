@@ -0,0 +1,69 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBitrateLimiter(maxBitrate uint64, window time.Duration) (*bitrateLimiter, *time.Time) {
+	cur := time.Date(2010, 1, 1, 1, 1, 1, 0, time.UTC)
+	l := newBitrateLimiter(maxBitrate, window)
+	l.now = func() time.Time {
+		return cur
+	}
+	return l, &cur
+}
+
+func TestBitrateLimiterBelow(t *testing.T) {
+	l, cur := newTestBitrateLimiter(8000, 1*time.Second)
+
+	// 500 bytes per second
+	for i := 0; i <= 50; i++ {
+		err := l.check(uint64(i) * 50)
+		require.NoError(t, err)
+		*cur = cur.Add(100 * time.Millisecond)
+	}
+
+	// samples out of the window are removed
+	require.LessOrEqual(t, len(l.samples), bitrateLimiterSamplesPerWindow+1)
+}
+
+func TestBitrateLimiterInitialBurst(t *testing.T) {
+	l, cur := newTestBitrateLimiter(8000, 1*time.Second)
+
+	// a burst shorter than the window is allowed
+	err := l.check(0)
+	require.NoError(t, err)
+
+	*cur = cur.Add(100 * time.Millisecond)
+	err = l.check(5000)
+	require.NoError(t, err)
+
+	// then the average bitrate is taken into account
+	*cur = cur.Add(900 * time.Millisecond)
+	err = l.check(5000)
+	require.EqualError(t, err, "bitrate (40000 bit/s) exceeds the maximum (8000 bit/s)")
+}
+
+func TestBitrateLimiterAbove(t *testing.T) {
+	l, cur := newTestBitrateLimiter(8000, 1*time.Second)
+
+	// 500 bytes per second, then 2000 bytes per second
+	var bytes uint64
+	for i := 0; i < 20; i++ {
+		err := l.check(bytes)
+		require.NoError(t, err)
+		*cur = cur.Add(100 * time.Millisecond)
+		bytes += 50
+	}
+
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		err = l.check(bytes)
+		*cur = cur.Add(100 * time.Millisecond)
+		bytes += 200
+	}
+	require.Error(t, err)
+}
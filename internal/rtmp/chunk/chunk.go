@@ -5,6 +5,42 @@ import (
 	"io"
 )
 
+// timestamps and timestamp deltas that don't fit into the 3-byte field of the header
+// are replaced by this value and stored into a 4-byte extended timestamp field.
+const extendedTimestampMarker = 0xFFFFFF
+
+// HasExtendedTimestamp returns whether a timestamp or timestamp delta
+// must be stored into the extended timestamp field.
+func HasExtendedTimestamp(v uint32) bool {
+	return v >= extendedTimestampMarker
+}
+
+func readExtendedTimestamp(r io.Reader) (uint32, error) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3]), nil
+}
+
+func marshalTimestamp(buf []byte, v uint32) {
+	if HasExtendedTimestamp(v) {
+		v = extendedTimestampMarker
+	}
+	buf[0] = byte(v >> 16)
+	buf[1] = byte(v >> 8)
+	buf[2] = byte(v)
+}
+
+func marshalExtendedTimestamp(buf []byte, v uint32) {
+	buf[0] = byte(v >> 24)
+	buf[1] = byte(v >> 16)
+	buf[2] = byte(v >> 8)
+	buf[3] = byte(v)
+}
+
 // Chunk is a chunk.
 type Chunk interface {
 	Read(io.Reader, uint32) error
@@ -31,6 +31,13 @@ func (c *Chunk0) Read(r io.Reader, chunkMaxBodyLen uint32) error {
 	c.Type = MessageType(header[7])
 	c.MessageStreamID = uint32(header[8])<<24 | uint32(header[9])<<16 | uint32(header[10])<<8 | uint32(header[11])
 
+	if c.Timestamp == extendedTimestampMarker {
+		c.Timestamp, err = readExtendedTimestamp(r)
+		if err != nil {
+			return err
+		}
+	}
+
 	chunkBodyLen := c.BodyLen
 	if chunkBodyLen > chunkMaxBodyLen {
 		chunkBodyLen = chunkMaxBodyLen
@@ -43,11 +50,14 @@ func (c *Chunk0) Read(r io.Reader, chunkMaxBodyLen uint32) error {
 
 // Marshal writes the chunk.
 func (c Chunk0) Marshal() ([]byte, error) {
-	buf := make([]byte, 12+len(c.Body))
+	headerLen := 12
+	if HasExtendedTimestamp(c.Timestamp) {
+		headerLen += 4
+	}
+
+	buf := make([]byte, headerLen+len(c.Body))
 	buf[0] = c.ChunkStreamID
-	buf[1] = byte(c.Timestamp >> 16)
-	buf[2] = byte(c.Timestamp >> 8)
-	buf[3] = byte(c.Timestamp)
+	marshalTimestamp(buf[1:], c.Timestamp)
 	buf[4] = byte(c.BodyLen >> 16)
 	buf[5] = byte(c.BodyLen >> 8)
 	buf[6] = byte(c.BodyLen)
@@ -56,6 +66,9 @@ func (c Chunk0) Marshal() ([]byte, error) {
 	buf[9] = byte(c.MessageStreamID >> 16)
 	buf[10] = byte(c.MessageStreamID >> 8)
 	buf[11] = byte(c.MessageStreamID)
-	copy(buf[12:], c.Body)
+	if HasExtendedTimestamp(c.Timestamp) {
+		marshalExtendedTimestamp(buf[12:], c.Timestamp)
+	}
+	copy(buf[headerLen:], c.Body)
 	return buf, nil
 }
@@ -33,3 +33,31 @@ func TestChunk0Marshal(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, chunk0enc, buf)
 }
+
+var chunk0extenc = []byte{
+	0x19, 0xff, 0xff, 0xff, 0x0, 0x0, 0x4, 0x9,
+	0x0, 0x0, 0x0, 0x1, 0x1, 0x0, 0x0, 0x0,
+	0x1, 0x2, 0x3, 0x4,
+}
+
+var chunk0extdec = Chunk0{
+	ChunkStreamID:   25,
+	Timestamp:       0x1000000,
+	Type:            MessageTypeVideo,
+	MessageStreamID: 1,
+	BodyLen:         4,
+	Body:            []byte{0x01, 0x02, 0x03, 0x04},
+}
+
+func TestChunk0ReadExtendedTimestamp(t *testing.T) {
+	var chunk0 Chunk0
+	err := chunk0.Read(bytes.NewReader(chunk0extenc), 4)
+	require.NoError(t, err)
+	require.Equal(t, chunk0extdec, chunk0)
+}
+
+func TestChunk0MarshalExtendedTimestamp(t *testing.T) {
+	buf, err := chunk0extdec.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, chunk0extenc, buf)
+}
@@ -31,6 +31,13 @@ func (c *Chunk1) Read(r io.Reader, chunkMaxBodyLen uint32) error {
 	c.BodyLen = uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6])
 	c.Type = MessageType(header[7])
 
+	if c.TimestampDelta == extendedTimestampMarker {
+		c.TimestampDelta, err = readExtendedTimestamp(r)
+		if err != nil {
+			return err
+		}
+	}
+
 	chunkBodyLen := (c.BodyLen)
 	if chunkBodyLen > chunkMaxBodyLen {
 		chunkBodyLen = chunkMaxBodyLen
@@ -43,15 +50,21 @@ func (c *Chunk1) Read(r io.Reader, chunkMaxBodyLen uint32) error {
 
 // Marshal writes the chunk.
 func (c Chunk1) Marshal() ([]byte, error) {
-	buf := make([]byte, 8+len(c.Body))
+	headerLen := 8
+	if HasExtendedTimestamp(c.TimestampDelta) {
+		headerLen += 4
+	}
+
+	buf := make([]byte, headerLen+len(c.Body))
 	buf[0] = 1<<6 | c.ChunkStreamID
-	buf[1] = byte(c.TimestampDelta >> 16)
-	buf[2] = byte(c.TimestampDelta >> 8)
-	buf[3] = byte(c.TimestampDelta)
+	marshalTimestamp(buf[1:], c.TimestampDelta)
 	buf[4] = byte(c.BodyLen >> 16)
 	buf[5] = byte(c.BodyLen >> 8)
 	buf[6] = byte(c.BodyLen)
 	buf[7] = byte(c.Type)
-	copy(buf[8:], c.Body)
+	if HasExtendedTimestamp(c.TimestampDelta) {
+		marshalExtendedTimestamp(buf[8:], c.TimestampDelta)
+	}
+	copy(buf[headerLen:], c.Body)
 	return buf, nil
 }
@@ -25,6 +25,13 @@ func (c *Chunk2) Read(r io.Reader, chunkBodyLen uint32) error {
 	c.ChunkStreamID = header[0] & 0x3F
 	c.TimestampDelta = uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
 
+	if c.TimestampDelta == extendedTimestampMarker {
+		c.TimestampDelta, err = readExtendedTimestamp(r)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.Body = make([]byte, chunkBodyLen)
 	_, err = io.ReadFull(r, c.Body)
 	return err
@@ -32,11 +39,17 @@ func (c *Chunk2) Read(r io.Reader, chunkBodyLen uint32) error {
 
 // Marshal writes the chunk.
 func (c Chunk2) Marshal() ([]byte, error) {
-	buf := make([]byte, 4+len(c.Body))
+	headerLen := 4
+	if HasExtendedTimestamp(c.TimestampDelta) {
+		headerLen += 4
+	}
+
+	buf := make([]byte, headerLen+len(c.Body))
 	buf[0] = 2<<6 | c.ChunkStreamID
-	buf[1] = byte(c.TimestampDelta >> 16)
-	buf[2] = byte(c.TimestampDelta >> 8)
-	buf[3] = byte(c.TimestampDelta)
-	copy(buf[4:], c.Body)
+	marshalTimestamp(buf[1:], c.TimestampDelta)
+	if HasExtendedTimestamp(c.TimestampDelta) {
+		marshalExtendedTimestamp(buf[4:], c.TimestampDelta)
+	}
+	copy(buf[headerLen:], c.Body)
 	return buf, nil
 }
@@ -12,7 +12,14 @@ import (
 // the first one SHOULD use this type.
 type Chunk3 struct {
 	ChunkStreamID byte
-	Body          []byte
+
+	// when the preceding chunk of the same Chunk Stream ID contains an
+	// extended timestamp, the extended timestamp is repeated in type 3 chunks.
+	// HasExtendedTimestamp must be set before calling Read().
+	HasExtendedTimestamp bool
+	ExtendedTimestamp    uint32
+
+	Body []byte
 }
 
 // Read reads the chunk.
@@ -25,6 +32,13 @@ func (c *Chunk3) Read(r io.Reader, chunkBodyLen uint32) error {
 
 	c.ChunkStreamID = header[0] & 0x3F
 
+	if c.HasExtendedTimestamp {
+		c.ExtendedTimestamp, err = readExtendedTimestamp(r)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.Body = make([]byte, chunkBodyLen)
 	_, err = io.ReadFull(r, c.Body)
 	return err
@@ -32,8 +46,16 @@ func (c *Chunk3) Read(r io.Reader, chunkBodyLen uint32) error {
 
 // Marshal writes the chunk.
 func (c Chunk3) Marshal() ([]byte, error) {
-	buf := make([]byte, 1+len(c.Body))
+	headerLen := 1
+	if c.HasExtendedTimestamp {
+		headerLen += 4
+	}
+
+	buf := make([]byte, headerLen+len(c.Body))
 	buf[0] = 3<<6 | c.ChunkStreamID
-	copy(buf[1:], c.Body)
+	if c.HasExtendedTimestamp {
+		marshalExtendedTimestamp(buf[1:], c.ExtendedTimestamp)
+	}
+	copy(buf[headerLen:], c.Body)
 	return buf, nil
 }
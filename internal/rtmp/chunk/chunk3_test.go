@@ -28,3 +28,28 @@ func TestChunk3Marshal(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, chunk3enc, buf)
 }
+
+var chunk3extenc = []byte{
+	0xd9, 0x1, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3,
+	0x4,
+}
+
+var chunk3extdec = Chunk3{
+	ChunkStreamID:        25,
+	HasExtendedTimestamp: true,
+	ExtendedTimestamp:    0x1000000,
+	Body:                 []byte{0x01, 0x02, 0x03, 0x04},
+}
+
+func TestChunk3ReadExtendedTimestamp(t *testing.T) {
+	chunk3 := Chunk3{HasExtendedTimestamp: true}
+	err := chunk3.Read(bytes.NewReader(chunk3extenc), 4)
+	require.NoError(t, err)
+	require.Equal(t, chunk3extdec, chunk3)
+}
+
+func TestChunk3MarshalExtendedTimestamp(t *testing.T) {
+	buf, err := chunk3extdec.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, chunk3extenc, buf)
+}
@@ -2,21 +2,30 @@
 package rtmp
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aler9/gortsplib/v2/pkg/bits"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h265"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/notedit/rtmp/format/flv/flvio"
 
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/bytecounter"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h265conf"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/handshake"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
 )
@@ -24,6 +33,7 @@ import (
 const (
 	codecH264 = 7
 	codecAAC  = 10
+	codecH265 = 12
 )
 
 func resultIsOK1(res *message.MsgCommandAMF0) bool {
@@ -44,7 +54,8 @@ func resultIsOK1(res *message.MsgCommandAMF0) bool {
 	return v == "status"
 }
 
-func resultIsOK2(res *message.MsgCommandAMF0) bool {
+// resultIsStreamID checks whether the result of createStream contains a valid stream ID.
+func resultIsStreamID(res *message.MsgCommandAMF0) bool {
 	if len(res.Arguments) < 2 {
 		return false
 	}
@@ -54,30 +65,92 @@ func resultIsOK2(res *message.MsgCommandAMF0) bool {
 		return false
 	}
 
-	return v == 1
+	return v >= 1 && v <= math.MaxUint32 && v == math.Trunc(v)
 }
 
-func splitPath(u *url.URL) (app, stream string) {
+// messageStreamID converts a stream ID, as returned by createStream,
+// into the MessageStreamID field of messages, that is encoded in little endian.
+func messageStreamID(streamID uint32) uint32 {
+	return streamID<<24 | (streamID<<8)&0xFF0000 | (streamID>>8)&0xFF00 | streamID>>24
+}
+
+func defaultPort(scheme string) (string, error) {
+	switch scheme {
+	case "rtmp":
+		return "1935", nil
+
+	case "rtmps":
+		return "443", nil
+	}
+
+	return "", fmt.Errorf("unsupported scheme '%s'", scheme)
+}
+
+// fillHost applies the given port to the host of a URL when the port is missing.
+func fillHost(u *url.URL, port string) {
+	// some clients send IPv6 literals without brackets,
+	// that are parsed as a host and a port.
+	if strings.Contains(u.Host, ":") && !strings.HasPrefix(u.Host, "[") && net.ParseIP(u.Host) != nil {
+		u.Host = net.JoinHostPort(u.Host, port)
+		return
+	}
+
+	_, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+}
+
+// ParseURL parses a RTMP or RTMPS URL.
+// If the port is missing, the default port of the scheme is applied
+// (1935 for RTMP, 443 for RTMPS).
+func ParseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := defaultPort(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid host")
+	}
+
+	fillHost(u, port)
+
+	return u, nil
+}
+
+// splitPath splits the path of a URL into the app and the stream name.
+// appDepth is the number of path segments that belong to the app. If it is zero,
+// the app is made of the first segment, or of the first two segments
+// when the path contains more than two of them.
+func splitPath(u *url.URL, appDepth int) (app, stream string) {
 	nu := *u
 	nu.ForceQuery = false
 
-	pathsegs := strings.Split(nu.RequestURI(), "/")
-	if len(pathsegs) == 2 {
-		app = pathsegs[1]
-	}
-	if len(pathsegs) == 3 {
-		app = pathsegs[1]
-		stream = pathsegs[2]
+	pathsegs := strings.Split(strings.TrimPrefix(nu.RequestURI(), "/"), "/")
+
+	if appDepth <= 0 {
+		if len(pathsegs) > 2 {
+			appDepth = 2
+		} else {
+			appDepth = 1
+		}
 	}
-	if len(pathsegs) > 3 {
-		app = strings.Join(pathsegs[1:3], "/")
-		stream = strings.Join(pathsegs[3:], "/")
+
+	if appDepth >= len(pathsegs) {
+		return strings.Join(pathsegs, "/"), ""
 	}
-	return
+
+	return strings.Join(pathsegs[:appDepth], "/"), strings.Join(pathsegs[appDepth:], "/")
 }
 
-func getTcURL(u *url.URL) string {
-	app, _ := splitPath(u)
+func getTcURL(u *url.URL, appDepth int) string {
+	app, _ := splitPath(u, appDepth)
 	nu, _ := url.Parse(u.String()) // perform a deep copy
 	nu.RawQuery = ""
 	nu.Path = "/"
@@ -85,7 +158,8 @@ func getTcURL(u *url.URL) string {
 }
 
 func createURL(tcurl, app, play string) (*url.URL, error) {
-	u, err := url.ParseRequestURI("/" + app + "/" + play)
+	// some clients send the app with a trailing slash
+	u, err := url.ParseRequestURI("/" + strings.Trim(app, "/") + "/" + strings.TrimPrefix(play, "/"))
 	if err != nil {
 		return nil, err
 	}
@@ -98,26 +172,72 @@ func createURL(tcurl, app, play string) (*url.URL, error) {
 	if tu.Host == "" {
 		return nil, fmt.Errorf("invalid host")
 	}
-	u.Host = tu.Host
 
 	if tu.Scheme == "" {
 		return nil, fmt.Errorf("invalid scheme")
 	}
+
+	// tcUrls are sent by clients, that can use any scheme (rtmpt, rtmpe, ...):
+	// the default port is applied to known schemes only.
+	if port, err := defaultPort(tu.Scheme); err == nil {
+		fillHost(tu, port)
+	}
+
+	u.Host = tu.Host
 	u.Scheme = tu.Scheme
 
 	return u, nil
 }
 
+// ConnLogger allows to receive log lines.
+type ConnLogger interface {
+	Log(level logger.Level, format string, args ...interface{})
+}
+
 // Conn is a RTMP connection.
 type Conn struct {
+	rw  io.ReadWriter
 	bc  *bytecounter.ReadWriter
 	mrw *message.ReadWriter
+
+	connectProperties flvio.AMFMap
+	clientProperties  flvio.AMFMap
+	objectEncoding    int
+	playLimiter       *PlayLimiter
+	playAcquired      bool
+	pacer             *pacer
+	bFrameDropper     *bFrameDropper
+	tsCorrector       *timestampCorrector
+	aacObjectTypes    []mpeg4audio.ObjectType
+	setupTimeout      time.Duration
+	streamID          uint32
+	bitrateLimiter    *bitrateLimiter
+	duration          time.Duration
+	fileSize          uint64
+	logger            ConnLogger
+	onMetadata        func(flvio.AMFMap)
+	onPlayCommand     func(PlayCommand) error
+	onReleaseStream   func(*url.URL)
+	onUnknownCommand  func(*message.MsgCommandAMF0) (*message.MsgCommandAMF0, error)
+	releasedStream    string
+	tracksRead        bool
+	commandAMF3       bool
+	appDepth          int
+
+	additionalAudioTracks map[uint8]format.Format
+
+	auVideoTrack         format.Format
+	auAudioTrack         format.Format
+	auVideoParamsChanged bool
+	auPending            []*AccessUnit
 }
 
 // NewConn initializes a connection.
 func NewConn(rw io.ReadWriter) *Conn {
 	return &Conn{
-		bc: bytecounter.NewReadWriter(rw),
+		rw:       rw,
+		bc:       bytecounter.NewReadWriter(rw),
+		streamID: 1,
 	}
 }
 
@@ -131,6 +251,249 @@ func (c *Conn) BytesSent() uint64 {
 	return c.bc.Writer.Count()
 }
 
+// MessageStreamID returns the message stream ID of stream commands and media messages,
+// that is the one negotiated with the createStream command, in the format of the
+// MessageStreamID field of messages.
+// It must be called after InitializeClient() or InitializeServer().
+func (c *Conn) MessageStreamID() uint32 {
+	return messageStreamID(c.streamID)
+}
+
+// VideoChunkStreamID returns the chunk stream ID of video messages written by the connection.
+func (c *Conn) VideoChunkStreamID() byte {
+	return message.MsgVideoChunkStreamID
+}
+
+// AudioChunkStreamID returns the chunk stream ID of audio messages written by the connection.
+func (c *Conn) AudioChunkStreamID() byte {
+	return message.MsgAudioChunkStreamID
+}
+
+// SetClientConnectProperties sets properties that are advertised to the server
+// in the connect command of a client-side connection. They replace the default ones
+// with the same name (flashVer, capabilities, audioCodecs, videoCodecs, ...)
+// and are appended otherwise (swfUrl, pageUrl, ...). This allows to impersonate
+// a specific encoder, i.e. by setting flashVer to "FMLE/3.0 (compatible; FMSc/1.0)",
+// or to provide fields required by some origins, i.e. type "nonprivate".
+// It must be called before InitializeClient().
+func (c *Conn) SetClientConnectProperties(props flvio.AMFMap) {
+	c.clientProperties = props
+}
+
+// SetClientObjectEncoding sets the object encoding that is requested in the connect command
+// of a client-side connection, that can be 0 (AMF0, the default) or 3 (AMF3).
+// When it is 3, the objectEncoding property is added to the connect command
+// and, if the server accepts it, the following commands are written with the AMF3 encoding.
+// It must be called before InitializeClient().
+func (c *Conn) SetClientObjectEncoding(enc int) {
+	c.objectEncoding = enc
+}
+
+// SetAppDepth sets the number of path segments of the URL passed to InitializeClient()
+// that make up the app name; the remaining ones make up the stream name.
+// i.e. with a depth of 3, rtmp://host/live/region/cam1/streamkey is split into
+// app "live/region/cam1" and stream "streamkey".
+// If it is zero (the default), the app is made of the first path segment,
+// or of the first two segments when the path contains more than two of them.
+// It must be called before InitializeClient().
+func (c *Conn) SetAppDepth(depth int) {
+	c.appDepth = depth
+}
+
+// SetLogger sets a ConnLogger that receives anomalies that don't cause errors,
+// like skipped or malformed messages. If it is not set, they are discarded.
+func (c *Conn) SetLogger(l ConnLogger) {
+	c.logger = l
+}
+
+func (c *Conn) log(level logger.Level, format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Log(level, format, args...)
+	}
+}
+
+// SetOnMetadata sets a callback that is called by ReadMessage() when
+// the metadata is updated after ReadTracks(), i.e. when the encoder changes
+// resolution or bitrate and sends a new @setDataFrame onMetaData.
+// The message is returned by ReadMessage() too.
+func (c *Conn) SetOnMetadata(cb func(flvio.AMFMap)) {
+	c.onMetadata = cb
+}
+
+// SetOnPlayCommand sets a callback that is called by ReadMessage() when
+// a play client sends a seek, pause or resume command, in order to allow
+// a server of finite streams to reposition the source.
+// If the callback returns nil, the client is notified that the command succeeded
+// (NetStream.Seek.Notify, NetStream.Pause.Notify or NetStream.Unpause.Notify),
+// otherwise that it failed. If the callback is not set, commands always fail.
+// ReadMessage() can be called in a routine that is different from the one that
+// writes messages. The command is returned by ReadMessage() too.
+func (c *Conn) SetOnPlayCommand(cb func(PlayCommand) error) {
+	c.onPlayCommand = cb
+}
+
+// SetOnReleaseStream sets a callback that is called by InitializeServer() when
+// a publisher sends a releaseStream or FCPublish command, with the URL of the
+// stream it is going to publish. Publishers send these commands in order to ask the server
+// to release the stream from a previous session, i.e. after a crash and a reconnection,
+// therefore the callback allows to close the existing publisher before the new one publishes.
+// The callback is called once per stream, even if the publisher sends both commands.
+// It must be called before InitializeServer().
+func (c *Conn) SetOnReleaseStream(cb func(*url.URL)) {
+	c.onReleaseStream = cb
+}
+
+// SetOnUnknownCommand sets a callback that is called by InitializeServer() when
+// a command that is not recognized is received, like getStreamLength or FCSubscribe.
+// The callback returns the response to send to the client, or nil to send nothing.
+// If the callback returns an error, InitializeServer() fails.
+// By default, commands that expect a response (i.e. with a non-zero CommandID) are answered with _error,
+// since some clients stall when they don't receive a response.
+// It must be called before InitializeServer().
+func (c *Conn) SetOnUnknownCommand(cb func(*message.MsgCommandAMF0) (*message.MsgCommandAMF0, error)) {
+	c.onUnknownCommand = cb
+}
+
+// SetPlayLimiter sets a PlayLimiter that is used to reject play requests
+// when the maximum number of play clients is reached.
+// It must be called before InitializeServer().
+func (c *Conn) SetPlayLimiter(l *PlayLimiter) {
+	c.playLimiter = l
+}
+
+// ReleasePlay releases the slot of the PlayLimiter acquired by a play request.
+// It must be called when a play client disconnects.
+func (c *Conn) ReleasePlay() {
+	if c.playAcquired {
+		c.playAcquired = false
+		c.playLimiter.release()
+	}
+}
+
+// SetPacing enables or disables pacing of media messages.
+// When enabled, WriteMessage() releases video and audio messages according to their DTS,
+// in order to smooth bursts, and never delays a message more than one frame interval.
+func (c *Conn) SetPacing(enabled bool) {
+	if enabled {
+		c.pacer = newPacer()
+	} else {
+		c.pacer = nil
+	}
+}
+
+// SetDropBFrames enables or disables the removal of B-frames from H264 streams that are read.
+// When enabled, ReadMessage() drops video messages that contain B-frames and sets the DTS
+// of the remaining ones equal to their PTS, in order to obtain an IPP stream that can be
+// decoded without the delay of the reorder buffer. This is lossy and reduces the frame rate.
+// B-frames used as references by other frames (b-pyramid) are kept, and when one of them is found,
+// timestamps are not rewritten anymore from that point on, since the reorder buffer is still needed.
+// H265 streams are not affected.
+// It must be called before ReadTracks().
+func (c *Conn) SetDropBFrames(enabled bool) {
+	if enabled {
+		c.bFrameDropper = &bFrameDropper{}
+	} else {
+		c.bFrameDropper = nil
+	}
+}
+
+// SetTimestampCorrection enables or disables the correction of non-monotonic timestamps of streams that are read.
+// When enabled, ReadMessage() prevents the DTS of each track from going backward, by replacing the DTS
+// of frames that precede the previous frame of the same track with the DTS of the previous frame.
+// Corrections greater than warnThreshold are logged.
+// It must be called before ReadTracks().
+func (c *Conn) SetTimestampCorrection(enabled bool, warnThreshold time.Duration) {
+	if enabled {
+		c.tsCorrector = newTimestampCorrector(warnThreshold, c.log)
+	} else {
+		c.tsCorrector = nil
+	}
+}
+
+// SetAACObjectTypes sets the AAC object types that are accepted from publishers.
+// Tracks with an extension that is not allowed are downgraded, when possible, by removing it,
+// otherwise ReadTracks() returns an error.
+// By default, AAC-LC, HE-AAC (SBR) and HE-AACv2 (PS) are accepted.
+// It must be called before ReadTracks().
+func (c *Conn) SetAACObjectTypes(types []mpeg4audio.ObjectType) {
+	c.aacObjectTypes = types
+}
+
+// SetSetupTimeout sets the maximum time that InitializeServer() can take,
+// from the handshake to the publish or play command, after which it returns an error.
+// Unlike read deadlines, it is not extended by messages that don't advance the setup,
+// therefore it prevents clients from holding the connection by sending commands slowly.
+// 0 means no limit, that is the default.
+// It must be called before InitializeServer().
+func (c *Conn) SetSetupTimeout(timeout time.Duration) {
+	c.setupTimeout = timeout
+}
+
+// SetMaxBitrate sets the maximum bitrate of received data, in bits per second,
+// that is measured with the byte counter over a sliding window of the given duration.
+// When it is exceeded, ReadMessage() notifies the publisher with a NetStream.Publish.BadName
+// status and returns an error, and the connection must be closed.
+// 0 means no limit, that is the default.
+// It must be called before ReadTracks().
+func (c *Conn) SetMaxBitrate(bitrate uint64, window time.Duration) {
+	if bitrate != 0 {
+		c.bitrateLimiter = newBitrateLimiter(bitrate, window)
+	} else {
+		c.bitrateLimiter = nil
+	}
+}
+
+// IsFinite returns whether the stream is finite,
+// i.e. it's a file that is being streamed, as advertised by the metadata.
+// It must be called after ReadTracks().
+func (c *Conn) IsFinite() bool {
+	return c.duration > 0
+}
+
+// Duration returns the total duration of a finite stream, as advertised by the metadata.
+// It must be called after ReadTracks().
+func (c *Conn) Duration() time.Duration {
+	return c.duration
+}
+
+// FileSize returns the size of the file of a finite stream, as advertised by the metadata.
+// It must be called after ReadTracks().
+func (c *Conn) FileSize() uint64 {
+	return c.fileSize
+}
+
+// ConnectProperties returns the properties advertised by the peer during the connect phase.
+// On server-side connections, they are the properties of the client connect command
+// (flashVer, audioCodecs, videoCodecs, videoFunction, ...).
+// On client-side connections, they are the properties of the server connect response
+// (fmsVer, capabilities, ...).
+func (c *Conn) ConnectProperties() flvio.AMFMap {
+	return c.connectProperties
+}
+
+// commandFromMessage returns the command contained in a message.
+// AMF3 commands are converted into AMF0 commands. Once an AMF3 command is received,
+// commands are written with the AMF3 encoding too, in order to match the one of the peer.
+func (c *Conn) commandFromMessage(msg message.Message) (*message.MsgCommandAMF0, bool) {
+	switch tmsg := msg.(type) {
+	case *message.MsgCommandAMF0:
+		return tmsg, true
+
+	case *message.MsgCommandAMF3:
+		c.commandAMF3 = true
+		return (*message.MsgCommandAMF0)(tmsg), true
+	}
+
+	return nil, false
+}
+
+func (c *Conn) writeCommand(cmd *message.MsgCommandAMF0) error {
+	if c.commandAMF3 {
+		return c.mrw.Write((*message.MsgCommandAMF3)(cmd))
+	}
+	return c.mrw.Write(cmd)
+}
+
 func (c *Conn) readCommand() (*message.MsgCommandAMF0, error) {
 	for {
 		msg, err := c.mrw.Read()
@@ -138,26 +501,75 @@ func (c *Conn) readCommand() (*message.MsgCommandAMF0, error) {
 			return nil, err
 		}
 
-		if cmd, ok := msg.(*message.MsgCommandAMF0); ok {
+		if cmd, ok := c.commandFromMessage(msg); ok {
 			return cmd, nil
 		}
 	}
 }
 
-func (c *Conn) readCommandResult(commandID int, commandName string, isValid func(*message.MsgCommandAMF0) bool) error {
+// ConnectError is returned by InitializeClient when the server refuses a request,
+// for instance because credentials are wrong or the stream doesn't exist.
+// Unlike network errors, it's not solved by retrying.
+type ConnectError struct {
+	// name of the refused request (connect, createStream, play or publish).
+	Request string
+
+	// status code and description sent by the server, if any.
+	Code        string
+	Description string
+}
+
+// Error implements the error interface.
+func (e *ConnectError) Error() string {
+	ret := "server refused " + e.Request + " request"
+	if e.Code != "" {
+		ret += " (" + e.Code + ")"
+	}
+	if e.Description != "" {
+		ret += ": " + e.Description
+	}
+	return ret
+}
+
+func newConnectError(request string, cmd *message.MsgCommandAMF0) *ConnectError {
+	e := &ConnectError{
+		Request: request,
+	}
+
+	if len(cmd.Arguments) >= 2 {
+		if ma, ok := cmd.Arguments[1].(flvio.AMFMap); ok {
+			e.Code, _ = ma.GetString("code")
+			e.Description, _ = ma.GetString("description")
+		}
+	}
+
+	return e
+}
+
+func (c *Conn) readCommandResult(
+	request string,
+	commandID int,
+	commandName string,
+	isValid func(*message.MsgCommandAMF0) bool,
+) (*message.MsgCommandAMF0, error) {
 	for {
 		msg, err := c.mrw.Read()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if cmd, ok := msg.(*message.MsgCommandAMF0); ok {
-			if cmd.CommandID == commandID && cmd.Name == commandName {
+		if cmd, ok := c.commandFromMessage(msg); ok && cmd.CommandID == commandID {
+			switch {
+			case cmd.Name == commandName:
 				if !isValid(cmd) {
-					return fmt.Errorf("server refused connect request")
+					return nil, newConnectError(request, cmd)
 				}
 
-				return nil
+				return cmd, nil
+
+			// requests can be refused with an _error result
+			case cmd.Name == "_error":
+				return nil, newConnectError(request, cmd)
 			}
 		}
 	}
@@ -165,7 +577,11 @@ func (c *Conn) readCommandResult(commandID int, commandName string, isValid func
 
 // InitializeClient performs the initialization of a client-side connection.
 func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
-	connectpath, actionpath := splitPath(u)
+	if c.objectEncoding != 0 && c.objectEncoding != 3 {
+		return fmt.Errorf("unsupported object encoding: %d", c.objectEncoding)
+	}
+
+	connectpath, actionpath := splitPath(u, c.appDepth)
 
 	err := handshake.DoClient(c.bc, false)
 	if err != nil {
@@ -196,34 +612,54 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 		return err
 	}
 
-	err = c.mrw.Write(&message.MsgCommandAMF0{
+	props := flvio.AMFMap{
+		{K: "app", V: connectpath},
+		{K: "flashVer", V: "LNX 9,0,124,2"},
+		{K: "tcUrl", V: getTcURL(u, c.appDepth)},
+		{K: "fpad", V: false},
+		{K: "capabilities", V: 15},
+		{K: "audioCodecs", V: 4071},
+		{K: "videoCodecs", V: 252},
+		{K: "videoFunction", V: 1},
+	}
+	if c.objectEncoding != 0 {
+		props = props.Set("objectEncoding", float64(c.objectEncoding))
+	}
+	for _, kv := range c.clientProperties {
+		props = props.Set(kv.K, kv.V)
+	}
+
+	// the connect command is always encoded with AMF0
+	err = c.writeCommand(&message.MsgCommandAMF0{
 		ChunkStreamID: 3,
 		Name:          "connect",
 		CommandID:     1,
 		Arguments: []interface{}{
-			flvio.AMFMap{
-				{K: "app", V: connectpath},
-				{K: "flashVer", V: "LNX 9,0,124,2"},
-				{K: "tcUrl", V: getTcURL(u)},
-				{K: "fpad", V: false},
-				{K: "capabilities", V: 15},
-				{K: "audioCodecs", V: 4071},
-				{K: "videoCodecs", V: 252},
-				{K: "videoFunction", V: 1},
-			},
+			props,
 		},
 	})
 	if err != nil {
 		return err
 	}
 
-	err = c.readCommandResult(1, "_result", resultIsOK1)
+	res, err := c.readCommandResult("connect", 1, "_result", resultIsOK1)
 	if err != nil {
 		return err
 	}
 
+	if ma, ok := res.Arguments[0].(flvio.AMFMap); ok {
+		c.connectProperties = ma
+	}
+
+	// switch to AMF3 when the server accepts the requested encoding
+	if oe, ok := props.GetFloat64("objectEncoding"); ok && oe == 3 {
+		if oe, ok := res.Arguments[1].(flvio.AMFMap).GetFloat64("objectEncoding"); ok && oe == 3 {
+			c.commandAMF3 = true
+		}
+	}
+
 	if !isPublishing {
-		err = c.mrw.Write(&message.MsgCommandAMF0{
+		err = c.writeCommand(&message.MsgCommandAMF0{
 			ChunkStreamID: 3,
 			Name:          "createStream",
 			CommandID:     2,
@@ -235,10 +671,11 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 			return err
 		}
 
-		err = c.readCommandResult(2, "_result", resultIsOK2)
+		res, err = c.readCommandResult("createStream", 2, "_result", resultIsStreamID)
 		if err != nil {
 			return err
 		}
+		c.streamID = uint32(res.Arguments[1].(float64))
 
 		err = c.mrw.Write(&message.MsgUserControlSetBufferLength{
 			BufferLength: 0x64,
@@ -247,9 +684,9 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 			return err
 		}
 
-		err = c.mrw.Write(&message.MsgCommandAMF0{
+		err = c.writeCommand(&message.MsgCommandAMF0{
 			ChunkStreamID:   4,
-			MessageStreamID: 0x1000000,
+			MessageStreamID: c.MessageStreamID(),
 			Name:            "play",
 			CommandID:       3,
 			Arguments: []interface{}{
@@ -261,10 +698,11 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 			return err
 		}
 
-		return c.readCommandResult(3, "onStatus", resultIsOK1)
+		_, err = c.readCommandResult("play", 3, "onStatus", resultIsOK1)
+		return err
 	}
 
-	err = c.mrw.Write(&message.MsgCommandAMF0{
+	err = c.writeCommand(&message.MsgCommandAMF0{
 		ChunkStreamID: 3,
 		Name:          "releaseStream",
 		CommandID:     2,
@@ -277,7 +715,7 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 		return err
 	}
 
-	err = c.mrw.Write(&message.MsgCommandAMF0{
+	err = c.writeCommand(&message.MsgCommandAMF0{
 		ChunkStreamID: 3,
 		Name:          "FCPublish",
 		CommandID:     3,
@@ -290,7 +728,7 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 		return err
 	}
 
-	err = c.mrw.Write(&message.MsgCommandAMF0{
+	err = c.writeCommand(&message.MsgCommandAMF0{
 		ChunkStreamID: 3,
 		Name:          "createStream",
 		CommandID:     4,
@@ -302,14 +740,15 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 		return err
 	}
 
-	err = c.readCommandResult(4, "_result", resultIsOK2)
+	res, err = c.readCommandResult("createStream", 4, "_result", resultIsStreamID)
 	if err != nil {
 		return err
 	}
+	c.streamID = uint32(res.Arguments[1].(float64))
 
-	err = c.mrw.Write(&message.MsgCommandAMF0{
+	err = c.writeCommand(&message.MsgCommandAMF0{
 		ChunkStreamID:   4,
-		MessageStreamID: 0x1000000,
+		MessageStreamID: c.MessageStreamID(),
 		Name:            "publish",
 		CommandID:       5,
 		Arguments: []interface{}{
@@ -322,11 +761,38 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 		return err
 	}
 
-	return c.readCommandResult(5, "onStatus", resultIsOK1)
+	_, err = c.readCommandResult("publish", 5, "onStatus", resultIsOK1)
+	return err
 }
 
 // InitializeServer performs the initialization of a server-side connection.
 func (c *Conn) InitializeServer() (*url.URL, bool, error) {
+	if c.setupTimeout <= 0 {
+		return c.initializeServer()
+	}
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), c.setupTimeout)
+	defer ctxCancel()
+
+	var u *url.URL
+	var isPublishing bool
+
+	err := c.runWithContext(ctx, func() error {
+		var err error
+		u, isPublishing, err = c.initializeServer()
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, false, fmt.Errorf("connection setup took more than %v", c.setupTimeout)
+		}
+		return nil, false, err
+	}
+
+	return u, isPublishing, nil
+}
+
+func (c *Conn) initializeServer() (*url.URL, bool, error) {
 	err := handshake.DoServer(c.bc, false)
 	if err != nil {
 		return nil, false, err
@@ -357,6 +823,8 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 		return nil, false, fmt.Errorf("invalid connect command: %+v", cmd)
 	}
 
+	c.connectProperties = ma
+
 	tcURL, ok := ma.GetString("tcUrl")
 	if !ok {
 		tcURL, ok = ma.GetString("tcurl")
@@ -389,7 +857,7 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 
 	oe, _ := ma.GetFloat64("objectEncoding")
 
-	err = c.mrw.Write(&message.MsgCommandAMF0{
+	err = c.writeCommand(&message.MsgCommandAMF0{
 		ChunkStreamID: cmd.ChunkStreamID,
 		Name:          "_result",
 		CommandID:     cmd.CommandID,
@@ -417,14 +885,46 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 		}
 
 		switch cmd.Name {
+		// bandwidth check, performed by some legacy encoders
+		case "checkBandwidth", "_checkbw":
+			err = c.writeCommand(&message.MsgCommandAMF0{
+				ChunkStreamID: cmd.ChunkStreamID,
+				Name:          "_result",
+				CommandID:     cmd.CommandID,
+				Arguments: []interface{}{
+					nil,
+				},
+			})
+			if err != nil {
+				return nil, false, err
+			}
+
+			err = c.writeCommand(&message.MsgCommandAMF0{
+				ChunkStreamID: cmd.ChunkStreamID,
+				Name:          "onBWDone",
+				CommandID:     0,
+				Arguments: []interface{}{
+					nil,
+				},
+			})
+			if err != nil {
+				return nil, false, err
+			}
+
+		case "releaseStream", "FCPublish":
+			err := c.releaseStream(cmd, tcURL, connectpath)
+			if err != nil {
+				return nil, false, err
+			}
+
 		case "createStream":
-			err = c.mrw.Write(&message.MsgCommandAMF0{
+			err = c.writeCommand(&message.MsgCommandAMF0{
 				ChunkStreamID: cmd.ChunkStreamID,
 				Name:          "_result",
 				CommandID:     cmd.CommandID,
 				Arguments: []interface{}{
 					nil,
-					float64(1),
+					float64(c.streamID),
 				},
 			})
 			if err != nil {
@@ -446,6 +946,32 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, err
 			}
 
+			if c.playLimiter != nil {
+				if !c.playLimiter.acquire() {
+					err = c.writeCommand(&message.MsgCommandAMF0{
+						ChunkStreamID:   5,
+						MessageStreamID: c.MessageStreamID(),
+						Name:            "onStatus",
+						CommandID:       cmd.CommandID,
+						Arguments: []interface{}{
+							nil,
+							flvio.AMFMap{
+								{K: "level", V: "error"},
+								{K: "code", V: "NetStream.Play.Failed"},
+								{K: "description", V: "too many readers"},
+							},
+						},
+					})
+					if err != nil {
+						return nil, false, err
+					}
+
+					return nil, false, fmt.Errorf("too many readers")
+				}
+
+				c.playAcquired = true
+			}
+
 			err = c.mrw.Write(&message.MsgUserControlStreamIsRecorded{
 				StreamID: 1,
 			})
@@ -460,9 +986,9 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, err
 			}
 
-			err = c.mrw.Write(&message.MsgCommandAMF0{
+			err = c.writeCommand(&message.MsgCommandAMF0{
 				ChunkStreamID:   5,
-				MessageStreamID: 0x1000000,
+				MessageStreamID: c.MessageStreamID(),
 				Name:            "onStatus",
 				CommandID:       cmd.CommandID,
 				Arguments: []interface{}{
@@ -478,9 +1004,9 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, err
 			}
 
-			err = c.mrw.Write(&message.MsgCommandAMF0{
+			err = c.writeCommand(&message.MsgCommandAMF0{
 				ChunkStreamID:   5,
-				MessageStreamID: 0x1000000,
+				MessageStreamID: c.MessageStreamID(),
 				Name:            "onStatus",
 				CommandID:       cmd.CommandID,
 				Arguments: []interface{}{
@@ -496,9 +1022,9 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, err
 			}
 
-			err = c.mrw.Write(&message.MsgCommandAMF0{
+			err = c.writeCommand(&message.MsgCommandAMF0{
 				ChunkStreamID:   5,
-				MessageStreamID: 0x1000000,
+				MessageStreamID: c.MessageStreamID(),
 				Name:            "onStatus",
 				CommandID:       cmd.CommandID,
 				Arguments: []interface{}{
@@ -514,9 +1040,9 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, err
 			}
 
-			err = c.mrw.Write(&message.MsgCommandAMF0{
+			err = c.writeCommand(&message.MsgCommandAMF0{
 				ChunkStreamID:   5,
-				MessageStreamID: 0x1000000,
+				MessageStreamID: c.MessageStreamID(),
 				Name:            "onStatus",
 				CommandID:       cmd.CommandID,
 				Arguments: []interface{}{
@@ -549,11 +1075,11 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 				return nil, false, err
 			}
 
-			err = c.mrw.Write(&message.MsgCommandAMF0{
+			err = c.writeCommand(&message.MsgCommandAMF0{
 				ChunkStreamID:   5,
 				Name:            "onStatus",
 				CommandID:       cmd.CommandID,
-				MessageStreamID: 0x1000000,
+				MessageStreamID: c.MessageStreamID(),
 				Arguments: []interface{}{
 					nil,
 					flvio.AMFMap{
@@ -568,66 +1094,882 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 			}
 
 			return u, true, nil
+
+		default:
+			err := c.handleUnknownCommand(cmd)
+			if err != nil {
+				return nil, false, err
+			}
 		}
 	}
 }
 
-// ReadMessage reads a message.
-func (c *Conn) ReadMessage() (message.Message, error) {
-	return c.mrw.Read()
-}
+func (c *Conn) handleUnknownCommand(cmd *message.MsgCommandAMF0) error {
+	var res *message.MsgCommandAMF0
 
-// WriteMessage writes a message.
-func (c *Conn) WriteMessage(msg message.Message) error {
-	return c.mrw.Write(msg)
-}
+	if c.onUnknownCommand != nil {
+		var err error
+		res, err = c.onUnknownCommand(cmd)
+		if err != nil {
+			return err
+		}
+	} else if cmd.CommandID != 0 {
+		res = &message.MsgCommandAMF0{
+			ChunkStreamID: cmd.ChunkStreamID,
+			Name:          "_error",
+			CommandID:     cmd.CommandID,
+			Arguments: []interface{}{
+				nil,
+				flvio.AMFMap{
+					{K: "level", V: "error"},
+					{K: "code", V: "NetConnection.Call.Failed"},
+					{K: "description", V: "unsupported command: " + cmd.Name},
+				},
+			},
+		}
+	}
 
-func trackFromH264DecoderConfig(data []byte) (*format.H264, error) {
-	var conf h264conf.Conf
-	err := conf.Unmarshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse H264 config: %v", err)
+	if res == nil {
+		return nil
 	}
 
-	return &format.H264{
-		PayloadTyp:        96,
-		SPS:               conf.SPS,
-		PPS:               conf.PPS,
-		PacketizationMode: 1,
-	}, nil
+	return c.writeCommand(res)
 }
 
-func trackFromAACDecoderConfig(data []byte) (*format.MPEG4Audio, error) {
-	var mpegConf mpeg4audio.Config
-	err := mpegConf.Unmarshal(data)
+func (c *Conn) releaseStream(cmd *message.MsgCommandAMF0, tcURL string, connectpath string) error {
+	if c.onReleaseStream == nil || len(cmd.Arguments) < 2 {
+		return nil
+	}
+
+	actionpath, ok := cmd.Arguments[1].(string)
+	if !ok || actionpath == "" || actionpath == c.releasedStream {
+		return nil
+	}
+
+	u, err := createURL(tcURL, connectpath, actionpath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &format.MPEG4Audio{
-		PayloadTyp:       96,
-		Config:           &mpegConf,
-		SizeLength:       13,
-		IndexLength:      3,
-		IndexDeltaLength: 3,
-	}, nil
+	c.releasedStream = actionpath
+	c.onReleaseStream(u)
+	return nil
 }
 
-var errEmptyMetadata = errors.New("metadata is empty")
-
-func (c *Conn) readTracksFromMetadata(payload []interface{}) (format.Format, *format.MPEG4Audio, error) {
-	if len(payload) != 1 {
-		return nil, nil, fmt.Errorf("invalid metadata")
+// WriteUnpublishNotify notifies a play client that the publisher has left.
+// It is the counterpart of the PublishNotify sent by InitializeServer()
+// and allows players to stop or reconnect gracefully.
+func (c *Conn) WriteUnpublishNotify() error {
+	err := c.writeCommand(&message.MsgCommandAMF0{
+		ChunkStreamID:   5,
+		MessageStreamID: c.MessageStreamID(),
+		Name:            "onStatus",
+		CommandID:       0,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "status"},
+				{K: "code", V: "NetStream.Play.UnpublishNotify"},
+				{K: "description", V: "unpublish notify"},
+			},
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	md, ok := payload[0].(flvio.AMFMap)
-	if !ok {
-		return nil, nil, fmt.Errorf("invalid metadata")
+	err = c.writeCommand(&message.MsgCommandAMF0{
+		ChunkStreamID:   5,
+		MessageStreamID: c.MessageStreamID(),
+		Name:            "onStatus",
+		CommandID:       0,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "status"},
+				{K: "code", V: "NetStream.Play.Stop"},
+				{K: "description", V: "play stop"},
+			},
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	hasVideo, err := func() (bool, error) {
-		v, ok := md.GetV("videocodecid")
-		if !ok {
+	return c.mrw.Write(&message.MsgUserControlStreamEOF{
+		StreamID: 1,
+	})
+}
+
+// rejectPublish notifies the publisher that the stream has been rejected.
+func (c *Conn) rejectPublish(description string) error {
+	return c.writeCommand(&message.MsgCommandAMF0{
+		ChunkStreamID:   5,
+		MessageStreamID: c.MessageStreamID(),
+		Name:            "onStatus",
+		CommandID:       0,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "error"},
+				{K: "code", V: "NetStream.Publish.BadName"},
+				{K: "description", V: description},
+			},
+		},
+	})
+}
+
+// mediaPayloadIsEmpty checks whether a media message has no payload.
+// The AVC end of sequence is excluded since it's a marker that never has a payload.
+func mediaPayloadIsEmpty(msg message.Message) bool {
+	switch tmsg := msg.(type) {
+	case *message.MsgVideo:
+		return len(tmsg.Payload) == 0 && tmsg.H264Type != flvio.AVC_EOS
+
+	case *message.MsgAudio:
+		return len(tmsg.Payload) == 0
+	}
+
+	return false
+}
+
+// ReadMessage reads a message.
+// Video and audio messages without payload are skipped, since they are used
+// as markers by some tools and can't be decoded.
+func (c *Conn) ReadMessage() (message.Message, error) {
+	for {
+		msg, err := c.mrw.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.bitrateLimiter != nil {
+			err := c.bitrateLimiter.check(c.BytesReceived())
+			if err != nil {
+				// the connection is closed anyway, therefore errors are ignored
+				_ = c.rejectPublish(err.Error())
+				return nil, err
+			}
+		}
+
+		if mediaPayloadIsEmpty(msg) {
+			c.log(logger.Debug, "skipping media message without payload")
+			continue
+		}
+
+		if cmd, ok := c.commandFromMessage(msg); ok {
+			err := c.handlePlayCommand(cmd)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if tmsg, ok := msg.(*message.MsgVideo); ok && c.bFrameDropper != nil {
+			keep, err := c.bFrameDropper.process(tmsg)
+			if err != nil {
+				return nil, fmt.Errorf("unable to drop B-frames: %v", err)
+			}
+
+			if !keep {
+				continue
+			}
+		}
+
+		if c.tsCorrector != nil {
+			c.tsCorrector.process(msg)
+		}
+
+		if c.tracksRead && c.onMetadata != nil {
+			if payload, ok := metadataPayload(msg); ok {
+				if len(payload) == 1 {
+					if md, ok := payload[0].(flvio.AMFMap); ok {
+						c.onMetadata(md)
+						return msg, nil
+					}
+				}
+
+				c.log(logger.Warn, "received invalid metadata update")
+			}
+		}
+
+		return msg, nil
+	}
+}
+
+// WriteMessage writes a message.
+func (c *Conn) WriteMessage(msg message.Message) error {
+	if c.pacer != nil {
+		switch tmsg := msg.(type) {
+		case *message.MsgVideo:
+			c.pacer.wait(tmsg.DTS)
+
+		case *message.MsgAudio:
+			c.pacer.wait(tmsg.DTS)
+		}
+	}
+
+	return c.mrw.Write(msg)
+}
+
+// EncodeMessage encodes a message once, in order to write it to multiple
+// connections with WriteEncodedMessage(), without encoding it for each of them.
+// This is useful to fan out a stream to multiple readers, as long as
+// they receive identical messages (same timestamps and payloads).
+// The message stream ID and the chunk stream ID are fixed at encode time,
+// therefore they must match the ones of every connection the message is written to.
+func (c *Conn) EncodeMessage(msg message.Message) (*message.EncodedMessage, error) {
+	return c.mrw.EncodeToBytes(msg)
+}
+
+// WriteEncodedMessage writes a message encoded by EncodeMessage(),
+// by this or by another connection.
+func (c *Conn) WriteEncodedMessage(em *message.EncodedMessage) error {
+	if c.pacer != nil {
+		switch tmsg := em.Message().(type) {
+		case *message.MsgVideo:
+			c.pacer.wait(tmsg.DTS)
+
+		case *message.MsgAudio:
+			c.pacer.wait(tmsg.DTS)
+		}
+	}
+
+	return c.mrw.WriteEncoded(em)
+}
+
+func trackFromH264DecoderConfig(data []byte) (*format.H264, error) {
+	var conf h264conf.Conf
+	err := conf.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse H264 config: %v", err)
+	}
+
+	return &format.H264{
+		PayloadTyp:        96,
+		SPS:               conf.SPS,
+		PPS:               conf.PPS,
+		PacketizationMode: 1,
+	}, nil
+}
+
+// UpdateH264TrackFromDecoderConfig updates the SPS and PPS of a H264 track with the ones
+// of a decoder configuration (AVC_SEQHDR) received after the track has been read,
+// i.e. in case of a resolution change. The new SPS is validated before being applied.
+// It returns true if the SPS or the PPS changed.
+func UpdateH264TrackFromDecoderConfig(track *format.H264, data []byte) (bool, error) {
+	var conf h264conf.Conf
+	err := conf.Unmarshal(data)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse H264 config: %v", err)
+	}
+
+	if bytes.Equal(conf.SPS, track.SafeSPS()) && bytes.Equal(conf.PPS, track.SafePPS()) {
+		return false, nil
+	}
+
+	var sps h264.SPS
+	err = sps.Unmarshal(conf.SPS)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse H264 SPS: %v", err)
+	}
+
+	track.SafeSetSPS(conf.SPS)
+	track.SafeSetPPS(conf.PPS)
+
+	return true, nil
+}
+
+// UpdateH265TrackFromDecoderConfig updates the VPS, SPS and PPS of a H265 track with the ones
+// of a decoder configuration (hvcC) received after the track has been read,
+// i.e. in case of a resolution change. The new SPS is validated before being applied.
+// It returns true if the VPS, the SPS or the PPS changed.
+func UpdateH265TrackFromDecoderConfig(track *format.H265, data []byte) (bool, error) {
+	var conf h265conf.Conf
+	err := conf.Unmarshal(data)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse H265 config: %v", err)
+	}
+
+	if bytes.Equal(conf.VPS, track.SafeVPS()) &&
+		bytes.Equal(conf.SPS, track.SafeSPS()) &&
+		bytes.Equal(conf.PPS, track.SafePPS()) {
+		return false, nil
+	}
+
+	var sps h265.SPS
+	err = sps.Unmarshal(conf.SPS)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse H265 SPS: %v", err)
+	}
+
+	track.SafeSetVPS(conf.VPS)
+	track.SafeSetSPS(conf.SPS)
+	track.SafeSetPPS(conf.PPS)
+
+	return true, nil
+}
+
+func trackFromH265DecoderConfig(data []byte) (*format.H265, error) {
+	var conf h265conf.Conf
+	err := conf.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse H265 config: %v", err)
+	}
+
+	return &format.H265{
+		PayloadTyp: 96,
+		VPS:        conf.VPS,
+		SPS:        conf.SPS,
+		PPS:        conf.PPS,
+	}, nil
+}
+
+var aacSampleRates = []int{
+	96000,
+	88200,
+	64000,
+	48000,
+	44100,
+	32000,
+	24000,
+	22050,
+	16000,
+	12000,
+	11025,
+	8000,
+	7350,
+}
+
+// readAACSyncExtension reads the backward compatible signaling of SBR and PS,
+// that is placed after the GASpecificConfig of an AAC-LC AudioSpecificConfig.
+func readAACSyncExtension(data []byte, conf *mpeg4audio.Config) error {
+	// hierarchical signaling, already decoded
+	if conf.ExtensionType != 0 {
+		return nil
+	}
+
+	pos := 5
+
+	sampleRateIndex, err := bits.ReadBits(data, &pos, 4)
+	if err != nil {
+		return err
+	}
+	if sampleRateIndex == 0x0F {
+		pos += 24
+	}
+
+	pos += 4 // channel configuration
+	pos += 2 // frame length flag, depends on core coder
+	if conf.DependsOnCoreCoder {
+		pos += 14
+	}
+	pos++ // extension flag
+
+	if (len(data)*8 - pos) < 16 {
+		return nil
+	}
+
+	syncExtensionType, _ := bits.ReadBits(data, &pos, 11)
+	if syncExtensionType != 0x2B7 {
+		return nil
+	}
+
+	extensionType, err := bits.ReadBits(data, &pos, 5)
+	if err != nil {
+		return err
+	}
+	if mpeg4audio.ObjectType(extensionType) != mpeg4audio.ObjectTypeSBR {
+		return nil
+	}
+
+	sbrPresent, err := bits.ReadFlag(data, &pos)
+	if err != nil {
+		return err
+	}
+	if !sbrPresent {
+		return nil
+	}
+
+	extensionSampleRateIndex, err := bits.ReadBits(data, &pos, 4)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case int(extensionSampleRateIndex) < len(aacSampleRates):
+		conf.ExtensionSampleRate = aacSampleRates[extensionSampleRateIndex]
+
+	case extensionSampleRateIndex == 0x0F:
+		tmp, err := bits.ReadBits(data, &pos, 24)
+		if err != nil {
+			return err
+		}
+		conf.ExtensionSampleRate = int(tmp)
+
+	default:
+		return fmt.Errorf("invalid extension sample rate index (%d)", extensionSampleRateIndex)
+	}
+
+	conf.ExtensionType = mpeg4audio.ObjectTypeSBR
+
+	if (len(data)*8 - pos) >= 12 {
+		syncExtensionType, _ := bits.ReadBits(data, &pos, 11)
+		if syncExtensionType == 0x548 {
+			psPresent, _ := bits.ReadFlag(data, &pos)
+			if psPresent {
+				conf.ExtensionType = mpeg4audio.ObjectTypePS
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyAACImplicitSBR detects the implicit signaling of SBR, in which the AudioSpecificConfig
+// contains the sample rate of the AAC-LC core only, by comparing it with the
+// sample rate advertised in the stream metadata.
+func applyAACImplicitSBR(conf *mpeg4audio.Config, metadataSampleRate int) {
+	if conf.ExtensionType == 0 &&
+		conf.Type == mpeg4audio.ObjectTypeAACLC &&
+		conf.SampleRate <= 24000 &&
+		metadataSampleRate == conf.SampleRate*2 {
+		conf.ExtensionType = mpeg4audio.ObjectTypeSBR
+		conf.ExtensionSampleRate = metadataSampleRate
+	}
+}
+
+// AudioFlags returns the rate, depth and channels flags
+// of the FLV audio header that correspond to an AAC configuration.
+func AudioFlags(conf *mpeg4audio.Config) (uint8, uint8, uint8) {
+	sampleRate := conf.SampleRate
+	if conf.ExtensionSampleRate != 0 {
+		sampleRate = conf.ExtensionSampleRate
+	}
+
+	var rate uint8
+	switch {
+	case sampleRate >= 44100:
+		rate = flvio.SOUND_44Khz
+
+	case sampleRate >= 22050:
+		rate = flvio.SOUND_22Khz
+
+	case sampleRate >= 11025:
+		rate = flvio.SOUND_11Khz
+
+	default:
+		rate = flvio.SOUND_5_5Khz
+	}
+
+	// AAC is always decoded into 16-bit samples
+	depth := uint8(flvio.SOUND_16BIT)
+
+	var channels uint8
+	if conf.ChannelCount == 1 && conf.ExtensionType != mpeg4audio.ObjectTypePS {
+		channels = flvio.SOUND_MONO
+	} else {
+		channels = flvio.SOUND_STEREO
+	}
+
+	return rate, depth, channels
+}
+
+func trackFromAACDecoderConfig(data []byte) (*format.MPEG4Audio, error) {
+	var mpegConf mpeg4audio.Config
+	err := mpegConf.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readAACSyncExtension(data, &mpegConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &format.MPEG4Audio{
+		PayloadTyp:       96,
+		Config:           &mpegConf,
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}, nil
+}
+
+// maximum time span of raw AAC frames that are received
+// while waiting for the AAC decoder configuration.
+const aacDecoderConfigMaxWait = 1 * time.Second
+
+// trackFromAACMetadata generates an AAC track from the metadata,
+// for publishers that send raw AAC frames without the decoder configuration.
+func trackFromAACMetadata(md flvio.AMFMap) (*format.MPEG4Audio, error) {
+	sampleRate, ok := md.GetFloat64("audiosamplerate")
+	if !ok || sampleRate <= 0 {
+		return nil, fmt.Errorf("audio sample rate is missing from metadata")
+	}
+
+	var channelCount int
+	if v, ok := md.GetFloat64("audiochannels"); ok && v > 0 {
+		channelCount = int(v)
+	} else if v, ok := md.GetBool("stereo"); ok {
+		if v {
+			channelCount = 2
+		} else {
+			channelCount = 1
+		}
+	} else {
+		return nil, fmt.Errorf("audio channel count is missing from metadata")
+	}
+
+	objectType := mpeg4audio.ObjectTypeAACLC
+	if v, ok := md.GetFloat64("aacaot"); ok {
+		objectType = mpeg4audio.ObjectType(v)
+	}
+
+	var conf mpeg4audio.Config
+
+	// in case of SBR and PS, the sample rate in metadata is the output one.
+	switch objectType {
+	case mpeg4audio.ObjectTypeAACLC:
+		conf = mpeg4audio.Config{
+			Type:         mpeg4audio.ObjectTypeAACLC,
+			SampleRate:   int(sampleRate),
+			ChannelCount: channelCount,
+		}
+
+	case mpeg4audio.ObjectTypeSBR:
+		conf = mpeg4audio.Config{
+			Type:                mpeg4audio.ObjectTypeAACLC,
+			SampleRate:          int(sampleRate) / 2,
+			ChannelCount:        channelCount,
+			ExtensionType:       mpeg4audio.ObjectTypeSBR,
+			ExtensionSampleRate: int(sampleRate),
+		}
+
+	case mpeg4audio.ObjectTypePS:
+		conf = mpeg4audio.Config{
+			Type:                mpeg4audio.ObjectTypeAACLC,
+			SampleRate:          int(sampleRate) / 2,
+			ChannelCount:        1,
+			ExtensionType:       mpeg4audio.ObjectTypePS,
+			ExtensionSampleRate: int(sampleRate),
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported AAC object type: %d", objectType)
+	}
+
+	return &format.MPEG4Audio{
+		PayloadTyp:       96,
+		Config:           &conf,
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}, nil
+}
+
+// aacObjectType returns the object type that is needed to decode a configuration,
+// i.e. the type of its extension, if present.
+func aacObjectType(conf *mpeg4audio.Config) mpeg4audio.ObjectType {
+	if conf.ExtensionType == mpeg4audio.ObjectTypeSBR || conf.ExtensionType == mpeg4audio.ObjectTypePS {
+		return conf.ExtensionType
+	}
+	return conf.Type
+}
+
+func aacObjectTypeAllowed(types []mpeg4audio.ObjectType, typ mpeg4audio.ObjectType) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAACObjectType checks whether the object type of an AAC track is allowed.
+// PS and SBR are backward compatible: if they are not allowed,
+// they are removed from the configuration and the track is decoded without them.
+func (c *Conn) checkAACObjectType(track format.Format) error {
+	if c.aacObjectTypes == nil {
+		return nil
+	}
+
+	mtrack, ok := track.(*format.MPEG4Audio)
+	if !ok {
+		return nil
+	}
+
+	conf := mtrack.Config
+	initial := aacObjectType(conf)
+
+	for !aacObjectTypeAllowed(c.aacObjectTypes, aacObjectType(conf)) {
+		switch aacObjectType(conf) {
+		case mpeg4audio.ObjectTypePS:
+			conf.ExtensionType = mpeg4audio.ObjectTypeSBR
+
+		case mpeg4audio.ObjectTypeSBR:
+			conf.ExtensionType = 0
+			conf.ExtensionSampleRate = 0
+
+		default:
+			return fmt.Errorf("AAC object type %d is not allowed", initial)
+		}
+	}
+
+	if typ := aacObjectType(conf); typ != initial {
+		c.log(logger.Warn, "AAC object type %d is not allowed, downgrading to %d", initial, typ)
+	}
+
+	return nil
+}
+
+func trackFromAC3Frame(data []byte) (*ac3.Format, error) {
+	var conf ac3.Config
+	err := conf.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse AC-3 frame: %v", err)
+	}
+
+	if conf.Dependent {
+		return nil, fmt.Errorf("dependent substreams can't be the first frame of a stream")
+	}
+
+	return ac3.NewFormat(96, &conf), nil
+}
+
+// audioTrackFromMessage returns the audio track described by a message,
+// or nil if the message doesn't contain enough informations.
+func audioTrackFromMessage(msg *message.MsgAudio) (format.Format, error) {
+	switch {
+	case msg.FourCC == 0 && msg.AACType == flvio.AAC_SEQHDR:
+		return trackFromAACDecoderConfig(msg.Payload)
+
+	case msg.FourCC != 0 && msg.AACType == flvio.AAC_RAW:
+		return trackFromAC3Frame(msg.Payload)
+	}
+
+	return nil, nil
+}
+
+// readAdditionalAudioTrack reads the track of an additional audio track
+// of an enhanced RTMP multitrack stream, if it's not known yet.
+func (c *Conn) readAdditionalAudioTrack(msg *message.MsgAudio) error {
+	if _, ok := c.additionalAudioTracks[msg.TrackID]; ok {
+		return nil
+	}
+
+	track, err := audioTrackFromMessage(msg)
+	if err != nil {
+		return fmt.Errorf("audio track %d: %v", msg.TrackID, err)
+	}
+
+	if track != nil {
+		if c.additionalAudioTracks == nil {
+			c.additionalAudioTracks = make(map[uint8]format.Format)
+		}
+		c.additionalAudioTracks[msg.TrackID] = track
+	}
+
+	return nil
+}
+
+// additionalAudioTrackIDs returns the IDs of the additional audio tracks
+// that are advertised in the metadata of an enhanced RTMP multitrack stream.
+func additionalAudioTrackIDs(md flvio.AMFMap) []uint8 {
+	v, ok := md.GetV("audioTrackIdInfoMap")
+	if !ok {
+		return nil
+	}
+
+	infoMap, ok := v.(flvio.AMFMap)
+	if !ok {
+		return nil
+	}
+
+	var ret []uint8
+
+	for _, entry := range infoMap {
+		id, err := strconv.ParseUint(entry.K, 10, 8)
+		if err != nil || id == 0 {
+			continue
+		}
+
+		ret = append(ret, uint8(id))
+	}
+
+	return ret
+}
+
+// trackFromH265KeyFrame returns a H265 track with the parameters contained in a key frame,
+// or nil if the key frame doesn't contain all of them.
+func trackFromH265KeyFrame(payload []byte) (*format.H265, error) {
+	nalus, err := h264.AVCCUnmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var vps []byte
+	var sps []byte
+	var pps []byte
+
+	for _, nalu := range nalus {
+		typ := h265.NALUType((nalu[0] >> 1) & 0b111111)
+
+		switch typ {
+		case h265.NALUType_VPS_NUT:
+			vps = append([]byte(nil), nalu...)
+
+		case h265.NALUType_SPS_NUT:
+			sps = append([]byte(nil), nalu...)
+
+		case h265.NALUType_PPS_NUT:
+			pps = append([]byte(nil), nalu...)
+		}
+	}
+
+	if vps == nil || sps == nil || pps == nil {
+		return nil, nil
+	}
+
+	return &format.H265{
+		PayloadTyp: 96,
+		VPS:        vps,
+		SPS:        sps,
+		PPS:        pps,
+	}, nil
+}
+
+// trackFromH264KeyFrame returns a H264 track with the parameters contained in a key frame,
+// or nil if the key frame doesn't contain all of them.
+// This allows to read streams whose parameters are sent inline, without a decoder configuration.
+func trackFromH264KeyFrame(payload []byte) (*format.H264, error) {
+	nalus, err := h264.AVCCUnmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var sps []byte
+	var pps []byte
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		typ := h264.NALUType(nalu[0] & 0x1F)
+
+		switch typ {
+		case h264.NALUTypeSPS:
+			sps = append([]byte(nil), nalu...)
+
+		case h264.NALUTypePPS:
+			pps = append([]byte(nil), nalu...)
+		}
+	}
+
+	if sps == nil || pps == nil {
+		return nil, nil
+	}
+
+	return &format.H264{
+		PayloadTyp:        96,
+		SPS:               sps,
+		PPS:               pps,
+		PacketizationMode: 1,
+	}, nil
+}
+
+func keyFrameHasH264Parameters(payload []byte) bool {
+	track, err := trackFromH264KeyFrame(payload)
+	return err == nil && track != nil
+}
+
+var errEmptyMetadata = errors.New("metadata is empty")
+
+// avccMaybeH265 checks whether the first NALU of an AVCC payload has a H265 header
+// with a type greater or equal than VPS, without unmarshaling the whole payload.
+// This allows to skip the detection of H265 parameter sets in H264 streams.
+func avccMaybeH265(buf []byte) bool {
+	if len(buf) < 6 {
+		return false
+	}
+
+	typ := h265.NALUType((buf[4] >> 1) & 0b111111)
+	layerID := ((buf[4] & 0b1) << 5) | (buf[5] >> 3)
+	temporalIDPlus1 := buf[5] & 0b111
+
+	return typ >= h265.NALUType_VPS_NUT && layerID == 0 && temporalIDPlus1 != 0
+}
+
+// maximum number of messages that are buffered while waiting for the metadata.
+const readTracksMaxBufferedMessages = 10
+
+// readTracksReader returns buffered messages before reading new ones.
+type readTracksReader struct {
+	c    *Conn
+	msgs []message.Message
+}
+
+func (r *readTracksReader) read() (message.Message, error) {
+	if len(r.msgs) != 0 {
+		msg := r.msgs[0]
+		r.msgs = r.msgs[1:]
+		return msg, nil
+	}
+
+	return r.c.ReadMessage()
+}
+
+func metadataPayload(msg message.Message) ([]interface{}, bool) {
+	data, ok := msg.(*message.MsgDataAMF0)
+	if !ok || len(data.Payload) < 1 {
+		return nil, false
+	}
+
+	payload := data.Payload
+
+	if s, ok := payload[0].(string); ok && s == "@setDataFrame" {
+		payload = payload[1:]
+	}
+
+	if len(payload) < 1 {
+		return nil, false
+	}
+
+	if s, ok := payload[0].(string); !ok || s != "onMetaData" {
+		return nil, false
+	}
+
+	return payload[1:], true
+}
+
+func (c *Conn) readTracksFromMetadata(
+	payload []interface{},
+	r *readTracksReader,
+) (format.Format, format.Format, error) {
+	if len(payload) != 1 {
+		return nil, nil, fmt.Errorf("invalid metadata")
+	}
+
+	md, ok := payload[0].(flvio.AMFMap)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid metadata")
+	}
+
+	// duration and filesize are provided by files that are being streamed
+	if v, ok := md.GetFloat64("duration"); ok && v > 0 {
+		c.duration = time.Duration(v * float64(time.Second))
+	}
+
+	if v, ok := md.GetFloat64("filesize"); ok && v > 0 {
+		c.fileSize = uint64(v)
+	}
+
+	// set when metadata suggests that the video track is H265
+	videoIsH265 := false
+
+	hasVideo, err := func() (bool, error) {
+		v, ok := md.GetV("videocodecid")
+		if !ok {
 			return false, nil
 		}
 
@@ -639,10 +1981,19 @@ func (c *Conn) readTracksFromMetadata(payload []interface{}) (format.Format, *fo
 
 			case codecH264:
 				return true, nil
+
+			case codecH265, message.FourCCHEVC:
+				videoIsH265 = true
+				return true, nil
 			}
 
 		case string:
-			if vt == "avc1" {
+			switch vt {
+			case "avc1":
+				return true, nil
+
+			case "hvc1", "hev1":
+				videoIsH265 = true
 				return true, nil
 			}
 		}
@@ -665,12 +2016,13 @@ func (c *Conn) readTracksFromMetadata(payload []interface{}) (format.Format, *fo
 			case 0:
 				return false, nil
 
-			case codecAAC:
+			case codecAAC, message.FourCCAC3, message.FourCCEAC3:
 				return true, nil
 			}
 
 		case string:
-			if vt == "mp4a" {
+			switch vt {
+			case "mp4a", "ac-3", "ec-3":
 				return true, nil
 			}
 		}
@@ -685,11 +2037,16 @@ func (c *Conn) readTracksFromMetadata(payload []interface{}) (format.Format, *fo
 		return nil, nil, errEmptyMetadata
 	}
 
+	additionalAudioIDs := additionalAudioTrackIDs(md)
+
 	var videoTrack format.Format
-	var audioTrack *format.MPEG4Audio
+	var audioTrack format.Format
+
+	// DTS of the first raw AAC frame received without the decoder configuration
+	var aacRawStart *time.Duration
 
 	for {
-		msg, err := c.ReadMessage()
+		msg, err := r.read()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -701,43 +2058,47 @@ func (c *Conn) readTracksFromMetadata(payload []interface{}) (format.Format, *fo
 			}
 
 			if videoTrack == nil {
-				if tmsg.H264Type == flvio.AVC_SEQHDR {
+				isH265 := videoIsH265 || tmsg.FourCC == message.FourCCHEVC
+
+				if tmsg.H264Type == flvio.AVC_SEQHDR && !isH265 {
 					videoTrack, err = trackFromH264DecoderConfig(tmsg.Payload)
 					if err != nil {
 						return nil, nil, err
 					}
-				} else if tmsg.H264Type == 1 && tmsg.IsKeyFrame {
-					nalus, err := h264.AVCCUnmarshal(tmsg.Payload)
+				} else if tmsg.H264Type == flvio.AVC_SEQHDR && isH265 {
+					// some encoders send a HEVCDecoderConfigurationRecord,
+					// otherwise parameters are extracted from key frames.
+					track, err := trackFromH265DecoderConfig(tmsg.Payload)
 					if err != nil {
-						return nil, nil, err
+						c.log(logger.Debug, "unable to parse the H265 decoder configuration, "+
+							"waiting for a key frame: %v", err)
+					} else {
+						videoTrack = track
+					}
+				} else if tmsg.H264Type == 1 && tmsg.IsKeyFrame &&
+					(videoIsH265 || avccMaybeH265(tmsg.Payload)) {
+					// a malformed packet doesn't prevent detection,
+					// since parameters can be found in the next key frames.
+					track, err := trackFromH265KeyFrame(tmsg.Payload)
+					if err != nil {
+						c.log(logger.Warn, "skipping malformed video packet: %v", err)
+						continue
 					}
 
-					var h265VPS []byte
-					var h265SPS []byte
-					var h265PPS []byte
-
-					for _, nalu := range nalus {
-						typ := h265.NALUType((nalu[0] >> 1) & 0b111111)
-
-						switch typ {
-						case h265.NALUType_VPS_NUT:
-							h265VPS = append([]byte(nil), nalu...)
-
-						case h265.NALUType_SPS_NUT:
-							h265SPS = append([]byte(nil), nalu...)
-
-						case h265.NALUType_PPS_NUT:
-							h265PPS = append([]byte(nil), nalu...)
-						}
+					if track != nil {
+						videoTrack = track
+					}
+				} else if tmsg.H264Type == 1 && tmsg.IsKeyFrame && tmsg.FourCC == 0 {
+					// some encoders never send the decoder configuration
+					// and put parameters inside key frames.
+					track, err := trackFromH264KeyFrame(tmsg.Payload)
+					if err != nil {
+						c.log(logger.Warn, "skipping malformed video packet: %v", err)
+						continue
 					}
 
-					if h265VPS != nil && h265SPS != nil && h265PPS != nil {
-						videoTrack = &format.H265{
-							PayloadTyp: 96,
-							VPS:        h265VPS,
-							SPS:        h265SPS,
-							PPS:        h265PPS,
-						}
+					if track != nil {
+						videoTrack = track
 					}
 				}
 			}
@@ -747,31 +2108,138 @@ func (c *Conn) readTracksFromMetadata(payload []interface{}) (format.Format, *fo
 				return nil, nil, fmt.Errorf("unexpected audio packet")
 			}
 
-			if audioTrack == nil {
-				if tmsg.AACType == flvio.AVC_SEQHDR {
-					audioTrack, err = trackFromAACDecoderConfig(tmsg.Payload)
+			if tmsg.TrackID != 0 {
+				err := c.readAdditionalAudioTrack(tmsg)
+				if err != nil {
+					return nil, nil, err
+				}
+			} else if audioTrack == nil {
+				switch {
+				case tmsg.FourCC == 0 && tmsg.AACType == flvio.AAC_SEQHDR:
+					track, err := trackFromAACDecoderConfig(tmsg.Payload)
+					if err != nil {
+						return nil, nil, err
+					}
+
+					if v, ok := md.GetFloat64("audiosamplerate"); ok {
+						applyAACImplicitSBR(track.Config, int(v))
+					}
+
+					audioTrack = track
+
+				case tmsg.FourCC == 0 && tmsg.AACType == flvio.AAC_RAW:
+					// some publishers never send the decoder configuration:
+					// generate it from the metadata.
+					if aacRawStart == nil {
+						v := tmsg.DTS
+						aacRawStart = &v
+					}
+
+					if (tmsg.DTS - *aacRawStart) >= aacDecoderConfigMaxWait {
+						c.log(logger.Warn, "AAC decoder configuration not received, "+
+							"generating it from metadata")
+
+						audioTrack, err = trackFromAACMetadata(md)
+						if err != nil {
+							return nil, nil, err
+						}
+					}
+
+				case tmsg.FourCC != 0 && tmsg.AACType == flvio.AAC_RAW:
+					audioTrack, err = trackFromAC3Frame(tmsg.Payload)
 					if err != nil {
 						return nil, nil, err
 					}
 				}
 			}
+
+		default:
+			c.log(logger.Debug, "skipping unexpected message of type %T", msg)
 		}
 
 		if (!hasVideo || videoTrack != nil) &&
-			(!hasAudio || audioTrack != nil) {
+			(!hasAudio || audioTrack != nil) &&
+			c.additionalAudioTracksFound(additionalAudioIDs) {
 			return videoTrack, audioTrack, nil
 		}
 	}
 }
 
-func (c *Conn) readTracksFromMessages(msg message.Message) (*format.H264, *format.MPEG4Audio, error) {
+func (c *Conn) additionalAudioTracksFound(ids []uint8) bool {
+	for _, id := range ids {
+		if _, ok := c.additionalAudioTracks[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// videoTrackFromMessage returns the video track described by a message of a stream without metadata,
+// or nil if the message doesn't contain enough informations.
+func (c *Conn) videoTrackFromMessage(msg *message.MsgVideo) (format.Format, error) {
+	switch {
+	case msg.H264Type == flvio.AVC_SEQHDR && msg.FourCC == message.FourCCHEVC:
+		return trackFromH265DecoderConfig(msg.Payload)
+
+	case msg.H264Type == flvio.AVC_SEQHDR:
+		track, err := trackFromH264DecoderConfig(msg.Payload)
+		if err == nil {
+			return track, nil
+		}
+
+		// some encoders send a HEVCDecoderConfigurationRecord without signaling H265
+		h265Track, h265Err := trackFromH265DecoderConfig(msg.Payload)
+		if h265Err == nil {
+			return h265Track, nil
+		}
+
+		return nil, err
+
+	// some encoders don't signal H265: detect it through the parameters contained in key frames.
+	case msg.H264Type == 1 && msg.IsKeyFrame && avccMaybeH265(msg.Payload):
+		track, err := trackFromH265KeyFrame(msg.Payload)
+		if err != nil {
+			c.log(logger.Warn, "skipping malformed video packet: %v", err)
+			return nil, nil
+		}
+
+		if track == nil {
+			return nil, nil
+		}
+
+		return track, nil
+
+	// some encoders don't send the decoder configuration: use the parameters contained in key frames.
+	case msg.H264Type == 1 && msg.IsKeyFrame && msg.FourCC == 0:
+		track, err := trackFromH264KeyFrame(msg.Payload)
+		if err != nil {
+			c.log(logger.Warn, "skipping malformed video packet: %v", err)
+			return nil, nil
+		}
+
+		if track == nil {
+			return nil, nil
+		}
+
+		return track, nil
+	}
+
+	return nil, nil
+}
+
+func (c *Conn) readTracksFromMessages(r *readTracksReader) (format.Format, format.Format, error) {
 	var startTime *time.Duration
-	var videoTrack *format.H264
-	var audioTrack *format.MPEG4Audio
+	var videoTrack format.Format
+	var audioTrack format.Format
 
 	// analyze 1 second of packets
 outer:
 	for {
+		msg, err := r.read()
+		if err != nil {
+			return nil, nil, err
+		}
+
 		switch tmsg := msg.(type) {
 		case *message.MsgVideo:
 			if startTime == nil {
@@ -779,16 +2247,17 @@ outer:
 				startTime = &v
 			}
 
-			if tmsg.H264Type == flvio.AVC_SEQHDR {
-				if videoTrack == nil {
-					var err error
-					videoTrack, err = trackFromH264DecoderConfig(tmsg.Payload)
-					if err != nil {
-						return nil, nil, err
-					}
+			if videoTrack == nil {
+				track, err := c.videoTrackFromMessage(tmsg)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				if track != nil {
+					videoTrack = track
 
 					// stop the analysis if both tracks are found
-					if videoTrack != nil && audioTrack != nil {
+					if audioTrack != nil {
 						return videoTrack, audioTrack, nil
 					}
 				}
@@ -804,30 +2273,30 @@ outer:
 				startTime = &v
 			}
 
-			if tmsg.AACType == flvio.AVC_SEQHDR {
-				if audioTrack == nil {
-					var err error
-					audioTrack, err = trackFromAACDecoderConfig(tmsg.Payload)
-					if err != nil {
-						return nil, nil, err
-					}
+			if tmsg.TrackID != 0 {
+				err := c.readAdditionalAudioTrack(tmsg)
+				if err != nil {
+					return nil, nil, err
+				}
+			} else if audioTrack == nil {
+				var err error
+				audioTrack, err = audioTrackFromMessage(tmsg)
+				if err != nil {
+					return nil, nil, err
+				}
 
-					// stop the analysis if both tracks are found
-					if videoTrack != nil && audioTrack != nil {
-						return videoTrack, audioTrack, nil
-					}
+				// stop the analysis if both tracks are found
+				if videoTrack != nil && audioTrack != nil {
+					return videoTrack, audioTrack, nil
 				}
 			}
 
 			if (tmsg.DTS - *startTime) >= 1*time.Second {
 				break outer
 			}
-		}
 
-		var err error
-		msg, err = c.ReadMessage()
-		if err != nil {
-			return nil, nil, err
+		default:
+			c.log(logger.Debug, "skipping unexpected message of type %T", msg)
 		}
 	}
 
@@ -840,124 +2309,270 @@ outer:
 
 // ReadTracks reads track informations.
 // It returns the video track and the audio track.
-func (c *Conn) ReadTracks() (format.Format, *format.MPEG4Audio, error) {
-	msg, err := func() (message.Message, error) {
-		for {
-			msg, err := c.ReadMessage()
-			if err != nil {
-				return nil, err
-			}
+// Metadata and decoder configurations can be received in any order,
+// as long as the metadata is within the first messages.
+// In case of enhanced RTMP multitrack audio, the audio track is the one with ID 0.
+func (c *Conn) ReadTracks() (format.Format, format.Format, error) {
+	videoTrack, audioTrack, err := c.readTracks()
+	if err != nil {
+		return nil, nil, err
+	}
 
-			// skip play start and data start
-			if cmd, ok := msg.(*message.MsgCommandAMF0); ok && cmd.Name == "onStatus" {
+	if audioTrack != nil {
+		err := c.checkAACObjectType(audioTrack)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for id, track := range c.additionalAudioTracks {
+		err := c.checkAACObjectType(track)
+		if err != nil {
+			return nil, nil, fmt.Errorf("audio track %d: %v", id, err)
+		}
+	}
+
+	c.tracksRead = true
+
+	return videoTrack, audioTrack, nil
+}
+
+// ReadTracksMultitrack is like ReadTracks(), but returns all audio tracks,
+// keyed by track ID, in order to support enhanced RTMP multitrack audio.
+// Additional audio tracks are the ones listed in the metadata or, when the metadata
+// doesn't list them, the ones found among the messages analyzed to detect the other tracks.
+// Audio messages can be associated with tracks through MsgAudio.TrackID.
+func (c *Conn) ReadTracksMultitrack() (format.Format, map[uint8]format.Format, error) {
+	videoTrack, audioTrack, err := c.ReadTracks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	audioTracks := make(map[uint8]format.Format)
+
+	if audioTrack != nil {
+		audioTracks[0] = audioTrack
+	}
+
+	for id, track := range c.additionalAudioTracks {
+		audioTracks[id] = track
+	}
+
+	return videoTrack, audioTracks, nil
+}
+
+func (c *Conn) readTracks() (format.Format, format.Format, error) {
+	r := &readTracksReader{c: c}
+	hasVideoConfig := false
+	hasAudioConfig := false
+
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// skip play start and data start
+		if cmd, ok := c.commandFromMessage(msg); ok && cmd.Name == "onStatus" {
+			continue
+		}
+
+		// skip RtmpSampleAccess
+		if data, ok := msg.(*message.MsgDataAMF0); ok && len(data.Payload) >= 1 {
+			if s, ok := data.Payload[0].(string); ok && s == "|RtmpSampleAccess" {
 				continue
 			}
+		}
 
-			// skip RtmpSampleAccess
-			if data, ok := msg.(*message.MsgDataAMF0); ok && len(data.Payload) >= 1 {
-				if s, ok := data.Payload[0].(string); ok && s == "|RtmpSampleAccess" {
-					continue
+		if payload, ok := metadataPayload(msg); ok {
+			videoTrack, audioTrack, err := c.readTracksFromMetadata(payload, r)
+			if err != nil {
+				if err == errEmptyMetadata {
+					return c.readTracksFromMessages(r)
 				}
+
+				return nil, nil, err
 			}
 
-			return msg, nil
+			return videoTrack, audioTrack, nil
+		}
+
+		// buffer messages that precede the metadata
+		r.msgs = append(r.msgs, msg)
+
+		switch tmsg := msg.(type) {
+		case *message.MsgVideo:
+			if tmsg.H264Type == flvio.AVC_SEQHDR ||
+				(tmsg.H264Type == 1 && tmsg.IsKeyFrame && avccMaybeH265(tmsg.Payload)) ||
+				(tmsg.H264Type == 1 && tmsg.IsKeyFrame && tmsg.FourCC == 0 && keyFrameHasH264Parameters(tmsg.Payload)) {
+				hasVideoConfig = true
+			}
+
+		case *message.MsgAudio:
+			if tmsg.TrackID == 0 && (tmsg.AACType == flvio.AAC_SEQHDR || tmsg.FourCC != 0) {
+				hasAudioConfig = true
+			}
+		}
+
+		// metadata is missing
+		if (hasVideoConfig && hasAudioConfig) || len(r.msgs) >= readTracksMaxBufferedMessages {
+			return c.readTracksFromMessages(r)
 		}
-	}()
-	if err != nil {
-		return nil, nil, err
 	}
+}
 
-	if data, ok := msg.(*message.MsgDataAMF0); ok && len(data.Payload) >= 1 {
-		payload := data.Payload
+// videoCodecID returns the codec ID that is advertised in the metadata.
+func videoCodecID(videoTrack format.Format) float64 {
+	switch track := videoTrack.(type) {
+	case *format.H264:
+		if track != nil {
+			return codecH264
+		}
 
-		if s, ok := payload[0].(string); ok && s == "@setDataFrame" {
-			payload = payload[1:]
+	case *format.H265:
+		if track != nil {
+			return message.FourCCHEVC
 		}
+	}
 
-		if len(payload) >= 1 {
-			if s, ok := payload[0].(string); ok && s == "onMetaData" {
-				videoTrack, audioTrack, err := c.readTracksFromMetadata(payload[1:])
-				if err != nil {
-					if err == errEmptyMetadata {
-						msg, err := c.ReadMessage()
-						if err != nil {
-							return nil, nil, err
-						}
+	return 0
+}
 
-						return c.readTracksFromMessages(msg)
-					}
+// writeVideoDecoderConfig writes the decoder configuration of a video track,
+// only if parameters are available. If they're not available yet, they're sent later.
+func (c *Conn) writeVideoDecoderConfig(videoTrack format.Format) error {
+	switch track := videoTrack.(type) {
+	case *format.H264:
+		if track == nil || track.SafeSPS() == nil || track.SafePPS() == nil {
+			return nil
+		}
 
-					return nil, nil, err
-				}
+		buf, err := H264DecoderConfig(track)
+		if err != nil {
+			return err
+		}
+
+		return c.WriteMessage(&message.MsgVideo{
+			ChunkStreamID:   message.MsgVideoChunkStreamID,
+			MessageStreamID: c.MessageStreamID(),
+			IsKeyFrame:      true,
+			H264Type:        flvio.AVC_SEQHDR,
+			Payload:         buf,
+		})
+
+	case *format.H265:
+		if track == nil || track.SafeVPS() == nil || track.SafeSPS() == nil || track.SafePPS() == nil {
+			return nil
+		}
+
+		buf, err := H265DecoderConfig(track)
+		if err != nil {
+			return err
+		}
 
-				return videoTrack, audioTrack, nil
+		// H265 is not part of the FLV specification, therefore
+		// the enhanced RTMP specification is used.
+		return c.WriteMessage(&message.MsgVideo{
+			ChunkStreamID:   message.MsgVideoChunkStreamID,
+			MessageStreamID: c.MessageStreamID(),
+			IsKeyFrame:      true,
+			FourCC:          message.FourCCHEVC,
+			H264Type:        flvio.AVC_SEQHDR,
+			Payload:         buf,
+		})
+	}
+
+	return nil
+}
+
+// videoMetadata returns the resolution and the frame rate of a video track,
+// extracted from its SPS. The frame rate is zero when the SPS doesn't contain timing info.
+func videoMetadata(videoTrack format.Format) (int, int, float64, bool) {
+	switch track := videoTrack.(type) {
+	case *format.H264:
+		if track != nil {
+			var sps h264.SPS
+			if err := sps.Unmarshal(track.SafeSPS()); err == nil {
+				return sps.Width(), sps.Height(), sps.FPS(), true
+			}
+		}
+
+	case *format.H265:
+		if track != nil {
+			var sps h265.SPS
+			if err := sps.Unmarshal(track.SafeSPS()); err == nil {
+				return sps.Width(), sps.Height(), sps.FPS(), true
 			}
 		}
 	}
 
-	return c.readTracksFromMessages(msg)
+	return 0, 0, 0, false
+}
+
+// tracksMetadata generates the onMetaData of the given tracks.
+// Values that are unknown are omitted.
+func tracksMetadata(videoTrack format.Format, audioTrack *format.MPEG4Audio) flvio.AMFMap {
+	md := flvio.AMFMap{
+		{K: "videocodecid", V: videoCodecID(videoTrack)},
+	}
+
+	if width, height, fps, ok := videoMetadata(videoTrack); ok {
+		md = append(md,
+			flvio.AMFKv{K: "width", V: float64(width)},
+			flvio.AMFKv{K: "height", V: float64(height)})
+
+		if fps > 0 {
+			md = append(md, flvio.AMFKv{K: "framerate", V: fps})
+		}
+	}
+
+	if audioTrack == nil {
+		md = append(md, flvio.AMFKv{K: "audiocodecid", V: float64(0)})
+		return md
+	}
+
+	// in case of SBR, the output sample rate is the one of the extension
+	sampleRate := audioTrack.Config.SampleRate
+	if audioTrack.Config.ExtensionSampleRate != 0 {
+		sampleRate = audioTrack.Config.ExtensionSampleRate
+	}
+
+	md = append(md,
+		flvio.AMFKv{K: "audiocodecid", V: float64(codecAAC)},
+		flvio.AMFKv{K: "audiosamplerate", V: float64(sampleRate)},
+		flvio.AMFKv{K: "audiochannels", V: float64(audioTrack.Config.ChannelCount)},
+		flvio.AMFKv{K: "stereo", V: audioTrack.Config.ChannelCount >= 2})
+
+	return md
 }
 
 // WriteTracks writes track informations.
-func (c *Conn) WriteTracks(videoTrack *format.H264, audioTrack *format.MPEG4Audio) error {
+// The video track can be a *format.H264 or a *format.H265.
+// In case of audio-only streams, the video track can be nil (or a typed nil):
+// videocodecid is set to zero and no video decoder configuration is sent.
+func (c *Conn) WriteTracks(videoTrack format.Format, audioTrack *format.MPEG4Audio) error {
+	switch videoTrack.(type) {
+	case nil, *format.H264, *format.H265:
+	default:
+		return fmt.Errorf("unsupported video track: %T", videoTrack)
+	}
+
 	err := c.WriteMessage(&message.MsgDataAMF0{
 		ChunkStreamID:   4,
-		MessageStreamID: 0x1000000,
+		MessageStreamID: c.MessageStreamID(),
 		Payload: []interface{}{
 			"@setDataFrame",
 			"onMetaData",
-			flvio.AMFMap{
-				{
-					K: "videodatarate",
-					V: float64(0),
-				},
-				{
-					K: "videocodecid",
-					V: func() float64 {
-						if videoTrack != nil {
-							return codecH264
-						}
-						return 0
-					}(),
-				},
-				{
-					K: "audiodatarate",
-					V: float64(0),
-				},
-				{
-					K: "audiocodecid",
-					V: func() float64 {
-						if audioTrack != nil {
-							return codecAAC
-						}
-						return 0
-					}(),
-				},
-			},
+			tracksMetadata(videoTrack, audioTrack),
 		},
 	})
 	if err != nil {
 		return err
 	}
 
-	// write decoder config only if SPS and PPS are available.
-	// if they're not available yet, they're sent later.
-	if videoTrack != nil && videoTrack.SafeSPS() != nil && videoTrack.SafePPS() != nil {
-		buf, _ := h264conf.Conf{
-			SPS: videoTrack.SafeSPS(),
-			PPS: videoTrack.SafePPS(),
-		}.Marshal()
-
-		err = c.WriteMessage(&message.MsgVideo{
-			ChunkStreamID:   message.MsgVideoChunkStreamID,
-			MessageStreamID: 0x1000000,
-			IsKeyFrame:      true,
-			H264Type:        flvio.AVC_SEQHDR,
-			Payload:         buf,
-		})
-		if err != nil {
-			return err
-		}
+	err = c.writeVideoDecoderConfig(videoTrack)
+	if err != nil {
+		return err
 	}
 
 	if audioTrack != nil {
@@ -966,12 +2581,14 @@ func (c *Conn) WriteTracks(videoTrack *format.H264, audioTrack *format.MPEG4Audi
 			return err
 		}
 
+		rate, depth, channels := AudioFlags(audioTrack.Config)
+
 		err = c.WriteMessage(&message.MsgAudio{
 			ChunkStreamID:   message.MsgAudioChunkStreamID,
-			MessageStreamID: 0x1000000,
-			Rate:            flvio.SOUND_44Khz,
-			Depth:           flvio.SOUND_16BIT,
-			Channels:        flvio.SOUND_STEREO,
+			MessageStreamID: c.MessageStreamID(),
+			Rate:            rate,
+			Depth:           depth,
+			Channels:        channels,
 			AACType:         flvio.AAC_SEQHDR,
 			Payload:         enc,
 		})
@@ -0,0 +1,91 @@
+package rtmp
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+)
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// interrupt unblocks pending reads.
+func (c *Conn) interrupt() {
+	if d, ok := c.rw.(readDeadliner); ok {
+		d.SetReadDeadline(time.Now())
+		return
+	}
+
+	if cl, ok := c.rw.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// runWithContext runs cb and interrupts it when ctx is canceled.
+// When ctx is canceled, the error of ctx is returned, and the connection
+// must not be used anymore.
+func (c *Conn) runWithContext(ctx context.Context, cb func() error) error {
+	done := make(chan struct{})
+	terminated := make(chan struct{})
+
+	go func() {
+		defer close(terminated)
+
+		select {
+		case <-ctx.Done():
+			c.interrupt()
+		case <-done:
+		}
+	}()
+
+	err := cb()
+
+	close(done)
+	<-terminated
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// InitializeServerContext is like InitializeServer, but can be canceled with a context.
+// When the context is canceled, the error of the context is returned.
+func (c *Conn) InitializeServerContext(ctx context.Context) (*url.URL, bool, error) {
+	var u *url.URL
+	var isPublishing bool
+
+	err := c.runWithContext(ctx, func() error {
+		var err error
+		u, isPublishing, err = c.InitializeServer()
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return u, isPublishing, nil
+}
+
+// ReadTracksContext is like ReadTracks, but can be canceled with a context.
+// When the context is canceled, the error of the context is returned.
+func (c *Conn) ReadTracksContext(ctx context.Context) (format.Format, format.Format, error) {
+	var videoTrack format.Format
+	var audioTrack format.Format
+
+	err := c.runWithContext(ctx, func() error {
+		var err error
+		videoTrack, audioTrack, err = c.ReadTracks()
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return videoTrack, audioTrack, nil
+}
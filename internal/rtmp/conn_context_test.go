@@ -0,0 +1,112 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/handshake"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+func TestInitializeServerContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// client that connects but never performs the handshake
+	nconn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	sconn, err := ln.Accept()
+	require.NoError(t, err)
+	defer sconn.Close()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ctxCancel()
+	}()
+
+	_, _, err = NewConn(sconn).InitializeServerContext(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestInitializeServerSetupTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	sconn, err := ln.Accept()
+	require.NoError(t, err)
+	defer sconn.Close()
+
+	clientDone := make(chan struct{})
+	defer func() { <-clientDone }()
+
+	// client that performs the handshake, then keeps sending messages
+	// without ever sending the connect command
+	go func() {
+		defer close(clientDone)
+
+		err := handshake.DoClient(nconn, false)
+		if err != nil {
+			return
+		}
+
+		mrw := message.NewReadWriter(nconn, false)
+
+		for {
+			err := mrw.Write(&message.MsgSetChunkSize{
+				Value: 65536,
+			})
+			if err != nil {
+				return
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	conn := NewConn(sconn)
+	conn.SetSetupTimeout(200 * time.Millisecond)
+
+	start := time.Now()
+	_, _, err = conn.InitializeServer()
+	require.EqualError(t, err, "connection setup took more than 200ms")
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	sconn.Close()
+}
+
+func TestReadTracksContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	sconn, err := ln.Accept()
+	require.NoError(t, err)
+	defer sconn.Close()
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer ctxCancel()
+
+	conn := NewConn(sconn)
+	conn.mrw = message.NewReadWriter(conn.bc, false)
+
+	_, _, err = conn.ReadTracksContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -2,9 +2,13 @@ package rtmp
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
 	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
@@ -12,12 +16,593 @@ import (
 	"github.com/notedit/rtmp/format/flv/flvio"
 	"github.com/stretchr/testify/require"
 
+	"github.com/aler9/rtsp-simple-server/internal/ac3"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/bytecounter"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/chunk"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/handshake"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/rawmessage"
 )
 
+func TestParseURL(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		raw    string
+		host   string
+		tcURL  string
+		app    string
+		stream string
+	}{
+		{
+			"rtmp",
+			"rtmp://host/app/stream",
+			"host:1935",
+			"rtmp://host:1935/app",
+			"app",
+			"stream",
+		},
+		{
+			"rtmp with port",
+			"rtmp://host:1936/app/stream",
+			"host:1936",
+			"rtmp://host:1936/app",
+			"app",
+			"stream",
+		},
+		{
+			"rtmps",
+			"rtmps://host/app/stream",
+			"host:443",
+			"rtmps://host:443/app",
+			"app",
+			"stream",
+		},
+		{
+			"ipv6",
+			"rtmp://[::1]/app/stream",
+			"[::1]:1935",
+			"rtmp://[::1]:1935/app",
+			"app",
+			"stream",
+		},
+		{
+			"ipv6 with port",
+			"rtmp://[2001:db8::1]:1936/app/stream",
+			"[2001:db8::1]:1936",
+			"rtmp://[2001:db8::1]:1936/app",
+			"app",
+			"stream",
+		},
+		{
+			"ipv6 with zone",
+			"rtmp://[fe80::1%25eth0]:1936/app/stream",
+			"[fe80::1%eth0]:1936",
+			"rtmp://[fe80::1%25eth0]:1936/app",
+			"app",
+			"stream",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			u, err := ParseURL(ca.raw)
+			require.NoError(t, err)
+			require.Equal(t, ca.host, u.Host)
+			require.Equal(t, ca.tcURL, getTcURL(u, 0))
+
+			app, stream := splitPath(u, 0)
+			require.Equal(t, ca.app, app)
+			require.Equal(t, ca.stream, stream)
+
+			u2, err := createURL(getTcURL(u, 0), app, stream)
+			require.NoError(t, err)
+			require.Equal(t, u.Scheme, u2.Scheme)
+			require.Equal(t, ca.host, u2.Host)
+		})
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	for _, ca := range []struct {
+		name     string
+		raw      string
+		appDepth int
+		tcURL    string
+		app      string
+		stream   string
+	}{
+		{
+			"2 segments",
+			"rtmp://host/app/stream",
+			0,
+			"rtmp://host:1935/app",
+			"app",
+			"stream",
+		},
+		{
+			"3 segments",
+			"rtmp://host/live/region/stream",
+			0,
+			"rtmp://host:1935/live/region",
+			"live/region",
+			"stream",
+		},
+		{
+			"4 segments",
+			"rtmp://host/live/region/cam1/streamkey",
+			0,
+			"rtmp://host:1935/live/region",
+			"live/region",
+			"cam1/streamkey",
+		},
+		{
+			"4 segments with depth",
+			"rtmp://host/live/region/cam1/streamkey",
+			3,
+			"rtmp://host:1935/live/region/cam1",
+			"live/region/cam1",
+			"streamkey",
+		},
+		{
+			"5 segments with depth",
+			"rtmp://host/live/eu/region/cam1/streamkey",
+			4,
+			"rtmp://host:1935/live/eu/region/cam1",
+			"live/eu/region/cam1",
+			"streamkey",
+		},
+		{
+			"6 segments with depth",
+			"rtmp://host/a/b/c/d/e/f",
+			1,
+			"rtmp://host:1935/a",
+			"a",
+			"b/c/d/e/f",
+		},
+		{
+			"query",
+			"rtmp://host/live/region/stream?key=val",
+			2,
+			"rtmp://host:1935/live/region",
+			"live/region",
+			"stream?key=val",
+		},
+		{
+			"depth greater than segments",
+			"rtmp://host/app/stream",
+			3,
+			"rtmp://host:1935/app/stream",
+			"app/stream",
+			"",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			u, err := ParseURL(ca.raw)
+			require.NoError(t, err)
+			require.Equal(t, ca.tcURL, getTcURL(u, ca.appDepth))
+
+			app, stream := splitPath(u, ca.appDepth)
+			require.Equal(t, ca.app, app)
+			require.Equal(t, ca.stream, stream)
+
+			if stream != "" {
+				u2, err := createURL(getTcURL(u, ca.appDepth), app, stream)
+				require.NoError(t, err)
+				require.Equal(t, u.String(), u2.String())
+			}
+		})
+	}
+}
+
+func TestCreateURL(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		tcURL string
+		host  string
+		str   string
+	}{
+		{
+			"ipv6",
+			"rtmp://[::1]:1936/app",
+			"[::1]:1936",
+			"rtmp://[::1]:1936/app/stream",
+		},
+		{
+			"ipv6 without port",
+			"rtmp://[::1]/app",
+			"[::1]:1935",
+			"rtmp://[::1]:1935/app/stream",
+		},
+		{
+			"ipv6 without brackets",
+			"rtmp://fe80::1/app",
+			"[fe80::1]:1935",
+			"rtmp://[fe80::1]:1935/app/stream",
+		},
+		{
+			"rtmpt",
+			"rtmpt://example.com/app",
+			"example.com",
+			"rtmpt://example.com/app/stream",
+		},
+		{
+			"rtmpe with port",
+			"rtmpe://example.com:1936/app",
+			"example.com:1936",
+			"rtmpe://example.com:1936/app/stream",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			u, err := createURL(ca.tcURL, "app", "stream")
+			require.NoError(t, err)
+			require.Equal(t, ca.host, u.Host)
+			require.Equal(t, ca.str, u.String())
+		})
+	}
+}
+
+func TestParseURLErrors(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{
+			"invalid scheme",
+			"http://host/app/stream",
+			"unsupported scheme 'http'",
+		},
+		{
+			"invalid host",
+			"rtmps:///app/stream",
+			"invalid host",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := ParseURL(ca.raw)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestAudioFlags(t *testing.T) {
+	for _, ca := range []struct {
+		name     string
+		conf     mpeg4audio.Config
+		rate     uint8
+		channels uint8
+	}{
+		{
+			"44100 stereo",
+			mpeg4audio.Config{
+				Type:         2,
+				SampleRate:   44100,
+				ChannelCount: 2,
+			},
+			flvio.SOUND_44Khz,
+			flvio.SOUND_STEREO,
+		},
+		{
+			"48000 mono",
+			mpeg4audio.Config{
+				Type:         2,
+				SampleRate:   48000,
+				ChannelCount: 1,
+			},
+			flvio.SOUND_44Khz,
+			flvio.SOUND_MONO,
+		},
+		{
+			"22050 mono",
+			mpeg4audio.Config{
+				Type:         2,
+				SampleRate:   22050,
+				ChannelCount: 1,
+			},
+			flvio.SOUND_22Khz,
+			flvio.SOUND_MONO,
+		},
+		{
+			"8000 mono",
+			mpeg4audio.Config{
+				Type:         2,
+				SampleRate:   8000,
+				ChannelCount: 1,
+			},
+			flvio.SOUND_5_5Khz,
+			flvio.SOUND_MONO,
+		},
+		{
+			"he-aac v2",
+			mpeg4audio.Config{
+				Type:                2,
+				SampleRate:          24000,
+				ChannelCount:        1,
+				ExtensionType:       mpeg4audio.ObjectTypePS,
+				ExtensionSampleRate: 48000,
+			},
+			flvio.SOUND_44Khz,
+			flvio.SOUND_STEREO,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			rate, depth, channels := AudioFlags(&ca.conf)
+			require.Equal(t, ca.rate, rate)
+			require.Equal(t, uint8(flvio.SOUND_16BIT), depth)
+			require.Equal(t, ca.channels, channels)
+		})
+	}
+}
+
+func TestAVCCMaybeH265(t *testing.T) {
+	for _, ca := range []struct {
+		name  string
+		nalus [][]byte
+		res   bool
+	}{
+		{
+			"h264 sps",
+			[][]byte{{0x67, 0x42, 0xc0, 0x28}, {0x65, 0x88}},
+			false,
+		},
+		{
+			"h264 pps",
+			[][]byte{{0x68, 0xce, 0x3c, 0x80}, {0x65, 0x88}},
+			false,
+		},
+		{
+			"h264 idr",
+			[][]byte{{0x65, 0x88, 0x84, 0x00}},
+			false,
+		},
+		{
+			"h265 vps",
+			[][]byte{{0x40, 0x01, 0x0c, 0x01}, {0x26, 0x01}},
+			true,
+		},
+		{
+			"h265 aud",
+			[][]byte{{0x46, 0x01, 0x50}, {0x40, 0x01, 0x0c, 0x01}},
+			true,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			buf, err := h264.AVCCMarshal(ca.nalus)
+			require.NoError(t, err)
+			require.Equal(t, ca.res, avccMaybeH265(buf))
+		})
+	}
+}
+
+func TestUpdateH264TrackFromDecoderConfig(t *testing.T) {
+	sps1 := []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+
+	sps2 := []byte{
+		0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+		0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+		0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9,
+		0x20,
+	}
+
+	pps := []byte{
+		0x68, 0xee, 0x3c, 0x80,
+	}
+
+	track := &format.H264{
+		PayloadTyp:        96,
+		SPS:               sps1,
+		PPS:               pps,
+		PacketizationMode: 1,
+	}
+
+	buf, err := h264conf.Conf{
+		SPS: sps1,
+		PPS: pps,
+	}.Marshal()
+	require.NoError(t, err)
+
+	changed, err := UpdateH264TrackFromDecoderConfig(track, buf)
+	require.NoError(t, err)
+	require.Equal(t, false, changed)
+
+	// resolution change
+	buf, err = h264conf.Conf{
+		SPS: sps2,
+		PPS: pps,
+	}.Marshal()
+	require.NoError(t, err)
+
+	changed, err = UpdateH264TrackFromDecoderConfig(track, buf)
+	require.NoError(t, err)
+	require.Equal(t, true, changed)
+	require.Equal(t, sps2, track.SafeSPS())
+
+	var oldSPS h264.SPS
+	err = oldSPS.Unmarshal(sps1)
+	require.NoError(t, err)
+
+	var newSPS h264.SPS
+	err = newSPS.Unmarshal(track.SafeSPS())
+	require.NoError(t, err)
+	require.Equal(t, 1920, newSPS.Width())
+	require.NotEqual(t, oldSPS.Width(), newSPS.Width())
+
+	// invalid SPS
+	buf, err = h264conf.Conf{
+		SPS: []byte{0x67, 0x01},
+		PPS: pps,
+	}.Marshal()
+	require.NoError(t, err)
+
+	_, err = UpdateH264TrackFromDecoderConfig(track, buf)
+	require.Error(t, err)
+	require.Equal(t, sps2, track.SafeSPS())
+}
+
+func TestTrackFromAACDecoderConfig(t *testing.T) {
+	for _, ca := range []struct {
+		name               string
+		byts               []byte
+		metadataSampleRate int
+		conf               mpeg4audio.Config
+	}{
+		{
+			"aac-lc",
+			[]byte{0x13, 0x10},
+			0,
+			mpeg4audio.Config{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   24000,
+				ChannelCount: 2,
+			},
+		},
+		{
+			"sbr explicit hierarchical",
+			[]byte{0x2b, 0x11, 0x88, 0x00},
+			0,
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        2,
+				ExtensionType:       mpeg4audio.ObjectTypeSBR,
+				ExtensionSampleRate: 48000,
+			},
+		},
+		{
+			"sbr explicit backward compatible",
+			[]byte{0x13, 0x10, 0x56, 0xe5, 0x98},
+			0,
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        2,
+				ExtensionType:       mpeg4audio.ObjectTypeSBR,
+				ExtensionSampleRate: 48000,
+			},
+		},
+		{
+			"ps explicit backward compatible",
+			[]byte{0x13, 0x08, 0x56, 0xe5, 0x9d, 0x48, 0x80},
+			0,
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        1,
+				ExtensionType:       mpeg4audio.ObjectTypePS,
+				ExtensionSampleRate: 48000,
+			},
+		},
+		{
+			"sbr implicit",
+			[]byte{0x13, 0x10},
+			48000,
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        2,
+				ExtensionType:       mpeg4audio.ObjectTypeSBR,
+				ExtensionSampleRate: 48000,
+			},
+		},
+		{
+			"no sbr with same metadata sample rate",
+			[]byte{0x13, 0x10},
+			24000,
+			mpeg4audio.Config{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   24000,
+				ChannelCount: 2,
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			track, err := trackFromAACDecoderConfig(ca.byts)
+			require.NoError(t, err)
+
+			if ca.metadataSampleRate != 0 {
+				applyAACImplicitSBR(track.Config, ca.metadataSampleRate)
+			}
+
+			require.Equal(t, &ca.conf, track.Config)
+		})
+	}
+}
+
+func TestCheckAACObjectType(t *testing.T) {
+	ps := mpeg4audio.Config{
+		Type:                mpeg4audio.ObjectTypeAACLC,
+		SampleRate:          24000,
+		ChannelCount:        1,
+		ExtensionType:       mpeg4audio.ObjectTypePS,
+		ExtensionSampleRate: 48000,
+	}
+
+	for _, ca := range []struct {
+		name  string
+		types []mpeg4audio.ObjectType
+		conf  mpeg4audio.Config
+		err   string
+	}{
+		{
+			"default",
+			nil,
+			ps,
+			"",
+		},
+		{
+			"ps to sbr",
+			[]mpeg4audio.ObjectType{mpeg4audio.ObjectTypeAACLC, mpeg4audio.ObjectTypeSBR},
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        1,
+				ExtensionType:       mpeg4audio.ObjectTypeSBR,
+				ExtensionSampleRate: 48000,
+			},
+			"",
+		},
+		{
+			"ps to lc",
+			[]mpeg4audio.ObjectType{mpeg4audio.ObjectTypeAACLC},
+			mpeg4audio.Config{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   24000,
+				ChannelCount: 1,
+			},
+			"",
+		},
+		{
+			"not allowed",
+			[]mpeg4audio.ObjectType{},
+			ps,
+			"AAC object type 29 is not allowed",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			c := NewConn(nil)
+			c.SetAACObjectTypes(ca.types)
+
+			conf := ps
+			track := &format.MPEG4Audio{
+				PayloadTyp: 96,
+				Config:     &conf,
+			}
+
+			err := c.checkAACObjectType(track)
+			if ca.err != "" {
+				require.EqualError(t, err, ca.err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, &ca.conf, track.Config)
+			}
+		})
+	}
+}
+
 func TestInitializeClient(t *testing.T) {
 	for _, ca := range []string{"read", "publish"} {
 		t.Run(ca, func(t *testing.T) {
@@ -244,6 +829,10 @@ func TestInitializeClient(t *testing.T) {
 
 			err = conn.InitializeClient(u, ca == "publish")
 			require.NoError(t, err)
+			require.Equal(t, flvio.AMFMap{
+				{K: "fmsVer", V: "LNX 9,0,124,2"},
+				{K: "capabilities", V: float64(31)},
+			}, conn.ConnectProperties())
 
 			if ca == "read" {
 				require.Equal(t, uint64(3421), conn.BytesReceived())
@@ -258,32 +847,379 @@ func TestInitializeClient(t *testing.T) {
 	}
 }
 
-func TestInitializeServer(t *testing.T) {
-	for _, ca := range []string{"read", "publish"} {
-		t.Run(ca, func(t *testing.T) {
-			ln, err := net.Listen("tcp", "127.0.0.1:9121")
-			require.NoError(t, err)
-			defer ln.Close()
+func TestInitializeClientStreamID(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
 
-			done := make(chan struct{})
+	done := make(chan struct{})
 
-			go func() {
-				nconn, err := ln.Accept()
-				require.NoError(t, err)
-				defer nconn.Close()
+	go func() {
+		defer close(done)
 
-				conn := NewConn(nconn)
-				u, isPublishing, err := conn.InitializeServer()
-				require.NoError(t, err)
-				require.Equal(t, &url.URL{
-					Scheme: "rtmp",
-					Host:   "127.0.0.1:9121",
-					Path:   "//stream/",
-				}, u)
-				require.Equal(t, ca == "publish", isPublishing)
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		bc := bytecounter.NewReadWriter(conn)
 
-				close(done)
-			}()
+		err = handshake.DoServer(bc, true)
+		require.NoError(t, err)
+
+		mrw := message.NewReadWriter(bc, true)
+
+		readCommand := func(name string) *message.MsgCommandAMF0 {
+			for {
+				msg, err := mrw.Read()
+				require.NoError(t, err)
+
+				if cmd, ok := msg.(*message.MsgCommandAMF0); ok && cmd.Name == name {
+					return cmd
+				}
+			}
+		}
+
+		readCommand("connect")
+
+		err = mrw.Write(&message.MsgCommandAMF0{
+			ChunkStreamID: 3,
+			Name:          "_result",
+			CommandID:     1,
+			Arguments: []interface{}{
+				flvio.AMFMap{
+					{K: "fmsVer", V: "LNX 9,0,124,2"},
+					{K: "capabilities", V: float64(31)},
+				},
+				flvio.AMFMap{
+					{K: "level", V: "status"},
+					{K: "code", V: "NetConnection.Connect.Success"},
+					{K: "description", V: "Connection succeeded."},
+					{K: "objectEncoding", V: float64(0)},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		cmd := readCommand("createStream")
+
+		err = mrw.Write(&message.MsgCommandAMF0{
+			ChunkStreamID: 3,
+			Name:          "_result",
+			CommandID:     cmd.CommandID,
+			Arguments: []interface{}{
+				nil,
+				float64(3),
+			},
+		})
+		require.NoError(t, err)
+
+		cmd = readCommand("publish")
+		require.Equal(t, uint32(0x3000000), cmd.MessageStreamID)
+
+		err = mrw.Write(&message.MsgCommandAMF0{
+			ChunkStreamID:   5,
+			MessageStreamID: 0x3000000,
+			Name:            "onStatus",
+			CommandID:       cmd.CommandID,
+			Arguments: []interface{}{
+				nil,
+				flvio.AMFMap{
+					{K: "level", V: "status"},
+					{K: "code", V: "NetStream.Publish.Start"},
+					{K: "description", V: "publish start"},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+	conn := NewConn(nconn)
+
+	err = conn.InitializeClient(u, true)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0x3000000), conn.MessageStreamID())
+	require.Equal(t, byte(message.MsgVideoChunkStreamID), conn.VideoChunkStreamID())
+	require.Equal(t, byte(message.MsgAudioChunkStreamID), conn.AudioChunkStreamID())
+
+	<-done
+}
+
+func TestInitializeClientConnectProperties(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		bc := bytecounter.NewReadWriter(conn)
+
+		err = handshake.DoServer(bc, true)
+		require.NoError(t, err)
+
+		mrw := message.NewReadWriter(bc, true)
+
+		for i := 0; i < 3; i++ {
+			_, err = mrw.Read()
+			require.NoError(t, err)
+		}
+
+		msg, err := mrw.Read()
+		require.NoError(t, err)
+		require.Equal(t, &message.MsgCommandAMF0{
+			ChunkStreamID: 3,
+			Name:          "connect",
+			CommandID:     1,
+			Arguments: []interface{}{
+				flvio.AMFMap{
+					{K: "app", V: "stream"},
+					{K: "flashVer", V: "FMLE/3.0 (compatible; FMSc/1.0)"},
+					{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+					{K: "fpad", V: false},
+					{K: "capabilities", V: float64(15)},
+					{K: "audioCodecs", V: float64(4071)},
+					{K: "videoCodecs", V: float64(252)},
+					{K: "videoFunction", V: float64(1)},
+					{K: "swfUrl", V: "rtmp://127.0.0.1:9121/stream"},
+				},
+			},
+		}, msg)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+	conn := NewConn(nconn)
+
+	conn.SetClientConnectProperties(flvio.AMFMap{
+		{K: "flashVer", V: "FMLE/3.0 (compatible; FMSc/1.0)"},
+		{K: "swfUrl", V: "rtmp://127.0.0.1:9121/stream"},
+	})
+
+	// the server closes the connection after receiving the connect command
+	conn.InitializeClient(u, true)
+
+	<-done
+}
+
+func TestInitializeClientObjectEncoding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		bc := bytecounter.NewReadWriter(conn)
+
+		err = handshake.DoServer(bc, true)
+		require.NoError(t, err)
+
+		mrw := message.NewReadWriter(bc, true)
+
+		for i := 0; i < 3; i++ {
+			_, err = mrw.Read()
+			require.NoError(t, err)
+		}
+
+		// the connect command is encoded with AMF0
+		msg, err := mrw.Read()
+		require.NoError(t, err)
+		require.Equal(t, &message.MsgCommandAMF0{
+			ChunkStreamID: 3,
+			Name:          "connect",
+			CommandID:     1,
+			Arguments: []interface{}{
+				flvio.AMFMap{
+					{K: "app", V: "stream"},
+					{K: "flashVer", V: "LNX 9,0,124,2"},
+					{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+					{K: "fpad", V: false},
+					{K: "capabilities", V: float64(15)},
+					{K: "audioCodecs", V: float64(4071)},
+					{K: "videoCodecs", V: float64(252)},
+					{K: "videoFunction", V: float64(1)},
+					{K: "objectEncoding", V: float64(3)},
+					{K: "type", V: "nonprivate"},
+				},
+			},
+		}, msg)
+
+		err = mrw.Write(&message.MsgCommandAMF0{
+			ChunkStreamID: 3,
+			Name:          "_result",
+			CommandID:     1,
+			Arguments: []interface{}{
+				flvio.AMFMap{
+					{K: "fmsVer", V: "LNX 9,0,124,2"},
+					{K: "capabilities", V: float64(31)},
+				},
+				flvio.AMFMap{
+					{K: "level", V: "status"},
+					{K: "code", V: "NetConnection.Connect.Success"},
+					{K: "description", V: "Connection succeeded."},
+					{K: "objectEncoding", V: float64(3)},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		// the following commands are encoded with AMF3
+		msg, err = mrw.Read()
+		require.NoError(t, err)
+		require.IsType(t, &message.MsgCommandAMF3{}, msg)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+	conn := NewConn(nconn)
+
+	conn.SetClientObjectEncoding(3)
+	conn.SetClientConnectProperties(flvio.AMFMap{
+		{K: "type", V: "nonprivate"},
+	})
+
+	// the server closes the connection after receiving the second command
+	conn.InitializeClient(u, true)
+
+	<-done
+}
+
+func TestInitializeClientObjectEncodingInvalid(t *testing.T) {
+	conn := NewConn(&bytes.Buffer{})
+	conn.SetClientObjectEncoding(1)
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	err = conn.InitializeClient(u, true)
+	require.EqualError(t, err, "unsupported object encoding: 1")
+}
+
+func TestInitializeClientRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		bc := bytecounter.NewReadWriter(conn)
+
+		err = handshake.DoServer(bc, true)
+		require.NoError(t, err)
+
+		mrw := message.NewReadWriter(bc, true)
+
+		for {
+			msg, err := mrw.Read()
+			require.NoError(t, err)
+
+			if cmd, ok := msg.(*message.MsgCommandAMF0); ok && cmd.Name == "connect" {
+				break
+			}
+		}
+
+		err = mrw.Write(&message.MsgCommandAMF0{
+			ChunkStreamID: 3,
+			Name:          "_error",
+			CommandID:     1,
+			Arguments: []interface{}{
+				nil,
+				flvio.AMFMap{
+					{K: "level", V: "error"},
+					{K: "code", V: "NetConnection.Connect.Rejected"},
+					{K: "description", V: "authentication failed"},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, true)
+	require.Equal(t, &ConnectError{
+		Request:     "connect",
+		Code:        "NetConnection.Connect.Rejected",
+		Description: "authentication failed",
+	}, err)
+	require.EqualError(t, err, "server refused connect request "+
+		"(NetConnection.Connect.Rejected): authentication failed")
+	require.False(t, IsRetriableError(err))
+
+	<-done
+}
+
+func TestInitializeServer(t *testing.T) {
+	for _, ca := range []string{"read", "publish", "publish with bandwidth check"} {
+		t.Run(ca, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:9121")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			done := make(chan struct{})
+
+			go func() {
+				nconn, err := ln.Accept()
+				require.NoError(t, err)
+				defer nconn.Close()
+
+				conn := NewConn(nconn)
+				u, isPublishing, err := conn.InitializeServer()
+				require.NoError(t, err)
+				require.Equal(t, &url.URL{
+					Scheme: "rtmp",
+					Host:   "127.0.0.1:9121",
+					Path:   "//stream/",
+				}, u)
+				require.Equal(t, ca != "read", isPublishing)
+				require.Equal(t, flvio.AMFMap{
+					{K: "app", V: "/stream"},
+					{K: "flashVer", V: "LNX 9,0,124,2"},
+					{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+					{K: "fpad", V: false},
+					{K: "capabilities", V: float64(15)},
+					{K: "audioCodecs", V: float64(4071)},
+					{K: "videoCodecs", V: float64(252)},
+					{K: "videoFunction", V: float64(1)},
+				}, conn.ConnectProperties())
+
+				close(done)
+			}()
 
 			conn, err := net.Dial("tcp", "127.0.0.1:9121")
 			require.NoError(t, err)
@@ -398,6 +1334,40 @@ func TestInitializeServer(t *testing.T) {
 				})
 				require.NoError(t, err)
 			} else {
+				if ca == "publish with bandwidth check" {
+					err = mrw.Write(&message.MsgCommandAMF0{
+						ChunkStreamID: 3,
+						Name:          "checkBandwidth",
+						CommandID:     2,
+						Arguments: []interface{}{
+							nil,
+						},
+					})
+					require.NoError(t, err)
+
+					msg, err = mrw.Read()
+					require.NoError(t, err)
+					require.Equal(t, &message.MsgCommandAMF0{
+						ChunkStreamID: 3,
+						Name:          "_result",
+						CommandID:     2,
+						Arguments: []interface{}{
+							nil,
+						},
+					}, msg)
+
+					msg, err = mrw.Read()
+					require.NoError(t, err)
+					require.Equal(t, &message.MsgCommandAMF0{
+						ChunkStreamID: 3,
+						Name:          "onBWDone",
+						CommandID:     0,
+						Arguments: []interface{}{
+							nil,
+						},
+					}, msg)
+				}
+
 				err = mrw.Write(&message.MsgCommandAMF0{
 					ChunkStreamID: 3,
 					Name:          "releaseStream",
@@ -461,59 +1431,1447 @@ func TestInitializeServer(t *testing.T) {
 	}
 }
 
-func TestReadTracks(t *testing.T) {
-	sps := []byte{
-		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
-		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
-		0x00, 0x03, 0x00, 0x3d, 0x08,
-	}
+func TestInitializeServerTcURLScheme(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
 
-	pps := []byte{
-		0x68, 0xee, 0x3c, 0x80,
-	}
+	done := make(chan struct{})
 
-	for _, ca := range []struct {
-		name       string
-		videoTrack format.Format
-		audioTrack format.Format
-	}{
-		{
-			"video+audio",
-			&format.H264{
-				PayloadTyp:        96,
-				SPS:               sps,
-				PPS:               pps,
-				PacketizationMode: 1,
-			},
-			&format.MPEG4Audio{
-				PayloadTyp: 96,
-				Config: &mpeg4audio.Config{
-					Type:         2,
-					SampleRate:   44100,
-					ChannelCount: 2,
-				},
-				SizeLength:       13,
-				IndexLength:      3,
-				IndexDeltaLength: 3,
-			},
-		},
-		{
-			"video",
-			&format.H264{
-				PayloadTyp:        96,
-				SPS:               sps,
-				PPS:               pps,
-				PacketizationMode: 1,
-			},
-			(*format.MPEG4Audio)(nil),
-		},
-		{
-			"metadata without codec id",
-			&format.H264{
-				PayloadTyp:        96,
-				SPS:               sps,
-				PPS:               pps,
-				PacketizationMode: 1,
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		// tcUrls with schemes different than rtmp and rtmps are accepted
+		conn := NewConn(nconn)
+		u, isPublishing, err := conn.InitializeServer()
+		require.NoError(t, err)
+		require.Equal(t, true, isPublishing)
+		require.Equal(t, "rtmpt", u.Scheme)
+		require.Equal(t, "127.0.0.1:9121", u.Host)
+	}()
+
+	u, err := url.Parse("rtmpt://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, true)
+	require.NoError(t, err)
+
+	<-done
+}
+
+func TestInitializeServerAMF3(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		u, isPublishing, err := conn.InitializeServer()
+		require.NoError(t, err)
+		require.Equal(t, "rtmp://127.0.0.1:9121/stream/", u.String())
+		require.Equal(t, true, isPublishing)
+
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn.Close()
+	bc := bytecounter.NewReadWriter(conn)
+
+	err = handshake.DoClient(bc, true)
+	require.NoError(t, err)
+
+	mrw := message.NewReadWriter(bc, true)
+
+	err = mrw.Write(&message.MsgCommandAMF3{
+		ChunkStreamID: 3,
+		Name:          "connect",
+		CommandID:     1,
+		Arguments: []interface{}{
+			flvio.AMFMap{
+				{K: "app", V: "stream"},
+				{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+				{K: "objectEncoding", V: float64(3)},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = mrw.Read()
+		require.NoError(t, err)
+	}
+
+	// responses are encoded with AMF3 too
+	msg, err := mrw.Read()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgCommandAMF3{
+		ChunkStreamID: 3,
+		Name:          "_result",
+		CommandID:     1,
+		Arguments: []interface{}{
+			flvio.AMFMap{
+				{K: "fmsVer", V: "LNX 9,0,124,2"},
+				{K: "capabilities", V: float64(31)},
+			},
+			flvio.AMFMap{
+				{K: "level", V: "status"},
+				{K: "code", V: "NetConnection.Connect.Success"},
+				{K: "description", V: "Connection succeeded."},
+				{K: "objectEncoding", V: float64(3)},
+			},
+		},
+	}, msg)
+
+	err = mrw.Write(&message.MsgCommandAMF3{
+		ChunkStreamID: 3,
+		Name:          "createStream",
+		CommandID:     2,
+		Arguments: []interface{}{
+			nil,
+		},
+	})
+	require.NoError(t, err)
+
+	msg, err = mrw.Read()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgCommandAMF3{
+		ChunkStreamID: 3,
+		Name:          "_result",
+		CommandID:     2,
+		Arguments: []interface{}{
+			nil,
+			float64(1),
+		},
+	}, msg)
+
+	err = mrw.Write(&message.MsgCommandAMF3{
+		ChunkStreamID:   4,
+		MessageStreamID: 0x1000000,
+		Name:            "publish",
+		CommandID:       3,
+		Arguments: []interface{}{
+			nil,
+			"",
+			"stream",
+		},
+	})
+	require.NoError(t, err)
+
+	<-done
+}
+
+func TestInitializeServerUnknownCommand(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		var names []string
+
+		conn := NewConn(nconn)
+		conn.SetOnUnknownCommand(func(cmd *message.MsgCommandAMF0) (*message.MsgCommandAMF0, error) {
+			names = append(names, cmd.Name)
+
+			if cmd.CommandID == 0 {
+				return nil, nil
+			}
+
+			return &message.MsgCommandAMF0{
+				ChunkStreamID: cmd.ChunkStreamID,
+				Name:          "_result",
+				CommandID:     cmd.CommandID,
+				Arguments: []interface{}{
+					nil,
+					float64(0),
+				},
+			}, nil
+		})
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+		require.Equal(t, []string{"getStreamLength", "customCommand"}, names)
+
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn.Close()
+	bc := bytecounter.NewReadWriter(conn)
+
+	err = handshake.DoClient(bc, true)
+	require.NoError(t, err)
+
+	mrw := message.NewReadWriter(bc, true)
+
+	err = mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID: 3,
+		Name:          "connect",
+		CommandID:     1,
+		Arguments: []interface{}{
+			flvio.AMFMap{
+				{K: "app", V: "stream"},
+				{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err = mrw.Read()
+		require.NoError(t, err)
+	}
+
+	err = mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID: 8,
+		Name:          "getStreamLength",
+		CommandID:     2,
+		Arguments: []interface{}{
+			nil,
+			"",
+		},
+	})
+	require.NoError(t, err)
+
+	msg, err := mrw.Read()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgCommandAMF0{
+		ChunkStreamID: 8,
+		Name:          "_result",
+		CommandID:     2,
+		Arguments: []interface{}{
+			nil,
+			float64(0),
+		},
+	}, msg)
+
+	// commands that don't expect a response
+	err = mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID: 3,
+		Name:          "customCommand",
+		CommandID:     0,
+		Arguments: []interface{}{
+			nil,
+		},
+	})
+	require.NoError(t, err)
+
+	err = mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID:   4,
+		MessageStreamID: 0x1000000,
+		Name:            "publish",
+		CommandID:       3,
+		Arguments: []interface{}{
+			nil,
+			"",
+			"stream",
+		},
+	})
+	require.NoError(t, err)
+
+	<-done
+}
+
+// replayReadWriter is an in-memory io.ReadWriter that returns a captured byte stream
+// and stores written bytes, allowing to test connections deterministically, without sockets.
+type replayReadWriter struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (rw *replayReadWriter) Read(p []byte) (int, error) {
+	return rw.r.Read(p)
+}
+
+func (rw *replayReadWriter) Write(p []byte) (int, error) {
+	return rw.w.Write(p)
+}
+
+func TestInitializeServerReplay(t *testing.T) {
+	// byte streams reproduce the handshake and the command sequence of publishers,
+	// including their connect properties and chunk sizes.
+	for _, ca := range []struct {
+		name                   string
+		file                   string
+		connectPropertiesCount int
+	}{
+		{
+			"ffmpeg",
+			"testdata/publish_ffmpeg.bin",
+			4,
+		},
+		{
+			"obs",
+			"testdata/publish_obs.bin",
+			5,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			capture, err := os.ReadFile(ca.file)
+			require.NoError(t, err)
+
+			rw := &replayReadWriter{r: bytes.NewReader(capture)}
+
+			conn := NewConn(rw)
+			u, isPublishing, err := conn.InitializeServer()
+			require.NoError(t, err)
+			require.Equal(t, &url.URL{
+				Scheme: "rtmp",
+				Host:   "127.0.0.1:1935",
+				Path:   "/live/mystream",
+			}, u)
+			require.Equal(t, true, isPublishing)
+			require.Equal(t, ca.connectPropertiesCount, len(conn.connectProperties))
+
+			// S0, S1 and S2 contain random data
+			out := rw.w.Bytes()
+			require.Greater(t, len(out), 1+1536+1536)
+			require.Equal(t, byte(3), out[0])
+
+			mr := message.NewReader(bytecounter.NewReader(bytes.NewReader(out[1+1536+1536:])), nil)
+
+			for _, expected := range []message.Message{
+				&message.MsgSetWindowAckSize{
+					Value: 2500000,
+				},
+				&message.MsgSetPeerBandwidth{
+					Value: 2500000,
+					Type:  2,
+				},
+				&message.MsgSetChunkSize{
+					Value: 65536,
+				},
+				&message.MsgCommandAMF0{
+					ChunkStreamID: 3,
+					Name:          "_result",
+					CommandID:     1,
+					Arguments: []interface{}{
+						flvio.AMFMap{
+							{K: "fmsVer", V: "LNX 9,0,124,2"},
+							{K: "capabilities", V: float64(31)},
+						},
+						flvio.AMFMap{
+							{K: "level", V: "status"},
+							{K: "code", V: "NetConnection.Connect.Success"},
+							{K: "description", V: "Connection succeeded."},
+							{K: "objectEncoding", V: float64(0)},
+						},
+					},
+				},
+				&message.MsgCommandAMF0{
+					ChunkStreamID: 3,
+					Name:          "_result",
+					CommandID:     4,
+					Arguments: []interface{}{
+						nil,
+						float64(1),
+					},
+				},
+				&message.MsgCommandAMF0{
+					ChunkStreamID:   5,
+					MessageStreamID: 0x1000000,
+					Name:            "onStatus",
+					CommandID:       5,
+					Arguments: []interface{}{
+						nil,
+						flvio.AMFMap{
+							{K: "level", V: "status"},
+							{K: "code", V: "NetStream.Publish.Start"},
+							{K: "description", V: "publish start"},
+						},
+					},
+				},
+			} {
+				msg, err := mr.Read()
+				require.NoError(t, err)
+				require.Equal(t, expected, msg)
+			}
+
+			_, err = mr.Read()
+			require.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestInitializeServerReleaseStream(t *testing.T) {
+	for _, file := range []string{
+		"testdata/publish_ffmpeg.bin",
+		"testdata/publish_obs.bin",
+	} {
+		t.Run(file, func(t *testing.T) {
+			capture, err := os.ReadFile(file)
+			require.NoError(t, err)
+
+			var released []*url.URL
+
+			conn := NewConn(&replayReadWriter{r: bytes.NewReader(capture)})
+			conn.SetOnReleaseStream(func(u *url.URL) {
+				released = append(released, u)
+			})
+			_, _, err = conn.InitializeServer()
+			require.NoError(t, err)
+
+			// releaseStream and FCPublish refer to the same stream
+			require.Equal(t, []*url.URL{{
+				Scheme: "rtmp",
+				Host:   "127.0.0.1:1935",
+				Path:   "/live/mystream",
+			}}, released)
+		})
+	}
+}
+
+func TestInitializeServerPlayLimiter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	limiter := NewPlayLimiter(1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn1, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn1.Close()
+
+		conn1 := NewConn(nconn1)
+		conn1.SetPlayLimiter(limiter)
+		_, _, err = conn1.InitializeServer()
+		require.NoError(t, err)
+		require.Equal(t, 1, limiter.Count())
+
+		nconn2, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn2.Close()
+
+		conn2 := NewConn(nconn2)
+		conn2.SetPlayLimiter(limiter)
+		_, _, err = conn2.InitializeServer()
+		require.EqualError(t, err, "too many readers")
+		conn2.ReleasePlay()
+		require.Equal(t, 1, limiter.Count())
+
+		conn1.ReleasePlay()
+		require.Equal(t, 0, limiter.Count())
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn1, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn1.Close()
+
+	err = NewConn(nconn1).InitializeClient(u, false)
+	require.NoError(t, err)
+
+	nconn2, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn2.Close()
+
+	err = NewConn(nconn2).InitializeClient(u, false)
+	require.Error(t, err)
+
+	<-done
+}
+
+func TestWriteUnpublishNotify(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		err = conn.WriteUnpublishNotify()
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	for _, code := range []string{
+		"NetStream.Play.UnpublishNotify",
+		"NetStream.Play.Stop",
+	} {
+		msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		cmd, ok := msg.(*message.MsgCommandAMF0)
+		require.Equal(t, true, ok)
+		require.Equal(t, "onStatus", cmd.Name)
+		v, _ := cmd.Arguments[1].(flvio.AMFMap).GetString("code")
+		require.Equal(t, code, v)
+	}
+
+	msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgUserControlStreamEOF{
+		StreamID: 1,
+	}, msg)
+
+	<-done
+}
+
+func TestReadTracksFiniteStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgDataAMF0{
+			ChunkStreamID:   4,
+			MessageStreamID: 0x1000000,
+			Payload: []interface{}{
+				"@setDataFrame",
+				"onMetaData",
+				flvio.AMFMap{
+					{K: "duration", V: float64(12.5)},
+					{K: "filesize", V: float64(123456)},
+					{K: "audiocodecid", V: float64(codecAAC)},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		enc, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_SEQHDR,
+			Payload:         enc,
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	require.Equal(t, false, conn.IsFinite())
+
+	_, audioTrack, err := conn.ReadTracks()
+	require.NoError(t, err)
+	require.NotNil(t, audioTrack)
+
+	require.Equal(t, true, conn.IsFinite())
+	require.Equal(t, 12500*time.Millisecond, conn.Duration())
+	require.Equal(t, uint64(123456), conn.FileSize())
+
+	<-done
+}
+
+type testConnLogger struct {
+	lines []string
+}
+
+func (l *testConnLogger) Log(level logger.Level, format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestReadTracksLogger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgDataAMF0{
+			ChunkStreamID:   4,
+			MessageStreamID: 0x1000000,
+			Payload: []interface{}{
+				"@setDataFrame",
+				"onMetaData",
+				flvio.AMFMap{
+					{K: "audiocodecid", V: float64(codecAAC)},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgDataAMF0{
+			ChunkStreamID:   4,
+			MessageStreamID: 0x1000000,
+			Payload: []interface{}{
+				"onTextData",
+			},
+		})
+		require.NoError(t, err)
+
+		enc, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_SEQHDR,
+			Payload:         enc,
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	l := &testConnLogger{}
+
+	conn := NewConn(nconn)
+	conn.SetLogger(l)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	_, audioTrack, err := conn.ReadTracks()
+	require.NoError(t, err)
+	require.NotNil(t, audioTrack)
+
+	require.Contains(t, l.lines, "skipping unexpected message of type *message.MsgDataAMF0")
+
+	<-done
+}
+
+func TestReadMessageMetadataUpdate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgDataAMF0{
+			ChunkStreamID:   4,
+			MessageStreamID: 0x1000000,
+			Payload: []interface{}{
+				"@setDataFrame",
+				"onMetaData",
+				flvio.AMFMap{
+					{K: "audiocodecid", V: float64(codecAAC)},
+					{K: "audiodatarate", V: float64(128)},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		enc, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_SEQHDR,
+			Payload:         enc,
+		})
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgDataAMF0{
+			ChunkStreamID:   4,
+			MessageStreamID: 0x1000000,
+			Payload: []interface{}{
+				"@setDataFrame",
+				"onMetaData",
+				flvio.AMFMap{
+					{K: "audiocodecid", V: float64(codecAAC)},
+					{K: "audiodatarate", V: float64(64)},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	var updates []flvio.AMFMap
+
+	conn := NewConn(nconn)
+	conn.SetOnMetadata(func(md flvio.AMFMap) {
+		updates = append(updates, md)
+	})
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	_, audioTrack, err := conn.ReadTracks()
+	require.NoError(t, err)
+	require.NotNil(t, audioTrack)
+
+	// the initial metadata is not reported
+	require.Equal(t, 0, len(updates))
+
+	for len(updates) == 0 {
+		_, err = conn.ReadMessage()
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []flvio.AMFMap{{
+		{K: "audiocodecid", V: float64(codecAAC)},
+		{K: "audiodatarate", V: float64(64)},
+	}}, updates)
+
+	<-done
+}
+
+func TestReadMessageMaxBitrate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		conn.SetMaxBitrate(100000, 200*time.Millisecond)
+		_, isPublishing, err := conn.InitializeServer()
+		require.NoError(t, err)
+		require.Equal(t, true, isPublishing)
+
+		for {
+			_, err = conn.ReadMessage()
+			if err != nil {
+				break
+			}
+		}
+
+		require.Contains(t, err.Error(), "exceeds the maximum (100000 bit/s)")
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, true)
+	require.NoError(t, err)
+
+	// about 800 kbit/s, until the server disconnects the client
+	for i := 0; i < 300; i++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		err = conn.WriteMessage(&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_RAW,
+			DTS:             time.Duration(i) * 10 * time.Millisecond,
+			Payload:         bytes.Repeat([]byte{0x01}, 1000),
+		})
+		if err != nil {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-done
+}
+
+// rawDataAMF0 is a AMF0 data message whose body is written as is.
+type rawDataAMF0 struct {
+	body []byte
+}
+
+func (m *rawDataAMF0) Unmarshal(*rawmessage.Message) error {
+	return fmt.Errorf("unimplemented")
+}
+
+func (m rawDataAMF0) Marshal() (*rawmessage.Message, error) {
+	return &rawmessage.Message{
+		ChunkStreamID:   4,
+		Type:            chunk.MessageTypeDataAMF0,
+		MessageStreamID: 0x1000000,
+		Body:            m.body,
+	}, nil
+}
+
+func TestReadTracksMetadataECMAArray(t *testing.T) {
+	sps := []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+
+	pps := []byte{
+		0x68, 0xee, 0x3c, 0x80,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		videoConf, err := h264conf.Conf{
+			SPS: sps,
+			PPS: pps,
+		}.Marshal()
+		require.NoError(t, err)
+
+		audioConf, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		for _, msg := range []message.Message{
+			// metadata sent by ffmpeg, as an ECMA array
+			&rawDataAMF0{
+				body: []byte{
+					0x02, 0x00, 0x0d, '@', 's', 'e', 't', 'D',
+					'a', 't', 'a', 'F', 'r', 'a', 'm', 'e',
+					0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't',
+					'a', 'D', 'a', 't', 'a',
+					0x08, 0x00, 0x00, 0x00, 0x02,
+					0x00, 0x0c, 'v', 'i', 'd', 'e', 'o', 'c',
+					'o', 'd', 'e', 'c', 'i', 'd',
+					0x00, 0x40, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+					0x00, 0x0c, 'a', 'u', 'd', 'i', 'o', 'c',
+					'o', 'd', 'e', 'c', 'i', 'd',
+					0x00, 0x40, 0x24, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+					0x00, 0x00, 0x09,
+				},
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				Payload:         videoConf,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+				Payload:         audioConf,
+			},
+		} {
+			err = conn.WriteMessage(msg)
+			require.NoError(t, err)
+		}
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	videoTrack, audioTrack, err := conn.ReadTracks()
+	require.NoError(t, err)
+
+	require.Equal(t, &format.H264{
+		PayloadTyp:        96,
+		SPS:               sps,
+		PPS:               pps,
+		PacketizationMode: 1,
+	}, videoTrack)
+
+	require.Equal(t, &format.MPEG4Audio{
+		PayloadTyp: 96,
+		Config: &mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		},
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+	}, audioTrack)
+
+	<-done
+}
+
+func TestReadTracksEmptyPayloads(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		enc, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		for _, msg := range []message.Message{
+			&message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					flvio.AMFMap{
+						{K: "audiocodecid", V: float64(codecAAC)},
+					},
+				},
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+				Payload:         enc,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_RAW,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_RAW,
+				Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+			},
+		} {
+			err = conn.WriteMessage(msg)
+			require.NoError(t, err)
+		}
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	_, audioTrack, err := conn.ReadTracks()
+	require.NoError(t, err)
+	require.NotNil(t, audioTrack)
+
+	for {
+		msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		if tmsg, ok := msg.(*message.MsgAudio); ok {
+			require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, tmsg.Payload)
+			break
+		}
+	}
+
+	<-done
+}
+
+func TestReadTracksMultitrack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		enc1, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   44100,
+			ChannelCount: 2,
+		}.Marshal()
+		require.NoError(t, err)
+
+		enc2, err := mpeg4audio.Config{
+			Type:         2,
+			SampleRate:   48000,
+			ChannelCount: 1,
+		}.Marshal()
+		require.NoError(t, err)
+
+		for _, msg := range []message.Message{
+			&message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					flvio.AMFMap{
+						{K: "audiocodecid", V: float64(codecAAC)},
+						{K: "audioTrackIdInfoMap", V: flvio.AMFMap{
+							{K: "1", V: flvio.AMFMap{}},
+						}},
+					},
+				},
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+				Payload:         enc1,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				AACType:         flvio.AAC_SEQHDR,
+				TrackID:         1,
+				Payload:         enc2,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				AACType:         flvio.AAC_RAW,
+				TrackID:         1,
+				Payload:         []byte{0x05, 0x06, 0x07, 0x08},
+			},
+		} {
+			err = conn.WriteMessage(msg)
+			require.NoError(t, err)
+		}
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	videoTrack, audioTracks, err := conn.ReadTracksMultitrack()
+	require.NoError(t, err)
+	require.Nil(t, videoTrack)
+	require.Equal(t, 2, len(audioTracks))
+	require.Equal(t, 44100, audioTracks[0].(*format.MPEG4Audio).Config.SampleRate)
+	require.Equal(t, 48000, audioTracks[1].(*format.MPEG4Audio).Config.SampleRate)
+
+	for {
+		msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		if tmsg, ok := msg.(*message.MsgAudio); ok {
+			require.Equal(t, uint8(1), tmsg.TrackID)
+			require.Equal(t, []byte{0x05, 0x06, 0x07, 0x08}, tmsg.Payload)
+			break
+		}
+	}
+
+	<-done
+}
+
+func TestTrackFromAACMetadata(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		md   flvio.AMFMap
+		conf mpeg4audio.Config
+	}{
+		{
+			"aac-lc",
+			flvio.AMFMap{
+				{K: "audiosamplerate", V: float64(44100)},
+				{K: "audiochannels", V: float64(2)},
+			},
+			mpeg4audio.Config{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   44100,
+				ChannelCount: 2,
+			},
+		},
+		{
+			"stereo flag",
+			flvio.AMFMap{
+				{K: "audiosamplerate", V: float64(48000)},
+				{K: "stereo", V: false},
+			},
+			mpeg4audio.Config{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   48000,
+				ChannelCount: 1,
+			},
+		},
+		{
+			"sbr",
+			flvio.AMFMap{
+				{K: "audiosamplerate", V: float64(48000)},
+				{K: "audiochannels", V: float64(2)},
+				{K: "aacaot", V: float64(5)},
+			},
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        2,
+				ExtensionType:       mpeg4audio.ObjectTypeSBR,
+				ExtensionSampleRate: 48000,
+			},
+		},
+		{
+			"ps",
+			flvio.AMFMap{
+				{K: "audiosamplerate", V: float64(48000)},
+				{K: "audiochannels", V: float64(2)},
+				{K: "aacaot", V: float64(29)},
+			},
+			mpeg4audio.Config{
+				Type:                mpeg4audio.ObjectTypeAACLC,
+				SampleRate:          24000,
+				ChannelCount:        1,
+				ExtensionType:       mpeg4audio.ObjectTypePS,
+				ExtensionSampleRate: 48000,
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			track, err := trackFromAACMetadata(ca.md)
+			require.NoError(t, err)
+			require.Equal(t, &ca.conf, track.Config)
+		})
+	}
+}
+
+func TestTrackFromAACMetadataErrors(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		md   flvio.AMFMap
+		err  string
+	}{
+		{
+			"missing sample rate",
+			flvio.AMFMap{
+				{K: "audiochannels", V: float64(2)},
+			},
+			"audio sample rate is missing from metadata",
+		},
+		{
+			"missing channel count",
+			flvio.AMFMap{
+				{K: "audiosamplerate", V: float64(44100)},
+			},
+			"audio channel count is missing from metadata",
+		},
+		{
+			"unsupported object type",
+			flvio.AMFMap{
+				{K: "audiosamplerate", V: float64(44100)},
+				{K: "audiochannels", V: float64(2)},
+				{K: "aacaot", V: float64(1)},
+			},
+			"unsupported AAC object type: 1",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := trackFromAACMetadata(ca.md)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestReadTracks(t *testing.T) {
+	sps := []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+
+	pps := []byte{
+		0x68, 0xee, 0x3c, 0x80,
+	}
+
+	for _, ca := range []struct {
+		name       string
+		videoTrack format.Format
+		audioTrack format.Format
+	}{
+		{
+			"video+audio",
+			&format.H264{
+				PayloadTyp:        96,
+				SPS:               sps,
+				PPS:               pps,
+				PacketizationMode: 1,
+			},
+			&format.MPEG4Audio{
+				PayloadTyp: 96,
+				Config: &mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			},
+		},
+		{
+			"video",
+			&format.H264{
+				PayloadTyp:        96,
+				SPS:               sps,
+				PPS:               pps,
+				PacketizationMode: 1,
+			},
+			nil,
+		},
+		{
+			"metadata without codec id",
+			&format.H264{
+				PayloadTyp:        96,
+				SPS:               sps,
+				PPS:               pps,
+				PacketizationMode: 1,
+			},
+			&format.MPEG4Audio{
+				PayloadTyp: 96,
+				Config: &mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			},
+		},
+		{
+			"missing metadata",
+			&format.H264{
+				PayloadTyp:        96,
+				SPS:               sps,
+				PPS:               pps,
+				PacketizationMode: 1,
+			},
+			&format.MPEG4Audio{
+				PayloadTyp: 96,
+				Config: &mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			},
+		},
+		{
+			"missing metadata inline parameters",
+			&format.H264{
+				PayloadTyp:        96,
+				SPS:               sps,
+				PPS:               pps,
+				PacketizationMode: 1,
+			},
+			&format.MPEG4Audio{
+				PayloadTyp: 96,
+				Config: &mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			},
+		},
+		{
+			"missing metadata h265",
+			&format.H265{
+				PayloadTyp: 96,
+				VPS: []byte{
+					0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
+					0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+					0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
+				},
+				SPS: []byte{
+					0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
+					0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+					0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
+					0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
+					0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
+					0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
+					0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
+					0x00, 0x04, 0xc4, 0xb4, 0x20,
+				},
+				PPS: []byte{
+					0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+				},
 			},
 			&format.MPEG4Audio{
 				PayloadTyp: 96,
@@ -528,7 +2886,7 @@ func TestReadTracks(t *testing.T) {
 			},
 		},
 		{
-			"missing metadata",
+			"audio before metadata",
 			&format.H264{
 				PayloadTyp:        96,
 				SPS:               sps,
@@ -582,6 +2940,35 @@ func TestReadTracks(t *testing.T) {
 				IndexDeltaLength: 3,
 			},
 		},
+		{
+			"aac without decoder configuration",
+			nil,
+			&format.MPEG4Audio{
+				PayloadTyp: 96,
+				Config: &mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				},
+				SizeLength:       13,
+				IndexLength:      3,
+				IndexDeltaLength: 3,
+			},
+		},
+		{
+			"ac-3",
+			nil,
+			ac3.NewFormat(96, &ac3.Config{
+				SampleRate:   48000,
+				ChannelCount: 6,
+				BlockCount:   6,
+				Bsid:         8,
+				Acmod:        7,
+				LFEOn:        true,
+				BitRateCode:  10,
+				FrameSize:    768,
+			}),
+		},
 	} {
 		t.Run(ca.name, func(t *testing.T) {
 			ln, err := net.Listen("tcp", "127.0.0.1:9121")
@@ -813,7 +3200,236 @@ func TestReadTracks(t *testing.T) {
 				})
 				require.NoError(t, err)
 
-			case "video":
+			case "video":
+				err = mrw.Write(&message.MsgDataAMF0{
+					ChunkStreamID:   4,
+					MessageStreamID: 1,
+					Payload: []interface{}{
+						"@setDataFrame",
+						"onMetaData",
+						flvio.AMFMap{
+							{
+								K: "videodatarate",
+								V: float64(0),
+							},
+							{
+								K: "videocodecid",
+								V: float64(codecH264),
+							},
+							{
+								K: "audiodatarate",
+								V: float64(0),
+							},
+							{
+								K: "audiocodecid",
+								V: float64(0),
+							},
+						},
+					},
+				})
+				require.NoError(t, err)
+
+				buf, _ := h264conf.Conf{
+					SPS: sps,
+					PPS: pps,
+				}.Marshal()
+				err = mrw.Write(&message.MsgVideo{
+					ChunkStreamID:   message.MsgVideoChunkStreamID,
+					MessageStreamID: 0x1000000,
+					IsKeyFrame:      true,
+					H264Type:        flvio.AVC_SEQHDR,
+					Payload:         buf,
+				})
+				require.NoError(t, err)
+
+			case "metadata without codec id":
+				err = mrw.Write(&message.MsgDataAMF0{
+					ChunkStreamID:   4,
+					MessageStreamID: 1,
+					Payload: []interface{}{
+						"@setDataFrame",
+						"onMetaData",
+						flvio.AMFMap{
+							{
+								K: "width",
+								V: float64(2688),
+							},
+							{
+								K: "height",
+								V: float64(1520),
+							},
+							{
+								K: "framerate",
+								V: float64(0o25),
+							},
+						},
+					},
+				})
+				require.NoError(t, err)
+
+				buf, _ := h264conf.Conf{
+					SPS: sps,
+					PPS: pps,
+				}.Marshal()
+				err = mrw.Write(&message.MsgVideo{
+					ChunkStreamID:   message.MsgVideoChunkStreamID,
+					MessageStreamID: 0x1000000,
+					IsKeyFrame:      true,
+					H264Type:        flvio.AVC_SEQHDR,
+					Payload:         buf,
+				})
+				require.NoError(t, err)
+
+				enc, err := mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				}.Marshal()
+				require.NoError(t, err)
+				err = mrw.Write(&message.MsgAudio{
+					ChunkStreamID:   message.MsgAudioChunkStreamID,
+					MessageStreamID: 0x1000000,
+					Rate:            flvio.SOUND_44Khz,
+					Depth:           flvio.SOUND_16BIT,
+					Channels:        flvio.SOUND_STEREO,
+					AACType:         flvio.AAC_SEQHDR,
+					Payload:         enc,
+				})
+				require.NoError(t, err)
+
+			case "missing metadata":
+				buf, _ := h264conf.Conf{
+					SPS: sps,
+					PPS: pps,
+				}.Marshal()
+				err = mrw.Write(&message.MsgVideo{
+					ChunkStreamID:   message.MsgVideoChunkStreamID,
+					MessageStreamID: 0x1000000,
+					IsKeyFrame:      true,
+					H264Type:        flvio.AVC_SEQHDR,
+					Payload:         buf,
+				})
+				require.NoError(t, err)
+
+				enc, err := mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				}.Marshal()
+				require.NoError(t, err)
+				err = mrw.Write(&message.MsgAudio{
+					ChunkStreamID:   message.MsgAudioChunkStreamID,
+					MessageStreamID: 0x1000000,
+					Rate:            flvio.SOUND_44Khz,
+					Depth:           flvio.SOUND_16BIT,
+					Channels:        flvio.SOUND_STEREO,
+					AACType:         flvio.AAC_SEQHDR,
+					Payload:         enc,
+				})
+				require.NoError(t, err)
+
+			case "missing metadata inline parameters":
+				// parameters are sent inside the key frame, without a decoder configuration
+				avcc, err := h264.AVCCMarshal([][]byte{
+					sps,
+					pps,
+					{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}, // IDR
+				})
+				require.NoError(t, err)
+				err = mrw.Write(&message.MsgVideo{
+					ChunkStreamID:   message.MsgVideoChunkStreamID,
+					MessageStreamID: 0x1000000,
+					IsKeyFrame:      true,
+					H264Type:        1,
+					Payload:         avcc,
+				})
+				require.NoError(t, err)
+
+				enc, err := mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				}.Marshal()
+				require.NoError(t, err)
+				err = mrw.Write(&message.MsgAudio{
+					ChunkStreamID:   message.MsgAudioChunkStreamID,
+					MessageStreamID: 0x1000000,
+					Rate:            flvio.SOUND_44Khz,
+					Depth:           flvio.SOUND_16BIT,
+					Channels:        flvio.SOUND_STEREO,
+					AACType:         flvio.AAC_SEQHDR,
+					Payload:         enc,
+				})
+				require.NoError(t, err)
+
+			case "missing metadata h265":
+				enc, err := mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				}.Marshal()
+				require.NoError(t, err)
+				err = mrw.Write(&message.MsgAudio{
+					ChunkStreamID:   message.MsgAudioChunkStreamID,
+					MessageStreamID: 0x1000000,
+					Rate:            flvio.SOUND_44Khz,
+					Depth:           flvio.SOUND_16BIT,
+					Channels:        flvio.SOUND_STEREO,
+					AACType:         flvio.AAC_SEQHDR,
+					Payload:         enc,
+				})
+				require.NoError(t, err)
+
+				avcc, err := h264.AVCCMarshal([][]byte{
+					{ // VPS
+						0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
+						0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+						0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
+					},
+					{ // SPS
+						0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
+						0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+						0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
+						0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
+						0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
+						0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
+						0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
+						0x00, 0x04, 0xc4, 0xb4, 0x20,
+					},
+					{
+						// PPS
+						0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+					},
+				})
+				require.NoError(t, err)
+
+				err = mrw.Write(&message.MsgVideo{
+					ChunkStreamID:   message.MsgVideoChunkStreamID,
+					MessageStreamID: 0x1000000,
+					IsKeyFrame:      true,
+					H264Type:        1,
+					Payload:         avcc,
+				})
+				require.NoError(t, err)
+
+			case "audio before metadata":
+				enc, err := mpeg4audio.Config{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				}.Marshal()
+				require.NoError(t, err)
+				err = mrw.Write(&message.MsgAudio{
+					ChunkStreamID:   message.MsgAudioChunkStreamID,
+					MessageStreamID: 0x1000000,
+					Rate:            flvio.SOUND_44Khz,
+					Depth:           flvio.SOUND_16BIT,
+					Channels:        flvio.SOUND_STEREO,
+					AACType:         flvio.AAC_SEQHDR,
+					Payload:         enc,
+				})
+				require.NoError(t, err)
+
 				err = mrw.Write(&message.MsgDataAMF0{
 					ChunkStreamID:   4,
 					MessageStreamID: 1,
@@ -821,21 +3437,13 @@ func TestReadTracks(t *testing.T) {
 						"@setDataFrame",
 						"onMetaData",
 						flvio.AMFMap{
-							{
-								K: "videodatarate",
-								V: float64(0),
-							},
 							{
 								K: "videocodecid",
 								V: float64(codecH264),
 							},
-							{
-								K: "audiodatarate",
-								V: float64(0),
-							},
 							{
 								K: "audiocodecid",
-								V: float64(0),
+								V: float64(codecAAC),
 							},
 						},
 					},
@@ -855,7 +3463,7 @@ func TestReadTracks(t *testing.T) {
 				})
 				require.NoError(t, err)
 
-			case "metadata without codec id":
+			case "obs studio h265":
 				err = mrw.Write(&message.MsgDataAMF0{
 					ChunkStreamID:   4,
 					MessageStreamID: 1,
@@ -864,63 +3472,65 @@ func TestReadTracks(t *testing.T) {
 						"onMetaData",
 						flvio.AMFMap{
 							{
-								K: "width",
-								V: float64(2688),
+								K: "videodatarate",
+								V: float64(0),
 							},
 							{
-								K: "height",
-								V: float64(1520),
+								K: "videocodecid",
+								V: float64(codecH264),
 							},
 							{
-								K: "framerate",
-								V: float64(0o25),
+								K: "audiodatarate",
+								V: float64(0),
+							},
+							{
+								K: "audiocodecid",
+								V: float64(codecAAC),
 							},
 						},
 					},
 				})
 				require.NoError(t, err)
 
-				buf, _ := h264conf.Conf{
-					SPS: sps,
-					PPS: pps,
-				}.Marshal()
+				// malformed key frame, that must be skipped
 				err = mrw.Write(&message.MsgVideo{
 					ChunkStreamID:   message.MsgVideoChunkStreamID,
 					MessageStreamID: 0x1000000,
 					IsKeyFrame:      true,
-					H264Type:        flvio.AVC_SEQHDR,
-					Payload:         buf,
+					H264Type:        1,
+					Payload:         []byte{0x00, 0x00, 0x00, 0x20, 0x40, 0x01, 0x0c},
 				})
 				require.NoError(t, err)
 
-				enc, err := mpeg4audio.Config{
-					Type:         2,
-					SampleRate:   44100,
-					ChannelCount: 2,
-				}.Marshal()
-				require.NoError(t, err)
-				err = mrw.Write(&message.MsgAudio{
-					ChunkStreamID:   message.MsgAudioChunkStreamID,
-					MessageStreamID: 0x1000000,
-					Rate:            flvio.SOUND_44Khz,
-					Depth:           flvio.SOUND_16BIT,
-					Channels:        flvio.SOUND_STEREO,
-					AACType:         flvio.AAC_SEQHDR,
-					Payload:         enc,
+				avcc, err := h264.AVCCMarshal([][]byte{
+					{ // VPS
+						0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
+						0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+						0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
+					},
+					{ // SPS
+						0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
+						0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+						0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
+						0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
+						0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
+						0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
+						0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
+						0x00, 0x04, 0xc4, 0xb4, 0x20,
+					},
+					{
+						// PPS
+						0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+					},
 				})
 				require.NoError(t, err)
 
-			case "missing metadata":
-				buf, _ := h264conf.Conf{
-					SPS: sps,
-					PPS: pps,
-				}.Marshal()
 				err = mrw.Write(&message.MsgVideo{
 					ChunkStreamID:   message.MsgVideoChunkStreamID,
 					MessageStreamID: 0x1000000,
 					IsKeyFrame:      true,
-					H264Type:        flvio.AVC_SEQHDR,
-					Payload:         buf,
+					H264Type:        1,
+					Payload:         avcc,
 				})
 				require.NoError(t, err)
 
@@ -941,7 +3551,7 @@ func TestReadTracks(t *testing.T) {
 				})
 				require.NoError(t, err)
 
-			case "obs studio h265":
+			case "aac without decoder configuration":
 				err = mrw.Write(&message.MsgDataAMF0{
 					ChunkStreamID:   4,
 					MessageStreamID: 1,
@@ -950,72 +3560,62 @@ func TestReadTracks(t *testing.T) {
 						"onMetaData",
 						flvio.AMFMap{
 							{
-								K: "videodatarate",
-								V: float64(0),
-							},
-							{
-								K: "videocodecid",
-								V: float64(codecH264),
+								K: "audiocodecid",
+								V: float64(codecAAC),
 							},
 							{
-								K: "audiodatarate",
-								V: float64(0),
+								K: "audiosamplerate",
+								V: float64(44100),
 							},
 							{
-								K: "audiocodecid",
-								V: float64(codecAAC),
+								K: "audiochannels",
+								V: float64(2),
 							},
 						},
 					},
 				})
 				require.NoError(t, err)
 
-				avcc, err := h264.AVCCMarshal([][]byte{
-					{ // VPS
-						0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
-						0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
-						0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
-					},
-					{ // SPS
-						0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
-						0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
-						0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
-						0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
-						0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
-						0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
-						0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
-						0x00, 0x04, 0xc4, 0xb4, 0x20,
-					},
-					{
-						// PPS
-						0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+				for _, dts := range []time.Duration{0, 500 * time.Millisecond, 1 * time.Second} {
+					err = mrw.Write(&message.MsgAudio{
+						ChunkStreamID:   message.MsgAudioChunkStreamID,
+						MessageStreamID: 0x1000000,
+						Rate:            flvio.SOUND_44Khz,
+						Depth:           flvio.SOUND_16BIT,
+						Channels:        flvio.SOUND_STEREO,
+						AACType:         flvio.AAC_RAW,
+						DTS:             dts,
+						Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+					})
+					require.NoError(t, err)
+				}
+
+			case "ac-3":
+				err = mrw.Write(&message.MsgDataAMF0{
+					ChunkStreamID:   4,
+					MessageStreamID: 1,
+					Payload: []interface{}{
+						"@setDataFrame",
+						"onMetaData",
+						flvio.AMFMap{
+							{
+								K: "audiocodecid",
+								V: "ac-3",
+							},
+						},
 					},
 				})
 				require.NoError(t, err)
 
-				err = mrw.Write(&message.MsgVideo{
-					ChunkStreamID:   message.MsgVideoChunkStreamID,
-					MessageStreamID: 0x1000000,
-					IsKeyFrame:      true,
-					H264Type:        1,
-					Payload:         avcc,
-				})
-				require.NoError(t, err)
+				frame := make([]byte, 768)
+				copy(frame, []byte{0x0b, 0x77, 0x00, 0x00, 0x14, 0x40, 0xe1})
 
-				enc, err := mpeg4audio.Config{
-					Type:         2,
-					SampleRate:   44100,
-					ChannelCount: 2,
-				}.Marshal()
-				require.NoError(t, err)
 				err = mrw.Write(&message.MsgAudio{
 					ChunkStreamID:   message.MsgAudioChunkStreamID,
 					MessageStreamID: 0x1000000,
-					Rate:            flvio.SOUND_44Khz,
-					Depth:           flvio.SOUND_16BIT,
-					Channels:        flvio.SOUND_STEREO,
-					AACType:         flvio.AAC_SEQHDR,
-					Payload:         enc,
+					FourCC:          message.FourCCAC3,
+					AACType:         flvio.AAC_RAW,
+					Payload:         frame,
 				})
 				require.NoError(t, err)
 			}
@@ -1179,6 +3779,22 @@ func TestWriteTracks(t *testing.T) {
 	})
 	require.NoError(t, err)
 
+	msg, err = mrw.Read()
+	require.NoError(t, err)
+	require.Equal(t, &message.MsgCommandAMF0{
+		ChunkStreamID: 8,
+		Name:          "_error",
+		CommandID:     3,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "error"},
+				{K: "code", V: "NetConnection.Call.Failed"},
+				{K: "description", V: "unsupported command: getStreamLength"},
+			},
+		},
+	}, msg)
+
 	err = mrw.Write(&message.MsgCommandAMF0{
 		ChunkStreamID:   8,
 		MessageStreamID: 0x1000000,
@@ -1281,10 +3897,14 @@ func TestWriteTracks(t *testing.T) {
 			"@setDataFrame",
 			"onMetaData",
 			flvio.AMFMap{
-				{K: "videodatarate", V: float64(0)},
 				{K: "videocodecid", V: float64(7)},
-				{K: "audiodatarate", V: float64(0)},
+				{K: "width", V: float64(352)},
+				{K: "height", V: float64(288)},
+				{K: "framerate", V: float64(15)},
 				{K: "audiocodecid", V: float64(10)},
+				{K: "audiosamplerate", V: float64(44100)},
+				{K: "audiochannels", V: float64(2)},
+				{K: "stereo", V: true},
 			},
 		},
 	}, msg)
@@ -1319,6 +3939,135 @@ func TestWriteTracks(t *testing.T) {
 	}, msg)
 }
 
+func TestWriteTracksAudioOnly(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		// the video track of the stream is passed as a typed nil,
+		// like the server does when a stream has no H264 track.
+		var videoTrack *format.H264
+
+		audioTrack := &format.MPEG4Audio{
+			PayloadTyp: 96,
+			Config: &mpeg4audio.Config{
+				Type:         2,
+				SampleRate:   44100,
+				ChannelCount: 2,
+			},
+			SizeLength:       13,
+			IndexLength:      3,
+			IndexDeltaLength: 3,
+		}
+
+		err = conn.WriteTracks(videoTrack, audioTrack)
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_RAW,
+			Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+			DTS:             20 * time.Millisecond,
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	var statusCodes []string
+
+	for _, expected := range []message.Message{
+		&message.MsgDataAMF0{
+			ChunkStreamID:   4,
+			MessageStreamID: 0x1000000,
+			Payload: []interface{}{
+				"@setDataFrame",
+				"onMetaData",
+				flvio.AMFMap{
+					{K: "videocodecid", V: float64(0)},
+					{K: "audiocodecid", V: float64(10)},
+					{K: "audiosamplerate", V: float64(44100)},
+					{K: "audiochannels", V: float64(2)},
+					{K: "stereo", V: true},
+				},
+			},
+		},
+		// no video decoder configuration is sent.
+		&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_SEQHDR,
+			Payload:         []byte{0x12, 0x10},
+		},
+		&message.MsgAudio{
+			ChunkStreamID:   message.MsgAudioChunkStreamID,
+			MessageStreamID: 0x1000000,
+			Rate:            flvio.SOUND_44Khz,
+			Depth:           flvio.SOUND_16BIT,
+			Channels:        flvio.SOUND_STEREO,
+			AACType:         flvio.AAC_RAW,
+			Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+			DTS:             20 * time.Millisecond,
+		},
+	} {
+		var msg message.Message
+
+		for {
+			msg, err = conn.ReadMessage()
+			require.NoError(t, err)
+
+			cmd, ok := msg.(*message.MsgCommandAMF0)
+			if !ok || cmd.Name != "onStatus" {
+				break
+			}
+
+			code, _ := cmd.Arguments[1].(flvio.AMFMap).GetString("code")
+			statusCodes = append(statusCodes, code)
+		}
+
+		require.Equal(t, expected, msg)
+	}
+
+	// the play onStatus sequence is sent even without a video track.
+	// NetStream.Play.Reset is consumed by InitializeClient().
+	require.Equal(t, []string{
+		"NetStream.Play.Start",
+		"NetStream.Data.Start",
+		"NetStream.Play.PublishNotify",
+	}, statusCodes)
+
+	<-done
+}
+
 func BenchmarkRead(b *testing.B) {
 	var buf bytes.Buffer
 
@@ -1347,3 +4096,95 @@ func BenchmarkRead(b *testing.B) {
 		conn.ReadMessage()
 	}
 }
+
+func TestWriteTracksH265(t *testing.T) {
+	videoTrack := &format.H265{
+		PayloadTyp: 96,
+		VPS: []byte{
+			0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
+			0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+			0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
+		},
+		SPS: []byte{
+			0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
+			0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+			0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
+			0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
+			0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
+			0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
+			0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
+			0x00, 0x04, 0xc4, 0xb4, 0x20,
+		},
+		PPS: []byte{
+			0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		err = conn.WriteTracks(videoTrack, nil)
+		require.NoError(t, err)
+
+		err = conn.WriteMessage(&message.MsgVideo{
+			ChunkStreamID:   message.MsgVideoChunkStreamID,
+			MessageStreamID: 0x1000000,
+			IsKeyFrame:      true,
+			FourCC:          message.FourCCHEVC,
+			H264Type:        flvio.AVC_NALU,
+			Payload:         []byte{0x00, 0x00, 0x00, 0x02, 0x26, 0x01},
+		})
+		require.NoError(t, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	videoTrack2, audioTrack2, err := conn.ReadTracks()
+	require.NoError(t, err)
+	require.Equal(t, videoTrack, videoTrack2)
+	require.Nil(t, audioTrack2)
+
+	for {
+		msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		if tmsg, ok := msg.(*message.MsgVideo); ok {
+			require.Equal(t, uint32(message.FourCCHEVC), tmsg.FourCC)
+			require.Equal(t, []byte{0x00, 0x00, 0x00, 0x02, 0x26, 0x01}, tmsg.Payload)
+			break
+		}
+	}
+
+	<-done
+}
+
+func TestWriteTracksUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	conn := NewConn(&buf)
+
+	err := conn.WriteTracks(&format.VP8{}, nil)
+	require.EqualError(t, err, "unsupported video track: *format.VP8")
+}
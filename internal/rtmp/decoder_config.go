@@ -0,0 +1,44 @@
+package rtmp
+
+import (
+	"fmt"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h265conf"
+)
+
+// H264DecoderConfig returns the AVC decoder configuration record (avcC) of a H264 track.
+// It's the same payload that is written into RTMP sequence headers,
+// therefore it can be used to write MP4 files that are consistent with the RTMP stream.
+func H264DecoderConfig(track *format.H264) ([]byte, error) {
+	sps := track.SafeSPS()
+	pps := track.SafePPS()
+	if sps == nil || pps == nil {
+		return nil, fmt.Errorf("SPS or PPS not available")
+	}
+
+	return h264conf.Conf{
+		SPS: sps,
+		PPS: pps,
+	}.Marshal()
+}
+
+// H265DecoderConfig returns the HEVC decoder configuration record (hvcC) of a H265 track.
+// It's the same payload that is written into RTMP sequence headers,
+// therefore it can be used to write MP4 files that are consistent with the RTMP stream.
+func H265DecoderConfig(track *format.H265) ([]byte, error) {
+	vps := track.SafeVPS()
+	sps := track.SafeSPS()
+	pps := track.SafePPS()
+	if vps == nil || sps == nil || pps == nil {
+		return nil, fmt.Errorf("VPS, SPS or PPS not available")
+	}
+
+	return h265conf.Conf{
+		VPS: vps,
+		SPS: sps,
+		PPS: pps,
+	}.Marshal()
+}
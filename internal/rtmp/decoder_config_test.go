@@ -0,0 +1,77 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h265conf"
+)
+
+func TestH264DecoderConfig(t *testing.T) {
+	track := &format.H264{
+		PayloadTyp: 96,
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS: []byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+		PacketizationMode: 1,
+	}
+
+	buf, err := H264DecoderConfig(track)
+	require.NoError(t, err)
+
+	var conf h264conf.Conf
+	err = conf.Unmarshal(buf)
+	require.NoError(t, err)
+	require.Equal(t, h264conf.Conf{
+		SPS: track.SPS,
+		PPS: track.PPS,
+	}, conf)
+
+	_, err = H264DecoderConfig(&format.H264{PayloadTyp: 96})
+	require.EqualError(t, err, "SPS or PPS not available")
+}
+
+func TestH265DecoderConfig(t *testing.T) {
+	track := &format.H265{
+		PayloadTyp: 96,
+		VPS: []byte{
+			0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x40,
+			0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+			0x03, 0x00, 0x00, 0x03, 0x00, 0x7b, 0xac, 0x09,
+		},
+		SPS: []byte{
+			0x42, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00, 0x03,
+			0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x00,
+			0x03, 0x00, 0x7b, 0xa0, 0x03, 0xc0, 0x80, 0x11,
+			0x07, 0xcb, 0x96, 0xb4, 0xa4, 0x25, 0x92, 0xe3,
+			0x01, 0x6a, 0x02, 0x02, 0x02, 0x08, 0x00, 0x00,
+			0x03, 0x00, 0x08, 0x00, 0x00, 0x03, 0x01, 0xe3,
+			0x00, 0x2e, 0xf2, 0x88, 0x00, 0x09, 0x89, 0x60,
+			0x00, 0x04, 0xc4, 0xb4, 0x20,
+		},
+		PPS: []byte{
+			0x44, 0x01, 0xc0, 0xf7, 0xc0, 0xcc, 0x90,
+		},
+	}
+
+	buf, err := H265DecoderConfig(track)
+	require.NoError(t, err)
+
+	var conf h265conf.Conf
+	err = conf.Unmarshal(buf)
+	require.NoError(t, err)
+	require.Equal(t, track.VPS, conf.VPS)
+	require.Equal(t, track.SPS, conf.SPS)
+	require.Equal(t, track.PPS, conf.PPS)
+
+	_, err = H265DecoderConfig(&format.H265{PayloadTyp: 96})
+	require.EqualError(t, err, "VPS, SPS or PPS not available")
+}
@@ -0,0 +1,145 @@
+// Package h265conf contains a H265 configuration parser.
+package h265conf
+
+import (
+	"fmt"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h265"
+)
+
+// Conf is a RTMP H265 configuration (HEVCDecoderConfigurationRecord).
+type Conf struct {
+	VPS []byte
+	SPS []byte
+	PPS []byte
+}
+
+// Unmarshal decodes a Conf from bytes.
+func (c *Conf) Unmarshal(buf []byte) error {
+	if len(buf) < 23 {
+		return fmt.Errorf("invalid size 1")
+	}
+
+	c.VPS = nil
+	c.SPS = nil
+	c.PPS = nil
+
+	arrayCount := int(buf[22])
+	pos := 23
+
+	for i := 0; i < arrayCount; i++ {
+		if (len(buf) - pos) < 3 {
+			return fmt.Errorf("invalid size 2")
+		}
+
+		typ := h265.NALUType(buf[pos] & 0x3F)
+		naluCount := int(uint16(buf[pos+1])<<8 | uint16(buf[pos+2]))
+		pos += 3
+
+		for j := 0; j < naluCount; j++ {
+			if (len(buf) - pos) < 2 {
+				return fmt.Errorf("invalid size 3")
+			}
+
+			naluLen := int(uint16(buf[pos])<<8 | uint16(buf[pos+1]))
+			pos += 2
+			if (len(buf) - pos) < naluLen {
+				return fmt.Errorf("invalid size 4")
+			}
+
+			nalu := buf[pos : pos+naluLen]
+			pos += naluLen
+
+			switch typ {
+			case h265.NALUType_VPS_NUT:
+				if c.VPS == nil {
+					c.VPS = nalu
+				}
+
+			case h265.NALUType_SPS_NUT:
+				if c.SPS == nil {
+					c.SPS = nalu
+				}
+
+			case h265.NALUType_PPS_NUT:
+				if c.PPS == nil {
+					c.PPS = nalu
+				}
+			}
+		}
+	}
+
+	if c.VPS == nil || c.SPS == nil || c.PPS == nil {
+		return fmt.Errorf("VPS, SPS or PPS not found")
+	}
+
+	return nil
+}
+
+// Marshal encodes a Conf into bytes.
+func (c Conf) Marshal() ([]byte, error) {
+	// profile_tier_level is read directly from the SPS,
+	// after the NALU header and the first byte.
+	sps := h264.EmulationPreventionRemove(c.SPS)
+	if len(sps) < 15 {
+		return nil, fmt.Errorf("invalid SPS")
+	}
+
+	// chroma format and bit depth are read from the SPS when possible,
+	// otherwise 4:2:0 and 8 bits are assumed.
+	chromaFormat := uint32(1)
+	bitDepthLumaMinus8 := uint32(0)
+	bitDepthChromaMinus8 := uint32(0)
+	var spsp h265.SPS
+	if err := spsp.Unmarshal(c.SPS); err == nil {
+		chromaFormat = spsp.ChromaFormatIdc
+		bitDepthLumaMinus8 = spsp.BitDepthLumaMinus8
+		bitDepthChromaMinus8 = spsp.BitDepthChromaMinus8
+	}
+
+	maxSubLayersMinus1 := (sps[2] >> 1) & 0x07
+	temporalIDNesting := sps[2] & 0x01
+
+	vpsLen := len(c.VPS)
+	spsLen := len(c.SPS)
+	ppsLen := len(c.PPS)
+
+	buf := make([]byte, 23+3*5+vpsLen+spsLen+ppsLen)
+
+	buf[0] = 1
+	copy(buf[1:13], sps[3:15])
+	buf[13] = 0xF0
+	buf[14] = 0
+	buf[15] = 0xFC
+	buf[16] = 0xFC | byte(chromaFormat&0x03)
+	buf[17] = 0xF8 | byte(bitDepthLumaMinus8&0x07)
+	buf[18] = 0xF8 | byte(bitDepthChromaMinus8&0x07)
+	buf[19] = 0
+	buf[20] = 0
+	buf[21] = (maxSubLayersMinus1+1)<<3 | temporalIDNesting<<2 | 3
+	buf[22] = 3
+	pos := 23
+
+	for _, entry := range []struct {
+		typ  h265.NALUType
+		nalu []byte
+	}{
+		{h265.NALUType_VPS_NUT, c.VPS},
+		{h265.NALUType_SPS_NUT, c.SPS},
+		{h265.NALUType_PPS_NUT, c.PPS},
+	} {
+		buf[pos] = 0x80 | byte(entry.typ)
+		buf[pos+1] = 0
+		buf[pos+2] = 1
+		pos += 3
+
+		buf[pos] = byte(len(entry.nalu) >> 8)
+		buf[pos+1] = byte(len(entry.nalu))
+		pos += 2
+
+		pos += copy(buf[pos:], entry.nalu)
+	}
+
+	return buf, nil
+}
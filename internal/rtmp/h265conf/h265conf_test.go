@@ -0,0 +1,40 @@
+package h265conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var decoded = Conf{
+	VPS: []byte{0x40, 0x01, 0x0c},
+	SPS: []byte{
+		0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00,
+		0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5d,
+	},
+	PPS: []byte{0x44, 0x01, 0xc1},
+}
+
+var encoded = []byte{
+	0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x5d, 0xf0, 0x00, 0xfc,
+	0xfd, 0xf8, 0xf8, 0x00, 0x00, 0x0f, 0x03,
+	0xa0, 0x00, 0x01, 0x00, 0x03, 0x40, 0x01, 0x0c,
+	0xa1, 0x00, 0x01, 0x00, 0x0f,
+	0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00,
+	0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5d,
+	0xa2, 0x00, 0x01, 0x00, 0x03, 0x44, 0x01, 0xc1,
+}
+
+func TestUnmarshal(t *testing.T) {
+	var dec Conf
+	err := dec.Unmarshal(encoded)
+	require.NoError(t, err)
+	require.Equal(t, decoded, dec)
+}
+
+func TestMarshal(t *testing.T) {
+	enc, err := decoded.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, encoded, enc)
+}
@@ -15,6 +15,22 @@ const (
 	MsgAudioChunkStreamID = 6
 )
 
+// audio codecs of the enhanced RTMP specification, identified by FourCC.
+const (
+	FourCCAC3  = 'a'<<24 | 'c'<<16 | '-'<<8 | '3'
+	FourCCEAC3 = 'e'<<24 | 'c'<<16 | '-'<<8 | '3'
+	FourCCAAC  = 'm'<<24 | 'p'<<16 | '4'<<8 | 'a'
+)
+
+// sound format that introduces an enhanced RTMP header.
+const soundFormatExHeader = 9
+
+// audio packet type that introduces an enhanced RTMP multitrack header.
+const audioPacketTypeMultitrack = 5
+
+// enhanced RTMP multitrack type in which a message contains a single track.
+const audioMultitrackTypeOneTrack = 0
+
 // MsgAudio is an audio message.
 type MsgAudio struct {
 	ChunkStreamID   byte
@@ -23,8 +39,69 @@ type MsgAudio struct {
 	Rate            uint8
 	Depth           uint8
 	Channels        uint8
-	AACType         uint8
-	Payload         []byte
+
+	// FourCC of the codec, in case of enhanced RTMP audio.
+	// When zero, the codec is AAC.
+	FourCC uint32
+
+	// AAC packet type, or audio packet type in case of enhanced RTMP audio
+	// (0 = sequence start, 1 = coded frames).
+	AACType uint8
+
+	// ID of the track, in case of enhanced RTMP multitrack audio.
+	// Track 0 is the main track, and is the only one of streams without multitrack audio.
+	TrackID uint8
+
+	Payload []byte
+}
+
+func (m *MsgAudio) unmarshalExHeader(body []byte) error {
+	m.AACType = body[0] & 0x0F
+	body = body[1:]
+
+	multitrack := false
+
+	if m.AACType == audioPacketTypeMultitrack {
+		multitrackType := body[0] >> 4
+		if multitrackType != audioMultitrackTypeOneTrack {
+			return fmt.Errorf("unsupported audio multitrack type: %d", multitrackType)
+		}
+
+		m.AACType = body[0] & 0x0F
+		body = body[1:]
+		multitrack = true
+	}
+
+	if len(body) < 4 {
+		return fmt.Errorf("invalid body size")
+	}
+
+	m.FourCC = uint32(body[0])<<24 | uint32(body[1])<<16 | uint32(body[2])<<8 | uint32(body[3])
+
+	switch m.FourCC {
+	case FourCCAC3, FourCCEAC3:
+
+	case FourCCAAC:
+		// AAC is represented in the same way of legacy RTMP audio
+		m.FourCC = 0
+
+	default:
+		return fmt.Errorf("unsupported audio codec: %s", string(body[0:4]))
+	}
+
+	body = body[4:]
+
+	if multitrack {
+		if len(body) < 1 {
+			return fmt.Errorf("invalid body size")
+		}
+
+		m.TrackID = body[0]
+		body = body[1:]
+	}
+
+	m.Payload = body
+	return nil
 }
 
 // Unmarshal implements Message.
@@ -38,6 +115,13 @@ func (m *MsgAudio) Unmarshal(raw *rawmessage.Message) error {
 	}
 
 	codec := raw.Body[0] >> 4
+
+	if codec == soundFormatExHeader {
+		return m.unmarshalExHeader(raw.Body)
+	}
+
+	// the second byte is the AAC packet type only when the sound format is AAC,
+	// therefore other formats are rejected before interpreting it.
 	if codec != flvio.SOUND_AAC {
 		return fmt.Errorf("unsupported audio codec: %d", codec)
 	}
@@ -51,8 +135,59 @@ func (m *MsgAudio) Unmarshal(raw *rawmessage.Message) error {
 	return nil
 }
 
+func (m MsgAudio) marshalMultitrack() (*rawmessage.Message, error) {
+	fourCC := m.FourCC
+	if fourCC == 0 {
+		fourCC = FourCCAAC
+	}
+
+	body := make([]byte, 7+len(m.Payload))
+
+	body[0] = soundFormatExHeader<<4 | audioPacketTypeMultitrack
+	body[1] = audioMultitrackTypeOneTrack<<4 | m.AACType
+	body[2] = byte(fourCC >> 24)
+	body[3] = byte(fourCC >> 16)
+	body[4] = byte(fourCC >> 8)
+	body[5] = byte(fourCC)
+	body[6] = m.TrackID
+
+	copy(body[7:], m.Payload)
+
+	return &rawmessage.Message{
+		ChunkStreamID:   m.ChunkStreamID,
+		Timestamp:       m.DTS,
+		Type:            chunk.MessageTypeAudio,
+		MessageStreamID: m.MessageStreamID,
+		Body:            body,
+	}, nil
+}
+
 // Marshal implements Message.
 func (m MsgAudio) Marshal() (*rawmessage.Message, error) {
+	if m.TrackID != 0 {
+		return m.marshalMultitrack()
+	}
+
+	if m.FourCC != 0 {
+		body := make([]byte, 5+len(m.Payload))
+
+		body[0] = soundFormatExHeader<<4 | m.AACType
+		body[1] = byte(m.FourCC >> 24)
+		body[2] = byte(m.FourCC >> 16)
+		body[3] = byte(m.FourCC >> 8)
+		body[4] = byte(m.FourCC)
+
+		copy(body[5:], m.Payload)
+
+		return &rawmessage.Message{
+			ChunkStreamID:   m.ChunkStreamID,
+			Timestamp:       m.DTS,
+			Type:            chunk.MessageTypeAudio,
+			MessageStreamID: m.MessageStreamID,
+			Body:            body,
+		}, nil
+	}
+
 	body := make([]byte, 2+len(m.Payload))
 
 	body[0] = flvio.SOUND_AAC<<4 | m.Rate<<2 | m.Depth<<1 | m.Channels
@@ -0,0 +1,58 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/chunk"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/rawmessage"
+)
+
+// MsgCommandAMF3 is a AMF3 command message.
+// Only the AMF0 encoding inside the AMF3 envelope is supported,
+// that is the one used by clients that negotiate objectEncoding 3.
+type MsgCommandAMF3 struct {
+	ChunkStreamID   byte
+	MessageStreamID uint32
+	Name            string
+	CommandID       int
+	Arguments       []interface{}
+}
+
+// Unmarshal implements Message.
+func (m *MsgCommandAMF3) Unmarshal(raw *rawmessage.Message) error {
+	if len(raw.Body) < 1 {
+		return fmt.Errorf("invalid body size")
+	}
+
+	// the first byte of the envelope is the encoding of the command
+	if raw.Body[0] != 0 {
+		return fmt.Errorf("unsupported AMF3 command encoding (%d)", raw.Body[0])
+	}
+
+	var cmd MsgCommandAMF0
+	err := cmd.Unmarshal(&rawmessage.Message{
+		ChunkStreamID:   raw.ChunkStreamID,
+		Type:            chunk.MessageTypeCommandAMF0,
+		MessageStreamID: raw.MessageStreamID,
+		Body:            raw.Body[1:],
+	})
+	if err != nil {
+		return err
+	}
+
+	*m = MsgCommandAMF3(cmd)
+	return nil
+}
+
+// Marshal implements Message.
+func (m MsgCommandAMF3) Marshal() (*rawmessage.Message, error) {
+	raw, err := MsgCommandAMF0(m).Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	raw.Type = chunk.MessageTypeCommandAMF3
+	raw.Body = append([]byte{0}, raw.Body...)
+
+	return raw, nil
+}
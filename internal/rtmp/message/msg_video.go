@@ -15,15 +15,40 @@ const (
 	MsgVideoChunkStreamID = 6
 )
 
+// video codecs of the enhanced RTMP specification, identified by FourCC.
+const (
+	FourCCHEVC = 'h'<<24 | 'v'<<16 | 'c'<<8 | '1'
+)
+
+// video packet types of the enhanced RTMP specification.
+const (
+	videoPacketTypeCodedFrames = 1
+)
+
+// VideoPacketTypeCodedFramesX is the video packet type of the enhanced RTMP specification
+// that contains coded frames without a composition time, since their PTS is equal to their DTS.
+const VideoPacketTypeCodedFramesX = 3
+
+// bit of the first byte that introduces an enhanced RTMP header.
+const videoExHeaderFlag = 0x80
+
 // MsgVideo is a video message.
 type MsgVideo struct {
 	ChunkStreamID   byte
 	DTS             time.Duration
 	MessageStreamID uint32
 	IsKeyFrame      bool
-	H264Type        uint8
-	PTSDelta        time.Duration
-	Payload         []byte
+
+	// FourCC of the codec, in case of enhanced RTMP video.
+	// When zero, the codec is H264.
+	FourCC uint32
+
+	// AVC packet type, or video packet type in case of enhanced RTMP video
+	// (0 = sequence start, 1 = coded frames, 2 = sequence end, 3 = coded frames without composition time).
+	H264Type uint8
+
+	PTSDelta time.Duration
+	Payload  []byte
 }
 
 // Unmarshal implements Message.
@@ -36,6 +61,32 @@ func (m *MsgVideo) Unmarshal(raw *rawmessage.Message) error {
 		return fmt.Errorf("invalid body size")
 	}
 
+	if (raw.Body[0] & videoExHeaderFlag) != 0 {
+		m.IsKeyFrame = ((raw.Body[0] >> 4) & 0x07) == flvio.FRAME_KEY
+		m.H264Type = raw.Body[0] & 0x0F
+		m.FourCC = uint32(raw.Body[1])<<24 | uint32(raw.Body[2])<<16 | uint32(raw.Body[3])<<8 | uint32(raw.Body[4])
+
+		if m.FourCC != FourCCHEVC {
+			return fmt.Errorf("unsupported video codec: %s", string(raw.Body[1:5]))
+		}
+
+		// only coded frames contain a composition time
+		if m.H264Type == videoPacketTypeCodedFrames {
+			if len(raw.Body) < 8 {
+				return fmt.Errorf("invalid body size")
+			}
+
+			tmp := uint32(raw.Body[5])<<16 | uint32(raw.Body[6])<<8 | uint32(raw.Body[7])
+			m.PTSDelta = time.Duration(tmp) * time.Millisecond
+
+			m.Payload = raw.Body[8:]
+			return nil
+		}
+
+		m.Payload = raw.Body[5:]
+		return nil
+	}
+
 	m.IsKeyFrame = (raw.Body[0] >> 4) == flvio.FRAME_KEY
 
 	codec := raw.Body[0] & 0x0F
@@ -55,6 +106,43 @@ func (m *MsgVideo) Unmarshal(raw *rawmessage.Message) error {
 
 // Marshal implements Message.
 func (m MsgVideo) Marshal() (*rawmessage.Message, error) {
+	if m.FourCC != 0 {
+		headerLen := 5
+		if m.H264Type == videoPacketTypeCodedFrames {
+			headerLen = 8
+		}
+
+		body := make([]byte, headerLen+len(m.Payload))
+
+		if m.IsKeyFrame {
+			body[0] = videoExHeaderFlag | flvio.FRAME_KEY<<4
+		} else {
+			body[0] = videoExHeaderFlag | flvio.FRAME_INTER<<4
+		}
+		body[0] |= m.H264Type
+		body[1] = byte(m.FourCC >> 24)
+		body[2] = byte(m.FourCC >> 16)
+		body[3] = byte(m.FourCC >> 8)
+		body[4] = byte(m.FourCC)
+
+		if m.H264Type == videoPacketTypeCodedFrames {
+			tmp := uint32(m.PTSDelta / time.Millisecond)
+			body[5] = uint8(tmp >> 16)
+			body[6] = uint8(tmp >> 8)
+			body[7] = uint8(tmp)
+		}
+
+		copy(body[headerLen:], m.Payload)
+
+		return &rawmessage.Message{
+			ChunkStreamID:   m.ChunkStreamID,
+			Timestamp:       m.DTS,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: m.MessageStreamID,
+			Body:            body,
+		}, nil
+	}
+
 	body := make([]byte, 5+len(m.Payload))
 
 	if m.IsKeyFrame {
@@ -57,6 +57,9 @@ func allocateMessage(raw *rawmessage.Message) (Message, error) {
 	case chunk.MessageTypeCommandAMF0:
 		return &MsgCommandAMF0{}, nil
 
+	case chunk.MessageTypeCommandAMF3:
+		return &MsgCommandAMF3{}, nil
+
 	case chunk.MessageTypeDataAMF0:
 		return &MsgDataAMF0{}, nil
 
@@ -84,12 +87,32 @@ func NewReader(r *bytecounter.Reader, onAckNeeded func(uint32) error) *Reader {
 }
 
 // Read reads a Message.
+// Zero-length video and audio messages are skipped.
 func (r *Reader) Read() (Message, error) {
-	raw, err := r.r.Read()
-	if err != nil {
-		return nil, err
+	for {
+		raw, err := r.r.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		// zero-length media messages are used by some tools as stream markers.
+		// They don't even contain the media header, therefore they can't be decoded.
+		if (raw.Type == chunk.MessageTypeVideo || raw.Type == chunk.MessageTypeAudio) &&
+			len(raw.Body) == 0 {
+			continue
+		}
+
+		return r.decode(raw)
 	}
+}
+
+// SetExtendedTimestampMode sets the convention used to read extended timestamps
+// of type 3 chunks.
+func (r *Reader) SetExtendedTimestampMode(v rawmessage.ExtendedTimestampMode) {
+	r.r.SetExtendedTimestampMode(v)
+}
 
+func (r *Reader) decode(raw *rawmessage.Message) (Message, error) {
 	msg, err := allocateMessage(raw)
 	if err != nil {
 		return nil, err
@@ -44,6 +44,55 @@ var readWriterCases = []struct {
 			0x77, 0x40,
 		},
 	},
+	{
+		"audio enhanced",
+		&MsgAudio{
+			ChunkStreamID:   7,
+			DTS:             6013806 * time.Millisecond,
+			MessageStreamID: 4534543,
+			FourCC:          FourCCAC3,
+			AACType:         1,
+			Payload:         []byte{0x0b, 0x77, 0x40, 0x5a},
+		},
+		[]byte{
+			0x7, 0x5b, 0xc3, 0x6e, 0x0, 0x0, 0x9, 0x8,
+			0x0, 0x45, 0x31, 0xf, 0x91, 0x61, 0x63, 0x2d,
+			0x33, 0x0b, 0x77, 0x40, 0x5a,
+		},
+	},
+	{
+		"audio multitrack",
+		&MsgAudio{
+			ChunkStreamID:   7,
+			DTS:             6013806 * time.Millisecond,
+			MessageStreamID: 4534543,
+			FourCC:          FourCCAC3,
+			AACType:         1,
+			TrackID:         1,
+			Payload:         []byte{0x0b, 0x77, 0x40, 0x5a},
+		},
+		[]byte{
+			0x7, 0x5b, 0xc3, 0x6e, 0x0, 0x0, 0xb, 0x8,
+			0x0, 0x45, 0x31, 0xf, 0x95, 0x01, 0x61, 0x63,
+			0x2d, 0x33, 0x01, 0x0b, 0x77, 0x40, 0x5a,
+		},
+	},
+	{
+		"audio multitrack aac",
+		&MsgAudio{
+			ChunkStreamID:   7,
+			DTS:             6013806 * time.Millisecond,
+			MessageStreamID: 4534543,
+			AACType:         flvio.AAC_RAW,
+			TrackID:         2,
+			Payload:         []byte{0x5A, 0xC0, 0x77, 0x40},
+		},
+		[]byte{
+			0x7, 0x5b, 0xc3, 0x6e, 0x0, 0x0, 0xb, 0x8,
+			0x0, 0x45, 0x31, 0xf, 0x95, 0x01, 0x6d, 0x70,
+			0x34, 0x61, 0x02, 0x5a, 0xc0, 0x77, 0x40,
+		},
+	},
 	{
 		"command amf0",
 		&MsgCommandAMF0{
@@ -70,6 +119,32 @@ var readWriterCases = []struct {
 			0x0, 0x9, 0x5,
 		},
 	},
+	{
+		"command amf3",
+		&MsgCommandAMF3{
+			ChunkStreamID:   3,
+			MessageStreamID: 345243,
+			Name:            "i8yythrergre",
+			CommandID:       56456,
+			Arguments: []interface{}{
+				flvio.AMFMap{
+					{K: "k1", V: "v1"},
+					{K: "k2", V: "v2"},
+				},
+				nil,
+			},
+		},
+		[]byte{
+			0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x30, 0x11,
+			0x0, 0x5, 0x44, 0x9b, 0x0, 0x2, 0x0, 0xc,
+			0x69, 0x38, 0x79, 0x79, 0x74, 0x68, 0x72, 0x65,
+			0x72, 0x67, 0x72, 0x65, 0x0, 0x40, 0xeb, 0x91,
+			0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x2,
+			0x6b, 0x31, 0x2, 0x0, 0x2, 0x76, 0x31, 0x0,
+			0x2, 0x6b, 0x32, 0x2, 0x0, 0x2, 0x76, 0x32,
+			0x0, 0x0, 0x9, 0x5,
+		},
+	},
 	{
 		"data amf0",
 		&MsgDataAMF0{
@@ -213,6 +288,24 @@ var readWriterCases = []struct {
 			0xa, 0x1, 0x2, 0x3,
 		},
 	},
+	{
+		"video enhanced",
+		&MsgVideo{
+			ChunkStreamID:   6,
+			DTS:             2543534 * time.Millisecond,
+			MessageStreamID: 0x1000000,
+			IsKeyFrame:      true,
+			FourCC:          FourCCHEVC,
+			H264Type:        1,
+			PTSDelta:        10 * time.Millisecond,
+			Payload:         []byte{0x01, 0x02, 0x03},
+		},
+		[]byte{
+			0x6, 0x26, 0xcf, 0xae, 0x0, 0x0, 0xb, 0x9,
+			0x1, 0x0, 0x0, 0x0, 0x91, 0x68, 0x76, 0x63,
+			0x31, 0x0, 0x0, 0xa, 0x1, 0x2, 0x3,
+		},
+	},
 }
 
 func TestReader(t *testing.T) {
@@ -225,3 +318,32 @@ func TestReader(t *testing.T) {
 		})
 	}
 }
+
+func TestReaderSkipZeroLength(t *testing.T) {
+	r := NewReader(bytecounter.NewReader(bytes.NewReader([]byte{
+		// zero-length video message
+		0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x9,
+		0x1, 0x0, 0x0, 0x0,
+		// zero-length audio message
+		0x7, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8,
+		0x1, 0x0, 0x0, 0x0,
+		// acknowledge
+		0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x3,
+		0x0, 0x0, 0x0, 0x0, 0x2, 0xbd, 0x33, 0xb0,
+	})), nil)
+
+	dec, err := r.Read()
+	require.NoError(t, err)
+	require.Equal(t, &MsgAcknowledge{Value: 45953968}, dec)
+}
+
+func TestReaderUnsupportedAudioCodec(t *testing.T) {
+	r := NewReader(bytecounter.NewReader(bytes.NewReader([]byte{
+		// MP3 audio message, whose second byte would be an AAC sequence header
+		0x7, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x8,
+		0x1, 0x0, 0x0, 0x0, 0x2f, 0x0, 0xff, 0xfb,
+	})), nil)
+
+	_, err := r.Read()
+	require.EqualError(t, err, "unsupported audio codec: 2")
+}
@@ -1,29 +1,42 @@
 package message
 
 import (
+	"sync"
+
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/bytecounter"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/rawmessage"
 )
 
 // ReadWriter is a message reader/writer.
+// Read() can be called in a routine that is different from the one that writes,
+// since writes are serialized.
 type ReadWriter struct {
 	r *Reader
 	w *Writer
+
+	wmutex sync.Mutex
 }
 
 // NewReadWriter allocates a ReadWriter.
 func NewReadWriter(bc *bytecounter.ReadWriter, checkAcknowledge bool) *ReadWriter {
-	w := NewWriter(bc.Writer, checkAcknowledge)
+	rw := &ReadWriter{
+		w: NewWriter(bc.Writer, checkAcknowledge),
+	}
 
-	r := NewReader(bc.Reader, func(count uint32) error {
-		return w.Write(&MsgAcknowledge{
+	rw.r = NewReader(bc.Reader, func(count uint32) error {
+		return rw.Write(&MsgAcknowledge{
 			Value: count,
 		})
 	})
 
-	return &ReadWriter{
-		r: r,
-		w: w,
-	}
+	return rw
+}
+
+// SetExtendedTimestampMode sets the convention used to read extended timestamps
+// of type 3 chunks. By default, it is detected in each chunk.
+// It must be called before Read().
+func (rw *ReadWriter) SetExtendedTimestampMode(v rawmessage.ExtendedTimestampMode) {
+	rw.r.SetExtendedTimestampMode(v)
 }
 
 // Read reads a message.
@@ -35,10 +48,12 @@ func (rw *ReadWriter) Read() (Message, error) {
 
 	switch tmsg := msg.(type) {
 	case *MsgAcknowledge:
+		rw.wmutex.Lock()
 		rw.w.SetAcknowledgeValue(tmsg.Value)
+		rw.wmutex.Unlock()
 
 	case *MsgUserControlPingRequest:
-		rw.w.Write(&MsgUserControlPingResponse{
+		rw.Write(&MsgUserControlPingResponse{
 			ServerTime: tmsg.ServerTime,
 		})
 	}
@@ -48,5 +63,22 @@ func (rw *ReadWriter) Read() (Message, error) {
 
 // Write writes a message.
 func (rw *ReadWriter) Write(msg Message) error {
+	rw.wmutex.Lock()
+	defer rw.wmutex.Unlock()
 	return rw.w.Write(msg)
 }
+
+// EncodeToBytes encodes a message, in order to write it to multiple ReadWriters
+// with WriteEncoded().
+func (rw *ReadWriter) EncodeToBytes(msg Message) (*EncodedMessage, error) {
+	rw.wmutex.Lock()
+	defer rw.wmutex.Unlock()
+	return rw.w.EncodeToBytes(msg)
+}
+
+// WriteEncoded writes an encoded message.
+func (rw *ReadWriter) WriteEncoded(em *EncodedMessage) error {
+	rw.wmutex.Lock()
+	defer rw.wmutex.Unlock()
+	return rw.w.WriteEncoded(em)
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"io"
 	"testing"
+	"time"
 
+	"github.com/notedit/rtmp/format/flv/flvio"
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/bytecounter"
@@ -70,3 +72,42 @@ func TestReadWriterPing(t *testing.T) {
 		ServerTime: 143424312,
 	}, msg)
 }
+
+func TestReadWriterExtendedTimestamp(t *testing.T) {
+	var buf1 bytes.Buffer
+	var buf2 bytes.Buffer
+
+	rw1 := NewReadWriter(bytecounter.NewReadWriter(&duplexRW{
+		Reader: &buf2,
+		Writer: &buf1,
+	}), true)
+
+	rw2 := NewReadWriter(bytecounter.NewReadWriter(&duplexRW{
+		Reader: &buf1,
+		Writer: &buf2,
+	}), true)
+
+	// timestamps greater than 0xFFFFFF ms, split into multiple chunks
+	for _, dts := range []time.Duration{
+		5 * time.Hour,
+		5*time.Hour + 40*time.Millisecond,
+		5*time.Hour + 80*time.Millisecond,
+		5*time.Hour + 120*time.Millisecond,
+	} {
+		msg := &MsgVideo{
+			ChunkStreamID:   MsgVideoChunkStreamID,
+			DTS:             dts,
+			MessageStreamID: 0x1000000,
+			IsKeyFrame:      true,
+			H264Type:        flvio.AVC_NALU,
+			Payload:         bytes.Repeat([]byte{0x01}, 1000),
+		}
+
+		err := rw1.Write(msg)
+		require.NoError(t, err)
+
+		dec, err := rw2.Read()
+		require.NoError(t, err)
+		require.Equal(t, msg, dec)
+	}
+}
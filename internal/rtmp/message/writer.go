@@ -1,6 +1,8 @@
 package message
 
 import (
+	"fmt"
+
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/bytecounter"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp/rawmessage"
 )
@@ -22,6 +24,55 @@ func (w *Writer) SetAcknowledgeValue(v uint32) {
 	w.w.SetAcknowledgeValue(v)
 }
 
+// EncodedMessage is a message that has been encoded once,
+// in order to be written to multiple connections without being encoded again.
+// The message stream ID and the chunk stream ID are fixed at encode time,
+// therefore they must match the ones of every connection the message is written to.
+type EncodedMessage struct {
+	msg Message
+	raw *rawmessage.EncodedMessage
+}
+
+// Message returns the message that has been encoded.
+func (em *EncodedMessage) Message() Message {
+	return em.msg
+}
+
+// Bytes returns the encoded message.
+func (em *EncodedMessage) Bytes() []byte {
+	return em.raw.Bytes()
+}
+
+// EncodeToBytes encodes a message with the current chunk size of the Writer.
+// Messages that change the state of the Writer can't be encoded.
+func (w *Writer) EncodeToBytes(msg Message) (*EncodedMessage, error) {
+	switch msg.(type) {
+	case *MsgSetChunkSize, *MsgSetWindowAckSize:
+		return nil, fmt.Errorf("unable to encode a message of type %T", msg)
+	}
+
+	raw, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	em, err := rawmessage.Encode(raw, w.w.ChunkSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedMessage{
+		msg: msg,
+		raw: em,
+	}, nil
+}
+
+// WriteEncoded writes a message encoded by EncodeToBytes(),
+// by this or by another Writer.
+func (w *Writer) WriteEncoded(em *EncodedMessage) error {
+	return w.w.WriteEncoded(em.raw)
+}
+
 // Write writes a message.
 func (w *Writer) Write(msg Message) error {
 	raw, err := msg.Marshal()
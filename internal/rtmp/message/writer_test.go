@@ -20,3 +20,39 @@ func TestWriter(t *testing.T) {
 		})
 	}
 }
+
+func TestWriterEncodeToBytes(t *testing.T) {
+	for _, ca := range readWriterCases {
+		if _, ok := ca.dec.(*MsgSetChunkSize); ok {
+			continue
+		}
+		if _, ok := ca.dec.(*MsgSetWindowAckSize); ok {
+			continue
+		}
+
+		t.Run(ca.name, func(t *testing.T) {
+			var buf1 bytes.Buffer
+			w1 := NewWriter(bytecounter.NewWriter(&buf1), true)
+			em, err := w1.EncodeToBytes(ca.dec)
+			require.NoError(t, err)
+			require.Equal(t, ca.dec, em.Message())
+
+			// the first message of a writer is encoded in the same way
+			require.Equal(t, ca.enc, em.Bytes())
+
+			var buf2 bytes.Buffer
+			w2 := NewWriter(bytecounter.NewWriter(&buf2), true)
+			err = w2.WriteEncoded(em)
+			require.NoError(t, err)
+			require.Equal(t, ca.enc, buf2.Bytes())
+		})
+	}
+}
+
+func TestWriterEncodeToBytesStateful(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(bytecounter.NewWriter(&buf), true)
+
+	_, err := w.EncodeToBytes(&MsgSetChunkSize{Value: 65536})
+	require.EqualError(t, err, "unable to encode a message of type *message.MsgSetChunkSize")
+}
@@ -0,0 +1,27 @@
+package rtmp
+
+import (
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+)
+
+// AVCCToAnnexB converts H264 or H265 NALUs from the AVCC format, used by FLV,
+// into the Annex-B format.
+func AVCCToAnnexB(buf []byte) ([]byte, error) {
+	nalus, err := h264.AVCCUnmarshal(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return h264.AnnexBMarshal(nalus)
+}
+
+// AnnexBToAVCC converts H264 or H265 NALUs from the Annex-B format
+// into the AVCC format, used by FLV.
+func AnnexBToAVCC(buf []byte) ([]byte, error) {
+	nalus, err := h264.AnnexBUnmarshal(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return h264.AVCCMarshal(nalus)
+}
@@ -0,0 +1,27 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAVCCAnnexBConversion(t *testing.T) {
+	avcc := []byte{
+		0x00, 0x00, 0x00, 0x02, 0x09, 0xf0,
+		0x00, 0x00, 0x00, 0x03, 0x65, 0x88, 0x84,
+	}
+
+	annexb := []byte{
+		0x00, 0x00, 0x00, 0x01, 0x09, 0xf0,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84,
+	}
+
+	enc, err := AVCCToAnnexB(avcc)
+	require.NoError(t, err)
+	require.Equal(t, annexb, enc)
+
+	dec, err := AnnexBToAVCC(annexb)
+	require.NoError(t, err)
+	require.Equal(t, avcc, dec)
+}
@@ -0,0 +1,65 @@
+package rtmp
+
+import (
+	"time"
+)
+
+// intervals longer than this are considered timestamp discontinuities.
+const pacerMaxInterval = 1 * time.Second
+
+// pacer releases media messages according to their DTS,
+// relative to a virtual clock that is anchored to the wall clock.
+type pacer struct {
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	started   bool
+	startTime time.Time
+	lastDTS   time.Duration
+}
+
+func newPacer() *pacer {
+	return &pacer{
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// wait blocks until the message with the given DTS can be released.
+// It never blocks for longer than the interval between the given DTS
+// and the DTS of the previous message.
+func (p *pacer) wait(dts time.Duration) {
+	now := p.now()
+
+	if !p.started {
+		p.started = true
+		p.startTime = now.Add(-dts)
+		p.lastDTS = dts
+		return
+	}
+
+	// messages of another track that are behind the clock are released immediately.
+	interval := dts - p.lastDTS
+	if interval <= 0 {
+		return
+	}
+	p.lastDTS = dts
+
+	delay := p.startTime.Add(dts).Sub(now)
+
+	switch {
+	// the source is late, or timestamps jumped:
+	// move the clock forward in order not to accumulate latency.
+	case delay <= 0 || interval > pacerMaxInterval:
+		p.startTime = now.Add(-dts)
+		return
+
+	// the source is ahead of the clock by more than a frame:
+	// move the clock backward in order not to stall the output.
+	case delay > interval:
+		p.startTime = now.Add(interval - dts)
+		delay = interval
+	}
+
+	p.sleep(delay)
+}
@@ -0,0 +1,85 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type pacerTestClock struct {
+	cur    time.Time
+	sleeps []time.Duration
+}
+
+func (c *pacerTestClock) now() time.Time {
+	return c.cur
+}
+
+func (c *pacerTestClock) sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.cur = c.cur.Add(d)
+}
+
+func newTestPacer() (*pacer, *pacerTestClock) {
+	clock := &pacerTestClock{cur: time.Date(2010, 1, 1, 1, 1, 1, 0, time.UTC)}
+	p := newPacer()
+	p.now = clock.now
+	p.sleep = clock.sleep
+	return p, clock
+}
+
+func TestPacerBurst(t *testing.T) {
+	p, clock := newTestPacer()
+
+	// a GOP received at once is released at the frame rate
+	for i := 0; i < 5; i++ {
+		p.wait(time.Duration(i) * 40 * time.Millisecond)
+	}
+
+	require.Equal(t, []time.Duration{
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+	}, clock.sleeps)
+}
+
+func TestPacerLateSource(t *testing.T) {
+	p, clock := newTestPacer()
+
+	p.wait(0)
+
+	// the source stalls, then sends the next frames at once
+	clock.cur = clock.cur.Add(500 * time.Millisecond)
+	p.wait(40 * time.Millisecond)
+	p.wait(80 * time.Millisecond)
+
+	// latency is not accumulated
+	require.Equal(t, []time.Duration{40 * time.Millisecond}, clock.sleeps)
+}
+
+func TestPacerTimestampJump(t *testing.T) {
+	p, clock := newTestPacer()
+
+	p.wait(0)
+	p.wait(10 * time.Second)
+	p.wait(10*time.Second + 40*time.Millisecond)
+
+	// the discontinuity is not waited for
+	require.Equal(t, []time.Duration{40 * time.Millisecond}, clock.sleeps)
+}
+
+func TestPacerInterleavedTracks(t *testing.T) {
+	p, clock := newTestPacer()
+
+	p.wait(0)
+	p.wait(40 * time.Millisecond)
+	p.wait(20 * time.Millisecond)
+	p.wait(80 * time.Millisecond)
+
+	require.Equal(t, []time.Duration{
+		40 * time.Millisecond,
+		40 * time.Millisecond,
+	}, clock.sleeps)
+}
@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+// PlayCommandType is the type of a PlayCommand.
+type PlayCommandType int
+
+// play command types.
+const (
+	PlayCommandSeek PlayCommandType = iota
+	PlayCommandPause
+	PlayCommandResume
+)
+
+// String implements fmt.Stringer.
+func (t PlayCommandType) String() string {
+	switch t {
+	case PlayCommandSeek:
+		return "seek"
+
+	case PlayCommandPause:
+		return "pause"
+
+	case PlayCommandResume:
+		return "resume"
+	}
+
+	return "unknown"
+}
+
+// PlayCommand is a command sent by a play client in order to control
+// the playback of a finite stream.
+type PlayCommand struct {
+	Type PlayCommandType
+
+	// in case of seek, the position to move to;
+	// in case of pause and resume, the position at which the client paused or resumed.
+	Position time.Duration
+}
+
+func parsePlayCommand(cmd *message.MsgCommandAMF0) (*PlayCommand, error) {
+	switch cmd.Name {
+	case "seek":
+		if len(cmd.Arguments) < 2 {
+			return nil, fmt.Errorf("invalid seek command arguments")
+		}
+
+		pos, ok := cmd.Arguments[1].(float64)
+		if !ok || pos < 0 {
+			return nil, fmt.Errorf("invalid seek command arguments")
+		}
+
+		return &PlayCommand{
+			Type:     PlayCommandSeek,
+			Position: time.Duration(pos * float64(time.Millisecond)),
+		}, nil
+
+	case "pause":
+		if len(cmd.Arguments) < 3 {
+			return nil, fmt.Errorf("invalid pause command arguments")
+		}
+
+		pause, ok := cmd.Arguments[1].(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid pause command arguments")
+		}
+
+		pos, ok := cmd.Arguments[2].(float64)
+		if !ok || pos < 0 {
+			return nil, fmt.Errorf("invalid pause command arguments")
+		}
+
+		typ := PlayCommandResume
+		if pause {
+			typ = PlayCommandPause
+		}
+
+		return &PlayCommand{
+			Type:     typ,
+			Position: time.Duration(pos * float64(time.Millisecond)),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (c *Conn) writePlayStatus(commandID int, level string, code string, description string) error {
+	return c.writeCommand(&message.MsgCommandAMF0{
+		ChunkStreamID:   5,
+		MessageStreamID: c.MessageStreamID(),
+		Name:            "onStatus",
+		CommandID:       commandID,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: level},
+				{K: "code", V: code},
+				{K: "description", V: description},
+			},
+		},
+	})
+}
+
+// writePlayCommandResponse notifies the client that a play command has been executed.
+func (c *Conn) writePlayCommandResponse(commandID int, pc *PlayCommand) error {
+	switch pc.Type {
+	case PlayCommandSeek:
+		err := c.writePlayStatus(commandID, "status", "NetStream.Seek.Notify",
+			fmt.Sprintf("seeking to %v", pc.Position))
+		if err != nil {
+			return err
+		}
+
+		return c.writePlayStatus(commandID, "status", "NetStream.Play.Start", "play start")
+
+	case PlayCommandPause:
+		err := c.mrw.Write(&message.MsgUserControlStreamEOF{
+			StreamID: 1,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.writePlayStatus(commandID, "status", "NetStream.Pause.Notify", "paused")
+
+	default:
+		err := c.mrw.Write(&message.MsgUserControlStreamBegin{
+			StreamID: 1,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.writePlayStatus(commandID, "status", "NetStream.Unpause.Notify", "unpaused")
+	}
+}
+
+// writePlayCommandFailure notifies the client that a play command is not supported.
+func (c *Conn) writePlayCommandFailure(commandID int, pc *PlayCommand) error {
+	code := "NetStream.Seek.Failed"
+	if pc.Type != PlayCommandSeek {
+		code = "NetStream.Pause.Failed"
+	}
+
+	return c.writePlayStatus(commandID, "error", code, pc.Type.String()+" is not supported")
+}
+
+// handlePlayCommand processes seek and pause commands.
+func (c *Conn) handlePlayCommand(cmd *message.MsgCommandAMF0) error {
+	pc, err := parsePlayCommand(cmd)
+	if err != nil {
+		c.log(logger.Warn, "%v", err)
+		return nil
+	}
+
+	if pc == nil {
+		return nil
+	}
+
+	if c.onPlayCommand == nil {
+		c.log(logger.Debug, "%s command received but not supported", pc.Type)
+		return c.writePlayCommandFailure(cmd.CommandID, pc)
+	}
+
+	err = c.onPlayCommand(*pc)
+	if err != nil {
+		c.log(logger.Warn, "unable to %s: %v", pc.Type, err)
+		return c.writePlayCommandFailure(cmd.CommandID, pc)
+	}
+
+	return c.writePlayCommandResponse(cmd.CommandID, pc)
+}
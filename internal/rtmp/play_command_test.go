@@ -0,0 +1,221 @@
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+func TestParsePlayCommand(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		cmd  *message.MsgCommandAMF0
+		pc   *PlayCommand
+	}{
+		{
+			"seek",
+			&message.MsgCommandAMF0{
+				Name:      "seek",
+				Arguments: []interface{}{nil, float64(15000)},
+			},
+			&PlayCommand{
+				Type:     PlayCommandSeek,
+				Position: 15 * time.Second,
+			},
+		},
+		{
+			"pause",
+			&message.MsgCommandAMF0{
+				Name:      "pause",
+				Arguments: []interface{}{nil, true, float64(2500)},
+			},
+			&PlayCommand{
+				Type:     PlayCommandPause,
+				Position: 2500 * time.Millisecond,
+			},
+		},
+		{
+			"resume",
+			&message.MsgCommandAMF0{
+				Name:      "pause",
+				Arguments: []interface{}{nil, false, float64(2500)},
+			},
+			&PlayCommand{
+				Type:     PlayCommandResume,
+				Position: 2500 * time.Millisecond,
+			},
+		},
+		{
+			"other command",
+			&message.MsgCommandAMF0{
+				Name:      "deleteStream",
+				Arguments: []interface{}{nil, float64(1)},
+			},
+			nil,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pc, err := parsePlayCommand(ca.cmd)
+			require.NoError(t, err)
+			require.Equal(t, ca.pc, pc)
+		})
+	}
+}
+
+func TestParsePlayCommandErrors(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		cmd  *message.MsgCommandAMF0
+		err  string
+	}{
+		{
+			"seek without position",
+			&message.MsgCommandAMF0{
+				Name:      "seek",
+				Arguments: []interface{}{nil},
+			},
+			"invalid seek command arguments",
+		},
+		{
+			"seek with negative position",
+			&message.MsgCommandAMF0{
+				Name:      "seek",
+				Arguments: []interface{}{nil, float64(-1)},
+			},
+			"invalid seek command arguments",
+		},
+		{
+			"pause without flag",
+			&message.MsgCommandAMF0{
+				Name:      "pause",
+				Arguments: []interface{}{nil, float64(2500), float64(2500)},
+			},
+			"invalid pause command arguments",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			_, err := parsePlayCommand(ca.cmd)
+			require.EqualError(t, err, ca.err)
+		})
+	}
+}
+
+func TestReadMessagePlayCommand(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		var received []PlayCommand
+
+		conn := NewConn(nconn)
+		conn.SetOnPlayCommand(func(pc PlayCommand) error {
+			received = append(received, pc)
+			if pc.Type == PlayCommandResume {
+				return fmt.Errorf("source is not available")
+			}
+			return nil
+		})
+
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		for len(received) != 3 {
+			_, err = conn.ReadMessage()
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, []PlayCommand{
+			{Type: PlayCommandSeek, Position: 10 * time.Second},
+			{Type: PlayCommandPause, Position: 12 * time.Second},
+			{Type: PlayCommandResume, Position: 12 * time.Second},
+		}, received)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.NoError(t, err)
+
+	readStatus := func() (string, string) {
+		for {
+			msg, err := conn.mrw.Read()
+			require.NoError(t, err)
+
+			if cmd, ok := msg.(*message.MsgCommandAMF0); ok && cmd.Name == "onStatus" {
+				ma := cmd.Arguments[1].(flvio.AMFMap)
+				level, _ := ma.GetString("level")
+				code, _ := ma.GetString("code")
+				return level, code
+			}
+		}
+	}
+
+	// skip the statuses sent after the play command
+	for {
+		_, code := readStatus()
+		if code == "NetStream.Play.PublishNotify" {
+			break
+		}
+	}
+
+	for _, ca := range []struct {
+		args  []interface{}
+		codes []string
+		level string
+	}{
+		{
+			[]interface{}{"seek", nil, float64(10000)},
+			[]string{"NetStream.Seek.Notify", "NetStream.Play.Start"},
+			"status",
+		},
+		{
+			[]interface{}{"pause", nil, true, float64(12000)},
+			[]string{"NetStream.Pause.Notify"},
+			"status",
+		},
+		{
+			[]interface{}{"pause", nil, false, float64(12000)},
+			[]string{"NetStream.Pause.Failed"},
+			"error",
+		},
+	} {
+		err = conn.mrw.Write(&message.MsgCommandAMF0{
+			ChunkStreamID:   8,
+			MessageStreamID: 0x1000000,
+			Name:            ca.args[0].(string),
+			CommandID:       0,
+			Arguments:       ca.args[1:],
+		})
+		require.NoError(t, err)
+
+		for _, expectedCode := range ca.codes {
+			level, code := readStatus()
+			require.Equal(t, ca.level, level)
+			require.Equal(t, expectedCode, code)
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,46 @@
+package rtmp
+
+import (
+	"sync"
+)
+
+// PlayLimiter limits the number of concurrent play clients.
+// It can be shared between multiple server-side connections.
+type PlayLimiter struct {
+	max int
+
+	mutex sync.Mutex
+	count int
+}
+
+// NewPlayLimiter allocates a PlayLimiter.
+func NewPlayLimiter(max int) *PlayLimiter {
+	return &PlayLimiter{
+		max: max,
+	}
+}
+
+// Count returns the number of play clients that are currently attached.
+func (l *PlayLimiter) Count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.count
+}
+
+func (l *PlayLimiter) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.count >= l.max {
+		return false
+	}
+
+	l.count++
+	return true
+}
+
+func (l *PlayLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.count--
+}
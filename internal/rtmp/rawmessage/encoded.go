@@ -0,0 +1,71 @@
+package rawmessage
+
+import (
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/chunk"
+)
+
+// EncodedMessage is a Message that has been split into chunks and marshaled once,
+// in order to be written to multiple Writers without being encoded again.
+// Since the first chunk is a type 0 chunk, the encoding doesn't depend
+// on the messages previously written to each Writer.
+type EncodedMessage struct {
+	msg       *Message
+	chunkSize uint32
+	buf       []byte
+}
+
+// Encode encodes a Message with the given chunk size.
+// The Message must not be modified after encoding.
+func Encode(msg *Message, chunkSize uint32) (*EncodedMessage, error) {
+	bodyLen := uint32(len(msg.Body))
+	timestamp := uint32(msg.Timestamp / time.Millisecond)
+
+	firstLen := bodyLen
+	if firstLen > chunkSize {
+		firstLen = chunkSize
+	}
+
+	buf, err := chunk.Chunk0{
+		ChunkStreamID:   msg.ChunkStreamID,
+		Timestamp:       timestamp,
+		Type:            msg.Type,
+		MessageStreamID: msg.MessageStreamID,
+		BodyLen:         bodyLen,
+		Body:            msg.Body[:firstLen],
+	}.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	for pos := firstLen; pos < bodyLen; pos += chunkSize {
+		end := pos + chunkSize
+		if end > bodyLen {
+			end = bodyLen
+		}
+
+		cbuf, err := chunk.Chunk3{
+			ChunkStreamID:        msg.ChunkStreamID,
+			HasExtendedTimestamp: chunk.HasExtendedTimestamp(timestamp),
+			ExtendedTimestamp:    timestamp,
+			Body:                 msg.Body[pos:end],
+		}.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, cbuf...)
+	}
+
+	return &EncodedMessage{
+		msg:       msg,
+		chunkSize: chunkSize,
+		buf:       buf,
+	}, nil
+}
+
+// Bytes returns the encoded message.
+func (m *EncodedMessage) Bytes() []byte {
+	return m.buf
+}
@@ -2,6 +2,7 @@ package rawmessage
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"time"
@@ -12,6 +13,25 @@ import (
 
 var errMoreChunksNeeded = errors.New("more chunks are needed")
 
+// ExtendedTimestampMode is the convention used to read type 3 chunks
+// that follow a chunk with an extended timestamp.
+// The specification is ambiguous on whether the extended timestamp
+// is repeated in type 3 chunks, and encoders disagree.
+type ExtendedTimestampMode int
+
+// extended timestamp modes.
+const (
+	// the extended timestamp is detected in each type 3 chunk,
+	// by comparing it with the timestamp of the message.
+	ExtendedTimestampModeAuto ExtendedTimestampMode = iota
+
+	// the extended timestamp is always repeated in type 3 chunks.
+	ExtendedTimestampModePresent
+
+	// the extended timestamp is never repeated in type 3 chunks.
+	ExtendedTimestampModeAbsent
+)
+
 type readerChunkStream struct {
 	mr                 *Reader
 	curTimestamp       *uint32
@@ -20,6 +40,38 @@ type readerChunkStream struct {
 	curBodyLen         *uint32
 	curBody            []byte
 	curTimestampDelta  *uint32
+
+	// whether the last type 0, 1 or 2 chunk contained an extended timestamp,
+	// that can be repeated in the following type 3 chunks, and its value.
+	curHasExtendedTimestamp bool
+	curExtendedTimestamp    uint32
+}
+
+// type3HasExtendedTimestamp checks whether the next type 3 chunk contains an extended timestamp.
+// timestamp is the timestamp of the message the chunk belongs to.
+func (rc *readerChunkStream) type3HasExtendedTimestamp(timestamp uint32) (bool, error) {
+	if !rc.curHasExtendedTimestamp {
+		return false, nil
+	}
+
+	switch rc.mr.extendedTimestampMode {
+	case ExtendedTimestampModePresent:
+		return true, nil
+
+	case ExtendedTimestampModeAbsent:
+		return false, nil
+	}
+
+	// some encoders repeat the value of the preceding header,
+	// others the timestamp of the message.
+	// If the body starts with a different value, the field is absent.
+	buf, err := rc.mr.br.Peek(5)
+	if err != nil {
+		return false, err
+	}
+
+	v := binary.BigEndian.Uint32(buf[1:])
+	return v == rc.curExtendedTimestamp || v == timestamp, nil
 }
 
 func (rc *readerChunkStream) readChunk(c chunk.Chunk, chunkBodySize uint32) error {
@@ -67,6 +119,8 @@ func (rc *readerChunkStream) readMessage(typ byte) (*Message, error) {
 		v4 := rc.mr.c0.BodyLen
 		rc.curBodyLen = &v4
 		rc.curTimestampDelta = nil
+		rc.curHasExtendedTimestamp = chunk.HasExtendedTimestamp(rc.mr.c0.Timestamp)
+		rc.curExtendedTimestamp = rc.mr.c0.Timestamp
 
 		if rc.mr.c0.BodyLen != uint32(len(rc.mr.c0.Body)) {
 			rc.curBody = rc.mr.c0.Body
@@ -101,6 +155,8 @@ func (rc *readerChunkStream) readMessage(typ byte) (*Message, error) {
 		rc.curBodyLen = &v4
 		v5 := rc.mr.c1.TimestampDelta
 		rc.curTimestampDelta = &v5
+		rc.curHasExtendedTimestamp = chunk.HasExtendedTimestamp(rc.mr.c1.TimestampDelta)
+		rc.curExtendedTimestamp = rc.mr.c1.TimestampDelta
 
 		if rc.mr.c1.BodyLen != uint32(len(rc.mr.c1.Body)) {
 			rc.curBody = rc.mr.c1.Body
@@ -136,6 +192,8 @@ func (rc *readerChunkStream) readMessage(typ byte) (*Message, error) {
 		rc.curTimestamp = &v1
 		v2 := rc.mr.c2.TimestampDelta
 		rc.curTimestampDelta = &v2
+		rc.curHasExtendedTimestamp = chunk.HasExtendedTimestamp(rc.mr.c2.TimestampDelta)
+		rc.curExtendedTimestamp = rc.mr.c2.TimestampDelta
 
 		if *rc.curBodyLen != uint32(len(rc.mr.c2.Body)) {
 			rc.curBody = rc.mr.c2.Body
@@ -159,7 +217,13 @@ func (rc *readerChunkStream) readMessage(typ byte) (*Message, error) {
 				chunkBodyLen = rc.mr.chunkSize
 			}
 
-			err := rc.readChunk(&rc.mr.c3, chunkBodyLen)
+			var err error
+			rc.mr.c3.HasExtendedTimestamp, err = rc.type3HasExtendedTimestamp(*rc.curTimestamp)
+			if err != nil {
+				return nil, err
+			}
+
+			err = rc.readChunk(&rc.mr.c3, chunkBodyLen)
 			if err != nil {
 				return nil, err
 			}
@@ -185,12 +249,19 @@ func (rc *readerChunkStream) readMessage(typ byte) (*Message, error) {
 			chunkBodyLen = rc.mr.chunkSize
 		}
 
-		err := rc.readChunk(&rc.mr.c3, chunkBodyLen)
+		v1 := *rc.curTimestamp + *rc.curTimestampDelta
+
+		var err error
+		rc.mr.c3.HasExtendedTimestamp, err = rc.type3HasExtendedTimestamp(v1)
+		if err != nil {
+			return nil, err
+		}
+
+		err = rc.readChunk(&rc.mr.c3, chunkBodyLen)
 		if err != nil {
 			return nil, err
 		}
 
-		v1 := *rc.curTimestamp + *rc.curTimestampDelta
 		rc.curTimestamp = &v1
 
 		if *rc.curBodyLen != uint32(len(rc.mr.c3.Body)) {
@@ -211,16 +282,17 @@ type Reader struct {
 	r           *bytecounter.Reader
 	onAckNeeded func(uint32) error
 
-	br            *bufio.Reader
-	chunkSize     uint32
-	ackWindowSize uint32
-	lastAckCount  uint32
-	msg           Message
-	c0            chunk.Chunk0
-	c1            chunk.Chunk1
-	c2            chunk.Chunk2
-	c3            chunk.Chunk3
-	chunkStreams  map[byte]*readerChunkStream
+	br                    *bufio.Reader
+	chunkSize             uint32
+	ackWindowSize         uint32
+	extendedTimestampMode ExtendedTimestampMode
+	lastAckCount          uint32
+	msg                   Message
+	c0                    chunk.Chunk0
+	c1                    chunk.Chunk1
+	c2                    chunk.Chunk2
+	c3                    chunk.Chunk3
+	chunkStreams          map[byte]*readerChunkStream
 }
 
 // NewReader allocates a Reader.
@@ -246,6 +318,12 @@ func (r *Reader) SetWindowAckSize(v uint32) {
 	r.ackWindowSize = v
 }
 
+// SetExtendedTimestampMode sets the convention used to read extended timestamps
+// of type 3 chunks. The default is ExtendedTimestampModeAuto.
+func (r *Reader) SetExtendedTimestampMode(v ExtendedTimestampMode) {
+	r.extendedTimestampMode = v
+}
+
 // Read reads a Message.
 func (r *Reader) Read() (*Message, error) {
 	for {
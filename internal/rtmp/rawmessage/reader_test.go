@@ -192,6 +192,56 @@ var cases = []struct {
 			64,
 		},
 	},
+	{
+		"(chunk0 + chunk3) + (chunk2 + chunk3) with extended timestamp",
+		[]*Message{
+			{
+				ChunkStreamID:   6,
+				Timestamp:       0x1000000 * time.Millisecond,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				Body:            bytes.Repeat([]byte{0x03}, 190),
+			},
+			{
+				ChunkStreamID:   6,
+				Timestamp:       (0x1000000 + 40) * time.Millisecond,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				Body:            bytes.Repeat([]byte{0x04}, 190),
+			},
+		},
+		[]chunk.Chunk{
+			&chunk.Chunk0{
+				ChunkStreamID:   6,
+				Timestamp:       0x1000000,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				BodyLen:         190,
+				Body:            bytes.Repeat([]byte{0x03}, 128),
+			},
+			&chunk.Chunk3{
+				ChunkStreamID:        6,
+				HasExtendedTimestamp: true,
+				ExtendedTimestamp:    0x1000000,
+				Body:                 bytes.Repeat([]byte{0x03}, 62),
+			},
+			&chunk.Chunk2{
+				ChunkStreamID:  6,
+				TimestampDelta: 40,
+				Body:           bytes.Repeat([]byte{0x04}, 128),
+			},
+			&chunk.Chunk3{
+				ChunkStreamID: 6,
+				Body:          bytes.Repeat([]byte{0x04}, 62),
+			},
+		},
+		[]uint32{
+			128,
+			62,
+			128,
+			62,
+		},
+	},
 }
 
 func TestReader(t *testing.T) {
@@ -255,3 +305,187 @@ func TestReaderAcknowledge(t *testing.T) {
 		})
 	}
 }
+
+func TestReaderExtendedTimestampType3(t *testing.T) {
+	// a body that starts with the same bytes of the extended timestamp
+	ambiguousBody := append([]byte{0x01, 0x00, 0x00, 0x00}, bytes.Repeat([]byte{0x03}, 186)...)
+
+	for _, ca := range []struct {
+		name     string
+		mode     ExtendedTimestampMode
+		messages []*Message
+		chunks   []chunk.Chunk
+	}{
+		{
+			"auto, present",
+			ExtendedTimestampModeAuto,
+			[]*Message{{
+				ChunkStreamID:   6,
+				Timestamp:       0x1000000 * time.Millisecond,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				Body:            bytes.Repeat([]byte{0x03}, 190),
+			}},
+			[]chunk.Chunk{
+				&chunk.Chunk0{
+					ChunkStreamID:   6,
+					Timestamp:       0x1000000,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					BodyLen:         190,
+					Body:            bytes.Repeat([]byte{0x03}, 128),
+				},
+				&chunk.Chunk3{
+					ChunkStreamID:        6,
+					HasExtendedTimestamp: true,
+					ExtendedTimestamp:    0x1000000,
+					Body:                 bytes.Repeat([]byte{0x03}, 62),
+				},
+			},
+		},
+		{
+			"auto, absent",
+			ExtendedTimestampModeAuto,
+			[]*Message{{
+				ChunkStreamID:   6,
+				Timestamp:       0x1000000 * time.Millisecond,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				Body:            bytes.Repeat([]byte{0x03}, 190),
+			}},
+			[]chunk.Chunk{
+				&chunk.Chunk0{
+					ChunkStreamID:   6,
+					Timestamp:       0x1000000,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					BodyLen:         190,
+					Body:            bytes.Repeat([]byte{0x03}, 128),
+				},
+				&chunk.Chunk3{
+					ChunkStreamID: 6,
+					Body:          bytes.Repeat([]byte{0x03}, 62),
+				},
+			},
+		},
+		{
+			"auto, absolute timestamp after delta",
+			ExtendedTimestampModeAuto,
+			[]*Message{
+				{
+					ChunkStreamID:   6,
+					Timestamp:       0x1000000 * time.Millisecond,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					Body:            bytes.Repeat([]byte{0x03}, 190),
+				},
+				{
+					ChunkStreamID:   6,
+					Timestamp:       0x2000000 * time.Millisecond,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					Body:            bytes.Repeat([]byte{0x04}, 190),
+				},
+			},
+			[]chunk.Chunk{
+				&chunk.Chunk0{
+					ChunkStreamID:   6,
+					Timestamp:       0x1000000,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					BodyLen:         190,
+					Body:            bytes.Repeat([]byte{0x03}, 128),
+				},
+				&chunk.Chunk3{
+					ChunkStreamID:        6,
+					HasExtendedTimestamp: true,
+					ExtendedTimestamp:    0x1000000,
+					Body:                 bytes.Repeat([]byte{0x03}, 62),
+				},
+				&chunk.Chunk2{
+					ChunkStreamID:  6,
+					TimestampDelta: 0x1000000,
+					Body:           bytes.Repeat([]byte{0x04}, 128),
+				},
+				&chunk.Chunk3{
+					ChunkStreamID:        6,
+					HasExtendedTimestamp: true,
+					ExtendedTimestamp:    0x2000000,
+					Body:                 bytes.Repeat([]byte{0x04}, 62),
+				},
+			},
+		},
+		{
+			"absent, ambiguous body",
+			ExtendedTimestampModeAbsent,
+			[]*Message{{
+				ChunkStreamID:   6,
+				Timestamp:       0x1000000 * time.Millisecond,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				Body:            append(bytes.Repeat([]byte{0x03}, 128), ambiguousBody[:62]...),
+			}},
+			[]chunk.Chunk{
+				&chunk.Chunk0{
+					ChunkStreamID:   6,
+					Timestamp:       0x1000000,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					BodyLen:         190,
+					Body:            bytes.Repeat([]byte{0x03}, 128),
+				},
+				&chunk.Chunk3{
+					ChunkStreamID: 6,
+					Body:          ambiguousBody[:62],
+				},
+			},
+		},
+		{
+			"present",
+			ExtendedTimestampModePresent,
+			[]*Message{{
+				ChunkStreamID:   6,
+				Timestamp:       0x1000000 * time.Millisecond,
+				Type:            chunk.MessageTypeVideo,
+				MessageStreamID: 1,
+				Body:            bytes.Repeat([]byte{0x03}, 190),
+			}},
+			[]chunk.Chunk{
+				&chunk.Chunk0{
+					ChunkStreamID:   6,
+					Timestamp:       0x1000000,
+					Type:            chunk.MessageTypeVideo,
+					MessageStreamID: 1,
+					BodyLen:         190,
+					Body:            bytes.Repeat([]byte{0x03}, 128),
+				},
+				&chunk.Chunk3{
+					ChunkStreamID:        6,
+					HasExtendedTimestamp: true,
+					ExtendedTimestamp:    0x1234,
+					Body:                 bytes.Repeat([]byte{0x03}, 62),
+				},
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r := NewReader(bytecounter.NewReader(&buf), func(count uint32) error {
+				return nil
+			})
+			r.SetExtendedTimestampMode(ca.mode)
+
+			for _, cach := range ca.chunks {
+				buf2, err := cach.Marshal()
+				require.NoError(t, err)
+				buf.Write(buf2)
+			}
+
+			for _, camsg := range ca.messages {
+				msg, err := r.Read()
+				require.NoError(t, err)
+				require.Equal(t, camsg, msg)
+			}
+		})
+	}
+}
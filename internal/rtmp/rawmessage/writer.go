@@ -13,18 +13,14 @@ type writerChunkStream struct {
 	lastMessageStreamID *uint32
 	lastType            *chunk.MessageType
 	lastBodyLen         *uint32
-	lastTimestamp       *time.Duration
-	lastTimestampDelta  *time.Duration
+	lastTimestamp       *uint32
+	lastTimestampDelta  *uint32
 }
 
 func (wc *writerChunkStream) writeChunk(c chunk.Chunk) error {
-	// check if we received an acknowledge
-	if wc.mw.checkAcknowledge && wc.mw.ackWindowSize != 0 {
-		diff := uint32(wc.mw.w.Count()) - wc.mw.ackValue
-
-		if diff > (wc.mw.ackWindowSize * 3 / 2) {
-			return fmt.Errorf("no acknowledge received within window")
-		}
+	err := wc.mw.checkAcknowledgeWindow()
+	if err != nil {
+		return err
 	}
 
 	buf, err := c.Marshal()
@@ -45,12 +41,23 @@ func (wc *writerChunkStream) writeMessage(msg *Message) error {
 	pos := uint32(0)
 	firstChunk := true
 
-	var timestampDelta *time.Duration
-	if wc.lastTimestamp != nil {
-		diff := msg.Timestamp - *wc.lastTimestamp
+	// timestamp or timestamp delta of the first chunk,
+	// whose extended form must be repeated in the following type 3 chunks.
+	var headerTimestamp uint32
+
+	// whether the first chunk is a type 0 chunk.
+	isType0 := false
+
+	// deltas are computed between timestamps in milliseconds, that are the ones
+	// reconstructed by the receiver, otherwise the sub-millisecond part of timestamps
+	// (i.e. of audio frames) is lost at every message and timestamps drift.
+	timestamp := uint32(msg.Timestamp / time.Millisecond)
 
+	var timestampDelta *uint32
+	if wc.lastTimestamp != nil {
 		// use delta only if it is positive
-		if diff >= 0 {
+		if timestamp >= *wc.lastTimestamp {
+			diff := timestamp - *wc.lastTimestamp
 			timestampDelta = &diff
 		}
 	}
@@ -66,9 +73,11 @@ func (wc *writerChunkStream) writeMessage(msg *Message) error {
 
 			switch {
 			case wc.lastMessageStreamID == nil || timestampDelta == nil || *wc.lastMessageStreamID != msg.MessageStreamID:
+				isType0 = true
+				headerTimestamp = timestamp
 				err := wc.writeChunk(&chunk.Chunk0{
 					ChunkStreamID:   msg.ChunkStreamID,
-					Timestamp:       uint32(msg.Timestamp / time.Millisecond),
+					Timestamp:       headerTimestamp,
 					Type:            msg.Type,
 					MessageStreamID: msg.MessageStreamID,
 					BodyLen:         (bodyLen),
@@ -79,9 +88,10 @@ func (wc *writerChunkStream) writeMessage(msg *Message) error {
 				}
 
 			case *wc.lastType != msg.Type || *wc.lastBodyLen != bodyLen:
+				headerTimestamp = *timestampDelta
 				err := wc.writeChunk(&chunk.Chunk1{
 					ChunkStreamID:  msg.ChunkStreamID,
-					TimestampDelta: uint32(*timestampDelta / time.Millisecond),
+					TimestampDelta: headerTimestamp,
 					Type:           msg.Type,
 					BodyLen:        (bodyLen),
 					Body:           msg.Body[pos : pos+chunkBodyLen],
@@ -91,9 +101,10 @@ func (wc *writerChunkStream) writeMessage(msg *Message) error {
 				}
 
 			case wc.lastTimestampDelta == nil || *wc.lastTimestampDelta != *timestampDelta:
+				headerTimestamp = *timestampDelta
 				err := wc.writeChunk(&chunk.Chunk2{
 					ChunkStreamID:  msg.ChunkStreamID,
-					TimestampDelta: uint32(*timestampDelta / time.Millisecond),
+					TimestampDelta: headerTimestamp,
 					Body:           msg.Body[pos : pos+chunkBodyLen],
 				})
 				if err != nil {
@@ -101,9 +112,12 @@ func (wc *writerChunkStream) writeMessage(msg *Message) error {
 				}
 
 			default:
+				headerTimestamp = *timestampDelta
 				err := wc.writeChunk(&chunk.Chunk3{
-					ChunkStreamID: msg.ChunkStreamID,
-					Body:          msg.Body[pos : pos+chunkBodyLen],
+					ChunkStreamID:        msg.ChunkStreamID,
+					HasExtendedTimestamp: chunk.HasExtendedTimestamp(headerTimestamp),
+					ExtendedTimestamp:    headerTimestamp,
+					Body:                 msg.Body[pos : pos+chunkBodyLen],
 				})
 				if err != nil {
 					return err
@@ -116,17 +130,23 @@ func (wc *writerChunkStream) writeMessage(msg *Message) error {
 			wc.lastType = &v2
 			v3 := bodyLen
 			wc.lastBodyLen = &v3
-			v4 := msg.Timestamp
+			v4 := timestamp
 			wc.lastTimestamp = &v4
 
-			if timestampDelta != nil {
+			// the timestamp delta is unknown to the receiver after a type 0 chunk,
+			// therefore the next message can't use a type 3 chunk.
+			if isType0 {
+				wc.lastTimestampDelta = nil
+			} else {
 				v5 := *timestampDelta
 				wc.lastTimestampDelta = &v5
 			}
 		} else {
 			err := wc.writeChunk(&chunk.Chunk3{
-				ChunkStreamID: msg.ChunkStreamID,
-				Body:          msg.Body[pos : pos+chunkBodyLen],
+				ChunkStreamID:        msg.ChunkStreamID,
+				HasExtendedTimestamp: chunk.HasExtendedTimestamp(headerTimestamp),
+				ExtendedTimestamp:    headerTimestamp,
+				Body:                 msg.Body[pos : pos+chunkBodyLen],
 			})
 			if err != nil {
 				return err
@@ -166,6 +186,11 @@ func (w *Writer) SetChunkSize(v uint32) {
 	w.chunkSize = v
 }
 
+// ChunkSize returns the maximum chunk size.
+func (w *Writer) ChunkSize() uint32 {
+	return w.chunkSize
+}
+
 // SetWindowAckSize sets the window acknowledgement size.
 func (w *Writer) SetWindowAckSize(v uint32) {
 	w.ackWindowSize = v
@@ -176,13 +201,63 @@ func (w *Writer) SetAcknowledgeValue(v uint32) {
 	w.ackValue = v
 }
 
-// Write writes a Message.
-func (w *Writer) Write(msg *Message) error {
-	wc, ok := w.chunkStreams[msg.ChunkStreamID]
+// checkAcknowledgeWindow checks if we received an acknowledge.
+func (w *Writer) checkAcknowledgeWindow() error {
+	if w.checkAcknowledge && w.ackWindowSize != 0 {
+		diff := uint32(w.w.Count()) - w.ackValue
+
+		if diff > (w.ackWindowSize * 3 / 2) {
+			return fmt.Errorf("no acknowledge received within window")
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) chunkStream(id byte) *writerChunkStream {
+	wc, ok := w.chunkStreams[id]
 	if !ok {
 		wc = &writerChunkStream{mw: w}
-		w.chunkStreams[msg.ChunkStreamID] = wc
+		w.chunkStreams[id] = wc
+	}
+	return wc
+}
+
+// Write writes a Message.
+func (w *Writer) Write(msg *Message) error {
+	return w.chunkStream(msg.ChunkStreamID).writeMessage(msg)
+}
+
+// WriteEncoded writes an EncodedMessage.
+// If the message has been encoded with a chunk size that is different
+// from the one of the Writer, it is encoded again.
+func (w *Writer) WriteEncoded(em *EncodedMessage) error {
+	if em.chunkSize != w.chunkSize {
+		return w.Write(em.msg)
 	}
 
-	return wc.writeMessage(msg)
+	err := w.checkAcknowledgeWindow()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(em.buf)
+	if err != nil {
+		return err
+	}
+
+	// the next message of the chunk stream can be compressed with respect to this one.
+	// The timestamp delta is unknown after a type 0 chunk.
+	wc := w.chunkStream(em.msg.ChunkStreamID)
+	v1 := em.msg.MessageStreamID
+	wc.lastMessageStreamID = &v1
+	v2 := em.msg.Type
+	wc.lastType = &v2
+	v3 := uint32(len(em.msg.Body))
+	wc.lastBodyLen = &v3
+	v4 := uint32(em.msg.Timestamp / time.Millisecond)
+	wc.lastTimestamp = &v4
+	wc.lastTimestampDelta = nil
+
+	return nil
 }
@@ -24,6 +24,9 @@ func TestWriter(t *testing.T) {
 
 			for i, cach := range ca.chunks {
 				ch := reflect.New(reflect.TypeOf(cach).Elem()).Interface().(chunk.Chunk)
+				if c3, ok := cach.(*chunk.Chunk3); ok {
+					ch.(*chunk.Chunk3).HasExtendedTimestamp = c3.HasExtendedTimestamp
+				}
 				err := ch.Read(&buf, ca.chunkSizes[i])
 				require.NoError(t, err)
 				require.Equal(t, cach, ch)
@@ -67,3 +70,168 @@ func TestWriterAcknowledge(t *testing.T) {
 		})
 	}
 }
+
+func TestWriterEncoded(t *testing.T) {
+	msgs := []*Message{
+		{
+			ChunkStreamID:   6,
+			Timestamp:       100 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 0x1000000,
+			Body:            bytes.Repeat([]byte{0x01}, 300),
+		},
+		{
+			ChunkStreamID:   6,
+			Timestamp:       140 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 0x1000000,
+			Body:            bytes.Repeat([]byte{0x02}, 300),
+		},
+		{
+			ChunkStreamID:   6,
+			Timestamp:       180 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 0x1000000,
+			Body:            bytes.Repeat([]byte{0x03}, 300),
+		},
+		{
+			ChunkStreamID:   6,
+			Timestamp:       220 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 0x1000000,
+			Body:            bytes.Repeat([]byte{0x04}, 300),
+		},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(bytecounter.NewWriter(&buf), true)
+
+	err := w.Write(msgs[0])
+	require.NoError(t, err)
+
+	em, err := Encode(msgs[1], 128)
+	require.NoError(t, err)
+	err = w.WriteEncoded(em)
+	require.NoError(t, err)
+
+	err = w.Write(msgs[2])
+	require.NoError(t, err)
+
+	// the chunk size is different: the message is encoded again
+	em, err = Encode(msgs[3], 65536)
+	require.NoError(t, err)
+	err = w.WriteEncoded(em)
+	require.NoError(t, err)
+
+	r := NewReader(bytecounter.NewReader(&buf), func(count uint32) error {
+		return nil
+	})
+
+	for _, msg := range msgs {
+		dec, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, msg, dec)
+	}
+}
+
+func TestWriterTimestampDeltas(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(bytecounter.NewWriter(&buf), true)
+
+	// AAC frames at 44100Hz last 23.219ms, therefore timestamps are not multiples of a millisecond.
+	var msgs []*Message
+	for i := 0; i < 100; i++ {
+		msgs = append(msgs, &Message{
+			ChunkStreamID:   4,
+			Timestamp:       time.Duration(i) * 1024 * time.Second / 44100,
+			Type:            chunk.MessageTypeAudio,
+			MessageStreamID: 0x1000000,
+			Body:            bytes.Repeat([]byte{byte(i)}, 16),
+		})
+	}
+
+	for _, msg := range msgs {
+		err := w.Write(msg)
+		require.NoError(t, err)
+	}
+
+	// a header is written for every message: 12 bytes for the first one,
+	// 4 bytes when the delta changes, 1 byte when the delta is repeated.
+	require.Less(t, buf.Len(), 12+16+99*(4+16))
+
+	r := NewReader(bytecounter.NewReader(&buf), func(count uint32) error {
+		return nil
+	})
+
+	for _, msg := range msgs {
+		dec, err := r.Read()
+		require.NoError(t, err)
+		require.Equal(t, msg.Timestamp/time.Millisecond*time.Millisecond, dec.Timestamp)
+		require.Equal(t, msg.Body, dec.Body)
+	}
+}
+
+func TestWriterMessageStreamIDChange(t *testing.T) {
+	msgs := []*Message{
+		{
+			ChunkStreamID:   6,
+			Timestamp:       100 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 1,
+			Body:            bytes.Repeat([]byte{0x01}, 64),
+		},
+		{
+			ChunkStreamID:   6,
+			Timestamp:       140 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 2,
+			Body:            bytes.Repeat([]byte{0x02}, 64),
+		},
+		{
+			ChunkStreamID:   6,
+			Timestamp:       180 * time.Millisecond,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 2,
+			Body:            bytes.Repeat([]byte{0x03}, 64),
+		},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(bytecounter.NewWriter(&buf), true)
+
+	for _, msg := range msgs {
+		err := w.Write(msg)
+		require.NoError(t, err)
+	}
+
+	// the delta is not known by the receiver after the type 0 chunk,
+	// therefore it is sent again with a type 2 chunk.
+	for i, cach := range []chunk.Chunk{
+		&chunk.Chunk0{
+			ChunkStreamID:   6,
+			Timestamp:       100,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 1,
+			BodyLen:         64,
+			Body:            bytes.Repeat([]byte{0x01}, 64),
+		},
+		&chunk.Chunk0{
+			ChunkStreamID:   6,
+			Timestamp:       140,
+			Type:            chunk.MessageTypeVideo,
+			MessageStreamID: 2,
+			BodyLen:         64,
+			Body:            bytes.Repeat([]byte{0x02}, 64),
+		},
+		&chunk.Chunk2{
+			ChunkStreamID:  6,
+			TimestampDelta: 40,
+			Body:           bytes.Repeat([]byte{0x03}, 64),
+		},
+	} {
+		ch := reflect.New(reflect.TypeOf(cach).Elem()).Interface().(chunk.Chunk)
+		err := ch.Read(&buf, []uint32{128, 128, 64}[i])
+		require.NoError(t, err)
+		require.Equal(t, cach, ch)
+	}
+}
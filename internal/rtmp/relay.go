@@ -0,0 +1,211 @@
+package rtmp
+
+import (
+	"time"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+// distance between the last timestamp written before a reconnection
+// and the first timestamp written after it.
+const relayTimelineGap = time.Millisecond
+
+// RelayTimeline keeps the timestamps written by RelayWithTimeline() monotonically increasing
+// across multiple calls, when the destination connection is re-established after a failure.
+// It also stores the metadata and the decoder configurations received from the source,
+// that are written again to the new destination, since the source doesn't send them twice.
+// Its zero value is ready to use. It must be used by a single routine.
+type RelayTimeline struct {
+	baseDTS time.Duration
+	offset  time.Duration
+	written bool
+	lastDTS time.Duration
+
+	metadata    []interface{}
+	videoConfig *message.MsgVideo
+	audioConfig *message.MsgAudio
+}
+
+// begin starts a session, whose first media message has the given DTS.
+// The session continues from the last timestamp written by the previous one.
+func (tl *RelayTimeline) begin(dts time.Duration) {
+	tl.baseDTS = dts
+
+	if tl.written {
+		tl.offset = tl.lastDTS + relayTimelineGap
+	}
+}
+
+// rebase shifts a DTS in order to make the first session start near zero.
+func (tl *RelayTimeline) rebase(dts time.Duration) time.Duration {
+	dts -= tl.baseDTS
+	if dts < 0 {
+		dts = 0
+	}
+	dts += tl.offset
+
+	if !tl.written || dts > tl.lastDTS {
+		tl.written = true
+		tl.lastDTS = dts
+	}
+
+	return dts
+}
+
+// relay contains the state of a Relay() call.
+type relay struct {
+	dst      *Conn
+	timeline *RelayTimeline
+	started  bool
+}
+
+func (r *relay) writeMetadata(payload []interface{}) error {
+	return r.dst.WriteMessage(&message.MsgDataAMF0{
+		ChunkStreamID:   4,
+		MessageStreamID: r.dst.MessageStreamID(),
+		Payload:         append([]interface{}{"@setDataFrame", "onMetaData"}, payload...),
+	})
+}
+
+func (r *relay) writeVideo(msg *message.MsgVideo) error {
+	out := *msg
+	out.ChunkStreamID = r.dst.VideoChunkStreamID()
+	out.MessageStreamID = r.dst.MessageStreamID()
+	out.DTS = r.timeline.rebase(msg.DTS)
+	return r.dst.WriteMessage(&out)
+}
+
+func (r *relay) writeAudio(msg *message.MsgAudio) error {
+	out := *msg
+	out.ChunkStreamID = r.dst.AudioChunkStreamID()
+	out.MessageStreamID = r.dst.MessageStreamID()
+	out.DTS = r.timeline.rebase(msg.DTS)
+	return r.dst.WriteMessage(&out)
+}
+
+// start writes the metadata and the decoder configurations received so far,
+// including the ones received by previous calls with the same timeline, before the first media message.
+// Decoder configurations are written with the DTS of the first media message,
+// since the stored ones may belong to a previous session.
+func (r *relay) start(dts time.Duration) error {
+	r.started = true
+	r.timeline.begin(dts)
+
+	if r.timeline.metadata != nil {
+		err := r.writeMetadata(r.timeline.metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.timeline.videoConfig != nil {
+		conf := *r.timeline.videoConfig
+		conf.DTS = dts
+		err := r.writeVideo(&conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.timeline.audioConfig != nil {
+		conf := *r.timeline.audioConfig
+		conf.DTS = dts
+		err := r.writeAudio(&conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *relay) process(msg message.Message) error {
+	if payload, ok := metadataPayload(msg); ok {
+		r.timeline.metadata = payload
+
+		if !r.started {
+			return nil
+		}
+		return r.writeMetadata(payload)
+	}
+
+	switch tmsg := msg.(type) {
+	case *message.MsgVideo:
+		if tmsg.H264Type == flvio.AVC_SEQHDR {
+			r.timeline.videoConfig = tmsg
+
+			if !r.started {
+				return nil
+			}
+			return r.writeVideo(tmsg)
+		}
+
+		if !r.started {
+			err := r.start(tmsg.DTS)
+			if err != nil {
+				return err
+			}
+		}
+
+		return r.writeVideo(tmsg)
+
+	case *message.MsgAudio:
+		if tmsg.AACType == flvio.AAC_SEQHDR {
+			r.timeline.audioConfig = tmsg
+
+			if !r.started {
+				return nil
+			}
+			return r.writeAudio(tmsg)
+		}
+
+		if !r.started {
+			err := r.start(tmsg.DTS)
+			if err != nil {
+				return err
+			}
+		}
+
+		return r.writeAudio(tmsg)
+	}
+
+	// other messages (commands, control messages, ...) are specific
+	// to the source connection and are not forwarded.
+	return nil
+}
+
+// Relay reads the stream of src and writes it to dst verbatim, until an error occurs.
+// src must be a connection that is ready to provide media messages
+// (a publishing connection after InitializeServer() or a reading connection after InitializeClient()),
+// whose tracks have not been read yet. dst must be a publishing connection.
+// The metadata and the decoder configurations are stored and written to dst
+// before the first video or audio message, in this order, regardless of the order in which
+// they're received. Timestamps are rebased in order to make the stream start near zero.
+func Relay(src *Conn, dst *Conn) error {
+	return RelayWithTimeline(src, dst, &RelayTimeline{})
+}
+
+// RelayWithTimeline is like Relay(), but timestamps are rebased through the given timeline.
+// When dst is re-established after a failure, passing the same timeline to the following call
+// makes timestamps continue from the last ones written, instead of restarting from zero,
+// since destination servers usually reject timestamps that go backwards.
+func RelayWithTimeline(src *Conn, dst *Conn, timeline *RelayTimeline) error {
+	r := &relay{
+		dst:      dst,
+		timeline: timeline,
+	}
+
+	for {
+		msg, err := src.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		err = r.process(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
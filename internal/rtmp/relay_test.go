@@ -0,0 +1,345 @@
+package rtmp
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/mpeg4audio"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/bytecounter"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/h264conf"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+func TestRelay(t *testing.T) {
+	videoConfig, err := h264conf.Conf{
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS: []byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+	}.Marshal()
+	require.NoError(t, err)
+
+	audioConfig, err := mpeg4audio.Config{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Marshal()
+	require.NoError(t, err)
+
+	metadata := flvio.AMFMap{
+		{K: "videocodecid", V: float64(codecH264)},
+		{K: "audiocodecid", V: float64(codecAAC)},
+	}
+
+	srcLn, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer srcLn.Close()
+
+	dstLn, err := net.Listen("tcp", "127.0.0.1:9122")
+	require.NoError(t, err)
+	defer dstLn.Close()
+
+	publisherDone := make(chan struct{})
+
+	go func() {
+		defer close(publisherDone)
+
+		u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+		require.NoError(t, err)
+
+		nconn, err := net.Dial("tcp", u.Host)
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		err = conn.InitializeClient(u, true)
+		require.NoError(t, err)
+
+		// decoder configurations precede the metadata,
+		// timestamps don't start from zero.
+		for _, msg := range []message.Message{
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				DTS:             10 * time.Second,
+				Payload:         videoConfig,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+				DTS:             10 * time.Second,
+				Payload:         audioConfig,
+			},
+			&message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					metadata,
+				},
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_NALU,
+				DTS:             10 * time.Second,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x01, 0x05},
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_RAW,
+				DTS:             10*time.Second + 20*time.Millisecond,
+				Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+			},
+		} {
+			err = conn.WriteMessage(msg)
+			require.NoError(t, err)
+		}
+	}()
+
+	receiverDone := make(chan struct{})
+
+	go func() {
+		defer close(receiverDone)
+
+		nconn, err := dstLn.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		conn := NewConn(nconn)
+		_, _, err = conn.InitializeServer()
+		require.NoError(t, err)
+
+		for _, expected := range []message.Message{
+			&message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					metadata,
+				},
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				Payload:         videoConfig,
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_SEQHDR,
+				Payload:         audioConfig,
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_NALU,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x01, 0x05},
+			},
+			&message.MsgAudio{
+				ChunkStreamID:   message.MsgAudioChunkStreamID,
+				MessageStreamID: 0x1000000,
+				Rate:            flvio.SOUND_44Khz,
+				Depth:           flvio.SOUND_16BIT,
+				Channels:        flvio.SOUND_STEREO,
+				AACType:         flvio.AAC_RAW,
+				DTS:             20 * time.Millisecond,
+				Payload:         []byte{0x01, 0x02, 0x03, 0x04},
+			},
+		} {
+			msg, err := conn.ReadMessage()
+			require.NoError(t, err)
+			require.Equal(t, expected, msg)
+		}
+	}()
+
+	srcConn, err := srcLn.Accept()
+	require.NoError(t, err)
+	defer srcConn.Close()
+
+	src := NewConn(srcConn)
+	_, _, err = src.InitializeServer()
+	require.NoError(t, err)
+
+	u, err := url.Parse("rtmp://127.0.0.1:9122/stream")
+	require.NoError(t, err)
+
+	dstConn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer dstConn.Close()
+
+	dst := NewConn(dstConn)
+	err = dst.InitializeClient(u, true)
+	require.NoError(t, err)
+
+	// Relay() returns when the publisher disconnects
+	err = Relay(src, dst)
+	require.Error(t, err)
+
+	<-publisherDone
+	<-receiverDone
+}
+
+func TestRelayTimeline(t *testing.T) {
+	var tl RelayTimeline
+
+	tl.begin(10 * time.Second)
+	require.Equal(t, time.Duration(0), tl.rebase(10*time.Second))
+	require.Equal(t, 40*time.Millisecond, tl.rebase(10*time.Second+40*time.Millisecond))
+	require.Equal(t, time.Duration(0), tl.rebase(9*time.Second))
+
+	// after a reconnection, the source timestamps restart from an arbitrary value
+	tl.begin(2 * time.Second)
+	require.Equal(t, 41*time.Millisecond, tl.rebase(2*time.Second))
+	require.Equal(t, 81*time.Millisecond, tl.rebase(2*time.Second+40*time.Millisecond))
+
+	tl.begin(30 * time.Second)
+	require.Equal(t, 82*time.Millisecond, tl.rebase(30*time.Second))
+}
+
+func TestRelayDestinationReconnection(t *testing.T) {
+	videoConfig, err := h264conf.Conf{
+		SPS: []byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		PPS: []byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+	}.Marshal()
+	require.NoError(t, err)
+
+	metadata := flvio.AMFMap{
+		{K: "videocodecid", V: float64(codecH264)},
+	}
+
+	var tl RelayTimeline
+
+	// the source keeps sending the same stream, while the destination is replaced.
+	for i, src := range [][]message.Message{
+		{
+			&message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					metadata,
+				},
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				DTS:             10 * time.Second,
+				Payload:         videoConfig,
+			},
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_NALU,
+				DTS:             10 * time.Second,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x01, 0x05},
+			},
+		},
+		{
+			// the source is mid-stream and doesn't send the decoder configuration again
+			&message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				H264Type:        flvio.AVC_NALU,
+				DTS:             12 * time.Second,
+				Payload:         []byte{0x00, 0x00, 0x00, 0x01, 0x01},
+			},
+		},
+	} {
+		dstConn, readerConn := net.Pipe()
+
+		readerDone := make(chan struct{})
+
+		go func() {
+			defer close(readerDone)
+
+			mrw := message.NewReadWriter(bytecounter.NewReadWriter(readerConn), false)
+
+			msg, err := mrw.Read()
+			require.NoError(t, err)
+			require.Equal(t, &message.MsgDataAMF0{
+				ChunkStreamID:   4,
+				MessageStreamID: 0x1000000,
+				Payload: []interface{}{
+					"@setDataFrame",
+					"onMetaData",
+					metadata,
+				},
+			}, msg)
+
+			msg, err = mrw.Read()
+			require.NoError(t, err)
+			require.Equal(t, &message.MsgVideo{
+				ChunkStreamID:   message.MsgVideoChunkStreamID,
+				MessageStreamID: 0x1000000,
+				IsKeyFrame:      true,
+				H264Type:        flvio.AVC_SEQHDR,
+				DTS:             time.Duration(i) * time.Millisecond,
+				Payload:         videoConfig,
+			}, msg)
+
+			// timestamps continue from the ones written to the previous destination
+			expected := *src[len(src)-1].(*message.MsgVideo)
+			expected.DTS = time.Duration(i) * time.Millisecond
+
+			msg, err = mrw.Read()
+			require.NoError(t, err)
+			require.Equal(t, &expected, msg)
+		}()
+
+		dst := NewConn(dstConn)
+		dst.mrw = message.NewReadWriter(dst.bc, false)
+
+		r := &relay{
+			dst:      dst,
+			timeline: &tl,
+		}
+
+		for _, msg := range src {
+			err := r.process(msg)
+			require.NoError(t, err)
+		}
+
+		<-readerDone
+		dstConn.Close()
+		readerConn.Close()
+	}
+}
@@ -0,0 +1,65 @@
+package rtmp
+
+import (
+	"net"
+)
+
+// default size of the send buffer.
+// It allows to store a GOP of a 8 Mbit/s stream with a keyframe every second,
+// in order not to block the writer when the GOP is sent at once.
+const defaultTCPWriteBufferSize = 1024 * 1024
+
+// TCPOptions contains settings of the TCP socket that transports a Conn.
+// Since a Conn doesn't own the socket, these have to be applied by the caller
+// before the connection is initialized.
+type TCPOptions struct {
+	// disable Nagle's algorithm.
+	// Nagle's algorithm delays small packets, like audio messages
+	// and chunks that close a message, adding up to 40ms of latency.
+	NoDelay bool
+
+	// size of the kernel send buffer.
+	// If zero, the operating system default is kept.
+	WriteBufferSize int
+}
+
+// DefaultTCPOptions returns the recommended settings for RTMP connections.
+func DefaultTCPOptions() TCPOptions {
+	return TCPOptions{
+		NoDelay:         true,
+		WriteBufferSize: defaultTCPWriteBufferSize,
+	}
+}
+
+// Apply applies the options to a connection.
+// TLS connections are supported; connections that are not backed
+// by a TCP socket are left untouched.
+func (o TCPOptions) Apply(conn net.Conn) error {
+	if tconn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tconn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	err := tcpConn.SetNoDelay(o.NoDelay)
+	if err != nil {
+		return err
+	}
+
+	if o.WriteBufferSize != 0 {
+		err = tcpConn.SetWriteBuffer(o.WriteBufferSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConfigureTCP applies the recommended settings to a connection.
+func ConfigureTCP(conn net.Conn) error {
+	return DefaultTCPOptions().Apply(conn)
+}
@@ -0,0 +1,45 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		nconn, err := ln.Accept()
+		require.NoError(t, err)
+		defer nconn.Close()
+
+		err = ConfigureTCP(nconn)
+		require.NoError(t, err)
+	}()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	err = ConfigureTCP(nconn)
+	require.NoError(t, err)
+
+	<-done
+}
+
+func TestConfigureTCPNotTCP(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+
+	err := ConfigureTCP(conn1)
+	require.NoError(t, err)
+}
@@ -0,0 +1,94 @@
+package rtmp
+
+import (
+	"time"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+type timestampCorrectorTrack struct {
+	isVideo bool
+	trackID uint8
+}
+
+// timestampCorrector prevents the DTS of each track from going backward,
+// since some encoders produce timestamps that jump slightly back because of clock glitches,
+// while muxers require monotonic timestamps.
+// Frames whose DTS is lower than the one of the previous frame of the same track
+// are given the DTS of the previous frame.
+type timestampCorrector struct {
+	warnThreshold time.Duration
+	log           func(logger.Level, string, ...interface{})
+
+	prevDTS map[timestampCorrectorTrack]time.Duration
+}
+
+func newTimestampCorrector(
+	warnThreshold time.Duration,
+	log func(logger.Level, string, ...interface{}),
+) *timestampCorrector {
+	return &timestampCorrector{
+		warnThreshold: warnThreshold,
+		log:           log,
+		prevDTS:       make(map[timestampCorrectorTrack]time.Duration),
+	}
+}
+
+// correct returns the DTS to use in place of the given one.
+func (c *timestampCorrector) correct(track timestampCorrectorTrack, dts time.Duration) time.Duration {
+	prev, ok := c.prevDTS[track]
+	if !ok || dts >= prev {
+		c.prevDTS[track] = dts
+		return dts
+	}
+
+	if (prev - dts) > c.warnThreshold {
+		name := "audio"
+		if track.isVideo {
+			name = "video"
+		}
+		c.log(logger.Warn, "DTS of the %s track went backward by %v, correcting it", name, prev-dts)
+	}
+
+	return prev
+}
+
+// videoIsCodedFrame checks whether a video message contains a frame.
+func videoIsCodedFrame(msg *message.MsgVideo) bool {
+	return msg.H264Type == flvio.AVC_NALU ||
+		(msg.FourCC != 0 && msg.H264Type == message.VideoPacketTypeCodedFramesX)
+}
+
+// process corrects the DTS of a video or audio message.
+// Sequence headers are not processed, since they don't contain frames.
+func (c *timestampCorrector) process(msg message.Message) {
+	switch tmsg := msg.(type) {
+	case *message.MsgVideo:
+		if !videoIsCodedFrame(tmsg) {
+			return
+		}
+
+		dts := c.correct(timestampCorrectorTrack{isVideo: true}, tmsg.DTS)
+
+		// preserve the PTS when possible, since it can't precede the DTS.
+		if dts != tmsg.DTS {
+			diff := dts - tmsg.DTS
+			if tmsg.PTSDelta > diff {
+				tmsg.PTSDelta -= diff
+			} else {
+				tmsg.PTSDelta = 0
+			}
+			tmsg.DTS = dts
+		}
+
+	case *message.MsgAudio:
+		if tmsg.AACType != flvio.AAC_RAW {
+			return
+		}
+
+		tmsg.DTS = c.correct(timestampCorrectorTrack{trackID: tmsg.TrackID}, tmsg.DTS)
+	}
+}
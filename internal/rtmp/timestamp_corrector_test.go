@@ -0,0 +1,152 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp/message"
+)
+
+func TestTimestampCorrector(t *testing.T) {
+	var warnings []string
+
+	c := newTimestampCorrector(50*time.Millisecond, func(level logger.Level, format string, args ...interface{}) {
+		require.Equal(t, logger.Warn, level)
+		warnings = append(warnings, format)
+	})
+
+	var videoDTS []time.Duration
+	var audioDTS []time.Duration
+
+	for _, ca := range []struct {
+		video bool
+		dts   time.Duration
+	}{
+		{true, 0},
+		{false, 0},
+		{true, 33 * time.Millisecond},
+		{false, 23 * time.Millisecond},
+		{true, 66 * time.Millisecond},
+		{false, 46 * time.Millisecond},
+		{true, 50 * time.Millisecond}, // backward, below the threshold
+		{false, 20 * time.Millisecond},
+		{true, 100 * time.Millisecond},
+		{false, 69 * time.Millisecond},
+		{true, 0}, // backward, above the threshold
+		{true, 133 * time.Millisecond},
+	} {
+		if ca.video {
+			msg := &message.MsgVideo{
+				H264Type: flvio.AVC_NALU,
+				DTS:      ca.dts,
+			}
+			c.process(msg)
+			videoDTS = append(videoDTS, msg.DTS)
+		} else {
+			msg := &message.MsgAudio{
+				AACType: flvio.AAC_RAW,
+				DTS:     ca.dts,
+			}
+			c.process(msg)
+			audioDTS = append(audioDTS, msg.DTS)
+		}
+	}
+
+	require.Equal(t, []time.Duration{
+		0,
+		33 * time.Millisecond,
+		66 * time.Millisecond,
+		66 * time.Millisecond,
+		100 * time.Millisecond,
+		100 * time.Millisecond,
+		133 * time.Millisecond,
+	}, videoDTS)
+
+	require.Equal(t, []time.Duration{
+		0,
+		23 * time.Millisecond,
+		46 * time.Millisecond,
+		46 * time.Millisecond,
+		69 * time.Millisecond,
+	}, audioDTS)
+
+	require.Equal(t, 1, len(warnings))
+}
+
+func TestTimestampCorrectorPTS(t *testing.T) {
+	c := newTimestampCorrector(time.Second, nil)
+
+	c.process(&message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      100 * time.Millisecond,
+	})
+
+	// the PTS is preserved
+	msg := &message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      90 * time.Millisecond,
+		PTSDelta: 66 * time.Millisecond,
+	}
+	c.process(msg)
+	require.Equal(t, 100*time.Millisecond, msg.DTS)
+	require.Equal(t, 56*time.Millisecond, msg.PTSDelta)
+
+	// the PTS can't precede the DTS
+	msg = &message.MsgVideo{
+		H264Type: flvio.AVC_NALU,
+		DTS:      80 * time.Millisecond,
+		PTSDelta: 10 * time.Millisecond,
+	}
+	c.process(msg)
+	require.Equal(t, 100*time.Millisecond, msg.DTS)
+	require.Equal(t, time.Duration(0), msg.PTSDelta)
+
+	// sequence headers are not corrected
+	msg = &message.MsgVideo{
+		H264Type: flvio.AVC_SEQHDR,
+		DTS:      0,
+	}
+	c.process(msg)
+	require.Equal(t, time.Duration(0), msg.DTS)
+}
+
+func TestTimestampCorrectorHEVC(t *testing.T) {
+	c := newTimestampCorrector(time.Second, nil)
+
+	for _, ca := range []struct {
+		name       string
+		packetType uint8
+	}{
+		{"coded frames", 1},
+		{"coded frames x", message.VideoPacketTypeCodedFramesX},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			c.process(&message.MsgVideo{
+				FourCC:   message.FourCCHEVC,
+				H264Type: ca.packetType,
+				DTS:      100 * time.Millisecond,
+			})
+
+			msg := &message.MsgVideo{
+				FourCC:   message.FourCCHEVC,
+				H264Type: ca.packetType,
+				DTS:      90 * time.Millisecond,
+			}
+			c.process(msg)
+			require.Equal(t, 100*time.Millisecond, msg.DTS)
+		})
+	}
+
+	// sequence starts are not corrected
+	msg := &message.MsgVideo{
+		FourCC:   message.FourCCHEVC,
+		H264Type: 0,
+		DTS:      0,
+	}
+	c.process(msg)
+	require.Equal(t, time.Duration(0), msg.DTS)
+}